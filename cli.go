@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost"
+)
+
+// Subcommands that run instead of the bridge. They take the same flags as the bridge, e.g.
+// `mautrix-mattermost doctor -c config.yaml`.
+const (
+	cmdDoctor               = "doctor"
+	cmdMigrateDB            = "migrate-db"
+	cmdGenerateRegistration = "generate-registration"
+)
+
+// popSubcommand removes the subcommand from the arguments, so that the flag parser only
+// sees the flags
+func popSubcommand() string {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		return ""
+	}
+	command := os.Args[1]
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	return command
+}
+
+// runSubcommand runs a subcommand and exits. It returns if there is no subcommand.
+func (br *MattermostBridge) runSubcommand(command string, connector *mattermost.MattermostConnector) {
+	switch command {
+	case "":
+		return
+	case cmdDoctor:
+		br.PreInit()
+		br.Init()
+		os.Exit(br.doctor(connector))
+	case cmdMigrateDB:
+		br.PreInit()
+		br.Init()
+		os.Exit(br.migrateDB(connector))
+	case cmdGenerateRegistration:
+		br.PreInit()
+		fmt.Println(mattermost.SlashCommandSetup(br.Config.AppService.Address))
+		// Saves the registration and exits
+		br.GenerateRegistration()
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "Unknown command %q, expected %s, %s or %s\n", command, cmdDoctor, cmdMigrateDB, cmdGenerateRegistration)
+		os.Exit(1)
+	}
+}
+
+// doctor runs the connectivity and permission checks and prints the results. The exit
+// code is 1 if any check failed.
+func (br *MattermostBridge) doctor(connector *mattermost.MattermostConnector) int {
+	ctx := br.Log.WithContext(context.Background())
+	homeserver := mattermost.DoctorCheck{Name: "Homeserver", Status: mattermost.DoctorOK, Detail: "reachable at " + br.Config.Homeserver.Address}
+	if _, err := br.Matrix.Bot.Versions(ctx); err != nil {
+		homeserver.Status, homeserver.Detail = mattermost.DoctorFail, err.Error()
+	}
+	exitCode := 0
+	for _, check := range append([]mattermost.DoctorCheck{homeserver}, connector.Doctor(ctx)...) {
+		fmt.Println(check)
+		if check.Status == mattermost.DoctorFail {
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
+
+// migrateDB upgrades the database of the bridge and of the connector without starting them
+func (br *MattermostBridge) migrateDB(connector *mattermost.MattermostConnector) int {
+	ctx := br.Log.WithContext(context.Background())
+	if err := br.DB.Upgrade(ctx); err != nil {
+		br.Log.Err(err).Msg("Failed to upgrade bridge database")
+		return 1
+	}
+	if err := connector.MigrateDB(ctx); err != nil {
+		br.Log.Err(err).Msg("Failed to upgrade Mattermost database")
+		return 1
+	}
+	br.Log.Info().Msg("Database is up to date")
+	return 0
+}
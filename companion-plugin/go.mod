@@ -0,0 +1,5 @@
+module github.com/hanthor/mattermost-matrix-bridge/companion-plugin
+
+go 1.24
+
+require github.com/mattermost/mattermost/server/public v0.1.20
@@ -0,0 +1,233 @@
+// Command plugin is a Mattermost plugin that runs next to the Matrix bridge. It forwards
+// posts and reactions to the bridge in the same format as WebSocket events, and creates
+// users and access tokens for the bridge, which would otherwise need a system admin token.
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// secretHeader authenticates requests in both directions
+const secretHeader = "X-Bridge-Secret"
+
+// eventQueueSize is how many events are buffered while the bridge is slow or unreachable
+const eventQueueSize = 1024
+
+// The bridge's ghost users have usernames starting with ghostUsernamePrefix, and newer ones
+// also have the Matrix user they were created for in the ghostMXIDProp prop. Users and
+// tokens are only created for them.
+const (
+	ghostUsernamePrefix = "mx."
+	ghostMXIDProp       = "matrix_mxid"
+)
+
+type configuration struct {
+	BridgeURL string
+	Secret    string
+}
+
+type Plugin struct {
+	plugin.MattermostPlugin
+
+	configLock sync.RWMutex
+	config     configuration
+
+	events     chan *model.WebSocketEvent
+	stop       chan struct{}
+	httpClient *http.Client
+}
+
+func (p *Plugin) getConfig() configuration {
+	p.configLock.RLock()
+	defer p.configLock.RUnlock()
+	return p.config
+}
+
+func (p *Plugin) OnConfigurationChange() error {
+	var cfg configuration
+	if err := p.API.LoadPluginConfiguration(&cfg); err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	p.configLock.Lock()
+	p.config = cfg
+	p.configLock.Unlock()
+	return nil
+}
+
+func (p *Plugin) OnActivate() error {
+	p.events = make(chan *model.WebSocketEvent, eventQueueSize)
+	p.stop = make(chan struct{})
+	p.httpClient = &http.Client{Timeout: 30 * time.Second}
+	go p.forwardEvents()
+	return nil
+}
+
+func (p *Plugin) OnDeactivate() error {
+	close(p.stop)
+	return nil
+}
+
+// forwardEvents sends queued events to the bridge one at a time, so that they arrive in order
+func (p *Plugin) forwardEvents() {
+	for {
+		select {
+		case <-p.stop:
+			return
+		case evt := <-p.events:
+			p.forward(evt)
+		}
+	}
+}
+
+func (p *Plugin) forward(evt *model.WebSocketEvent) {
+	cfg := p.getConfig()
+	if cfg.BridgeURL == "" || cfg.Secret == "" {
+		return
+	}
+	body, err := evt.ToJSON()
+	if err != nil {
+		p.API.LogError("Failed to serialize event", "error", err.Error())
+		return
+	}
+	// Retry a few times in case the bridge is restarting
+	for attempt := range 3 {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+		req, err := http.NewRequest(http.MethodPost, strings.TrimRight(cfg.BridgeURL, "/")+"/mattermost/companion/events", bytes.NewReader(body))
+		if err != nil {
+			p.API.LogError("Failed to create request", "error", err.Error())
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(secretHeader, cfg.Secret)
+		resp, err := p.httpClient.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode < 500 {
+				if resp.StatusCode >= 300 {
+					p.API.LogWarn("Bridge rejected event", "status", resp.StatusCode, "event", string(evt.EventType()))
+				}
+				return
+			}
+			err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		p.API.LogWarn("Failed to forward event to bridge", "error", err.Error(), "attempt", attempt+1)
+	}
+}
+
+// queue adds an event to the forwarding queue, dropping it if the queue is full
+func (p *Plugin) queue(eventType model.WebsocketEventType, channelID, key string, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		p.API.LogError("Failed to serialize event data", "error", err.Error())
+		return
+	}
+	evt := model.NewWebSocketEvent(eventType, "", channelID, "", nil, "")
+	evt.Add(key, string(data))
+	select {
+	case p.events <- evt:
+	default:
+		p.API.LogWarn("Event queue is full, dropping event", "event", string(eventType), "channel_id", channelID)
+	}
+}
+
+func (p *Plugin) MessageHasBeenPosted(_ *plugin.Context, post *model.Post) {
+	p.queue(model.WebsocketEventPosted, post.ChannelId, "post", post)
+}
+
+func (p *Plugin) MessageHasBeenUpdated(_ *plugin.Context, newPost, _ *model.Post) {
+	p.queue(model.WebsocketEventPostEdited, newPost.ChannelId, "post", newPost)
+}
+
+func (p *Plugin) MessageHasBeenDeleted(_ *plugin.Context, post *model.Post) {
+	p.queue(model.WebsocketEventPostDeleted, post.ChannelId, "post", post)
+}
+
+func (p *Plugin) ReactionHasBeenAdded(_ *plugin.Context, reaction *model.Reaction) {
+	p.queue(model.WebsocketEventReactionAdded, reaction.ChannelId, "reaction", reaction)
+}
+
+func (p *Plugin) ReactionHasBeenRemoved(_ *plugin.Context, reaction *model.Reaction) {
+	p.queue(model.WebsocketEventReactionRemoved, reaction.ChannelId, "reaction", reaction)
+}
+
+// ServeHTTP handles the actions the bridge calls at /plugins/<id>/actions/<action>
+func (p *Plugin) ServeHTTP(_ *plugin.Context, w http.ResponseWriter, r *http.Request) {
+	secret := p.getConfig().Secret
+	if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(secretHeader)), []byte(secret)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	} else if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var resp any
+	var appErr *model.AppError
+	switch r.URL.Path {
+	case "/actions/create_user":
+		var user model.User
+		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if !isGhost(&user) {
+			http.Error(w, "Only ghost users can be created", http.StatusForbidden)
+			return
+		}
+		// Ghosts are always regular users, whatever roles the request asked for
+		user.Roles = model.SystemUserRoleId
+		resp, appErr = p.API.CreateUser(&user)
+	case "/actions/create_token":
+		var token model.UserAccessToken
+		if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		var user *model.User
+		if user, appErr = p.API.GetUser(token.UserId); appErr != nil {
+			break
+		} else if !isGhost(user) || user.IsBot || user.IsSystemAdmin() {
+			p.API.LogWarn("Refused to create access token for a user that isn't a ghost", "user_id", user.Id, "username", user.Username)
+			http.Error(w, "Tokens can only be created for ghost users", http.StatusForbidden)
+			return
+		}
+		var created *model.UserAccessToken
+		if created, appErr = p.API.CreateUserAccessToken(&token); appErr == nil {
+			p.API.LogInfo("Created access token for the bridge", "user_id", user.Id, "username", user.Username, "token_id", created.Id)
+			resp = created
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if appErr != nil {
+		status := appErr.StatusCode
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		http.Error(w, appErr.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// isGhost checks whether a user is one of the bridge's ghost users
+func isGhost(user *model.User) bool {
+	return strings.HasPrefix(user.Username, ghostUsernamePrefix) || user.Props[ghostMXIDProp] != ""
+}
+
+func main() {
+	plugin.ClientMain(&Plugin{})
+}
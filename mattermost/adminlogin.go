@@ -0,0 +1,72 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrNoAdminLoginOwner is returned when there's no Matrix user to log in the admin token for
+var ErrNoAdminLoginOwner = errors.New("no Matrix user to own the login of the admin token, set admin_login_owner or give a user admin permissions in the bridge config")
+
+// adminLoginOwner returns the Matrix user who owns the login of the admin token: the one set
+// in admin_login_owner, or else the first user with admin permissions in the bridge config.
+// Permissions given to whole servers or everyone don't count.
+func (m *MattermostConnector) adminLoginOwner() (id.UserID, error) {
+	if owner := id.UserID(m.config().AdminLoginOwner); owner != "" {
+		if _, _, err := owner.Parse(); err != nil {
+			return "", fmt.Errorf("invalid admin_login_owner: %w", err)
+		}
+		return owner, nil
+	}
+	var admins []id.UserID
+	for key, perms := range m.Bridge.Config.Permissions {
+		userID := id.UserID(key)
+		if _, _, err := userID.Parse(); err == nil && perms != nil && perms.Admin {
+			admins = append(admins, userID)
+		}
+	}
+	if len(admins) == 0 {
+		return "", ErrNoAdminLoginOwner
+	}
+	slices.Sort(admins)
+	return admins[0], nil
+}
+
+// provisionAdminLogin logs in the admin token for its owner and connects the login, so that
+// a fresh bridge works before anyone logs in themselves
+func (m *MattermostConnector) provisionAdminLogin(ctx context.Context) (*bridgev2.UserLogin, error) {
+	owner, err := m.adminLoginOwner()
+	if err != nil {
+		return nil, err
+	}
+	me, resp, err := m.Client.GetMe(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get admin user: %w", wrapMattermostError(resp, err))
+	}
+	user, err := m.Bridge.GetUserByMXID(ctx, owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user %s: %w", owner, err)
+	}
+	login, err := user.NewLogin(ctx, &database.UserLogin{
+		ID:         networkid.UserLoginID(me.Username),
+		RemoteName: me.Username,
+		Metadata: map[string]any{
+			"token": m.config().AdminToken,
+			"mm_id": me.Id,
+		},
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save login: %w", err)
+	}
+	if err = login.Client.Connect(login.Log.WithContext(ctx)); err != nil {
+		return login, fmt.Errorf("failed to connect login: %w", err)
+	}
+	return login, nil
+}
@@ -0,0 +1,43 @@
+package mattermost
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestAdminLoginOwner(t *testing.T) {
+	permissions := bridgeconfig.PermissionConfig{
+		"*":                  &bridgeconfig.PermissionLevelRelay,
+		"example.com":        &bridgeconfig.PermissionLevelAdmin,
+		"@zoe:example.com":   &bridgeconfig.PermissionLevelAdmin,
+		"@bob:example.com":   &bridgeconfig.PermissionLevelAdmin,
+		"@alice:example.com": &bridgeconfig.PermissionLevelUser,
+	}
+	m := &MattermostConnector{
+		Bridge: &bridgev2.Bridge{Config: &bridgeconfig.BridgeConfig{Permissions: permissions}},
+		Config: &NetworkConfig{},
+	}
+
+	// The first admin user is picked, servers and users without admin rights are skipped
+	owner, err := m.adminLoginOwner()
+	assert.NoError(t, err)
+	assert.Equal(t, id.UserID("@bob:example.com"), owner)
+
+	m.config().AdminLoginOwner = "@alice:example.com"
+	owner, err = m.adminLoginOwner()
+	assert.NoError(t, err)
+	assert.Equal(t, id.UserID("@alice:example.com"), owner)
+
+	m.config().AdminLoginOwner = "alice"
+	_, err = m.adminLoginOwner()
+	assert.ErrorContains(t, err, "invalid admin_login_owner")
+
+	m.config().AdminLoginOwner = ""
+	m.Bridge.Config.Permissions = bridgeconfig.PermissionConfig{"example.com": &bridgeconfig.PermissionLevelAdmin}
+	_, err = m.adminLoginOwner()
+	assert.ErrorIs(t, err, ErrNoAdminLoginOwner)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.mau.fi/util/ptr"
@@ -12,33 +13,34 @@ import (
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/event"
 
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/msgconv"
 	"github.com/mattermost/mattermost/server/public/model"
 )
 
 type MattermostAPI struct {
 	Login     *bridgev2.UserLogin
 	Connector *MattermostConnector
-	Client    *Client
+	// client is replaced when the login gets a new token, while events are being handled
+	client atomic.Pointer[Client]
+	// tokenInvalid is set while Mattermost rejects the token of the login
+	tokenInvalid atomic.Bool
 }
 
-func (m *MattermostAPI) getMMID(ctx context.Context, ghostID networkid.UserID) string {
-	// Try metadata first
-	ghost, err := m.Connector.Bridge.GetGhostByID(ctx, ghostID)
-	if err == nil && ghost != nil && ghost.Metadata != nil {
-		if meta, ok := ghost.Metadata.(map[string]any); ok {
-			if id, _ := meta["mm_id"].(string); id != "" {
-				return id
-			}
-		}
-	}
+// newMattermostAPI returns the network API of a login that uses a client
+func newMattermostAPI(login *bridgev2.UserLogin, connector *MattermostConnector, client *Client) *MattermostAPI {
+	api := &MattermostAPI{Login: login, Connector: connector}
+	api.client.Store(client)
+	return api
+}
 
-	// Fallback to EnsureGhost which guarantees a UUID or error
-	mmID, err := m.Connector.EnsureGhost(ctx, string(ghostID))
-	if err != nil {
-		m.Connector.Bridge.Log.Warn().Err(err).Str("ghost_id", string(ghostID)).Msg("Failed to resolve MM ID for ghost")
-		return ""
-	}
-	return mmID
+// Client returns the client that the login currently uses
+func (m *MattermostAPI) Client() *Client {
+	return m.client.Load()
+}
+
+// setClient switches the login to another client, for example one with a new token
+func (m *MattermostAPI) setClient(client *Client) {
+	m.client.Store(client)
 }
 
 func (m *MattermostAPI) getOwnMMID() string {
@@ -57,15 +59,27 @@ func (m *MattermostAPI) getOwnMMID() string {
 }
 
 func (m *MattermostAPI) GetClient() *model.Client4 {
-	return m.Client.GetClient()
+	return m.Client().GetClient()
 }
 
 func (m *MattermostAPI) GetFile(ctx context.Context, fileID string) ([]byte, error) {
-	return m.Client.GetFile(ctx, fileID)
+	return m.Client().GetFile(ctx, fileID)
+}
+
+func (m *MattermostAPI) GetFileInfo(ctx context.Context, fileID string) (*model.FileInfo, error) {
+	return m.Client().GetFileInfo(ctx, fileID)
+}
+
+func (m *MattermostAPI) GetFileWithInfo(ctx context.Context, fileID string) ([]byte, *model.FileInfo, error) {
+	return m.Client().GetFileWithInfo(ctx, fileID)
+}
+
+func (m *MattermostAPI) GetFileThumbnail(ctx context.Context, fileID string) ([]byte, error) {
+	return m.Client().GetFileThumbnail(ctx, fileID)
 }
 
 func (m *MattermostAPI) UploadFile(ctx context.Context, data []byte, channelID, filename string) (*model.FileInfo, error) {
-	return m.Client.UploadFile(ctx, data, channelID, filename)
+	return m.Client().UploadFile(ctx, data, channelID, filename)
 }
 
 func (m *MattermostAPI) Connect(ctx context.Context) error {
@@ -74,7 +88,7 @@ func (m *MattermostAPI) Connect(ctx context.Context) error {
 	}
 
 	// Fetch our own user details to resolve UUID
-	user, _, err := m.Client.GetMe(ctx, "")
+	user, _, err := m.Client().GetMe(ctx, "")
 	if err != nil {
 		return fmt.Errorf("failed to get own user details: %w", err)
 	}
@@ -101,6 +115,17 @@ func (m *MattermostAPI) Connect(ctx context.Context) error {
 		}
 	}
 
+	m.setupDoublePuppet(ctx)
+	if meta["bot"] != true {
+		go func() {
+			if err := m.syncChats(ctx); err != nil {
+				m.Login.Log.Warn().Err(err).Msg("Failed to sync direct and group messages")
+			}
+			if err := m.syncSidebarTags(m.Login.Log.WithContext(ctx)); err != nil {
+				m.Login.Log.Warn().Err(err).Msg("Failed to sync sidebar category tags")
+			}
+		}()
+	}
 	return nil
 }
 
@@ -108,47 +133,75 @@ func (m *MattermostAPI) Disconnect() {
 }
 
 func (m *MattermostAPI) IsConnected() bool {
-	return m.Client != nil
+	return m.Client() != nil
 }
 
+// GetCapabilities tells the bridge which Matrix features can be bridged to Mattermost.
+// Mattermost has no replies outside threads, so the bridge turns replies into threads.
 func (m *MattermostAPI) GetCapabilities(ctx context.Context, portal *bridgev2.Portal) *bridgev2.NetworkRoomCapabilities {
 	return &bridgev2.NetworkRoomCapabilities{
-		FormattedText: true,
+		FormattedText:    true,
+		Captions:         true,
+		MaxTextLength:    msgconv.MaxMessageLength,
+		MaxCaptionLength: msgconv.MaxMessageLength,
+
+		Threads: true,
+		Edits:   true,
+		Deletes: true,
+
+		DefaultFileRestriction: &bridgev2.FileRestriction{
+			MaxSize:   m.Connector.MsgConv.MaxFileSizeToMattermost,
+			MimeTypes: m.Connector.MsgConv.AllowedMimeTypes,
+		},
+
+		Reactions: true,
 	}
 }
 
 func (m *MattermostAPI) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*bridgev2.ChatInfo, error) {
+	if categoryID, ok := parseCategoryPortalID(portal.ID); ok {
+		if ci := m.Connector.categoryChatInfo(categoryID); ci != nil {
+			return ci, nil
+		}
+		return nil, fmt.Errorf("unknown sidebar category %s", categoryID)
+	}
+
 	// Try as channel first
-	channel, _, err := m.Client.GetChannel(ctx, string(portal.ID), "")
+	channel, err := m.Connector.getCachedChannel(ctx, m.Client(), string(portal.ID))
 	if err == nil {
 		ci := &bridgev2.ChatInfo{
 			Name:    &channel.DisplayName,
-			Topic:   &channel.Purpose,
+			Topic:   ptr.Ptr(m.Connector.channelTopic(channel)),
 			Members: &bridgev2.ChatMemberList{},
+			// Lets the bridge's backfill queue fetch older posts
+			CanBackfill: true,
+			UserLocal:   m.channelUserLocalInfo(ctx, channel.Id),
 		}
 
 		if channel.Type == model.ChannelTypeOpen {
 			ci.Type = ptr.Ptr(database.RoomTypeDefault)
-			ci.ParentID = ptr.Ptr(networkid.PortalID(channel.TeamId))
+			ci.ParentID = m.Connector.channelParentID(channel)
+			m.applyChannelModeration(ctx, m.Connector.serverClient(loginServer(m.Login)), portal, channel, ci)
 		} else if channel.Type == model.ChannelTypePrivate {
 			ci.Type = ptr.Ptr(database.RoomTypeDefault) // Or RoomTypePrivate if bridge supports it specifically? Usually Default is fine.
-			ci.ParentID = ptr.Ptr(networkid.PortalID(channel.TeamId))
+			ci.ParentID = m.Connector.channelParentID(channel)
+			m.applyChannelModeration(ctx, m.Connector.serverClient(loginServer(m.Login)), portal, channel, ci)
 		} else if channel.Type == model.ChannelTypeDirect {
 			ci.Type = ptr.Ptr(database.RoomTypeDM)
 			// For DMs, name is often empty or just usernames.
 			// We might want to clear name so bridge generates it from members.
 			ci.Name = nil
 			// We need to fetch members for DMs to work properly
-			members, _, err := m.Client.GetChannelMembers(ctx, channel.Id, 0, 10, "")
+			users, err := m.Connector.getCachedChannelUsers(ctx, m.Client(), channel.Id)
 			if err == nil {
 				ci.Members.IsFull = true
-				ci.Members.Members = make([]bridgev2.ChatMember, 0, len(members))
-				for _, member := range members {
-					if m.isGhost(ctx, member.UserId) {
+				ci.Members.Members = make([]bridgev2.ChatMember, 0, len(users))
+				for _, user := range users {
+					if isGhostUser(user) {
 						continue
 					}
 					ci.Members.Members = append(ci.Members.Members, bridgev2.ChatMember{
-						EventSender: bridgev2.EventSender{Sender: networkid.UserID(m.Connector.GetUsername(ctx, member.UserId))},
+						EventSender: bridgev2.EventSender{Sender: m.makeUserID(user.Id)},
 					})
 				}
 			}
@@ -156,13 +209,13 @@ func (m *MattermostAPI) GetChatInfo(ctx context.Context, portal *bridgev2.Portal
 			ci.Type = ptr.Ptr(database.RoomTypeGroupDM)
 			ci.Name = nil // Let bridge generate
 			// Fetch members similar to DM
-			members, _, err := m.Client.GetChannelMembers(ctx, channel.Id, 0, 10, "")
+			users, err := m.Connector.getCachedChannelUsers(ctx, m.Client(), channel.Id)
 			if err == nil {
 				ci.Members.IsFull = true
-				ci.Members.Members = make([]bridgev2.ChatMember, len(members))
-				for i, member := range members {
+				ci.Members.Members = make([]bridgev2.ChatMember, len(users))
+				for i, user := range users {
 					ci.Members.Members[i] = bridgev2.ChatMember{
-						EventSender: bridgev2.EventSender{Sender: networkid.UserID(m.Connector.GetUsername(ctx, member.UserId))},
+						EventSender: bridgev2.EventSender{Sender: m.makeUserID(user.Id)},
 					}
 				}
 			}
@@ -172,12 +225,13 @@ func (m *MattermostAPI) GetChatInfo(ctx context.Context, portal *bridgev2.Portal
 	}
 
 	// If not channel, try Team
-	team, err := m.Client.GetTeam(ctx, string(portal.ID))
+	team, err := m.Client().GetTeam(ctx, string(portal.ID))
 	if err == nil {
 		return &bridgev2.ChatInfo{
-			Name:  &team.DisplayName,
-			Topic: &team.Description,
-			Type:  ptr.Ptr(database.RoomTypeSpace),
+			Name:   &team.DisplayName,
+			Topic:  &team.Description,
+			Avatar: m.Connector.teamAvatar(loginServer(m.Login), team),
+			Type:   ptr.Ptr(database.RoomTypeSpace),
 		}, nil
 	}
 
@@ -185,48 +239,57 @@ func (m *MattermostAPI) GetChatInfo(ctx context.Context, portal *bridgev2.Portal
 }
 
 func (m *MattermostAPI) GetUserInfo(ctx context.Context, ghost *bridgev2.Ghost) (*bridgev2.UserInfo, error) {
-	user, _, err := m.Client.GetUser(ctx, m.getMMID(ctx, ghost.ID), "")
+	user, err := m.Connector.getUser(ctx, m.Client(), ParseUserID(ghost.ID))
 	if err != nil {
 		return nil, err
 	}
-	name := user.Username
-	var parts []string
-	if user.FirstName != "" && user.FirstName != "()" {
-		parts = append(parts, strings.TrimSpace(user.FirstName))
-	}
-	if user.LastName != "" && user.LastName != "()" {
-		parts = append(parts, strings.TrimSpace(user.LastName))
-	}
-	fullName := strings.Join(parts, " ")
-
-	if fullName != "" {
-		name = fullName
-	} else if user.Nickname != "" {
-		name = user.Nickname
-	}
+	name := m.Connector.userDisplayName(user)
+	go m.Connector.syncCustomStatus(context.WithoutCancel(ctx), m.Client(), ghost, user)
 
 	m.Connector.Bridge.Log.Debug().
 		Str("username", user.Username).
 		Str("first_name", user.FirstName).
 		Str("last_name", user.LastName).
 		Str("nickname", user.Nickname).
-		Str("calc_fullname", fullName).
 		Str("final_name", name).
 		Int64("last_picture_update", user.LastPictureUpdate).
 		Msg("GetUserInfo name components")
 
 	return &bridgev2.UserInfo{
-		Name: &name,
+		Name:  &name,
+		IsBot: &user.IsBot,
 		Avatar: &bridgev2.Avatar{
 			ID: networkid.AvatarID(fmt.Sprintf("%d-force3", user.LastPictureUpdate)),
 			Get: func(ctx context.Context) ([]byte, error) {
-				data, _, err := m.Client.GetProfileImage(ctx, user.Id, "")
+				data, _, err := m.Client().GetProfileImage(ctx, user.Id, "")
 				return data, err
 			},
 		},
 	}, nil
 }
 
+// userDisplayName returns the name of a Mattermost user's ghost: their full name, nickname
+// or username, whichever is set first
+func (m *MattermostConnector) userDisplayName(user *model.User) string {
+	name := user.Username
+	var parts []string
+	if user.FirstName != "" && user.FirstName != "()" {
+		parts = append(parts, strings.TrimSpace(user.FirstName))
+	}
+	if user.LastName != "" && user.LastName != "()" {
+		parts = append(parts, strings.TrimSpace(user.LastName))
+	}
+	if fullName := strings.Join(parts, " "); fullName != "" {
+		name = fullName
+	} else if user.Nickname != "" {
+		name = user.Nickname
+	}
+	if user.IsBot {
+		name += m.config().BotAccounts.NameSuffix
+	}
+	return name
+}
+
 func (m *MattermostAPI) IsLoggedIn() bool {
 	return m.Login != nil
 }
@@ -235,21 +298,31 @@ func (m *MattermostAPI) IsThisUser(ctx context.Context, userID networkid.UserID)
 	if m.Login == nil {
 		return false
 	}
-	return string(userID) == string(m.Login.ID)
+	return ParseUserID(userID) == m.getOwnMMID()
 }
 
 func (m *MattermostAPI) isGhost(ctx context.Context, userID string) bool {
-	user, _, err := m.Client.GetUser(ctx, userID, "")
+	user, err := m.Connector.getUser(ctx, m.Client(), userID)
 	if err != nil {
 		return false
 	}
+	return isGhostUser(user)
+}
+
+// isGhostUser checks if a Mattermost user is an account the bridge created for a Matrix user
+func isGhostUser(user *model.User) bool {
 	return strings.HasPrefix(user.Username, "mx.")
 }
 
 func (m *MattermostAPI) LogoutRemote(ctx context.Context) {}
 
 func (m *MattermostAPI) HandleMatrixMessage(ctx context.Context, msg *bridgev2.MatrixMessage) (*bridgev2.MatrixMessageResponse, error) {
-	post, err := m.Connector.MsgConv.ToMattermost(ctx, m.Client, msg.Portal, msg.Content)
+	if meta := getPortalMetadata(msg.Portal); !meta.BridgesToMattermost() {
+		return nil, ErrDirectionDisabled
+	} else if msg.OrigSender != nil && !meta.RelayEnabled() {
+		return nil, ErrRelayDisabled
+	}
+	post, err := m.Connector.MsgConv.ToMattermost(ctx, m.Client(), msg.Portal, msg.Event.Sender, msg.Content)
 	if err != nil {
 		return nil, err
 	}
@@ -276,25 +349,31 @@ func (m *MattermostAPI) HandleMatrixMessage(ctx context.Context, msg *bridgev2.M
 	// Get the sender's Matrix user ID
 	senderMXID := msg.Event.Sender
 
-	// Get authenticated client for the ghost user and their MM ID
-	userClient, mmUserID, err := m.Connector.GetClientForUser(ctx, senderMXID.String())
-	if err != nil {
-		return nil, fmt.Errorf("failed to get client for ghost: %w", err)
+	// Text messages in channels shared with the bridge are synced as posts of remote users,
+	// so the sender doesn't need a ghost account
+	if rc := m.Connector.sharedChannelRemote(ctx, post.ChannelId); rc != nil && len(post.FileIds) == 0 {
+		return m.syncMatrixMessage(ctx, rc, msg, post)
 	}
 
-	// Update ghost profile if needed (avatar/name)
-	ghost, err := m.Connector.Bridge.GetGhostByID(ctx, networkid.UserID(senderMXID.String()))
-	if err == nil {
-		m.Connector.Bridge.Log.Info().Str("mxid", senderMXID.String()).Msg("Calling UpdateGhost from HandleMatrixMessage")
-		err = m.UpdateGhost(ctx, ghost)
+	// Senders with their own login post with their account, everyone else with a ghost
+	var userClient *Client
+	var mmUserID string
+	ownLogin := m.senderLogin(senderMXID)
+	if ownLogin != nil {
+		userClient, mmUserID = ownLogin.Client(), ownLogin.getOwnMMID()
+		m.Connector.Bridge.Log.Info().Str("matrix_user", senderMXID.String()).Str("mm_user_id", mmUserID).Msg("Posting with sender's own login")
+	} else {
+		// Get authenticated client for the ghost user and their MM ID
+		userClient, mmUserID, err = m.Connector.GetClientForUser(ctx, loginServer(m.Login), senderMXID.String())
 		if err != nil {
-			m.Connector.Bridge.Log.Warn().Err(err).Msg("Failed to update ghost profile")
+			return nil, fmt.Errorf("%w: %w", ErrGhostUnavailable, err)
 		}
-	} else {
-		m.Connector.Bridge.Log.Warn().Err(err).Str("mxid", senderMXID.String()).Msg("Failed to get ghost for profile update")
-	}
 
-	m.Connector.Bridge.Log.Info().Str("matrix_user", senderMXID.String()).Str("mm_user_id", mmUserID).Msg("Ghost Puppeting with Token")
+		// Update ghost profile if needed (avatar/name)
+		m.queueMatrixProfileSync(ctx, senderMXID, mmUserID)
+
+		m.Connector.Bridge.Log.Info().Str("matrix_user", senderMXID.String()).Str("mm_user_id", mmUserID).Msg("Ghost Puppeting with Token")
+	}
 
 	// Set the post's UserId (though the token implies it)
 	post.UserId = mmUserID
@@ -305,32 +384,98 @@ func (m *MattermostAPI) HandleMatrixMessage(ctx context.Context, msg *bridgev2.M
 	}
 	post.Props["from_matrix"] = true
 
-	// Ensure ghost is a member of the team and channel before posting
-	// This is needed for joined Matrix rooms where ghosts may not be members yet
-	channel, _, err := m.Client.GetChannel(ctx, post.ChannelId, "")
-	if err == nil && channel.TeamId != "" {
-		_, _, err = m.Client.AddTeamMember(ctx, channel.TeamId, mmUserID)
+	if ownLogin != nil {
+		// Real accounts are never added to channels by the bridge, they can only join
+		// channels their permissions allow
+		_, _, err = userClient.AddChannelMember(ctx, post.ChannelId, mmUserID)
+		if err != nil {
+			m.Connector.Bridge.Log.Debug().Err(err).Str("channel", post.ChannelId).Str("user", mmUserID).Msg("Could not join sender to channel (may already be member)")
+		}
+	} else {
+		// Ensure ghost is a member of the team and channel before posting
+		// This is needed for joined Matrix rooms where ghosts may not be members yet
+		channel, _, err := m.Client().GetChannel(ctx, post.ChannelId, "")
+		if err == nil && channel.TeamId != "" {
+			_, _, err = m.adminClient().AddTeamMember(ctx, channel.TeamId, mmUserID)
+			if err != nil {
+				// Log but don't fail - they might already be a member
+				m.Connector.Bridge.Log.Debug().Err(err).Str("team", channel.TeamId).Str("user", mmUserID).Msg("Could not add ghost to team (may already be member)")
+			}
+		}
+
+		_, _, err = m.adminClient().AddChannelMember(ctx, post.ChannelId, mmUserID)
 		if err != nil {
 			// Log but don't fail - they might already be a member
-			m.Connector.Bridge.Log.Debug().Err(err).Str("team", channel.TeamId).Str("user", mmUserID).Msg("Could not add ghost to team (may already be member)")
+			m.Connector.Bridge.Log.Debug().Err(err).Str("channel", post.ChannelId).Str("user", mmUserID).Msg("Could not add ghost to channel (may already be member)")
 		}
 	}
 
-	_, _, err = m.Client.AddChannelMember(ctx, post.ChannelId, mmUserID)
+	// Mattermost deduplicates posts by pending ID, so a retry can't create a second copy
+	// if the first attempt actually went through
+	post.PendingPostId = fmt.Sprintf("%s:%d", mmUserID, time.Now().UnixMilli())
+
+	// Long messages are uploaded as a file or split into several posts, the first one is the
+	// one the Matrix event maps to
+	extraParts, err := m.Connector.MsgConv.SplitLongPost(ctx, m.Client(), post)
 	if err != nil {
-		// Log but don't fail - they might already be a member
-		m.Connector.Bridge.Log.Debug().Err(err).Str("channel", post.ChannelId).Str("user", mmUserID).Msg("Could not add ghost to channel (may already be member)")
+		return nil, err
 	}
 
 	// Use the USER'S client to create the post
-	createdPost, _, err := userClient.CreatePost(ctx, post)
+	var createdPost *model.Post
+	resp, err := m.Connector.DoAsUser(ctx, loginServer(m.Login), senderMXID.String(), userClient, func(client *Client) (resp *model.Response, err error) {
+		createdPost, resp, err = client.CreatePost(ctx, post)
+		return resp, err
+	})
 	if err != nil {
-		return nil, err
+		// The retry queue only resends single posts, so split messages aren't queued
+		if m.Connector.RetryQueue != nil && len(extraParts) == 0 && IsRetryablePostError(resp, err) {
+			queueErr := m.Connector.RetryQueue.Enqueue(ctx, &RetryItem{
+				EventID:    msg.Event.ID,
+				RoomID:     msg.Portal.MXID,
+				Portal:     msg.Portal.PortalKey,
+				SenderMXID: senderMXID,
+				Post:       post,
+			}, err)
+			if queueErr == nil {
+				return nil, fmt.Errorf("%w: %w", ErrQueuedForRetry, err)
+			}
+			m.Connector.Bridge.Log.Err(queueErr).Msg("Failed to queue post for retry")
+		}
+		return nil, wrapMattermostError(resp, err)
 	}
+	meta := &MessageMetadata{}
+	if len(extraParts) > 0 {
+		meta.PartIDs = m.sendMessageParts(ctx, senderMXID, userClient, createdPost, post.PendingPostId, extraParts)
+	}
+	m.Connector.countMessage(StatsFromMatrix)
+
+	return &bridgev2.MatrixMessageResponse{
+		DB: &database.Message{
+			ID:       networkid.MessageID(createdPost.Id),
+			Metadata: meta,
+		},
+	}, nil
+}
 
+// syncMatrixMessage sends a Matrix message to a shared channel through the bridge's remote cluster
+func (m *MattermostAPI) syncMatrixMessage(ctx context.Context, rc *RemoteCluster, msg *bridgev2.MatrixMessage, post *model.Post) (*bridgev2.MatrixMessageResponse, error) {
+	var displayName string
+	if member, err := m.Connector.Bridge.Matrix.GetMemberInfo(ctx, msg.Portal.MXID, msg.Event.Sender); err == nil && member != nil {
+		displayName = member.Displayname
+	}
+	if post.Props == nil {
+		post.Props = make(map[string]any)
+	}
+	post.Props["from_matrix"] = true
+	synced, err := m.Connector.syncSharedChannelPost(ctx, rc, msg.Event.Sender, displayName, post)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sync post to shared channel: %w", err)
+	}
 	return &bridgev2.MatrixMessageResponse{
 		DB: &database.Message{
-			ID: networkid.MessageID(createdPost.Id),
+			ID:       networkid.MessageID(synced.Id),
+			SenderID: m.makeUserID(synced.UserId),
 		},
 	}, nil
 }
@@ -341,33 +486,20 @@ func (m *MattermostAPI) ResolveIdentifier(ctx context.Context, identifier string
 
 	// Check if identifier is an email
 	if strings.Contains(identifier, "@") {
-		user, err = m.Client.GetUserByEmail(ctx, identifier)
+		user, err = m.Client().GetUserByEmail(ctx, identifier)
 	} else {
-		user, err = m.Client.GetUserByUsername(ctx, identifier)
+		user, err = m.Client().GetUserByUsername(ctx, identifier)
 	}
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to find user by identifier %s: %w", identifier, err)
 	}
 
-	// Ghost ID is now the Username for readability
-	ghostID := networkid.UserID(user.Username)
+	ghostID := m.makeUserID(user.Id)
 	ghost, err := m.Connector.Bridge.GetGhostByID(ctx, ghostID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get ghost: %w", err)
 	}
-	// Ensure UUID is in metadata
-	if ghost.Metadata == nil {
-		ghost.Metadata = make(map[string]any)
-	}
-	meta, ok := ghost.Metadata.(map[string]any)
-	if ok && meta["mm_id"] != user.Id {
-		meta["mm_id"] = user.Id
-		err = m.Connector.Bridge.DB.Ghost.Update(ctx, ghost.Ghost)
-		if err != nil {
-			fmt.Printf("DEBUG: Failed to update ghost metadata: %v\n", err)
-		}
-	}
 
 	var chatResp *bridgev2.CreateChatResponse
 	if createChat {
@@ -401,33 +533,15 @@ func (m *MattermostAPI) CreateChatWithGhost(ctx context.Context, ghost *bridgev2
 	}
 	myUserID := m.getOwnMMID()
 
-	// Resolve otherUserID from the passed ghost object directly if possible
-	var otherUserID string
-	if ghost.Metadata != nil {
-		if meta, ok := ghost.Metadata.(map[string]any); ok {
-			if id, ok := meta["mm_id"].(string); ok && id != "" {
-				otherUserID = id
-			}
-		}
-	}
-
-	if otherUserID == "" {
-		otherUserID = m.getMMID(ctx, ghost.ID)
-	}
+	otherUserID := ParseUserID(ghost.ID)
 
-	fmt.Printf("DEBUG: CreateDirectChannelWithBoth myID=%s otherID=%s ghostID=%s\n", myUserID, otherUserID, ghost.ID)
-
-	// Ensure we don't pass the Matrix ID (username) if we failed to resolve UUID
-	if otherUserID == string(ghost.ID) && strings.Contains(otherUserID, "matrix_") {
-		// Try to resolve username to ID one last time
-		user, err := m.Client.GetUserByUsername(ctx, otherUserID)
-		if err == nil && user != nil {
-			otherUserID = user.Id
-			fmt.Printf("DEBUG: Resolved username %s to UUID %s\n", string(ghost.ID), otherUserID)
-		}
-	}
+	m.Connector.Bridge.Log.Debug().
+		Str("my_mm_id", myUserID).
+		Str("other_mm_id", otherUserID).
+		Str("ghost_id", string(ghost.ID)).
+		Msg("Creating direct channel")
 
-	channel, err := m.Client.CreateDirectChannelWithBoth(ctx, myUserID, otherUserID)
+	channel, err := m.Client().CreateDirectChannelWithBoth(ctx, myUserID, otherUserID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create direct channel: %w", err)
 	}
@@ -441,7 +555,7 @@ func (m *MattermostAPI) CreateChatWithGhost(ctx context.Context, ghost *bridgev2
 		Members: &bridgev2.ChatMemberList{
 			IsFull: true,
 			Members: []bridgev2.ChatMember{
-				{EventSender: bridgev2.EventSender{Sender: networkid.UserID(myUserID)}},
+				{EventSender: bridgev2.EventSender{Sender: m.makeUserID(myUserID)}},
 			},
 		},
 	}
@@ -449,7 +563,7 @@ func (m *MattermostAPI) CreateChatWithGhost(ctx context.Context, ghost *bridgev2
 	// Only add other user if they are NOT a ghost (i.e. not a Matrix user)
 	if !m.isGhost(ctx, otherUserID) {
 		ci.Members.Members = append(ci.Members.Members, bridgev2.ChatMember{
-			EventSender: bridgev2.EventSender{Sender: networkid.UserID(otherUserID)},
+			EventSender: bridgev2.EventSender{Sender: m.makeUserID(otherUserID)},
 		})
 	}
 
@@ -467,18 +581,22 @@ func (m *MattermostAPI) HandleMatrixEdit(ctx context.Context, edit *bridgev2.Mat
 	if edit.EditTarget == nil {
 		return fmt.Errorf("no edit target")
 	}
+	if !getPortalMetadata(edit.Portal).BridgesToMattermost() {
+		return ErrDirectionDisabled
+	}
 
-	// Get the post ID from the edit target
+	// Get the post ID from the edit target. Edits of any part of a Mattermost post, like a
+	// file with a caption, change the message of the whole post.
 	postID := string(edit.EditTarget.ID)
 
 	// Fetch the existing post to update it
-	existingPost, _, err := m.Client.GetPost(ctx, postID, "")
+	existingPost, resp, err := m.Client().GetPost(ctx, postID, "")
 	if err != nil {
-		return fmt.Errorf("failed to get post for edit: %w", err)
+		return fmt.Errorf("failed to get post for edit: %w", wrapMattermostError(resp, err))
 	}
 
-	// Convert the new content
-	newPost, err := m.Connector.MsgConv.ToMattermost(ctx, m.Client, edit.Portal, edit.Content)
+	// Convert the new text or caption, the post keeps its files
+	message, err := m.Connector.MsgConv.EditToMattermost(ctx, edit.Portal, edit.Event.Sender, edit.Content)
 	if err != nil {
 		return fmt.Errorf("failed to convert edit content: %w", err)
 	}
@@ -486,23 +604,23 @@ func (m *MattermostAPI) HandleMatrixEdit(ctx context.Context, edit *bridgev2.Mat
 	// Ensure the post has the correct UserId (for ghost puppeting)
 	// Get the sender's Matrix user ID
 	senderMXID := edit.Event.Sender
-	ghost, err := m.Connector.Bridge.GetGhostByID(ctx, networkid.UserID(senderMXID.String()))
+	mmUserID, err := m.Connector.EnsureGhost(ctx, loginServer(m.Login), senderMXID.String())
 	if err != nil {
 		return fmt.Errorf("failed to get ghost for sender: %w", err)
 	}
-	mmUserID := m.getMMID(ctx, ghost.ID)
 	existingPost.UserId = mmUserID
 
-	// Update the post message
-	existingPost.Message = newPost.Message
+	// Long messages are split again, the first part replaces the message of the post
+	parts := msgconv.SplitText(message, msgconv.MaxMessageLength)
+	existingPost.Message = parts[0]
 
 	// Update the post in Mattermost
-	_, _, err = m.Client.UpdatePost(ctx, postID, existingPost)
+	_, resp, err = m.Client().UpdatePost(ctx, postID, existingPost)
 	if err != nil {
-		return fmt.Errorf("failed to update post: %w", err)
+		return fmt.Errorf("failed to update post: %w", wrapMattermostError(resp, err))
 	}
 
-	return nil
+	return m.editMessageParts(ctx, edit, existingPost, parts[1:])
 }
 
 // HandleMatrixMessageRemove handles redaction events from Matrix, deleting the corresponding Mattermost post
@@ -514,13 +632,40 @@ func (m *MattermostAPI) HandleMatrixMessageRemove(ctx context.Context, remove *b
 	// Get the post ID from the target message
 	postID := string(remove.TargetMessage.ID)
 
+	// Redacting one part of a post bridged as several Matrix messages only removes that part
+	parts, err := m.Connector.Bridge.DB.Message.GetAllPartsByID(ctx, remove.Portal.Receiver, remove.TargetMessage.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get message parts: %w", err)
+	} else if len(parts) > 1 {
+		return m.removePostPart(ctx, postID, remove.TargetMessage.PartID)
+	}
+
 	// Delete the post in Mattermost
-	_, err := m.Client.DeletePost(ctx, postID)
+	resp, err := m.Client().DeletePost(ctx, postID)
 	if err != nil {
-		return fmt.Errorf("failed to delete post: %w", err)
+		return fmt.Errorf("failed to delete post: %w", wrapMattermostError(resp, err))
 	}
 
-	return nil
+	// Delete the other posts a long message was split into
+	return m.deleteMessageParts(ctx, remove.TargetMessage)
+}
+
+var _ bridgev2.ReactionHandlingNetworkAPI = (*MattermostAPI)(nil)
+
+// PreHandleMatrixReaction tells the bridge which Mattermost user and emoji name a Matrix
+// reaction maps to, so that it can drop duplicates. Reactions are stored with the emoji's
+// Mattermost name as their ID, as that's what removing them needs.
+func (m *MattermostAPI) PreHandleMatrixReaction(ctx context.Context, reaction *bridgev2.MatrixReaction) (bridgev2.MatrixReactionPreResponse, error) {
+	_, mmUserID, err := m.getSenderClient(ctx, reaction.Event.Sender)
+	if err != nil {
+		return bridgev2.MatrixReactionPreResponse{}, fmt.Errorf("%w: %w", ErrGhostUnavailable, err)
+	}
+	key := reaction.Content.RelatesTo.Key
+	return bridgev2.MatrixReactionPreResponse{
+		SenderID: m.makeUserID(mmUserID),
+		EmojiID:  networkid.EmojiID(msgconv.EmojiToMattermost(key)),
+		Emoji:    key,
+	}, nil
 }
 
 // HandleMatrixReaction handles reaction events from Matrix, adding the reaction to the Mattermost post
@@ -528,33 +673,43 @@ func (m *MattermostAPI) HandleMatrixReaction(ctx context.Context, reaction *brid
 	if reaction.TargetMessage == nil {
 		return nil, fmt.Errorf("no target message")
 	}
+	if !getPortalMetadata(reaction.Portal).BridgesToMattermost() {
+		return nil, ErrDirectionDisabled
+	}
 
 	postID := string(reaction.TargetMessage.ID)
 
-	// Get the emoji - bridgev2 provides the emoji via Content.RelatesTo.Key
-	emoji := reaction.Content.RelatesTo.Key
-	// Get the sender's Matrix user ID for ghost puppeting
+	// Mattermost reactions use emoji names like "thumbsup" instead of Unicode emoji
+	emoji := msgconv.EmojiToMattermost(reaction.Content.RelatesTo.Key)
+	// Get the sender's Matrix user ID, for their own login or ghost puppeting
 	senderMXID := reaction.Event.Sender
-	userClient, mmUserID, err := m.Connector.GetClientForUser(ctx, senderMXID.String())
+	userClient, mmUserID, err := m.getSenderClient(ctx, senderMXID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get client for ghost: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrGhostUnavailable, err)
 	}
 
 	// Create the reaction in Mattermost
 	mmReaction := &model.Reaction{
 		UserId:    mmUserID,
 		PostId:    postID,
-		EmojiName: emoji, // Mattermost uses emoji names like "thumbsup"
+		EmojiName: emoji,
 	}
 
-	savedReaction, _, err := userClient.SaveReaction(ctx, mmReaction)
+	// The reaction is tracked before it's sent, as the echo may arrive before SaveReaction returns
+	forgetReaction := m.Connector.trackReaction(ctx, postID, mmUserID, emoji, true)
+	var savedReaction *model.Reaction
+	resp, err := m.Connector.DoAsUser(ctx, loginServer(m.Login), senderMXID.String(), userClient, func(client *Client) (resp *model.Response, err error) {
+		savedReaction, resp, err = client.SaveReaction(ctx, mmReaction)
+		return resp, err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to save reaction: %w", err)
+		forgetReaction()
+		return nil, fmt.Errorf("failed to save reaction: %w", wrapMattermostError(resp, err))
 	}
 
 	return &database.Reaction{
 		EmojiID: networkid.EmojiID(savedReaction.EmojiName),
-		Emoji:   savedReaction.EmojiName,
+		Emoji:   reaction.Content.RelatesTo.Key,
 	}, nil
 }
 
@@ -564,25 +719,42 @@ func (m *MattermostAPI) HandleMatrixReactionRemove(ctx context.Context, reaction
 		return fmt.Errorf("no target reaction")
 	}
 
-	// Get the post ID and emoji from the target reaction
+	// Get the post ID and emoji from the target reaction. The emoji ID is the Mattermost name
+	// the reaction was saved with, but reactions stored before emoji were converted may have
+	// the Unicode emoji instead.
 	postID := string(reaction.TargetReaction.MessageID)
-	emoji := string(reaction.TargetReaction.EmojiID)
+	emoji := reactionEmojiName(reaction.TargetReaction)
 
-	// Get the sender's Matrix user ID for ghost puppeting
+	// Get the sender's Matrix user ID, for their own login or ghost puppeting
 	senderMXID := reaction.Event.Sender
-	userClient, mmUserID, err := m.Connector.GetClientForUser(ctx, senderMXID.String())
+	userClient, mmUserID, err := m.getSenderClient(ctx, senderMXID)
 	if err != nil {
-		return fmt.Errorf("failed to get client for ghost: %w", err)
+		return fmt.Errorf("%w: %w", ErrGhostUnavailable, err)
+	}
+
+	// Acknowledgements are bridged as reactions, redacting one unacknowledges the post
+	if reaction.TargetReaction.EmojiID == ackEmojiID {
+		resp, err := m.Connector.DoAsUser(ctx, loginServer(m.Login), senderMXID.String(), userClient, func(client *Client) (*model.Response, error) {
+			return client.UnacknowledgePost(ctx, postID, mmUserID)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remove acknowledgement: %w", wrapMattermostError(resp, err))
+		}
+		return nil
 	}
 
 	// Delete the reaction in Mattermost
-	_, err = userClient.DeleteReaction(ctx, &model.Reaction{
-		UserId:    mmUserID,
-		PostId:    postID,
-		EmojiName: emoji,
+	forgetReaction := m.Connector.trackReaction(ctx, postID, mmUserID, emoji, false)
+	resp, err := m.Connector.DoAsUser(ctx, loginServer(m.Login), senderMXID.String(), userClient, func(client *Client) (*model.Response, error) {
+		return client.DeleteReaction(ctx, &model.Reaction{
+			UserId:    mmUserID,
+			PostId:    postID,
+			EmojiName: emoji,
+		})
 	})
 	if err != nil {
-		return fmt.Errorf("failed to delete reaction: %w", err)
+		forgetReaction()
+		return fmt.Errorf("failed to delete reaction: %w", wrapMattermostError(resp, err))
 	}
 
 	return nil
@@ -590,32 +762,48 @@ func (m *MattermostAPI) HandleMatrixReactionRemove(ctx context.Context, reaction
 
 // FetchMessages implements BackfillingNetworkAPI to support historical message backfill
 func (m *MattermostAPI) FetchMessages(ctx context.Context, params bridgev2.FetchMessagesParams) (*bridgev2.FetchMessagesResponse, error) {
+	if meta := getPortalMetadata(params.Portal); !meta.BackfillEnabled() || !meta.BridgesToMatrix() {
+		return &bridgev2.FetchMessagesResponse{}, nil
+	}
 	channelID := string(params.Portal.ID)
+	cfg := &m.Connector.config().Backfill
 	count := params.Count
-	if count <= 0 {
-		count = 50
+	if historyLimit := m.Connector.config().Mirror.HistoryLimit; params.AnchorMessage == nil && historyLimit > 0 && m.Connector.IsMirrorMode() {
+		count = historyLimit
+	} else if params.AnchorMessage == nil && cfg.InitialMessages > 0 {
+		count = cfg.InitialMessages
+	} else if params.AnchorMessage != nil && cfg.PageSize > 0 {
+		count = cfg.PageSize
+	} else if count <= 0 {
+		count = cfg.pageSize()
+	}
+	count = min(count, maxBackfillPageSize)
+
+	release, err := m.Connector.backfillLimiter.acquire(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
 	// Get posts for channel
 	var postList *model.PostList
-	var err error
 
 	if params.Forward {
 		// Forward backfill: get messages after the anchor
 		if params.AnchorMessage != nil {
 			// Get posts after this message
-			postList, _, err = m.Client.GetPostsAfter(ctx, channelID, string(params.AnchorMessage.ID), 0, count, "", false, false)
+			postList, _, err = m.Client().GetPostsAfter(ctx, channelID, string(params.AnchorMessage.ID), 0, count, "", false, false)
 		} else {
 			// No anchor, get latest posts
-			postList, _, err = m.Client.GetPostsForChannel(ctx, channelID, 0, count, "", false, false)
+			postList, _, err = m.Client().GetPostsForChannel(ctx, channelID, 0, count, "", false, false)
 		}
 	} else {
 		// Backward backfill: get messages before the anchor
 		if params.AnchorMessage != nil {
-			postList, _, err = m.Client.GetPostsBefore(ctx, channelID, string(params.AnchorMessage.ID), 0, count, "", false, false)
+			postList, _, err = m.Client().GetPostsBefore(ctx, channelID, string(params.AnchorMessage.ID), 0, count, "", false, false)
 		} else {
 			// No anchor, get latest posts for initial backfill
-			postList, _, err = m.Client.GetPostsForChannel(ctx, channelID, 0, count, "", false, false)
+			postList, _, err = m.Client().GetPostsForChannel(ctx, channelID, 0, count, "", false, false)
 		}
 	}
 
@@ -632,8 +820,13 @@ func (m *MattermostAPI) FetchMessages(ctx context.Context, params bridgev2.Fetch
 		postID := postList.Order[i]
 		post := postList.Posts[postID]
 
-		// Skip system messages
-		if post.Type != "" && !strings.HasPrefix(post.Type, "custom_") {
+		// Skip system messages and ignored posts
+		if !m.Connector.isPostTypeBridged(post.Type) || m.Connector.ignoredPostReason(post) != "" {
+			continue
+		}
+
+		message, ok := m.Connector.MsgConv.FilterText(params.Portal, post.UserId, post.Message)
+		if !ok {
 			continue
 		}
 
@@ -642,11 +835,18 @@ func (m *MattermostAPI) FetchMessages(ctx context.Context, params bridgev2.Fetch
 		converted := &bridgev2.ConvertedMessage{}
 
 		// Handle text content
-		if post.Message != "" {
+		if message != "" {
+			body := message
+			if label := msgconv.PriorityLabel(post.GetPriority()); label != "" {
+				body = label + "\n\n" + body
+			}
 			content := &event.MessageEventContent{
-				Body:    post.Message,
+				Body:    body,
 				MsgType: event.MsgText,
 			}
+			if m.Connector.MsgConv.IsNoticePost(post) {
+				content.MsgType = event.MsgNotice
+			}
 			converted.Parts = append(converted.Parts, &bridgev2.ConvertedMessagePart{
 				Type:    event.EventMessage,
 				Content: content,
@@ -655,7 +855,7 @@ func (m *MattermostAPI) FetchMessages(ctx context.Context, params bridgev2.Fetch
 
 		// Note: File attachments in backfill would need async handling
 		// For now, we add a note about attachments
-		if len(post.FileIds) > 0 && post.Message == "" {
+		if len(post.FileIds) > 0 && message == "" {
 			content := &event.MessageEventContent{
 				Body:    fmt.Sprintf("[%d file attachment(s)]", len(post.FileIds)),
 				MsgType: event.MsgNotice,
@@ -674,7 +874,7 @@ func (m *MattermostAPI) FetchMessages(ctx context.Context, params bridgev2.Fetch
 		bfMsg := &bridgev2.BackfillMessage{
 			ConvertedMessage: converted,
 			Sender: bridgev2.EventSender{
-				Sender: networkid.UserID(m.Connector.GetUsername(ctx, post.UserId)),
+				Sender: m.makeUserID(post.UserId),
 			},
 			ID:        networkid.MessageID(post.Id),
 			Timestamp: time.UnixMilli(post.CreateAt),
@@ -687,13 +887,13 @@ func (m *MattermostAPI) FetchMessages(ctx context.Context, params bridgev2.Fetch
 		}
 
 		// Fetch reactions for this post
-		reactions, _, err := m.Client.GetReactions(ctx, post.Id)
+		reactions, _, err := m.Client().GetReactions(ctx, post.Id)
 		if err == nil && len(reactions) > 0 {
 			bfMsg.Reactions = make([]*bridgev2.BackfillReaction, 0, len(reactions))
 			for _, reaction := range reactions {
 				bfMsg.Reactions = append(bfMsg.Reactions, &bridgev2.BackfillReaction{
 					Sender: bridgev2.EventSender{
-						Sender: networkid.UserID(m.Connector.GetUsername(ctx, reaction.UserId)),
+						Sender: m.makeUserID(reaction.UserId),
 					},
 					EmojiID:   networkid.EmojiID(reaction.EmojiName),
 					Emoji:     reaction.EmojiName,
@@ -708,10 +908,19 @@ func (m *MattermostAPI) FetchMessages(ctx context.Context, params bridgev2.Fetch
 	// Determine if there are more messages
 	hasMore := len(postList.Order) >= count
 
+	if err = m.Connector.backfillLimiter.wait(ctx, len(messages)); err != nil {
+		return nil, err
+	}
+
+	// Forward backfill runs in the portal's event loop, so the read state is applied
+	// after the messages are sent instead of marking all of them as read
+	if params.Forward && len(messages) > 0 {
+		m.Connector.queueReadState(ctx, channelID)
+	}
+
 	return &bridgev2.FetchMessagesResponse{
 		Messages: messages,
 		HasMore:  hasMore,
 		Forward:  params.Forward,
-		MarkRead: params.Forward, // Mark read for forward backfill
 	}, nil
 }
@@ -0,0 +1,135 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/mmtest"
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/msgconv"
+)
+
+// newTestMatrixMessageAPI returns an API using a fake Mattermost server, and a portal of
+// a channel of the server
+func newTestMatrixMessageAPI(t *testing.T) (*MattermostAPI, *mmtest.Server, *bridgev2.Portal) {
+	ctx := context.Background()
+	server := mmtest.NewServer(t)
+	team := server.AddTeam(&model.Team{Name: "team"})
+	channel := server.AddChannel(&model.Channel{TeamId: team.Id, Name: "town-square"})
+
+	store := NewMatrixUserStore("mattermost", newTestBridgeDB(t).Database)
+	require.NoError(t, store.Upgrade(ctx))
+	connector := &MattermostConnector{
+		Config:      &NetworkConfig{ServerURL: server.URL},
+		Bridge:      &bridgev2.Bridge{},
+		Client:      NewClient(server.URL, server.AdminToken),
+		MsgConv:     &msgconv.MessageConverter{},
+		MatrixUsers: store,
+	}
+	portal := &bridgev2.Portal{Portal: &database.Portal{
+		PortalKey: networkid.PortalKey{ID: networkid.PortalID(channel.Id)},
+		MXID:      "!portal:example.com",
+		Metadata:  &PortalMetadata{},
+	}}
+	return newMattermostAPI(nil, connector, connector.Client), server, portal
+}
+
+// newTestMatrixMessage returns a text message sent by a Matrix user
+func newTestMatrixMessage(portal *bridgev2.Portal, sender id.UserID, body string) *bridgev2.MatrixMessage {
+	return &bridgev2.MatrixMessage{MatrixEventBase: bridgev2.MatrixEventBase[*event.MessageEventContent]{
+		Event:   &event.Event{ID: "$event", Sender: sender, RoomID: portal.MXID},
+		Content: &event.MessageEventContent{MsgType: event.MsgText, Body: body},
+		Portal:  portal,
+	}}
+}
+
+func TestHandleMatrixMessage_PostsAsGhost(t *testing.T) {
+	ctx := context.Background()
+	api, server, portal := newTestMatrixMessageAPI(t)
+	channelID := string(portal.ID)
+
+	// The first message creates the ghost account and its token
+	resp, err := api.HandleMatrixMessage(ctx, newTestMatrixMessage(portal, "@alice:example.com", "hello"))
+	require.NoError(t, err)
+	post := server.Post(string(resp.DB.ID))
+	require.NotNil(t, post)
+	assert.Equal(t, "hello", post.Message)
+	assert.Equal(t, true, post.GetProp("from_matrix"))
+
+	matrixUser, err := api.Connector.MatrixUsers.Get(ctx, "", "@alice:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, matrixUser)
+	assert.Equal(t, matrixUser.MMUserID, post.UserId)
+	assert.NotEmpty(t, matrixUser.Token)
+	assert.Contains(t, server.ChannelMembers(channelID), post.UserId)
+
+	// Replies in threads are posted in the thread with the stored token. Pending post IDs
+	// are made from the time in milliseconds, and Mattermost deduplicates posts by them.
+	time.Sleep(time.Millisecond)
+	msg := newTestMatrixMessage(portal, "@alice:example.com", "reply")
+	msg.ThreadRoot = &database.Message{ID: resp.DB.ID}
+	resp, err = api.HandleMatrixMessage(ctx, msg)
+	require.NoError(t, err)
+	reply := server.Post(string(resp.DB.ID))
+	require.NotNil(t, reply)
+	assert.Equal(t, post.Id, reply.RootId)
+	assert.Equal(t, post.UserId, reply.UserId)
+	assert.Len(t, server.ChannelPosts(channelID), 2)
+}
+
+func TestHandleMatrixMessage_PostsAsGhostOnLoginServer(t *testing.T) {
+	ctx := context.Background()
+	mainAPI, mainServer, _ := newTestMatrixMessageAPI(t)
+	connector := mainAPI.Connector
+	other := mmtest.NewServer(t)
+	team := other.AddTeam(&model.Team{Name: "team"})
+	channel := other.AddChannel(&model.Channel{TeamId: team.Id, Name: "town-square"})
+	connector.servers = map[string]*mattermostServer{
+		"":      {URL: mainServer.URL, Client: connector.Client},
+		"other": {Name: "other", URL: other.URL, Client: NewClient(other.URL, other.AdminToken)},
+	}
+	login := &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "other-login", Metadata: map[string]any{"server": "other"}}}
+	api := newMattermostAPI(login, connector, NewClient(other.URL, other.AdminToken))
+	portal := &bridgev2.Portal{Portal: &database.Portal{
+		PortalKey: networkid.PortalKey{ID: networkid.PortalID(channel.Id)},
+		MXID:      "!other:example.com",
+		Metadata:  &PortalMetadata{},
+	}}
+
+	resp, err := api.HandleMatrixMessage(ctx, newTestMatrixMessage(portal, "@alice:example.com", "hello"))
+	require.NoError(t, err)
+	post := other.Post(string(resp.DB.ID))
+	require.NotNil(t, post)
+
+	// The ghost account is created on the login's server and stored for it
+	matrixUser, err := connector.MatrixUsers.Get(ctx, "other", "@alice:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, matrixUser)
+	assert.Equal(t, matrixUser.MMUserID, post.UserId)
+	mainUser, err := connector.MatrixUsers.Get(ctx, "", "@alice:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, mainUser)
+
+	// Without an admin token, the bridge can't create ghosts on a server
+	connector.servers["other"].Client = nil
+	_, err = api.HandleMatrixMessage(ctx, newTestMatrixMessage(portal, "@bob:example.com", "hello"))
+	assert.ErrorContains(t, err, "server other has no admin token")
+}
+
+func TestHandleMatrixMessage_DirectionDisabled(t *testing.T) {
+	api, server, portal := newTestMatrixMessageAPI(t)
+	portal.Metadata.(*PortalMetadata).Settings.Direction = DirectionToMatrix
+
+	_, err := api.HandleMatrixMessage(context.Background(), newTestMatrixMessage(portal, "@alice:example.com", "hello"))
+	assert.Equal(t, ErrDirectionDisabled, err)
+	assert.Empty(t, server.ChannelPosts(string(portal.ID)))
+}
@@ -0,0 +1,107 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var ErrAutoProvisionNotAllowed = errors.New("user doesn't have permission to log in")
+
+// autoProvisionLoginPrefix is the prefix of the IDs of automatically provisioned logins
+const autoProvisionLoginPrefix = "auto_"
+
+// registerAutoProvisioning makes the bridge log in Matrix users who invite a ghost without
+// being logged in, with the Mattermost account the bridge creates for them. The handler
+// runs before the bridge's own, so the invite finds the new login.
+func (m *MattermostConnector) registerAutoProvisioning() {
+	if !m.config().AutoProvision {
+		return
+	}
+	log := m.moduleLog(LogModuleConnector)
+	mc, ok := m.Bridge.Matrix.(*matrix.Connector)
+	if !ok || mc.EventProcessor == nil {
+		log.Warn().Msg("Matrix connector has no event processor, auto-provisioning is disabled")
+		return
+	}
+	if mc.EventProcessor.ExecMode == appservice.AsyncHandlers {
+		log.Warn().Msg("Transactions are handled asynchronously, the first invite of a user may fail before their login is provisioned")
+	}
+	mc.EventProcessor.PrependHandler(event.StateMember, m.handleGhostInvite)
+}
+
+// isGhostInvite checks whether an event is a Matrix user inviting a ghost
+func isGhostInvite(evt *event.Event, isGhost func(id.UserID) bool) bool {
+	if evt.Type != event.StateMember || evt.StateKey == nil || isGhost(evt.Sender) {
+		return false
+	}
+	return evt.Content.AsMember().Membership == event.MembershipInvite && isGhost(id.UserID(*evt.StateKey))
+}
+
+// handleGhostInvite provisions a login for the sender of an invite to a ghost
+func (m *MattermostConnector) handleGhostInvite(ctx context.Context, evt *event.Event) {
+	isGhost := func(userID id.UserID) bool {
+		_, ok := m.Bridge.Matrix.ParseGhostMXID(userID)
+		return ok
+	}
+	if evt.Sender == m.Bridge.Bot.GetMXID() || !isGhostInvite(evt, isGhost) {
+		return
+	}
+	log := m.moduleLog(LogModuleConnector).With().
+		Stringer("sender", evt.Sender).
+		Str("target", evt.GetStateKey()).
+		Logger()
+	login, err := m.autoProvisionLogin(ctx, evt.Sender)
+	if errors.Is(err, ErrAutoProvisionNotAllowed) {
+		log.Debug().Msg("Not auto-provisioning login for user without login permission")
+	} else if err != nil {
+		log.Err(err).Msg("Failed to auto-provision login for user inviting ghost")
+	} else if login != nil {
+		log.Info().Str("login_id", string(login.ID)).Msg("Auto-provisioned login for user inviting ghost")
+	}
+}
+
+// autoProvisionLogin logs in a Matrix user with the Mattermost account the bridge creates
+// for them, if they don't have a login yet and the bridge permissions allow them to log in.
+// It returns nil if the user or their Mattermost account already has a login.
+func (m *MattermostConnector) autoProvisionLogin(ctx context.Context, mxid id.UserID) (*bridgev2.UserLogin, error) {
+	user, err := m.Bridge.GetUserByMXID(ctx, mxid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	} else if user == nil || !user.Permissions.Login {
+		return nil, ErrAutoProvisionNotAllowed
+	} else if len(user.GetCachedUserLogins()) > 0 {
+		return nil, nil
+	}
+	_, mmUserID, err := m.GetClientForUser(ctx, "", mxid.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Mattermost account: %w", err)
+	}
+	matrixUser, err := m.MatrixUsers.Get(ctx, "", mxid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Mattermost token: %w", err)
+	} else if matrixUser == nil {
+		return nil, fmt.Errorf("no Mattermost account was stored for %s", mxid)
+	}
+	// The account may already be logged in by someone who logged in with its token
+	if len(m.accountLogins("", mmUserID)) > 0 {
+		return nil, nil
+	}
+	return user.NewLogin(ctx, &database.UserLogin{
+		ID:         networkid.UserLoginID(autoProvisionLoginPrefix + mxid.String()),
+		RemoteName: mxid.String(),
+		Metadata: map[string]any{
+			"mm_id":               mmUserID,
+			"token":               matrixUser.Token,
+			"is_auto_provisioned": true,
+		},
+	}, nil)
+}
@@ -0,0 +1,36 @@
+package mattermost
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestIsGhostInvite(t *testing.T) {
+	isGhost := func(userID id.UserID) bool {
+		return strings.HasPrefix(string(userID), "@mattermost_")
+	}
+	member := func(sender id.UserID, target string, membership event.Membership) *event.Event {
+		return &event.Event{
+			Type:     event.StateMember,
+			Sender:   sender,
+			StateKey: &target,
+			Content:  event.Content{Parsed: &event.MemberEventContent{Membership: membership}},
+		}
+	}
+
+	assert.True(t, isGhostInvite(member("@alice:example.com", "@mattermost_bob:example.com", event.MembershipInvite), isGhost))
+	assert.False(t, isGhostInvite(member("@alice:example.com", "@carol:example.com", event.MembershipInvite), isGhost), "target isn't a ghost")
+	assert.False(t, isGhostInvite(member("@alice:example.com", "@mattermost_bob:example.com", event.MembershipJoin), isGhost), "not an invite")
+	assert.False(t, isGhostInvite(member("@mattermost_bob:example.com", "@mattermost_dave:example.com", event.MembershipInvite), isGhost), "ghosts inviting ghosts")
+	assert.False(t, isGhostInvite(&event.Event{Type: event.EventMessage, Sender: "@alice:example.com"}, isGhost))
+}
+
+func TestRegisterAutoProvisioning_Disabled(t *testing.T) {
+	// With auto-provisioning off the Matrix connector isn't touched at all
+	connector := &MattermostConnector{Config: &NetworkConfig{AutoProvision: false}}
+	assert.NotPanics(t, connector.registerAutoProvisioning)
+}
@@ -0,0 +1,94 @@
+package mattermost
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BackfillConfig contains settings for bridging message history
+type BackfillConfig struct {
+	InitialMessages   int `yaml:"initial_messages"`
+	PageSize          int `yaml:"page_size"`
+	Concurrency       int `yaml:"concurrency"`
+	MessagesPerSecond int `yaml:"messages_per_second"`
+}
+
+// Defaults used when the backfill config values are unset
+const (
+	defaultBackfillPageSize    = 50
+	defaultBackfillConcurrency = 2
+	// Mattermost doesn't return more posts than this per request
+	maxBackfillPageSize = 200
+)
+
+// pageSize returns the number of posts fetched from Mattermost per request
+func (c *BackfillConfig) pageSize() int {
+	if c.PageSize > 0 {
+		return min(c.PageSize, maxBackfillPageSize)
+	}
+	return defaultBackfillPageSize
+}
+
+// backfillLimiter limits how many portals are backfilled at once and how fast
+// historical messages are bridged, so that backfilling a large server doesn't
+// overload Mattermost or the homeserver. A nil limiter doesn't limit anything.
+type backfillLimiter struct {
+	slots    chan struct{}
+	interval time.Duration
+
+	lock sync.Mutex
+	next time.Time
+}
+
+func newBackfillLimiter(cfg BackfillConfig) *backfillLimiter {
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultBackfillConcurrency
+	}
+	limiter := &backfillLimiter{slots: make(chan struct{}, concurrency)}
+	if cfg.MessagesPerSecond > 0 {
+		limiter.interval = time.Second / time.Duration(cfg.MessagesPerSecond)
+	}
+	return limiter
+}
+
+// acquire waits until another portal can be backfilled. The returned function must be
+// called when the backfill is done.
+func (l *backfillLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// wait waits until the given number of messages may be bridged
+func (l *backfillLimiter) wait(ctx context.Context, count int) error {
+	if l == nil || l.interval <= 0 || count <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(time.Duration(count) * l.interval)
+	l.lock.Unlock()
+
+	delay := time.Until(start)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
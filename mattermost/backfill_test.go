@@ -0,0 +1,47 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackfillConfig_Defaults(t *testing.T) {
+	var cfg BackfillConfig
+	assert.Equal(t, defaultBackfillPageSize, cfg.pageSize())
+
+	cfg = BackfillConfig{PageSize: 1000}
+	assert.Equal(t, maxBackfillPageSize, cfg.pageSize(), "page size is capped at what Mattermost allows")
+}
+
+func TestBackfillLimiter_Concurrency(t *testing.T) {
+	limiter := newBackfillLimiter(BackfillConfig{Concurrency: 1})
+	release, err := limiter.acquire(context.Background())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = limiter.acquire(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "second backfill should wait for the first")
+
+	release()
+	release, err = limiter.acquire(context.Background())
+	require.NoError(t, err)
+	release()
+}
+
+func TestBackfillLimiter_Rate(t *testing.T) {
+	limiter := newBackfillLimiter(BackfillConfig{MessagesPerSecond: 100})
+	ctx := context.Background()
+	start := time.Now()
+	require.NoError(t, limiter.wait(ctx, 5))
+	require.NoError(t, limiter.wait(ctx, 1))
+	// The second call waits for the 5 messages of the first one
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	var unlimited *backfillLimiter
+	assert.NoError(t, unlimited.wait(ctx, 1000))
+}
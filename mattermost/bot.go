@@ -0,0 +1,194 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+const botTokenDescription = "mautrix-mattermost bot login"
+
+var ErrBotLoginNotAllowed = errors.New("only bridge admins can log in with a bot account")
+
+// BotLogin logs in a dedicated Mattermost bot account, for example to use as a relay.
+// The bot is created with the admin token if it doesn't exist yet.
+type BotLogin struct {
+	user      *bridgev2.User
+	connector *MattermostConnector
+}
+
+func (b *BotLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
+	if !b.user.Permissions.Admin {
+		return nil, ErrBotLoginNotAllowed
+	}
+	return &bridgev2.LoginStep{
+		Type:         bridgev2.LoginStepTypeUserInput,
+		StepID:       "bot",
+		Instructions: "Enter the username of the Mattermost bot account. It will be created if it doesn't exist.",
+		UserInputParams: &bridgev2.LoginUserInputParams{
+			Fields: []bridgev2.LoginInputDataField{
+				{
+					ID:   "username",
+					Type: bridgev2.LoginInputFieldTypeUsername,
+					Name: "Bot username",
+				},
+			},
+		},
+	}, nil
+}
+
+func (b *BotLogin) SubmitUserInput(ctx context.Context, input map[string]string) (*bridgev2.LoginStep, error) {
+	bot, err := b.connector.ensureBot(ctx, input["username"])
+	if err != nil {
+		return nil, err
+	}
+	// The companion plugin only creates tokens for ghosts, so bots always use the admin client
+	token, err := b.connector.adminClient().CreateUserAccessToken(ctx, bot.UserId, botTokenDescription)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bot token: %w", err)
+	}
+
+	login, err := b.user.NewLogin(ctx, &database.UserLogin{
+		ID:         networkid.UserLoginID(bot.Username),
+		RemoteName: bot.Username,
+		Metadata: map[string]any{
+			"token":         token.Token,
+			"mm_id":         bot.UserId,
+			"bot":           true,
+			"token_id":      token.Id,
+			"token_created": time.Now().Unix(),
+		},
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save login: %w", err)
+	}
+	return &bridgev2.LoginStep{
+		Type:         bridgev2.LoginStepTypeComplete,
+		StepID:       "complete",
+		Instructions: fmt.Sprintf("Successfully logged in as bot %s", bot.Username),
+		CompleteParams: &bridgev2.LoginCompleteParams{
+			UserLoginID: login.ID,
+			UserLogin:   login,
+		},
+	}, nil
+}
+
+func (b *BotLogin) Cancel() {
+}
+
+// ensureBot returns the bot account with the given username, creating or re-enabling it if needed
+func (m *MattermostConnector) ensureBot(ctx context.Context, username string) (*model.Bot, error) {
+	if username == "" {
+		return nil, errors.New("bot username is required")
+	}
+	user, err := m.Client.GetUserByUsername(ctx, username)
+	if err != nil && responseStatusCode(nil, err) != http.StatusNotFound {
+		return nil, fmt.Errorf("failed to look up bot user: %w", err)
+	} else if err != nil {
+		bot, err := m.adminClient().CreateBot(ctx, &model.Bot{
+			Username:    username,
+			Description: "Matrix bridge bot",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create bot: %w", err)
+		}
+		return bot, nil
+	} else if !user.IsBot {
+		return nil, fmt.Errorf("%s is a regular user, not a bot account", username)
+	}
+
+	bot, err := m.Client.GetBot(ctx, user.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bot: %w", err)
+	}
+	if bot.DeleteAt != 0 {
+		if bot, err = m.adminClient().EnableBot(ctx, user.Id); err != nil {
+			return nil, fmt.Errorf("failed to enable bot: %w", err)
+		}
+	}
+	return bot, nil
+}
+
+// runBotTokenRotation periodically replaces the tokens of bot logins that are older than interval
+func (m *MattermostConnector) runBotTokenRotation(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		m.rotateBotTokens(ctx, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *MattermostConnector) rotateBotTokens(ctx context.Context, maxAge time.Duration) {
+	log := m.moduleLog(LogModuleConnector)
+	for _, login := range m.GetUsers() {
+		meta, ok := login.Metadata.(map[string]any)
+		if !ok || meta["bot"] != true {
+			continue
+		}
+		if created := metadataUnix(meta["token_created"]); time.Since(created) < maxAge {
+			continue
+		}
+		if err := m.rotateBotToken(ctx, login, meta); err != nil {
+			log.Err(err).Str("login_id", string(login.ID)).Msg("Failed to rotate bot token")
+		} else {
+			log.Info().Str("login_id", string(login.ID)).Msg("Rotated bot token")
+		}
+	}
+}
+
+// rotateBotToken creates a new token for a bot login, switches the login to it and revokes the old one
+func (m *MattermostConnector) rotateBotToken(ctx context.Context, login *bridgev2.UserLogin, meta map[string]any) error {
+	botID, _ := meta["mm_id"].(string)
+	if botID == "" {
+		return errors.New("login has no bot user ID")
+	}
+	token, err := m.adminClient().CreateUserAccessToken(ctx, botID, botTokenDescription)
+	if err != nil {
+		return fmt.Errorf("failed to create token: %w", err)
+	}
+	oldTokenID, _ := meta["token_id"].(string)
+	meta["token"] = token.Token
+	meta["token_id"] = token.Id
+	meta["token_created"] = time.Now().Unix()
+	if err = login.Save(ctx); err != nil {
+		return fmt.Errorf("failed to save login: %w", err)
+	}
+	if api, ok := login.Client.(*MattermostAPI); ok {
+		api.setClient(api.newLoginClient(token.Token))
+		api.tokenInvalid.Store(false)
+	}
+	if oldTokenID != "" {
+		if err = m.adminClient().RevokeUserAccessToken(ctx, oldTokenID); err != nil {
+			return fmt.Errorf("failed to revoke old token: %w", err)
+		}
+	}
+	return nil
+}
+
+// metadataUnix reads a unix timestamp from login metadata, which is a float64 after
+// a round trip through the database
+func metadataUnix(value any) time.Time {
+	switch ts := value.(type) {
+	case int64:
+		return time.Unix(ts, 0)
+	case float64:
+		return time.Unix(int64(ts), 0)
+	default:
+		return time.Time{}
+	}
+}
@@ -0,0 +1,55 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureBot(t *testing.T) {
+	var createdBot *model.Bot
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v4/users/username/relaybot":
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(model.AppError{Id: "app.user.missing_account.const", StatusCode: http.StatusNotFound})
+		case r.URL.Path == "/api/v4/users/username/alice":
+			_ = json.NewEncoder(w).Encode(model.User{Id: "user1", Username: "alice"})
+		case r.URL.Path == "/api/v4/bots" && r.Method == http.MethodPost:
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&createdBot))
+			createdBot.UserId = "bot1"
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(createdBot)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	connector := &MattermostConnector{Client: NewClient(server.URL, "token")}
+
+	bot, err := connector.ensureBot(context.Background(), "relaybot")
+	require.NoError(t, err)
+	assert.Equal(t, "bot1", bot.UserId)
+	require.NotNil(t, createdBot)
+	assert.Equal(t, "relaybot", createdBot.Username)
+
+	_, err = connector.ensureBot(context.Background(), "alice")
+	assert.ErrorContains(t, err, "not a bot account")
+
+	_, err = connector.ensureBot(context.Background(), "")
+	assert.Error(t, err)
+}
+
+func TestMetadataUnix(t *testing.T) {
+	assert.Equal(t, time.Unix(1700000000, 0), metadataUnix(int64(1700000000)))
+	assert.Equal(t, time.Unix(1700000000, 0), metadataUnix(float64(1700000000)))
+	assert.True(t, metadataUnix(nil).IsZero())
+}
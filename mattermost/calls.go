@@ -0,0 +1,274 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+// Calls of the Mattermost Calls plugin can't be bridged, but with calls.notices the bridge
+// bot posts a notice in the room when a call starts and ends, with a link to join it on
+// Mattermost. With calls.from_matrix, calls started in Matrix rooms as Jitsi or Element
+// Call widgets are announced in the channel the same way.
+
+// CallsConfig contains the settings for notices about calls
+type CallsConfig struct {
+	// Notices posts a notice in the room when a call starts or ends in its channel
+	Notices bool `yaml:"notices"`
+	// JoinLink adds a link to the call to the notice of its start
+	JoinLink bool `yaml:"join_link"`
+	// FromMatrix posts a message in the channel when a call is started in the room
+	FromMatrix bool `yaml:"from_matrix"`
+}
+
+// WebSocket events of the Calls plugin
+const (
+	callStartEvent = model.WebsocketEventType("custom_com.mattermost.calls_call_start")
+	callEndEvent   = model.WebsocketEventType("custom_com.mattermost.calls_call_end")
+)
+
+// widgetStateEvent is the state event of room widgets, which Element uses for calls
+var widgetStateEvent = event.Type{Type: "im.vector.modular.widgets", Class: event.StateEventType}
+
+// callWidgetTypes are the types of widgets that are calls
+var callWidgetTypes = map[string]bool{"jitsi": true, "m.jitsi": true, "m.call": true}
+
+// activeCall is a call the bridge has seen start
+type activeCall struct {
+	ID       string
+	ThreadID string
+	StartAt  time.Time
+}
+
+// activeCalls remembers the calls going on in each channel, to say how long they lasted
+type activeCalls struct {
+	lock  sync.Mutex
+	calls map[string]*activeCall
+}
+
+func (c *activeCalls) start(channelID string, call *activeCall) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.calls == nil {
+		c.calls = make(map[string]*activeCall)
+	}
+	c.calls[channelID] = call
+}
+
+func (c *activeCalls) end(channelID string) *activeCall {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	call := c.calls[channelID]
+	delete(c.calls, channelID)
+	return call
+}
+
+// MattermostCallEvent is a synthetic event for the notice of a call starting or ending,
+// which the bridge bot sends
+type MattermostCallEvent struct {
+	MattermostEvent
+	CallID string
+	Ended  bool
+	// Text is the notice in Markdown
+	Text string
+}
+
+var _ bridgev2.RemoteMessage = (*MattermostCallEvent)(nil)
+
+func (e *MattermostCallEvent) GetType() bridgev2.RemoteEventType {
+	return bridgev2.RemoteEventMessage
+}
+
+func (e *MattermostCallEvent) GetSender() bridgev2.EventSender {
+	return bridgev2.EventSender{}
+}
+
+func (e *MattermostCallEvent) GetID() networkid.MessageID {
+	if e.Ended {
+		return networkid.MessageID("call:" + e.CallID + ":end")
+	}
+	return networkid.MessageID("call:" + e.CallID + ":start")
+}
+
+func (e *MattermostCallEvent) ConvertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI) (*bridgev2.ConvertedMessage, error) {
+	if !getPortalMetadata(portal).BridgesToMatrix() {
+		return nil, bridgev2.ErrIgnoringRemoteEvent
+	}
+	content := format.RenderMarkdown(e.Text, true, false)
+	content.MsgType = event.MsgNotice
+	return &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{{
+			Type:    event.EventMessage,
+			Content: &content,
+		}},
+	}, nil
+}
+
+// callEventString returns a string field of the data of a Calls plugin event
+func callEventString(data map[string]any, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := data[key].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// callStartNotice renders the notice of a call starting
+func callStartNotice(username, joinURL string) string {
+	text := "📞 A call started"
+	if username != "" {
+		text = "📞 **@" + username + "** started a call"
+	}
+	if joinURL != "" {
+		text += " ([join on Mattermost](" + joinURL + "))"
+	}
+	return text
+}
+
+// callEndNotice renders the notice of a call ending
+func callEndNotice(duration time.Duration) string {
+	if duration <= 0 {
+		return "📞 The call ended"
+	}
+	return fmt.Sprintf("📞 The call ended after %s", duration.Round(time.Second))
+}
+
+// handleCallEvent posts the notice of a call starting or ending in a channel
+func (m *MattermostConnector) handleCallEvent(ctx context.Context, server string, evt *model.WebSocketEvent) {
+	if !m.config().Calls.Notices {
+		return
+	}
+	if callEvt := m.callNoticeEvent(ctx, server, evt); callEvt != nil {
+		m.queueRemoteEvent(callEvt)
+	}
+}
+
+// callNoticeEvent returns the notice of a Calls plugin event, or nil if its channel is unknown
+func (m *MattermostConnector) callNoticeEvent(ctx context.Context, server string, evt *model.WebSocketEvent) *MattermostCallEvent {
+	data := evt.GetData()
+	channelID := callEventString(data, "channelID", "channel_id")
+	if broadcast := evt.GetBroadcast(); broadcast != nil && broadcast.ChannelId != "" {
+		channelID = broadcast.ChannelId
+	}
+	if channelID == "" {
+		return nil
+	}
+	callEvt := &MattermostCallEvent{
+		MattermostEvent: MattermostEvent{
+			Connector: m,
+			Server:    server,
+			Timestamp: time.Now(),
+			ChannelID: channelID,
+		},
+	}
+	if evt.EventType() == callStartEvent {
+		call := &activeCall{
+			ID:       callEventString(data, "id", "call_id", "thread_id"),
+			ThreadID: callEventString(data, "thread_id"),
+			StartAt:  time.Now(),
+		}
+		if startAt, ok := data["start_at"].(float64); ok && startAt > 0 {
+			call.StartAt = time.UnixMilli(int64(startAt))
+		}
+		if call.ID == "" {
+			call.ID = fmt.Sprintf("%s-%d", channelID, call.StartAt.UnixMilli())
+		}
+		m.activeCalls.start(channelID, call)
+		var username, joinURL string
+		if ownerID := callEventString(data, "owner_id", "user_id"); ownerID != "" {
+			username = m.getServerUsername(ctx, server, ownerID)
+		}
+		if serverURL, ok := m.serverURL(server); ok && m.config().Calls.JoinLink && call.ThreadID != "" {
+			joinURL = strings.TrimRight(serverURL, "/") + "/_redirect/pl/" + call.ThreadID
+		}
+		callEvt.CallID = call.ID
+		callEvt.Timestamp = call.StartAt
+		callEvt.Text = callStartNotice(username, joinURL)
+	} else {
+		call := m.activeCalls.end(channelID)
+		var duration time.Duration
+		if call != nil {
+			callEvt.CallID = call.ID
+			duration = time.Since(call.StartAt)
+		} else {
+			callEvt.CallID = callEventString(data, "id", "call_id", "thread_id")
+		}
+		if callEvt.CallID == "" {
+			callEvt.CallID = fmt.Sprintf("%s-%d", channelID, time.Now().UnixMilli())
+		}
+		callEvt.Ended = true
+		callEvt.Text = callEndNotice(duration)
+	}
+	return callEvt
+}
+
+// registerCallWidgetHandler makes the bridge notice calls started in Matrix rooms
+func (m *MattermostConnector) registerCallWidgetHandler() {
+	if !m.config().Calls.FromMatrix {
+		return
+	}
+	mc, ok := m.Bridge.Matrix.(*matrix.Connector)
+	if !ok || mc.EventProcessor == nil {
+		log := m.moduleLog(LogModuleConnector)
+		log.Warn().Msg("Matrix connector has no event processor, calls started in Matrix won't be noticed")
+		return
+	}
+	mc.EventProcessor.PrependHandler(widgetStateEvent, m.handleCallWidget)
+}
+
+// callWidgetURL returns the link to join a call widget: the Jitsi meeting for Jitsi widgets,
+// otherwise the room, where the call can be joined from a Matrix client
+func callWidgetURL(roomID id.RoomID, content map[string]any) string {
+	if data, ok := content["data"].(map[string]any); ok {
+		domain, _ := data["domain"].(string)
+		conferenceID, _ := data["conferenceId"].(string)
+		if domain != "" && conferenceID != "" {
+			return "https://" + domain + "/" + conferenceID
+		}
+	}
+	return roomID.URI().MatrixToURL()
+}
+
+// handleCallWidget posts a message in the channel of a portal when a Matrix user adds a
+// call widget to its room
+func (m *MattermostConnector) handleCallWidget(ctx context.Context, evt *event.Event) {
+	if evt.StateKey == nil || evt.Sender == m.Bridge.Bot.GetMXID() || m.Bridge.IsGhostMXID(evt.Sender) {
+		return
+	}
+	content := evt.Content.Raw
+	widgetType, _ := content["type"].(string)
+	if !callWidgetTypes[widgetType] {
+		return
+	}
+	log := m.moduleLog(LogModuleConnector).With().Stringer("room_id", evt.RoomID).Stringer("sender", evt.Sender).Logger()
+	portal, err := m.Bridge.GetPortalByMXID(ctx, evt.RoomID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get portal of call widget")
+		return
+	} else if portal == nil || !getPortalMetadata(portal).BridgesToMattermost() {
+		return
+	}
+	name := evt.Sender.String()
+	if member, err := m.Bridge.Matrix.GetMemberInfo(ctx, evt.RoomID, evt.Sender); err == nil && member != nil && member.Displayname != "" {
+		name = member.Displayname
+	}
+	post := &model.Post{
+		ChannelId: string(portal.ID),
+		Message:   fmt.Sprintf("📞 **%s** started a call in Matrix: %s", name, callWidgetURL(evt.RoomID, content)),
+	}
+	post.AddProp("from_bridge", true)
+	if _, resp, err := m.Client.CreatePost(ctx, post); err != nil {
+		log.Err(wrapMattermostError(resp, err)).Msg("Failed to post call from Matrix")
+	}
+}
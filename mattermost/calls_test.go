@@ -0,0 +1,46 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestCallNotices(t *testing.T) {
+	assert.Equal(t, "📞 A call started", callStartNotice("", ""))
+	assert.Equal(t, "📞 **@alice** started a call ([join on Mattermost](https://mm.example.com/_redirect/pl/post1))",
+		callStartNotice("alice", "https://mm.example.com/_redirect/pl/post1"))
+	assert.Equal(t, "📞 The call ended", callEndNotice(0))
+	assert.Equal(t, "📞 The call ended after 1m30s", callEndNotice(90*time.Second+200*time.Millisecond))
+}
+
+func TestCallWidgetURL(t *testing.T) {
+	jitsi := map[string]any{"type": "jitsi", "data": map[string]any{"domain": "meet.example.com", "conferenceId": "abc"}}
+	assert.Equal(t, "https://meet.example.com/abc", callWidgetURL("!room:example.com", jitsi))
+	assert.Equal(t, "https://matrix.to/#/%21room:example.com", callWidgetURL(id.RoomID("!room:example.com"), map[string]any{"type": "m.call"}))
+}
+
+func TestCallNoticeEvent(t *testing.T) {
+	ctx := context.Background()
+	m := &MattermostConnector{Config: &NetworkConfig{ServerURL: "https://mm.example.com", Calls: CallsConfig{Notices: true, JoinLink: true}}}
+	start := model.NewWebSocketEvent(callStartEvent, "", "channel1", "", nil, "")
+	start.Add("id", "call1")
+	start.Add("thread_id", "post1")
+	start.Add("start_at", float64(time.Now().Add(-time.Minute).UnixMilli()))
+
+	startEvt := m.callNoticeEvent(ctx, "", start)
+	assert.EqualValues(t, "call:call1:start", startEvt.GetID())
+	assert.Equal(t, "channel1", startEvt.ChannelID)
+	assert.Equal(t, "📞 A call started ([join on Mattermost](https://mm.example.com/_redirect/pl/post1))", startEvt.Text)
+
+	// The end of the call says how long it lasted
+	endEvt := m.callNoticeEvent(ctx, "", model.NewWebSocketEvent(callEndEvent, "", "channel1", "", nil, ""))
+	assert.EqualValues(t, "call:call1:end", endEvt.GetID())
+	assert.Contains(t, endEvt.Text, "The call ended after 1m")
+
+	assert.Nil(t, m.callNoticeEvent(ctx, "", model.NewWebSocketEvent(callEndEvent, "", "", "", nil, "")))
+}
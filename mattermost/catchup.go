@@ -0,0 +1,228 @@
+package mattermost
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// CatchUpConfig contains settings for fetching posts that were sent while the bridge was down
+type CatchUpConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	MaxAge   int  `yaml:"max_age"` // hours
+	MaxPosts int  `yaml:"max_posts"`
+}
+
+// Defaults used when the catch-up config values are unset
+const (
+	defaultCatchUpMaxAge   = 24 * time.Hour
+	defaultCatchUpMaxPosts = 500
+)
+
+var lastPostUpgrades dbutil.UpgradeTable
+
+func init() {
+	lastPostUpgrades.Register(-1, 1, 0, "Create Mattermost last post table", dbutil.TxnModeOn, func(ctx context.Context, db *dbutil.Database) error {
+		_, err := db.Exec(ctx, `
+			CREATE TABLE mattermost_last_post (
+				bridge_id    TEXT   NOT NULL,
+				channel_id   TEXT   NOT NULL,
+				last_post_at BIGINT NOT NULL,
+
+				PRIMARY KEY (bridge_id, channel_id)
+			)
+		`)
+		return err
+	})
+}
+
+// LastPostStore stores the creation time of the newest post seen in each channel
+type LastPostStore struct {
+	bridgeID networkid.BridgeID
+	db       *dbutil.Database
+}
+
+// NewLastPostStore creates a last post store in the given database
+func NewLastPostStore(bridgeID networkid.BridgeID, db *dbutil.Database) *LastPostStore {
+	return &LastPostStore{
+		bridgeID: bridgeID,
+		db:       db.Child("mattermost_last_post_version", lastPostUpgrades, nil),
+	}
+}
+
+// Upgrade creates the table if needed
+func (s *LastPostStore) Upgrade(ctx context.Context) error {
+	return s.db.Upgrade(ctx)
+}
+
+// Set stores the creation time (in milliseconds) of a post, unless a newer one is already stored
+func (s *LastPostStore) Set(ctx context.Context, channelID string, createAt int64) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO mattermost_last_post (bridge_id, channel_id, last_post_at) VALUES ($1, $2, $3)
+		ON CONFLICT (bridge_id, channel_id) DO UPDATE SET last_post_at=excluded.last_post_at
+		WHERE mattermost_last_post.last_post_at < excluded.last_post_at
+	`, s.bridgeID, channelID, createAt)
+	return err
+}
+
+// Get returns the last post time of a channel, or 0 if no post of it was seen
+func (s *LastPostStore) Get(ctx context.Context, channelID string) (int64, error) {
+	var lastPostAt int64
+	err := s.db.QueryRow(ctx, "SELECT last_post_at FROM mattermost_last_post WHERE bridge_id=$1 AND channel_id=$2", s.bridgeID, channelID).Scan(&lastPostAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return lastPostAt, err
+}
+
+// GetAll returns the last post times of all channels, keyed by channel ID
+func (s *LastPostStore) GetAll(ctx context.Context) (map[string]int64, error) {
+	rows, err := s.db.Query(ctx, "SELECT channel_id, last_post_at FROM mattermost_last_post WHERE bridge_id=$1", s.bridgeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lastPosts := make(map[string]int64)
+	for rows.Next() {
+		var channelID string
+		var lastPostAt int64
+		if err = rows.Scan(&channelID, &lastPostAt); err != nil {
+			return nil, err
+		}
+		lastPosts[channelID] = lastPostAt
+	}
+	return lastPosts, rows.Err()
+}
+
+// recordPost remembers that a post was seen, so that catch-up starts after it
+func (m *MattermostConnector) recordPost(ctx context.Context, post *model.Post) {
+	if m.LastPosts == nil {
+		return
+	}
+	if err := m.LastPosts.Set(ctx, post.ChannelId, post.CreateAt); err != nil {
+		log := m.moduleLog(LogModuleWebSocket)
+		log.Warn().Err(err).Str("channel_id", post.ChannelId).Msg("Failed to save last post time")
+	}
+}
+
+// CatchUp queues the posts that were sent to bridged channels while the bridge was down.
+// It runs on startup before the WebSocket is connected, and when WebSocket events were
+// missed. Each channel is caught up by the event workers in the channel's queue, so its
+// missed posts are bridged before the events that are received after CatchUp returns,
+// without holding up the events of other channels. Posts older than max_age and all but
+// the newest max_posts posts of each channel are skipped.
+func (m *MattermostConnector) CatchUp(ctx context.Context) error {
+	if !m.config().CatchUp.Enabled || m.config().Mirror.DryRun {
+		return nil
+	}
+	log := m.moduleLog(LogModuleSync).With().Str("action", "catch up").Logger()
+	lastPosts, err := m.LastPosts.GetAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get last post times: %w", err)
+	}
+	if len(lastPosts) == 0 {
+		return nil
+	}
+	// Posts are queued for a login, so the logins have to be loaded before the bridge does it
+	if err = m.loadLogins(ctx); err != nil {
+		return err
+	}
+
+	maxAge := defaultCatchUpMaxAge
+	if m.config().CatchUp.MaxAge > 0 {
+		maxAge = time.Duration(m.config().CatchUp.MaxAge) * time.Hour
+	}
+	oldest := time.Now().Add(-maxAge).UnixMilli()
+	for channelID := range lastPosts {
+		if !m.ownsChannel(channelID) {
+			continue
+		}
+		m.eventWorkers.submit(channelID, func() {
+			channelCtx, cancel := m.eventContext(log)
+			defer cancel()
+			m.catchUpChannel(channelCtx, channelID, oldest)
+		})
+	}
+	log.Info().Int("channel_count", len(lastPosts)).Msg("Catching up on missed posts")
+	return nil
+}
+
+// catchUpChannel queues the posts of a bridged channel that were created after the last
+// post seen in it, but not before oldest
+func (m *MattermostConnector) catchUpChannel(ctx context.Context, channelID string, oldest int64) {
+	log := zerolog.Ctx(ctx).With().Str("channel_id", channelID).Logger()
+	portal, err := m.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{ID: networkid.PortalID(channelID)})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get portal")
+		return
+	} else if portal == nil || portal.MXID == "" || !m.isChannelMirrored(ctx, channelID) {
+		return
+	}
+	// Read when the channel's turn comes, as the events before it may have seen newer posts
+	lastPostAt, err := m.LastPosts.Get(ctx, channelID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get last post time")
+		return
+	}
+	posts, err := m.getMissedPosts(ctx, channelID, max(lastPostAt, oldest))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get missed posts")
+		return
+	}
+	for _, post := range posts {
+		m.queuePost(ctx, post)
+	}
+	if len(posts) > 0 {
+		log.Debug().Int("post_count", len(posts)).Msg("Caught up on missed posts")
+	}
+}
+
+// getMissedPosts returns the posts created in a channel after the given time in milliseconds,
+// oldest first and limited to max_posts
+func (m *MattermostConnector) getMissedPosts(ctx context.Context, channelID string, since int64) ([]*model.Post, error) {
+	list, resp, err := m.Client.GetPostsSince(ctx, channelID, since, false)
+	if err != nil {
+		return nil, wrapMattermostError(resp, err)
+	}
+	// The list also contains posts that were edited or deleted after the time
+	posts := make([]*model.Post, 0, len(list.Posts))
+	for _, post := range list.Posts {
+		if post.CreateAt > since && post.DeleteAt == 0 {
+			posts = append(posts, post)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].CreateAt < posts[j].CreateAt
+	})
+	maxPosts := m.config().CatchUp.MaxPosts
+	if maxPosts <= 0 {
+		maxPosts = defaultCatchUpMaxPosts
+	}
+	if len(posts) > maxPosts {
+		posts = posts[len(posts)-maxPosts:]
+	}
+	return posts, nil
+}
+
+// loadLogins loads all user logins of the bridge. The bridge only does it after starting
+// the connector, but catching up needs them earlier.
+func (m *MattermostConnector) loadLogins(ctx context.Context) error {
+	userIDs, err := m.Bridge.DB.UserLogin.GetAllUserIDsWithLogins(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get users with logins: %w", err)
+	}
+	for _, userID := range userIDs {
+		if _, err = m.Bridge.GetUserByMXID(ctx, userID); err != nil {
+			return fmt.Errorf("failed to load user %s: %w", userID, err)
+		}
+	}
+	return nil
+}
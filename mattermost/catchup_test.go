@@ -0,0 +1,74 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+)
+
+func TestLastPostStore_OnlyMovesForward(t *testing.T) {
+	ctx := context.Background()
+	db, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	require.NoError(t, err)
+	// Every connection to :memory: is a separate database
+	db.RawDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+
+	store := NewLastPostStore("mattermost", db)
+	require.NoError(t, store.Upgrade(ctx))
+	require.NoError(t, store.Set(ctx, "channel1", 200))
+	require.NoError(t, store.Set(ctx, "channel1", 100))
+	require.NoError(t, store.Set(ctx, "channel2", 50))
+
+	lastPosts, err := store.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"channel1": 200, "channel2": 50}, lastPosts)
+
+	lastPostAt, err := store.Get(ctx, "channel1")
+	require.NoError(t, err)
+	assert.EqualValues(t, 200, lastPostAt)
+	lastPostAt, err = store.Get(ctx, "channel3")
+	require.NoError(t, err)
+	assert.Zero(t, lastPostAt)
+}
+
+func TestGetMissedPosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v4/channels/channel1/posts", r.URL.Path)
+		require.Equal(t, "100", r.URL.Query().Get("since"))
+		list := model.NewPostList()
+		for _, post := range []*model.Post{
+			{Id: "old-edited", ChannelId: "channel1", CreateAt: 90, UpdateAt: 150},
+			{Id: "deleted", ChannelId: "channel1", CreateAt: 110, DeleteAt: 160},
+			{Id: "third", ChannelId: "channel1", CreateAt: 140},
+			{Id: "first", ChannelId: "channel1", CreateAt: 101},
+			{Id: "second", ChannelId: "channel1", CreateAt: 120},
+		} {
+			list.AddPost(post)
+			list.AddOrder(post.Id)
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	}))
+	defer server.Close()
+
+	connector := &MattermostConnector{
+		Config: &NetworkConfig{CatchUp: CatchUpConfig{Enabled: true, MaxPosts: 2}},
+		Client: NewClient(server.URL, "token"),
+	}
+	posts, err := connector.getMissedPosts(context.Background(), "channel1", 100)
+	require.NoError(t, err)
+	ids := make([]string, len(posts))
+	for i, post := range posts {
+		ids[i] = post.Id
+	}
+	// Only the newest max_posts posts are kept, oldest first
+	assert.Equal(t, []string{"second", "third"}, ids)
+}
@@ -0,0 +1,197 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// Portal IDs of category sub-spaces have this prefix, followed by the category ID
+const categoryPortalPrefix = "category:"
+
+func categoryPortalID(categoryID string) networkid.PortalID {
+	return networkid.PortalID(categoryPortalPrefix + categoryID)
+}
+
+func parseCategoryPortalID(portalID networkid.PortalID) (string, bool) {
+	return strings.CutPrefix(string(portalID), categoryPortalPrefix)
+}
+
+// channelParentID returns the portal ID of the space a channel belongs in: its sidebar
+// category sub-space if category_spaces is enabled and the channel is in a category,
+// otherwise its team space. DMs and group messages aren't part of a team and return nil.
+func (m *MattermostConnector) channelParentID(channel *model.Channel) *networkid.PortalID {
+	if channel.TeamId == "" || (channel.Type != model.ChannelTypeOpen && channel.Type != model.ChannelTypePrivate) {
+		return nil
+	}
+	if m != nil && m.config() != nil && m.config().Mirror.CategorySpaces {
+		m.categoryLock.RLock()
+		categoryID, ok := m.channelCategories[channel.Id]
+		m.categoryLock.RUnlock()
+		if ok {
+			return ptr.Ptr(categoryPortalID(categoryID))
+		}
+	}
+	return ptr.Ptr(networkid.PortalID(channel.TeamId))
+}
+
+// categoryChatInfo returns the info of a category sub-space, or nil if the category isn't known
+func (m *MattermostConnector) categoryChatInfo(categoryID string) *bridgev2.ChatInfo {
+	m.categoryLock.RLock()
+	category, ok := m.categories[categoryID]
+	m.categoryLock.RUnlock()
+	if !ok {
+		return nil
+	}
+	return &bridgev2.ChatInfo{
+		Name:     &category.DisplayName,
+		Type:     ptr.Ptr(database.RoomTypeSpace),
+		ParentID: ptr.Ptr(networkid.PortalID(category.TeamId)),
+	}
+}
+
+// updateCategories replaces the known sidebar categories of a team. It returns the
+// categories that are new or were renamed, and the channels whose category changed.
+func (m *MattermostConnector) updateCategories(teamID string, categories []*model.SidebarCategoryWithChannels) (changed []*model.SidebarCategory, movedChannels []string) {
+	m.categoryLock.Lock()
+	defer m.categoryLock.Unlock()
+	if m.categories == nil {
+		m.categories = make(map[string]*model.SidebarCategory)
+		m.channelCategories = make(map[string]string)
+	}
+
+	seen := make(map[string]bool)
+	seenChannels := make(map[string]bool)
+	for _, category := range categories {
+		// DMs and group messages aren't in team spaces, and empty categories aren't worth a space
+		if category.Type == model.SidebarCategoryDirectMessages || len(category.Channels) == 0 {
+			continue
+		}
+		seen[category.Id] = true
+		if old, ok := m.categories[category.Id]; !ok || old.DisplayName != category.DisplayName {
+			changed = append(changed, &category.SidebarCategory)
+		}
+		m.categories[category.Id] = &category.SidebarCategory
+		for _, channelID := range category.Channels {
+			seenChannels[channelID] = true
+			if m.channelCategories[channelID] != category.Id {
+				m.channelCategories[channelID] = category.Id
+				movedChannels = append(movedChannels, channelID)
+			}
+		}
+	}
+
+	for categoryID, category := range m.categories {
+		if category.TeamId == teamID && !seen[categoryID] {
+			delete(m.categories, categoryID)
+		}
+	}
+	for channelID, categoryID := range m.channelCategories {
+		if category, ok := m.categories[categoryID]; !ok || (category.TeamId == teamID && !seenChannels[channelID]) {
+			delete(m.channelCategories, channelID)
+			movedChannels = append(movedChannels, channelID)
+		}
+	}
+	return
+}
+
+// SyncCategories mirrors the sidebar categories of a team as sub-spaces of the team space,
+// and moves channel rooms to the sub-space of their category
+func (s *SyncEngine) SyncCategories(ctx context.Context, teamID string) error {
+	userID, err := s.getCategoryUserID(ctx)
+	if err != nil {
+		return err
+	}
+	etagKey := "categories:" + teamID
+	categories, resp, err := s.Connector.Client.GetSidebarCategoriesForTeamForUser(ctx, userID, teamID, s.etags[etagKey])
+	if err != nil {
+		return fmt.Errorf("failed to get sidebar categories: %w", err)
+	} else if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	changed, movedChannels := s.Connector.updateCategories(teamID, categories.Categories)
+	for _, category := range changed {
+		if s.dryRun != nil {
+			s.dryRun.Spaces = append(s.dryRun.Spaces, DryRunEntity{ID: string(categoryPortalID(category.Id)), Name: category.DisplayName})
+			continue
+		}
+		s.queueChatInfoUpdate(func(evt MattermostEvent) bridgev2.RemoteEvent {
+			evt.ChannelID = string(categoryPortalID(category.Id))
+			return &CategorySyncEvent{MattermostEvent: evt, Category: category}
+		})
+	}
+	if s.dryRun == nil {
+		for _, channelID := range movedChannels {
+			if !s.syncedChannels[channelID] {
+				continue
+			}
+			channel, _, err := s.Connector.Client.GetChannel(ctx, channelID, "")
+			if err != nil {
+				s.log.Warn().Err(err).Str("channel_id", channelID).Msg("Failed to get channel that changed category")
+				continue
+			}
+			s.queueChatInfoUpdate(func(evt MattermostEvent) bridgev2.RemoteEvent {
+				evt.ChannelID = channel.Id
+				return &ChannelSyncEvent{MattermostEvent: evt, Channel: channel}
+			})
+		}
+	}
+
+	s.etags[etagKey] = resp.Etag
+	s.log.Debug().Str("team_id", teamID).
+		Int("changed_categories", len(changed)).
+		Int("moved_channels", len(movedChannels)).
+		Msg("Synced sidebar categories")
+	return nil
+}
+
+// getCategoryUserID returns the ID of the Mattermost user whose sidebar categories are mirrored
+func (s *SyncEngine) getCategoryUserID(ctx context.Context) (string, error) {
+	if s.categoryUserID != "" {
+		return s.categoryUserID, nil
+	}
+	username := s.Connector.config().Mirror.CategoryUser
+	if username == "" {
+		s.categoryUserID = "me"
+		return s.categoryUserID, nil
+	}
+	user, err := s.Connector.Client.GetUserByUsername(ctx, username)
+	if err != nil {
+		return "", fmt.Errorf("failed to get category user %s: %w", username, err)
+	}
+	s.categoryUserID = user.Id
+	return s.categoryUserID, nil
+}
+
+// CategorySyncEvent is a synthetic event for renaming category sub-spaces. The sub-spaces
+// aren't created by it, but when the first bridged channel room is moved into them, so
+// categories without bridged channels don't get a space.
+type CategorySyncEvent struct {
+	MattermostEvent
+	Category *model.SidebarCategory
+}
+
+func (e *CategorySyncEvent) GetType() bridgev2.RemoteEventType {
+	return bridgev2.RemoteEventChatInfoChange
+}
+
+func (e *CategorySyncEvent) ShouldCreatePortal() bool {
+	return false
+}
+
+func (e *CategorySyncEvent) GetChatInfoChange(ctx context.Context) (*bridgev2.ChatInfoChange, error) {
+	return &bridgev2.ChatInfoChange{
+		ChatInfo: &bridgev2.ChatInfo{
+			Name:     &e.Category.DisplayName,
+			ParentID: ptr.Ptr(networkid.PortalID(e.Category.TeamId)),
+		},
+	}, nil
+}
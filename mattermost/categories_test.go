@@ -0,0 +1,67 @@
+package mattermost
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func testCategory(id, name string, typ model.SidebarCategoryType, channels ...string) *model.SidebarCategoryWithChannels {
+	return &model.SidebarCategoryWithChannels{
+		SidebarCategory: model.SidebarCategory{Id: id, TeamId: "team1", DisplayName: name, Type: typ},
+		Channels:        channels,
+	}
+}
+
+func TestUpdateCategories(t *testing.T) {
+	m := &MattermostConnector{Config: &NetworkConfig{Mirror: MirrorConfig{CategorySpaces: true}}}
+
+	changed, moved := m.updateCategories("team1", []*model.SidebarCategoryWithChannels{
+		testCategory("cat1", "Projects", model.SidebarCategoryCustom, "channel1", "channel2"),
+		testCategory("cat2", "Channels", model.SidebarCategoryChannels, "channel3"),
+		testCategory("cat3", "Favorites", model.SidebarCategoryFavorites),
+		testCategory("cat4", "Direct Messages", model.SidebarCategoryDirectMessages, "dm1"),
+	})
+	assert.Len(t, changed, 2)
+	assert.ElementsMatch(t, []string{"channel1", "channel2", "channel3"}, moved)
+
+	// channel2 moves to another category and cat1 is renamed
+	changed, moved = m.updateCategories("team1", []*model.SidebarCategoryWithChannels{
+		testCategory("cat1", "Active projects", model.SidebarCategoryCustom, "channel1"),
+		testCategory("cat2", "Channels", model.SidebarCategoryChannels, "channel2", "channel3"),
+	})
+	require.Len(t, changed, 1)
+	assert.Equal(t, "Active projects", changed[0].DisplayName)
+	assert.Equal(t, []string{"channel2"}, moved)
+
+	parentID := m.channelParentID(&model.Channel{Id: "channel2", TeamId: "team1", Type: model.ChannelTypeOpen})
+	require.NotNil(t, parentID)
+	assert.Equal(t, categoryPortalID("cat2"), *parentID)
+
+	// Channels in removed categories go back to the team space
+	_, moved = m.updateCategories("team1", []*model.SidebarCategoryWithChannels{
+		testCategory("cat2", "Channels", model.SidebarCategoryChannels, "channel2", "channel3"),
+	})
+	assert.Equal(t, []string{"channel1"}, moved)
+	parentID = m.channelParentID(&model.Channel{Id: "channel1", TeamId: "team1", Type: model.ChannelTypeOpen})
+	require.NotNil(t, parentID)
+	assert.Equal(t, networkid.PortalID("team1"), *parentID)
+	assert.Nil(t, m.categoryChatInfo("cat1"))
+
+	info := m.categoryChatInfo("cat2")
+	require.NotNil(t, info)
+	assert.Equal(t, "Channels", *info.Name)
+	assert.Equal(t, networkid.PortalID("team1"), *info.ParentID)
+}
+
+func TestParseCategoryPortalID(t *testing.T) {
+	categoryID, ok := parseCategoryPortalID(categoryPortalID("cat1"))
+	assert.True(t, ok)
+	assert.Equal(t, "cat1", categoryID)
+
+	_, ok = parseCategoryPortalID("channel1")
+	assert.False(t, ok)
+}
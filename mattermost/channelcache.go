@@ -0,0 +1,129 @@
+package mattermost
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// channelCacheTTL is how long cached channels are used without asking Mattermost
+const channelCacheTTL = 5 * time.Minute
+
+// channelCache caches Mattermost channels and the members of DMs and group messages, so
+// that portal resyncs don't fetch them every time. Entries older than channelCacheTTL are
+// revalidated with the channel's etag, and channel and membership events drop them. The
+// zero value is ready to use.
+type channelCache struct {
+	lock    sync.Mutex
+	entries map[string]*channelCacheEntry
+	ttl     time.Duration
+}
+
+type channelCacheEntry struct {
+	channel *model.Channel
+	etag    string
+	// members is nil until the members are fetched
+	members []*model.User
+	checked time.Time
+}
+
+func (c *channelCache) init() {
+	if c.entries == nil {
+		c.entries = make(map[string]*channelCacheEntry)
+	}
+	if c.ttl <= 0 {
+		c.ttl = channelCacheTTL
+	}
+}
+
+// get returns a cached channel and whether it was checked recently enough to use as is
+func (c *channelCache) get(channelID string) (channel *model.Channel, etag string, fresh bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.init()
+	entry, ok := c.entries[channelID]
+	if !ok {
+		return nil, "", false
+	}
+	return entry.channel, entry.etag, time.Since(entry.checked) < c.ttl
+}
+
+// set caches a channel. The members are dropped, as they're only as fresh as the channel.
+func (c *channelCache) set(channel *model.Channel, etag string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.init()
+	c.entries[channel.Id] = &channelCacheEntry{channel: channel, etag: etag, checked: time.Now()}
+}
+
+// getMembers returns the cached members of a channel, or nil if they aren't cached
+func (c *channelCache) getMembers(channelID string) []*model.User {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.init()
+	if entry, ok := c.entries[channelID]; ok && time.Since(entry.checked) < c.ttl {
+		return entry.members
+	}
+	return nil
+}
+
+// setMembers caches the members of a channel whose channel is cached
+func (c *channelCache) setMembers(channelID string, members []*model.User) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if entry, ok := c.entries[channelID]; ok {
+		entry.members = members
+	}
+}
+
+// invalidateMembers drops the cached members of a channel
+func (c *channelCache) invalidateMembers(channelID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if entry, ok := c.entries[channelID]; ok {
+		entry.members = nil
+	}
+}
+
+// invalidate removes a channel from the cache
+func (c *channelCache) invalidate(channelID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, channelID)
+}
+
+// getCachedChannel returns a channel, from the cache if it was checked recently. Older
+// entries are revalidated with their etag, which Mattermost answers without the channel if
+// it hasn't changed.
+func (m *MattermostConnector) getCachedChannel(ctx context.Context, client *Client, channelID string) (*model.Channel, error) {
+	cached, etag, fresh := m.channelCache.get(channelID)
+	if fresh {
+		return cached, nil
+	}
+	channel, resp, err := client.GetChannel(ctx, channelID, etag)
+	if err != nil {
+		return nil, wrapMattermostError(resp, err)
+	} else if resp.StatusCode == http.StatusNotModified && cached != nil {
+		channel = cached
+	} else {
+		etag = resp.Etag
+	}
+	m.channelCache.set(channel, etag)
+	return channel, nil
+}
+
+// getCachedChannelUsers returns the members of a channel, from the cache if possible
+func (m *MattermostConnector) getCachedChannelUsers(ctx context.Context, client *Client, channelID string) ([]*model.User, error) {
+	if users := m.channelCache.getMembers(channelID); users != nil {
+		return users, nil
+	}
+	users, err := m.getChannelUsers(ctx, client, channelID)
+	if err != nil {
+		return nil, err
+	}
+	m.channelCache.setMembers(channelID, users)
+	return users, nil
+}
@@ -0,0 +1,75 @@
+package mattermost
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCachedChannel(t *testing.T) {
+	var requests, notModified, userRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/channels/channel1":
+			requests++
+			if r.Header.Get("If-None-Match") == "etag1" {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Etag", "etag1")
+			_, _ = w.Write([]byte(`{"id":"channel1","display_name":"Town Square","type":"D"}`))
+		case "/api/v4/users":
+			userRequests++
+			_, _ = w.Write([]byte(`[{"id":"user1"},{"id":"user2"}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	m := &MattermostConnector{}
+	client := NewClient(server.URL, "token")
+	ctx := context.Background()
+
+	channel, err := m.getCachedChannel(ctx, client, "channel1")
+	require.NoError(t, err)
+	assert.Equal(t, "Town Square", channel.DisplayName)
+	users, err := m.getCachedChannelUsers(ctx, client, "channel1")
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+
+	// Recently checked channels and their members are served from the cache
+	_, err = m.getCachedChannel(ctx, client, "channel1")
+	require.NoError(t, err)
+	_, err = m.getCachedChannelUsers(ctx, client, "channel1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, 1, userRequests)
+
+	// Membership events drop the members
+	m.channelCache.invalidateMembers("channel1")
+	_, err = m.getCachedChannelUsers(ctx, client, "channel1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, userRequests)
+
+	// Older entries are revalidated with the etag
+	m.channelCache.ttl = time.Nanosecond
+	channel, err = m.getCachedChannel(ctx, client, "channel1")
+	require.NoError(t, err)
+	assert.Equal(t, "Town Square", channel.DisplayName)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 1, notModified)
+
+	// Invalidated channels are fetched again in full
+	m.channelCache.invalidate("channel1")
+	_, err = m.getCachedChannel(ctx, client, "channel1")
+	require.NoError(t, err)
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, 1, notModified)
+}
@@ -0,0 +1,208 @@
+package mattermost
+
+import (
+	"archive/zip"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+)
+
+// Channel archives are zip files with the full history of a channel, so that channels of a
+// server that is being shut down can be imported into Matrix later. The archive contains:
+//
+//	manifest.json         the channel and the users who posted or reacted in it
+//	posts.jsonl           one post per line with its reactions, oldest first
+//	files/<id>/data       the files of the posts
+//	files/<id>/info       their file info
+//	files/<id>/thumbnail  the thumbnail of images, if they have one
+//
+// Importing feeds the posts through the message converter and the bridge's backfill, like
+// posts fetched from the server, but reads everything from the archive.
+
+// channelArchiveVersion is the version of the archive format
+const channelArchiveVersion = 1
+
+const (
+	archiveManifestFile = "manifest.json"
+	archivePostsFile    = "posts.jsonl"
+)
+
+// ChannelArchiveManifest describes the channel an archive was exported from
+type ChannelArchiveManifest struct {
+	Version    int                    `json:"version"`
+	ExportedAt int64                  `json:"exported_at"`
+	ServerURL  string                 `json:"server_url"`
+	Channel    *model.Channel         `json:"channel"`
+	Users      map[string]*model.User `json:"users"`
+}
+
+// ArchivedPost is a post in a channel archive
+type ArchivedPost struct {
+	Post      *model.Post       `json:"post"`
+	Reactions []*model.Reaction `json:"reactions,omitempty"`
+}
+
+// ChannelArchiveStats counts what was exported or imported
+type ChannelArchiveStats struct {
+	Posts     int
+	Files     int
+	Reactions int
+}
+
+func archiveFilePath(fileID, name string) string {
+	return "files/" + fileID + "/" + name
+}
+
+// archivedUser returns the profile fields of a user that are kept in archives
+func archivedUser(user *model.User) *model.User {
+	return &model.User{
+		Id:        user.Id,
+		Username:  user.Username,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Nickname:  user.Nickname,
+		IsBot:     user.IsBot,
+	}
+}
+
+// fetchChannelPosts returns all posts of a channel, oldest first
+func fetchChannelPosts(ctx context.Context, client *Client, channelID string) ([]*model.Post, error) {
+	var posts []*model.Post
+	for page := 0; ; page++ {
+		postList, resp, err := client.GetPostsForChannel(ctx, channelID, page, maxBackfillPageSize, "", false, false)
+		if err != nil {
+			return nil, wrapMattermostError(resp, err)
+		}
+		for _, postID := range postList.Order {
+			posts = append(posts, postList.Posts[postID])
+		}
+		if len(postList.Order) < maxBackfillPageSize {
+			break
+		}
+	}
+	slices.SortStableFunc(posts, func(a, b *model.Post) int {
+		return cmp.Compare(a.CreateAt, b.CreateAt)
+	})
+	return slices.CompactFunc(posts, func(a, b *model.Post) bool {
+		return a.Id == b.Id
+	}), nil
+}
+
+// exportChannel writes the full history of a channel into an archive
+func (m *MattermostConnector) exportChannel(ctx context.Context, client *Client, channelID string, w io.Writer) (*ChannelArchiveStats, error) {
+	channel, resp, err := client.GetChannel(ctx, channelID, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channel: %w", wrapMattermostError(resp, err))
+	}
+	posts, err := fetchChannelPosts(ctx, client, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get posts: %w", err)
+	}
+	zw := zip.NewWriter(w)
+	stats := &ChannelArchiveStats{}
+	users := make(map[string]*model.User)
+	addUser := func(userID string) {
+		if _, ok := users[userID]; ok || userID == "" {
+			return
+		}
+		if user, err := m.getUser(ctx, client, userID); err == nil {
+			users[userID] = archivedUser(user)
+		} else {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("user_id", userID).Msg("Failed to get user for channel archive")
+		}
+	}
+	archived := make([]*ArchivedPost, 0, len(posts))
+	for _, post := range posts {
+		entry := &ArchivedPost{Post: post}
+		addUser(post.UserId)
+		for _, fileID := range post.FileIds {
+			if err = exportFile(ctx, client, zw, fileID); err != nil {
+				return nil, fmt.Errorf("failed to export file %s: %w", fileID, err)
+			}
+			stats.Files++
+		}
+		if post.HasReactions {
+			entry.Reactions, resp, err = client.GetReactions(ctx, post.Id)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get reactions of %s: %w", post.Id, wrapMattermostError(resp, err))
+			}
+			for _, reaction := range entry.Reactions {
+				addUser(reaction.UserId)
+			}
+			stats.Reactions += len(entry.Reactions)
+		}
+		archived = append(archived, entry)
+	}
+	stats.Posts = len(archived)
+
+	postsWriter, err := zw.Create(archivePostsFile)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(postsWriter)
+	for _, entry := range archived {
+		if err = enc.Encode(entry); err != nil {
+			return nil, err
+		}
+	}
+	manifestWriter, err := zw.Create(archiveManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewEncoder(manifestWriter).Encode(&ChannelArchiveManifest{
+		Version:    channelArchiveVersion,
+		ExportedAt: time.Now().UnixMilli(),
+		ServerURL:  client.URL,
+		Channel:    channel,
+		Users:      users,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, zw.Close()
+}
+
+// exportFile writes a file of a post, its info and its thumbnail into an archive
+func exportFile(ctx context.Context, client *Client, zw *zip.Writer, fileID string) error {
+	info, err := client.GetFileInfo(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err = writeArchiveFile(zw, archiveFilePath(fileID, "info"), infoJSON); err != nil {
+		return err
+	}
+	data, err := client.GetFile(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	if err = writeArchiveFile(zw, archiveFilePath(fileID, "data"), data); err != nil {
+		return err
+	}
+	if info.HasPreviewImage {
+		// Thumbnails only make the imported images nicer, so they're optional
+		if thumbnail, err := client.GetFileThumbnail(ctx, fileID); err == nil {
+			return writeArchiveFile(zw, archiveFilePath(fileID, "thumbnail"), thumbnail)
+		}
+	}
+	return nil
+}
+
+func writeArchiveFile(zw *zip.Writer, name string, data []byte) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
@@ -0,0 +1,82 @@
+package mattermost
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportChannel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp any
+		switch r.URL.Path {
+		case "/api/v4/channels/channel1":
+			resp = &model.Channel{Id: "channel1", Name: "town-square", DisplayName: "Town Square", Type: model.ChannelTypeOpen}
+		case "/api/v4/channels/channel1/posts":
+			resp = &model.PostList{
+				Order: []string{"post2", "post1"},
+				Posts: map[string]*model.Post{
+					"post1": {Id: "post1", ChannelId: "channel1", UserId: "user1", Message: "hello", CreateAt: 1, FileIds: []string{"file1"}},
+					"post2": {Id: "post2", ChannelId: "channel1", UserId: "user1", RootId: "post1", Message: "reply", CreateAt: 2, HasReactions: true},
+				},
+			}
+		case "/api/v4/posts/post2/reactions":
+			resp = []*model.Reaction{{UserId: "user2", PostId: "post2", EmojiName: "thumbsup", CreateAt: 3}}
+		case "/api/v4/users/user1":
+			resp = &model.User{Id: "user1", Username: "alice", Email: "alice@example.com"}
+		case "/api/v4/users/user2":
+			resp = &model.User{Id: "user2", Username: "bob", IsBot: true}
+		case "/api/v4/files/file1/info":
+			resp = &model.FileInfo{Id: "file1", Name: "cat.png", MimeType: "image/png", HasPreviewImage: true}
+		case "/api/v4/files/file1":
+			_, _ = w.Write([]byte("image data"))
+			return
+		case "/api/v4/files/file1/thumbnail":
+			_, _ = w.Write([]byte("thumbnail data"))
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	m := &MattermostConnector{}
+	var buf bytes.Buffer
+	stats, err := m.exportChannel(context.Background(), NewClient(server.URL, "token"), "channel1", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, &ChannelArchiveStats{Posts: 2, Files: 1, Reactions: 1}, stats)
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	archive, err := readChannelArchive(zr)
+	require.NoError(t, err)
+	assert.Equal(t, "Town Square", archive.Manifest.Channel.DisplayName)
+	require.Len(t, archive.Manifest.Users, 2)
+	// Only the profile is kept
+	assert.Empty(t, archive.Manifest.Users["user1"].Email)
+	require.Len(t, archive.Posts, 2)
+	assert.Equal(t, "post1", archive.Posts[0].Post.Id)
+	assert.Equal(t, "post1", archive.Posts[1].Post.RootId)
+	require.Len(t, archive.Posts[1].Reactions, 1)
+
+	client := &archiveClient{archive: archive}
+	data, info, err := client.GetFileWithInfo(context.Background(), "file1")
+	require.NoError(t, err)
+	assert.Equal(t, "image data", string(data))
+	assert.Equal(t, "cat.png", info.Name)
+	thumbnail, err := client.GetFileThumbnail(context.Background(), "file1")
+	require.NoError(t, err)
+	assert.Equal(t, "thumbnail data", string(thumbnail))
+	_, err = client.GetFile(context.Background(), "file2")
+	assert.Error(t, err)
+}
@@ -0,0 +1,233 @@
+package mattermost
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// channelArchive is an opened channel archive
+type channelArchive struct {
+	Manifest ChannelArchiveManifest
+	Posts    []*ArchivedPost
+	files    map[string]*zip.File
+}
+
+// readChannelArchive reads the manifest and posts of a channel archive
+func readChannelArchive(zr *zip.Reader) (*channelArchive, error) {
+	archive := &channelArchive{files: make(map[string]*zip.File, len(zr.File))}
+	for _, file := range zr.File {
+		archive.files[file.Name] = file
+	}
+	if err := archive.decode(archiveManifestFile, func(dec *json.Decoder) error {
+		return dec.Decode(&archive.Manifest)
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	} else if archive.Manifest.Version != channelArchiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", archive.Manifest.Version)
+	} else if archive.Manifest.Channel == nil {
+		return nil, fmt.Errorf("archive has no channel")
+	}
+	if err := archive.decode(archivePostsFile, func(dec *json.Decoder) error {
+		for dec.More() {
+			var post ArchivedPost
+			if err := dec.Decode(&post); err != nil {
+				return err
+			} else if post.Post != nil {
+				archive.Posts = append(archive.Posts, &post)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read posts: %w", err)
+	}
+	return archive, nil
+}
+
+func (a *channelArchive) open(name string) (io.ReadCloser, error) {
+	file, ok := a.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s isn't in the archive", name)
+	}
+	return file.Open()
+}
+
+func (a *channelArchive) decode(name string, fn func(dec *json.Decoder) error) error {
+	r, err := a.open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return fn(json.NewDecoder(r))
+}
+
+func (a *channelArchive) readFile(name string) ([]byte, error) {
+	r, err := a.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// archiveClient serves the files of posts from a channel archive to the message converter,
+// so that importing doesn't need the server the archive was exported from
+type archiveClient struct {
+	*MattermostAPI
+	archive *channelArchive
+}
+
+func (c *archiveClient) GetClient() *model.Client4 {
+	return nil
+}
+
+func (c *archiveClient) GetFile(ctx context.Context, fileID string) ([]byte, error) {
+	return c.archive.readFile(archiveFilePath(fileID, "data"))
+}
+
+func (c *archiveClient) GetFileInfo(ctx context.Context, fileID string) (*model.FileInfo, error) {
+	var info model.FileInfo
+	err := c.archive.decode(archiveFilePath(fileID, "info"), func(dec *json.Decoder) error {
+		return dec.Decode(&info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *archiveClient) GetFileWithInfo(ctx context.Context, fileID string) ([]byte, *model.FileInfo, error) {
+	info, err := c.GetFileInfo(ctx, fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := c.GetFile(ctx, fileID)
+	return data, info, err
+}
+
+func (c *archiveClient) GetFileThumbnail(ctx context.Context, fileID string) ([]byte, error) {
+	return c.archive.readFile(archiveFilePath(fileID, "thumbnail"))
+}
+
+func (c *archiveClient) UploadFile(ctx context.Context, data []byte, channelID, filename string) (*model.FileInfo, error) {
+	return nil, errors.New("can't upload files to a channel archive")
+}
+
+// archiveChatInfo returns the info of the room of an archived channel
+func (m *MattermostConnector) archiveChatInfo(channel *model.Channel) *bridgev2.ChatInfo {
+	info := &bridgev2.ChatInfo{
+		Name:  ptr.Ptr(channel.DisplayName),
+		Topic: ptr.Ptr(m.channelTopic(channel)),
+		Type:  ptr.Ptr(database.RoomTypeDefault),
+	}
+	switch channel.Type {
+	case model.ChannelTypeDirect:
+		info.Type = ptr.Ptr(database.RoomTypeDM)
+	case model.ChannelTypeGroup:
+		info.Type = ptr.Ptr(database.RoomTypeGroupDM)
+	}
+	return info
+}
+
+// importChannel sends the posts of a channel archive to the room of the channel, creating it
+// if needed. Posts that are already in the room are skipped, so an import that was
+// interrupted can be run again.
+func (m *MattermostConnector) importChannel(ctx context.Context, login *bridgev2.UserLogin, zr *zip.Reader) (*bridgev2.Portal, *ChannelArchiveStats, error) {
+	archive, err := readChannelArchive(zr)
+	if err != nil {
+		return nil, nil, err
+	}
+	channel := archive.Manifest.Channel
+	log := zerolog.Ctx(ctx).With().Str("channel_id", channel.Id).Logger()
+	ctx = log.WithContext(ctx)
+	portal, err := m.Bridge.GetPortalByKey(ctx, networkid.PortalKey{ID: networkid.PortalID(channel.Id)})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get portal: %w", err)
+	}
+	if portal.MXID == "" {
+		if err = portal.CreateMatrixRoom(ctx, login, m.archiveChatInfo(channel)); err != nil {
+			return nil, nil, fmt.Errorf("failed to create room: %w", err)
+		}
+	}
+	// The ghosts get their names from the archive, as the server may be gone
+	for _, user := range archive.Manifest.Users {
+		ghost, err := m.Bridge.GetGhostByID(ctx, MakeUserID(user.Id))
+		if err != nil {
+			log.Warn().Err(err).Str("user_id", user.Id).Msg("Failed to get ghost of archived user")
+			continue
+		}
+		ghost.UpdateInfo(ctx, &bridgev2.UserInfo{Name: ptr.Ptr(m.userDisplayName(user)), IsBot: &user.IsBot})
+	}
+
+	source := &bridgev2.UserLogin{Client: &archiveClient{MattermostAPI: &MattermostAPI{Connector: m}, archive: archive}}
+	stats := &ChannelArchiveStats{}
+	batch := make([]*bridgev2.BackfillMessage, 0, maxBackfillPageSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := m.backfillLimiter.wait(ctx, len(batch)); err != nil {
+			return err
+		}
+		portal.Internal().SendBackfill(ctx, login, batch, true, false, false)
+		batch = make([]*bridgev2.BackfillMessage, 0, maxBackfillPageSize)
+		return nil
+	}
+	for _, entry := range archive.Posts {
+		post := entry.Post
+		if !m.isPostTypeBridged(post.Type) || m.ignoredPostReason(post) != "" {
+			continue
+		}
+		existing, err := m.Bridge.DB.Message.GetFirstPartByID(ctx, portal.Receiver, networkid.MessageID(post.Id))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to check if post %s was imported: %w", post.Id, err)
+		} else if existing != nil {
+			continue
+		}
+		sender := bridgev2.EventSender{Sender: MakeUserID(post.UserId)}
+		intent := portal.GetIntentFor(ctx, sender, login, bridgev2.RemoteEventMessage)
+		converted := m.MsgConv.ToMatrix(ctx, portal, intent, source, post)
+		if converted == nil || len(converted.Parts) == 0 {
+			continue
+		}
+		msg := &bridgev2.BackfillMessage{
+			ConvertedMessage: converted,
+			Sender:           sender,
+			ID:               networkid.MessageID(post.Id),
+			Timestamp:        time.UnixMilli(post.CreateAt),
+		}
+		for _, reaction := range entry.Reactions {
+			msg.Reactions = append(msg.Reactions, &bridgev2.BackfillReaction{
+				Sender:    bridgev2.EventSender{Sender: MakeUserID(reaction.UserId)},
+				EmojiID:   networkid.EmojiID(reaction.EmojiName),
+				Emoji:     reaction.EmojiName,
+				Timestamp: time.UnixMilli(reaction.CreateAt),
+			})
+		}
+		batch = append(batch, msg)
+		stats.Posts++
+		stats.Files += len(post.FileIds)
+		stats.Reactions += len(entry.Reactions)
+		if len(batch) == cap(batch) {
+			if err = flush(); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return nil, nil, err
+	}
+	log.Info().Int("post_count", stats.Posts).Msg("Imported channel archive")
+	return portal, stats, nil
+}
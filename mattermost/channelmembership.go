@@ -0,0 +1,121 @@
+package mattermost
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// channelMemberships caches which logins are members of which channels, so that in puppet
+// mode the events of a channel are queued for a login that's actually in it instead of
+// whichever login sorts first. Entries older than channelCacheTTL are checked again, and
+// membership events drop the entries of their channel. The zero value is ready to use.
+type channelMemberships struct {
+	lock    sync.Mutex
+	entries map[string]map[networkid.UserLoginID]membershipEntry // ChannelId -> login -> entry
+	ttl     time.Duration
+}
+
+type membershipEntry struct {
+	member  bool
+	checked time.Time
+}
+
+// get returns whether a login is a member of a channel, and whether that's known
+func (c *channelMemberships) get(channelID string, loginID networkid.UserLoginID) (member, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ttl := c.ttl
+	if ttl <= 0 {
+		ttl = channelCacheTTL
+	}
+	entry, ok := c.entries[channelID][loginID]
+	if !ok || time.Since(entry.checked) >= ttl {
+		return false, false
+	}
+	return entry.member, true
+}
+
+// set caches whether a login is a member of a channel
+func (c *channelMemberships) set(channelID string, loginID networkid.UserLoginID, member bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]map[networkid.UserLoginID]membershipEntry)
+	}
+	if c.entries[channelID] == nil {
+		c.entries[channelID] = make(map[networkid.UserLoginID]membershipEntry)
+	}
+	c.entries[channelID][loginID] = membershipEntry{member: member, checked: time.Now()}
+}
+
+// invalidate drops the cached memberships of a channel
+func (c *channelMemberships) invalidate(channelID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, channelID)
+}
+
+// channelMemberLogins returns the IDs of the logins of a server that are members of a
+// channel, sorted. Logins whose membership can't be checked are left out.
+func (m *MattermostConnector) channelMemberLogins(ctx context.Context, server, channelID string) []networkid.UserLoginID {
+	var members []networkid.UserLoginID
+	for _, login := range m.GetUsers() {
+		if loginServer(login) != server {
+			continue
+		}
+		member, ok := m.channelMemberships.get(channelID, login.ID)
+		if !ok {
+			member, ok = m.checkChannelMember(ctx, login, channelID)
+			if !ok {
+				continue
+			}
+			m.channelMemberships.set(channelID, login.ID, member)
+		}
+		if member {
+			members = append(members, login.ID)
+		}
+	}
+	slices.Sort(members)
+	return members
+}
+
+// checkChannelMember asks Mattermost whether a login is a member of a channel. Logins can
+// only see the members of channels they're in, so being refused means they aren't one.
+func (m *MattermostConnector) checkChannelMember(ctx context.Context, login *bridgev2.UserLogin, channelID string) (member, ok bool) {
+	api, isAPI := login.Client.(*MattermostAPI)
+	if !isAPI || api.Client() == nil || api.getOwnMMID() == "" {
+		return false, false
+	}
+	_, resp, err := api.Client().GetChannelMember(ctx, channelID, api.getOwnMMID(), "")
+	switch {
+	case err == nil:
+		return true, true
+	case resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden):
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// preferredPortalLogins returns the logins that events of a portal should be queued for in
+// puppet mode, best first: the logins that are members of its channel, or else the relay
+// login of its portal
+func (m *MattermostConnector) preferredPortalLogins(ctx context.Context, key networkid.PortalKey, server string) []networkid.UserLoginID {
+	if members := m.channelMemberLogins(ctx, server, string(key.ID)); len(members) > 0 {
+		return members
+	}
+	if m.Bridge == nil || m.Bridge.DB == nil {
+		return nil
+	}
+	portal, err := m.Bridge.GetExistingPortalByKey(ctx, key)
+	if err != nil || portal == nil || portal.Relay == nil {
+		return nil
+	}
+	return []networkid.UserLoginID{portal.Relay.ID}
+}
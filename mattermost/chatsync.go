@@ -0,0 +1,124 @@
+package mattermost
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+)
+
+// ChatSyncConfig contains settings for syncing the direct and group messages of a login
+// when it connects
+type ChatSyncConfig struct {
+	// Count is the number of most recently active chats to sync, -1 syncs all of them
+	Count  int `yaml:"count"`
+	MaxAge int `yaml:"max_age"` // days
+	// SidebarTags tags rooms with the custom sidebar categories of their channels
+	SidebarTags bool `yaml:"sidebar_tags"`
+}
+
+// defaultChatSyncCount is used when the chat sync count is unset
+const defaultChatSyncCount = 20
+
+// ChatSyncEvent is a synthetic event that creates the room of a direct or group message
+// channel of a login, and backfills the posts missing from it. Unlike ChannelBackfillEvent,
+// it uses the login's own client, since only the members of a DM can read it.
+type ChatSyncEvent struct {
+	MattermostEvent
+	Client *Client
+}
+
+var (
+	_ bridgev2.RemoteChatResyncBackfill       = (*ChatSyncEvent)(nil)
+	_ bridgev2.RemoteEventThatMayCreatePortal = (*ChatSyncEvent)(nil)
+)
+
+func (e *ChatSyncEvent) GetType() bridgev2.RemoteEventType {
+	return bridgev2.RemoteEventChatResync
+}
+
+// ShouldCreatePortal lets the event create the room if it doesn't exist yet. The room is
+// created with the chat info and history from the login's GetChatInfo and FetchMessages.
+func (e *ChatSyncEvent) ShouldCreatePortal() bool {
+	return true
+}
+
+func (e *ChatSyncEvent) CheckNeedsBackfill(ctx context.Context, latestMessage *database.Message) (bool, error) {
+	channel, resp, err := e.Client.GetChannel(ctx, e.ChannelID, "")
+	if err != nil {
+		return false, wrapMattermostError(resp, err)
+	}
+	if latestMessage == nil {
+		return channel.TotalMsgCount > 0, nil
+	}
+	return channel.LastPostAt > latestMessage.Timestamp.UnixMilli(), nil
+}
+
+// isChatSyncChannel checks whether a channel is synced per login: mirror sync only covers
+// the channels of teams, so direct and group messages are synced for each of their members
+func isChatSyncChannel(channel *model.Channel) bool {
+	return channel.DeleteAt == 0 && (channel.Type == model.ChannelTypeDirect || channel.Type == model.ChannelTypeGroup)
+}
+
+// selectChatSyncChannels returns the direct and group message channels to sync, the most
+// recently active first. Chats without posts since max_age are skipped, and only the newest
+// count chats are kept.
+func selectChatSyncChannels(channels []*model.Channel, cfg ChatSyncConfig, now time.Time) []*model.Channel {
+	var cutoff int64
+	if cfg.MaxAge > 0 {
+		cutoff = now.Add(-time.Duration(cfg.MaxAge) * 24 * time.Hour).UnixMilli()
+	}
+	selected := make([]*model.Channel, 0, len(channels))
+	for _, channel := range channels {
+		if isChatSyncChannel(channel) && (cutoff == 0 || channel.LastPostAt >= cutoff) {
+			selected = append(selected, channel)
+		}
+	}
+	slices.SortStableFunc(selected, func(a, b *model.Channel) int {
+		return cmp.Compare(b.LastPostAt, a.LastPostAt)
+	})
+	count := cfg.Count
+	if count == 0 {
+		count = defaultChatSyncCount
+	}
+	if count > 0 && len(selected) > count {
+		selected = selected[:count]
+	}
+	return selected
+}
+
+// syncChats creates the rooms of the login's recently active direct and group message
+// channels and backfills their recent history. Like other DMs, their portals are shared by all members,
+// so rooms that already exist are only caught up.
+func (m *MattermostAPI) syncChats(ctx context.Context) error {
+	userID := m.getOwnMMID()
+	if userID == "" {
+		return fmt.Errorf("own Mattermost user ID is unknown")
+	}
+	channels, resp, err := m.Client().GetChannelsForUserWithLastDeleteAt(ctx, userID, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get channels: %w", wrapMattermostError(resp, err))
+	}
+	channels = selectChatSyncChannels(channels, m.Connector.config().ChatSync, time.Now())
+	for _, channel := range channels {
+		m.Connector.queueLoginEvent(m.Login, &ChatSyncEvent{
+			MattermostEvent: MattermostEvent{
+				Connector: m.Connector,
+				Timestamp: time.Now(),
+				ChannelID: channel.Id,
+				UserID:    userID,
+			},
+			Client: m.Client(),
+		})
+	}
+	m.Login.Log.Info().Int("chat_count", len(channels)).Msg("Queued sync of direct and group messages")
+	if len(channels) > 0 {
+		m.Connector.notifyStatus(ctx, "", "Syncing %d direct and group messages of %s", len(channels), m.Login.RemoteName)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package mattermost
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2/database"
+)
+
+func TestIsChatSyncChannel(t *testing.T) {
+	assert.True(t, isChatSyncChannel(&model.Channel{Type: model.ChannelTypeDirect}))
+	assert.True(t, isChatSyncChannel(&model.Channel{Type: model.ChannelTypeGroup}))
+	assert.False(t, isChatSyncChannel(&model.Channel{Type: model.ChannelTypeOpen}))
+	assert.False(t, isChatSyncChannel(&model.Channel{Type: model.ChannelTypePrivate}))
+	assert.False(t, isChatSyncChannel(&model.Channel{Type: model.ChannelTypeGroup, DeleteAt: 1}))
+}
+
+func TestSelectChatSyncChannels(t *testing.T) {
+	now := time.Now()
+	daysAgo := func(days int) int64 {
+		return now.Add(-time.Duration(days) * 24 * time.Hour).UnixMilli()
+	}
+	channels := []*model.Channel{
+		{Id: "old", Type: model.ChannelTypeDirect, LastPostAt: daysAgo(60)},
+		{Id: "open", Type: model.ChannelTypeOpen, LastPostAt: daysAgo(0)},
+		{Id: "recent", Type: model.ChannelTypeGroup, LastPostAt: daysAgo(1)},
+		{Id: "newest", Type: model.ChannelTypeDirect, LastPostAt: daysAgo(0)},
+		{Id: "week", Type: model.ChannelTypeDirect, LastPostAt: daysAgo(7)},
+	}
+	ids := func(channels []*model.Channel) (ids []string) {
+		for _, channel := range channels {
+			ids = append(ids, channel.Id)
+		}
+		return
+	}
+
+	assert.Equal(t, []string{"newest", "recent", "week", "old"}, ids(selectChatSyncChannels(channels, ChatSyncConfig{Count: -1}, now)))
+	assert.Equal(t, []string{"newest", "recent"}, ids(selectChatSyncChannels(channels, ChatSyncConfig{Count: 2}, now)))
+	assert.Equal(t, []string{"newest", "recent", "week"}, ids(selectChatSyncChannels(channels, ChatSyncConfig{MaxAge: 30}, now)))
+	assert.Equal(t, []string{"newest"}, ids(selectChatSyncChannels(channels, ChatSyncConfig{Count: 1, MaxAge: 30}, now)))
+}
+
+func TestChatSyncEvent_CheckNeedsBackfill(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/channels/dm1" || !strings.HasSuffix(r.Header.Get("Authorization"), " user-token") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"dm1","type":"D","last_post_at":2000,"total_msg_count":3}`))
+	}))
+	defer server.Close()
+
+	evt := &ChatSyncEvent{
+		MattermostEvent: MattermostEvent{ChannelID: "dm1"},
+		Client:          NewClient(server.URL, "user-token"),
+	}
+	ctx := context.Background()
+	assert.True(t, evt.ShouldCreatePortal())
+
+	needed, err := evt.CheckNeedsBackfill(ctx, nil)
+	require.NoError(t, err)
+	assert.True(t, needed)
+
+	needed, err = evt.CheckNeedsBackfill(ctx, &database.Message{Timestamp: time.UnixMilli(1000)})
+	require.NoError(t, err)
+	assert.True(t, needed)
+
+	needed, err = evt.CheckNeedsBackfill(ctx, &database.Message{Timestamp: time.UnixMilli(2000)})
+	require.NoError(t, err)
+	assert.False(t, needed)
+}
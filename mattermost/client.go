@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
 )
 
 type Client struct {
@@ -22,6 +23,12 @@ func NewClient(url, adminToken string) *Client {
 	}
 }
 
+// NewLocalClient creates a client that talks to Mattermost over its local mode Unix
+// socket. Requests on the socket don't need a token and have system admin permissions.
+func NewLocalClient(socketPath string) *Client {
+	return &Client{Client4: *model.NewAPIv4SocketClient(socketPath)}
+}
+
 func (c *Client) Connect(ctx context.Context) error {
 	// Verify connection and admin token
 	user, _, err := c.GetMe(ctx, "")
@@ -36,7 +43,10 @@ func (c *Client) Connect(ctx context.Context) error {
 		}
 	}
 	if !isSystemAdmin {
-		fmt.Printf("Warning: Admin token user %s is not a system admin (roles: %s)\n", user.Username, user.Roles)
+		zerolog.Ctx(ctx).Warn().
+			Str("username", user.Username).
+			Str("roles", user.Roles).
+			Msg("Admin token user is not a system admin")
 	}
 	return nil
 }
@@ -153,3 +163,24 @@ func (c *Client) CreateUserAccessToken(ctx context.Context, userID, description
 	token, _, err := c.Client4.CreateUserAccessToken(ctx, userID, description)
 	return token, err
 }
+
+func (c *Client) RevokeUserAccessToken(ctx context.Context, tokenID string) error {
+	_, err := c.Client4.RevokeUserAccessToken(ctx, tokenID)
+	return err
+}
+
+// GetBot retrieves a bot account by its user ID, including disabled bots
+func (c *Client) GetBot(ctx context.Context, botUserID string) (*model.Bot, error) {
+	bot, _, err := c.Client4.GetBotIncludeDeleted(ctx, botUserID, "")
+	return bot, err
+}
+
+func (c *Client) CreateBot(ctx context.Context, bot *model.Bot) (*model.Bot, error) {
+	created, _, err := c.Client4.CreateBot(ctx, bot)
+	return created, err
+}
+
+func (c *Client) EnableBot(ctx context.Context, botUserID string) (*model.Bot, error) {
+	bot, _, err := c.Client4.EnableBot(ctx, botUserID)
+	return bot, err
+}
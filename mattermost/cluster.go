@@ -0,0 +1,81 @@
+package mattermost
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// EnvInstanceID can set cluster.instance_id, e.g. to the pod name of a StatefulSet
+const EnvInstanceID = "MATTERMOST_BRIDGE_INSTANCE_ID"
+
+// ClusterConfig configures running several bridge instances against the same database.
+// Channels are spread over the instances with rendezvous hashing, and each instance only
+// handles the events, catch-up, backfill and mirror sync of its own channels, so nothing
+// is processed twice. Adding or removing an instance only moves the channels of that
+// instance. Work that isn't tied to a channel, like syncing users, is done by the instance
+// that owns the empty channel ID.
+//
+// Logins, portals and ghosts are cached in memory by each instance, and changes made by
+// one instance aren't picked up by the others until they restart. Bot token rotation is
+// disabled for that reason.
+type ClusterConfig struct {
+	InstanceID string   `yaml:"instance_id"`
+	Instances  []string `yaml:"instances"`
+}
+
+// Enabled checks whether the bridge is running with more than one instance
+func (c *ClusterConfig) Enabled() bool {
+	return len(c.Instances) > 1
+}
+
+// Validate checks that the instance ID is one of the instances, after reading it from the
+// environment if it isn't set
+func (c *ClusterConfig) Validate() error {
+	if c.InstanceID == "" {
+		c.InstanceID = os.Getenv(EnvInstanceID)
+	}
+	if !c.Enabled() {
+		return nil
+	}
+	seen := make(map[string]struct{}, len(c.Instances))
+	for _, instance := range c.Instances {
+		if _, ok := seen[instance]; ok {
+			return fmt.Errorf("duplicate instance %q in cluster.instances", instance)
+		}
+		seen[instance] = struct{}{}
+	}
+	if !slices.Contains(c.Instances, c.InstanceID) {
+		return fmt.Errorf("cluster.instance_id %q is not listed in cluster.instances", c.InstanceID)
+	}
+	return nil
+}
+
+// channelOwner returns the instance that handles a channel: the one with the highest hash
+// of the instance and channel ID
+func channelOwner(instances []string, channelID string) string {
+	var owner string
+	var best uint64
+	for _, instance := range instances {
+		hash := sha256.Sum256([]byte(instance + "\x00" + channelID))
+		if sum := binary.BigEndian.Uint64(hash[:8]); owner == "" || sum > best {
+			owner, best = instance, sum
+		}
+	}
+	return owner
+}
+
+// ownsChannel checks whether this instance handles a channel (or team)
+func (m *MattermostConnector) ownsChannel(channelID string) bool {
+	if m.config() == nil || !m.config().Cluster.Enabled() {
+		return true
+	}
+	return channelOwner(m.config().Cluster.Instances, channelID) == m.config().Cluster.InstanceID
+}
+
+// ownsGlobalTasks checks whether this instance does the work that isn't tied to a channel
+func (m *MattermostConnector) ownsGlobalTasks() bool {
+	return m.ownsChannel("")
+}
@@ -0,0 +1,62 @@
+package mattermost
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelOwner_SpreadsChannels(t *testing.T) {
+	instances := []string{"a", "b", "c"}
+	counts := map[string]int{}
+	owners := map[string]string{}
+	for i := range 300 {
+		channelID := fmt.Sprintf("channel%d", i)
+		owners[channelID] = channelOwner(instances, channelID)
+		counts[owners[channelID]]++
+	}
+	for _, instance := range instances {
+		assert.Greater(t, counts[instance], 50, "instance %s should get a share of the channels", instance)
+	}
+
+	// Removing an instance only moves its own channels
+	for channelID, owner := range owners {
+		if owner != "c" {
+			assert.Equal(t, owner, channelOwner([]string{"a", "b"}, channelID))
+		}
+	}
+}
+
+func TestClusterConfig_Validate(t *testing.T) {
+	cfg := &ClusterConfig{}
+	assert.NoError(t, cfg.Validate())
+	assert.False(t, cfg.Enabled())
+
+	cfg = &ClusterConfig{InstanceID: "a", Instances: []string{"a", "b"}}
+	assert.NoError(t, cfg.Validate())
+	assert.True(t, cfg.Enabled())
+
+	cfg = &ClusterConfig{InstanceID: "c", Instances: []string{"a", "b"}}
+	assert.Error(t, cfg.Validate())
+	cfg = &ClusterConfig{InstanceID: "a", Instances: []string{"a", "a"}}
+	assert.Error(t, cfg.Validate())
+
+	t.Setenv(EnvInstanceID, "b")
+	cfg = &ClusterConfig{Instances: []string{"a", "b"}}
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, "b", cfg.InstanceID)
+}
+
+func TestOwnsChannel(t *testing.T) {
+	connector := &MattermostConnector{Config: &NetworkConfig{}}
+	assert.True(t, connector.ownsChannel("channel1"))
+
+	connector.config().Cluster = ClusterConfig{InstanceID: "a", Instances: []string{"a", "b"}}
+	other := &MattermostConnector{Config: &NetworkConfig{Cluster: ClusterConfig{InstanceID: "b", Instances: []string{"a", "b"}}}}
+	for i := range 20 {
+		channelID := fmt.Sprintf("channel%d", i)
+		assert.NotEqual(t, connector.ownsChannel(channelID), other.ownsChannel(channelID))
+	}
+	assert.NotEqual(t, connector.ownsGlobalTasks(), other.ownsGlobalTasks())
+}
@@ -0,0 +1,160 @@
+package mattermost
+
+import (
+	"archive/zip"
+	"os"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2/commands"
+)
+
+// cmdConfig shows or changes the bridge settings of a room
+var cmdConfig = &commands.FullHandler{
+	Func: func(ce *commands.Event) {
+		ce.Reply(runConfigCommand(ce.Ctx, ce.Portal, ce.Args, ce.User.Permissions.Admin))
+	},
+	Name: "config",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "View or change the bridge settings of this room",
+		Args:        "[_setting_ _value_]",
+	},
+	RequiresPortal: true,
+}
+
+// cmdReloadConfig reloads the settings that can be changed without a restart
+func (m *MattermostConnector) cmdReloadConfig() *commands.FullHandler {
+	return &commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			changed, err := m.ReloadConfig()
+			if err != nil {
+				ce.Reply("Failed to reload config: %v", err)
+			} else if len(changed) == 0 {
+				ce.Reply("Reloaded config, nothing changed")
+			} else {
+				ce.Reply("Reloaded config, changed: %s", strings.Join(changed, ", "))
+			}
+		},
+		Name: "reload-config",
+		Help: commands.HelpMeta{
+			Section:     commands.HelpSectionAdmin,
+			Description: "Reload log levels, filters and mirror settings from the config file",
+		},
+		RequiresAdmin: true,
+	}
+}
+
+// cmdEraseUser removes the bridged data of a user, for data erasure requests
+func (m *MattermostConnector) cmdEraseUser() *commands.FullHandler {
+	return &commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			if len(ce.Args) != 1 {
+				ce.Reply("**Usage:** `$cmdprefix erase-user <Matrix ID or Mattermost user ID>`")
+				return
+			}
+			ce.Reply("Erasing %s, this may take a while", ce.Args[0])
+			report, err := m.EraseUser(ce.Ctx, ce.Args[0])
+			if err != nil {
+				ce.Reply("Failed to erase user: %v", err)
+				return
+			}
+			ce.Log.Info().Str("target", ce.Args[0]).Int("errors", len(report.Errors)).Msg("Erased user")
+			ce.Reply(report.String())
+		},
+		Name: "erase-user",
+		Help: commands.HelpMeta{
+			Section:     commands.HelpSectionAdmin,
+			Description: "Redact the bridged messages of a user, deactivate the accounts the bridge created for them and delete their data",
+			Args:        "<_Matrix ID or Mattermost user ID_>",
+		},
+		RequiresAdmin: true,
+	}
+}
+
+// cmdExportChannel writes the history of a channel into an archive on the bridge's server
+func (m *MattermostConnector) cmdExportChannel() *commands.FullHandler {
+	return &commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			if len(ce.Args) != 2 {
+				ce.Reply("**Usage:** `$cmdprefix export-channel <channel ID> <path>`")
+				return
+			}
+			file, err := os.OpenFile(ce.Args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				ce.Reply("Failed to create archive: %v", err)
+				return
+			}
+			ce.Reply("Exporting %s, this may take a while", ce.Args[0])
+			stats, err := m.exportChannel(ce.Ctx, m.Client, ce.Args[0], file)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				_ = os.Remove(ce.Args[1])
+				ce.Reply("Failed to export channel: %v", err)
+				return
+			}
+			ce.Reply("Exported %d posts, %d files and %d reactions to `%s`", stats.Posts, stats.Files, stats.Reactions, ce.Args[1])
+		},
+		Name: "export-channel",
+		Help: commands.HelpMeta{
+			Section:     commands.HelpSectionAdmin,
+			Description: "Export the posts, files and reactions of a channel into an archive that can be imported without the Mattermost server",
+			Args:        "<_channel ID_> <_path_>",
+		},
+		RequiresAdmin: true,
+	}
+}
+
+// cmdImportChannel sends the posts of a channel archive to the channel's room
+func (m *MattermostConnector) cmdImportChannel() *commands.FullHandler {
+	return &commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			if len(ce.Args) != 1 {
+				ce.Reply("**Usage:** `$cmdprefix import-channel <path>`")
+				return
+			}
+			login := ce.User.GetDefaultLogin()
+			if login == nil {
+				ce.Reply("You need to be logged in to import a channel")
+				return
+			}
+			zr, err := zip.OpenReader(ce.Args[0])
+			if err != nil {
+				ce.Reply("Failed to open archive: %v", err)
+				return
+			}
+			defer zr.Close()
+			ce.Reply("Importing `%s`, this may take a while", ce.Args[0])
+			portal, stats, err := m.importChannel(ce.Ctx, login, &zr.Reader)
+			if err != nil {
+				ce.Reply("Failed to import channel: %v", err)
+				return
+			}
+			ce.Reply("Imported %d posts, %d files and %d reactions into %s", stats.Posts, stats.Files, stats.Reactions, portal.MXID.URI().MatrixToURL())
+		},
+		Name: "import-channel",
+		Help: commands.HelpMeta{
+			Section:     commands.HelpSectionAdmin,
+			Description: "Import a channel archive into the channel's room, creating it if needed",
+			Args:        "<_path_>",
+		},
+		RequiresAdmin: true,
+	}
+}
+
+// registerCommands adds the bridge's own commands to the Matrix command processor
+func (m *MattermostConnector) registerCommands() {
+	if proc, ok := m.Bridge.Commands.(*commands.Processor); ok {
+		proc.AddHandlers(cmdConfig, cmdStatus, m.cmdReloadConfig(), m.cmdEraseUser(), m.cmdExportChannel(), m.cmdImportChannel(), m.cmdRelogin())
+		if m.config().ScheduledPosts {
+			proc.AddHandlers(m.cmdSchedule())
+		}
+		if m.config().SharedChannels.Enabled {
+			proc.AddHandlers(m.cmdSharedChannels())
+		}
+		if m.config().Stats.Enabled {
+			proc.AddHandlers(m.cmdStats())
+		}
+	}
+}
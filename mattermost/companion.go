@@ -0,0 +1,154 @@
+package mattermost
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+// CompanionConfig configures the companion Mattermost plugin (see companion-plugin/).
+// The plugin forwards events to the bridge and creates users and access tokens for it
+// in-process, so the bridge doesn't need a system admin token.
+type CompanionConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	PluginID   string `yaml:"plugin_id"`
+	Secret     string `yaml:"secret"`
+	SecretFile string `yaml:"secret_file"`
+}
+
+const (
+	defaultCompanionPluginID = "com.github.hanthor.matrix-bridge-companion"
+	companionEventsPath      = "/mattermost/companion/events"
+	// companionSecretHeader authenticates requests in both directions. Mattermost uses the
+	// Authorization header for its own sessions, so a separate header is used.
+	companionSecretHeader = "X-Bridge-Secret"
+)
+
+var ErrCompanionNoSecret = errors.New("companion.secret must be set to use the companion plugin")
+
+func (c *CompanionConfig) pluginID() string {
+	if c.PluginID != "" {
+		return c.PluginID
+	}
+	return defaultCompanionPluginID
+}
+
+// useCompanion checks whether privileged actions go through the companion plugin
+func (m *MattermostConnector) useCompanion() bool {
+	return m.config() != nil && m.config().Companion.Enabled
+}
+
+// registerCompanionEndpoint adds the endpoint the companion plugin sends events to
+func (m *MattermostConnector) registerCompanionEndpoint() error {
+	if !m.useCompanion() {
+		return nil
+	} else if m.config().Companion.Secret == "" {
+		return ErrCompanionNoSecret
+	}
+	server, ok := m.Bridge.Matrix.(bridgev2.MatrixConnectorWithServer)
+	if !ok || server.GetRouter() == nil {
+		return errors.New("the companion plugin needs the appservice HTTP server")
+	}
+	server.GetRouter().HandleFunc(companionEventsPath, m.handleCompanionEvent).Methods(http.MethodPost)
+	log := m.moduleLog(LogModuleConnector)
+	log.Info().Str("url", strings.TrimRight(server.GetPublicAddress(), "/")+companionEventsPath).Msg("Companion plugin endpoint enabled")
+	return nil
+}
+
+func (m *MattermostConnector) isCompanionSecretValid(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(m.config().Companion.Secret)) == 1
+}
+
+// handleCompanionEvent receives an event forwarded by the companion plugin. Events have
+// the same format as WebSocket events, so they're handled the same way.
+func (m *MattermostConnector) handleCompanionEvent(w http.ResponseWriter, r *http.Request) {
+	if !m.isCompanionSecretValid(r.Header.Get(companionSecretHeader)) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	event, err := model.WebSocketEventFromJSON(r.Body)
+	if err != nil || event.EventType() == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	var channelID string
+	if broadcast := event.GetBroadcast(); broadcast != nil {
+		channelID = broadcast.ChannelId
+	}
+	m.eventWorkers.submit(channelID, func() {
+		m.HandleWebSocketEvent(event)
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// callCompanion runs an action in the companion plugin
+func (m *MattermostConnector) callCompanion(ctx context.Context, action string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	url := fmt.Sprintf("%s/plugins/%s/actions/%s", strings.TrimRight(m.config().ServerURL, "/"), m.config().Companion.pluginID(), action)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(companionSecretHeader, m.config().Companion.Secret)
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to call companion plugin: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		errBody, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return fmt.Errorf("companion plugin returned HTTP %d: %s", httpResp.StatusCode, strings.TrimSpace(string(errBody)))
+	}
+	if err = json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return fmt.Errorf("failed to parse companion plugin response: %w", err)
+	}
+	return nil
+}
+
+// createUser creates a Mattermost user on a server, through the companion plugin if it's
+// enabled. The companion plugin only runs on the main server.
+func (m *MattermostConnector) createUser(ctx context.Context, server string, user *model.User) (*model.User, error) {
+	if server != "" || !m.useCompanion() {
+		client, err := m.serverAdminClient(server)
+		if err != nil {
+			return nil, err
+		}
+		return client.CreateUser(ctx, user)
+	}
+	var created model.User
+	if err := m.callCompanion(ctx, "create_user", user, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// createUserAccessToken creates a personal access token for a user of a server, through
+// the companion plugin if it's enabled
+func (m *MattermostConnector) createUserAccessToken(ctx context.Context, server, userID, description string) (*model.UserAccessToken, error) {
+	if server != "" || !m.useCompanion() {
+		client, err := m.serverAdminClient(server)
+		if err != nil {
+			return nil, err
+		}
+		return client.CreateUserAccessToken(ctx, userID, description)
+	}
+	var token model.UserAccessToken
+	req := &model.UserAccessToken{UserId: userID, Description: description}
+	if err := m.callCompanion(ctx, "create_token", req, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
@@ -0,0 +1,62 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleCompanionEvent(t *testing.T) {
+	connector := &MattermostConnector{
+		Config: &NetworkConfig{Companion: CompanionConfig{Enabled: true, Secret: "secret"}},
+		ctx:    context.Background(),
+	}
+	evt := model.NewWebSocketEvent(model.WebsocketEventTyping, "", "channel1", "", nil, "")
+	body, err := evt.ToJSON()
+	require.NoError(t, err)
+	send := func(secret, body string) int {
+		req := httptest.NewRequest(http.MethodPost, companionEventsPath, strings.NewReader(body))
+		req.Header.Set(companionSecretHeader, secret)
+		rr := httptest.NewRecorder()
+		connector.handleCompanionEvent(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send("wrong", string(body)))
+	assert.Equal(t, http.StatusBadRequest, send("secret", "{}"))
+	assert.Equal(t, http.StatusNoContent, send("secret", string(body)))
+}
+
+func TestCreateUserAccessToken_Companion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/plugins/"+defaultCompanionPluginID+"/actions/create_token", r.URL.Path)
+		if r.Header.Get(companionSecretHeader) != "secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req model.UserAccessToken
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		_ = json.NewEncoder(w).Encode(&model.UserAccessToken{Id: "token1", Token: "tok", UserId: req.UserId})
+	}))
+	defer server.Close()
+
+	connector := &MattermostConnector{Config: &NetworkConfig{
+		ServerURL: server.URL,
+		Companion: CompanionConfig{Enabled: true, Secret: "secret"},
+	}}
+	token, err := connector.createUserAccessToken(context.Background(), "", "user1", "test")
+	require.NoError(t, err)
+	assert.Equal(t, "tok", token.Token)
+	assert.Equal(t, "user1", token.UserId)
+
+	connector.config().Companion.Secret = "wrong"
+	_, err = connector.createUserAccessToken(context.Background(), "", "user1", "test")
+	assert.ErrorContains(t, err, "HTTP 401")
+}
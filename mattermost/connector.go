@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"go.mau.fi/util/configupgrade"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/hanthor/mattermost-matrix-bridge/mattermost/msgconv"
 	_ "embed"
@@ -38,44 +40,209 @@ type MirrorConfig struct {
 	CreateMatrixAccounts bool `yaml:"create_matrix_accounts"`
 	SyncHistory          bool `yaml:"sync_history"`
 	HistoryLimit         int  `yaml:"history_limit"`
+	ResyncInterval       int  `yaml:"resync_interval"` // minutes
+	DryRun               bool `yaml:"dry_run"`
+
+	DeactivateMatrixAccounts bool   `yaml:"deactivate_matrix_accounts"`
+	AccountEmails            bool   `yaml:"account_emails"`
+	ExternalIDProvider       string `yaml:"external_id_provider"`
+	SSOAccounts              bool   `yaml:"sso_accounts"`
+
+	CategorySpaces bool   `yaml:"category_spaces"`
+	CategoryUser   string `yaml:"category_user"`
+
+	// DMTag is the room tag of direct and group message rooms, empty for no tag
+	DMTag string `yaml:"dm_tag"`
+
+	Teams    FilterConfig `yaml:"teams"`
+	Channels FilterConfig `yaml:"channels"`
+	Users    FilterConfig `yaml:"users"`
+}
+
+// BotAccountsConfig contains settings for the ghosts of Mattermost bot accounts. Their
+// ghosts are always marked as bots in their profile.
+type BotAccountsConfig struct {
+	// NameSuffix is appended to the display names of bot ghosts, like " (bot)"
+	NameSuffix string `yaml:"name_suffix"`
+	// Notices makes posts of bot accounts m.notice messages
+	Notices bool `yaml:"notices"`
 }
 
 // SynapseAdminConfig contains Synapse admin API settings
 type SynapseAdminConfig struct {
-	URL   string `yaml:"url"`
-	Token string `yaml:"token"`
+	Backend            string `yaml:"backend"`
+	URL                string `yaml:"url"`
+	Token              string `yaml:"token"`
+	TokenFile          string `yaml:"token_file"`
+	RequestTimeout     int    `yaml:"request_timeout"` // seconds
+	MaxRetries         *int   `yaml:"max_retries"` // nil for the default
+	ExemptRateLimits   bool   `yaml:"exempt_rate_limits"`
+	AppserviceFallback bool   `yaml:"appservice_fallback"`
 }
 
 type NetworkConfig struct {
-	ServerURL         string             `yaml:"server_url"`
-	AdminToken        string             `yaml:"admin_token"`
-	Mode              BridgeMode         `yaml:"mode"`
-	Mirror            MirrorConfig       `yaml:"mirror"`
-	SynapseAdmin      SynapseAdminConfig `yaml:"synapse_admin"`
-	SlashCommandToken string             `yaml:"slash_command_token"`
+	ServerURL               string                  `yaml:"server_url"`
+	Servers                 map[string]ServerConfig `yaml:"servers"`
+	AdminToken              string                  `yaml:"admin_token"`
+	AdminTokenFile          string                  `yaml:"admin_token_file"`
+	AdminLoginOwner         string                  `yaml:"admin_login_owner"`
+	Mode                    BridgeMode              `yaml:"mode"`
+	Mirror                  MirrorConfig            `yaml:"mirror"`
+	SynapseAdmin            SynapseAdminConfig      `yaml:"synapse_admin"`
+	PasswordPolicy          PasswordPolicyConfig    `yaml:"password_policy"`
+	SlashCommandToken       string                  `yaml:"slash_command_token"`
+	SlashCommandTokenFile   string                  `yaml:"slash_command_token_file"`
+	SlashCommandTeams       []SlashCommandTeam      `yaml:"slash_command_teams"`
+	Media                   msgconv.MediaConfig     `yaml:"media"`
+	LogLevels               map[string]string       `yaml:"log_levels"`
+	RetryQueue              RetryQueueConfig        `yaml:"retry_queue"`
+	CatchUp                 CatchUpConfig           `yaml:"catch_up"`
+	ChatSync                ChatSyncConfig          `yaml:"chat_sync"`
+	OAuth                   OAuthConfig             `yaml:"oauth"`
+	BotTokenRotation        int                     `yaml:"bot_token_rotation"` // days
+	EventWorkers            int                     `yaml:"event_workers"`
+	Backfill                BackfillConfig          `yaml:"backfill"`
+	SystemMessages          []string                `yaml:"system_messages"`
+	ChannelTopic            string                  `yaml:"channel_topic"`
+	BotAccounts             BotAccountsConfig       `yaml:"bot_accounts"`
+	EventSource             EventSourceConfig       `yaml:"event_source"`
+	Companion               CompanionConfig         `yaml:"companion"`
+	LocalSocket             string                  `yaml:"local_socket"`
+	Ignore                  IgnoreConfig            `yaml:"ignore"`
+	Filters                 msgconv.FilterConfig    `yaml:"filters"`
+	Cluster                 ClusterConfig           `yaml:"cluster"`
+	Retention               RetentionConfig         `yaml:"retention"`
+	NotificationSync        int                     `yaml:"notification_sync"` // minutes
+	AutoProvision           bool                    `yaml:"auto_provision"`
+	AllowLoginTakeover      bool                    `yaml:"allow_login_takeover"`
+	ScheduledPosts          bool                    `yaml:"scheduled_posts"`
+	StatusRoom              string                  `yaml:"status_room"`
+	ThreadSummaries         bool                    `yaml:"thread_summaries"`
+	SharedChannels          SharedChannelsConfig    `yaml:"shared_channels"`
+	Calls                   CallsConfig             `yaml:"calls"`
+	PluginNotices           PluginNoticesConfig     `yaml:"plugin_notices"`
+	Stats                   StatsConfig             `yaml:"stats"`
+	SlashCommandPermissions SlashCommandPermissions `yaml:"slash_command_permissions"`
 }
 
 type MattermostConnector struct {
 	Bridge *bridgev2.Bridge
+	// Config is the config as it was loaded at startup. Config reloads don't change it,
+	// the settings in use are read with config().
 	Config *NetworkConfig
-	Client   *Client
-	WSClient *model.WebSocketClient
-	MsgConv  *msgconv.MessageConverter
+	// ConfigPath is the path of the config file, used to reload the config
+	ConfigPath string
+	Client     *Client
+	// LocalClient uses Mattermost's local mode socket for admin operations, nil if it isn't configured
+	LocalClient *Client
+	// WSClient is the WebSocket connection to the main server while it is connected
+	WSClient   atomic.Pointer[model.WebSocketClient]
+	MsgConv    *msgconv.MessageConverter
+	RetryQueue *RetryQueue
+	// MatrixUsers stores the Mattermost accounts the bridge created for Matrix users
+	MatrixUsers *MatrixUserStore
+	// LastPosts stores the newest post seen in each channel for catching up after downtime
+	LastPosts *LastPostStore
+	// ReactionEchoes stores the reactions sent from Matrix, so that their echoes are dropped
+	ReactionEchoes *ReactionEchoStore
+	// PendingKnocks stores the knocks of /matrix join that are waiting to be accepted
+	PendingKnocks *PendingKnockStore
+	// ScheduledPosts stores the posts Matrix users scheduled with the schedule command
+	ScheduledPosts *ScheduledPostStore
+	// SharedChannels stores the bridge's remote cluster and the channels shared with it
+	SharedChannels *SharedChannelStore
+	// Stats stores the daily message counts of stats, nil if it's disabled
+	Stats *StatsStore
+	// MatrixAdmin is the shared homeserver admin backend, nil if it isn't configured
+	MatrixAdmin HomeserverAdmin
 	
 	usersLock sync.RWMutex
 	users     map[networkid.UserLoginID]*bridgev2.UserLogin
-
-	userCacheLock sync.RWMutex
-	usernameCache map[string]string // UserId -> Username
-
-	ctx context.Context
+	// dispatcher keeps the events of each portal on one login and in order
+	dispatcher portalDispatcher
+	// eventWorkers handles WebSocket events concurrently, keeping the order within channels
+	eventWorkers eventWorkers
+	// backfillLimiter limits the concurrency and rate of backfilling, nil until Start
+	backfillLimiter *backfillLimiter
+
+	// joinVias remembers the via server each room was last joined through
+	joinVias joinViaCache
+
+	// userCache caches Mattermost users by ID, it's invalidated by user_updated events
+	userCache userCache
+	// channelCache caches channels for GetChatInfo, it's invalidated by channel and
+	// membership events
+	channelCache channelCache
+	// channelMemberships caches which logins are in which channels for routing events
+	channelMemberships channelMemberships
+	// groupMentions caches the members of mentioned groups
+	groupMentions groupMentionCache
+
+	profileSyncLock sync.Mutex
+	profileSyncs    map[profileSyncKey]time.Time // Matrix user -> last profile check
+	// customStatuses remembers the status messages set for ghosts
+	customStatuses customStatusCache
+
+	// servers are the Mattermost servers by name, the main server has an empty name
+	servers       map[string]*mattermostServer
+	stopWebSocket context.CancelFunc
+
+	// live is the config in use and the filters compiled from it, replaced as a whole by
+	// config reloads
+	live               atomic.Pointer[liveConfig]
+	filterCacheLock    sync.RWMutex
+	channelFilterCache map[string]bool // ChannelId -> mirrored
+
+	categoryLock      sync.RWMutex
+	categories        map[string]*model.SidebarCategory // CategoryId -> category
+	channelCategories map[string]string                 // ChannelId -> CategoryId
+
+	oauthLock   sync.Mutex
+	oauthLogins map[string]*SSOLogin // OAuth state -> waiting login
+
+	reloginLock sync.Mutex
+	relogins    map[id.UserID]*bridgev2.UserLogin // Matrix user -> login being renewed
+
+	// moduleLoggers caches the loggers of moduleLog
+	moduleLoggers moduleLoggers
+
+	// reloadLock makes config reloads happen one at a time
+	reloadLock sync.Mutex
+	// resyncRequests wakes up the mirror sync engine to resync everything
+	resyncRequests chan struct{}
+	// notificationSync remembers the push rules of double puppets for notification_sync
+	notificationSync notificationSync
+	// statusRoom is where operational notices are posted with status_room
+	statusRoom statusRoom
+	// threadSummaries tracks the thread summary updates waiting for threadSummaryDelay
+	threadSummaries threadSummaries
+	// activeCalls tracks the calls going on in channels for the notices of calls.notices
+	activeCalls activeCalls
+	// playbookRuns and boards track the runs and boards of plugin_notices
+	playbookRuns playbookRuns
+	boards       boardsCache
+	// statsCounter counts bridged messages until they're saved in Stats
+	statsCounter statsCounter
+
+	// ctx is the context of the running connector, events are handled in contexts derived
+	// from it. It's canceled by Stop.
+	ctx            context.Context
+	stop           context.CancelFunc
+	stopMirrorSync context.CancelFunc
 }
 
 
 
 
 func (m *MattermostConnector) GetDBMetaTypes() database.MetaTypes {
-	return database.MetaTypes{}
+	return database.MetaTypes{
+		Portal: func() any {
+			return &PortalMetadata{}
+		},
+		Message: func() any {
+			return &MessageMetadata{}
+		},
+	}
 }
 
 func (m *MattermostConnector) GetConfig() (string, any, configupgrade.Upgrader) {
@@ -85,6 +252,9 @@ func (m *MattermostConnector) GetConfig() (string, any, configupgrade.Upgrader)
 func (m *MattermostConnector) UpgradeConfig(helper configupgrade.Helper) {
 	helper.Copy(configupgrade.Str, "server_url")
 	helper.Copy(configupgrade.Str, "admin_token")
+	helper.Copy(configupgrade.Str, "admin_token_file")
+	helper.Copy(configupgrade.Str, "admin_login_owner")
+	helper.Copy(configupgrade.Map, "servers")
 	helper.Copy(configupgrade.Str, "mode")
 	
 	// Mirror mode settings
@@ -93,20 +263,157 @@ func (m *MattermostConnector) UpgradeConfig(helper configupgrade.Helper) {
 	helper.Copy(configupgrade.Bool, "mirror", "sync_all_users")
 	helper.Copy(configupgrade.Bool, "mirror", "auto_invite_users")
 	helper.Copy(configupgrade.Bool, "mirror", "create_matrix_accounts")
+	helper.Copy(configupgrade.Bool, "mirror", "deactivate_matrix_accounts")
+	helper.Copy(configupgrade.Bool, "mirror", "account_emails")
+	helper.Copy(configupgrade.Str, "mirror", "external_id_provider")
+	helper.Copy(configupgrade.Bool, "mirror", "sso_accounts")
 	helper.Copy(configupgrade.Bool, "mirror", "sync_history")
 	helper.Copy(configupgrade.Int, "mirror", "history_limit")
+	helper.Copy(configupgrade.Int, "mirror", "resync_interval")
+	helper.Copy(configupgrade.Bool, "mirror", "dry_run")
+	helper.Copy(configupgrade.Bool, "mirror", "category_spaces")
+	helper.Copy(configupgrade.Str, "mirror", "category_user")
+	helper.Copy(configupgrade.Str, "mirror", "dm_tag")
+	helper.Copy(configupgrade.List, "mirror", "teams", "allow")
+	helper.Copy(configupgrade.List, "mirror", "teams", "deny")
+	helper.Copy(configupgrade.List, "mirror", "channels", "allow")
+	helper.Copy(configupgrade.List, "mirror", "channels", "deny")
+	helper.Copy(configupgrade.List, "mirror", "users", "allow")
+	helper.Copy(configupgrade.List, "mirror", "users", "deny")
 	
 	// Synapse admin settings
+	helper.Copy(configupgrade.Str, "synapse_admin", "backend")
 	helper.Copy(configupgrade.Str, "synapse_admin", "url")
 	helper.Copy(configupgrade.Str, "synapse_admin", "token")
+	helper.Copy(configupgrade.Str, "synapse_admin", "token_file")
+	helper.Copy(configupgrade.Int, "synapse_admin", "request_timeout")
+	helper.Copy(configupgrade.Int, "synapse_admin", "max_retries")
+	helper.Copy(configupgrade.Bool, "synapse_admin", "exempt_rate_limits")
+	helper.Copy(configupgrade.Bool, "synapse_admin", "appservice_fallback")
+
+	// Password policy for created Matrix accounts
+	helper.Copy(configupgrade.Int, "password_policy", "length")
+	helper.Copy(configupgrade.Str, "password_policy", "charset")
+	helper.Copy(configupgrade.Bool, "password_policy", "deliver_via_dm")
 
 	// Slash command settings
 	helper.Copy(configupgrade.Str, "slash_command_token")
+	helper.Copy(configupgrade.Str, "slash_command_token_file")
+	helper.Copy(configupgrade.List, "slash_command_teams")
+
+	// Media settings
+	helper.Copy(configupgrade.Int, "media", "max_file_size_to_matrix")
+	helper.Copy(configupgrade.Int, "media", "max_file_size_to_mattermost")
+	helper.Copy(configupgrade.Int, "media", "link_threshold")
+	helper.Copy(configupgrade.List, "media", "allowed_mime_types")
+	helper.Copy(configupgrade.Int, "media", "long_text_file_threshold")
+
+	// Logging settings
+	helper.Copy(configupgrade.Map, "log_levels")
+
+	// Retry queue settings
+	helper.Copy(configupgrade.Bool, "retry_queue", "enabled")
+	helper.Copy(configupgrade.Int, "retry_queue", "max_attempts")
+	helper.Copy(configupgrade.Int, "retry_queue", "initial_delay")
+	helper.Copy(configupgrade.Int, "retry_queue", "max_delay")
+	helper.Copy(configupgrade.Bool, "catch_up", "enabled")
+	helper.Copy(configupgrade.Int, "catch_up", "max_age")
+	helper.Copy(configupgrade.Int, "catch_up", "max_posts")
+	helper.Copy(configupgrade.Int, "chat_sync", "count")
+	helper.Copy(configupgrade.Int, "chat_sync", "max_age")
+	helper.Copy(configupgrade.Bool, "chat_sync", "sidebar_tags")
+	helper.Copy(configupgrade.Str, "oauth", "client_id")
+	helper.Copy(configupgrade.Str, "oauth", "client_secret")
+	helper.Copy(configupgrade.Str, "oauth", "client_secret_file")
+	helper.Copy(configupgrade.Int, "bot_token_rotation")
+	helper.Copy(configupgrade.Int, "event_workers")
+	helper.Copy(configupgrade.Int, "backfill", "initial_messages")
+	helper.Copy(configupgrade.Int, "backfill", "page_size")
+	helper.Copy(configupgrade.Int, "backfill", "concurrency")
+	helper.Copy(configupgrade.Int, "backfill", "messages_per_second")
+	helper.Copy(configupgrade.List, "system_messages")
+	helper.Copy(configupgrade.Str, "channel_topic")
+	helper.Copy(configupgrade.Str, "bot_accounts", "name_suffix")
+	helper.Copy(configupgrade.Bool, "bot_accounts", "notices")
+	helper.Copy(configupgrade.Bool, "event_source", "websocket")
+	helper.Copy(configupgrade.Bool, "event_source", "webhook", "enabled")
+	helper.Copy(configupgrade.List, "event_source", "webhook", "tokens")
+	helper.Copy(configupgrade.List, "event_source", "events", "allow")
+	helper.Copy(configupgrade.List, "event_source", "events", "deny")
+	helper.Copy(configupgrade.Bool, "companion", "enabled")
+	helper.Copy(configupgrade.Str, "companion", "plugin_id")
+	helper.Copy(configupgrade.Str, "companion", "secret")
+	helper.Copy(configupgrade.Str, "companion", "secret_file")
+	helper.Copy(configupgrade.Str, "local_socket")
+	helper.Copy(configupgrade.List, "ignore", "user_ids")
+	helper.Copy(configupgrade.List, "ignore", "post_types")
+	helper.Copy(configupgrade.Bool, "ignore", "command_responses")
+	helper.Copy(configupgrade.List, "filters", "drop")
+	helper.Copy(configupgrade.Map, "filters", "replace")
+	helper.Copy(configupgrade.Int, "filters", "max_length")
+	helper.Copy(configupgrade.Map, "filters", "muted_senders")
+	helper.Copy(configupgrade.Str, "cluster", "instance_id")
+	helper.Copy(configupgrade.List, "cluster", "instances")
+	helper.Copy(configupgrade.Bool, "retention", "reconcile")
+	helper.Copy(configupgrade.Int, "retention", "max_age")
+	helper.Copy(configupgrade.Int, "retention", "interval")
+	helper.Copy(configupgrade.Int, "notification_sync")
+	helper.Copy(configupgrade.Bool, "auto_provision")
+	helper.Copy(configupgrade.Bool, "allow_login_takeover")
+	helper.Copy(configupgrade.Bool, "scheduled_posts")
+	helper.Copy(configupgrade.Str, "status_room")
+	helper.Copy(configupgrade.Bool, "thread_summaries")
+	helper.Copy(configupgrade.Bool, "shared_channels", "enabled")
+	helper.Copy(configupgrade.Str, "shared_channels", "name")
+	helper.Copy(configupgrade.Bool, "calls", "notices")
+	helper.Copy(configupgrade.Bool, "calls", "join_link")
+	helper.Copy(configupgrade.Bool, "calls", "from_matrix")
+	helper.Copy(configupgrade.Bool, "plugin_notices", "playbooks")
+	helper.Copy(configupgrade.Bool, "plugin_notices", "boards")
+	helper.Copy(configupgrade.Bool, "stats", "enabled")
+	helper.Copy(configupgrade.Int, "stats", "days")
+	helper.Copy(configupgrade.List, "slash_command_permissions", "teams")
+	helper.Copy(configupgrade.List, "slash_command_permissions", "roles")
+	helper.Copy(configupgrade.Map, "slash_command_permissions", "commands")
+}
+
+// liveConfig is the config in use and the filters compiled from it
+type liveConfig struct {
+	Config        *NetworkConfig
+	MirrorFilters *MirrorFilters
+	Filters       msgconv.Filters
+}
+
+// config returns the config in use, which may have been replaced by a reload. Before
+// Start, it's the config that was loaded.
+func (m *MattermostConnector) config() *NetworkConfig {
+	if live := m.live.Load(); live != nil {
+		return live.Config
+	}
+	return m.Config
+}
+
+// mirrorFilters returns the compiled mirror filters of the config in use, or nil if
+// nothing is filtered
+func (m *MattermostConnector) mirrorFilters() *MirrorFilters {
+	if live := m.live.Load(); live != nil {
+		return live.MirrorFilters
+	}
+	return nil
+}
+
+// MessageFilters returns the message filters of the config in use
+func (m *MattermostConnector) MessageFilters() msgconv.Filters {
+	if live := m.live.Load(); live != nil {
+		return live.Filters
+	}
+	return nil
 }
 
 // IsMirrorMode returns true if the bridge is running in mirror mode
 func (m *MattermostConnector) IsMirrorMode() bool {
-	return m.Config != nil && m.Config.Mode == ModeMirror
+	cfg := m.config()
+	return cfg != nil && cfg.Mode == ModeMirror
 }
 
 
@@ -131,7 +438,25 @@ func (m *MattermostConnector) GetName() bridgev2.BridgeName {
 func (m *MattermostConnector) Init(br *bridgev2.Bridge) {
 	m.Bridge = br
 	m.users = make(map[networkid.UserLoginID]*bridgev2.UserLogin)
-	m.MsgConv = msgconv.New(br)
+	var media msgconv.MediaConfig
+	if m.config() != nil {
+		media = m.config().Media
+	}
+	m.MsgConv = msgconv.New(br, media)
+	if m.config() != nil {
+		m.MsgConv.BotNotices = m.config().BotAccounts.Notices
+	}
+	m.MsgConv.Groups = m
+	m.MsgConv.Filters = m
+	m.registerCommands()
+}
+
+// SetMaxFileSize is called by the bridge with the homeserver's upload limit.
+// The configured limit is lowered to it, as larger files would be rejected anyway.
+func (m *MattermostConnector) SetMaxFileSize(maxSize int64) {
+	if m.MsgConv != nil && maxSize > 0 && maxSize < m.MsgConv.MaxFileSize {
+		m.MsgConv.MaxFileSize = maxSize
+	}
 }
 
 
@@ -140,52 +465,144 @@ func (m *MattermostConnector) Init(br *bridgev2.Bridge) {
 
 
 func (m *MattermostConnector) GetUsername(ctx context.Context, userID string) string {
-	m.userCacheLock.RLock()
-	if m.usernameCache == nil {
-		m.userCacheLock.RUnlock()
-		m.userCacheLock.Lock()
-		m.usernameCache = make(map[string]string)
-		m.userCacheLock.Unlock()
-		m.userCacheLock.RLock()
-	}
-	if username, ok := m.usernameCache[userID]; ok {
-		m.userCacheLock.RUnlock()
-		return username
-	}
-	m.userCacheLock.RUnlock()
+	return m.getServerUsername(ctx, "", userID)
+}
 
-	user, _, err := m.Client.GetUser(ctx, userID, "")
+// getServerUsername returns the username of a user of a server
+func (m *MattermostConnector) getServerUsername(ctx context.Context, server, userID string) string {
+	user, err := m.getUser(ctx, m.serverClient(server), userID)
 	if err != nil {
 		return userID // Fallback to ID if fetch fails
 	}
-
-	m.userCacheLock.Lock()
-	m.usernameCache[userID] = user.Username
-	m.userCacheLock.Unlock()
 	return user.Username
 }
 
 func (m *MattermostConnector) Start(ctx context.Context) error {
-	m.ctx = ctx
+	m.ctx, m.stop = context.WithCancel(ctx)
 	// Log bridge mode
-	mode := m.Config.Mode
+	mode := m.config().Mode
 	if mode == "" {
 		mode = ModePuppet // Default to puppet mode
 	}
-	fmt.Printf("INFO: Starting Mattermost bridge in %s mode\n", mode)
+	log := m.moduleLog(LogModuleConnector)
+	log.Info().Str("mode", string(mode)).Msg("Starting Mattermost bridge")
+
+	err := m.config().ResolveSecrets()
+	if err != nil {
+		return err
+	}
+	if err = m.config().Cluster.Validate(); err != nil {
+		return err
+	} else if m.config().Cluster.Enabled() {
+		log.Info().Str("instance_id", m.config().Cluster.InstanceID).Int("instances", len(m.config().Cluster.Instances)).Msg("Running as one instance of a cluster")
+	}
+	mirrorFilters, err := NewMirrorFilters(m.config().Mirror)
+	if err != nil {
+		return fmt.Errorf("invalid mirror filter: %w", err)
+	}
+	filters, err := msgconv.NewFilters(m.config().Filters)
+	if err != nil {
+		return fmt.Errorf("invalid message filter: %w", err)
+	}
+	m.live.Store(&liveConfig{Config: m.Config, MirrorFilters: mirrorFilters, Filters: filters})
+	if err = m.config().SlashCommandPermissions.Validate(); err != nil {
+		return err
+	}
+	if err = validateSlashCommandTeams(m.config().SlashCommandTeams); err != nil {
+		return err
+	}
+	if err = m.config().EventSource.Events.Validate(); err != nil {
+		return err
+	}
+	if m.config().Mirror.SSOAccounts && m.config().Mirror.ExternalIDProvider == "" {
+		return fmt.Errorf("mirror.sso_accounts needs mirror.external_id_provider to be set")
+	}
 	
-	m.Client = NewClient(m.Config.ServerURL, m.Config.AdminToken)
-	err := m.Client.Connect(ctx)
+	m.Client = NewClient(m.config().ServerURL, m.config().AdminToken)
+	err = m.Client.Connect(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to connect to Mattermost: %w", err)
 	}
+	if err = m.connectLocalSocket(ctx); err != nil {
+		return err
+	}
+	if err = m.setupServers(ctx); err != nil {
+		return err
+	}
+
+	if err = m.MigrateDB(ctx); err != nil {
+		return err
+	}
 
-	m.StartWebSocket()
+	m.MatrixAdmin, err = NewHomeserverAdmin(m.Bridge, m.config().SynapseAdmin)
+	if err != nil {
+		return fmt.Errorf("failed to set up homeserver admin: %w", err)
+	} else if m.MatrixAdmin == nil && m.config().SynapseAdmin.AppserviceFallback {
+		log := m.moduleLog(LogModuleConnector)
+		log.Info().Msg("Homeserver admin API isn't configured, using the appservice API with ghosts as Matrix accounts")
+		m.MatrixAdmin = NewAppserviceAdmin(m.Bridge)
+	}
+
+	if m.config().Mirror.DryRun {
+		// A dry run only logs what the mirror sync would create, so nothing that bridges
+		// events, logs in or changes anything on either side is started
+		log.Info().Msg("Dry run: not starting event sources, background tasks or automatic logins")
+		if m.IsMirrorMode() {
+			go m.startMirrorSync(m.ctx)
+		}
+		return nil
+	}
+
+	if m.config().RetryQueue.Enabled {
+		m.RetryQueue = NewRetryQueue(m, m.Bridge.DB.Database, m.config().RetryQueue)
+		if err = m.RetryQueue.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start retry queue: %w", err)
+		}
+	}
+
+	m.backfillLimiter = newBackfillLimiter(m.config().Backfill)
+	m.registerOAuthCallback()
+	if err = m.CatchUp(ctx); err != nil {
+		log.Err(err).Msg("Failed to catch up on missed posts")
+	}
+	m.eventWorkers.start(ctx, m.config().EventWorkers)
+	if m.config().EventSource.WebSocket {
+		m.StartWebSocket()
+	}
+	if err = m.registerWebhookEndpoint(); err != nil {
+		return fmt.Errorf("failed to set up outgoing webhooks: %w", err)
+	}
+	if err = m.registerCompanionEndpoint(); err != nil {
+		return fmt.Errorf("failed to set up companion plugin: %w", err)
+	}
+	if err = m.registerSharedChannelsEndpoint(); err != nil {
+		return fmt.Errorf("failed to set up shared channels: %w", err)
+	}
+	m.registerErasureEndpoint()
+	m.registerStatsEndpoint()
+	m.registerAutoProvisioning()
+	m.registerKnockHandler()
+	m.registerCallWidgetHandler()
+	if m.config().Cluster.Enabled() {
+		// The other instances would keep using the revoked token, as they only load
+		// logins on startup
+		if m.config().BotTokenRotation > 0 {
+			log.Warn().Msg("Bot token rotation is disabled when running several instances")
+		}
+	} else {
+		go m.runBotTokenRotation(ctx, time.Duration(m.config().BotTokenRotation)*24*time.Hour)
+	}
+	go m.runRetention(ctx)
+	go m.runNotificationSync(ctx)
+	go m.runStats(ctx)
 	
 	// Mirror mode: start server sync engine
 	if m.IsMirrorMode() {
-		fmt.Printf("INFO: Mirror mode enabled - will sync all teams/channels/users\n")
-		go m.startMirrorSync(ctx)
+		log.Info().Msg("Mirror mode enabled - will sync all teams/channels/users")
+		var syncCtx context.Context
+		syncCtx, m.stopMirrorSync = context.WithCancel(ctx)
+		m.resyncRequests = make(chan struct{}, 1)
+		go m.startMirrorSync(syncCtx)
 	}
 	
 	// Auto-login sysadmin if no users are logged in
@@ -195,56 +612,23 @@ func (m *MattermostConnector) Start(ctx context.Context) error {
 		userCount := len(m.users)
 		m.usersLock.RUnlock()
 		
-		if userCount == 0 && m.Config.AdminToken != "" {
-			fmt.Printf("DEBUG: Auto-provisioning sysadmin login\n")
-			me, _, err := m.Client.GetMe(ctx, "")
-			if err == nil {
-				// Get or create the user via the bridge's API
-				// We now use the username for the ghost ID to make MXIDs readable
-				ghost, err := m.Bridge.GetGhostByID(ctx, networkid.UserID(me.Username))
-				if err != nil {
-					fmt.Printf("DEBUG: Failed to get ghost for auto-login: %v\n", err)
-					return
-				}
-				mxid := ghost.Intent.GetMXID()
-				user, err := m.Bridge.GetUserByMXID(ctx, mxid)
-				if err != nil {
-					fmt.Printf("DEBUG: Failed to get user: %v\n", err)
-					return
-				}
-				
-				// Create login via bridge's user management
-				loginID := networkid.UserLoginID(me.Username)
-				login, err := user.NewLogin(ctx, &database.UserLogin{
-					ID:         loginID,
-					BridgeID:   m.Bridge.ID,
-					UserMXID:   user.MXID,
-					RemoteName: me.Username,
-					Metadata: map[string]any{
-						"token": m.Config.AdminToken,
-						"mm_id": me.Id,
-					},
-				}, nil)
-				if err != nil {
-					fmt.Printf("DEBUG: Failed to create login: %v\n", err)
-					return
-				}
-				
-				err = m.LoadUserLogin(ctx, login)
-				if err != nil {
-					fmt.Printf("DEBUG: Failed to load auto-login: %v\n", err)
-				} else {
-					fmt.Printf("DEBUG: Successfully auto-provisioned sysadmin login\n")
-				}
+		if userCount == 0 && m.config().AdminToken != "" && m.ownsGlobalTasks() {
+			log.Debug().Msg("Auto-provisioning sysadmin login")
+			login, err := m.provisionAdminLogin(ctx)
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to auto-provision sysadmin login")
 			} else {
-				fmt.Printf("DEBUG: Failed to get sysadmin info for auto-login: %v\n", err)
+				log.Info().Str("login_id", string(login.ID)).Stringer("user_mxid", login.UserMXID).Msg("Auto-provisioned sysadmin login")
 			}
 		}
 	}()
 
+	go m.watchReloadSignal(ctx)
+
 	// Start slash command HTTP handler (listens on port 8081)
 	go m.startSlashCommandServer()
 	
+	m.notifyStatusAsync("", "Bridge started in %s mode", mode)
 	return nil
 }
 
@@ -252,19 +636,39 @@ func (m *MattermostConnector) Start(ctx context.Context) error {
 
 
 func (m *MattermostConnector) Stop() {
+	if m.ctx != nil {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(m.ctx), 5*time.Second)
+		m.notifyStatus(ctx, "", "Bridge is shutting down")
+		cancel()
+	}
 	// Stop background processes
+	if m.stop != nil {
+		m.stop()
+	}
+	if m.stopMirrorSync != nil {
+		m.stopMirrorSync()
+	}
+	if m.RetryQueue != nil {
+		m.RetryQueue.Stop()
+	}
+	if m.stopWebSocket != nil {
+		m.stopWebSocket()
+	}
 }
 
 // startSlashCommandServer starts an HTTP server for handling Mattermost slash commands.
 // It listens on port 8081 by default.
 func (m *MattermostConnector) startSlashCommandServer() {
-	handler := NewSlashCommandHandler(m, m.Config.SlashCommandToken)
+	handler := NewSlashCommandHandler(m, m.config().SlashCommandToken)
+	handler.Teams = m.config().SlashCommandTeams
 	
 	mux := http.NewServeMux()
-	mux.Handle("/mattermost/command", handler)
+	mux.Handle(slashCommandPath, handler)
+	mux.HandleFunc(slashActionPath, handler.ServeAction)
 	
-	addr := ":8081"
-	fmt.Printf("INFO: Starting slash command server on %s\n", addr)
+	addr := fmt.Sprintf(":%d", slashCommandPort)
+	log := m.moduleLog(LogModuleSlashCmd)
+	log.Info().Str("address", addr).Msg("Starting slash command server")
 	
 	server := &http.Server{
 		Addr:    addr,
@@ -272,7 +676,7 @@ func (m *MattermostConnector) startSlashCommandServer() {
 	}
 	
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		fmt.Printf("ERROR: Slash command server failed: %v\n", err)
+		log.Err(err).Msg("Slash command server failed")
 	}
 }
 
@@ -292,22 +696,59 @@ func (m *MattermostConnector) LoadUserLogin(ctx context.Context, login *bridgev2
 
 
 func (m *MattermostConnector) GetLoginFlows() []bridgev2.LoginFlow {
-	return []bridgev2.LoginFlow{
+	flows := []bridgev2.LoginFlow{
 		{
 			ID: "personal-access-token",
 			Name: "Personal Access Token",
 			Description: "Login using a Mattermost Personal Access Token",
 		},
 	}
+	flows = append(flows, bridgev2.LoginFlow{
+		ID:          "bot",
+		Name:        "Bot account",
+		Description: "Login as a Mattermost bot account, for relay-only setups (bridge admins only)",
+	})
+	flows = append(flows, m.serverLoginFlows()...)
+	if m.oauthRedirectURL() != "" {
+		flows = append(flows, bridgev2.LoginFlow{
+			ID:          "sso",
+			Name:        "Single sign-on",
+			Description: "Login through Mattermost in your browser, including GitLab, OpenID Connect and SAML accounts",
+		})
+	}
+	return flows
 }
 
 func (m *MattermostConnector) CreateLogin(ctx context.Context, user *bridgev2.User, flowID string) (bridgev2.LoginProcess, error) {
+	relogin := m.takeRelogin(user.MXID)
 	if flowID == "personal-access-token" {
 		return &PATLogin{
 			user:      user,
 			connector: m,
+			relogin:   relogin,
 		}, nil
 
+	} else if flowID == "bot" {
+		return &BotLogin{
+			user:      user,
+			connector: m,
+		}, nil
+	} else if flowID == "sso" {
+		if m.oauthRedirectURL() == "" {
+			return nil, ErrOAuthNotConfigured
+		}
+		return &SSOLogin{
+			user:      user,
+			connector: m,
+			relogin:   relogin,
+		}, nil
+	} else if server, ok := m.serverForLoginFlow(flowID); ok {
+		return &PATLogin{
+			user:      user,
+			connector: m,
+			server:    server,
+			relogin:   relogin,
+		}, nil
 	}
 	return nil, fmt.Errorf("unknown login flow ID: %s", flowID)
 }
@@ -318,7 +759,8 @@ func (m *MattermostConnector) GetBridgeInfoVersion() (info, capabilities int) {
 }
 
 func (m *MattermostConnector) NewNetworkAPI(login *bridgev2.UserLogin) (bridgev2.NetworkAPI, error) {
-	fmt.Printf("DEBUG: NewNetworkAPI called for login %s\n", login.ID)
+	log := m.moduleLog(LogModuleConnector)
+	log.Debug().Str("login_id", string(login.ID)).Msg("Creating network API for login")
 	api := &MattermostAPI{
 		Login:     login,
 		Connector: m,
@@ -333,13 +775,13 @@ func (m *MattermostConnector) NewNetworkAPI(login *bridgev2.UserLogin) (bridgev2
 		meta, ok := login.Metadata.(map[string]any)
 		if ok {
 			if token, ok := meta["token"].(string); ok && token != "" {
-				api.Client = NewClient(m.Config.ServerURL, token)
+				api.setClient(api.newLoginClient(token))
 			}
 		}
 	}
 
-	if api.Client == nil {
-		api.Client = m.Client
+	if api.Client() == nil {
+		api.setClient(m.serverClient(loginServer(login)))
 	}
 	return api, nil
 }
@@ -1,9 +1,15 @@
 package mattermost
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"net/http"
 	"testing"
 
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/msgconv"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
@@ -24,9 +30,10 @@ func TestMattermostConnector_GetLoginFlows(t *testing.T) {
 	connector := &MattermostConnector{}
 	flows := connector.GetLoginFlows()
 
-	assert.Len(t, flows, 1)
+	assert.Len(t, flows, 2)
 	assert.Equal(t, "personal-access-token", flows[0].ID)
 	assert.Equal(t, "Personal Access Token", flows[0].Name)
+	assert.Equal(t, "bot", flows[1].ID)
 }
 
 func TestMattermostConnector_CreateLogin(t *testing.T) {
@@ -47,3 +54,83 @@ func TestMattermostConnector_CreateLogin(t *testing.T) {
 	_, err = connector.CreateLogin(context.Background(), user, "invalid-flow")
 	assert.Error(t, err)
 }
+
+func TestMattermostConnector_ModuleLogLevels(t *testing.T) {
+	var buf bytes.Buffer
+	connector := &MattermostConnector{
+		Bridge: &bridgev2.Bridge{Log: zerolog.New(&buf).Level(zerolog.TraceLevel)},
+		Config: &NetworkConfig{
+			LogLevels: map[string]string{
+				LogModuleSync:      "WARN",
+				LogModuleWebSocket: "not-a-level",
+			},
+		},
+	}
+
+	syncLog := connector.moduleLog(LogModuleSync)
+	syncLog.Info().Msg("hidden")
+	assert.Empty(t, buf.String())
+	syncLog.Warn().Msg("shown")
+	assert.Contains(t, buf.String(), `"module":"sync"`)
+	assert.Contains(t, buf.String(), "shown")
+
+	// Invalid and missing levels fall back to the bridge logger's level
+	buf.Reset()
+	wsLog := connector.moduleLog(LogModuleWebSocket)
+	assert.Contains(t, buf.String(), "Invalid log level")
+	buf.Reset()
+	wsLog.Debug().Msg("ws debug")
+	assert.Contains(t, buf.String(), "ws debug")
+
+	// Loggers are cached, so the invalid level is only warned about once
+	buf.Reset()
+	connector.moduleLog(LogModuleWebSocket)
+	assert.Empty(t, buf.String())
+	connector.moduleLoggers.reset()
+	connector.moduleLog(LogModuleWebSocket)
+	assert.Contains(t, buf.String(), "Invalid log level")
+
+	buf.Reset()
+	cmdLog := connector.moduleLog(LogModuleSlashCmd)
+	cmdLog.Debug().Msg("cmd debug")
+	assert.Contains(t, buf.String(), `"module":"slashcmd"`)
+}
+
+func TestMattermostConnector_DoAsUserOnlyRefreshesOnAuthError(t *testing.T) {
+	connector := &MattermostConnector{}
+	client := NewClient("https://mattermost.example.com", "token")
+
+	calls := 0
+	resp, err := connector.DoAsUser(context.Background(), "", "@alice:example.com", client, func(c *Client) (*model.Response, error) {
+		calls++
+		assert.Same(t, client, c)
+		return &model.Response{StatusCode: http.StatusForbidden}, errors.New("forbidden")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	_, err = connector.DoAsUser(context.Background(), "", "@alice:example.com", client, func(c *Client) (*model.Response, error) {
+		calls++
+		return &model.Response{StatusCode: http.StatusCreated}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestMattermostAPI_GetCapabilities(t *testing.T) {
+	api := &MattermostAPI{Connector: &MattermostConnector{
+		MsgConv: &msgconv.MessageConverter{MaxFileSizeToMattermost: 1024},
+	}}
+	caps := api.GetCapabilities(context.Background(), nil)
+
+	assert.True(t, caps.Threads)
+	assert.False(t, caps.Replies)
+	assert.True(t, caps.Edits)
+	assert.True(t, caps.Deletes)
+	assert.True(t, caps.Reactions)
+	assert.True(t, caps.Captions)
+	assert.Equal(t, 16383, caps.MaxTextLength)
+	assert.Equal(t, int64(1024), caps.DefaultFileRestriction.MaxSize)
+}
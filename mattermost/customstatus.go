@@ -0,0 +1,208 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+// Custom statuses of Mattermost users are bridged as the presence status message of their
+// ghosts, like ":coffee: Out for lunch". Emojis are kept as Mattermost emoji names, like
+// reactions are.
+
+// emojiNamePattern matches a Mattermost emoji name in colons
+var emojiNamePattern = regexp.MustCompile(`^:([a-z0-9_+-]+):$`)
+
+// customStatusMessage formats a custom status as a Matrix status message. Expired and
+// empty statuses are empty.
+func customStatusMessage(cs *model.CustomStatus, now time.Time) string {
+	if cs == nil || customStatusExpired(cs, now) {
+		return ""
+	}
+	var parts []string
+	if cs.Emoji != "" {
+		parts = append(parts, ":"+cs.Emoji+":")
+	}
+	if text := strings.TrimSpace(cs.Text); text != "" {
+		parts = append(parts, text)
+	}
+	return strings.Join(parts, " ")
+}
+
+// customStatusExpired checks whether a custom status with an expiry time has expired.
+// Statuses that don't expire have no duration.
+func customStatusExpired(cs *model.CustomStatus, now time.Time) bool {
+	return cs.Duration != "" && !cs.ExpiresAt.IsZero() && !cs.ExpiresAt.After(now)
+}
+
+// presenceForStatus converts a Mattermost user status to a Matrix presence
+func presenceForStatus(status string) event.Presence {
+	switch status {
+	case model.StatusOnline:
+		return event.PresenceOnline
+	case model.StatusAway, model.StatusDnd:
+		return event.PresenceUnavailable
+	default:
+		return event.PresenceOffline
+	}
+}
+
+// customStatusCache remembers the status message last set for each ghost, so that it's
+// only sent to the homeserver when it changes
+type customStatusCache struct {
+	lock     sync.Mutex
+	messages map[networkid.UserID]string
+}
+
+// swap stores the status message of a ghost and returns whether it changed. Ghosts seen
+// for the first time without a status are left alone.
+func (c *customStatusCache) swap(ghostID networkid.UserID, msg string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.messages == nil {
+		c.messages = make(map[networkid.UserID]string)
+	}
+	prev, ok := c.messages[ghostID]
+	c.messages[ghostID] = msg
+	return prev != msg || (!ok && msg != "")
+}
+
+// clearIf forgets the status message of a ghost if it's still msg, and returns whether it was
+func (c *customStatusCache) clearIf(ghostID networkid.UserID, msg string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.messages[ghostID] != msg {
+		return false
+	}
+	c.messages[ghostID] = ""
+	return true
+}
+
+// syncCustomStatus sets the status message of a ghost to the custom status of its
+// Mattermost user if it changed, and clears it again when the status expires
+func (m *MattermostConnector) syncCustomStatus(ctx context.Context, client *Client, ghost *bridgev2.Ghost, user *model.User) {
+	cs := user.GetCustomStatus()
+	msg := customStatusMessage(cs, time.Now())
+	if !m.customStatuses.swap(ghost.ID, msg) {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Str("mm_user_id", user.Id).Logger()
+	presence := event.PresenceOnline
+	if status, resp, err := client.GetUserStatus(ctx, user.Id, ""); err != nil {
+		log.Debug().Err(wrapMattermostError(resp, err)).Msg("Failed to get user status for presence")
+	} else {
+		presence = presenceForStatus(status.Status)
+	}
+	if err := setGhostStatusMessage(ctx, ghost, presence, msg); err != nil {
+		log.Warn().Err(err).Msg("Failed to set custom status of ghost")
+		return
+	}
+	if msg != "" && cs.Duration != "" && !cs.ExpiresAt.IsZero() {
+		time.AfterFunc(time.Until(cs.ExpiresAt), func() {
+			if m.customStatuses.clearIf(ghost.ID, msg) {
+				if err := setGhostStatusMessage(ctx, ghost, presence, ""); err != nil {
+					log.Warn().Err(err).Msg("Failed to clear expired custom status of ghost")
+				}
+			}
+		})
+	}
+}
+
+// setGhostStatusMessage sets the presence and status message of a ghost
+func setGhostStatusMessage(ctx context.Context, ghost *bridgev2.Ghost, presence event.Presence, msg string) error {
+	intent := asIntent(ghost.Intent)
+	if intent == nil {
+		return fmt.Errorf("ghost intent is not an appservice intent")
+	}
+	if err := intent.EnsureRegistered(ctx); err != nil {
+		return err
+	}
+	req := struct {
+		Presence  event.Presence `json:"presence"`
+		StatusMsg string         `json:"status_msg"`
+	}{presence, msg}
+	_, err := intent.MakeRequest(ctx, http.MethodPut, intent.BuildClientURL("v3", "presence", intent.UserID, "status"), req, nil)
+	return err
+}
+
+// parseCustomStatusArgs parses the arguments of the status command: an optional duration,
+// an optional emoji name in colons and the status text
+func parseCustomStatusArgs(args []string, now time.Time) (*model.CustomStatus, error) {
+	cs := &model.CustomStatus{}
+	if len(args) > 0 {
+		if d, err := time.ParseDuration(args[0]); err == nil {
+			if d <= 0 {
+				return nil, fmt.Errorf("the duration must be positive")
+			}
+			cs.Duration = "date_and_time"
+			cs.ExpiresAt = now.Add(d)
+			args = args[1:]
+		}
+	}
+	if len(args) > 0 {
+		if match := emojiNamePattern.FindStringSubmatch(args[0]); match != nil {
+			cs.Emoji = match[1]
+			args = args[1:]
+		}
+	}
+	cs.Text = strings.Join(args, " ")
+	if cs.Emoji == "" && cs.Text == "" {
+		return nil, fmt.Errorf("the status needs an emoji or text")
+	}
+	if len([]rune(cs.Text)) > model.CustomStatusTextMaxRunes {
+		return nil, fmt.Errorf("the status text can't be longer than %d characters", model.CustomStatusTextMaxRunes)
+	}
+	return cs, nil
+}
+
+// cmdStatus sets or clears the Mattermost custom status of the user's login
+var cmdStatus = &commands.FullHandler{
+	Func: func(ce *commands.Event) {
+		if len(ce.Args) == 0 {
+			ce.Reply("**Usage:** `$cmdprefix status [duration] [:emoji:] <text>` or `$cmdprefix status clear`")
+			return
+		}
+		api, ok := ce.User.GetDefaultLogin().Client.(*MattermostAPI)
+		if !ok || api.Client() == nil {
+			ce.Reply("You're not logged in to Mattermost")
+			return
+		}
+		mmUserID := api.getOwnMMID()
+		if len(ce.Args) == 1 && strings.ToLower(ce.Args[0]) == "clear" {
+			if resp, err := api.Client().RemoveUserCustomStatus(ce.Ctx, mmUserID); err != nil {
+				ce.Reply("Failed to clear custom status: %v", wrapMattermostError(resp, err))
+			} else {
+				ce.Reply("Cleared your custom status")
+			}
+			return
+		}
+		cs, err := parseCustomStatusArgs(ce.Args, time.Now())
+		if err != nil {
+			ce.Reply("Invalid status: %v", err)
+			return
+		}
+		if _, resp, err := api.Client().UpdateUserCustomStatus(ce.Ctx, mmUserID, cs); err != nil {
+			ce.Reply("Failed to set custom status: %v", wrapMattermostError(resp, err))
+		} else {
+			ce.Reply("Set your custom status to %s", customStatusMessage(cs, time.Now()))
+		}
+	},
+	Name: "status",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Set or clear your custom status on Mattermost, optionally for a duration like 1h30m",
+		Args:        "[_duration_] [_:emoji:_] <_text_> | clear",
+	},
+	RequiresLogin: true,
+}
@@ -0,0 +1,68 @@
+package mattermost
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestCustomStatusMessage(t *testing.T) {
+	now := time.Now()
+	assert.Empty(t, customStatusMessage(nil, now))
+	assert.Equal(t, ":coffee: Out for lunch", customStatusMessage(&model.CustomStatus{Emoji: "coffee", Text: "Out for lunch"}, now))
+	assert.Equal(t, "In a meeting", customStatusMessage(&model.CustomStatus{Text: " In a meeting "}, now))
+	assert.Equal(t, ":palm_tree:", customStatusMessage(&model.CustomStatus{
+		Emoji: "palm_tree", Duration: "date_and_time", ExpiresAt: now.Add(time.Hour),
+	}, now))
+	assert.Empty(t, customStatusMessage(&model.CustomStatus{
+		Emoji: "palm_tree", Duration: "one_hour", ExpiresAt: now.Add(-time.Minute),
+	}, now), "expired statuses are cleared")
+}
+
+func TestPresenceForStatus(t *testing.T) {
+	assert.Equal(t, event.PresenceOnline, presenceForStatus(model.StatusOnline))
+	assert.Equal(t, event.PresenceUnavailable, presenceForStatus(model.StatusAway))
+	assert.Equal(t, event.PresenceUnavailable, presenceForStatus(model.StatusDnd))
+	assert.Equal(t, event.PresenceOffline, presenceForStatus(model.StatusOffline))
+}
+
+func TestCustomStatusCache(t *testing.T) {
+	var cache customStatusCache
+	assert.False(t, cache.swap("user1", ""), "new ghosts without a status are left alone")
+	assert.True(t, cache.swap("user1", ":coffee: Lunch"))
+	assert.False(t, cache.swap("user1", ":coffee: Lunch"))
+	assert.True(t, cache.swap("user2", ":house: WFH"))
+
+	assert.False(t, cache.clearIf("user1", ":coffee: Old"), "the status changed since")
+	assert.True(t, cache.clearIf("user1", ":coffee: Lunch"))
+	assert.True(t, cache.swap("user1", ":coffee: Lunch"))
+}
+
+func TestParseCustomStatusArgs(t *testing.T) {
+	now := time.Now()
+	cs, err := parseCustomStatusArgs([]string{"1h30m", ":coffee:", "Out", "for", "lunch"}, now)
+	require.NoError(t, err)
+	assert.Equal(t, "coffee", cs.Emoji)
+	assert.Equal(t, "Out for lunch", cs.Text)
+	assert.Equal(t, "date_and_time", cs.Duration)
+	assert.Equal(t, now.Add(90*time.Minute), cs.ExpiresAt)
+
+	cs, err = parseCustomStatusArgs([]string{"Focusing"}, now)
+	require.NoError(t, err)
+	assert.Empty(t, cs.Emoji)
+	assert.Empty(t, cs.Duration)
+	assert.Equal(t, "Focusing", cs.Text)
+
+	cs, err = parseCustomStatusArgs([]string{":house:"}, now)
+	require.NoError(t, err)
+	assert.Equal(t, "house", cs.Emoji)
+
+	_, err = parseCustomStatusArgs([]string{"2h"}, now)
+	assert.Error(t, err)
+	_, err = parseCustomStatusArgs([]string{"-5m", "Back soon"}, now)
+	assert.Error(t, err)
+}
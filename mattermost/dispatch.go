@@ -0,0 +1,215 @@
+package mattermost
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// portalDispatcher keeps the events of each portal in order. The bridge handles a portal's
+// events in the order they're queued, but the WebSocket, catching up and the sync engine
+// queue events from different goroutines, and queueing them for different logins would
+// let edits, deletions and reactions race the messages they refer to. So every portal
+// sticks to one login and events are queued one at a time per portal.
+type portalDispatcher struct {
+	lock   sync.Mutex
+	logins map[networkid.PortalKey]networkid.UserLoginID
+	queues map[networkid.PortalKey]*sync.Mutex
+
+	// queue is swapped out in tests, which don't have a running bridge to queue events in
+	queue func(login *bridgev2.UserLogin, evt bridgev2.RemoteEvent)
+}
+
+// portalQueue returns the lock that orders the events of a portal
+func (d *portalDispatcher) portalQueue(key networkid.PortalKey) *sync.Mutex {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.queues == nil {
+		d.queues = make(map[networkid.PortalKey]*sync.Mutex)
+	}
+	queue, ok := d.queues[key]
+	if !ok {
+		queue = &sync.Mutex{}
+		d.queues[key] = queue
+	}
+	return queue
+}
+
+// portalLogin returns the login that events of a portal of the main server are queued for.
+// The first login (by ID) is picked, and kept until it's logged out.
+func (m *MattermostConnector) portalLogin(key networkid.PortalKey) *bridgev2.UserLogin {
+	return m.serverPortalLogin(key, "")
+}
+
+// serverPortalLogin returns the login for a portal of a server, picking one of the
+// server's logins if the portal doesn't have one yet
+func (m *MattermostConnector) serverPortalLogin(key networkid.PortalKey, server string) *bridgev2.UserLogin {
+	return m.pickPortalLogin(key, server, nil)
+}
+
+// pickPortalLogin returns the login for a portal of a server. The portal keeps its login
+// unless preferred (in order of preference) is set and doesn't contain it, then it moves to
+// the first preferred login, or the first login of the server if none of them is logged in.
+func (m *MattermostConnector) pickPortalLogin(key networkid.PortalKey, server string, preferred []networkid.UserLoginID) *bridgev2.UserLogin {
+	m.usersLock.RLock()
+	defer m.usersLock.RUnlock()
+	d := &m.dispatcher
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if loginID, ok := d.logins[key]; ok && (len(preferred) == 0 || slices.Contains(preferred, loginID)) {
+		if login, ok := m.users[loginID]; ok && loginServer(login) == server {
+			return login
+		}
+	}
+	var picked networkid.UserLoginID
+	for _, loginID := range preferred {
+		if login, ok := m.users[loginID]; ok && loginServer(login) == server {
+			picked = loginID
+			break
+		}
+	}
+	if picked == "" {
+		loginIDs := make([]networkid.UserLoginID, 0, len(m.users))
+		for loginID, login := range m.users {
+			if loginServer(login) == server {
+				loginIDs = append(loginIDs, loginID)
+			}
+		}
+		if len(loginIDs) == 0 {
+			return nil
+		}
+		picked = slices.Min(loginIDs)
+	}
+	if d.logins == nil {
+		d.logins = make(map[networkid.PortalKey]networkid.UserLoginID)
+	}
+	d.logins[key] = picked
+	return m.users[picked]
+}
+
+// queueRemoteEvent queues an event for the login of its portal. In puppet mode, that's a
+// login that's a member of the portal's channel, or else the portal's relay login. It
+// returns false if no user is logged in. Events of portals handled by another instance of
+// the cluster are dropped, as that instance queues them itself.
+func (m *MattermostConnector) queueRemoteEvent(evt bridgev2.RemoteEvent) bool {
+	key := evt.GetPortalKey()
+	if !m.ownsChannel(string(key.ID)) {
+		return true
+	}
+	queue := m.dispatcher.portalQueue(key)
+	queue.Lock()
+	defer queue.Unlock()
+	var preferred []networkid.UserLoginID
+	if !m.IsMirrorMode() {
+		ctx, cancel := m.eventContext(m.moduleLog(LogModuleConnector))
+		preferred = m.preferredPortalLogins(ctx, key, eventServer(evt))
+		cancel()
+	}
+	login := m.pickPortalLogin(key, eventServer(evt), preferred)
+	if login == nil {
+		return false
+	}
+	m.dispatch(login, evt)
+	if evt.GetType() == bridgev2.RemoteEventMessage {
+		m.countMessage(StatsFromMattermost)
+	}
+	return true
+}
+
+// dispatch hands an event to the bridge
+func (m *MattermostConnector) dispatch(login *bridgev2.UserLogin, evt bridgev2.RemoteEvent) {
+	if m.dispatcher.queue != nil {
+		m.dispatcher.queue(login, evt)
+		return
+	}
+	m.Bridge.QueueRemoteEvent(login, evt)
+}
+
+// queueLoginEvent queues an event for a specific login instead of the login of its
+// portal, for events that only concern that login, like its room tags
+func (m *MattermostConnector) queueLoginEvent(login *bridgev2.UserLogin, evt bridgev2.RemoteEvent) {
+	key := evt.GetPortalKey()
+	if !m.ownsChannel(string(key.ID)) {
+		return
+	}
+	queue := m.dispatcher.portalQueue(key)
+	queue.Lock()
+	defer queue.Unlock()
+	m.dispatch(login, evt)
+}
+
+// defaultEventWorkers is the number of workers used when event_workers isn't set
+const defaultEventWorkers = 8
+
+// eventWorkers handles events from Mattermost with a pool of workers. Handling an event
+// can involve API calls and file transfers, so one slow event shouldn't hold up the
+// others, but the events of a channel are still handled one at a time and in order: each
+// channel has its own queue, and only one worker at a time takes events from it.
+type eventWorkers struct {
+	lock    sync.Mutex
+	pending map[string][]func()
+	ready   chan string
+}
+
+// start starts the workers, which stop when the context is canceled. Until it's called,
+// events are handled synchronously.
+func (w *eventWorkers) start(ctx context.Context, count int) {
+	if count <= 0 {
+		count = defaultEventWorkers
+	}
+	w.lock.Lock()
+	w.pending = make(map[string][]func())
+	w.ready = make(chan string, 1024)
+	ready := w.ready
+	w.lock.Unlock()
+	for range count {
+		go w.run(ctx, ready)
+	}
+}
+
+// submit queues a handler in the queue of a channel
+func (w *eventWorkers) submit(channelID string, handler func()) {
+	w.lock.Lock()
+	if w.ready == nil {
+		w.lock.Unlock()
+		handler()
+		return
+	}
+	queue, active := w.pending[channelID]
+	w.pending[channelID] = append(queue, handler)
+	ready := w.ready
+	w.lock.Unlock()
+	// A channel with a non-empty queue is already ready or being handled by a worker
+	if !active {
+		ready <- channelID
+	}
+}
+
+func (w *eventWorkers) run(ctx context.Context, ready chan string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case channelID := <-ready:
+			for handler := w.next(channelID); handler != nil; handler = w.next(channelID) {
+				handler()
+			}
+		}
+	}
+}
+
+// next takes the next handler from the queue of a channel, or removes the queue if it's empty
+func (w *eventWorkers) next(channelID string) func() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	queue := w.pending[channelID]
+	if len(queue) == 0 {
+		delete(w.pending, channelID)
+		return nil
+	}
+	w.pending[channelID] = queue[1:]
+	return queue[0]
+}
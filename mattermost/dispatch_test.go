@@ -0,0 +1,120 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/mmtest"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestPortalLogin_StaysOnSameLogin(t *testing.T) {
+	newLogin := func(loginID networkid.UserLoginID) *bridgev2.UserLogin {
+		return &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: loginID}}
+	}
+	connector := &MattermostConnector{users: map[networkid.UserLoginID]*bridgev2.UserLogin{}}
+	channel1 := networkid.PortalKey{ID: "channel1"}
+	assert.Nil(t, connector.portalLogin(channel1))
+
+	connector.users["bob"] = newLogin("bob")
+	connector.users["carol"] = newLogin("carol")
+	assert.Equal(t, networkid.UserLoginID("bob"), connector.portalLogin(channel1).ID)
+
+	// A new login that sorts first doesn't take over the portal
+	connector.users["alice"] = newLogin("alice")
+	for range 10 {
+		assert.Equal(t, networkid.UserLoginID("bob"), connector.portalLogin(channel1).ID)
+	}
+	assert.Equal(t, networkid.UserLoginID("alice"), connector.portalLogin(networkid.PortalKey{ID: "channel2"}).ID)
+
+	// The portal moves on when its login is logged out
+	delete(connector.users, "bob")
+	assert.Equal(t, networkid.UserLoginID("alice"), connector.portalLogin(channel1).ID)
+}
+
+func TestEventWorkers_KeepsChannelOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var workers eventWorkers
+	workers.start(ctx, 4)
+
+	var lock sync.Mutex
+	handled := make(map[string][]int)
+	var wg sync.WaitGroup
+	for i := range 100 {
+		channelID := fmt.Sprintf("channel%d", i%3)
+		wg.Add(1)
+		workers.submit(channelID, func() {
+			defer wg.Done()
+			lock.Lock()
+			handled[channelID] = append(handled[channelID], i)
+			lock.Unlock()
+		})
+	}
+	wg.Wait()
+
+	require.Len(t, handled, 3)
+	for channelID, order := range handled {
+		assert.True(t, slices.IsSorted(order), "events of %s were handled out of order", channelID)
+	}
+}
+
+func TestEventWorkers_SynchronousBeforeStart(t *testing.T) {
+	var workers eventWorkers
+	handled := false
+	workers.submit("channel", func() { handled = true })
+	assert.True(t, handled)
+}
+
+func TestQueueRemoteEvent_RoutesToChannelMember(t *testing.T) {
+	ctx := context.Background()
+	server := mmtest.NewServer(t)
+	alice, bob := &model.User{Username: "alice"}, &model.User{Username: "bob"}
+	aliceToken, bobToken := server.AddUser(alice), server.AddUser(bob)
+	channel := server.AddChannel(&model.Channel{Name: "town-square"}, bob.Id)
+	empty := server.AddChannel(&model.Channel{Name: "off-topic"})
+	mirrored := server.AddChannel(&model.Channel{Name: "mirrored"}, bob.Id)
+
+	connector := &MattermostConnector{Config: &NetworkConfig{ServerURL: server.URL}}
+	addTestLogin(connector, "alice", "@alice:example.com", map[string]any{"mm_id": alice.Id, "token": aliceToken})
+	addTestLogin(connector, "bob", "@bob:example.com", map[string]any{"mm_id": bob.Id, "token": bobToken})
+	var queuedFor []networkid.UserLoginID
+	connector.dispatcher.queue = func(login *bridgev2.UserLogin, evt bridgev2.RemoteEvent) {
+		queuedFor = append(queuedFor, login.ID)
+	}
+	queue := func(channelID string) networkid.UserLoginID {
+		t.Helper()
+		require.True(t, connector.queueRemoteEvent(&MattermostMessageEvent{
+			MattermostEvent: MattermostEvent{Connector: connector, ChannelID: channelID},
+		}))
+		return queuedFor[len(queuedFor)-1]
+	}
+
+	// Events go to the login that's in the channel, not the one that sorts first
+	assert.Equal(t, networkid.UserLoginID("bob"), queue(channel.Id))
+	// Without a member or a relay, the first login is used
+	assert.Equal(t, networkid.UserLoginID("alice"), queue(empty.Id))
+
+	// The portal moves on when its login leaves the channel
+	admin := model.NewAPIv4Client(server.URL)
+	admin.SetToken(server.AdminToken)
+	_, _, err := admin.AddChannelMember(ctx, channel.Id, alice.Id)
+	require.NoError(t, err)
+	_, err = admin.RemoveUserFromChannel(ctx, channel.Id, bob.Id)
+	require.NoError(t, err)
+	assert.Equal(t, networkid.UserLoginID("bob"), queue(channel.Id), "memberships are cached")
+	connector.channelMemberships.invalidate(channel.Id)
+	assert.Equal(t, networkid.UserLoginID("alice"), queue(channel.Id))
+
+	// Mirror mode doesn't check memberships
+	connector.config().Mode = ModeMirror
+	assert.Equal(t, networkid.UserLoginID("alice"), queue(mirrored.Id))
+}
@@ -0,0 +1,116 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DoctorStatus is the result of a doctor check
+type DoctorStatus string
+
+const (
+	DoctorOK   DoctorStatus = "ok"
+	DoctorWarn DoctorStatus = "warn"
+	DoctorFail DoctorStatus = "fail"
+)
+
+// DoctorCheck is the result of one connectivity or permission check
+type DoctorCheck struct {
+	Name   string
+	Status DoctorStatus
+	Detail string
+}
+
+func (c DoctorCheck) String() string {
+	return fmt.Sprintf("[%s] %s: %s", strings.ToUpper(string(c.Status)), c.Name, c.Detail)
+}
+
+// Doctor checks that the bridge can reach Mattermost and the homeserver admin API with the
+// configured tokens, and that the tokens have the permissions the configured features
+// need. It doesn't change anything, so it can be run next to a running bridge.
+func (m *MattermostConnector) Doctor(ctx context.Context) []DoctorCheck {
+	if err := m.config().ResolveSecrets(); err != nil {
+		return []DoctorCheck{{"Secrets", DoctorFail, err.Error()}}
+	}
+	checks := m.doctorMattermost(ctx, "Mattermost", m.config().ServerURL, m.config().AdminToken, true)
+	for name, cfg := range m.config().Servers {
+		checks = append(checks, m.doctorMattermost(ctx, "Mattermost server "+name, cfg.URL, cfg.AdminToken, false)...)
+	}
+	if m.config().LocalSocket != "" {
+		check := DoctorCheck{Name: "Local mode socket", Status: DoctorOK, Detail: m.config().LocalSocket}
+		if _, resp, err := NewLocalClient(m.config().LocalSocket).GetPing(ctx); err != nil {
+			check.Status, check.Detail = DoctorFail, wrapMattermostError(resp, err).Error()
+		}
+		checks = append(checks, check)
+	}
+	return append(checks, m.doctorHomeserverAdmin(ctx))
+}
+
+// doctorMattermost checks a Mattermost server and its admin token
+func (m *MattermostConnector) doctorMattermost(ctx context.Context, name, url, token string, needsAdmin bool) []DoctorCheck {
+	client := NewClient(url, token)
+	if _, resp, err := client.GetPing(ctx); err != nil {
+		return []DoctorCheck{{name, DoctorFail, fmt.Sprintf("can't reach %s: %v", url, wrapMattermostError(resp, err))}}
+	}
+	checks := []DoctorCheck{{name, DoctorOK, "reachable at " + url}}
+	if token == "" {
+		status := DoctorOK
+		if needsAdmin {
+			status = DoctorFail
+		}
+		return append(checks, DoctorCheck{name + " token", status, "no admin token configured"})
+	}
+	me, _, err := client.GetMe(ctx, "")
+	if err != nil {
+		return append(checks, DoctorCheck{name + " token", DoctorFail, err.Error()})
+	}
+	checks = append(checks, DoctorCheck{name + " token", DoctorOK, "authenticated as " + me.Username})
+	if !needsAdmin {
+		return checks
+	}
+
+	isAdmin := slices.Contains(strings.Fields(me.Roles), "system_admin")
+	switch {
+	case isAdmin:
+		checks = append(checks, DoctorCheck{name + " permissions", DoctorOK, "token user is a system admin"})
+	case m.config().LocalSocket != "" || m.useCompanion():
+		checks = append(checks, DoctorCheck{name + " permissions", DoctorOK, "token user isn't a system admin, admin operations use local mode or the companion plugin"})
+	default:
+		checks = append(checks, DoctorCheck{name + " permissions", DoctorWarn, "token user isn't a system admin, creating users and tokens for Matrix users will fail"})
+	}
+	if m.IsMirrorMode() {
+		check := DoctorCheck{name + " mirror mode", DoctorOK, "can list teams and users"}
+		if _, _, err := client.GetAllTeams(ctx, "", 0, 1); err != nil {
+			check.Status, check.Detail = DoctorFail, "can't list teams: "+err.Error()
+		} else if _, _, err = client.GetUsers(ctx, 0, 1, ""); err != nil {
+			check.Status, check.Detail = DoctorFail, "can't list users: "+err.Error()
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// doctorHomeserverAdmin checks the homeserver admin API by looking up the bridge bot
+func (m *MattermostConnector) doctorHomeserverAdmin(ctx context.Context) DoctorCheck {
+	const name = "Homeserver admin API"
+	admin, err := NewHomeserverAdmin(m.Bridge, m.config().SynapseAdmin)
+	if err != nil {
+		return DoctorCheck{name, DoctorFail, err.Error()}
+	} else if admin == nil && m.config().SynapseAdmin.AppserviceFallback {
+		return DoctorCheck{name, DoctorOK, "not configured, using the appservice API with ghosts as Matrix accounts"}
+	} else if admin == nil {
+		return DoctorCheck{name, DoctorWarn, "not configured, Matrix accounts can't be created for Mattermost users"}
+	} else if _, ok := admin.(*AppserviceAdmin); ok {
+		return DoctorCheck{name, DoctorOK, "using the appservice API only"}
+	}
+	bot := m.Bridge.Bot.GetMXID()
+	exists, err := admin.UserExists(ctx, bot)
+	if err != nil {
+		return DoctorCheck{name, DoctorFail, err.Error()}
+	} else if !exists {
+		return DoctorCheck{name, DoctorWarn, fmt.Sprintf("reachable, but the bridge bot %s doesn't exist yet", bot)}
+	}
+	return DoctorCheck{name, DoctorOK, "reachable at " + m.config().SynapseAdmin.URL}
+}
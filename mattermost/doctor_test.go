@@ -0,0 +1,57 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoctorMattermost(t *testing.T) {
+	roles := "system_user"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/system/ping":
+			_ = json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
+		case "/api/v4/users/me":
+			if !strings.EqualFold(r.Header.Get("Authorization"), "Bearer token") {
+				w.WriteHeader(http.StatusUnauthorized)
+				_ = json.NewEncoder(w).Encode(model.NewAppError("", "api.context.session_expired.app_error", nil, "", http.StatusUnauthorized))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(&model.User{Id: "admin1", Username: "admin", Roles: roles})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	connector := &MattermostConnector{Config: &NetworkConfig{}}
+	statuses := func(checks []DoctorCheck) map[string]DoctorStatus {
+		result := make(map[string]DoctorStatus)
+		for _, check := range checks {
+			result[check.Name] = check.Status
+		}
+		return result
+	}
+
+	checks := statuses(connector.doctorMattermost(context.Background(), "Mattermost", server.URL, "token", true))
+	assert.Equal(t, DoctorOK, checks["Mattermost"])
+	assert.Equal(t, DoctorOK, checks["Mattermost token"])
+	assert.Equal(t, DoctorWarn, checks["Mattermost permissions"])
+
+	roles = "system_user system_admin"
+	checks = statuses(connector.doctorMattermost(context.Background(), "Mattermost", server.URL, "token", true))
+	assert.Equal(t, DoctorOK, checks["Mattermost permissions"])
+
+	checks = statuses(connector.doctorMattermost(context.Background(), "Mattermost", server.URL, "wrong", true))
+	assert.Equal(t, DoctorFail, checks["Mattermost token"])
+
+	checks = statuses(connector.doctorMattermost(context.Background(), "Mattermost", "http://127.0.0.1:1", "token", true))
+	assert.Equal(t, DoctorFail, checks["Mattermost"])
+}
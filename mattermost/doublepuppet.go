@@ -0,0 +1,60 @@
+package mattermost
+
+import (
+	"context"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// Double puppeting makes messages a logged-in user sends on Mattermost appear on Matrix
+// from their own Matrix account instead of their ghost. The bridge sets it up automatically
+// for users whose homeserver has a shared secret (or an "as_token:" appservice token for
+// MSC2778-style appservice login) in double_puppet.secrets of the bridge config, so users
+// don't have to provide their access token.
+
+// canDoublePuppet checks whether messages of a login's Mattermost user should be sent
+// with the double puppet of the login's Matrix user. Bot logins and logins owned by
+// ghosts (like the auto-provisioned admin login) aren't the same person on both sides.
+func (m *MattermostConnector) canDoublePuppet(login *bridgev2.UserLogin) bool {
+	if meta, ok := login.Metadata.(map[string]any); !ok || meta["bot"] == true {
+		return false
+	}
+	if m.Bridge != nil && m.Bridge.Matrix != nil {
+		if _, isGhost := m.Bridge.Matrix.ParseGhostMXID(login.UserMXID); isGhost {
+			return false
+		}
+	}
+	return true
+}
+
+// loginIDForMMUser returns the ID of the login of a Mattermost user whose messages can be
+// double puppeted, or an empty ID if there is none
+func (m *MattermostConnector) loginIDForMMUser(mmUserID string) networkid.UserLoginID {
+	if m == nil || mmUserID == "" {
+		return ""
+	}
+	m.usersLock.RLock()
+	defer m.usersLock.RUnlock()
+	for loginID, login := range m.users {
+		meta, ok := login.Metadata.(map[string]any)
+		if ok && meta["mm_id"] == mmUserID && m.canDoublePuppet(login) {
+			return loginID
+		}
+	}
+	return ""
+}
+
+// setupDoublePuppet logs in the double puppet of a login's Matrix user when the login
+// connects, so that problems with the shared secret show up right away
+func (m *MattermostAPI) setupDoublePuppet(ctx context.Context) {
+	if m.Login.User == nil || !m.Connector.canDoublePuppet(m.Login) {
+		return
+	}
+	log := m.Connector.moduleLog(LogModuleConnector)
+	if m.Login.User.DoublePuppet(ctx) != nil {
+		log.Debug().Stringer("user_mxid", m.Login.UserMXID).Msg("Double puppeting enabled for login")
+	} else {
+		log.Debug().Stringer("user_mxid", m.Login.UserMXID).Msg("No double puppeting for login, its homeserver has no shared secret")
+	}
+}
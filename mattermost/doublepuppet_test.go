@@ -0,0 +1,28 @@
+package mattermost
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestLoginIDForMMUser(t *testing.T) {
+	newLogin := func(loginID string, meta map[string]any) *bridgev2.UserLogin {
+		return &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: networkid.UserLoginID(loginID), Metadata: meta}}
+	}
+	connector := &MattermostConnector{users: map[networkid.UserLoginID]*bridgev2.UserLogin{
+		"alice":    newLogin("alice", map[string]any{"mm_id": "user1"}),
+		"relaybot": newLogin("relaybot", map[string]any{"mm_id": "bot1", "bot": true}),
+	}}
+
+	assert.Equal(t, networkid.UserLoginID("alice"), connector.loginIDForMMUser("user1"))
+	assert.Empty(t, connector.loginIDForMMUser("bot1"), "bot logins aren't double puppeted")
+	assert.Empty(t, connector.loginIDForMMUser("user2"))
+	assert.Empty(t, connector.loginIDForMMUser(""))
+
+	evt := &MattermostEvent{Connector: connector, UserID: "user1", Username: "alice"}
+	assert.Equal(t, networkid.UserLoginID("alice"), evt.GetSender().SenderLogin)
+}
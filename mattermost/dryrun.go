@@ -0,0 +1,98 @@
+package mattermost
+
+import (
+	"context"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+// DryRunReport collects what a mirror sync would create, when it runs in dry-run mode
+type DryRunReport struct {
+	Spaces   []DryRunEntity
+	Rooms    []DryRunEntity
+	Ghosts   []DryRunEntity
+	Accounts []id.UserID
+	Joins    []DryRunJoin
+}
+
+// DryRunEntity is a Mattermost team, channel or user that would be bridged
+type DryRunEntity struct {
+	ID   string
+	Name string
+}
+
+// DryRunJoin is a Matrix account that would be joined to a space or room
+type DryRunJoin struct {
+	UserID   id.UserID
+	PortalID string
+}
+
+// Log writes the report, one line per planned action followed by a summary
+func (r *DryRunReport) Log(log zerolog.Logger) {
+	for _, space := range r.Spaces {
+		log.Info().Str("team_id", space.ID).Str("team_name", space.Name).Msg("Dry run: would create space")
+	}
+	for _, room := range r.Rooms {
+		log.Info().Str("channel_id", room.ID).Str("channel_name", room.Name).Msg("Dry run: would create room")
+	}
+	for _, ghost := range r.Ghosts {
+		log.Info().Str("mm_user_id", ghost.ID).Str("username", ghost.Name).Msg("Dry run: would create ghost")
+	}
+	for _, mxid := range r.Accounts {
+		log.Info().Stringer("mxid", mxid).Msg("Dry run: would create Matrix account")
+	}
+	for _, join := range r.Joins {
+		log.Info().Stringer("mxid", join.UserID).Str("portal_id", join.PortalID).Msg("Dry run: would join Matrix account")
+	}
+	log.Info().
+		Int("spaces", len(r.Spaces)).
+		Int("rooms", len(r.Rooms)).
+		Int("ghosts", len(r.Ghosts)).
+		Int("accounts", len(r.Accounts)).
+		Int("joins", len(r.Joins)).
+		Msg("Dry run complete, nothing was changed")
+}
+
+// getPortal returns the portal for a key. In dry-run mode, and for portals of other
+// instances of a cluster, portals that don't exist yet are not created in the database,
+// and an empty portal without a room is returned instead.
+func (s *SyncEngine) getPortal(ctx context.Context, key networkid.PortalKey) (*bridgev2.Portal, error) {
+	if s.dryRun == nil && s.Connector.ownsChannel(string(key.ID)) {
+		return s.Connector.Bridge.GetPortalByKey(ctx, key)
+	}
+	portal, err := s.Connector.Bridge.GetExistingPortalByKey(ctx, key)
+	if err != nil || portal != nil {
+		return portal, err
+	}
+	return &bridgev2.Portal{Portal: &database.Portal{PortalKey: key}}, nil
+}
+
+// dryRunUser records the ghost and Matrix account that syncUser would create for a user
+func (s *SyncEngine) dryRunUser(ctx context.Context, user *model.User, matrixAdmin HomeserverAdmin) bool {
+	ghost, err := s.Connector.Bridge.GetExistingGhostByID(ctx, MakeUserID(user.Id))
+	if err != nil {
+		s.log.Warn().Err(err).Str("mm_user_id", user.Id).Msg("Failed to get ghost for user")
+	} else if ghost == nil {
+		s.dryRun.Ghosts = append(s.dryRun.Ghosts, DryRunEntity{ID: user.Id, Name: user.Username})
+	}
+	if matrixAdmin == nil || user.DeleteAt != 0 {
+		return false
+	}
+	if s.Connector.ssoAccounts() && s.Connector.ssoIdentity(user) == nil {
+		return false
+	}
+	mxid, exists, err := s.Connector.resolveMatrixAccount(ctx, matrixAdmin, user)
+	if err != nil {
+		s.log.Warn().Err(err).Str("mm_user_id", user.Id).Stringer("mxid", mxid).Msg("Failed to check if Matrix user exists")
+		return false
+	} else if exists {
+		return false
+	}
+	s.dryRun.Accounts = append(s.dryRun.Accounts, mxid)
+	return true
+}
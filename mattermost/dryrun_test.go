@@ -0,0 +1,34 @@
+package mattermost
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestDryRunReport_Log(t *testing.T) {
+	report := &DryRunReport{
+		Spaces:   []DryRunEntity{{ID: "team1", Name: "Team One"}},
+		Rooms:    []DryRunEntity{{ID: "channel1", Name: "Town Square"}, {ID: "channel2", Name: "Off-Topic"}},
+		Accounts: []id.UserID{"@alice:example.com"},
+		Joins:    []DryRunJoin{{UserID: "@alice:example.com", PortalID: "channel1"}},
+	}
+
+	var buf bytes.Buffer
+	report.Log(zerolog.New(&buf))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 6)
+	assert.Contains(t, lines[0], `"team_name":"Team One"`)
+	assert.Contains(t, lines[0], "would create space")
+	assert.Contains(t, lines[3], `"mxid":"@alice:example.com"`)
+	summary := lines[len(lines)-1]
+	assert.Contains(t, summary, `"spaces":1`)
+	assert.Contains(t, summary, `"rooms":2`)
+	assert.Contains(t, summary, `"ghosts":0`)
+	assert.Contains(t, summary, `"joins":1`)
+}
@@ -0,0 +1,449 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// erasurePath is the path of the erasure endpoint under the provisioning API prefix
+const erasurePath = "/mattermost/erase"
+
+// erasureReason is the reason of the redactions sent when a user is erased
+const erasureReason = "User data erased"
+
+var ErrInvalidErasureTarget = errors.New("expected a Matrix user ID or a Mattermost user ID")
+
+// ErasureReport lists what EraseUser removed
+type ErasureReport struct {
+	Target string `json:"target"`
+
+	RedactedEvents    int `json:"redacted_events"`
+	DeletedPosts      int `json:"deleted_posts"`
+	DeletedMessages   int `json:"deleted_messages"`
+	DeletedReactions  int `json:"deleted_reactions"`
+	DeletedRetryItems int `json:"deleted_retry_items"`
+	RevokedTokens     int `json:"revoked_tokens"`
+
+	// DeactivatedAccounts are the Mattermost user IDs and Matrix IDs of deactivated accounts
+	DeactivatedAccounts []string `json:"deactivated_accounts,omitempty"`
+	PurgedGhosts        []string `json:"purged_ghosts,omitempty"`
+	DeletedLogins       []string `json:"deleted_logins,omitempty"`
+	DoublePuppetRemoved bool     `json:"double_puppet_removed"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (r *ErasureReport) fail(action string, err error) {
+	r.Errors = append(r.Errors, fmt.Sprintf("failed to %s: %v", action, err))
+}
+
+func (r *ErasureReport) String() string {
+	var lines []string
+	add := func(count int, format string) {
+		if count > 0 {
+			lines = append(lines, "* "+fmt.Sprintf(format, count))
+		}
+	}
+	add(r.RedactedEvents, "Redacted %d Matrix events")
+	add(r.DeletedPosts, "Deleted %d Mattermost posts")
+	add(r.DeletedMessages, "Deleted %d bridged messages from the database")
+	add(r.DeletedReactions, "Deleted %d bridged reactions from the database")
+	add(r.DeletedRetryItems, "Dropped %d queued posts")
+	add(r.RevokedTokens, "Revoked %d Mattermost access tokens")
+	if len(r.DeactivatedAccounts) > 0 {
+		lines = append(lines, "* Deactivated accounts: "+strings.Join(r.DeactivatedAccounts, ", "))
+	}
+	if len(r.PurgedGhosts) > 0 {
+		lines = append(lines, "* Cleared ghosts: "+strings.Join(r.PurgedGhosts, ", "))
+	}
+	if len(r.DeletedLogins) > 0 {
+		lines = append(lines, "* Logged out: "+strings.Join(r.DeletedLogins, ", "))
+	}
+	if r.DoublePuppetRemoved {
+		lines = append(lines, "* Removed double puppeting")
+	}
+	for _, err := range r.Errors {
+		lines = append(lines, "* Error: "+err)
+	}
+	if len(lines) == 0 {
+		return fmt.Sprintf("Nothing was stored for %s", r.Target)
+	}
+	return fmt.Sprintf("Erased %s:\n%s", r.Target, strings.Join(lines, "\n"))
+}
+
+// EraseUser removes what the bridge has of a user, for data erasure requests. The user is
+// a Matrix ID or a Mattermost user ID, which is prefixed with the server name and a dot
+// for additional servers.
+//
+// For a Mattermost user, the Matrix events of their ghost are redacted, the ghost's
+// profile is cleared, and the Matrix account mirror mode created for them is deactivated.
+// For a Matrix user, the Mattermost posts the bridge created for their messages are
+// deleted, their logins and double puppeting are removed, and the Mattermost account the
+// bridge created for them is deactivated after revoking its tokens. In both cases the
+// bridged messages and reactions are deleted from the database. Steps that fail are
+// listed in the report and don't stop the others.
+func (m *MattermostConnector) EraseUser(ctx context.Context, user string) (*ErasureReport, error) {
+	report := &ErasureReport{Target: user}
+	if strings.HasPrefix(user, "@") {
+		mxid := id.UserID(user)
+		if _, _, err := mxid.Parse(); err != nil {
+			return nil, fmt.Errorf("invalid Matrix user ID: %w", err)
+		}
+		if ghostID, ok := m.Bridge.Matrix.ParseGhostMXID(mxid); ok {
+			m.eraseMattermostUser(ctx, report, ghostID)
+		} else {
+			m.eraseMatrixUser(ctx, report, mxid)
+		}
+		return report, nil
+	}
+	server, mmUserID := ParseServerUserID(networkid.UserID(user))
+	if !model.IsValidId(mmUserID) {
+		return nil, ErrInvalidErasureTarget
+	} else if _, ok := m.serverURL(server); !ok {
+		return nil, fmt.Errorf("unknown Mattermost server %q", server)
+	}
+	m.eraseMattermostUser(ctx, report, MakeServerUserID(server, mmUserID))
+	return report, nil
+}
+
+// eraseMattermostUser redacts the events of a ghost and removes its data
+func (m *MattermostConnector) eraseMattermostUser(ctx context.Context, report *ErasureReport, ghostID networkid.UserID) {
+	db := m.Bridge.DB.Database
+	events, err := getGhostEvents(ctx, db, m.Bridge.ID, ghostID)
+	if err != nil {
+		report.fail("find Matrix events", err)
+	}
+	failed := 0
+	for _, evt := range events {
+		if err = m.redactBridgedEvent(ctx, ghostID, evt, erasureReason); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Stringer("event_id", evt.EventID).Msg("Failed to redact event of erased user")
+			failed++
+		} else {
+			report.RedactedEvents++
+		}
+	}
+	if failed > 0 {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to redact %d Matrix events, see the logs", failed))
+	}
+	report.DeletedMessages, report.DeletedReactions, err = deleteBridgedRecords(ctx, db, m.Bridge.ID, "sender_id", string(ghostID))
+	if err != nil {
+		report.fail("delete bridged messages", err)
+	}
+	m.purgeGhost(ctx, report, ghostID)
+	m.deactivateMirrorAccount(ctx, report, ghostID)
+	if server, mmUserID := ParseServerUserID(ghostID); server == "" {
+		m.userCache.invalidate(mmUserID)
+	}
+}
+
+// eraseMatrixUser deletes the posts of a Matrix user and removes their data
+func (m *MattermostConnector) eraseMatrixUser(ctx context.Context, report *ErasureReport, mxid id.UserID) {
+	db := m.Bridge.DB.Database
+	posts, err := getMatrixUserPosts(ctx, db, m.Bridge.ID, mxid)
+	if err != nil {
+		report.fail("find Mattermost posts", err)
+	}
+	// The database rows go first, so that the deletions coming back from Mattermost don't
+	// find anything to bridge
+	report.DeletedMessages, report.DeletedReactions, err = deleteBridgedRecords(ctx, db, m.Bridge.ID, "sender_mxid", string(mxid))
+	if err != nil {
+		report.fail("delete bridged messages", err)
+	}
+	failed := 0
+	for _, post := range posts {
+		resp, err := m.receiverClient(post.Receiver).DeletePost(ctx, post.PostID)
+		if err == nil {
+			report.DeletedPosts++
+		} else if responseStatusCode(resp, err) != http.StatusNotFound {
+			zerolog.Ctx(ctx).Warn().Err(wrapMattermostError(resp, err)).Str("post_id", post.PostID).Msg("Failed to delete post of erased user")
+			failed++
+		}
+	}
+	if failed > 0 {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to delete %d Mattermost posts, see the logs", failed))
+	}
+	if m.RetryQueue != nil {
+		count, err := m.RetryQueue.DeleteBySender(ctx, mxid)
+		if err != nil {
+			report.fail("drop queued posts", err)
+		}
+		report.DeletedRetryItems = int(count)
+	}
+
+	if user, err := m.Bridge.GetExistingUserByMXID(ctx, mxid); err != nil {
+		report.fail("get bridge user", err)
+	} else if user != nil {
+		for _, login := range user.GetCachedUserLogins() {
+			report.DeletedLogins = append(report.DeletedLogins, string(login.ID))
+			login.Logout(ctx)
+		}
+		if user.AccessToken != "" {
+			user.LogoutDoublePuppet(ctx)
+			report.DoublePuppetRemoved = true
+		}
+	}
+
+	if m.MatrixUsers != nil {
+		matrixUsers, err := m.MatrixUsers.GetAll(ctx, mxid)
+		if err != nil {
+			report.fail("get Mattermost accounts", err)
+		} else if len(matrixUsers) > 0 {
+			for _, matrixUser := range matrixUsers {
+				m.deactivateMattermostAccount(ctx, report, matrixUser.Server, matrixUser.MMUserID)
+				m.purgeGhost(ctx, report, MakeServerUserID(matrixUser.Server, matrixUser.MMUserID))
+			}
+			if err = m.MatrixUsers.Delete(ctx, mxid); err != nil {
+				report.fail("delete Mattermost accounts from the database", err)
+			}
+		}
+	}
+	m.profileSyncLock.Lock()
+	for key := range m.profileSyncs {
+		if key.mxid == mxid {
+			delete(m.profileSyncs, key)
+		}
+	}
+	m.profileSyncLock.Unlock()
+}
+
+// purgeGhost clears the Matrix profile of a ghost and the data stored for it. The ghost
+// row itself stays, as the bridge caches ghosts.
+func (m *MattermostConnector) purgeGhost(ctx context.Context, report *ErasureReport, ghostID networkid.UserID) {
+	ghost, err := m.Bridge.GetExistingGhostByID(ctx, ghostID)
+	if err != nil {
+		report.fail("get ghost", err)
+		return
+	} else if ghost == nil {
+		return
+	}
+	if err = ghost.Intent.SetDisplayName(ctx, ""); err != nil {
+		report.fail("clear ghost display name", err)
+	}
+	if err = ghost.Intent.SetAvatarURL(ctx, ""); err != nil {
+		report.fail("clear ghost avatar", err)
+	}
+	ghost.Name = ""
+	ghost.AvatarID = ""
+	ghost.AvatarHash = [32]byte{}
+	ghost.AvatarMXC = ""
+	ghost.NameSet = false
+	ghost.AvatarSet = false
+	ghost.ContactInfoSet = false
+	ghost.Identifiers = nil
+	ghost.Metadata = map[string]any{}
+	if err = m.Bridge.DB.Ghost.Update(ctx, ghost.Ghost); err != nil {
+		report.fail("clear ghost", err)
+		return
+	}
+	report.PurgedGhosts = append(report.PurgedGhosts, ghost.Intent.GetMXID().String())
+}
+
+// deactivateMirrorAccount deactivates the Matrix account that mirror mode created for a
+// Mattermost user. Mirror mode accounts are named after the Mattermost username, so
+// nothing is done outside mirror mode, where the account may belong to someone else.
+func (m *MattermostConnector) deactivateMirrorAccount(ctx context.Context, report *ErasureReport, ghostID networkid.UserID) {
+	server, mmUserID := ParseServerUserID(ghostID)
+	if server != "" || !m.IsMirrorMode() || !m.config().Mirror.CreateMatrixAccounts || m.MatrixAdmin == nil ||
+		m.usesGhostAccounts() {
+		return
+	}
+	mmUser, err := m.getUser(ctx, m.Client, mmUserID)
+	if err != nil {
+		report.fail("get Mattermost user", err)
+		return
+	}
+	if mxid, exists, err := m.resolveMatrixAccount(ctx, m.MatrixAdmin, mmUser); err != nil {
+		report.fail("check Matrix account", err)
+	} else if !exists {
+		return
+	} else if err = m.MatrixAdmin.DeactivateUser(ctx, mxid); err != nil {
+		report.fail("deactivate Matrix account", err)
+	} else {
+		report.DeactivatedAccounts = append(report.DeactivatedAccounts, mxid.String())
+	}
+}
+
+// deactivateMattermostAccount revokes the tokens of a Mattermost account the bridge
+// created for a Matrix user on a server and deactivates it
+func (m *MattermostConnector) deactivateMattermostAccount(ctx context.Context, report *ErasureReport, server, mmUserID string) {
+	client, err := m.serverAdminClient(server)
+	if err != nil {
+		report.fail("deactivate Mattermost account", err)
+		return
+	}
+	tokens, resp, err := client.GetUserAccessTokensForUser(ctx, mmUserID, 0, 1000)
+	if err != nil {
+		report.fail("list Mattermost access tokens", wrapMattermostError(resp, err))
+	}
+	for _, token := range tokens {
+		if err = client.RevokeUserAccessToken(ctx, token.Id); err != nil {
+			report.fail("revoke Mattermost access token", err)
+		} else {
+			report.RevokedTokens++
+		}
+	}
+	if resp, err = client.DeleteUser(ctx, mmUserID); err != nil {
+		report.fail("deactivate Mattermost account", wrapMattermostError(resp, err))
+	} else {
+		report.DeactivatedAccounts = append(report.DeactivatedAccounts, mmUserID)
+	}
+}
+
+// receiverClient returns the client to delete the posts of a portal with: the admin
+// client, or the client of the server if the portal belongs to a login of another server
+func (m *MattermostConnector) receiverClient(receiver networkid.UserLoginID) *Client {
+	if receiver != "" {
+		if server := loginServer(m.Bridge.GetCachedUserLoginByID(receiver)); server != "" {
+			return m.serverClient(server)
+		}
+	}
+	return m.adminClient()
+}
+
+// bridgedEvent is a Matrix event the bridge sent
+type bridgedEvent struct {
+	RoomID  id.RoomID
+	EventID id.EventID
+	// Sender is the ghost or the double puppet that sent the event
+	Sender id.UserID
+}
+
+// redactBridgedEvent redacts an event the bridge sent for a Mattermost user. Events of
+// ghosts are redacted by the ghost, events sent with a double puppet by the bridge bot.
+func (m *MattermostConnector) redactBridgedEvent(ctx context.Context, ghostID networkid.UserID, evt bridgedEvent, reason string) error {
+	intent := m.Bridge.Matrix.GhostIntent(ghostID)
+	if evt.Sender != "" && evt.Sender != intent.GetMXID() {
+		intent = m.Bridge.Bot
+	}
+	_, err := intent.SendMessage(ctx, evt.RoomID, event.EventRedaction, &event.Content{
+		Parsed: &event.RedactionEventContent{Redacts: evt.EventID, Reason: reason},
+	}, nil)
+	return err
+}
+
+// getGhostEvents returns the messages and reactions a ghost sent to Matrix
+func getGhostEvents(ctx context.Context, db *dbutil.Database, bridgeID networkid.BridgeID, ghostID networkid.UserID) ([]bridgedEvent, error) {
+	rows, err := db.Query(ctx, `
+		SELECT portal.mxid, message.mxid, message.sender_mxid FROM message
+		JOIN portal ON portal.bridge_id=message.bridge_id AND portal.id=message.room_id AND portal.receiver=message.room_receiver
+		WHERE message.bridge_id=$1 AND message.sender_id=$2 AND portal.mxid IS NOT NULL
+		UNION ALL
+		SELECT portal.mxid, reaction.mxid, reaction.sender_mxid FROM reaction
+		JOIN portal ON portal.bridge_id=reaction.bridge_id AND portal.id=reaction.room_id AND portal.receiver=reaction.room_receiver
+		WHERE reaction.bridge_id=$1 AND reaction.sender_id=$2 AND portal.mxid IS NOT NULL
+	`, bridgeID, ghostID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []bridgedEvent
+	for rows.Next() {
+		var evt bridgedEvent
+		if err = rows.Scan(&evt.RoomID, &evt.EventID, &evt.Sender); err != nil {
+			return nil, err
+		}
+		events = append(events, evt)
+	}
+	return events, rows.Err()
+}
+
+// bridgedPost is a Mattermost post the bridge created for a Matrix message
+type bridgedPost struct {
+	PostID   string
+	Receiver networkid.UserLoginID
+}
+
+// getMatrixUserPosts returns the posts the bridge created for the messages of a Matrix user
+func getMatrixUserPosts(ctx context.Context, db *dbutil.Database, bridgeID networkid.BridgeID, mxid id.UserID) ([]bridgedPost, error) {
+	rows, err := db.Query(ctx, "SELECT DISTINCT id, room_receiver FROM message WHERE bridge_id=$1 AND sender_mxid=$2", bridgeID, mxid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var posts []bridgedPost
+	for rows.Next() {
+		var post bridgedPost
+		if err = rows.Scan(&post.PostID, &post.Receiver); err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+// deleteBridgedRecords deletes the messages and reactions of a sender from the bridge
+// database. senderColumn is sender_id for ghosts and sender_mxid for Matrix users.
+func deleteBridgedRecords(ctx context.Context, db *dbutil.Database, bridgeID networkid.BridgeID, senderColumn, sender string) (messages, reactions int, err error) {
+	res, err := db.Exec(ctx, "DELETE FROM reaction WHERE bridge_id=$1 AND "+senderColumn+"=$2", bridgeID, sender)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to delete reactions: %w", err)
+	}
+	reactionCount, _ := res.RowsAffected()
+	res, err = db.Exec(ctx, "DELETE FROM message WHERE bridge_id=$1 AND "+senderColumn+"=$2", bridgeID, sender)
+	if err != nil {
+		return 0, int(reactionCount), fmt.Errorf("failed to delete messages: %w", err)
+	}
+	messageCount, _ := res.RowsAffected()
+	return int(messageCount), int(reactionCount), nil
+}
+
+// provisioningConnector is implemented by the Matrix connector if the provisioning API is enabled
+type provisioningConnector interface {
+	GetProvisioning() matrix.IProvisioningAPI
+}
+
+// registerErasureEndpoint adds the erasure endpoint to the provisioning API. It uses the
+// provisioning API's authentication, and only bridge admins may call it.
+func (m *MattermostConnector) registerErasureEndpoint() {
+	prov, ok := m.Bridge.Matrix.(provisioningConnector)
+	if !ok || prov.GetProvisioning() == nil || prov.GetProvisioning().GetRouter() == nil {
+		return
+	}
+	api := prov.GetProvisioning()
+	api.GetRouter().HandleFunc(erasurePath, func(w http.ResponseWriter, r *http.Request) {
+		m.handleErasure(w, r, api)
+	}).Methods(http.MethodPost)
+}
+
+// erasureRequest is the body of an erasure request
+type erasureRequest struct {
+	UserID string `json:"user_id"`
+}
+
+func (m *MattermostConnector) handleErasure(w http.ResponseWriter, r *http.Request, api matrix.IProvisioningAPI) {
+	w.Header().Set("Content-Type", "application/json")
+	writeError := func(status int, code mautrix.RespError, message string) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(&mautrix.RespError{ErrCode: code.ErrCode, Err: message})
+	}
+	if user := api.GetUser(r); user == nil || !user.Permissions.Admin {
+		writeError(http.StatusForbidden, mautrix.MForbidden, "Only bridge admins can erase users")
+		return
+	}
+	var req erasureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+		writeError(http.StatusBadRequest, mautrix.MBadJSON, "Expected a JSON body with user_id")
+		return
+	}
+	log := m.moduleLog(LogModuleConnector).With().Str("action", "erase user").Str("target", req.UserID).Logger()
+	report, err := m.EraseUser(log.WithContext(r.Context()), req.UserID)
+	if err != nil {
+		writeError(http.StatusBadRequest, mautrix.MInvalidParam, err.Error())
+		return
+	}
+	log.Info().Int("errors", len(report.Errors)).Msg("Erased user")
+	_ = json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,97 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestErasureRecords(t *testing.T) {
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+
+	for _, ghostID := range []networkid.UserID{"alice-mm-id", "bob-mm-id"} {
+		require.NoError(t, bridgeDB.Ghost.Insert(ctx, &database.Ghost{BridgeID: "mattermost", ID: ghostID, Metadata: map[string]any{}}))
+	}
+	portalKey := networkid.PortalKey{ID: "channel1"}
+	require.NoError(t, bridgeDB.Portal.Insert(ctx, &database.Portal{BridgeID: "mattermost", PortalKey: portalKey, MXID: "!room:example.com"}))
+	messages := []*database.Message{
+		{ID: "post1", MXID: "$alice1", SenderID: "alice-mm-id"},
+		{ID: "post2", MXID: "$alice2", SenderID: "alice-mm-id"},
+		{ID: "post3", MXID: "$carol1", SenderID: "bob-mm-id", SenderMXID: "@carol:example.com"},
+		{ID: "post4", MXID: "$bob1", SenderID: "bob-mm-id"},
+	}
+	for i, msg := range messages {
+		msg.BridgeID = "mattermost"
+		msg.Room = portalKey
+		msg.Timestamp = time.UnixMilli(int64(i))
+		require.NoError(t, bridgeDB.Message.Insert(ctx, msg))
+	}
+	require.NoError(t, bridgeDB.Reaction.Upsert(ctx, &database.Reaction{
+		BridgeID:  "mattermost",
+		Room:      portalKey,
+		MessageID: "post4",
+		SenderID:  "alice-mm-id",
+		EmojiID:   "thumbsup",
+		MXID:      "$alice-reaction",
+		Timestamp: time.UnixMilli(10),
+	}))
+
+	events, err := getGhostEvents(ctx, bridgeDB.Database, "mattermost", "alice-mm-id")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []bridgedEvent{
+		{RoomID: "!room:example.com", EventID: "$alice1"},
+		{RoomID: "!room:example.com", EventID: "$alice2"},
+		{RoomID: "!room:example.com", EventID: "$alice-reaction"},
+	}, events)
+
+	posts, err := getMatrixUserPosts(ctx, bridgeDB.Database, "mattermost", "@carol:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []bridgedPost{{PostID: "post3"}}, posts)
+
+	deletedMessages, deletedReactions, err := deleteBridgedRecords(ctx, bridgeDB.Database, "mattermost", "sender_id", "alice-mm-id")
+	require.NoError(t, err)
+	assert.Equal(t, 2, deletedMessages)
+	assert.Equal(t, 1, deletedReactions)
+	deletedMessages, _, err = deleteBridgedRecords(ctx, bridgeDB.Database, "mattermost", "sender_mxid", "@carol:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, deletedMessages)
+
+	msg, err := bridgeDB.Message.GetFirstPartByID(ctx, "", "post4")
+	require.NoError(t, err)
+	assert.NotNil(t, msg, "messages of other users should be kept")
+	for _, postID := range []networkid.MessageID{"post1", "post3"} {
+		msg, err = bridgeDB.Message.GetFirstPartByID(ctx, "", postID)
+		require.NoError(t, err)
+		assert.Nil(t, msg)
+	}
+}
+
+func TestMatrixUserStore_Delete(t *testing.T) {
+	ctx := context.Background()
+	store := NewMatrixUserStore("mattermost", newTestBridgeDB(t).Database)
+	require.NoError(t, store.Upgrade(ctx))
+	require.NoError(t, store.Put(ctx, &MatrixUser{MXID: "@alice:example.com", MMUserID: "alice-mm-id"}))
+
+	require.NoError(t, store.Delete(ctx, "@alice:example.com"))
+	user, err := store.Get(ctx, "", id.UserID("@alice:example.com"))
+	require.NoError(t, err)
+	assert.Nil(t, user)
+}
+
+func TestErasureReport_String(t *testing.T) {
+	assert.Equal(t, "Nothing was stored for @alice:example.com", (&ErasureReport{Target: "@alice:example.com"}).String())
+
+	report := &ErasureReport{Target: "@alice:example.com", DeletedPosts: 3, DeactivatedAccounts: []string{"alice-mm-id"}}
+	report.fail("revoke Mattermost access token", assert.AnError)
+	assert.Equal(t, "Erased @alice:example.com:\n"+
+		"* Deleted 3 Mattermost posts\n"+
+		"* Deactivated accounts: alice-mm-id\n"+
+		"* Error: failed to revoke Mattermost access token: "+assert.AnError.Error(), report.String())
+}
@@ -0,0 +1,82 @@
+package mattermost
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// EventFilterConfig picks which Mattermost WebSocket events the bridge handles, so that
+// small deployments can skip events they don't need. Entries are the categories in
+// webSocketEventCategories or raw Mattermost event types like "channel_viewed". If allow
+// is set, only events it matches are handled; events deny matches are never handled.
+type EventFilterConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// webSocketEventCategories are the names of groups of WebSocket events for the event filter
+var webSocketEventCategories = map[string][]model.WebsocketEventType{
+	"posts":   {model.WebsocketEventPosted},
+	"edits":   {model.WebsocketEventPostEdited},
+	"deletes": {model.WebsocketEventPostDeleted},
+	"reactions": {
+		model.WebsocketEventReactionAdded, model.WebsocketEventReactionRemoved,
+		model.WebsocketEventAcknowledgementAdded, model.WebsocketEventAcknowledgementRemoved,
+	},
+	"typing":     {model.WebsocketEventTyping},
+	"membership": {model.WebsocketEventChannelMemberUpdated, model.WebsocketEventUserAdded, model.WebsocketEventUserRemoved},
+	"status":     {model.WebsocketEventStatusChange},
+	"channels": {
+		model.WebsocketEventChannelUpdated, model.WebsocketEventChannelDeleted,
+		model.WebsocketEventChannelRestored, model.WebsocketEventChannelConverted, model.WebsocketEventUpdateTeam,
+	},
+	"profiles":    {model.WebsocketEventUserUpdated},
+	"preferences": {model.WebsocketEventPreferencesChanged, model.WebsocketEventPreferencesDeleted},
+	"calls":       {callStartEvent, callEndEvent},
+	"playbooks":   {playbookRunCreatedEvent, playbookRunUpdatedEvent},
+	"boards":      {boardsBlockEvent},
+}
+
+// Validate checks that the entries of the filter are categories or look like event types
+func (c *EventFilterConfig) Validate() error {
+	for _, entry := range slices.Concat(c.Allow, c.Deny) {
+		if _, ok := webSocketEventCategories[entry]; !ok && !isEventTypeName(entry) {
+			return fmt.Errorf("invalid event_source.events entry %q", entry)
+		}
+	}
+	return nil
+}
+
+// isEventTypeName checks whether a string could be a Mattermost event type, which are
+// lowercase words joined with underscores
+func isEventTypeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesEventType checks whether a list of categories and event types contains an event type
+func matchesEventType(entries []string, eventType model.WebsocketEventType) bool {
+	for _, entry := range entries {
+		if model.WebsocketEventType(entry) == eventType || slices.Contains(webSocketEventCategories[entry], eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows checks whether events of a type are handled
+func (c *EventFilterConfig) Allows(eventType model.WebsocketEventType) bool {
+	if len(c.Allow) > 0 && !matchesEventType(c.Allow, eventType) {
+		return false
+	}
+	return !matchesEventType(c.Deny, eventType)
+}
@@ -0,0 +1,36 @@
+package mattermost
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventFilterConfig_Allows(t *testing.T) {
+	var all EventFilterConfig
+	assert.True(t, all.Allows(model.WebsocketEventPosted))
+	assert.True(t, all.Allows(model.WebsocketEventTyping))
+
+	minimal := EventFilterConfig{Allow: []string{"posts", "edits", "channel_viewed"}}
+	assert.True(t, minimal.Allows(model.WebsocketEventPosted))
+	assert.True(t, minimal.Allows(model.WebsocketEventPostEdited))
+	assert.True(t, minimal.Allows(model.WebsocketEventChannelViewed))
+	assert.False(t, minimal.Allows(model.WebsocketEventReactionAdded))
+
+	noisy := EventFilterConfig{Deny: []string{"typing", "reactions", "user_updated"}}
+	assert.True(t, noisy.Allows(model.WebsocketEventPosted))
+	assert.False(t, noisy.Allows(model.WebsocketEventAcknowledgementAdded))
+	assert.False(t, noisy.Allows(model.WebsocketEventUserUpdated))
+
+	// Deny wins over allow
+	both := EventFilterConfig{Allow: []string{"reactions"}, Deny: []string{"reaction_removed"}}
+	assert.True(t, both.Allows(model.WebsocketEventReactionAdded))
+	assert.False(t, both.Allows(model.WebsocketEventReactionRemoved))
+}
+
+func TestEventFilterConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&EventFilterConfig{Allow: []string{"posts", "channel_viewed"}, Deny: []string{"typing"}}).Validate())
+	assert.Error(t, (&EventFilterConfig{Allow: []string{"Posts"}}).Validate())
+	assert.Error(t, (&EventFilterConfig{Deny: []string{""}}).Validate())
+}
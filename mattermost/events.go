@@ -9,15 +9,25 @@ import (
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
 )
 
 
 type MattermostEvent struct {
 	Connector *MattermostConnector
+	// Server is the name of the server the event came from, empty for the main server
+	Server    string
 	Timestamp time.Time
 	ChannelID string
 	UserID    string
 	Username  string
+	// SenderLogin is the login whose double puppet sends the event, if it isn't the login
+	// of UserID, like for posts of ghost accounts
+	SenderLogin networkid.UserLoginID
+}
+
+func (e *MattermostEvent) getServer() string {
+	return e.Server
 }
 
 func (e *MattermostEvent) GetTimestamp() time.Time {
@@ -36,8 +46,14 @@ func (e *MattermostEvent) AddLogContext(c zerolog.Context) zerolog.Context {
 }
 
 func (e *MattermostEvent) GetSender() bridgev2.EventSender {
+	senderLogin := e.SenderLogin
+	if senderLogin == "" {
+		senderLogin = e.Connector.loginIDForMMUser(e.UserID)
+	}
 	return bridgev2.EventSender{
-		Sender: networkid.UserID(e.Username),
+		Sender: MakeServerUserID(e.Server, e.UserID),
+		// Sends the message with the user's double puppet if they're logged in
+		SenderLogin: senderLogin,
 	}
 }
 
@@ -47,6 +63,25 @@ type MattermostMessageEvent struct {
 	Content string
 	FileIds []string
 	RootID  string // Thread root post ID (empty if not a reply)
+
+	// Priority is the urgent/important label and acknowledgement request of the post
+	Priority *model.PostPriority
+	// PostType is the type of system posts, empty for normal posts
+	PostType string
+
+	// Preview is the post the post links with a permalink, if Mattermost shows a preview of it
+	Preview *model.PreviewPost
+
+	// ScheduledBy is the Matrix user who scheduled a post of their ghost account and has no
+	// double puppet, so the post is sent by the bridge bot in their name
+	ScheduledBy id.UserID
+}
+
+func (e *MattermostMessageEvent) GetSender() bridgev2.EventSender {
+	if e.ScheduledBy != "" {
+		return bridgev2.EventSender{}
+	}
+	return e.MattermostEvent.GetSender()
 }
 
 func (e *MattermostMessageEvent) GetType() bridgev2.RemoteEventType {
@@ -58,6 +93,17 @@ func (e *MattermostMessageEvent) GetID() networkid.MessageID {
 }
 
 func (e *MattermostMessageEvent) ConvertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI) (*bridgev2.ConvertedMessage, error) {
+	if !getPortalMetadata(portal).BridgesToMatrix() {
+		return nil, bridgev2.ErrIgnoringRemoteEvent
+	}
+	// Posts of users who can't send messages in a read-only room are bounced back to them
+	if !e.Connector.canSendMessages(ctx, portal.MXID, intent.GetMXID()) {
+		zerolog.Ctx(ctx).Debug().Str("post_id", e.PostID).Stringer("sender", intent.GetMXID()).Msg("Bouncing post to read-only room")
+		if err := e.Connector.bounceReadOnlyPost(ctx, e.Server, e.ChannelID, e.UserID, e.PostID, e.RootID); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("post_id", e.PostID).Msg("Failed to bounce post to read-only room")
+		}
+		return nil, bridgev2.ErrIgnoringRemoteEvent
+	}
 	// We need source user login for msgconv to download files/use client
 	// bridgev2 passes intent, but we need UserLogin to access Mattermost Client if we want to download files.
 	// Wait, ToMatrix needs `source *bridgev2.UserLogin`.
@@ -75,7 +121,7 @@ func (e *MattermostMessageEvent) ConvertMessage(ctx context.Context, portal *bri
 	// `connector.go` stores users by UserLoginID, which we set to UserID in `login.go`.
 	
 	e.Connector.usersLock.RLock()
-	source = e.Connector.users[networkid.UserLoginID(e.Username)]
+	source = e.Connector.users[MakeServerLoginID(e.Server, e.Username)]
 	e.Connector.usersLock.RUnlock()
 	
 	if source == nil {
@@ -91,7 +137,7 @@ func (e *MattermostMessageEvent) ConvertMessage(ctx context.Context, portal *bri
 		
 		// For now, let's just cheat and make a dummy UserLogin wrapping existing m.Connector.Client
 		source = &bridgev2.UserLogin{
-			Client: &MattermostAPI{Connector: e.Connector, Client: e.Connector.Client},
+			Client: newMattermostAPI(nil, e.Connector, e.Connector.serverClient(e.Server)),
 		}
 	}
 	
@@ -103,9 +149,24 @@ func (e *MattermostMessageEvent) ConvertMessage(ctx context.Context, portal *bri
 		Message:   e.Content,
 		FileIds:   e.FileIds,
 		RootId:    e.RootID, // Thread root for replies
+		Type:      e.PostType,
+	}
+	if e.Priority != nil {
+		post.Metadata = &model.PostMetadata{Priority: e.Priority}
 	}
 	
 	msg := e.Connector.MsgConv.ToMatrix(ctx, portal, intent, source, post)
+	if msg == nil {
+		return nil, bridgev2.ErrIgnoringRemoteEvent
+	}
+	if e.ScheduledBy != "" {
+		attributeScheduledPost(msg, e.ScheduledBy)
+	}
+	if api, ok := source.Client.(*MattermostAPI); ok {
+		e.Connector.quoteThreadRoot(ctx, portal, api.Client(), msg, e.RootID, e.PostID)
+		e.Connector.renderPermalink(ctx, portal, api.Client(), msg, e.Preview)
+	}
+	e.Connector.ensureRoomGhostName(ctx, portal, intent)
 	return msg, nil
 }
 
@@ -115,6 +176,9 @@ func (e *MattermostMessageEvent) ShouldCreatePortal() bool {
 
 type MattermostEditEvent struct {
 	MattermostMessageEvent
+
+	// Summary is the thread summary shown under the text of a thread root, if any
+	Summary *ThreadSummary
 }
 
 func (e *MattermostEditEvent) GetType() bridgev2.RemoteEventType {
@@ -130,13 +194,42 @@ func (e *MattermostEditEvent) ConvertEdit(ctx context.Context, portal *bridgev2.
 	if err != nil {
 		return nil, err
 	}
-	parts := make([]*bridgev2.ConvertedEditPart, len(existing))
-	for i, dbMsg := range existing {
-		parts[i] = msg.Parts[0].ToEditPart(dbMsg)
+	if e.Summary != nil && appendThreadSummary(msg, e.Summary) {
+		return &bridgev2.ConvertedEdit{
+			ModifiedParts: threadSummaryParts(msg, existing),
+		}, nil
 	}
-	return &bridgev2.ConvertedEdit{
-		ModifiedParts: parts,
-	}, nil
+	return editParts(msg, existing), nil
+}
+
+// editParts matches the parts of an edited post with the parts bridged before by their ID:
+// the text and the files that are still there are edited, files removed from the post are
+// redacted and files added to it are sent as new parts
+func editParts(msg *bridgev2.ConvertedMessage, existing []*database.Message) *bridgev2.ConvertedEdit {
+	edit := &bridgev2.ConvertedEdit{}
+	converted := make(map[networkid.PartID]*bridgev2.ConvertedMessagePart, len(msg.Parts))
+	for _, part := range msg.Parts {
+		converted[part.ID] = part
+	}
+	bridged := make(map[networkid.PartID]bool, len(existing))
+	for _, dbMsg := range existing {
+		bridged[dbMsg.PartID] = true
+		if part, ok := converted[dbMsg.PartID]; ok {
+			edit.ModifiedParts = append(edit.ModifiedParts, part.ToEditPart(dbMsg))
+		} else {
+			edit.DeletedParts = append(edit.DeletedParts, dbMsg)
+		}
+	}
+	for _, part := range msg.Parts {
+		if bridged[part.ID] {
+			continue
+		}
+		if edit.AddedParts == nil {
+			edit.AddedParts = &bridgev2.ConvertedMessage{ReplyTo: msg.ReplyTo, ThreadRoot: msg.ThreadRoot}
+		}
+		edit.AddedParts.Parts = append(edit.AddedParts.Parts, part)
+	}
+	return edit
 }
 
 type MattermostRemoveEvent struct {
@@ -162,6 +255,8 @@ type MattermostReactionEvent struct {
 	PostID    string
 	EmojiName string
 	Added     bool // true = reaction added, false = reaction removed
+	// RemovedEmojiID is the emoji ID a removed reaction was bridged with, if it's known
+	RemovedEmojiID networkid.EmojiID
 }
 
 func (e *MattermostReactionEvent) GetType() bridgev2.RemoteEventType {
@@ -184,5 +279,28 @@ func (e *MattermostReactionEvent) GetReactionEmoji() (string, networkid.EmojiID)
 
 // GetRemovedEmojiID returns the emoji ID for reaction removal
 func (e *MattermostReactionEvent) GetRemovedEmojiID() networkid.EmojiID {
+	if e.RemovedEmojiID != "" {
+		return e.RemovedEmojiID
+	}
 	return networkid.EmojiID(e.EmojiName)
 }
+
+// Acknowledgements of posts are bridged as reactions with their own emoji ID, so that
+// they don't collide with a ✅ reaction of the same user
+const (
+	ackEmoji   = "✅"
+	ackEmojiID = networkid.EmojiID("ack")
+)
+
+// MattermostAckEvent is an acknowledgement of a post that requested one
+type MattermostAckEvent struct {
+	MattermostReactionEvent
+}
+
+func (e *MattermostAckEvent) GetReactionEmoji() (string, networkid.EmojiID) {
+	return ackEmoji, ackEmojiID
+}
+
+func (e *MattermostAckEvent) GetRemovedEmojiID() networkid.EmojiID {
+	return ackEmojiID
+}
@@ -0,0 +1,176 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// Reasons federated joins fail, wrapped around the homeserver's error
+var (
+	ErrJoinForbidden          = errors.New("the room is invite-only, or you're banned from it")
+	ErrJoinUnreachable        = errors.New("none of the servers in the room could be reached")
+	ErrJoinRateLimited        = errors.New("the homeserver is rate limiting joins, try again later")
+	ErrJoinUnsupportedVersion = errors.New("the homeserver doesn't support the version of the room")
+)
+
+// joinViaCache remembers the server each room was last joined through, so that later joins
+// of other ghosts try it first
+type joinViaCache struct {
+	lock    sync.Mutex
+	servers map[id.RoomID]string
+}
+
+func (c *joinViaCache) get(roomID id.RoomID) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.servers[roomID]
+}
+
+func (c *joinViaCache) set(roomID id.RoomID, server string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.servers == nil {
+		c.servers = make(map[id.RoomID]string)
+	}
+	c.servers[roomID] = server
+}
+
+// orderViaServers returns the via servers to try, the cached one first and without
+// duplicates
+func orderViaServers(cached string, via []string) []string {
+	servers := make([]string, 0, len(via)+1)
+	if cached != "" {
+		servers = append(servers, cached)
+	}
+	for _, server := range via {
+		if server != "" && !slices.Contains(servers, server) {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// retryableJoinError checks whether a join that failed through one server may work through
+// another. Join rules and bans apply everywhere, so forbidden joins aren't retried.
+func retryableJoinError(err error) bool {
+	return !errors.Is(err, mautrix.MForbidden) &&
+		!errors.Is(err, ErrAdminNotSupported) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+// describeJoinError wraps the error of a failed join with the reason it failed, if it's known
+func describeJoinError(err error) error {
+	var reason error
+	var respErr mautrix.RespError
+	switch {
+	case errors.Is(err, mautrix.MForbidden):
+		reason = ErrJoinForbidden
+	case errors.Is(err, mautrix.MLimitExceeded):
+		reason = ErrJoinRateLimited
+	case errors.Is(err, mautrix.MUnsupportedRoomVersion), errors.Is(err, mautrix.MIncompatibleRoomVersion):
+		reason = ErrJoinUnsupportedVersion
+	case errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound:
+		// Synapse answers 404 when no server in the room could be reached
+		reason = ErrJoinUnreachable
+	default:
+		return err
+	}
+	return fmt.Errorf("%w (%w)", reason, err)
+}
+
+// joinRoomVia joins a user to a room through the homeserver admin backend. Each via server
+// is tried in turn, starting with the one the room was last joined through, and the server
+// that works is remembered for the next join.
+func (m *MattermostConnector) joinRoomVia(ctx context.Context, userID id.UserID, roomID id.RoomID, via []string) error {
+	servers := orderViaServers(m.joinVias.get(roomID), via)
+	if len(servers) == 0 {
+		return describeJoinError(m.MatrixAdmin.JoinRoomVia(ctx, userID, roomID, nil))
+	}
+	log := zerolog.Ctx(ctx).With().Stringer("room_id", roomID).Stringer("user_id", userID).Logger()
+	var errs []error
+	for _, server := range servers {
+		err := m.MatrixAdmin.JoinRoomVia(ctx, userID, roomID, []string{server})
+		if err == nil {
+			m.joinVias.set(roomID, server)
+			return nil
+		}
+		log.Debug().Err(err).Str("via", server).Msg("Failed to join room via server")
+		errs = append(errs, fmt.Errorf("via %s: %w", server, err))
+		if !retryableJoinError(err) {
+			break
+		}
+	}
+	return describeJoinError(errors.Join(errs...))
+}
+
+// roomReference is a room a user asked to join, by alias or ID
+type roomReference struct {
+	Alias id.RoomAlias
+	ID    id.RoomID
+	Via   []string
+}
+
+// String returns the alias of the room, or its ID if it was referenced by ID
+func (ref *roomReference) String() string {
+	if ref.Alias != "" {
+		return ref.Alias.String()
+	}
+	return ref.ID.String()
+}
+
+// parseRoomReference parses a room alias, room ID, matrix.to link or matrix: URI.
+// Links may carry via servers, which are kept for joining.
+func parseRoomReference(identifier string) (*roomReference, bool) {
+	identifier = strings.TrimSpace(identifier)
+	switch {
+	case strings.HasPrefix(identifier, "#") && strings.Contains(identifier, ":"):
+		return &roomReference{Alias: id.RoomAlias(identifier)}, true
+	case strings.HasPrefix(identifier, "!") && len(identifier) > 1:
+		return &roomReference{ID: id.RoomID(identifier)}, true
+	}
+	uri, err := id.ParseMatrixURIOrMatrixToURL(identifier)
+	if err != nil || uri.MXID2 != "" {
+		return nil, false
+	}
+	switch uri.Sigil1 {
+	case '#':
+		return &roomReference{Alias: uri.RoomAlias(), Via: uri.Via}, true
+	case '!':
+		return &roomReference{ID: uri.RoomID(), Via: uri.Via}, true
+	}
+	return nil, false
+}
+
+// roomIDServers returns the server in a room ID, which created the room and is likely still
+// in it. Newer room versions have no server in their IDs.
+func roomIDServers(roomID id.RoomID) []string {
+	if _, server, ok := strings.Cut(string(roomID), ":"); ok && server != "" {
+		return []string{server}
+	}
+	return nil
+}
+
+// resolveRoomReference returns the ID of a referenced room and the servers to join it
+// through. Aliases are resolved with the homeserver admin backend, and room IDs are joined
+// through the servers of the link they came from and the server in the ID.
+func (m *MattermostConnector) resolveRoomReference(ctx context.Context, ref *roomReference) (id.RoomID, []string, error) {
+	via := slices.Clone(ref.Via)
+	if ref.ID != "" {
+		return ref.ID, append(via, roomIDServers(ref.ID)...), nil
+	}
+	roomID, servers, err := m.MatrixAdmin.ResolveRoomAlias(ctx, ref.Alias.String())
+	if err != nil {
+		return "", nil, err
+	}
+	return roomID, append(via, servers...), nil
+}
@@ -0,0 +1,132 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// joinTestAdmin is a homeserver admin backend whose joins fail except through some servers
+type joinTestAdmin struct {
+	HomeserverAdmin
+	working map[string]bool
+	errs    map[string]error
+	tried   []string
+}
+
+func (a *joinTestAdmin) JoinRoomVia(ctx context.Context, userID id.UserID, roomID id.RoomID, viaServers []string) error {
+	if len(viaServers) != 1 {
+		return fmt.Errorf("expected one via server, got %v", viaServers)
+	}
+	a.tried = append(a.tried, viaServers[0])
+	if a.working[viaServers[0]] {
+		return nil
+	} else if err, ok := a.errs[viaServers[0]]; ok {
+		return err
+	}
+	return fmt.Errorf("failed to join room (status 404): %w", mautrix.RespError{ErrCode: "M_UNKNOWN", StatusCode: http.StatusNotFound})
+}
+
+func TestOrderViaServers(t *testing.T) {
+	assert.Equal(t, []string{"b.org", "a.org", "c.org"}, orderViaServers("b.org", []string{"a.org", "b.org", "", "c.org", "a.org"}))
+	assert.Empty(t, orderViaServers("", nil))
+}
+
+func TestJoinRoomVia_TriesEachServer(t *testing.T) {
+	admin := &joinTestAdmin{working: map[string]bool{"c.org": true}}
+	m := &MattermostConnector{MatrixAdmin: admin}
+	ctx := context.Background()
+
+	require.NoError(t, m.joinRoomVia(ctx, "@alice:example.com", "!room:a.org", []string{"a.org", "b.org", "c.org"}))
+	assert.Equal(t, []string{"a.org", "b.org", "c.org"}, admin.tried)
+
+	// The server that worked is tried first next time
+	admin.tried = nil
+	require.NoError(t, m.joinRoomVia(ctx, "@bob:example.com", "!room:a.org", []string{"a.org", "b.org", "c.org"}))
+	assert.Equal(t, []string{"c.org"}, admin.tried)
+}
+
+func TestJoinRoomVia_Errors(t *testing.T) {
+	ctx := context.Background()
+	admin := &joinTestAdmin{errs: map[string]error{
+		"a.org": fmt.Errorf("failed to join room (status 403): %w", mautrix.RespError{ErrCode: "M_FORBIDDEN", StatusCode: http.StatusForbidden}),
+	}}
+	m := &MattermostConnector{MatrixAdmin: admin}
+	err := m.joinRoomVia(ctx, "@alice:example.com", "!room:a.org", []string{"a.org", "b.org"})
+	assert.ErrorIs(t, err, ErrJoinForbidden)
+	assert.Equal(t, []string{"a.org"}, admin.tried, "forbidden joins aren't retried")
+
+	admin = &joinTestAdmin{}
+	m = &MattermostConnector{MatrixAdmin: admin}
+	err = m.joinRoomVia(ctx, "@alice:example.com", "!room:a.org", []string{"a.org", "b.org"})
+	assert.ErrorIs(t, err, ErrJoinUnreachable)
+	assert.Contains(t, err.Error(), "via a.org")
+	assert.Contains(t, err.Error(), "via b.org")
+	assert.Equal(t, []string{"a.org", "b.org"}, admin.tried)
+}
+
+func TestDescribeJoinError(t *testing.T) {
+	assert.Nil(t, describeJoinError(nil))
+	assert.ErrorIs(t, describeJoinError(mautrix.MLimitExceeded), ErrJoinRateLimited)
+	assert.ErrorIs(t, describeJoinError(mautrix.MIncompatibleRoomVersion), ErrJoinUnsupportedVersion)
+	other := errors.New("connection refused")
+	assert.Equal(t, other, describeJoinError(other))
+}
+
+func (a *joinTestAdmin) ResolveRoomAlias(ctx context.Context, alias string) (id.RoomID, []string, error) {
+	if alias != "#room:a.org" {
+		return "", nil, mautrix.MNotFound
+	}
+	return "!room:a.org", []string{"a.org", "b.org"}, nil
+}
+
+func TestParseRoomReference(t *testing.T) {
+	ref, ok := parseRoomReference(" #room:a.org ")
+	require.True(t, ok)
+	assert.Equal(t, &roomReference{Alias: "#room:a.org"}, ref)
+	assert.Equal(t, "#room:a.org", ref.String())
+
+	ref, ok = parseRoomReference("!abc:a.org")
+	require.True(t, ok)
+	assert.Equal(t, &roomReference{ID: "!abc:a.org"}, ref)
+
+	ref, ok = parseRoomReference("https://matrix.to/#/!abc:a.org?via=b.org&via=c.org")
+	require.True(t, ok)
+	assert.Equal(t, &roomReference{ID: "!abc:a.org", Via: []string{"b.org", "c.org"}}, ref)
+	assert.Equal(t, "!abc:a.org", ref.String())
+
+	ref, ok = parseRoomReference("matrix:r/room:a.org")
+	require.True(t, ok)
+	assert.Equal(t, id.RoomAlias("#room:a.org"), ref.Alias)
+
+	for _, invalid := range []string{"room", "#room", "@alice:a.org", "https://matrix.to/#/@alice:a.org", "https://matrix.to/#/!abc:a.org/$event"} {
+		_, ok = parseRoomReference(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestResolveRoomReference(t *testing.T) {
+	ctx := context.Background()
+	m := &MattermostConnector{MatrixAdmin: &joinTestAdmin{}}
+
+	roomID, via, err := m.resolveRoomReference(ctx, &roomReference{Alias: "#room:a.org"})
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!room:a.org"), roomID)
+	assert.Equal(t, []string{"a.org", "b.org"}, via)
+
+	// Room IDs are joined through the servers of their link, then the one in the ID
+	roomID, via, err = m.resolveRoomReference(ctx, &roomReference{ID: "!abc:a.org", Via: []string{"c.org"}})
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!abc:a.org"), roomID)
+	assert.Equal(t, []string{"c.org", "a.org"}, via)
+
+	_, _, err = m.resolveRoomReference(ctx, &roomReference{Alias: "#missing:a.org"})
+	assert.ErrorIs(t, err, mautrix.MNotFound)
+}
@@ -0,0 +1,98 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// Ghosts can have a different display name in a single portal, like "Alice (Mattermost)"
+// in a plumbed room where Mattermost and Matrix users talk, without changing their global
+// profile. The name is set with the ghost's member event in the room. Changes of the global
+// name reset it, so it's set again when the ghost next sends a message.
+
+// roomGhostName returns the display name of a ghost in a portal
+func roomGhostName(portal *bridgev2.Portal, ghost *bridgev2.Ghost) string {
+	if suffix := getPortalMetadata(portal).Settings.GhostNameSuffix; suffix != "" {
+		return ghost.Name + " " + suffix
+	}
+	return ghost.Name
+}
+
+// setRoomGhostName sets the display name of a ghost in a portal if its member event has
+// a different one. Ghosts that haven't joined yet are joined first.
+func setRoomGhostName(ctx context.Context, portal *bridgev2.Portal, ghost *bridgev2.Ghost) error {
+	if portal.MXID == "" || ghost.Name == "" {
+		return nil
+	}
+	name := roomGhostName(portal, ghost)
+	userID := ghost.Intent.GetMXID()
+	member, err := portal.Bridge.Matrix.GetMemberInfo(ctx, portal.MXID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get member info: %w", err)
+	}
+	if member == nil || member.Membership != event.MembershipJoin {
+		if err = ghost.Intent.EnsureJoined(ctx, portal.MXID); err != nil {
+			return fmt.Errorf("failed to join room: %w", err)
+		}
+		member = &event.MemberEventContent{Displayname: ghost.Name, AvatarURL: ghost.AvatarMXC}
+	}
+	if member.Displayname == name {
+		return nil
+	}
+	content := *member
+	content.Membership = event.MembershipJoin
+	content.Displayname = name
+	_, err = ghost.Intent.SendState(ctx, portal.MXID, event.StateMember, userID.String(), &event.Content{Parsed: &content}, time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to send member event: %w", err)
+	}
+	return nil
+}
+
+// ensureRoomGhostName sets the room display name of the ghost of a message's sender in
+// portals with a ghost name suffix. Double puppeted messages aren't sent by ghosts.
+func (m *MattermostConnector) ensureRoomGhostName(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI) {
+	if getPortalMetadata(portal).Settings.GhostNameSuffix == "" || intent == nil {
+		return
+	}
+	ghost, err := m.Bridge.GetGhostByMXID(ctx, intent.GetMXID())
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to get ghost to set its room display name")
+		return
+	} else if ghost == nil {
+		return
+	}
+	if err = setRoomGhostName(ctx, portal, ghost); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("ghost_id", string(ghost.ID)).Msg("Failed to set room display name of ghost")
+	}
+}
+
+// applyRoomGhostNames sets the room display names of all ghosts in a portal after its ghost
+// name suffix changed
+func applyRoomGhostNames(ctx context.Context, portal *bridgev2.Portal) {
+	log := zerolog.Ctx(ctx)
+	members, err := portal.Bridge.Matrix.GetMembers(ctx, portal.MXID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get room members to set ghost display names")
+		return
+	}
+	for userID, member := range members {
+		ghostID, ok := portal.Bridge.Matrix.ParseGhostMXID(userID)
+		if !ok || member.Membership != event.MembershipJoin {
+			continue
+		}
+		ghost, err := portal.Bridge.GetGhostByID(ctx, ghostID)
+		if err != nil {
+			log.Warn().Err(err).Stringer("user_id", userID).Msg("Failed to get ghost to set its room display name")
+			continue
+		}
+		if err = setRoomGhostName(ctx, portal, ghost); err != nil {
+			log.Warn().Err(err).Stringer("user_id", userID).Msg("Failed to set room display name of ghost")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package mattermost
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+// Posts of the ghost accounts of Matrix users normally come from Matrix and have the
+// from_matrix prop, but anything else they post (like when an admin uses the account, or
+// the prop was lost) must not be bridged back as a message of a Mattermost user.
+
+// ghostMXID checks whether a Mattermost user is the ghost of a Matrix user, and returns the
+// Matrix user if it's known. Users come from the user cache, so only ghost accounts need
+// the database.
+func (m *MattermostConnector) ghostMXID(ctx context.Context, server, userID string) (id.UserID, bool) {
+	if userID == "" {
+		return "", false
+	}
+	user, err := m.getUser(ctx, m.serverClient(server), userID)
+	if err != nil || !isGhostUser(user) {
+		return "", false
+	}
+	if mxid := ghostOwner(user); mxid != "" {
+		return mxid, true
+	}
+	if m.MatrixUsers == nil {
+		return "", true
+	}
+	linked, err := m.MatrixUsers.GetByMMUserID(ctx, server, userID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("user_id", userID).Msg("Failed to get Matrix user of ghost")
+		return "", true
+	} else if linked == nil {
+		return "", true
+	}
+	return linked.MXID, true
+}
+
+// ghostPostLogin returns the login whose Matrix user's double puppet can send a post of
+// their ghost account, or an empty ID if the post has to be dropped
+func (m *MattermostConnector) ghostPostLogin(ctx context.Context, mxid id.UserID) networkid.UserLoginID {
+	if mxid == "" || m.Bridge == nil {
+		return ""
+	}
+	user, err := m.Bridge.GetExistingUserByMXID(ctx, mxid)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("mxid", mxid).Msg("Failed to get Matrix user of ghost")
+		return ""
+	} else if user == nil {
+		return ""
+	}
+	login := user.GetDefaultLogin()
+	if login == nil || user.DoublePuppet(ctx) == nil {
+		return ""
+	}
+	return login.ID
+}
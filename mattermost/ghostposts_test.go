@@ -0,0 +1,42 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestGhostMXID(t *testing.T) {
+	ctx := context.Background()
+	store := NewMatrixUserStore("mattermost", newTestBridgeDB(t).Database)
+	require.NoError(t, store.Upgrade(ctx))
+	m := &MattermostConnector{MatrixUsers: store}
+	m.userCache.set(&model.User{Id: "user1", Username: "alice"})
+	m.userCache.set(&model.User{Id: "ghost1", Username: "mx.bob_example.com", Props: model.StringMap{ghostMXIDProp: "@bob:example.com"}})
+	m.userCache.set(&model.User{Id: "ghost2", Username: "mx.carol_example.com", Nickname: "Carol"})
+	m.userCache.set(&model.User{Id: "ghost3", Username: "mx.dave_example.com", Nickname: "Dave"})
+	require.NoError(t, store.Put(ctx, &MatrixUser{MXID: "@carol:example.com", MMUserID: "ghost2"}))
+
+	for _, tc := range []struct {
+		userID  string
+		mxid    id.UserID
+		isGhost bool
+	}{
+		{"user1", "", false},
+		{"ghost1", "@bob:example.com", true},
+		// Ghosts without the prop are found in the database
+		{"ghost2", "@carol:example.com", true},
+		{"ghost3", "", true},
+	} {
+		mxid, isGhost := m.ghostMXID(ctx, "", tc.userID)
+		assert.Equal(t, tc.mxid, mxid, tc.userID)
+		assert.Equal(t, tc.isGhost, isGhost, tc.userID)
+	}
+
+	// Without a double puppet, posts of ghosts are dropped
+	assert.Empty(t, m.ghostPostLogin(ctx, "@bob:example.com"))
+}
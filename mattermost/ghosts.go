@@ -4,119 +4,131 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"go.mau.fi/util/ptr"
-	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/id"
 )
 
-func (m *MattermostAPI) UpdateGhost(ctx context.Context, ghost *bridgev2.Ghost) error {
-	// Get the Mattermost User ID for the ghost
-	mmUserID := m.getMMID(ctx, ghost.ID)
+// matrixProfileSyncInterval is how often the profile of a Matrix user who is sending
+// messages is checked for changes
+const matrixProfileSyncInterval = 15 * time.Minute
 
-	m.Connector.Bridge.Log.Info().Str("mm_user_id", mmUserID).Str("mxid", string(ghost.ID)).Str("ghost_name", ghost.Name).Str("avatar_mxc", string(ghost.AvatarMXC)).Msg("UpdateGhost called")
+// profileSyncKey is the Mattermost account of a Matrix user on a server
+type profileSyncKey struct {
+	server string
+	mxid   id.UserID
+}
 
-	// If ghost profile is empty, try to fetch it from Matrix
-	if (ghost.Name == "" || ghost.AvatarMXC == "") && m.Connector.Config.SynapseAdmin.URL != "" {
-		// Create ad-hoc admin client to fetch profile
-		adminClient := NewMatrixAdminClient(m.Connector.Config.SynapseAdmin.URL, m.Connector.Config.SynapseAdmin.Token)
-		profile, err := adminClient.GetProfile(ctx, id.UserID(ghost.ID))
+// shouldSyncMatrixProfile checks whether the profile of a Matrix user on a server is due
+// for a check, and marks it as checked if it is
+func (m *MattermostConnector) shouldSyncMatrixProfile(server string, mxid id.UserID) bool {
+	m.profileSyncLock.Lock()
+	defer m.profileSyncLock.Unlock()
+	key := profileSyncKey{server: server, mxid: mxid}
+	if last, ok := m.profileSyncs[key]; ok && time.Since(last) < matrixProfileSyncInterval {
+		return false
+	}
+	if m.profileSyncs == nil {
+		m.profileSyncs = make(map[profileSyncKey]time.Time)
+	}
+	m.profileSyncs[key] = time.Now()
+	return true
+}
 
-		if err == nil && profile != nil {
-			m.Connector.Bridge.Log.Info().Str("displayname", profile.DisplayName).Str("avatar_url", profile.AvatarURL).Msg("Fetched profile from Matrix")
-			if profile.DisplayName != "" {
-				ghost.Name = profile.DisplayName
-			}
-			if profile.AvatarURL != "" {
-				ghost.AvatarMXC = id.ContentURIString(profile.AvatarURL)
-			}
-			// Update ghost in DB
-			if ghost.Ghost != nil {
-				m.Connector.Bridge.DB.Ghost.Update(ctx, ghost.Ghost)
-			}
-		} else {
-			m.Connector.Bridge.Log.Warn().Err(err).Msg("Failed to fetch profile from Matrix")
-		}
+// queueMatrixProfileSync copies the profile of a message sender to their Mattermost account
+// in the background, so that sending messages doesn't wait for it
+func (m *MattermostAPI) queueMatrixProfileSync(ctx context.Context, mxid id.UserID, mmUserID string) {
+	if !m.Connector.shouldSyncMatrixProfile(loginServer(m.Login), mxid) {
+		return
 	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := m.UpdateMatrixUserProfile(ctx, mxid, mmUserID); err != nil {
+			m.Connector.Bridge.Log.Warn().Err(err).Str("mxid", string(mxid)).Msg("Failed to update ghost profile")
+		}
+	}()
+}
 
-	// Get authenticated client for the ghost (for updating profile)
-	// We need a client that can update the user. System admin token (m.Client) is best.
+// UpdateMatrixUserProfile copies the profile of a Matrix user to the Mattermost account
+// the bridge created for them on the server of the login. Mattermost is only updated if
+// the profile changed since the last time.
+func (m *MattermostAPI) UpdateMatrixUserProfile(ctx context.Context, mxid id.UserID, mmUserID string) error {
+	if m.Connector.MatrixAdmin == nil {
+		return nil
+	}
+	server := loginServer(m.Login)
+	matrixUser, err := m.Connector.MatrixUsers.Get(ctx, server, mxid)
+	if err != nil {
+		return fmt.Errorf("failed to get Matrix user: %w", err)
+	} else if matrixUser == nil {
+		return fmt.Errorf("no Mattermost account for %s", mxid)
+	}
 
-	// Check if we need to update avatar
-	if ghost.AvatarMXC == "" {
-		m.Connector.Bridge.Log.Info().Str("mxid", string(ghost.ID)).Msg("Ghost has no AvatarMXC, skipping avatar update")
-	} else if ghost.AvatarHash == [32]byte{} {
-		m.Connector.Bridge.Log.Info().Str("mxid", string(ghost.ID)).Msg("Ghost has no AvatarHash, but has MXC... proceeding?")
-		// Proceeding might be risky if we don't have hash?
-		// Actually typical logic relies on hash to check changes.
-		// But let's log it.
+	profile, err := m.Connector.MatrixAdmin.GetProfile(ctx, mxid)
+	if err != nil {
+		return fmt.Errorf("failed to fetch profile from Matrix: %w", err)
+	} else if profile == nil {
+		return nil
+	}
+	avatarMXC := id.ContentURIString(profile.AvatarURL)
+	nameChanged := profile.DisplayName != "" && profile.DisplayName != matrixUser.Name
+	avatarChanged := avatarMXC != "" && avatarMXC != matrixUser.AvatarMXC
+	if !nameChanged && !avatarChanged {
+		return nil
+	}
+	m.Connector.Bridge.Log.Debug().
+		Str("mm_user_id", mmUserID).
+		Str("mxid", string(mxid)).
+		Bool("name_changed", nameChanged).
+		Bool("avatar_changed", avatarChanged).
+		Msg("Matrix profile changed, updating ghost")
+	// Ghosts on additional servers are created with the server's admin token, logins of
+	// those servers may not be allowed to edit other users
+	client := m.adminClient()
+	if server != "" {
+		if client, err = m.Connector.serverAdminClient(server); err != nil {
+			return err
+		}
 	}
 
-	if ghost.AvatarMXC != "" {
+	if avatarChanged {
 		// Download avatar from Matrix
-		data, err := m.Connector.Bridge.Bot.DownloadMedia(ctx, ghost.AvatarMXC, nil)
+		data, err := m.Connector.Bridge.Bot.DownloadMedia(ctx, avatarMXC, nil)
 		if err != nil {
 			return fmt.Errorf("failed to download avatar: %w", err)
 		}
 
-		// Calculate hash and check if update is needed
+		// The same image can be uploaded again with a new MXC URI
 		hash := sha256.Sum256(data)
-
-		// Check if Mattermost actually has a profile picture
-		// If LastPictureUpdate is 0, it means no custom picture is set
-		var lastPictureUpdate int64
-		user, _, err := m.Client.GetUser(ctx, mmUserID, "")
-		if err == nil {
-			lastPictureUpdate = user.LastPictureUpdate
-		}
-
-		if hash == ghost.AvatarHash && lastPictureUpdate > 0 {
-			m.Connector.Bridge.Log.Debug().Str("mxid", string(ghost.ID)).Msg("Avatar hash matches and MM user has picture, skipping update")
-		} else {
-			if lastPictureUpdate == 0 {
-				m.Connector.Bridge.Log.Info().Str("mxid", string(ghost.ID)).Msg("Forcing avatar update because Mattermost user has no picture")
-			}
-
-			// Upload to Mattermost
-			_, err = m.Client.SetProfileImage(ctx, mmUserID, data)
+		if hash != matrixUser.AvatarHash {
+			_, err = client.SetProfileImage(ctx, mmUserID, data)
 			if err != nil {
 				return fmt.Errorf("failed to set profile image: %w", err)
 			}
-
-			// Update hash and persist
-			ghost.AvatarHash = hash
-			if ghost.Ghost != nil {
-				err = m.Connector.Bridge.DB.Ghost.Update(ctx, ghost.Ghost)
-				if err != nil {
-					m.Connector.Bridge.Log.Warn().Err(err).Msg("Failed to persist ghost avatar hash")
-				}
-			}
-			m.Connector.Bridge.Log.Info().Str("user_id", mmUserID).Str("mxid", string(ghost.ID)).Msg("Updated ghost avatar")
+			m.Connector.Bridge.Log.Info().Str("user_id", mmUserID).Str("mxid", string(mxid)).Msg("Updated ghost avatar")
 		}
+		matrixUser.AvatarMXC = avatarMXC
+		matrixUser.AvatarHash = hash
 	}
 
-	// Update Display Name if changed
-	if ghost.Name != "" {
-		// Fetch current user to compare
-		user, _, err := m.Client.GetUser(ctx, mmUserID, "")
-		if err == nil {
-			// Update if different
-			if user.FirstName != ghost.Name {
-				patch := &model.UserPatch{
-					FirstName: &ghost.Name,
-					LastName:  ptr.Ptr(""),
-					Nickname:  &ghost.Name,
-				}
-				_, _, err := m.Client.PatchUser(ctx, mmUserID, patch)
-				if err != nil {
-					m.Connector.Bridge.Log.Warn().Err(err).Msg("Failed to update ghost display name")
-				} else {
-					m.Connector.Bridge.Log.Info().Str("user_id", mmUserID).Str("name", ghost.Name).Msg("Updated ghost display name")
-				}
-			}
+	if nameChanged {
+		patch := &model.UserPatch{
+			FirstName: &profile.DisplayName,
+			LastName:  ptr.Ptr(""),
+			Nickname:  &profile.DisplayName,
 		}
+		_, _, err := client.PatchUser(ctx, mmUserID, patch)
+		if err != nil {
+			return fmt.Errorf("failed to update display name: %w", err)
+		}
+		m.Connector.Bridge.Log.Info().Str("user_id", mmUserID).Str("name", profile.DisplayName).Msg("Updated ghost display name")
+		matrixUser.Name = profile.DisplayName
 	}
 
+	if err = m.Connector.MatrixUsers.UpdateProfile(ctx, matrixUser); err != nil {
+		return fmt.Errorf("failed to save ghost profile: %w", err)
+	}
 	return nil
 }
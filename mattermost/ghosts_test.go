@@ -0,0 +1,69 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/id"
+)
+
+// profileAdmin is a homeserver admin backend that only supports GetProfile
+type profileAdmin struct {
+	HomeserverAdmin
+	profile *ProfileResponse
+	calls   int
+}
+
+func (a *profileAdmin) GetProfile(ctx context.Context, userID id.UserID) (*ProfileResponse, error) {
+	a.calls++
+	return a.profile, nil
+}
+
+func TestShouldSyncMatrixProfile(t *testing.T) {
+	connector := &MattermostConnector{}
+	assert.True(t, connector.shouldSyncMatrixProfile("", "@alice:example.com"))
+	assert.False(t, connector.shouldSyncMatrixProfile("", "@alice:example.com"))
+	assert.True(t, connector.shouldSyncMatrixProfile("", "@bob:example.com"))
+}
+
+func TestUpdateMatrixUserProfile_OnlyPatchesChanges(t *testing.T) {
+	ctx := context.Background()
+	var patches []model.UserPatch
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v4/users/alice-mm-id/patch", r.URL.Path)
+		var patch model.UserPatch
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&patch))
+		patches = append(patches, patch)
+		_ = json.NewEncoder(w).Encode(&model.User{Id: "alice-mm-id"})
+	}))
+	defer server.Close()
+
+	bridgeDB := newTestBridgeDB(t)
+	store := NewMatrixUserStore("mattermost", bridgeDB.Database)
+	require.NoError(t, store.Upgrade(ctx))
+	require.NoError(t, store.Put(ctx, &MatrixUser{MXID: "@alice:example.com", MMUserID: "alice-mm-id", Token: "token"}))
+
+	admin := &profileAdmin{profile: &ProfileResponse{DisplayName: "Alice"}}
+	api := newMattermostAPI(nil, &MattermostConnector{
+		Bridge:      &bridgev2.Bridge{},
+		MatrixUsers: store,
+		MatrixAdmin: admin,
+	}, NewClient(server.URL, "token"))
+	require.NoError(t, api.UpdateMatrixUserProfile(ctx, "@alice:example.com", "alice-mm-id"))
+	require.NoError(t, api.UpdateMatrixUserProfile(ctx, "@alice:example.com", "alice-mm-id"))
+	assert.Equal(t, 2, admin.calls)
+	require.Len(t, patches, 1)
+	assert.Equal(t, "Alice", *patches[0].Nickname)
+
+	user, err := store.Get(ctx, "", "@alice:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Alice", user.Name)
+	assert.Equal(t, "token", user.Token)
+}
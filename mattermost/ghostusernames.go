@@ -0,0 +1,143 @@
+package mattermost
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+)
+
+// ghostMXIDProp is the user prop that stores the Matrix user a ghost account was created
+// for. Older ghosts only have the Matrix ID as their nickname, which is replaced by the
+// display name when their profile is synced.
+const ghostMXIDProp = "matrix_mxid"
+
+// ghostPosition is the position of the ghost accounts the bridge creates
+const ghostPosition = "Matrix Bridge Ghost"
+
+// ghostUsernameHashLength is the number of hex characters of the Matrix ID's hash that
+// are appended to usernames that are too long or already taken
+const ghostUsernameHashLength = 8
+
+// encodeGhostUsername encodes a Matrix ID as a Mattermost username, reversibly as long as
+// it fits in the username length limit:
+// @james:reilly.asia -> mx.james_reilly.asia
+// _ -> __
+// : -> _
+// uppercase letters are lowercased, other characters are encoded as _xHH
+func encodeGhostUsername(mxid string) string {
+	var sb strings.Builder
+	sb.WriteString("mx.")
+	for _, char := range strings.TrimPrefix(mxid, "@") {
+		switch char {
+		case '_':
+			sb.WriteString("__")
+		case ':':
+			sb.WriteRune('_')
+		default:
+			// Mattermost allows letters, numbers, ., -, _
+			if (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9') || char == '-' || char == '.' {
+				sb.WriteRune(char)
+			} else if char >= 'A' && char <= 'Z' {
+				sb.WriteRune(char + 32) // basic lowercase
+			} else {
+				sb.WriteString(fmt.Sprintf("_x%02x", char))
+			}
+		}
+	}
+	return sb.String()
+}
+
+// ghostUsernames returns the usernames a ghost of a Matrix user can have, in the order
+// they're tried. The fallback ends in a hash of the Matrix ID, so it's the same every time
+// and different for Matrix IDs whose encoding is the same after truncating.
+func ghostUsernames(mxid string) []string {
+	username := encodeGhostUsername(mxid)
+	hash := sha256.Sum256([]byte(mxid))
+	suffix := "-" + hex.EncodeToString(hash[:])[:ghostUsernameHashLength]
+	base := username
+	if len(base) > model.UserNameMaxLength-len(suffix) {
+		base = base[:model.UserNameMaxLength-len(suffix)]
+	}
+	if len(username) > model.UserNameMaxLength {
+		return []string{base + suffix}
+	}
+	return []string{username, base + suffix}
+}
+
+// ghostOwner returns the Matrix user a Mattermost account was created for, or an empty ID
+// if it isn't known
+func ghostOwner(user *model.User) id.UserID {
+	if mxid := user.Props[ghostMXIDProp]; mxid != "" {
+		return id.UserID(mxid)
+	} else if strings.HasPrefix(user.Nickname, "@") {
+		return id.UserID(user.Nickname)
+	}
+	return ""
+}
+
+// claimableGhost checks whether an existing Mattermost account can be used as the ghost of
+// a Matrix user: it must be a ghost account that was created for them, or a ghost account
+// of unknown origin that no other Matrix user has.
+func (m *MattermostConnector) claimableGhost(ctx context.Context, server string, user *model.User, mxid id.UserID) (bool, error) {
+	if !isGhostUser(user) || user.Position != ghostPosition {
+		return false, nil
+	}
+	if owner := ghostOwner(user); owner != "" {
+		return owner == mxid, nil
+	}
+	linked, err := m.MatrixUsers.GetByMMUserID(ctx, server, user.Id)
+	if err != nil {
+		return false, fmt.Errorf("failed to check Matrix user of %s: %w", user.Username, err)
+	}
+	return linked == nil || linked.MXID == mxid, nil
+}
+
+// findGhostUsername returns the existing ghost account of a Matrix user on a server, or the
+// first free username for a new one if there is none. Usernames taken by other users are skipped.
+func (m *MattermostConnector) findGhostUsername(ctx context.Context, server string, mxid id.UserID) (*model.User, string, error) {
+	client := m.serverClient(server)
+	for _, username := range ghostUsernames(string(mxid)) {
+		user, resp, err := client.Client4.GetUserByUsername(ctx, username, "")
+		if err != nil {
+			if responseStatusCode(resp, err) == http.StatusNotFound {
+				return nil, username, nil
+			}
+			return nil, "", fmt.Errorf("failed to check username %s: %w", username, wrapMattermostError(resp, err))
+		}
+		if ok, err := m.claimableGhost(ctx, server, user, mxid); err != nil {
+			return nil, "", err
+		} else if ok {
+			return user, username, nil
+		}
+		zerolog.Ctx(ctx).Warn().Str("mxid", string(mxid)).Str("username", username).Msg("Ghost username is taken by another user")
+	}
+	return nil, "", fmt.Errorf("all ghost usernames of %s are taken", mxid)
+}
+
+// markGhostOwner stores the Matrix ID in the props of a ghost account that doesn't have it,
+// so that it's still recognized after its nickname changes
+func (m *MattermostConnector) markGhostOwner(ctx context.Context, server string, user *model.User, mxid id.UserID) {
+	if user.Props[ghostMXIDProp] == string(mxid) {
+		return
+	}
+	props := model.StringMap{}
+	for key, value := range user.Props {
+		props[key] = value
+	}
+	props[ghostMXIDProp] = string(mxid)
+	client, err := m.serverAdminClient(server)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("mxid", string(mxid)).Msg("Failed to store Matrix ID of ghost")
+		return
+	}
+	if _, resp, err := client.PatchUser(ctx, user.Id, &model.UserPatch{Props: props}); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(wrapMattermostError(resp, err)).Str("mxid", string(mxid)).Msg("Failed to store Matrix ID of ghost")
+	}
+}
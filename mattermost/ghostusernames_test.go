@@ -0,0 +1,73 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGhostUsernames(t *testing.T) {
+	usernames := ghostUsernames("@James_Bond:example.com")
+	require.Len(t, usernames, 2)
+	assert.Equal(t, "mx.james__bond_example.com", usernames[0])
+	assert.True(t, strings.HasPrefix(usernames[1], "mx.james__bond_example.com-"))
+	assert.Equal(t, usernames, ghostUsernames("@James_Bond:example.com"), "usernames are deterministic")
+
+	// Matrix IDs that are the same after truncating get different usernames
+	long := "@" + strings.Repeat("a", 70) + ":example.com"
+	other := "@" + strings.Repeat("a", 70) + ":example.org"
+	longNames, otherNames := ghostUsernames(long), ghostUsernames(other)
+	require.Len(t, longNames, 1)
+	assert.Len(t, longNames[0], model.UserNameMaxLength)
+	assert.NotEqual(t, longNames[0], otherNames[0])
+}
+
+func TestFindGhostUsername(t *testing.T) {
+	users := map[string]*model.User{
+		// A Mattermost user who happens to have the username of alice's ghost
+		"mx.alice_example.com": {Id: "human1", Username: "mx.alice_example.com"},
+		// bob's ghost from before the Matrix ID was stored in the props
+		"mx.bob_example.com": {Id: "ghost2", Username: "mx.bob_example.com", Nickname: "@bob:example.com", Position: ghostPosition},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := users[strings.TrimPrefix(r.URL.Path, "/api/v4/users/username/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(&model.AppError{Id: "app.user.missing_account.const", StatusCode: http.StatusNotFound})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(user)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	store := NewMatrixUserStore("mattermost", newTestBridgeDB(t).Database)
+	require.NoError(t, store.Upgrade(ctx))
+	m := &MattermostConnector{Client: NewClient(server.URL, "token"), MatrixUsers: store}
+
+	user, username, err := m.findGhostUsername(ctx, "", "@alice:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, user)
+	assert.Equal(t, ghostUsernames("@alice:example.com")[1], username)
+
+	user, username, err = m.findGhostUsername(ctx, "", "@bob:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	assert.Equal(t, "ghost2", user.Id)
+	assert.Equal(t, "mx.bob_example.com", username)
+
+	// A ghost that's linked to another Matrix user isn't claimed
+	users["mx.carol_example.com"] = &model.User{Id: "ghost3", Username: "mx.carol_example.com", Nickname: "Carol", Position: ghostPosition}
+	require.NoError(t, store.Put(ctx, &MatrixUser{MXID: "@carol:example.org", MMUserID: "ghost3"}))
+	user, username, err = m.findGhostUsername(ctx, "", "@carol:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, user)
+	assert.Equal(t, ghostUsernames("@carol:example.com")[1], username)
+}
@@ -0,0 +1,156 @@
+package mattermost
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/msgconv"
+)
+
+// groupMentionCacheTTL is how long the members of mentioned groups are cached. Most
+// mentions are of users, which are cached as not being groups, so they don't ask
+// Mattermost for every message either.
+const groupMentionCacheTTL = 10 * time.Minute
+
+// maxGroupMentionMembers is the largest group whose members are mentioned on Matrix. Mentions
+// of larger groups are only highlighted.
+const maxGroupMentionMembers = 200
+
+var _ msgconv.GroupMentionResolver = (*MattermostConnector)(nil)
+
+// groupMentionCache caches the Matrix users of the members of groups by server and name.
+// The zero value is ready to use.
+type groupMentionCache struct {
+	lock    sync.Mutex
+	entries map[string]*groupMentionEntry
+}
+
+type groupMentionEntry struct {
+	// isGroup is false for names that aren't groups that can be mentioned
+	isGroup bool
+	members []id.UserID
+	checked time.Time
+}
+
+// get returns a cached group, or nil if it isn't cached or expired
+func (c *groupMentionCache) get(key string) *groupMentionEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Since(entry.checked) >= groupMentionCacheTTL {
+		return nil
+	}
+	return entry
+}
+
+func (c *groupMentionCache) set(key string, entry *groupMentionEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*groupMentionEntry)
+	}
+	entry.checked = time.Now()
+	c.entries[key] = entry
+}
+
+// ResolveGroupMentions returns the Matrix users of the members of mentioned groups
+func (m *MattermostConnector) ResolveGroupMentions(ctx context.Context, client msgconv.MattermostClientProvider, names []string) map[string][]id.UserID {
+	if client.GetClient() == nil {
+		return nil
+	}
+	var server string
+	if api, ok := client.(*MattermostAPI); ok {
+		server = loginServer(api.Login)
+	}
+	groups := make(map[string][]id.UserID)
+	var missing []string
+	for _, name := range names {
+		if entry := m.groupMentions.get(server + "/" + name); entry == nil {
+			missing = append(missing, name)
+		} else if entry.isGroup {
+			groups[name] = entry.members
+		}
+	}
+	if len(missing) == 0 {
+		return groups
+	}
+	found, resp, err := client.GetClient().GetGroupsByNames(ctx, missing)
+	if err != nil {
+		// Servers without a license for groups reject the request, so every name is cached
+		// as not being a group
+		if status := responseStatusCode(resp, err); status != http.StatusNotImplemented && status != http.StatusForbidden {
+			zerolog.Ctx(ctx).Warn().Err(wrapMattermostError(resp, err)).Msg("Failed to get mentioned groups")
+			return groups
+		}
+	}
+	resolved := make(map[string]*groupMentionEntry, len(found))
+	for _, group := range found {
+		if group.Name == nil || !group.AllowReference || group.DeleteAt != 0 {
+			continue
+		}
+		members, err := m.groupMemberMXIDs(ctx, client.GetClient(), server, group.Id)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("group_id", group.Id).Msg("Failed to get members of mentioned group")
+		}
+		resolved[*group.Name] = &groupMentionEntry{isGroup: true, members: members}
+	}
+	for _, name := range missing {
+		entry, ok := resolved[name]
+		if !ok {
+			entry = &groupMentionEntry{}
+		}
+		m.groupMentions.set(server+"/"+name, entry)
+		if entry.isGroup {
+			groups[name] = entry.members
+		}
+	}
+	return groups
+}
+
+// groupMemberMXIDs returns the Matrix users of the members of a group, or none if it has
+// more than maxGroupMentionMembers members
+func (m *MattermostConnector) groupMemberMXIDs(ctx context.Context, client *model.Client4, server, groupID string) ([]id.UserID, error) {
+	var members []id.UserID
+	for page := 0; ; page++ {
+		users, resp, err := client.GetUsersInGroup(ctx, groupID, page, usersPerPage, "")
+		if err != nil {
+			return nil, wrapMattermostError(resp, err)
+		}
+		for _, user := range users {
+			if mxid := m.mentionMXID(server, user); mxid != "" {
+				members = append(members, mxid)
+			}
+		}
+		if len(members) > maxGroupMentionMembers {
+			return nil, nil
+		} else if len(users) < usersPerPage {
+			return members, nil
+		}
+	}
+}
+
+// mentionMXID returns the Matrix user that is mentioned for a Mattermost user: the Matrix
+// user of their login or ghost account, or their ghost on Matrix
+func (m *MattermostConnector) mentionMXID(server string, user *model.User) id.UserID {
+	if isGhostUser(user) {
+		return ghostOwner(user)
+	}
+	if loginID := m.loginIDForMMUser(user.Id); loginID != "" {
+		m.usersLock.RLock()
+		login := m.users[loginID]
+		m.usersLock.RUnlock()
+		if login != nil {
+			return login.UserMXID
+		}
+	}
+	if m.Bridge == nil || m.Bridge.Matrix == nil {
+		return ""
+	}
+	return m.Bridge.Matrix.GhostIntent(MakeServerUserID(server, user.Id)).GetMXID()
+}
@@ -0,0 +1,74 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestResolveGroupMentions(t *testing.T) {
+	var groupLookups int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/groups/names":
+			groupLookups++
+			var names []string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&names))
+			var groups []*model.Group
+			if slices.Contains(names, "developers") {
+				groups = append(groups, &model.Group{Id: "group1", Name: model.NewPointer("developers"), AllowReference: true})
+			}
+			if slices.Contains(names, "hidden") {
+				groups = append(groups, &model.Group{Id: "group2", Name: model.NewPointer("hidden")})
+			}
+			_ = json.NewEncoder(w).Encode(groups)
+		case "/api/v4/users":
+			assert.Equal(t, "group1", r.URL.Query().Get("in_group"))
+			_ = json.NewEncoder(w).Encode([]*model.User{
+				{Id: "user1", Username: "alice"},
+				{Id: "ghost1", Username: "mx.bob_example.com", Props: model.StringMap{ghostMXIDProp: "@bob:example.com"}},
+				{Id: "ghost2", Username: "mx.carol_example.com"},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	m := &MattermostConnector{}
+	client := newMattermostAPI(nil, m, NewClient(server.URL, "token"))
+	ctx := context.Background()
+
+	groups := m.ResolveGroupMentions(ctx, client, []string{"developers", "hidden", "alice"})
+	// Without a bridge, only ghost accounts of Matrix users have a known Matrix user
+	assert.Equal(t, map[string][]id.UserID{"developers": {"@bob:example.com"}}, groups)
+
+	// Groups and names that aren't groups are cached
+	groups = m.ResolveGroupMentions(ctx, client, []string{"alice", "developers"})
+	assert.Equal(t, map[string][]id.UserID{"developers": {"@bob:example.com"}}, groups)
+	assert.Equal(t, 1, groupLookups)
+}
+
+func TestResolveGroupMentions_Unlicensed(t *testing.T) {
+	var groupLookups int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		groupLookups++
+		w.WriteHeader(http.StatusNotImplemented)
+		_ = json.NewEncoder(w).Encode(model.AppError{Id: "api.ldap_groups.license_error", StatusCode: http.StatusNotImplemented})
+	}))
+	defer server.Close()
+
+	m := &MattermostConnector{}
+	client := newMattermostAPI(nil, m, NewClient(server.URL, "token"))
+	assert.Empty(t, m.ResolveGroupMentions(context.Background(), client, []string{"developers"}))
+	assert.Empty(t, m.ResolveGroupMentions(context.Background(), client, []string{"developers"}))
+	assert.Equal(t, 1, groupLookups)
+}
@@ -3,60 +3,42 @@ package mattermost
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"strings"
 
 	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
 	"go.mau.fi/util/random"
-	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
 )
 
-// EnsureGhost ensures a Mattermost ghost user exists for the given Matrix ID.
+// EnsureGhost ensures a Mattermost ghost user exists for the given Matrix ID on a server.
 // Returns the Mattermost User ID (UUID).
-func (m *MattermostConnector) EnsureGhost(ctx context.Context, mxid string) (string, error) {
-	// 1. Generate a valid Mattermost username using reversible encoding
-	// @james:reilly.asia -> matrix_james.reilly.asia
-	// _ -> __
-	// : -> .
-	// . -> _d
-	// - is preserved
-	cleanMXID := strings.TrimPrefix(mxid, "@")
-	var sb strings.Builder
-	sb.WriteString("mx.")
-	
-	for _, char := range cleanMXID {
-		switch char {
-		case '_':
-			sb.WriteString("__")
-		case ':':
-			// Replace colon with underscore as requested by user
-			sb.WriteRune('_')
-		default:
-			// Mattermost allows letters, numbers, ., -, _
-			if (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9') || char == '-' || char == '.' {
-				sb.WriteRune(char)
-			} else if char >= 'A' && char <= 'Z' {
-				sb.WriteRune(char + 32) // basic lowercase
-			} else {
-				// Encode other chars as _xHH
-				sb.WriteString(fmt.Sprintf("_x%02x", char))
-			}
-		}
+func (m *MattermostConnector) EnsureGhost(ctx context.Context, server, mxid string) (string, error) {
+	matrixUser, err := m.MatrixUsers.Get(ctx, server, id.UserID(mxid))
+	if err != nil {
+		return "", fmt.Errorf("failed to get Matrix user: %w", err)
+	} else if matrixUser != nil && matrixUser.MMUserID != "" {
+		return matrixUser.MMUserID, nil
 	}
-	
-	username := sb.String()
-	// Mattermost limit is usually 64
-	if len(username) > 64 {
-		username = username[:64]
+
+	// Ghosts can only be created on servers the bridge has an admin token for
+	if _, err = m.serverAdminClient(server); err != nil {
+		return "", err
 	}
 
-	// 2. Check if user exists
-	user, err := m.Client.GetUserByUsername(ctx, username)
-	if err == nil && user != nil {
-		return user.Id, nil
+	// 1. Find the existing ghost, or a free username for a new one
+	user, username, err := m.findGhostUsername(ctx, server, id.UserID(mxid))
+	if err != nil {
+		return "", err
+	} else if user != nil {
+		m.markGhostOwner(ctx, server, user, id.UserID(mxid))
+		return user.Id, m.saveMatrixUser(ctx, server, mxid, user.Id)
 	}
 
-	// 3. Create user if not exists
+	// 2. Create user if not exists
 	// Parse MXID for pretty display name
+	cleanMXID := strings.TrimPrefix(mxid, "@")
 	localpart := cleanMXID
 	serverName := ""
 	if idx := strings.LastIndex(cleanMXID, ":"); idx != -1 {
@@ -74,94 +56,99 @@ func (m *MattermostConnector) EnsureGhost(ctx context.Context, mxid string) (str
 		FirstName: localpart,
 		LastName:  fmt.Sprintf("(%s)", serverName),
 		Nickname:  mxid,
-		Position:  "Matrix Bridge Ghost",
+		Position:  ghostPosition,
+		Props:     model.StringMap{ghostMXIDProp: mxid},
 	}
 
-	createdUser, err := m.Client.CreateUser(ctx, newUser)
+	createdUser, err := m.createUser(ctx, server, newUser)
 	if err != nil {
 		// Race condition check: try fetching again
-		user, err2 := m.Client.GetUserByUsername(ctx, username)
-		if err2 == nil && user != nil {
-			return user.Id, nil
+		user, err2 := m.serverClient(server).GetUserByUsername(ctx, username)
+		if err2 == nil && user != nil && ghostOwner(user) == id.UserID(mxid) {
+			return user.Id, m.saveMatrixUser(ctx, server, mxid, user.Id)
 		}
 		return "", fmt.Errorf("failed to create Mattermost user for ghost: %w", err)
 	}
 
-	// 4. Update ghost metadata if possible to cache the ID
-	ghost, _ := m.Bridge.GetGhostByID(ctx, networkid.UserID(mxid))
-	if ghost != nil {
-		if ghost.Metadata == nil {
-			ghost.Metadata = make(map[string]any)
-		}
-		if meta, ok := ghost.Metadata.(map[string]any); ok {
-			if meta["mm_id"] != createdUser.Id {
-				meta["mm_id"] = createdUser.Id
-				ghost.Metadata = meta
-				if ghost.Ghost != nil {
-					_ = m.Bridge.DB.Ghost.Update(ctx, ghost.Ghost)
-				}
-			}
-		}
-	}
+	return createdUser.Id, m.saveMatrixUser(ctx, server, mxid, createdUser.Id)
+}
 
-	return createdUser.Id, nil
+// saveMatrixUser remembers the Mattermost account of a Matrix user on a server
+func (m *MattermostConnector) saveMatrixUser(ctx context.Context, server, mxid, mmUserID string) error {
+	err := m.MatrixUsers.Put(ctx, &MatrixUser{Server: server, MXID: id.UserID(mxid), MMUserID: mmUserID})
+	if err != nil {
+		return fmt.Errorf("failed to save Mattermost account of Matrix user: %w", err)
+	}
+	return nil
 }
 
-// GetClientForUser returns a Mattermost Client authenticated as the given Matrix user.
-// It manages (creates and caches) Personal Access Tokens for the ghost user.
-func (m *MattermostConnector) GetClientForUser(ctx context.Context, mxid string) (*Client, string, error) {
+// GetClientForUser returns a Mattermost Client authenticated as the given Matrix user on
+// a server. It manages (creates and caches) Personal Access Tokens for the ghost user.
+func (m *MattermostConnector) GetClientForUser(ctx context.Context, server, mxid string) (*Client, string, error) {
 	// 1. Ensure ghost user exists and get MM ID
-	mmUserID, err := m.EnsureGhost(ctx, mxid)
+	mmUserID, err := m.EnsureGhost(ctx, server, mxid)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to ensure ghost: %w", err)
 	}
+	serverURL, _ := m.serverURL(server)
 
-	// 2. Get the bridge ghost object to access metadata
-	ghost, err := m.Bridge.GetGhostByID(ctx, networkid.UserID(mxid))
+	// 2. Check for an existing token
+	matrixUser, err := m.MatrixUsers.Get(ctx, server, id.UserID(mxid))
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to get bridge ghost: %w", err)
-	}
-
-	// 3. Check for existing token in metadata
-	var metadata map[string]any
-	if ghost.Metadata == nil {
-		metadata = make(map[string]any)
-	} else if m, ok := ghost.Metadata.(map[string]any); ok {
-		metadata = m
-	} else {
-		// Should not happen, but safeguard
-		metadata = make(map[string]any)
-	}
-	
-	val, ok := metadata["mm_token"]
-	if ok {
-		tokenStr, ok := val.(string)
-		if ok && tokenStr != "" {
-			return NewClient(m.Config.ServerURL, tokenStr), mmUserID, nil
-		}
+		return nil, "", fmt.Errorf("failed to get Matrix user: %w", err)
+	}
+	if matrixUser.Token != "" {
+		return NewClient(serverURL, matrixUser.Token), mmUserID, nil
 	}
 
-	// 4. Generate new token if missing
-	token, err := m.Client.CreateUserAccessToken(ctx, mmUserID, "Matrix Bridge Ghost Token")
+	// 3. Generate new token if missing
+	token, err := m.createUserAccessToken(ctx, server, mmUserID, "Matrix Bridge Ghost Token")
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to create access token for ghost %s: %w", mmUserID, err)
 	}
-	
-	// 5. Store token in metadata
-	metadata["mm_token"] = token.Token
-	ghost.Metadata = metadata
-	
-	// Save metadata directly to DB
-	// Use explicit update if ghost.Ghost exists, otherwise comment out if unsure
-	// Based on errors, let's assume ghost.Ghost is safe or the compiler would have complained earlier?
-	// Actually, safer to check if Bridge has SaveGhost method?
-	// I'll try calling DB Update on ghost.Ghost if safe.
-	if ghost.Ghost != nil {
-		err = m.Bridge.DB.Ghost.Update(ctx, ghost.Ghost)
-		if err != nil {
-			m.Bridge.Log.Warn().Err(err).Msg("Failed to save ghost token to database")
+
+	// 4. Store token
+	matrixUser.Token = token.Token
+	if err = m.MatrixUsers.Put(ctx, matrixUser); err != nil {
+		m.Bridge.Log.Warn().Err(err).Msg("Failed to save ghost token to database")
+	}
+
+	return NewClient(serverURL, token.Token), mmUserID, nil
+}
+
+// InvalidateUserToken removes the cached Personal Access Token of a ghost user on a server,
+// so that the next GetClientForUser call creates a new one.
+func (m *MattermostConnector) InvalidateUserToken(ctx context.Context, server, mxid string) error {
+	if err := m.MatrixUsers.ClearToken(ctx, server, id.UserID(mxid)); err != nil {
+		return fmt.Errorf("failed to clear ghost token: %w", err)
+	}
+	return nil
+}
+
+// DoAsUser calls fn with the client of a ghost user. If Mattermost rejects the ghost's
+// Personal Access Token because it was revoked or has expired, a new token is created
+// and fn is called again once. Clients of logins are only called once, as their token
+// can't be replaced.
+func (m *MattermostConnector) DoAsUser(ctx context.Context, server, mxid string, client *Client, fn func(client *Client) (*model.Response, error)) (*model.Response, error) {
+	resp, err := fn(client)
+	if statusCode := responseStatusCode(resp, err); err == nil || statusCode != http.StatusUnauthorized || m.isLoginClient(client) {
+		if err != nil && statusCode == http.StatusTooManyRequests {
+			m.notifyStatusAsync(statusKeyRateLimit, "Mattermost is rate limiting the bridge, messages from Matrix are delayed or failing")
 		}
+		return resp, err
+	}
+
+	log := zerolog.Ctx(ctx).With().Str("server", server).Str("mxid", mxid).Logger()
+	log.Warn().Err(err).Msg("Ghost access token was rejected, creating a new one")
+	if invalidateErr := m.InvalidateUserToken(ctx, server, mxid); invalidateErr != nil {
+		log.Err(invalidateErr).Msg("Failed to invalidate ghost access token")
+		return resp, err
+	}
+	newClient, _, clientErr := m.GetClientForUser(ctx, server, mxid)
+	if clientErr != nil {
+		log.Err(clientErr).Msg("Failed to create new ghost access token")
+		return resp, err
 	}
-	
-	return NewClient(m.Config.ServerURL, token.Token), mmUserID, nil
+	return fn(newClient)
 }
+
@@ -0,0 +1,53 @@
+package mattermost
+
+import (
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// Ghosts are always identified by the Mattermost user ID (the 26 character UUID) of the
+// user they represent. Usernames can be changed on Mattermost and Matrix IDs belong to
+// the Matrix side, so neither of them is used as a networkid.UserID. The Mattermost
+// accounts the bridge creates for Matrix users are stored separately, see MatrixUserStore.
+//
+// Ghosts of additional servers (see ServerConfig) are prefixed with the server name and a
+// dot, so that each server has its own ghost namespace. Mattermost IDs never contain dots.
+
+// MakeUserID returns the ghost ID of a user of the main Mattermost server
+func MakeUserID(mmUserID string) networkid.UserID {
+	return networkid.UserID(mmUserID)
+}
+
+// MakeServerUserID returns the ghost ID of a Mattermost user of a server
+func MakeServerUserID(server, mmUserID string) networkid.UserID {
+	if server == "" {
+		return MakeUserID(mmUserID)
+	}
+	return networkid.UserID(server + "." + mmUserID)
+}
+
+// ParseUserID returns the Mattermost user ID of a ghost
+func ParseUserID(userID networkid.UserID) string {
+	_, mmUserID := ParseServerUserID(userID)
+	return mmUserID
+}
+
+// ParseServerUserID returns the server name and the Mattermost user ID of a ghost
+func ParseServerUserID(userID networkid.UserID) (server, mmUserID string) {
+	server, mmUserID, ok := strings.Cut(string(userID), ".")
+	if !ok {
+		return "", string(userID)
+	}
+	return server, mmUserID
+}
+
+// MakeServerLoginID returns the login ID of a Mattermost user of a server. Logins of the
+// main server are identified by the username, logins of additional servers are prefixed
+// like ghosts.
+func MakeServerLoginID(server, username string) networkid.UserLoginID {
+	if server == "" {
+		return networkid.UserLoginID(username)
+	}
+	return networkid.UserLoginID(server + "." + username)
+}
@@ -0,0 +1,51 @@
+package mattermost
+
+import (
+	"slices"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// IgnoreConfig lists posts that are never bridged to Matrix
+type IgnoreConfig struct {
+	UserIDs          []string `yaml:"user_ids"`
+	PostTypes        []string `yaml:"post_types"`
+	CommandResponses bool     `yaml:"command_responses"`
+}
+
+// ignoredPostReason returns why a post must not be bridged to Matrix, or an empty
+// string if it may be. Ephemeral posts are only meant for one user, and posts from the
+// bridge's own bot logins would loop back to Matrix.
+func (m *MattermostConnector) ignoredPostReason(post *model.Post) string {
+	switch {
+	case post.Type == model.PostTypeEphemeral:
+		return "ephemeral post"
+	case post.GetProp("from_matrix") == true:
+		return "echo of post sent from Matrix"
+	case post.GetProp("from_bridge") == true:
+		return "bridge notice post"
+	case m.config().Ignore.CommandResponses && post.GetProp(model.PostPropsFromWebhook) == "true":
+		return "slash command or webhook response"
+	case slices.Contains(m.config().Ignore.UserIDs, post.UserId):
+		return "post from ignored user"
+	case slices.Contains(m.config().Ignore.PostTypes, post.Type):
+		return "ignored post type"
+	case m.isBotLoginUser(post.UserId):
+		return "post from bridge bot account"
+	}
+	return ""
+}
+
+// isBotLoginUser checks whether a Mattermost user is a bot account logged into the bridge
+func (m *MattermostConnector) isBotLoginUser(userID string) bool {
+	if userID == "" {
+		return false
+	}
+	for _, login := range m.GetUsers() {
+		meta, ok := login.Metadata.(map[string]any)
+		if ok && meta["bot"] == true && meta["mm_id"] == userID {
+			return true
+		}
+	}
+	return false
+}
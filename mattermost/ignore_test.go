@@ -0,0 +1,43 @@
+package mattermost
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestIgnoredPostReason(t *testing.T) {
+	connector := &MattermostConnector{
+		Config: &NetworkConfig{Ignore: IgnoreConfig{
+			UserIDs:          []string{"otherbot"},
+			PostTypes:        []string{"custom_poll"},
+			CommandResponses: true,
+		}},
+		users: map[networkid.UserLoginID]*bridgev2.UserLogin{
+			"relaybot": {UserLogin: &database.UserLogin{ID: "relaybot", Metadata: map[string]any{"mm_id": "bot1", "bot": true}}},
+			"alice":    {UserLogin: &database.UserLogin{ID: "alice", Metadata: map[string]any{"mm_id": "user1"}}},
+		},
+	}
+	newPost := func(userID, postType string, props model.StringInterface) *model.Post {
+		post := &model.Post{UserId: userID, Type: postType}
+		post.SetProps(props)
+		return post
+	}
+
+	assert.Empty(t, connector.ignoredPostReason(newPost("user1", "", nil)))
+	assert.Empty(t, connector.ignoredPostReason(newPost("user2", "custom_other", nil)))
+	assert.NotEmpty(t, connector.ignoredPostReason(newPost("user1", model.PostTypeEphemeral, nil)))
+	assert.NotEmpty(t, connector.ignoredPostReason(newPost("user1", "", model.StringInterface{"from_matrix": true})))
+	assert.NotEmpty(t, connector.ignoredPostReason(newPost("user1", "", model.StringInterface{"from_bridge": true})))
+	assert.NotEmpty(t, connector.ignoredPostReason(newPost("user1", "", model.StringInterface{model.PostPropsFromWebhook: "true"})))
+	assert.NotEmpty(t, connector.ignoredPostReason(newPost("otherbot", "", nil)))
+	assert.NotEmpty(t, connector.ignoredPostReason(newPost("user1", "custom_poll", nil)))
+	assert.NotEmpty(t, connector.ignoredPostReason(newPost("bot1", "", nil)))
+
+	connector.config().Ignore.CommandResponses = false
+	assert.Empty(t, connector.ignoredPostReason(newPost("user1", "", model.StringInterface{model.PostPropsFromWebhook: "true"})))
+}
@@ -0,0 +1,205 @@
+package mattermost
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Rooms that can't be joined directly may still be knocked on. /matrix join knocks when the
+// join is forbidden, and the channel is created once a member of the room accepts the knock
+// by inviting the user.
+
+var pendingKnockUpgrades dbutil.UpgradeTable
+
+func init() {
+	pendingKnockUpgrades.Register(-1, 1, 0, "Create Mattermost pending knock table", dbutil.TxnModeOn, func(ctx context.Context, db *dbutil.Database) error {
+		_, err := db.Exec(ctx, `
+			CREATE TABLE mattermost_pending_knock (
+				bridge_id       TEXT   NOT NULL,
+				room_id         TEXT   NOT NULL,
+				mxid            TEXT   NOT NULL,
+				mm_user_id      TEXT   NOT NULL,
+				room_identifier TEXT   NOT NULL,
+				knocked_at      BIGINT NOT NULL,
+
+				PRIMARY KEY (bridge_id, room_id, mxid)
+			)
+		`)
+		return err
+	})
+}
+
+// knockReason is sent with knocks, so that room members know where they come from
+const knockReason = "Joining from Mattermost"
+
+// knockRequest is the body of a knock request
+type knockRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// PendingKnock is a knock on a Matrix room that is waiting to be accepted
+type PendingKnock struct {
+	RoomID id.RoomID
+	// MXID is the Matrix account that knocked
+	MXID     id.UserID
+	MMUserID string
+	// RoomIdentifier is the alias or ID the user asked to join, which names the channel
+	RoomIdentifier string
+	KnockedAt      time.Time
+}
+
+// PendingKnockStore stores the knocks sent by /matrix join, so that the channel can be
+// created when one is accepted, even after a restart
+type PendingKnockStore struct {
+	bridgeID networkid.BridgeID
+	db       *dbutil.Database
+}
+
+// NewPendingKnockStore creates a pending knock store in the given database
+func NewPendingKnockStore(bridgeID networkid.BridgeID, db *dbutil.Database) *PendingKnockStore {
+	return &PendingKnockStore{
+		bridgeID: bridgeID,
+		db:       db.Child("mattermost_pending_knock_version", pendingKnockUpgrades, nil),
+	}
+}
+
+// Upgrade creates the table if needed
+func (s *PendingKnockStore) Upgrade(ctx context.Context) error {
+	return s.db.Upgrade(ctx)
+}
+
+// Put inserts or replaces a pending knock
+func (s *PendingKnockStore) Put(ctx context.Context, knock *PendingKnock) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO mattermost_pending_knock (bridge_id, room_id, mxid, mm_user_id, room_identifier, knocked_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (bridge_id, room_id, mxid) DO UPDATE
+			SET mm_user_id=excluded.mm_user_id, room_identifier=excluded.room_identifier, knocked_at=excluded.knocked_at
+	`, s.bridgeID, knock.RoomID, knock.MXID, knock.MMUserID, knock.RoomIdentifier, knock.KnockedAt.UnixMilli())
+	return err
+}
+
+// Get returns the pending knock of a Matrix account on a room, or nil if there is none
+func (s *PendingKnockStore) Get(ctx context.Context, roomID id.RoomID, mxid id.UserID) (*PendingKnock, error) {
+	knock := PendingKnock{RoomID: roomID, MXID: mxid}
+	var knockedAt int64
+	err := s.db.QueryRow(ctx, `
+		SELECT mm_user_id, room_identifier, knocked_at
+		FROM mattermost_pending_knock WHERE bridge_id=$1 AND room_id=$2 AND mxid=$3
+	`, s.bridgeID, roomID, mxid).Scan(&knock.MMUserID, &knock.RoomIdentifier, &knockedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	knock.KnockedAt = time.UnixMilli(knockedAt)
+	return &knock, nil
+}
+
+// Delete removes a pending knock
+func (s *PendingKnockStore) Delete(ctx context.Context, roomID id.RoomID, mxid id.UserID) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM mattermost_pending_knock WHERE bridge_id=$1 AND room_id=$2 AND mxid=$3", s.bridgeID, roomID, mxid)
+	return err
+}
+
+// mayKnock checks whether a room with the given join rule may accept knocks. An empty join
+// rule means it couldn't be read, in which case knocking is worth a try.
+func mayKnock(joinRule event.JoinRule) bool {
+	return joinRule == "" || joinRule == event.JoinRuleKnock || joinRule == event.JoinRuleKnockRestricted
+}
+
+// knockRoomVia knocks on a room through the homeserver admin backend, with the server the
+// room was last joined through first
+func (m *MattermostConnector) knockRoomVia(ctx context.Context, userID id.UserID, roomID id.RoomID, via []string) error {
+	servers := orderViaServers(m.joinVias.get(roomID), via)
+	return describeJoinError(m.MatrixAdmin.KnockRoomVia(ctx, userID, roomID, servers, knockReason))
+}
+
+// registerKnockHandler watches the memberships of ghosts with pending knocks, to finish
+// joining rooms when their knocks are accepted
+func (m *MattermostConnector) registerKnockHandler() {
+	mc, ok := m.Bridge.Matrix.(*matrix.Connector)
+	if !ok || mc.EventProcessor == nil {
+		log := m.moduleLog(LogModuleConnector)
+		log.Warn().Msg("Matrix connector has no event processor, accepted knocks won't be noticed")
+		return
+	}
+	mc.EventProcessor.PrependHandler(event.StateMember, m.handleKnockMembership)
+}
+
+// handleKnockMembership completes a pending knock when the knocking user is invited, and
+// drops it when they're rejected or banned
+func (m *MattermostConnector) handleKnockMembership(ctx context.Context, evt *event.Event) {
+	if m.PendingKnocks == nil || evt.StateKey == nil {
+		return
+	}
+	membership := evt.Content.AsMember().Membership
+	if membership != event.MembershipInvite && membership != event.MembershipLeave && membership != event.MembershipBan {
+		return
+	}
+	mxid := id.UserID(*evt.StateKey)
+	log := m.moduleLog(LogModuleConnector).With().
+		Stringer("room_id", evt.RoomID).
+		Stringer("user_id", mxid).
+		Logger()
+	knock, err := m.PendingKnocks.Get(ctx, evt.RoomID, mxid)
+	if err != nil {
+		log.Err(err).Msg("Failed to get pending knock")
+		return
+	} else if knock == nil {
+		return
+	}
+	if membership != event.MembershipInvite {
+		if err = m.PendingKnocks.Delete(ctx, evt.RoomID, mxid); err != nil {
+			log.Err(err).Msg("Failed to delete rejected knock")
+		}
+		log.Info().Stringer("sender", evt.Sender).Msg("Knock on room was rejected")
+		if evt.Sender != mxid {
+			m.notifyKnockResult(log.WithContext(ctx), knock, fmt.Sprintf("❌ Your request to join the Matrix room `%s` was declined.", knock.RoomIdentifier))
+		}
+		return
+	}
+	log.Info().Stringer("sender", evt.Sender).Msg("Knock on room was accepted")
+	// Joining a federated room can take a while, so it's done outside of the event handler
+	go m.completeKnock(log.WithContext(context.Background()), knock, []string{evt.Sender.Homeserver()})
+}
+
+// completeKnock joins a room whose knock was accepted and creates its channel
+func (m *MattermostConnector) completeKnock(ctx context.Context, knock *PendingKnock, via []string) {
+	log := zerolog.Ctx(ctx)
+	defer func() {
+		if err := m.PendingKnocks.Delete(ctx, knock.RoomID, knock.MXID); err != nil {
+			log.Err(err).Msg("Failed to delete completed knock")
+		}
+	}()
+	if err := m.joinRoomVia(ctx, knock.MXID, knock.RoomID, append(via, roomIDServers(knock.RoomID)...)); err != nil {
+		log.Err(err).Msg("Failed to join room after knock was accepted")
+		m.notifyKnockResult(ctx, knock, fmt.Sprintf("❌ Your request to join the Matrix room `%s` was accepted, but joining it failed: %v", knock.RoomIdentifier, err))
+		return
+	}
+	// Rooms that need knocking aren't public
+	link, err := m.linkJoinedRoom(ctx, knock.MMUserID, knock.RoomIdentifier, knock.RoomID, false)
+	if err != nil {
+		log.Err(err).Msg("Failed to create channel after knock was accepted")
+		m.notifyKnockResult(ctx, knock, fmt.Sprintf("❌ Joined the Matrix room `%s`, but %v", knock.RoomIdentifier, err))
+		return
+	}
+	m.notifyKnockResult(ctx, knock, link.joinedText(knock.MXID))
+}
+
+// notifyKnockResult tells the Mattermost user who knocked how their knock ended
+func (m *MattermostConnector) notifyKnockResult(ctx context.Context, knock *PendingKnock, message string) {
+	if err := m.sendBridgeDM(ctx, knock.MMUserID, message); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("mm_user_id", knock.MMUserID).Msg("Failed to tell user about knock result")
+	}
+}
@@ -0,0 +1,76 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestPendingKnockStore(t *testing.T) {
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+	store := NewPendingKnockStore("mattermost", bridgeDB.Database)
+	require.NoError(t, store.Upgrade(ctx))
+
+	knock, err := store.Get(ctx, "!room:example.com", "@mattermost_user1:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, knock)
+
+	knockedAt := time.UnixMilli(time.Now().UnixMilli())
+	require.NoError(t, store.Put(ctx, &PendingKnock{
+		RoomID:         "!room:example.com",
+		MXID:           "@mattermost_user1:example.com",
+		MMUserID:       "user1",
+		RoomIdentifier: "#room:example.com",
+		KnockedAt:      knockedAt,
+	}))
+	knock, err = store.Get(ctx, "!room:example.com", "@mattermost_user1:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, knock)
+	assert.Equal(t, "user1", knock.MMUserID)
+	assert.Equal(t, "#room:example.com", knock.RoomIdentifier)
+	assert.True(t, knockedAt.Equal(knock.KnockedAt))
+
+	require.NoError(t, store.Delete(ctx, "!room:example.com", "@mattermost_user1:example.com"))
+	knock, err = store.Get(ctx, "!room:example.com", "@mattermost_user1:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, knock)
+}
+
+func TestMayKnock(t *testing.T) {
+	assert.True(t, mayKnock(event.JoinRuleKnock))
+	assert.True(t, mayKnock(event.JoinRuleKnockRestricted))
+	assert.True(t, mayKnock(""))
+	assert.False(t, mayKnock(event.JoinRuleInvite))
+	assert.False(t, mayKnock(event.JoinRuleRestricted))
+}
+
+func TestMatrixAdminClient_KnockRoomVia(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/knock/!room:example.com", r.URL.Path)
+		assert.Equal(t, []string{"a.org", "b.org"}, r.URL.Query()["server_name"])
+		assert.Equal(t, "@alice:example.com", r.URL.Query().Get("user_id"))
+		var req knockRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req.Reason == "" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"You are not allowed to knock on this room"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"room_id":"!room:example.com"}`))
+	}))
+	defer server.Close()
+
+	client := newTestMatrixAdminClient(server.URL)
+	require.NoError(t, client.KnockRoomVia(context.Background(), "@alice:example.com", "!room:example.com", []string{"a.org", "b.org"}, knockReason))
+	err := client.KnockRoomVia(context.Background(), "@alice:example.com", "!room:example.com", []string{"a.org", "b.org"}, "")
+	assert.ErrorIs(t, err, mautrix.MForbidden)
+}
@@ -0,0 +1,43 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+)
+
+// connectLocalSocket sets up the local mode client if local_socket is configured. Local
+// mode must be enabled in Mattermost (ServiceSettings.EnableLocalMode), and the socket is
+// only reachable from the Mattermost host, so the bridge has to run there or share the
+// socket through a volume.
+func (m *MattermostConnector) connectLocalSocket(ctx context.Context) error {
+	if m.config().LocalSocket == "" {
+		return nil
+	}
+	client := NewLocalClient(m.config().LocalSocket)
+	if _, resp, err := client.GetPing(ctx); err != nil {
+		return fmt.Errorf("failed to reach Mattermost local mode socket: %w", wrapMattermostError(resp, err))
+	}
+	m.LocalClient = client
+	log := m.moduleLog(LogModuleConnector)
+	log.Info().Str("socket", m.config().LocalSocket).Msg("Using Mattermost local mode for admin operations")
+	return nil
+}
+
+// adminClient returns the client for privileged operations, like creating users and
+// tokens: the local mode socket if it's configured, otherwise the admin token.
+func (m *MattermostConnector) adminClient() *Client {
+	if m.LocalClient != nil {
+		return m.LocalClient
+	}
+	return m.Client
+}
+
+// adminClient returns the client for privileged operations of a login: the local mode
+// socket if it's configured and the login is on the main server, otherwise the login's
+// own client
+func (m *MattermostAPI) adminClient() *Client {
+	if m.Connector.LocalClient != nil && loginServer(m.Login) == "" {
+		return m.Connector.LocalClient
+	}
+	return m.Client()
+}
@@ -0,0 +1,57 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalSocket_AdminOperations(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "mattermost_local.socket")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(model.HeaderAuth), "local mode requests don't need a token")
+		switch r.URL.Path {
+		case "/api/v4/system/ping":
+			_ = json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
+		case "/api/v4/users":
+			var user model.User
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&user))
+			user.Id = "user1"
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(&user)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	connector := &MattermostConnector{
+		Config: &NetworkConfig{LocalSocket: socketPath},
+		Client: NewClient("http://127.0.0.1:1", "token"),
+	}
+	assert.Same(t, connector.Client, connector.adminClient())
+	require.NoError(t, connector.connectLocalSocket(context.Background()))
+	assert.Same(t, connector.LocalClient, connector.adminClient())
+
+	user, err := connector.createUser(context.Background(), "", &model.User{Username: "mx.alice"})
+	require.NoError(t, err)
+	assert.Equal(t, "user1", user.Id)
+}
+
+func TestLocalSocket_Unreachable(t *testing.T) {
+	connector := &MattermostConnector{Config: &NetworkConfig{LocalSocket: filepath.Join(t.TempDir(), "missing.socket")}}
+	assert.Error(t, connector.connectLocalSocket(context.Background()))
+	assert.Nil(t, connector.LocalClient)
+}
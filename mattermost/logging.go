@@ -0,0 +1,74 @@
+package mattermost
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// Module names used for the "module" log field and as keys in the log_levels config
+const (
+	LogModuleConnector = "connector"
+	LogModuleSync      = "sync"
+	LogModuleWebSocket = "websocket"
+	LogModuleSlashCmd  = "slashcmd"
+	LogModuleRetry     = "retry"
+	LogModuleWebhook   = "webhook"
+)
+
+// moduleLoggers caches the logger of each module, so that log_levels is only parsed again
+// after the config is reloaded. The zero value is ready to use.
+type moduleLoggers struct {
+	lock    sync.RWMutex
+	loggers map[string]zerolog.Logger
+}
+
+// reset drops the cached loggers, after log_levels changed
+func (ml *moduleLoggers) reset() {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	ml.loggers = nil
+}
+
+// moduleLog returns the bridge logger for a module, with the level from log_levels applied.
+// Note that a module level can only make logging more verbose up to what the bridge's
+// log writers allow, as they also filter by level.
+func (m *MattermostConnector) moduleLog(module string) zerolog.Logger {
+	if m.Bridge == nil {
+		return zerolog.Nop()
+	}
+	m.moduleLoggers.lock.RLock()
+	log, ok := m.moduleLoggers.loggers[module]
+	m.moduleLoggers.lock.RUnlock()
+	if ok {
+		return log
+	}
+	log = m.newModuleLog(module)
+	m.moduleLoggers.lock.Lock()
+	if m.moduleLoggers.loggers == nil {
+		m.moduleLoggers.loggers = make(map[string]zerolog.Logger)
+	}
+	m.moduleLoggers.loggers[module] = log
+	m.moduleLoggers.lock.Unlock()
+	return log
+}
+
+// newModuleLog creates the logger of a module. An invalid level is warned about here, so
+// only once per module until the config is reloaded.
+func (m *MattermostConnector) newModuleLog(module string) zerolog.Logger {
+	log := m.Bridge.Log.With().Str("module", module).Logger()
+	if m.config() == nil {
+		return log
+	}
+	levelName, ok := m.config().LogLevels[module]
+	if !ok || levelName == "" {
+		return log
+	}
+	level, err := zerolog.ParseLevel(strings.ToLower(levelName))
+	if err != nil {
+		log.Warn().Str("level", levelName).Msg("Invalid log level in log_levels config, ignoring")
+		return log
+	}
+	return log.Level(level)
+}
@@ -2,15 +2,21 @@ package mattermost
 
 import (
 	"context"
+	"fmt"
 
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
-	"maunium.net/go/mautrix/bridgev2/networkid"
 )
 
 type PATLogin struct {
 	user      *bridgev2.User
 	connector *MattermostConnector
+	// server is the name of the server to log in to, empty for the main server
+	server string
+	// pending is set while the user is asked whether to take over the account
+	pending *pendingLogin
+	// relogin is the login whose token is being replaced, if any
+	relogin *bridgev2.UserLogin
 }
 
 func (p *PATLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
@@ -30,10 +36,16 @@ func (p *PATLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
 	}, nil
 }
 
-
 func (p *PATLogin) SubmitUserInput(ctx context.Context, input map[string]string) (*bridgev2.LoginStep, error) {
+	if p.pending != nil {
+		return p.pending.submit(ctx, input)
+	}
 	token := input["token"]
-	client := NewClient(p.connector.Config.ServerURL, token)
+	serverURL, ok := p.connector.serverURL(p.server)
+	if !ok {
+		return nil, fmt.Errorf("unknown server %s", p.server)
+	}
+	client := NewClient(serverURL, token)
 	err := client.Connect(ctx)
 	if err != nil {
 		return nil, err
@@ -43,26 +55,26 @@ func (p *PATLogin) SubmitUserInput(ctx context.Context, input map[string]string)
 	if err != nil {
 		return nil, err
 	}
+	if err = checkRelogin(p.relogin, me.Id); err != nil {
+		return nil, err
+	}
 
-
-	return &bridgev2.LoginStep{
-		Type: bridgev2.LoginStepTypeComplete,
-		CompleteParams: &bridgev2.LoginCompleteParams{
-			UserLoginID: networkid.UserLoginID(me.Username),
-			UserLogin: &bridgev2.UserLogin{
-				UserLogin: &database.UserLogin{
-					Metadata: map[string]any{
-						"token": token,
-						"mm_id": me.Id,
-					},
-					RemoteName: me.Username,
-				},
-			},
-		},
-	}, nil
+	metadata := map[string]any{
+		"token": token,
+		"mm_id": me.Id,
+	}
+	if p.server != "" {
+		metadata["server"] = p.server
+		metadata["server_url"] = serverURL
+	}
+	step, pending, err := p.connector.finishLogin(ctx, p.user, p.server, &database.UserLogin{
+		ID:         MakeServerLoginID(p.server, me.Username),
+		RemoteName: me.Username,
+		Metadata:   metadata,
+	})
+	p.pending = pending
+	return step, err
 }
 
 func (p *PATLogin) Cancel() {
 }
-
-
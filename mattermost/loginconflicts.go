@@ -0,0 +1,165 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+)
+
+// A Mattermost account can only be logged in to the bridge once, so that its posts aren't
+// bridged twice and it's clear whose double puppet sends them. Logging in again with the same
+// account updates the existing login, even if the username changed. When another Matrix user
+// logs in with an account that's already logged in, the login is rejected, or with
+// allow_login_takeover they're asked whether to log out the other user.
+
+// ErrLoginConflict is returned when a Mattermost account is already logged in to the bridge
+// by another Matrix user
+var ErrLoginConflict = bridgev2.RespError{
+	ErrCode:    "FI.MAU.MATTERMOST.LOGIN_CONFLICT",
+	Err:        "This Mattermost account is already logged in to the bridge by another Matrix user",
+	StatusCode: http.StatusConflict,
+}
+
+// StateLoginTakenOver is the error code of the bridge state sent for a login that was logged
+// out because another Matrix user logged in with its Mattermost account
+const StateLoginTakenOver status.BridgeStateErrorCode = "mm-login-taken-over"
+
+// loginTakeoverStepID is the ID of the login step asking whether to take over an account
+const loginTakeoverStepID = "takeover"
+
+// accountLogins returns the logins of a Mattermost account on a server, sorted by ID. Logins
+// that were deleted from the bridge since they were loaded are skipped.
+func (m *MattermostConnector) accountLogins(server, mmUserID string) []*bridgev2.UserLogin {
+	if mmUserID == "" {
+		return nil
+	}
+	var logins []*bridgev2.UserLogin
+	for _, login := range m.GetUsers() {
+		meta, ok := login.Metadata.(map[string]any)
+		if !ok || meta["mm_id"] != mmUserID || loginServer(login) != server {
+			continue
+		}
+		if m.Bridge != nil && m.Bridge.GetCachedUserLoginByID(login.ID) != login {
+			continue
+		}
+		logins = append(logins, login)
+	}
+	slices.SortFunc(logins, func(a, b *bridgev2.UserLogin) int {
+		return strings.Compare(string(a.ID), string(b.ID))
+	})
+	return logins
+}
+
+// pendingLogin is a login waiting for its user to confirm that the other Matrix users logged
+// in with its Mattermost account should be logged out
+type pendingLogin struct {
+	connector *MattermostConnector
+	user      *bridgev2.User
+	data      *database.UserLogin
+	conflicts []*bridgev2.UserLogin
+}
+
+// finishLogin saves a login of the Mattermost account in data, which must have the mm_id
+// metadata. If the user is already logged in with the account, that login is updated. If
+// other Matrix users are, the login is rejected, or with allow_login_takeover the returned
+// step asks the user whether to log them out, and the pending login continues with their
+// answer.
+func (m *MattermostConnector) finishLogin(ctx context.Context, user *bridgev2.User, server string, data *database.UserLogin) (*bridgev2.LoginStep, *pendingLogin, error) {
+	meta, _ := data.Metadata.(map[string]any)
+	mmUserID, _ := meta["mm_id"].(string)
+	var conflicts []*bridgev2.UserLogin
+	for _, login := range m.accountLogins(server, mmUserID) {
+		if login.UserMXID != user.MXID {
+			conflicts = append(conflicts, login)
+		} else if login.ID != data.ID {
+			data.ID = login.ID
+		}
+	}
+	if len(conflicts) == 0 {
+		step, err := m.saveLogin(ctx, user, data)
+		return step, nil, err
+	}
+
+	owners := loginOwners(conflicts)
+	if !m.config().AllowLoginTakeover {
+		return nil, nil, fmt.Errorf("%w (%s)", ErrLoginConflict, owners)
+	}
+	pending := &pendingLogin{connector: m, user: user, data: data, conflicts: conflicts}
+	return &bridgev2.LoginStep{
+		Type:         bridgev2.LoginStepTypeUserInput,
+		StepID:       loginTakeoverStepID,
+		Instructions: fmt.Sprintf("%s is already logged in to the bridge by %s. Answer yes to log them out and continue, or no to cancel.", data.RemoteName, owners),
+		UserInputParams: &bridgev2.LoginUserInputParams{
+			Fields: []bridgev2.LoginInputDataField{{
+				ID:       loginTakeoverStepID,
+				Type:     bridgev2.LoginInputFieldTypeUsername,
+				Name:     "Log out the other user (yes/no)",
+				Pattern:  "^(yes|no)$",
+				Validate: validateYesNo,
+			}},
+		},
+	}, pending, nil
+}
+
+// submit continues a pending login with the user's answer
+func (p *pendingLogin) submit(ctx context.Context, input map[string]string) (*bridgev2.LoginStep, error) {
+	if answer, _ := validateYesNo(input[loginTakeoverStepID]); answer != "yes" {
+		return nil, fmt.Errorf("%w (%s)", ErrLoginConflict, loginOwners(p.conflicts))
+	}
+	for _, login := range p.conflicts {
+		login.Delete(ctx, status.BridgeState{
+			StateEvent: status.StateLoggedOut,
+			Error:      StateLoginTakenOver,
+			Message:    fmt.Sprintf("%s logged in to the bridge with this Mattermost account", p.user.MXID),
+		}, bridgev2.DeleteOpts{})
+		p.connector.usersLock.Lock()
+		delete(p.connector.users, login.ID)
+		p.connector.usersLock.Unlock()
+	}
+	return p.connector.saveLogin(ctx, p.user, p.data)
+}
+
+// saveLogin creates or updates a login and returns the last step of the login process
+func (m *MattermostConnector) saveLogin(ctx context.Context, user *bridgev2.User, data *database.UserLogin) (*bridgev2.LoginStep, error) {
+	login, err := user.NewLogin(ctx, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save login: %w", err)
+	}
+	// Clears a BAD_CREDENTIALS state when an existing login got a new token
+	login.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+	return &bridgev2.LoginStep{
+		Type:         bridgev2.LoginStepTypeComplete,
+		StepID:       "complete",
+		Instructions: fmt.Sprintf("Successfully logged in as %s", login.RemoteName),
+		CompleteParams: &bridgev2.LoginCompleteParams{
+			UserLoginID: login.ID,
+			UserLogin:   login,
+		},
+	}, nil
+}
+
+// loginOwners lists the Matrix users of logins
+func loginOwners(logins []*bridgev2.UserLogin) string {
+	var owners []string
+	for _, login := range logins {
+		if !slices.Contains(owners, login.UserMXID.String()) {
+			owners = append(owners, login.UserMXID.String())
+		}
+	}
+	return strings.Join(owners, ", ")
+}
+
+// validateYesNo accepts yes or no in any case
+func validateYesNo(input string) (string, error) {
+	input = strings.ToLower(strings.TrimSpace(input))
+	if input != "yes" && input != "no" {
+		return "", fmt.Errorf("answer yes or no")
+	}
+	return input, nil
+}
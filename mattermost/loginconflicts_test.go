@@ -0,0 +1,65 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+)
+
+func TestAccountLogins(t *testing.T) {
+	connector := &MattermostConnector{Config: &NetworkConfig{}}
+	addTestLogin(connector, "bob", "@bob:example.com", map[string]any{"mm_id": "mm-alice"})
+	addTestLogin(connector, "alice", "@alice:example.com", map[string]any{"mm_id": "mm-alice"})
+	addTestLogin(connector, "work.alice", "@alice:example.com", map[string]any{"mm_id": "mm-alice", "server": "work"})
+	addTestLogin(connector, "carol", "@carol:example.com", map[string]any{"mm_id": "mm-carol"})
+
+	var ids []string
+	for _, login := range connector.accountLogins("", "mm-alice") {
+		ids = append(ids, string(login.ID))
+	}
+	assert.Equal(t, []string{"alice", "bob"}, ids)
+	assert.Len(t, connector.accountLogins("work", "mm-alice"), 1)
+	assert.Empty(t, connector.accountLogins("", ""))
+}
+
+func TestFinishLogin_Conflict(t *testing.T) {
+	ctx := context.Background()
+	connector := &MattermostConnector{Config: &NetworkConfig{}}
+	addTestLogin(connector, "alice", "@alice:example.com", map[string]any{"mm_id": "mm-alice"})
+	bob := &bridgev2.User{User: &database.User{MXID: "@bob:example.com"}}
+	newData := func() *database.UserLogin {
+		return &database.UserLogin{ID: "alice", RemoteName: "alice", Metadata: map[string]any{"mm_id": "mm-alice"}}
+	}
+
+	// Without takeover, the login is rejected
+	step, pending, err := connector.finishLogin(ctx, bob, "", newData())
+	assert.True(t, errors.Is(err, ErrLoginConflict))
+	assert.Contains(t, err.Error(), "@alice:example.com")
+	assert.Nil(t, step)
+	assert.Nil(t, pending)
+
+	// With takeover, the user is asked first, and answering no rejects the login
+	connector.config().AllowLoginTakeover = true
+	step, pending, err = connector.finishLogin(ctx, bob, "", newData())
+	require.NoError(t, err)
+	require.NotNil(t, pending)
+	assert.Equal(t, bridgev2.LoginStepTypeUserInput, step.Type)
+	assert.Equal(t, loginTakeoverStepID, step.StepID)
+	assert.Contains(t, step.Instructions, "@alice:example.com")
+	_, err = pending.submit(ctx, map[string]string{loginTakeoverStepID: "no"})
+	assert.True(t, errors.Is(err, ErrLoginConflict))
+	assert.Len(t, connector.accountLogins("", "mm-alice"), 1)
+}
+
+func TestValidateYesNo(t *testing.T) {
+	answer, err := validateYesNo(" Yes ")
+	require.NoError(t, err)
+	assert.Equal(t, "yes", answer)
+	_, err = validateYesNo("maybe")
+	assert.Error(t, err)
+}
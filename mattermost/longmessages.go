@@ -0,0 +1,147 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+// MessageMetadata is the metadata the bridge stores for every message
+type MessageMetadata struct {
+	// PartIDs are the posts after the first one that a long Matrix message was split into
+	PartIDs []string `json:"part_ids,omitempty"`
+}
+
+// getMessageMetadata returns the metadata of a message, or the defaults if it has none
+func getMessageMetadata(msg *database.Message) *MessageMetadata {
+	if msg != nil {
+		if meta, ok := msg.Metadata.(*MessageMetadata); ok {
+			return meta
+		}
+	}
+	return &MessageMetadata{}
+}
+
+// sendMessageParts sends the parts of a split Matrix message after the first post, threaded
+// under it unless the message is already in a thread, and returns the IDs of the posts that
+// were sent. The pending post IDs of the parts are derived from the first post's, so that
+// retries don't duplicate them. The first post went through, so failing parts are logged
+// instead of failing the message.
+func (m *MattermostAPI) sendMessageParts(ctx context.Context, senderMXID id.UserID, userClient *Client, first *model.Post, pendingPostID string, parts []string) []string {
+	rootID := first.RootId
+	if rootID == "" {
+		rootID = first.Id
+	}
+	partIDs := make([]string, 0, len(parts))
+	for i, part := range parts {
+		partPost := &model.Post{
+			ChannelId:     first.ChannelId,
+			RootId:        rootID,
+			UserId:        first.UserId,
+			Message:       part,
+			Props:         model.StringInterface{"from_matrix": true},
+			PendingPostId: fmt.Sprintf("%s:%d", pendingPostID, i+1),
+		}
+		var created *model.Post
+		resp, err := m.Connector.DoAsUser(ctx, loginServer(m.Login), senderMXID.String(), userClient, func(client *Client) (resp *model.Response, err error) {
+			created, resp, err = client.CreatePost(ctx, partPost)
+			return resp, err
+		})
+		if err != nil {
+			m.Connector.Bridge.Log.Err(wrapMattermostError(resp, err)).Str("post_id", first.Id).Int("part", i+2).Msg("Failed to send part of long message")
+			break
+		}
+		partIDs = append(partIDs, created.Id)
+	}
+	return partIDs
+}
+
+// deleteMessageParts deletes the posts after the first one of a split Matrix message. Parts
+// threaded under the first post are already gone with it, so missing posts are skipped.
+func (m *MattermostAPI) deleteMessageParts(ctx context.Context, msg *database.Message) error {
+	var errs []error
+	for _, partID := range getMessageMetadata(msg).PartIDs {
+		resp, err := m.Client().DeletePost(ctx, partID)
+		if err != nil && responseStatusCode(resp, err) != http.StatusNotFound {
+			errs = append(errs, fmt.Errorf("failed to delete part %s: %w", partID, wrapMattermostError(resp, err)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// editMessageParts maps the parts of an edited long message onto the posts it was split
+// into: existing parts are updated, new parts are sent in the thread of the first post, and
+// parts that are no longer needed are deleted. The message's metadata is updated to match.
+func (m *MattermostAPI) editMessageParts(ctx context.Context, edit *bridgev2.MatrixEdit, first *model.Post, parts []string) error {
+	meta := getMessageMetadata(edit.EditTarget)
+	if len(parts) == 0 && len(meta.PartIDs) == 0 {
+		return nil
+	}
+	var errs []error
+	partIDs := make([]string, 0, len(parts))
+	for i, partID := range meta.PartIDs {
+		if i >= len(parts) {
+			resp, err := m.Client().DeletePost(ctx, partID)
+			if err != nil && responseStatusCode(resp, err) != http.StatusNotFound {
+				errs = append(errs, fmt.Errorf("failed to delete part %s: %w", partID, wrapMattermostError(resp, err)))
+			}
+			continue
+		}
+		_, resp, err := m.Client().PatchPost(ctx, partID, &model.PostPatch{Message: &parts[i]})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to update part %s: %w", partID, wrapMattermostError(resp, err)))
+		}
+		partIDs = append(partIDs, partID)
+	}
+	if len(parts) > len(meta.PartIDs) {
+		userClient, _, err := m.getSenderClient(ctx, edit.Event.Sender)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w: %w", ErrGhostUnavailable, err))
+		} else {
+			pendingPostID := fmt.Sprintf("%s:%d", first.UserId, time.Now().UnixMilli())
+			partIDs = append(partIDs, m.sendMessageParts(ctx, edit.Event.Sender, userClient, first, pendingPostID, parts[len(meta.PartIDs):])...)
+		}
+	}
+	meta.PartIDs = partIDs
+	edit.EditTarget.Metadata = meta
+	return errors.Join(errs...)
+}
+
+// removePostPart removes one part of a Mattermost post that was bridged as several Matrix
+// messages: the file with the part's ID, or the text for the part without one. Posts with
+// nothing left are deleted.
+func (m *MattermostAPI) removePostPart(ctx context.Context, postID string, partID networkid.PartID) error {
+	post, resp, err := m.Client().GetPost(ctx, postID, "")
+	if err != nil {
+		return fmt.Errorf("failed to get post: %w", wrapMattermostError(resp, err))
+	}
+	message := post.Message
+	fileIDs := make(model.StringArray, 0, len(post.FileIds))
+	for _, fileID := range post.FileIds {
+		if fileID != string(partID) {
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	if partID == "" {
+		message = ""
+	}
+	if message == "" && len(fileIDs) == 0 {
+		if resp, err = m.Client().DeletePost(ctx, postID); err != nil {
+			return fmt.Errorf("failed to delete post: %w", wrapMattermostError(resp, err))
+		}
+		return nil
+	}
+	_, resp, err = m.Client().PatchPost(ctx, postID, &model.PostPatch{Message: &message, FileIds: &fileIDs})
+	if err != nil {
+		return fmt.Errorf("failed to remove part of post: %w", wrapMattermostError(resp, err))
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+)
+
+func TestDeleteMessageParts(t *testing.T) {
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/posts/part1":
+			deleted = append(deleted, "part1")
+			_, _ = w.Write([]byte(`{"status":"OK"}`))
+		case "/api/v4/posts/part2":
+			// Already deleted along with the thread root
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"id":"app.post.get.app_error","status_code":404}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	api := newMattermostAPI(nil, nil, NewClient(server.URL, "token"))
+	ctx := context.Background()
+
+	msg := &database.Message{ID: "first", Metadata: &MessageMetadata{PartIDs: []string{"part1", "part2"}}}
+	assert.NoError(t, api.deleteMessageParts(ctx, msg))
+	assert.Equal(t, []string{"part1"}, deleted)
+
+	// Messages that weren't split have no parts to delete
+	assert.NoError(t, api.deleteMessageParts(ctx, &database.Message{ID: "other"}))
+
+	msg = &database.Message{ID: "first", Metadata: &MessageMetadata{PartIDs: []string{"part3"}}}
+	assert.Error(t, api.deleteMessageParts(ctx, msg))
+}
+
+func TestEditMessageParts(t *testing.T) {
+	var patched, deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v4/posts/part1/patch":
+			patched = append(patched, "part1")
+			_, _ = w.Write([]byte(`{"id":"part1"}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/v4/posts/part2":
+			deleted = append(deleted, "part2")
+			_, _ = w.Write([]byte(`{"status":"OK"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	api := newMattermostAPI(nil, nil, NewClient(server.URL, "token"))
+	target := &database.Message{ID: "first", Metadata: &MessageMetadata{PartIDs: []string{"part1", "part2"}}}
+	edit := &bridgev2.MatrixEdit{EditTarget: target}
+
+	// The edited message is shorter, so the second part isn't needed anymore
+	err := api.editMessageParts(context.Background(), edit, &model.Post{Id: "first"}, []string{"second part"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"part1"}, patched)
+	assert.Equal(t, []string{"part2"}, deleted)
+	assert.Equal(t, []string{"part1"}, getMessageMetadata(target).PartIDs)
+
+	// Messages that weren't and aren't split don't touch any posts
+	edit = &bridgev2.MatrixEdit{EditTarget: &database.Message{ID: "other"}}
+	assert.NoError(t, api.editMessageParts(context.Background(), edit, &model.Post{Id: "other"}, nil))
+	assert.Len(t, patched, 1)
+}
+
+func TestRemovePostPart(t *testing.T) {
+	var patch model.PostPatch
+	var deleted bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/posts/post1":
+			_, _ = w.Write([]byte(`{"id":"post1","message":"hello","file_ids":["file1","file2"]}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/posts/post2":
+			_, _ = w.Write([]byte(`{"id":"post2","file_ids":["file1"]}`))
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v4/posts/post1/patch":
+			_ = json.NewDecoder(r.Body).Decode(&patch)
+			_, _ = w.Write([]byte(`{"id":"post1"}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/v4/posts/post2":
+			deleted = true
+			_, _ = w.Write([]byte(`{"status":"OK"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	api := newMattermostAPI(nil, nil, NewClient(server.URL, "token"))
+	ctx := context.Background()
+
+	require.NoError(t, api.removePostPart(ctx, "post1", "file1"))
+	assert.Equal(t, "hello", *patch.Message)
+	assert.Equal(t, model.StringArray{"file2"}, *patch.FileIds)
+
+	// The text part has no part ID
+	require.NoError(t, api.removePostPart(ctx, "post1", ""))
+	assert.Equal(t, "", *patch.Message)
+	assert.Equal(t, model.StringArray{"file1", "file2"}, *patch.FileIds)
+
+	// Posts with nothing left are deleted
+	require.NoError(t, api.removePostPart(ctx, "post2", "file1"))
+	assert.True(t, deleted)
+}
@@ -3,31 +3,264 @@ package mattermost
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/id"
 )
 
+// Homeserver admin backends, selected with synapse_admin.backend
+const (
+	// AdminBackendSynapse uses the Synapse Admin API
+	AdminBackendSynapse = "synapse"
+	// AdminBackendMAS uses the Matrix Authentication Service admin API for accounts
+	AdminBackendMAS = "mas"
+	// AdminBackendNone uses only the appservice, with the bridge's ghosts acting as accounts
+	AdminBackendNone = "none"
+)
+
+// HomeserverAdmin manages Matrix accounts and room memberships for mirror mode.
+// Implementations exist for Synapse, MAS and plain appservice access.
+type HomeserverAdmin interface {
+	UserExists(ctx context.Context, userID id.UserID) (bool, error)
+	CreateUser(ctx context.Context, userID id.UserID, password, displayName string) error
+	UpdateUserDisplayName(ctx context.Context, userID id.UserID, displayName string) error
+	UpdateUser(ctx context.Context, userID id.UserID, update *UserUpdate) error
+	FindUser(ctx context.Context, email string, externalID *ExternalID) (id.UserID, error)
+	JoinUserToRoom(ctx context.Context, userID id.UserID, roomID id.RoomID) error
+	GetProfile(ctx context.Context, userID id.UserID) (*ProfileResponse, error)
+	ResolveRoomAlias(ctx context.Context, alias string) (id.RoomID, []string, error)
+	GetRoomInfo(ctx context.Context, roomID id.RoomID) (map[string]interface{}, error)
+	JoinRoomVia(ctx context.Context, userID id.UserID, roomID id.RoomID, viaServers []string) error
+	KnockRoomVia(ctx context.Context, userID id.UserID, roomID id.RoomID, viaServers []string, reason string) error
+	DeactivateUser(ctx context.Context, userID id.UserID) error
+	ResetPassword(ctx context.Context, userID id.UserID, password string) error
+}
+
+var (
+	_ HomeserverAdmin = (*MatrixAdminClient)(nil)
+	_ HomeserverAdmin = (*MASAdminClient)(nil)
+	_ HomeserverAdmin = (*AppserviceAdmin)(nil)
+)
+
+// NewHomeserverAdmin creates the admin backend selected in the config.
+// It returns nil if the selected backend isn't configured.
+func NewHomeserverAdmin(br *bridgev2.Bridge, cfg SynapseAdminConfig) (HomeserverAdmin, error) {
+	switch cfg.Backend {
+	case AdminBackendSynapse, "":
+		if cfg.URL == "" {
+			return nil, nil
+		}
+		return NewMatrixAdminClientFromConfig(cfg), nil
+	case AdminBackendMAS:
+		if cfg.URL == "" || cfg.Token == "" {
+			return nil, nil
+		}
+		return NewMASAdminClient(br, cfg), nil
+	case AdminBackendNone:
+		return NewAppserviceAdmin(br), nil
+	default:
+		return nil, fmt.Errorf("unknown homeserver admin backend %q", cfg.Backend)
+	}
+}
+
+// Defaults for MatrixAdminClient request handling
+const (
+	defaultAdminRequestTimeout = 30 * time.Second
+	defaultAdminMaxRetries     = 3
+	defaultAdminInitialBackoff = 1 * time.Second
+	defaultAdminMaxBackoff     = 30 * time.Second
+)
+
 // MatrixAdminClient provides access to the Synapse Admin API for user management
 type MatrixAdminClient struct {
 	BaseURL    string
 	AdminToken string
 	HTTPClient *http.Client
+
+	// Timeout for a single request attempt, not including retries
+	Timeout time.Duration
+	// MaxRetries is how many times a request is retried after a 429, or after a network
+	// error or 5xx if it's safe to repeat
+	MaxRetries int
+	// InitialBackoff is the delay before the first retry, doubled for every following retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries, including delays requested by the server
+	MaxBackoff time.Duration
+	// ExemptCreatedUsers removes the message rate limit from users created with CreateUser
+	ExemptCreatedUsers bool
 }
 
 // NewMatrixAdminClient creates a new Synapse Admin API client
 func NewMatrixAdminClient(baseURL, adminToken string) *MatrixAdminClient {
 	return &MatrixAdminClient{
-		BaseURL:    baseURL,
-		AdminToken: adminToken,
-		HTTPClient: &http.Client{},
+		BaseURL:        baseURL,
+		AdminToken:     adminToken,
+		HTTPClient:     &http.Client{},
+		Timeout:        defaultAdminRequestTimeout,
+		MaxRetries:     defaultAdminMaxRetries,
+		InitialBackoff: defaultAdminInitialBackoff,
+		MaxBackoff:     defaultAdminMaxBackoff,
+	}
+}
+
+// NewMatrixAdminClientFromConfig creates a Synapse Admin API client from the synapse_admin config.
+// Unset request settings keep their defaults.
+func NewMatrixAdminClientFromConfig(cfg SynapseAdminConfig) *MatrixAdminClient {
+	c := NewMatrixAdminClient(cfg.URL, cfg.Token)
+	if cfg.RequestTimeout > 0 {
+		c.Timeout = time.Duration(cfg.RequestTimeout) * time.Second
+	}
+	if cfg.MaxRetries != nil {
+		c.MaxRetries = max(*cfg.MaxRetries, 0)
 	}
+	c.ExemptCreatedUsers = cfg.ExemptRateLimits
+	return c
+}
+
+// rateLimitResponse is the body of a 429 response from Synapse
+type rateLimitResponse struct {
+	RetryAfterMS int64 `json:"retry_after_ms"`
+}
+
+// do sends a request and returns the response status code and body. 429 responses are
+// retried with exponential backoff, respecting their retry_after_ms. Network errors,
+// timeouts and 5xx responses are only retried for idempotent methods, as the first attempt
+// may have gone through. Other error responses are returned to the caller as-is.
+func (c *MatrixAdminClient) do(ctx context.Context, method, urlStr string, reqBody any) (int, []byte, error) {
+	return c.request(ctx, method, urlStr, reqBody, isIdempotentMethod(method))
+}
+
+// doRepeatable is do for POST requests that are safe to repeat, like joining a room
+func (c *MatrixAdminClient) doRepeatable(ctx context.Context, method, urlStr string, reqBody any) (int, []byte, error) {
+	return c.request(ctx, method, urlStr, reqBody, true)
+}
+
+// isIdempotentMethod checks whether requests with a method can be repeated safely
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// request sends a request, retrying it as described in do. Requests that aren't
+// repeatable are only retried after a 429, which means the server didn't handle them.
+func (c *MatrixAdminClient) request(ctx context.Context, method, urlStr string, reqBody any, repeatable bool) (int, []byte, error) {
+	var body []byte
+	if reqBody != nil {
+		var err error
+		body, err = json.Marshal(reqBody)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		statusCode, respBody, retryAfter, err := c.doOnce(ctx, method, urlStr, body)
+		retryable := statusCode == http.StatusTooManyRequests || (repeatable && (err != nil || statusCode >= 500))
+		if !retryable || attempt >= c.MaxRetries || ctx.Err() != nil {
+			return statusCode, respBody, err
+		}
+
+		delay := c.backoff(attempt)
+		if retryAfter > 0 {
+			delay = min(retryAfter, c.maxBackoff())
+		}
+		zerolog.Ctx(ctx).Debug().
+			Err(err).
+			Str("method", method).
+			Int("status_code", statusCode).
+			Int("attempt", attempt+1).
+			Dur("delay", delay).
+			Msg("Synapse admin request failed, retrying")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			if err == nil {
+				err = fmt.Errorf("status %d", statusCode)
+			}
+			return statusCode, respBody, fmt.Errorf("%w (gave up retrying: %w)", err, ctx.Err())
+		}
+	}
+}
+
+// doOnce makes a single request attempt with the per-attempt timeout applied.
+func (c *MatrixAdminClient) doOnce(ctx context.Context, method, urlStr string, body []byte) (int, []byte, time.Duration, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, bodyReader)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, 0, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var retryAfter time.Duration
+	if resp.StatusCode == http.StatusTooManyRequests {
+		var rateLimit rateLimitResponse
+		if json.Unmarshal(respBody, &rateLimit) == nil && rateLimit.RetryAfterMS > 0 {
+			retryAfter = time.Duration(rateLimit.RetryAfterMS) * time.Millisecond
+		} else if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+	return resp.StatusCode, respBody, retryAfter, nil
+}
+
+// backoff returns the delay before the given retry (0-indexed).
+func (c *MatrixAdminClient) backoff(retry int) time.Duration {
+	delay := c.InitialBackoff
+	if delay <= 0 {
+		delay = defaultAdminInitialBackoff
+	}
+	maxDelay := c.maxBackoff()
+	for i := 0; i < retry && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+func (c *MatrixAdminClient) maxBackoff() time.Duration {
+	if c.MaxBackoff <= 0 {
+		return defaultAdminMaxBackoff
+	}
+	return c.MaxBackoff
 }
 
 // CreateUserRequest represents the request body for creating a user
@@ -55,10 +288,9 @@ type CreateUserResponse struct {
 
 // CreateUser creates a new Matrix user via the Synapse Admin API
 // The userID should be in the format @localpart:domain
+// If ExemptCreatedUsers is set, the new user is also exempted from rate limits.
 func (c *MatrixAdminClient) CreateUser(ctx context.Context, userID id.UserID, password, displayName string) error {
-	// Extract localpart from userID for the API endpoint
 	// Synapse Admin API: PUT /_synapse/admin/v2/users/{user_id}
-
 	reqBody := CreateUserRequest{
 		Password:    password,
 		DisplayName: displayName,
@@ -66,29 +298,41 @@ func (c *MatrixAdminClient) CreateUser(ctx context.Context, userID id.UserID, pa
 		Deactivated: false,
 	}
 
-	body, err := json.Marshal(reqBody)
+	url := fmt.Sprintf("%s/_synapse/admin/v2/users/%s", c.BaseURL, userID)
+	statusCode, respBody, err := c.do(ctx, http.MethodPut, url, reqBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal create user request: %w", err)
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+	if statusCode >= 400 {
+		return fmt.Errorf("failed to create user (status %d): %s", statusCode, string(respBody))
 	}
 
-	url := fmt.Sprintf("%s/_synapse/admin/v2/users/%s", c.BaseURL, userID)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(body))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+	if c.ExemptCreatedUsers {
+		// The account exists at this point, so a failure here shouldn't fail the creation
+		if err := c.ExemptFromRateLimits(ctx, userID); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Stringer("mxid", userID).Msg("Failed to exempt created user from rate limits")
+		}
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
-	req.Header.Set("Content-Type", "application/json")
+	return nil
+}
 
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to create user: %w", err)
+// ExemptFromRateLimits removes the message rate limit for a user
+func (c *MatrixAdminClient) ExemptFromRateLimits(ctx context.Context, userID id.UserID) error {
+	// Synapse Admin API: POST /_synapse/admin/v1/users/{user_id}/override_ratelimit
+	// Setting both values to 0 disables rate limiting for the user
+	reqBody := map[string]int{
+		"messages_per_second": 0,
+		"burst_count":         0,
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to create user (status %d): %s", resp.StatusCode, string(respBody))
+	url := fmt.Sprintf("%s/_synapse/admin/v1/users/%s/override_ratelimit", c.BaseURL, userID)
+	statusCode, respBody, err := c.doRepeatable(ctx, http.MethodPost, url, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to override rate limit: %w", err)
+	}
+	if statusCode >= 400 {
+		return fmt.Errorf("failed to override rate limit (status %d): %s", statusCode, string(respBody))
 	}
 
 	return nil
@@ -100,29 +344,65 @@ func (c *MatrixAdminClient) UpdateUserDisplayName(ctx context.Context, userID id
 		"displayname": displayName,
 	}
 
-	body, err := json.Marshal(reqBody)
-	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
-	}
-
 	url := fmt.Sprintf("%s/_synapse/admin/v2/users/%s", c.BaseURL, userID)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(body))
+	statusCode, respBody, err := c.do(ctx, http.MethodPut, url, reqBody)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	if statusCode >= 400 {
+		return fmt.Errorf("failed to update user (status %d): %s", statusCode, string(respBody))
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
-	req.Header.Set("Content-Type", "application/json")
+	return nil
+}
 
-	resp, err := c.HTTPClient.Do(req)
+// UserUpdate contains the account details mirror mode keeps in sync with Mattermost.
+// Empty fields are left unchanged.
+type UserUpdate struct {
+	DisplayName string
+	AvatarURL   id.ContentURIString
+	Email       string
+	ExternalID  *ExternalID
+	Deactivated bool
+}
+
+// ExternalID links a Matrix account to a user of an SSO provider
+type ExternalID struct {
+	AuthProvider string `json:"auth_provider"`
+	ExternalID   string `json:"external_id"`
+}
+
+// UpdateUser updates the profile, email and SSO link of a user, or deactivates them
+// without erasing their data. Setting an email replaces the user's other email addresses.
+func (c *MatrixAdminClient) UpdateUser(ctx context.Context, userID id.UserID, update *UserUpdate) error {
+	// Synapse Admin API: PUT /_synapse/admin/v2/users/{user_id}
+	reqBody := map[string]any{}
+	if update.Deactivated {
+		reqBody["deactivated"] = true
+	}
+	if update.DisplayName != "" {
+		reqBody["displayname"] = update.DisplayName
+	}
+	if update.AvatarURL != "" {
+		reqBody["avatar_url"] = update.AvatarURL
+	}
+	if update.Email != "" {
+		reqBody["threepids"] = []ThreePID{{Medium: "email", Address: update.Email}}
+	}
+	if update.ExternalID != nil {
+		reqBody["external_ids"] = []*ExternalID{update.ExternalID}
+	}
+	if len(reqBody) == 0 {
+		return nil
+	}
+
+	url := fmt.Sprintf("%s/_synapse/admin/v2/users/%s", c.BaseURL, userID)
+	statusCode, respBody, err := c.do(ctx, http.MethodPut, url, reqBody)
 	if err != nil {
 		return fmt.Errorf("failed to update user: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to update user (status %d): %s", resp.StatusCode, string(respBody))
+	if statusCode >= 400 {
+		return fmt.Errorf("failed to update user (status %d): %s", statusCode, string(respBody))
 	}
 
 	return nil
@@ -135,29 +415,52 @@ func (c *MatrixAdminClient) JoinUserToRoom(ctx context.Context, userID id.UserID
 		"user_id": string(userID),
 	}
 
-	body, err := json.Marshal(reqBody)
+	url := fmt.Sprintf("%s/_synapse/admin/v1/join/%s", c.BaseURL, roomID)
+	statusCode, respBody, err := c.doRepeatable(ctx, http.MethodPost, url, reqBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
+		return fmt.Errorf("failed to join user to room: %w", err)
+	}
+	if statusCode >= 400 {
+		return fmt.Errorf("failed to join user to room (status %d): %s", statusCode, string(respBody))
 	}
 
-	url := fmt.Sprintf("%s/_synapse/admin/v1/join/%s", c.BaseURL, roomID)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	return nil
+}
+
+// DeactivateUser deactivates a user and asks Synapse to erase their profile and messages
+func (c *MatrixAdminClient) DeactivateUser(ctx context.Context, userID id.UserID) error {
+	// Synapse Admin API: POST /_synapse/admin/v1/deactivate/{user_id}
+	reqBody := map[string]bool{
+		"erase": true,
+	}
+
+	url := fmt.Sprintf("%s/_synapse/admin/v1/deactivate/%s", c.BaseURL, userID)
+	statusCode, respBody, err := c.doRepeatable(ctx, http.MethodPost, url, reqBody)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to deactivate user: %w", err)
+	}
+	if statusCode >= 400 {
+		return fmt.Errorf("failed to deactivate user (status %d): %s", statusCode, string(respBody))
 	}
 
-	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
-	req.Header.Set("Content-Type", "application/json")
+	return nil
+}
 
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to join user to room: %w", err)
+// ResetPassword sets a new password for a user and logs out their devices
+func (c *MatrixAdminClient) ResetPassword(ctx context.Context, userID id.UserID, password string) error {
+	// Synapse Admin API: POST /_synapse/admin/v1/reset_password/{user_id}
+	reqBody := map[string]any{
+		"new_password":   password,
+		"logout_devices": true,
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to join user to room (status %d): %s", resp.StatusCode, string(respBody))
+	url := fmt.Sprintf("%s/_synapse/admin/v1/reset_password/%s", c.BaseURL, userID)
+	statusCode, respBody, err := c.doRepeatable(ctx, http.MethodPost, url, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to reset password: %w", err)
+	}
+	if statusCode >= 400 {
+		return fmt.Errorf("failed to reset password (status %d): %s", statusCode, string(respBody))
 	}
 
 	return nil
@@ -166,53 +469,67 @@ func (c *MatrixAdminClient) JoinUserToRoom(ctx context.Context, userID id.UserID
 // UserExists checks if a user already exists
 func (c *MatrixAdminClient) UserExists(ctx context.Context, userID id.UserID) (bool, error) {
 	url := fmt.Sprintf("%s/_synapse/admin/v2/users/%s", c.BaseURL, userID)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return false, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
-
-	resp, err := c.HTTPClient.Do(req)
+	statusCode, respBody, err := c.do(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return false, fmt.Errorf("failed to check user: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
+	if statusCode == http.StatusNotFound {
 		return false, nil
 	}
-	if resp.StatusCode >= 400 {
-		respBody, _ := io.ReadAll(resp.Body)
-		return false, fmt.Errorf("failed to check user (status %d): %s", resp.StatusCode, string(respBody))
+	if statusCode >= 400 {
+		return false, fmt.Errorf("failed to check user (status %d): %s", statusCode, string(respBody))
 	}
 
 	return true, nil
 }
 
+// FindUser looks up the user linked to an SSO identity, or else the user with an email
+// address. Either may be empty. It returns an empty user ID if no user was found.
+func (c *MatrixAdminClient) FindUser(ctx context.Context, email string, externalID *ExternalID) (id.UserID, error) {
+	var lookups []string
+	if externalID != nil {
+		// Synapse Admin API: GET /_synapse/admin/v1/auth_providers/{provider}/users/{external_id}
+		lookups = append(lookups, fmt.Sprintf("%s/_synapse/admin/v1/auth_providers/%s/users/%s",
+			c.BaseURL, url.PathEscape(externalID.AuthProvider), url.PathEscape(externalID.ExternalID)))
+	}
+	if email != "" {
+		// Synapse Admin API: GET /_synapse/admin/v1/threepid/email/users/{address}
+		lookups = append(lookups, fmt.Sprintf("%s/_synapse/admin/v1/threepid/email/users/%s", c.BaseURL, url.PathEscape(email)))
+	}
+	for _, lookupURL := range lookups {
+		statusCode, respBody, err := c.do(ctx, http.MethodGet, lookupURL, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to find user: %w", err)
+		} else if statusCode == http.StatusNotFound {
+			continue
+		} else if statusCode >= 400 {
+			return "", fmt.Errorf("failed to find user (status %d): %s", statusCode, string(respBody))
+		}
+		var found struct {
+			UserID id.UserID `json:"user_id"`
+		}
+		if err = json.Unmarshal(respBody, &found); err != nil {
+			return "", fmt.Errorf("failed to decode response: %w", err)
+		}
+		return found.UserID, nil
+	}
+	return "", nil
+}
+
 // GetUserInfo retrieves user information from Synapse Admin API
 func (c *MatrixAdminClient) GetUserInfo(ctx context.Context, userID id.UserID) (*CreateUserResponse, error) {
 	url := fmt.Sprintf("%s/_synapse/admin/v2/users/%s", c.BaseURL, userID)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
-
-	resp, err := c.HTTPClient.Do(req)
+	statusCode, respBody, err := c.do(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user info: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to get user info (status %d): %s", resp.StatusCode, string(respBody))
+	if statusCode >= 400 {
+		return nil, fmt.Errorf("failed to get user info (status %d): %s", statusCode, string(respBody))
 	}
 
 	var userInfo CreateUserResponse
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+	if err := json.Unmarshal(respBody, &userInfo); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
@@ -228,31 +545,22 @@ type ProfileResponse struct {
 // GetProfile retrieves a user's profile from the Matrix Client-Server API
 // Note: This uses the public CS API, not the Admin API, but likely works with Admin Token
 func (c *MatrixAdminClient) GetProfile(ctx context.Context, userID id.UserID) (*ProfileResponse, error) {
-	url := fmt.Sprintf("%s/_matrix/client/v3/profile/%s", c.BaseURL, userID)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
 	// Admin token usually works for client C-S API as well
-	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
-
-	resp, err := c.HTTPClient.Do(req)
+	url := fmt.Sprintf("%s/_matrix/client/v3/profile/%s", c.BaseURL, userID)
+	statusCode, respBody, err := c.do(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get profile: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
+	if statusCode == http.StatusNotFound {
 		return nil, nil // Profile not set
 	}
-	if resp.StatusCode >= 400 {
-		respBody, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to get profile (status %d): %s", resp.StatusCode, string(respBody))
+	if statusCode >= 400 {
+		return nil, fmt.Errorf("failed to get profile (status %d): %s", statusCode, string(respBody))
 	}
 
 	var profile ProfileResponse
-	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+	if err := json.Unmarshal(respBody, &profile); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
@@ -277,26 +585,17 @@ func (c *MatrixAdminClient) ResolveRoomAlias(ctx context.Context, alias string)
 	encodedAlias := url.PathEscape(alias)
 
 	urlStr := fmt.Sprintf("%s/_matrix/client/v3/directory/room/%s", c.BaseURL, encodedAlias)
-	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
-	if err != nil {
-		return "", nil, err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
-
-	resp, err := c.HTTPClient.Do(req)
+	statusCode, respBody, err := c.do(ctx, http.MethodGet, urlStr, nil)
 	if err != nil {
 		return "", nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", nil, fmt.Errorf("failed to resolve room alias: %s (status %d)", string(body), resp.StatusCode)
+	if statusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("failed to resolve room alias: %s (status %d)", string(respBody), statusCode)
 	}
 
 	var result RoomAliasResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	if err := json.Unmarshal(respBody, &result); err != nil {
 		return "", nil, err
 	}
 
@@ -307,39 +606,47 @@ func (c *MatrixAdminClient) ResolveRoomAlias(ctx context.Context, alias string)
 // The userID should be the full Matrix user ID (e.g., @user:server.com)
 // viaServers are the servers to try for federation (from ResolveRoomAlias)
 func (c *MatrixAdminClient) JoinRoomVia(ctx context.Context, userID id.UserID, roomID id.RoomID, viaServers []string) error {
+	// Empty JSON body for join request
+	return c.roomMembershipVia(ctx, "join", userID, roomID, viaServers, struct{}{})
+}
+
+// KnockRoomVia asks to join a room whose join rule allows knocking
+func (c *MatrixAdminClient) KnockRoomVia(ctx context.Context, userID id.UserID, roomID id.RoomID, viaServers []string, reason string) error {
+	return c.roomMembershipVia(ctx, "knock", userID, roomID, viaServers, &knockRequest{Reason: reason})
+}
+
+// roomMembershipVia sends a join or knock request for a user, with via server hints
+func (c *MatrixAdminClient) roomMembershipVia(ctx context.Context, action string, userID id.UserID, roomID id.RoomID, viaServers []string, reqBody any) error {
 	// Build URL with server_name query parameters for federation
-	urlStr := fmt.Sprintf("%s/_matrix/client/v3/join/%s", c.BaseURL, url.PathEscape(string(roomID)))
+	urlStr := fmt.Sprintf("%s/_matrix/client/v3/%s/%s", c.BaseURL, action, url.PathEscape(string(roomID)))
 
 	// Add server_name parameters for via servers
-	if len(viaServers) > 0 {
-		params := url.Values{}
-		for _, server := range viaServers {
-			params.Add("server_name", server)
-		}
-		// We also need to impersonate the user via the appservice
-		params.Set("user_id", string(userID))
-		urlStr = urlStr + "?" + params.Encode()
+	params := url.Values{}
+	for _, server := range viaServers {
+		params.Add("server_name", server)
 	}
+	// We also need to impersonate the user via the appservice
+	params.Set("user_id", string(userID))
+	urlStr = urlStr + "?" + params.Encode()
 
-	// Empty JSON body for join request
-	reqBody := []byte("{}")
-	req, err := http.NewRequestWithContext(ctx, "POST", urlStr, bytes.NewReader(reqBody))
-	if err != nil {
-		return err
+	// Joining a room again is harmless, knocking again isn't allowed
+	do := c.do
+	if action == "join" {
+		do = c.doRepeatable
 	}
-
-	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.HTTPClient.Do(req)
+	statusCode, respBody, err := do(ctx, http.MethodPost, urlStr, reqBody)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to join room (status %d): %s", resp.StatusCode, string(body))
+	if statusCode != http.StatusOK {
+		// Keep the Matrix error code, so that callers can tell why the request failed
+		var respErr mautrix.RespError
+		if json.Unmarshal(respBody, &respErr) == nil && respErr.ErrCode != "" {
+			respErr.StatusCode = statusCode
+			return fmt.Errorf("failed to %s room (status %d): %w", action, statusCode, respErr)
+		}
+		return fmt.Errorf("failed to %s room (status %d): %s", action, statusCode, string(respBody))
 	}
 
 	return nil
@@ -349,32 +656,39 @@ func (c *MatrixAdminClient) JoinRoomVia(ctx context.Context, userID id.UserID, r
 func (c *MatrixAdminClient) GetRoomInfo(ctx context.Context, roomID id.RoomID) (map[string]interface{}, error) {
 	// Get the room's join rules to determine if it's public or private
 	url := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/state/m.room.join_rules", c.BaseURL, roomID)
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
-
-	resp, err := c.HTTPClient.Do(req)
+	statusCode, respBody, err := c.do(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to get room info: %s (status %d)", string(body), resp.StatusCode)
+	if statusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get room info: %s (status %d)", string(respBody), statusCode)
 	}
 
 	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	if err := json.Unmarshal(respBody, &result); err != nil {
 		return nil, err
 	}
 
 	return result, nil
 }
 
+// usesGhostAccounts checks whether the bridge's ghosts act as the Matrix accounts of
+// Mattermost users, because the admin backend is none or the appservice fallback is used
+func (m *MattermostConnector) usesGhostAccounts() bool {
+	_, ok := m.MatrixAdmin.(*AppserviceAdmin)
+	return ok
+}
+
+// matrixAccountID returns the Matrix user that represents a Mattermost user's account.
+// Without an admin backend that can create accounts, the user's ghost is used.
+func (m *MattermostConnector) matrixAccountID(mmUser *model.User) id.UserID {
+	if m.usesGhostAccounts() {
+		return m.Bridge.Matrix.GhostIntent(MakeUserID(mmUser.Id)).GetMXID()
+	}
+	return GenerateMatrixUserID(mmUser, m.Bridge.Matrix.ServerName())
+}
+
 // GenerateMatrixUserID creates a Matrix user ID from a Mattermost user
 func GenerateMatrixUserID(mmUser *model.User, serverName string) id.UserID {
 	// Use Mattermost username as the localpart, sanitized
@@ -383,19 +697,49 @@ func GenerateMatrixUserID(mmUser *model.User, serverName string) id.UserID {
 	return id.NewUserID(localpart, serverName)
 }
 
-// GeneratePassword generates a random password for newly created Matrix users
-func GeneratePassword() string {
-	// In production, use a proper random password generator
-	// For now, we'll use a fixed-length random string
-	// This could also support SSO/OIDC in Phase 8
-	return "mattermost-bridge-" + randomString(16)
+// Defaults for the password policy
+const (
+	defaultPasswordLength  = 24
+	minPasswordLength      = 12
+	defaultPasswordCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!#$%&*+-=?@^_~"
+)
+
+// PasswordPolicyConfig contains settings for passwords of Matrix accounts created by the bridge
+type PasswordPolicyConfig struct {
+	Length       int    `yaml:"length"`
+	Charset      string `yaml:"charset"`
+	DeliverViaDM bool   `yaml:"deliver_via_dm"`
+}
+
+// GeneratePassword generates a random password for newly created Matrix users.
+// Unset policy values fall back to a 24 character password of letters, digits and symbols,
+// and lengths below 12 are raised to 12.
+func GeneratePassword(policy PasswordPolicyConfig) (string, error) {
+	length := policy.Length
+	if length <= 0 {
+		length = defaultPasswordLength
+	} else if length < minPasswordLength {
+		length = minPasswordLength
+	}
+	charset := []rune(policy.Charset)
+	if len(charset) == 0 {
+		charset = []rune(defaultPasswordCharset)
+	} else if len(charset) < 2 {
+		return "", fmt.Errorf("password charset must have at least 2 characters")
+	}
+	return randomString(length, charset)
 }
 
-func randomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, length)
+// randomString picks length characters from charset uniformly using crypto/rand
+func randomString(length int, charset []rune) (string, error) {
+	charsetSize := big.NewInt(int64(len(charset)))
+	b := make([]rune, length)
 	for i := range b {
-		b[i] = charset[i%len(charset)] // Simple deterministic for now
+		n, err := rand.Int(rand.Reader, charsetSize)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random number: %w", err)
+		}
+		b[i] = charset[n.Int64()]
 	}
-	return string(b)
+	return string(b), nil
 }
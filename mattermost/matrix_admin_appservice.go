@@ -0,0 +1,242 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrAdminNotSupported is returned for operations that need a homeserver admin API
+var ErrAdminNotSupported = errors.New("not supported without a homeserver admin API")
+
+// AppserviceAdmin implements HomeserverAdmin using only the bridge's appservice access.
+// The bridge's ghosts act as the Matrix accounts of Mattermost users, so it works on any
+// homeserver. Real Matrix users can't be created or force-joined, they're invited instead.
+type AppserviceAdmin struct {
+	Bridge *bridgev2.Bridge
+}
+
+// NewAppserviceAdmin creates a new appservice-only admin backend
+func NewAppserviceAdmin(br *bridgev2.Bridge) *AppserviceAdmin {
+	return &AppserviceAdmin{Bridge: br}
+}
+
+// ghostIntent returns the appservice intent for a ghost, or nil if the user isn't a ghost
+func (a *AppserviceAdmin) ghostIntent(userID id.UserID) *appservice.IntentAPI {
+	ghostID, ok := a.Bridge.Matrix.ParseGhostMXID(userID)
+	if !ok {
+		return nil
+	}
+	return asIntent(a.Bridge.Matrix.GhostIntent(ghostID))
+}
+
+// botIntent returns the appservice intent of the bridge bot
+func (a *AppserviceAdmin) botIntent() (*appservice.IntentAPI, error) {
+	intent := asIntent(a.Bridge.Bot)
+	if intent == nil {
+		return nil, fmt.Errorf("bridge bot is not an appservice intent")
+	}
+	return intent, nil
+}
+
+func asIntent(api bridgev2.MatrixAPI) *appservice.IntentAPI {
+	if intent, ok := api.(*matrix.ASIntent); ok {
+		return intent.Matrix
+	}
+	return nil
+}
+
+// UserExists checks if a user exists. Ghosts always exist, as they're registered on demand.
+func (a *AppserviceAdmin) UserExists(ctx context.Context, userID id.UserID) (bool, error) {
+	if _, ok := a.Bridge.Matrix.ParseGhostMXID(userID); ok {
+		return true, nil
+	}
+	profile, err := a.GetProfile(ctx, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to check user: %w", err)
+	}
+	return profile != nil, nil
+}
+
+// CreateUser registers a ghost. Other users can't be created without an admin API.
+func (a *AppserviceAdmin) CreateUser(ctx context.Context, userID id.UserID, password, displayName string) error {
+	intent := a.ghostIntent(userID)
+	if intent == nil {
+		return fmt.Errorf("failed to create user %s: %w", userID, ErrAdminNotSupported)
+	}
+	if err := intent.EnsureRegistered(ctx); err != nil {
+		return fmt.Errorf("failed to register ghost: %w", err)
+	}
+	return nil
+}
+
+// UpdateUserDisplayName updates the display name of a ghost
+func (a *AppserviceAdmin) UpdateUserDisplayName(ctx context.Context, userID id.UserID, displayName string) error {
+	intent := a.ghostIntent(userID)
+	if intent == nil {
+		return fmt.Errorf("failed to update user %s: %w", userID, ErrAdminNotSupported)
+	}
+	if err := intent.SetDisplayName(ctx, displayName); err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+// UpdateUser updates the profile of a ghost. Ghosts have no email or SSO link, and aren't
+// deactivated as the bridge keeps using them.
+func (a *AppserviceAdmin) UpdateUser(ctx context.Context, userID id.UserID, update *UserUpdate) error {
+	intent := a.ghostIntent(userID)
+	if intent == nil || update.Deactivated {
+		return fmt.Errorf("failed to update user %s: %w", userID, ErrAdminNotSupported)
+	}
+	if update.DisplayName != "" {
+		if err := intent.SetDisplayName(ctx, update.DisplayName); err != nil {
+			return fmt.Errorf("failed to update display name: %w", err)
+		}
+	}
+	if update.AvatarURL != "" {
+		avatarURL, err := update.AvatarURL.Parse()
+		if err != nil {
+			return fmt.Errorf("failed to parse avatar URL: %w", err)
+		}
+		if err = intent.SetAvatarURL(ctx, avatarURL); err != nil {
+			return fmt.Errorf("failed to update avatar: %w", err)
+		}
+	}
+	return nil
+}
+
+// FindUser isn't supported, as the appservice API can't look up users
+func (a *AppserviceAdmin) FindUser(ctx context.Context, email string, externalID *ExternalID) (id.UserID, error) {
+	return "", fmt.Errorf("failed to find user: %w", ErrAdminNotSupported)
+}
+
+// JoinUserToRoom joins a ghost to a room. Other users are invited by the bridge bot.
+func (a *AppserviceAdmin) JoinUserToRoom(ctx context.Context, userID id.UserID, roomID id.RoomID) error {
+	if ghostID, ok := a.Bridge.Matrix.ParseGhostMXID(userID); ok {
+		if err := a.Bridge.Matrix.GhostIntent(ghostID).EnsureJoined(ctx, roomID); err != nil {
+			return fmt.Errorf("failed to join user to room: %w", err)
+		}
+		return nil
+	}
+	if err := a.Bridge.Bot.EnsureInvited(ctx, roomID, userID); err != nil {
+		return fmt.Errorf("failed to invite user to room: %w", err)
+	}
+	return nil
+}
+
+// GetProfile retrieves a user's profile using the bridge bot
+func (a *AppserviceAdmin) GetProfile(ctx context.Context, userID id.UserID) (*ProfileResponse, error) {
+	bot, err := a.botIntent()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := bot.GetProfile(ctx, userID)
+	if errors.Is(err, mautrix.MNotFound) {
+		return nil, nil // Profile not set
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get profile: %w", err)
+	}
+	return &ProfileResponse{
+		DisplayName: resp.DisplayName,
+		AvatarURL:   resp.AvatarURL.String(),
+	}, nil
+}
+
+// ResolveRoomAlias resolves a Matrix room alias to a room ID using the bridge bot
+func (a *AppserviceAdmin) ResolveRoomAlias(ctx context.Context, alias string) (id.RoomID, []string, error) {
+	if !strings.HasPrefix(alias, "#") {
+		return "", nil, fmt.Errorf("invalid room alias: must start with #")
+	}
+	bot, err := a.botIntent()
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := bot.ResolveAlias(ctx, id.RoomAlias(alias))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve room alias: %w", err)
+	}
+	return resp.RoomID, resp.Servers, nil
+}
+
+// GetRoomInfo retrieves the join rules of a room using the bridge bot
+func (a *AppserviceAdmin) GetRoomInfo(ctx context.Context, roomID id.RoomID) (map[string]interface{}, error) {
+	bot, err := a.botIntent()
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]interface{}
+	if err := bot.StateEvent(ctx, roomID, event.StateJoinRules, "", &result); err != nil {
+		return nil, fmt.Errorf("failed to get room info: %w", err)
+	}
+	return result, nil
+}
+
+// JoinRoomVia joins a ghost to a room, using the first via server for federation
+func (a *AppserviceAdmin) JoinRoomVia(ctx context.Context, userID id.UserID, roomID id.RoomID, viaServers []string) error {
+	intent := a.ghostIntent(userID)
+	if intent == nil {
+		return fmt.Errorf("failed to join room as %s: %w", userID, ErrAdminNotSupported)
+	}
+	if err := intent.EnsureRegistered(ctx); err != nil {
+		return fmt.Errorf("failed to register ghost: %w", err)
+	}
+	var via string
+	if len(viaServers) > 0 {
+		via = viaServers[0]
+	}
+	if _, err := intent.JoinRoom(ctx, roomID.String(), via, nil); err != nil {
+		return fmt.Errorf("failed to join room: %w", err)
+	}
+	return nil
+}
+
+// KnockRoomVia asks to join a room as a ghost, using the first via server for federation
+func (a *AppserviceAdmin) KnockRoomVia(ctx context.Context, userID id.UserID, roomID id.RoomID, viaServers []string, reason string) error {
+	intent := a.ghostIntent(userID)
+	if intent == nil {
+		return fmt.Errorf("failed to knock on room as %s: %w", userID, ErrAdminNotSupported)
+	}
+	if err := intent.EnsureRegistered(ctx); err != nil {
+		return fmt.Errorf("failed to register ghost: %w", err)
+	}
+	query := map[string]string{}
+	if len(viaServers) > 0 {
+		query["server_name"] = viaServers[0]
+	}
+	urlPath := intent.BuildURLWithQuery(mautrix.ClientURLPath{"v3", "knock", roomID.String()}, query)
+	if _, err := intent.MakeRequest(ctx, http.MethodPost, urlPath, &knockRequest{Reason: reason}, nil); err != nil {
+		return fmt.Errorf("failed to knock on room: %w", err)
+	}
+	return nil
+}
+
+// ResetPassword isn't supported, as appservice users don't have passwords
+func (a *AppserviceAdmin) ResetPassword(ctx context.Context, userID id.UserID, password string) error {
+	return fmt.Errorf("failed to reset password of %s: %w", userID, ErrAdminNotSupported)
+}
+
+// DeactivateUser clears the profile of a ghost. Appservice users can't be deactivated,
+// and other users need an admin API.
+func (a *AppserviceAdmin) DeactivateUser(ctx context.Context, userID id.UserID) error {
+	intent := a.ghostIntent(userID)
+	if intent == nil {
+		return fmt.Errorf("failed to deactivate user %s: %w", userID, ErrAdminNotSupported)
+	}
+	if err := intent.SetDisplayName(ctx, ""); err != nil {
+		return fmt.Errorf("failed to clear display name: %w", err)
+	}
+	if err := intent.SetAvatarURL(ctx, id.ContentURI{}); err != nil {
+		return fmt.Errorf("failed to clear avatar: %w", err)
+	}
+	return nil
+}
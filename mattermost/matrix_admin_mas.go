@@ -0,0 +1,271 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/id"
+)
+
+// MASAdminClient implements HomeserverAdmin for homeservers that delegate authentication to
+// the Matrix Authentication Service. Accounts are managed with the MAS admin API, and
+// everything else goes through the appservice like AppserviceAdmin.
+type MASAdminClient struct {
+	*AppserviceAdmin
+
+	api *MatrixAdminClient
+}
+
+// NewMASAdminClient creates a new MAS admin API client.
+// The URL in the config is the MAS base URL, and the token must have the urn:mas:admin scope.
+func NewMASAdminClient(br *bridgev2.Bridge, cfg SynapseAdminConfig) *MASAdminClient {
+	return &MASAdminClient{
+		AppserviceAdmin: NewAppserviceAdmin(br),
+		api:             NewMatrixAdminClientFromConfig(cfg),
+	}
+}
+
+// masUserResponse is the response of the MAS admin API for a single user
+type masUserResponse struct {
+	Data struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// UserExists checks if a user already exists in MAS
+func (c *MASAdminClient) UserExists(ctx context.Context, userID id.UserID) (bool, error) {
+	user, err := c.getUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return user != nil, nil
+}
+
+// getUser looks up a user in MAS, it returns nil if the user doesn't exist
+func (c *MASAdminClient) getUser(ctx context.Context, userID id.UserID) (*masUserResponse, error) {
+	// MAS Admin API: GET /api/admin/v1/users/by-username/{username}
+	urlStr := fmt.Sprintf("%s/api/admin/v1/users/by-username/%s", c.api.BaseURL, url.PathEscape(userID.Localpart()))
+	statusCode, respBody, err := c.api.do(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check user: %w", err)
+	}
+
+	if statusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if statusCode >= 400 {
+		return nil, fmt.Errorf("failed to check user (status %d): %s", statusCode, string(respBody))
+	}
+
+	var user masUserResponse
+	if err := json.Unmarshal(respBody, &user); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &user, nil
+}
+
+// DeactivateUser deactivates a user in MAS, which ends their sessions
+func (c *MASAdminClient) DeactivateUser(ctx context.Context, userID id.UserID) error {
+	user, err := c.getUser(ctx, userID)
+	if err != nil {
+		return err
+	} else if user == nil {
+		return nil
+	}
+
+	// MAS Admin API: POST /api/admin/v1/users/{id}/deactivate
+	urlStr := fmt.Sprintf("%s/api/admin/v1/users/%s/deactivate", c.api.BaseURL, url.PathEscape(user.Data.ID))
+	statusCode, respBody, err := c.api.doRepeatable(ctx, http.MethodPost, urlStr, nil)
+	if err != nil {
+		return fmt.Errorf("failed to deactivate user: %w", err)
+	}
+	if statusCode >= 400 {
+		return fmt.Errorf("failed to deactivate user (status %d): %s", statusCode, string(respBody))
+	}
+
+	return nil
+}
+
+// CreateUser creates a new user in MAS and sets their password.
+// MAS doesn't store profiles, so the display name is left to the homeserver.
+func (c *MASAdminClient) CreateUser(ctx context.Context, userID id.UserID, password, displayName string) error {
+	// MAS Admin API: POST /api/admin/v1/users
+	reqBody := map[string]string{
+		"username": userID.Localpart(),
+	}
+
+	urlStr := fmt.Sprintf("%s/api/admin/v1/users", c.api.BaseURL)
+	statusCode, respBody, err := c.api.do(ctx, http.MethodPost, urlStr, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+	if statusCode >= 400 {
+		return fmt.Errorf("failed to create user (status %d): %s", statusCode, string(respBody))
+	}
+
+	if password == "" {
+		return nil
+	}
+
+	var user masUserResponse
+	if err := json.Unmarshal(respBody, &user); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return c.setPassword(ctx, user.Data.ID, password)
+}
+
+// ResetPassword sets a new password for a user in MAS
+func (c *MASAdminClient) ResetPassword(ctx context.Context, userID id.UserID, password string) error {
+	user, err := c.getUser(ctx, userID)
+	if err != nil {
+		return err
+	} else if user == nil {
+		return fmt.Errorf("user %s doesn't exist", userID)
+	}
+	return c.setPassword(ctx, user.Data.ID, password)
+}
+
+// setPassword sets the password of a MAS user by their MAS ID
+func (c *MASAdminClient) setPassword(ctx context.Context, masUserID, password string) error {
+	// MAS Admin API: POST /api/admin/v1/users/{id}/set-password
+	passwordBody := map[string]any{
+		"password":            password,
+		"skip_password_check": true,
+	}
+	urlStr := fmt.Sprintf("%s/api/admin/v1/users/%s/set-password", c.api.BaseURL, url.PathEscape(masUserID))
+	statusCode, respBody, err := c.api.doRepeatable(ctx, http.MethodPost, urlStr, passwordBody)
+	if err != nil {
+		return fmt.Errorf("failed to set password: %w", err)
+	}
+	if statusCode >= 400 {
+		return fmt.Errorf("failed to set password (status %d): %s", statusCode, string(respBody))
+	}
+
+	return nil
+}
+
+// UpdateUser adds the email and upstream SSO link of a user in MAS, or deactivates them.
+// MAS doesn't store profiles, so the display name and avatar are left to the homeserver.
+func (c *MASAdminClient) UpdateUser(ctx context.Context, userID id.UserID, update *UserUpdate) error {
+	if update.Deactivated {
+		return c.DeactivateUser(ctx, userID)
+	} else if update.Email == "" && update.ExternalID == nil {
+		return nil
+	}
+	user, err := c.getUser(ctx, userID)
+	if err != nil {
+		return err
+	} else if user == nil {
+		return fmt.Errorf("user %s doesn't exist", userID)
+	}
+
+	if update.Email != "" {
+		// MAS Admin API: POST /api/admin/v1/user-emails
+		reqBody := map[string]string{
+			"user_id": user.Data.ID,
+			"email":   update.Email,
+		}
+		if err = c.post(ctx, "/api/admin/v1/user-emails", reqBody); err != nil {
+			return fmt.Errorf("failed to add email: %w", err)
+		}
+	}
+	if update.ExternalID != nil {
+		// MAS Admin API: POST /api/admin/v1/upstream-oauth-links
+		reqBody := map[string]string{
+			"user_id":     user.Data.ID,
+			"provider_id": update.ExternalID.AuthProvider,
+			"subject":     update.ExternalID.ExternalID,
+		}
+		if err = c.post(ctx, "/api/admin/v1/upstream-oauth-links", reqBody); err != nil {
+			return fmt.Errorf("failed to link upstream account: %w", err)
+		}
+	}
+	return nil
+}
+
+// post creates a resource with the MAS admin API. Resources that already exist are fine,
+// so the request can be repeated.
+func (c *MASAdminClient) post(ctx context.Context, path string, reqBody any) error {
+	statusCode, respBody, err := c.api.doRepeatable(ctx, http.MethodPost, c.api.BaseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if statusCode >= 400 && statusCode != http.StatusConflict {
+		return fmt.Errorf("status %d: %s", statusCode, string(respBody))
+	}
+	return nil
+}
+
+// FindUser looks up the user linked to an upstream SSO identity, or else the user with an
+// email address. It returns an empty user ID if no user was found.
+func (c *MASAdminClient) FindUser(ctx context.Context, email string, externalID *ExternalID) (id.UserID, error) {
+	username, err := c.findUsername(ctx, email, externalID)
+	if err != nil || username == "" {
+		return "", err
+	}
+	return id.NewUserID(username, c.Bridge.Matrix.ServerName()), nil
+}
+
+// masListResponse is the response of the MAS admin API for lists of resources that belong
+// to users, like emails and upstream links
+type masListResponse struct {
+	Data []struct {
+		Attributes struct {
+			UserID string `json:"user_id"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// findUsername looks up the username of a user by their upstream link or email
+func (c *MASAdminClient) findUsername(ctx context.Context, email string, externalID *ExternalID) (string, error) {
+	var lookups []string
+	if externalID != nil {
+		// MAS Admin API: GET /api/admin/v1/upstream-oauth-links?filter[provider]=...&filter[subject]=...
+		query := url.Values{"filter[provider]": {externalID.AuthProvider}, "filter[subject]": {externalID.ExternalID}}
+		lookups = append(lookups, c.api.BaseURL+"/api/admin/v1/upstream-oauth-links?"+query.Encode())
+	}
+	if email != "" {
+		// MAS Admin API: GET /api/admin/v1/user-emails?filter[email]=...
+		query := url.Values{"filter[email]": {email}}
+		lookups = append(lookups, c.api.BaseURL+"/api/admin/v1/user-emails?"+query.Encode())
+	}
+	for _, lookupURL := range lookups {
+		statusCode, respBody, err := c.api.do(ctx, http.MethodGet, lookupURL, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to find user: %w", err)
+		} else if statusCode >= 400 {
+			return "", fmt.Errorf("failed to find user (status %d): %s", statusCode, string(respBody))
+		}
+		var list masListResponse
+		if err = json.Unmarshal(respBody, &list); err != nil {
+			return "", fmt.Errorf("failed to decode response: %w", err)
+		} else if len(list.Data) == 0 {
+			continue
+		}
+
+		// MAS Admin API: GET /api/admin/v1/users/{id}
+		userURL := fmt.Sprintf("%s/api/admin/v1/users/%s", c.api.BaseURL, url.PathEscape(list.Data[0].Attributes.UserID))
+		statusCode, respBody, err = c.api.do(ctx, http.MethodGet, userURL, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to get user: %w", err)
+		} else if statusCode >= 400 {
+			return "", fmt.Errorf("failed to get user (status %d): %s", statusCode, string(respBody))
+		}
+		var user struct {
+			Data struct {
+				Attributes struct {
+					Username string `json:"username"`
+				} `json:"attributes"`
+			} `json:"data"`
+		}
+		if err = json.Unmarshal(respBody, &user); err != nil {
+			return "", fmt.Errorf("failed to decode response: %w", err)
+		}
+		return user.Data.Attributes.Username, nil
+	}
+	return "", nil
+}
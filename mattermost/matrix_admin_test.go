@@ -1,10 +1,19 @@
 package mattermost
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/id"
 )
 
 func TestNewMatrixAdminClient(t *testing.T) {
@@ -58,11 +67,27 @@ func TestGenerateMatrixUserID(t *testing.T) {
 }
 
 func TestGeneratePassword(t *testing.T) {
-	password := GeneratePassword()
-	
-	assert.NotEmpty(t, password)
-	assert.True(t, len(password) > 20) // "mattermost-bridge-" prefix + 16 chars
-	assert.Contains(t, password, "mattermost-bridge-")
+	password, err := GeneratePassword(PasswordPolicyConfig{})
+	require.NoError(t, err)
+	assert.Len(t, password, defaultPasswordLength)
+
+	other, err := GeneratePassword(PasswordPolicyConfig{})
+	require.NoError(t, err)
+	assert.NotEqual(t, password, other)
+}
+
+func TestGeneratePassword_Policy(t *testing.T) {
+	password, err := GeneratePassword(PasswordPolicyConfig{Length: 40, Charset: "ab"})
+	require.NoError(t, err)
+	assert.Len(t, password, 40)
+	assert.Regexp(t, "^[ab]+$", password)
+
+	password, err = GeneratePassword(PasswordPolicyConfig{Length: 4})
+	require.NoError(t, err)
+	assert.Len(t, password, minPasswordLength)
+
+	_, err = GeneratePassword(PasswordPolicyConfig{Charset: "a"})
+	assert.Error(t, err)
 }
 
 func TestCreateUserRequest_Marshal(t *testing.T) {
@@ -88,3 +113,427 @@ func TestThreePID(t *testing.T) {
 	assert.Equal(t, "email", pid.Medium)
 	assert.Equal(t, "john@example.com", pid.Address)
 }
+
+func newTestMatrixAdminClient(url string) *MatrixAdminClient {
+	client := NewMatrixAdminClient(url, "admin_token")
+	client.InitialBackoff = time.Millisecond
+	client.MaxBackoff = 10 * time.Millisecond
+	return client
+}
+
+func TestNewMatrixAdminClientFromConfig(t *testing.T) {
+	client := NewMatrixAdminClientFromConfig(SynapseAdminConfig{
+		URL:              "https://matrix.example.com",
+		Token:            "admin_token",
+		RequestTimeout:   5,
+		ExemptRateLimits: true,
+	})
+
+	assert.Equal(t, "https://matrix.example.com", client.BaseURL)
+	assert.Equal(t, 5*time.Second, client.Timeout)
+	assert.Equal(t, defaultAdminMaxRetries, client.MaxRetries)
+	assert.True(t, client.ExemptCreatedUsers)
+}
+
+func TestNewMatrixAdminClientFromConfig_NoRetries(t *testing.T) {
+	client := NewMatrixAdminClientFromConfig(SynapseAdminConfig{URL: "https://matrix.example.com", MaxRetries: ptr.Ptr(0)})
+	assert.Equal(t, 0, client.MaxRetries)
+}
+
+func TestMatrixAdminClient_RetriesRateLimit(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer admin_token", r.Header.Get("Authorization"))
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":1}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"name":"@alice:example.com"}`))
+	}))
+	defer server.Close()
+
+	exists, err := newTestMatrixAdminClient(server.URL).UserExists(context.Background(), "@alice:example.com")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestMatrixAdminClient_GivesUpAfterMaxRetries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := newTestMatrixAdminClient(server.URL)
+	client.MaxRetries = 2
+	_, err := client.UserExists(context.Background(), "@alice:example.com")
+	assert.ErrorContains(t, err, "status 502")
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestMatrixAdminClient_DoesNotRetryClientErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	err := newTestMatrixAdminClient(server.URL).UpdateUserDisplayName(context.Background(), "@alice:example.com", "Alice")
+	assert.ErrorContains(t, err, "status 400")
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestMatrixAdminClient_RetriesOnlyRepeatableRequests(t *testing.T) {
+	var requests, status atomic.Int32
+	status.Store(http.StatusBadGateway)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client := newTestMatrixAdminClient(server.URL)
+	client.MaxRetries = 2
+
+	// A POST that failed with a server error may have gone through
+	statusCode, _, err := client.do(ctx, http.MethodPost, server.URL, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, statusCode)
+	assert.Equal(t, int32(1), requests.Load())
+
+	requests.Store(0)
+	_, _, err = client.doRepeatable(ctx, http.MethodPost, server.URL, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+
+	// Rate limited requests weren't handled, so they're always retried
+	requests.Store(0)
+	status.Store(http.StatusTooManyRequests)
+	_, _, err = client.do(ctx, http.MethodPost, server.URL, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestMatrixAdminClient_RequestTimeout(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := newTestMatrixAdminClient(server.URL)
+	client.Timeout = 50 * time.Millisecond
+	exists, err := client.UserExists(context.Background(), "@alice:example.com")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestMatrixAdminClient_CreateUserExemptsRateLimits(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/_synapse/admin/v1/users/@alice:example.com/override_ratelimit" {
+			var body map[string]int
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, 0, body["messages_per_second"])
+			assert.Equal(t, 0, body["burst_count"])
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := newTestMatrixAdminClient(server.URL)
+	require.NoError(t, client.CreateUser(context.Background(), "@alice:example.com", "password", "Alice"))
+	assert.Equal(t, []string{"PUT /_synapse/admin/v2/users/@alice:example.com"}, paths)
+
+	paths = nil
+	client.ExemptCreatedUsers = true
+	require.NoError(t, client.CreateUser(context.Background(), "@alice:example.com", "password", "Alice"))
+	assert.Equal(t, []string{
+		"PUT /_synapse/admin/v2/users/@alice:example.com",
+		"POST /_synapse/admin/v1/users/@alice:example.com/override_ratelimit",
+	}, paths)
+}
+
+func TestNewHomeserverAdmin(t *testing.T) {
+	admin, err := NewHomeserverAdmin(nil, SynapseAdminConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, admin)
+
+	admin, err = NewHomeserverAdmin(nil, SynapseAdminConfig{URL: "https://matrix.example.com", Token: "token"})
+	require.NoError(t, err)
+	assert.IsType(t, &MatrixAdminClient{}, admin)
+
+	admin, err = NewHomeserverAdmin(nil, SynapseAdminConfig{Backend: AdminBackendMAS, URL: "https://auth.example.com"})
+	require.NoError(t, err)
+	assert.Nil(t, admin, "MAS backend requires a token")
+
+	admin, err = NewHomeserverAdmin(nil, SynapseAdminConfig{Backend: AdminBackendMAS, URL: "https://auth.example.com", Token: "token"})
+	require.NoError(t, err)
+	assert.IsType(t, &MASAdminClient{}, admin)
+
+	admin, err = NewHomeserverAdmin(nil, SynapseAdminConfig{Backend: AdminBackendNone})
+	require.NoError(t, err)
+	assert.IsType(t, &AppserviceAdmin{}, admin)
+
+	_, err = NewHomeserverAdmin(nil, SynapseAdminConfig{Backend: "dendrite"})
+	assert.Error(t, err)
+}
+
+func TestMASAdminClient_CreateUser(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer mas_token", r.Header.Get("Authorization"))
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/api/admin/v1/users/by-username/alice":
+			w.WriteHeader(http.StatusNotFound)
+		case "/api/admin/v1/users":
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "alice", body["username"])
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"data":{"type":"user","id":"01HUSER"}}`))
+		case "/api/admin/v1/users/01HUSER/set-password":
+			var body map[string]any
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "secret", body["password"])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewMASAdminClient(nil, SynapseAdminConfig{URL: server.URL, Token: "mas_token"})
+	exists, err := client.UserExists(context.Background(), "@alice:example.com")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, client.CreateUser(context.Background(), "@alice:example.com", "secret", "Alice"))
+	assert.Equal(t, []string{
+		"GET /api/admin/v1/users/by-username/alice",
+		"POST /api/admin/v1/users",
+		"POST /api/admin/v1/users/01HUSER/set-password",
+	}, paths)
+}
+
+func TestMatrixAdminClient_DeactivateUser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/_synapse/admin/v1/deactivate/@alice:example.com", r.URL.Path)
+		var body map[string]bool
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.True(t, body["erase"])
+		_, _ = w.Write([]byte(`{"id_server_unbind_result":"success"}`))
+	}))
+	defer server.Close()
+
+	require.NoError(t, newTestMatrixAdminClient(server.URL).DeactivateUser(context.Background(), "@alice:example.com"))
+}
+
+func TestMASAdminClient_DeactivateUser(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/api/admin/v1/users/by-username/alice":
+			_, _ = w.Write([]byte(`{"data":{"type":"user","id":"01HUSER"}}`))
+		case "/api/admin/v1/users/01HUSER/deactivate":
+			_, _ = w.Write([]byte(`{"data":{"type":"user","id":"01HUSER"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewMASAdminClient(nil, SynapseAdminConfig{URL: server.URL, Token: "mas_token"})
+	require.NoError(t, client.DeactivateUser(context.Background(), "@alice:example.com"))
+	// Users that don't exist are skipped
+	require.NoError(t, client.DeactivateUser(context.Background(), "@bob:example.com"))
+	assert.Equal(t, []string{
+		"GET /api/admin/v1/users/by-username/alice",
+		"POST /api/admin/v1/users/01HUSER/deactivate",
+		"GET /api/admin/v1/users/by-username/bob",
+	}, paths)
+}
+
+func TestMatrixAdminClient_ResetPassword(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/_synapse/admin/v1/reset_password/@alice:example.com", r.URL.Path)
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "secret", body["new_password"])
+		assert.Equal(t, true, body["logout_devices"])
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	require.NoError(t, newTestMatrixAdminClient(server.URL).ResetPassword(context.Background(), "@alice:example.com", "secret"))
+}
+
+func TestMASAdminClient_ResetPassword(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/admin/v1/users/by-username/alice":
+			_, _ = w.Write([]byte(`{"data":{"type":"user","id":"01HUSER"}}`))
+		case "/api/admin/v1/users/01HUSER/set-password":
+			var body map[string]any
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "secret", body["password"])
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewMASAdminClient(nil, SynapseAdminConfig{URL: server.URL, Token: "mas_token"})
+	require.NoError(t, client.ResetPassword(context.Background(), "@alice:example.com", "secret"))
+	assert.Error(t, client.ResetPassword(context.Background(), "@bob:example.com", "secret"))
+}
+
+func TestUsesGhostAccounts(t *testing.T) {
+	m := &MattermostConnector{}
+	assert.False(t, m.usesGhostAccounts())
+	m.MatrixAdmin = newTestMatrixAdminClient("https://matrix.example.com")
+	assert.False(t, m.usesGhostAccounts())
+	m.MatrixAdmin = NewAppserviceAdmin(nil)
+	assert.True(t, m.usesGhostAccounts())
+}
+
+func TestMatrixAdminClient_UpdateUser(t *testing.T) {
+	var bodies []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/_synapse/admin/v2/users/@alice:example.com", r.URL.Path)
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		bodies = append(bodies, body)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := newTestMatrixAdminClient(server.URL)
+	ctx := context.Background()
+	require.NoError(t, client.UpdateUser(ctx, "@alice:example.com", &UserUpdate{
+		DisplayName: "Alice",
+		AvatarURL:   "mxc://example.com/avatar",
+		Email:       "alice@example.com",
+		ExternalID:  &ExternalID{AuthProvider: "oidc-keycloak", ExternalID: "sub-1"},
+	}))
+	require.NoError(t, client.UpdateUser(ctx, "@alice:example.com", &UserUpdate{Deactivated: true}))
+	// Empty updates don't send a request
+	require.NoError(t, client.UpdateUser(ctx, "@alice:example.com", &UserUpdate{}))
+
+	require.Len(t, bodies, 2)
+	assert.Equal(t, map[string]any{
+		"displayname":  "Alice",
+		"avatar_url":   "mxc://example.com/avatar",
+		"threepids":    []any{map[string]any{"medium": "email", "address": "alice@example.com"}},
+		"external_ids": []any{map[string]any{"auth_provider": "oidc-keycloak", "external_id": "sub-1"}},
+	}, bodies[0])
+	assert.Equal(t, map[string]any{"deactivated": true}, bodies[1])
+}
+
+func TestMASAdminClient_UpdateUser(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/api/admin/v1/users/by-username/alice":
+			_, _ = w.Write([]byte(`{"data":{"type":"user","id":"01HUSER"}}`))
+		case "/api/admin/v1/user-emails":
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, map[string]string{"user_id": "01HUSER", "email": "alice@example.com"}, body)
+			// Emails the user already has are fine
+			w.WriteHeader(http.StatusConflict)
+		case "/api/admin/v1/upstream-oauth-links":
+			var body map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, map[string]string{"user_id": "01HUSER", "provider_id": "01HPROVIDER", "subject": "sub-1"}, body)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewMASAdminClient(nil, SynapseAdminConfig{URL: server.URL, Token: "mas_token"})
+	ctx := context.Background()
+	require.NoError(t, client.UpdateUser(ctx, "@alice:example.com", &UserUpdate{
+		DisplayName: "Alice",
+		Email:       "alice@example.com",
+		ExternalID:  &ExternalID{AuthProvider: "01HPROVIDER", ExternalID: "sub-1"},
+	}))
+	// Profile-only updates are left to the homeserver
+	require.NoError(t, client.UpdateUser(ctx, "@alice:example.com", &UserUpdate{DisplayName: "Alice"}))
+	assert.Equal(t, []string{
+		"GET /api/admin/v1/users/by-username/alice",
+		"POST /api/admin/v1/user-emails",
+		"POST /api/admin/v1/upstream-oauth-links",
+	}, paths)
+}
+
+func TestMatrixAdminClient_FindUser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_synapse/admin/v1/auth_providers/oidc-keycloak/users/sub-1":
+			_, _ = w.Write([]byte(`{"user_id":"@alice:example.com"}`))
+		case "/_synapse/admin/v1/threepid/email/users/bob@example.com":
+			_, _ = w.Write([]byte(`{"user_id":"@bob:example.com"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := newTestMatrixAdminClient(server.URL)
+	ctx := context.Background()
+	mxid, err := client.FindUser(ctx, "alice@example.com", &ExternalID{AuthProvider: "oidc-keycloak", ExternalID: "sub-1"})
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@alice:example.com"), mxid)
+	// The email is looked up if the SSO identity isn't linked
+	mxid, err = client.FindUser(ctx, "bob@example.com", &ExternalID{AuthProvider: "oidc-keycloak", ExternalID: "sub-2"})
+	require.NoError(t, err)
+	assert.Equal(t, id.UserID("@bob:example.com"), mxid)
+	mxid, err = client.FindUser(ctx, "carol@example.com", nil)
+	require.NoError(t, err)
+	assert.Empty(t, mxid)
+}
+
+func TestMASAdminClient_FindUsername(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/admin/v1/upstream-oauth-links":
+			assert.Equal(t, "01HPROVIDER", r.URL.Query().Get("filter[provider]"))
+			_, _ = w.Write([]byte(`{"data":[]}`))
+		case "/api/admin/v1/user-emails":
+			assert.Equal(t, "alice@example.com", r.URL.Query().Get("filter[email]"))
+			_, _ = w.Write([]byte(`{"data":[{"type":"user-email","id":"01HEMAIL","attributes":{"user_id":"01HUSER","email":"alice@example.com"}}]}`))
+		case "/api/admin/v1/users/01HUSER":
+			_, _ = w.Write([]byte(`{"data":{"type":"user","id":"01HUSER","attributes":{"username":"alice"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewMASAdminClient(nil, SynapseAdminConfig{URL: server.URL, Token: "mas_token"})
+	username, err := client.findUsername(context.Background(), "alice@example.com", &ExternalID{AuthProvider: "01HPROVIDER", ExternalID: "sub-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "alice", username)
+}
@@ -0,0 +1,311 @@
+package mattermost
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+var matrixUserUpgrades dbutil.UpgradeTable
+
+func init() {
+	matrixUserUpgrades.Register(-1, 1, 0, "Create Mattermost accounts table for Matrix users", dbutil.TxnModeOn, func(ctx context.Context, db *dbutil.Database) error {
+		_, err := db.Exec(ctx, `
+			CREATE TABLE mattermost_matrix_user (
+				bridge_id   TEXT NOT NULL,
+				mxid        TEXT NOT NULL,
+				mm_user_id  TEXT NOT NULL,
+				mm_token    TEXT NOT NULL,
+				name        TEXT NOT NULL,
+				avatar_mxc  TEXT NOT NULL,
+				avatar_hash TEXT NOT NULL,
+
+				PRIMARY KEY (bridge_id, mxid)
+			)
+		`)
+		return err
+	})
+	matrixUserUpgrades.Register(1, 2, 0, "Migrate ghosts to Mattermost user IDs", dbutil.TxnModeOn, migrateGhostIDs)
+	matrixUserUpgrades.Register(2, 3, 3, "Add server to Mattermost accounts of Matrix users", dbutil.TxnModeOn, func(ctx context.Context, db *dbutil.Database) error {
+		// The primary key changes, which SQLite can't alter, so the table is rebuilt.
+		// Existing accounts were all created on the main server.
+		queries := []string{`
+			CREATE TABLE mattermost_matrix_user_new (
+				bridge_id   TEXT NOT NULL,
+				server      TEXT NOT NULL,
+				mxid        TEXT NOT NULL,
+				mm_user_id  TEXT NOT NULL,
+				mm_token    TEXT NOT NULL,
+				name        TEXT NOT NULL,
+				avatar_mxc  TEXT NOT NULL,
+				avatar_hash TEXT NOT NULL,
+
+				PRIMARY KEY (bridge_id, server, mxid)
+			)
+		`, `
+			INSERT INTO mattermost_matrix_user_new (bridge_id, server, mxid, mm_user_id, mm_token, name, avatar_mxc, avatar_hash)
+			SELECT bridge_id, '', mxid, mm_user_id, mm_token, name, avatar_mxc, avatar_hash FROM mattermost_matrix_user
+		`,
+			"DROP TABLE mattermost_matrix_user",
+			"ALTER TABLE mattermost_matrix_user_new RENAME TO mattermost_matrix_user",
+		}
+		for _, query := range queries {
+			if _, err := db.Exec(ctx, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MatrixUser is the Mattermost account the bridge created for a Matrix user, which is
+// used to post the user's messages to Mattermost. Matrix users get an account on each
+// server they post to, Server is empty for the main server.
+type MatrixUser struct {
+	Server     string
+	MXID       id.UserID
+	MMUserID   string
+	Token      string
+	Name       string
+	AvatarMXC  id.ContentURIString
+	AvatarHash [32]byte
+}
+
+// MatrixUserStore stores the Mattermost accounts of Matrix users
+type MatrixUserStore struct {
+	bridgeID networkid.BridgeID
+	db       *dbutil.Database
+}
+
+// NewMatrixUserStore creates a Matrix user store in the given database
+func NewMatrixUserStore(bridgeID networkid.BridgeID, db *dbutil.Database) *MatrixUserStore {
+	return &MatrixUserStore{
+		bridgeID: bridgeID,
+		db:       db.Child("mattermost_matrix_user_version", matrixUserUpgrades, nil),
+	}
+}
+
+// Upgrade creates the table if needed and migrates old ghost rows
+func (s *MatrixUserStore) Upgrade(ctx context.Context) error {
+	return s.db.Upgrade(ctx)
+}
+
+const matrixUserColumns = "server, mxid, mm_user_id, mm_token, name, avatar_mxc, avatar_hash"
+
+func scanMatrixUser(row dbutil.Scannable) (*MatrixUser, error) {
+	var user MatrixUser
+	var avatarHash string
+	err := row.Scan(&user.Server, &user.MXID, &user.MMUserID, &user.Token, &user.Name, &user.AvatarMXC, &avatarHash)
+	if err != nil {
+		return nil, err
+	}
+	if decoded, _ := hex.DecodeString(avatarHash); len(decoded) == len(user.AvatarHash) {
+		copy(user.AvatarHash[:], decoded)
+	}
+	return &user, nil
+}
+
+// Get returns the Mattermost account of a Matrix user on a server, or nil if there is none
+func (s *MatrixUserStore) Get(ctx context.Context, server string, mxid id.UserID) (*MatrixUser, error) {
+	user, err := scanMatrixUser(s.db.QueryRow(ctx, `
+		SELECT `+matrixUserColumns+` FROM mattermost_matrix_user WHERE bridge_id=$1 AND server=$2 AND mxid=$3
+	`, s.bridgeID, server, mxid))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return user, err
+}
+
+// GetAll returns the Mattermost accounts of a Matrix user on all servers
+func (s *MatrixUserStore) GetAll(ctx context.Context, mxid id.UserID) ([]*MatrixUser, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT `+matrixUserColumns+` FROM mattermost_matrix_user WHERE bridge_id=$1 AND mxid=$2 ORDER BY server
+	`, s.bridgeID, mxid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []*MatrixUser
+	for rows.Next() {
+		user, err := scanMatrixUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// GetByMMUserID returns the Matrix user of a Mattermost account on a server, or nil if
+// there is none
+func (s *MatrixUserStore) GetByMMUserID(ctx context.Context, server, mmUserID string) (*MatrixUser, error) {
+	user, err := scanMatrixUser(s.db.QueryRow(ctx, `
+		SELECT `+matrixUserColumns+` FROM mattermost_matrix_user WHERE bridge_id=$1 AND server=$2 AND mm_user_id=$3
+	`, s.bridgeID, server, mmUserID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return user, err
+}
+
+// Put inserts or updates the Mattermost account of a Matrix user
+func (s *MatrixUserStore) Put(ctx context.Context, user *MatrixUser) error {
+	avatarHash := ""
+	if user.AvatarHash != [32]byte{} {
+		avatarHash = hex.EncodeToString(user.AvatarHash[:])
+	}
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO mattermost_matrix_user (bridge_id, server, mxid, mm_user_id, mm_token, name, avatar_mxc, avatar_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (bridge_id, server, mxid) DO UPDATE
+			SET mm_user_id=excluded.mm_user_id, mm_token=excluded.mm_token, name=excluded.name,
+			    avatar_mxc=excluded.avatar_mxc, avatar_hash=excluded.avatar_hash
+	`, s.bridgeID, user.Server, user.MXID, user.MMUserID, user.Token, user.Name, user.AvatarMXC, avatarHash)
+	return err
+}
+
+// UpdateProfile stores the profile of a Matrix user that was copied to their Mattermost account
+func (s *MatrixUserStore) UpdateProfile(ctx context.Context, user *MatrixUser) error {
+	avatarHash := ""
+	if user.AvatarHash != [32]byte{} {
+		avatarHash = hex.EncodeToString(user.AvatarHash[:])
+	}
+	_, err := s.db.Exec(ctx, `
+		UPDATE mattermost_matrix_user SET name=$4, avatar_mxc=$5, avatar_hash=$6 WHERE bridge_id=$1 AND server=$2 AND mxid=$3
+	`, s.bridgeID, user.Server, user.MXID, user.Name, user.AvatarMXC, avatarHash)
+	return err
+}
+
+// ClearToken removes the cached Personal Access Token of a Matrix user on a server
+func (s *MatrixUserStore) ClearToken(ctx context.Context, server string, mxid id.UserID) error {
+	_, err := s.db.Exec(ctx, "UPDATE mattermost_matrix_user SET mm_token='' WHERE bridge_id=$1 AND server=$2 AND mxid=$3", s.bridgeID, server, mxid)
+	return err
+}
+
+// Delete removes the Mattermost accounts of a Matrix user on all servers from the store
+func (s *MatrixUserStore) Delete(ctx context.Context, mxid id.UserID) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM mattermost_matrix_user WHERE bridge_id=$1 AND mxid=$2", s.bridgeID, mxid)
+	return err
+}
+
+type oldGhost struct {
+	bridgeID string
+	id       string
+	name     string
+	mxc      string
+	hash     string
+	meta     map[string]any
+}
+
+// migrateGhostIDs rewrites ghosts from older versions, which were keyed by Mattermost
+// username or by Matrix ID, to the Mattermost user ID stored in their metadata. Ghosts
+// keyed by a Matrix ID held the Mattermost account of a Matrix user, so they're also
+// copied to the mattermost_matrix_user table.
+func migrateGhostIDs(ctx context.Context, db *dbutil.Database) error {
+	rows, err := db.Query(ctx, "SELECT bridge_id, id, name, avatar_mxc, avatar_hash, metadata FROM ghost")
+	if err != nil {
+		return fmt.Errorf("failed to query ghosts: %w", err)
+	}
+	var ghosts []*oldGhost
+	for rows.Next() {
+		var ghost oldGhost
+		var metaJSON []byte
+		if err = rows.Scan(&ghost.bridgeID, &ghost.id, &ghost.name, &ghost.mxc, &ghost.hash, &metaJSON); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to scan ghost: %w", err)
+		}
+		_ = json.Unmarshal(metaJSON, &ghost.meta)
+		ghosts = append(ghosts, &ghost)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to query ghosts: %w", err)
+	}
+
+	log := zerolog.Ctx(ctx)
+	migrated, skipped := 0, 0
+	for _, ghost := range ghosts {
+		mmUserID, _ := ghost.meta["mm_id"].(string)
+		if mmUserID == ghost.id {
+			continue
+		} else if mmUserID == "" {
+			// Without the metadata there's no way to find the user offline. The ghost is
+			// left as-is and a new one is created when the user is synced.
+			skipped++
+			continue
+		}
+		if strings.HasPrefix(ghost.id, "@") {
+			token, _ := ghost.meta["mm_token"].(string)
+			_, err = db.Exec(ctx, `
+				INSERT INTO mattermost_matrix_user (bridge_id, mxid, mm_user_id, mm_token, name, avatar_mxc, avatar_hash)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)
+			`, ghost.bridgeID, ghost.id, mmUserID, token, ghost.name, ghost.mxc, ghost.hash)
+			if err != nil {
+				return fmt.Errorf("failed to copy Mattermost account of %s: %w", ghost.id, err)
+			}
+			delete(ghost.meta, "mm_token")
+		}
+		if err = moveGhost(ctx, db, ghost, mmUserID); err != nil {
+			return fmt.Errorf("failed to migrate ghost %s: %w", ghost.id, err)
+		}
+		migrated++
+	}
+	if migrated > 0 || skipped > 0 {
+		log.Info().Int("migrated", migrated).Int("skipped", skipped).Msg("Migrated ghosts to Mattermost user IDs")
+	}
+	return nil
+}
+
+// moveGhost moves a ghost and everything that references it to a new ID. If a ghost
+// with the new ID already exists, the old one is merged into it.
+func moveGhost(ctx context.Context, db *dbutil.Database, ghost *oldGhost, newID string) error {
+	var exists bool
+	err := db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM ghost WHERE bridge_id=$1 AND id=$2)", ghost.bridgeID, newID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		metaJSON, err := json.Marshal(ghost.meta)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(ctx, `
+			INSERT INTO ghost (bridge_id, id, name, avatar_id, avatar_hash, avatar_mxc, name_set, avatar_set,
+			                   contact_info_set, is_bot, identifiers, metadata)
+			SELECT bridge_id, $3, name, avatar_id, avatar_hash, avatar_mxc, name_set, avatar_set,
+			       contact_info_set, is_bot, identifiers, $4
+			FROM ghost WHERE bridge_id=$1 AND id=$2
+		`, ghost.bridgeID, ghost.id, newID, string(metaJSON))
+		if err != nil {
+			return err
+		}
+	}
+	queries := []string{
+		"UPDATE message SET sender_id=$3 WHERE bridge_id=$1 AND sender_id=$2",
+		// Drop reactions that the user already has under the new ID, they'd violate the primary key
+		`DELETE FROM reaction WHERE bridge_id=$1 AND sender_id=$2 AND EXISTS(
+			SELECT 1 FROM reaction r2
+			WHERE r2.bridge_id=reaction.bridge_id AND r2.room_receiver=reaction.room_receiver
+			  AND r2.message_id=reaction.message_id AND r2.message_part_id=reaction.message_part_id
+			  AND r2.emoji_id=reaction.emoji_id AND r2.sender_id=$3
+		)`,
+		"UPDATE reaction SET sender_id=$3 WHERE bridge_id=$1 AND sender_id=$2",
+		"UPDATE portal SET other_user_id=$3 WHERE bridge_id=$1 AND other_user_id=$2",
+	}
+	for _, query := range queries {
+		if _, err = db.Exec(ctx, query, ghost.bridgeID, ghost.id, newID); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(ctx, "DELETE FROM ghost WHERE bridge_id=$1 AND id=$2", ghost.bridgeID, ghost.id)
+	return err
+}
@@ -0,0 +1,158 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestBridgeDB(t *testing.T) *database.Database {
+	db, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	require.NoError(t, err)
+	// Every connection to :memory: is a separate database
+	db.RawDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+
+	bridgeDB := database.New("mattermost", database.MetaTypes{}, db)
+	require.NoError(t, bridgeDB.Upgrade(context.Background()))
+	return bridgeDB
+}
+
+func TestMatrixUserStore_PutGetClearToken(t *testing.T) {
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+	store := NewMatrixUserStore("mattermost", bridgeDB.Database)
+	require.NoError(t, store.Upgrade(ctx))
+
+	user, err := store.Get(ctx, "", "@alice:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, user)
+
+	require.NoError(t, store.Put(ctx, &MatrixUser{
+		MXID:       "@alice:example.com",
+		MMUserID:   "alice-mm-id",
+		Token:      "token",
+		AvatarHash: [32]byte{1, 2, 3},
+	}))
+	require.NoError(t, store.ClearToken(ctx, "", "@alice:example.com"))
+
+	user, err = store.Get(ctx, "", "@alice:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	assert.Equal(t, "alice-mm-id", user.MMUserID)
+	assert.Empty(t, user.Token)
+	assert.Equal(t, [32]byte{1, 2, 3}, user.AvatarHash)
+}
+
+func TestMatrixUserStore_Servers(t *testing.T) {
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+	store := NewMatrixUserStore("mattermost", bridgeDB.Database)
+	require.NoError(t, store.Upgrade(ctx))
+
+	require.NoError(t, store.Put(ctx, &MatrixUser{MXID: "@alice:example.com", MMUserID: "alice-main", Token: "main-token"}))
+	require.NoError(t, store.Put(ctx, &MatrixUser{Server: "other", MXID: "@alice:example.com", MMUserID: "alice-other", Token: "other-token"}))
+	require.NoError(t, store.ClearToken(ctx, "other", "@alice:example.com"))
+
+	user, err := store.Get(ctx, "", "@alice:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	assert.Equal(t, "alice-main", user.MMUserID)
+	assert.Equal(t, "main-token", user.Token)
+
+	user, err = store.GetByMMUserID(ctx, "other", "alice-other")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	assert.Equal(t, id.UserID("@alice:example.com"), user.MXID)
+	assert.Empty(t, user.Token)
+	user, err = store.GetByMMUserID(ctx, "", "alice-other")
+	require.NoError(t, err)
+	assert.Nil(t, user)
+
+	users, err := store.GetAll(ctx, "@alice:example.com")
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, "", users[0].Server)
+	assert.Equal(t, "other", users[1].Server)
+
+	require.NoError(t, store.Delete(ctx, "@alice:example.com"))
+	users, err = store.GetAll(ctx, "@alice:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, users)
+}
+
+func TestMigrateGhostIDs(t *testing.T) {
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+
+	ghosts := []*database.Ghost{
+		// Keyed by username
+		{ID: "alice", Name: "Alice", Metadata: map[string]any{"mm_id": "alice-mm-id"}},
+		// Keyed by username, while a ghost with the user ID already exists
+		{ID: "bob", Name: "Bob", Metadata: map[string]any{"mm_id": "bob-mm-id"}},
+		{ID: "bob-mm-id", Name: "Bob", Metadata: map[string]any{"mm_id": "bob-mm-id"}},
+		// The Mattermost account of a Matrix user
+		{ID: "@carol:example.com", Name: "Carol", Metadata: map[string]any{"mm_id": "carol-mm-id", "mm_token": "carol-token"}},
+		// Nothing to migrate to
+		{ID: "dave", Name: "Dave", Metadata: map[string]any{}},
+	}
+	for _, ghost := range ghosts {
+		ghost.BridgeID = "mattermost"
+		require.NoError(t, bridgeDB.Ghost.Insert(ctx, ghost))
+	}
+	portalKey := networkid.PortalKey{ID: "dm1"}
+	require.NoError(t, bridgeDB.Portal.Insert(ctx, &database.Portal{BridgeID: "mattermost", PortalKey: portalKey, OtherUserID: "alice"}))
+	for i, sender := range []networkid.UserID{"alice", "bob"} {
+		require.NoError(t, bridgeDB.Message.Insert(ctx, &database.Message{
+			BridgeID:  "mattermost",
+			ID:        networkid.MessageID(sender),
+			MXID:      id.EventID("$" + string(sender)),
+			Room:      portalKey,
+			SenderID:  sender,
+			Timestamp: time.UnixMilli(int64(i)),
+		}))
+	}
+
+	store := NewMatrixUserStore("mattermost", bridgeDB.Database)
+	require.NoError(t, store.Upgrade(ctx))
+
+	for oldID, newID := range map[networkid.UserID]networkid.UserID{"alice": "alice-mm-id", "bob": "bob-mm-id", "@carol:example.com": "carol-mm-id"} {
+		ghost, err := bridgeDB.Ghost.GetByID(ctx, oldID)
+		require.NoError(t, err)
+		assert.Nil(t, ghost, "old ghost %s should be removed", oldID)
+		ghost, err = bridgeDB.Ghost.GetByID(ctx, newID)
+		require.NoError(t, err)
+		assert.NotNil(t, ghost, "ghost %s should exist", newID)
+	}
+	dave, err := bridgeDB.Ghost.GetByID(ctx, "dave")
+	require.NoError(t, err)
+	assert.NotNil(t, dave)
+
+	for sender, expected := range map[string]networkid.UserID{"alice": "alice-mm-id", "bob": "bob-mm-id"} {
+		msg, err := bridgeDB.Message.GetFirstPartByID(ctx, "", networkid.MessageID(sender))
+		require.NoError(t, err)
+		require.NotNil(t, msg)
+		assert.Equal(t, expected, msg.SenderID)
+	}
+	portal, err := bridgeDB.Portal.GetByKey(ctx, portalKey)
+	require.NoError(t, err)
+	assert.Equal(t, networkid.UserID("alice-mm-id"), portal.OtherUserID)
+
+	carol, err := store.Get(ctx, "", "@carol:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, carol)
+	assert.Equal(t, "carol-mm-id", carol.MMUserID)
+	assert.Equal(t, "carol-token", carol.Token)
+	var carolMeta string
+	err = bridgeDB.QueryRow(ctx, "SELECT metadata FROM ghost WHERE id='carol-mm-id'").Scan(&carolMeta)
+	require.NoError(t, err)
+	assert.NotContains(t, carolMeta, "carol-token")
+}
@@ -0,0 +1,71 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// Message status errors for Matrix events that couldn't be bridged to Mattermost.
+// The bridge turns them into com.beeper.message_send_status events and m.notice error
+// notices, depending on message_status_events and message_error_notices in the
+// matrix section of the bridge config.
+var (
+	ErrMattermostPermissionDenied error = bridgev2.WrapErrorInStatus(errors.New("no permission to post in this channel")).WithStatus(event.MessageStatusFail).WithErrorReason(event.MessageStatusNoPermission).WithMessage("you don't have permission to post in this Mattermost channel").WithIsCertain(true).WithSendNotice(true)
+	ErrMattermostTargetNotFound   error = bridgev2.WrapErrorInStatus(errors.New("target not found")).WithStatus(event.MessageStatusFail).WithErrorReason(event.MessageStatusGenericError).WithMessage("the message or channel no longer exists on Mattermost").WithIsCertain(true).WithSendNotice(true)
+	ErrMattermostTooLarge         error = bridgev2.WrapErrorInStatus(errors.New("request too large")).WithStatus(event.MessageStatusFail).WithErrorReason(event.MessageStatusUnsupported).WithMessage("the message is too large for Mattermost").WithIsCertain(true).WithSendNotice(true)
+	ErrMattermostRejected         error = bridgev2.WrapErrorInStatus(errors.New("rejected by Mattermost")).WithStatus(event.MessageStatusFail).WithErrorReason(event.MessageStatusGenericError).WithMessage("Mattermost rejected the message").WithIsCertain(true).WithSendNotice(true)
+	ErrMattermostUnavailable      error = bridgev2.WrapErrorInStatus(errors.New("Mattermost unavailable")).WithStatus(event.MessageStatusRetriable).WithErrorReason(event.MessageStatusNetworkError).WithMessage("couldn't reach Mattermost").WithSendNotice(true)
+	ErrMattermostRateLimited      error = bridgev2.WrapErrorInStatus(errors.New("rate limited")).WithStatus(event.MessageStatusRetriable).WithErrorReason(event.MessageStatusNetworkError).WithMessage("Mattermost is rate limiting the bridge").WithSendNotice(true)
+	ErrGhostUnavailable           error = bridgev2.WrapErrorInStatus(errors.New("failed to get Mattermost account for sender")).WithStatus(event.MessageStatusRetriable).WithErrorReason(event.MessageStatusGenericError).WithMessage("the bridge couldn't set up your Mattermost account").WithSendNotice(true)
+	ErrDirectionDisabled          error = bridgev2.WrapErrorInStatus(errors.New("not bridging to Mattermost in this room")).WithStatus(event.MessageStatusFail).WithErrorReason(event.MessageStatusNoPermission).WithMessage("messages aren't bridged to Mattermost in this room").WithIsCertain(true).WithSendNotice(true)
+	ErrRelayDisabled              error = bridgev2.WrapErrorInStatus(errors.New("relaying disabled in this room")).WithStatus(event.MessageStatusFail).WithErrorReason(event.MessageStatusNoPermission).WithMessage("messages aren't relayed in this room, log in to send messages").WithIsCertain(true).WithSendNotice(true)
+
+	// ErrQueuedForRetry is returned when a post failed with a transient error and was added
+	// to the retry queue. The final status is sent by the queue.
+	ErrQueuedForRetry error = bridgev2.WrapErrorInStatus(errors.New("queued for retry")).WithStatus(event.MessageStatusPending).WithErrorReason(event.MessageStatusNetworkError).WithMessage("failed to send message to Mattermost, it will be retried").WithSendNotice(false)
+)
+
+// wrapMattermostError attaches a message status to an error from the Mattermost API,
+// based on the HTTP status code of the response.
+func wrapMattermostError(resp *model.Response, err error) error {
+	if err == nil {
+		return nil
+	}
+	var statusErr error
+	switch statusCode := responseStatusCode(resp, err); {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		statusErr = ErrMattermostUnavailable
+	case statusCode == 0, statusCode >= 500, statusCode == http.StatusRequestTimeout:
+		statusErr = ErrMattermostUnavailable
+	case statusCode == http.StatusTooManyRequests:
+		statusErr = ErrMattermostRateLimited
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden:
+		statusErr = ErrMattermostPermissionDenied
+	case statusCode == http.StatusNotFound:
+		statusErr = ErrMattermostTargetNotFound
+	case statusCode == http.StatusRequestEntityTooLarge:
+		statusErr = ErrMattermostTooLarge
+	default:
+		statusErr = ErrMattermostRejected
+	}
+	return fmt.Errorf("%w: %w", statusErr, err)
+}
+
+// responseStatusCode finds the HTTP status code of a failed Mattermost API call.
+// It returns 0 if the request never got a response.
+func responseStatusCode(resp *model.Response, err error) int {
+	if resp != nil && resp.StatusCode != 0 {
+		return resp.StatusCode
+	}
+	var appErr *model.AppError
+	if errors.As(err, &appErr) {
+		return appErr.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package mattermost
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestWrapMattermostError(t *testing.T) {
+	apiErr := errors.New("api error")
+	tests := []struct {
+		name     string
+		resp     *model.Response
+		err      error
+		expected error
+		status   event.MessageStatus
+		reason   event.MessageStatusReason
+	}{
+		{"network error", nil, apiErr, ErrMattermostUnavailable, event.MessageStatusRetriable, event.MessageStatusNetworkError},
+		{"server error", &model.Response{StatusCode: http.StatusInternalServerError}, apiErr, ErrMattermostUnavailable, event.MessageStatusRetriable, event.MessageStatusNetworkError},
+		{"rate limited", &model.Response{StatusCode: http.StatusTooManyRequests}, apiErr, ErrMattermostRateLimited, event.MessageStatusRetriable, event.MessageStatusNetworkError},
+		{"forbidden", &model.Response{StatusCode: http.StatusForbidden}, apiErr, ErrMattermostPermissionDenied, event.MessageStatusFail, event.MessageStatusNoPermission},
+		{"not found", &model.Response{StatusCode: http.StatusNotFound}, apiErr, ErrMattermostTargetNotFound, event.MessageStatusFail, event.MessageStatusGenericError},
+		{"too large", &model.Response{StatusCode: http.StatusRequestEntityTooLarge}, apiErr, ErrMattermostTooLarge, event.MessageStatusFail, event.MessageStatusUnsupported},
+		{"bad request", &model.Response{StatusCode: http.StatusBadRequest}, apiErr, ErrMattermostRejected, event.MessageStatusFail, event.MessageStatusGenericError},
+		{"app error without response", nil, model.NewAppError("CreatePost", "id", nil, "", http.StatusForbidden), ErrMattermostPermissionDenied, event.MessageStatusFail, event.MessageStatusNoPermission},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := wrapMattermostError(tt.resp, tt.err)
+			assert.ErrorIs(t, err, tt.err)
+
+			// MessageStatus isn't comparable, so errors.Is can't be used to check which status was attached
+			status := bridgev2.WrapErrorInStatus(err)
+			assert.Equal(t, bridgev2.WrapErrorInStatus(tt.expected).Message, status.Message)
+			assert.Equal(t, tt.status, status.Status)
+			assert.Equal(t, tt.reason, status.ErrorReason)
+			assert.True(t, status.SendNotice)
+		})
+	}
+
+	assert.NoError(t, wrapMattermostError(nil, nil))
+}
+
+func TestQueuedForRetryStatus(t *testing.T) {
+	status := bridgev2.WrapErrorInStatus(errors.Join(ErrQueuedForRetry, errors.New("timeout")))
+	assert.Equal(t, event.MessageStatusPending, status.Status)
+	assert.False(t, status.SendNotice)
+}
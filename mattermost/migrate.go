@@ -0,0 +1,48 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+)
+
+// MigrateDB creates or upgrades the bridge's own database tables. It's run on startup,
+// and by the migrate-db command to upgrade the database before starting a new version.
+func (m *MattermostConnector) MigrateDB(ctx context.Context) error {
+	m.MatrixUsers = NewMatrixUserStore(m.Bridge.ID, m.Bridge.DB.Database)
+	if err := m.MatrixUsers.Upgrade(ctx); err != nil {
+		return fmt.Errorf("failed to upgrade Matrix user database: %w", err)
+	}
+	m.LastPosts = NewLastPostStore(m.Bridge.ID, m.Bridge.DB.Database)
+	if err := m.LastPosts.Upgrade(ctx); err != nil {
+		return fmt.Errorf("failed to upgrade last post database: %w", err)
+	}
+	m.ReactionEchoes = NewReactionEchoStore(m.Bridge.ID, m.Bridge.DB.Database)
+	if err := m.ReactionEchoes.Upgrade(ctx); err != nil {
+		return fmt.Errorf("failed to upgrade bridged reaction database: %w", err)
+	}
+	m.PendingKnocks = NewPendingKnockStore(m.Bridge.ID, m.Bridge.DB.Database)
+	if err := m.PendingKnocks.Upgrade(ctx); err != nil {
+		return fmt.Errorf("failed to upgrade pending knock database: %w", err)
+	}
+	m.ScheduledPosts = NewScheduledPostStore(m.Bridge.ID, m.Bridge.DB.Database)
+	if err := m.ScheduledPosts.Upgrade(ctx); err != nil {
+		return fmt.Errorf("failed to upgrade scheduled post database: %w", err)
+	}
+	m.SharedChannels = NewSharedChannelStore(m.Bridge.ID, m.Bridge.DB.Database)
+	if err := m.SharedChannels.Upgrade(ctx); err != nil {
+		return fmt.Errorf("failed to upgrade shared channel database: %w", err)
+	}
+	if m.config().Stats.Enabled {
+		m.Stats = NewStatsStore(m.Bridge.ID, m.Bridge.DB.Database)
+		if err := m.Stats.Upgrade(ctx); err != nil {
+			return fmt.Errorf("failed to upgrade stats database: %w", err)
+		}
+	}
+	if m.config().RetryQueue.Enabled {
+		queue := NewRetryQueue(m, m.Bridge.DB.Database, m.config().RetryQueue)
+		if err := queue.db.Upgrade(ctx); err != nil {
+			return fmt.Errorf("failed to upgrade retry queue database: %w", err)
+		}
+	}
+	return nil
+}
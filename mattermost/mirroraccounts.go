@@ -0,0 +1,167 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+)
+
+// errNoSSOIdentity is returned when an account should be linked to the SSO identity of a
+// Mattermost user who doesn't log in with SSO
+var errNoSSOIdentity = errors.New("the Mattermost user doesn't log in with SSO")
+
+// ssoAccounts checks whether Matrix accounts are mapped by SSO identity instead of being
+// created with passwords
+func (m *MattermostConnector) ssoAccounts() bool {
+	return m.config().Mirror.SSOAccounts && !m.usesGhostAccounts()
+}
+
+// ssoIdentity returns the identity of a Mattermost user at the SSO provider set in
+// external_id_provider, or nil if they don't log in with SSO
+func (m *MattermostConnector) ssoIdentity(mmUser *model.User) *ExternalID {
+	provider := m.config().Mirror.ExternalIDProvider
+	if provider == "" || mmUser.AuthData == nil || *mmUser.AuthData == "" {
+		return nil
+	}
+	return &ExternalID{AuthProvider: provider, ExternalID: *mmUser.AuthData}
+}
+
+// resolveMatrixAccount returns the Matrix account of a Mattermost user and whether it
+// exists. With sso_accounts, the account linked to the user's SSO identity or verified
+// email is preferred over the one named after their username.
+func (m *MattermostConnector) resolveMatrixAccount(ctx context.Context, admin HomeserverAdmin, mmUser *model.User) (id.UserID, bool, error) {
+	if m.ssoAccounts() {
+		var email string
+		if mmUser.EmailVerified {
+			email = mmUser.Email
+		}
+		if mxid, err := admin.FindUser(ctx, email, m.ssoIdentity(mmUser)); err != nil {
+			return "", false, err
+		} else if mxid != "" {
+			return mxid, true, nil
+		}
+	}
+	mxid := m.matrixAccountID(mmUser)
+	exists, err := admin.UserExists(ctx, mxid)
+	return mxid, exists, err
+}
+
+// createMatrixAccount creates the Matrix account of a Mattermost user and returns its
+// password. With sso_accounts the account has no password and is linked to the user's
+// SSO identity instead.
+func (m *MattermostConnector) createMatrixAccount(ctx context.Context, admin HomeserverAdmin, mxid id.UserID, mmUser *model.User) (string, error) {
+	update := m.matrixAccountUpdate(ctx, mmUser)
+	var password string
+	if m.ssoAccounts() {
+		if update.ExternalID == nil {
+			return "", errNoSSOIdentity
+		}
+	} else {
+		var err error
+		if password, err = GeneratePassword(m.config().PasswordPolicy); err != nil {
+			return "", fmt.Errorf("failed to generate password: %w", err)
+		}
+	}
+	if err := admin.CreateUser(ctx, mxid, password, update.DisplayName); err != nil {
+		return "", err
+	}
+	// The account exists at this point, so a failure here shouldn't fail the creation. The
+	// next sync retries it.
+	if err := admin.UpdateUser(ctx, mxid, update); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("mxid", mxid).Msg("Failed to set avatar, email and SSO link of created Matrix user")
+	}
+	return password, nil
+}
+
+// matrixCredentials formats the login credentials of a Matrix account for its user
+func matrixCredentials(heading string, mxid id.UserID, homeserver, password string) string {
+	return fmt.Sprintf("✅ **%s**\n\n"+
+		"• **Matrix ID**: `%s`\n"+
+		"• **Homeserver**: `%s`\n"+
+		"• **Password**: `%s`\n\n"+
+		"⚠️ **Save this password!** It will not be shown again.\n\n"+
+		"You can log in to any Matrix client (e.g., Element Web, Element Desktop, FluffyChat) using these credentials.",
+		heading, mxid, homeserver, password)
+}
+
+// sendBridgeDM sends a direct message from the bridge's Mattermost account to a user.
+// The post is marked so that it isn't bridged to Matrix.
+func (m *MattermostConnector) sendBridgeDM(ctx context.Context, userID, message string) error {
+	me, _, err := m.Client.GetMe(ctx, "")
+	if err != nil {
+		return fmt.Errorf("failed to get bridge user: %w", err)
+	}
+	channel, err := m.Client.CreateDirectChannelWithBoth(ctx, me.Id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to create direct channel: %w", err)
+	}
+	post := &model.Post{
+		ChannelId: channel.Id,
+		Message:   message,
+	}
+	post.AddProp("from_bridge", true)
+	if _, _, err = m.Client.CreatePost(ctx, post); err != nil {
+		return fmt.Errorf("failed to send direct message: %w", err)
+	}
+	return nil
+}
+
+// matrixAccountUpdate returns the details of a Mattermost user to keep in sync on their
+// Matrix account. The avatar is the one already uploaded for the user's ghost.
+func (m *MattermostConnector) matrixAccountUpdate(ctx context.Context, mmUser *model.User) *UserUpdate {
+	update := &UserUpdate{DisplayName: mmUser.GetDisplayName(model.ShowFullName)}
+	if update.DisplayName == "" {
+		update.DisplayName = mmUser.Username
+	}
+	if ghost, err := m.Bridge.GetExistingGhostByID(ctx, MakeUserID(mmUser.Id)); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("mm_user_id", mmUser.Id).Msg("Failed to get ghost for avatar")
+	} else if ghost != nil {
+		update.AvatarURL = ghost.AvatarMXC
+	}
+	if m.config().Mirror.AccountEmails && mmUser.Email != "" {
+		update.Email = mmUser.Email
+	}
+	update.ExternalID = m.ssoIdentity(mmUser)
+	return update
+}
+
+// syncMatrixAccount brings the existing Matrix account of a Mattermost user up to date,
+// deactivating it if the Mattermost user was deactivated and deactivate_matrix_accounts
+// is enabled
+func (m *MattermostConnector) syncMatrixAccount(ctx context.Context, admin HomeserverAdmin, mxid id.UserID, mmUser *model.User) error {
+	if mmUser.DeleteAt == 0 {
+		return admin.UpdateUser(ctx, mxid, m.matrixAccountUpdate(ctx, mmUser))
+	} else if !m.config().Mirror.DeactivateMatrixAccounts || m.usesGhostAccounts() {
+		return nil
+	}
+	if err := admin.UpdateUser(ctx, mxid, &UserUpdate{Deactivated: true}); err != nil {
+		return fmt.Errorf("failed to deactivate Matrix account: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().Str("mm_user_id", mmUser.Id).Stringer("mxid", mxid).Msg("Deactivated Matrix account of deactivated user")
+	return nil
+}
+
+// handleMirrorUserUpdated updates the Matrix account mirror mode created for a Mattermost
+// user after their profile changed or they were deactivated
+func (m *MattermostConnector) handleMirrorUserUpdated(ctx context.Context, mmUserID string) {
+	if !m.IsMirrorMode() || !m.config().Mirror.CreateMatrixAccounts || m.MatrixAdmin == nil {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Str("mm_user_id", mmUserID).Logger()
+	mmUser, err := m.getUser(ctx, m.Client, mmUserID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get updated user")
+		return
+	}
+	if mxid, exists, err := m.resolveMatrixAccount(ctx, m.MatrixAdmin, mmUser); err != nil {
+		log.Warn().Err(err).Msg("Failed to find Matrix account")
+	} else if !exists {
+		return
+	} else if err = m.syncMatrixAccount(ctx, m.MatrixAdmin, mxid, mmUser); err != nil {
+		log.Warn().Err(err).Stringer("mxid", mxid).Msg("Failed to update Matrix account")
+	}
+}
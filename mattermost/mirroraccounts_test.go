@@ -0,0 +1,117 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestMatrixAccountUpdate(t *testing.T) {
+	m := &MattermostConnector{Config: &NetworkConfig{}, Bridge: &bridgev2.Bridge{DB: newTestBridgeDB(t)}}
+	ctx := context.Background()
+	user := &model.User{Id: "user1", Username: "alice", Email: "alice@example.com", AuthData: model.NewPointer("sub-1")}
+
+	assert.Equal(t, &UserUpdate{DisplayName: "alice"}, m.matrixAccountUpdate(ctx, user))
+
+	m.config().Mirror.AccountEmails = true
+	m.config().Mirror.ExternalIDProvider = "oidc-keycloak"
+	user.FirstName, user.LastName = "Alice", "Liddell"
+	assert.Equal(t, &UserUpdate{
+		DisplayName: "Alice Liddell",
+		Email:       "alice@example.com",
+		ExternalID:  &ExternalID{AuthProvider: "oidc-keycloak", ExternalID: "sub-1"},
+	}, m.matrixAccountUpdate(ctx, user))
+
+	// Users without SSO aren't linked
+	user.AuthData = model.NewPointer("")
+	assert.Nil(t, m.matrixAccountUpdate(ctx, user).ExternalID)
+}
+
+// ssoTestAdmin is a homeserver admin backend that records the accounts created with it
+type ssoTestAdmin struct {
+	HomeserverAdmin
+	found     id.UserID
+	passwords map[id.UserID]string
+	updates   []*UserUpdate
+}
+
+func (a *ssoTestAdmin) FindUser(ctx context.Context, email string, externalID *ExternalID) (id.UserID, error) {
+	return a.found, nil
+}
+
+func (a *ssoTestAdmin) CreateUser(ctx context.Context, userID id.UserID, password, displayName string) error {
+	a.passwords[userID] = password
+	return nil
+}
+
+func (a *ssoTestAdmin) UpdateUser(ctx context.Context, userID id.UserID, update *UserUpdate) error {
+	a.updates = append(a.updates, update)
+	return nil
+}
+
+func TestSSOAccounts(t *testing.T) {
+	admin := &ssoTestAdmin{found: "@alice.liddell:example.com", passwords: make(map[id.UserID]string)}
+	m := &MattermostConnector{
+		Config:      &NetworkConfig{Mirror: MirrorConfig{SSOAccounts: true, ExternalIDProvider: "oidc-keycloak"}},
+		Bridge:      &bridgev2.Bridge{DB: newTestBridgeDB(t)},
+		MatrixAdmin: admin,
+	}
+	ctx := context.Background()
+	user := &model.User{Id: "user1", Username: "alice", AuthData: model.NewPointer("sub-1")}
+
+	// Existing accounts are found by SSO identity
+	mxid, exists, err := m.resolveMatrixAccount(ctx, admin, user)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, id.UserID("@alice.liddell:example.com"), mxid)
+
+	// New accounts get no password, and are linked to the SSO identity
+	password, err := m.createMatrixAccount(ctx, admin, "@alice:example.com", user)
+	require.NoError(t, err)
+	assert.Empty(t, password)
+	assert.Contains(t, admin.passwords, id.UserID("@alice:example.com"))
+	require.Len(t, admin.updates, 1)
+	assert.Equal(t, &ExternalID{AuthProvider: "oidc-keycloak", ExternalID: "sub-1"}, admin.updates[0].ExternalID)
+
+	// Users without SSO don't get accounts
+	_, err = m.createMatrixAccount(ctx, admin, "@bob:example.com", &model.User{Id: "user2", Username: "bob"})
+	assert.ErrorIs(t, err, errNoSSOIdentity)
+	assert.NotContains(t, admin.passwords, id.UserID("@bob:example.com"))
+}
+
+func TestSendBridgeDM(t *testing.T) {
+	var post model.Post
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v4/users/me":
+			_, _ = w.Write([]byte(`{"id":"bridge"}`))
+		case "POST /api/v4/channels/direct":
+			var ids []string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&ids))
+			assert.ElementsMatch(t, []string{"bridge", "user1"}, ids)
+			_, _ = w.Write([]byte(`{"id":"dm1"}`))
+		case "POST /api/v4/posts":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&post))
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"id":"post1"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	m := &MattermostConnector{Client: NewClient(server.URL, "token")}
+	credentials := matrixCredentials("Matrix Account Created!", "@alice:example.com", "example.com", "secret")
+	require.NoError(t, m.sendBridgeDM(context.Background(), "user1", credentials))
+	assert.Equal(t, "dm1", post.ChannelId)
+	assert.Contains(t, post.Message, "`secret`")
+	assert.Equal(t, true, post.GetProp("from_bridge"))
+}
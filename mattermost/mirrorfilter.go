@@ -0,0 +1,186 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// FilterConfig is an allowlist and a denylist of patterns for mirror mode.
+// Patterns are globs (e.g. "dev-*") matched case-insensitively against names and IDs,
+// or regular expressions when prefixed with "re:" (e.g. "re:^team-[0-9]+$").
+type FilterConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// NameFilter is a compiled FilterConfig. A nil filter allows everything.
+type NameFilter struct {
+	allow []func(string) bool
+	deny  []func(string) bool
+}
+
+// NewNameFilter compiles the patterns of a FilterConfig
+func NewNameFilter(cfg FilterConfig) (*NameFilter, error) {
+	if len(cfg.Allow) == 0 && len(cfg.Deny) == 0 {
+		return nil, nil
+	}
+	var f NameFilter
+	var err error
+	if f.allow, err = compilePatterns(cfg.Allow); err != nil {
+		return nil, fmt.Errorf("invalid allow pattern: %w", err)
+	}
+	if f.deny, err = compilePatterns(cfg.Deny); err != nil {
+		return nil, fmt.Errorf("invalid deny pattern: %w", err)
+	}
+	return &f, nil
+}
+
+func compilePatterns(patterns []string) ([]func(string) bool, error) {
+	matchers := make([]func(string) bool, 0, len(patterns))
+	for _, pattern := range patterns {
+		if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, re.MatchString)
+			continue
+		}
+		glob := strings.ToLower(pattern)
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("%q: %w", pattern, err)
+		}
+		matchers = append(matchers, func(value string) bool {
+			matched, _ := path.Match(glob, strings.ToLower(value))
+			return matched
+		})
+	}
+	return matchers, nil
+}
+
+// Allowed returns true if any of the values (e.g. a name and an ID) matches the allowlist,
+// or the allowlist is empty, and none of the values match the denylist.
+func (f *NameFilter) Allowed(values ...string) bool {
+	if f == nil {
+		return true
+	}
+	return (len(f.allow) == 0 || matchAny(f.allow, values)) && !matchAny(f.deny, values)
+}
+
+func matchAny(matchers []func(string) bool, values []string) bool {
+	for _, match := range matchers {
+		for _, value := range values {
+			if value != "" && match(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MirrorFilters are the compiled team, channel and user filters of MirrorConfig
+type MirrorFilters struct {
+	Teams    *NameFilter
+	Channels *NameFilter
+	Users    *NameFilter
+}
+
+// NewMirrorFilters compiles the filters in the mirror config
+func NewMirrorFilters(cfg MirrorConfig) (*MirrorFilters, error) {
+	var filters MirrorFilters
+	var err error
+	if filters.Teams, err = NewNameFilter(cfg.Teams); err != nil {
+		return nil, fmt.Errorf("mirror.teams: %w", err)
+	}
+	if filters.Channels, err = NewNameFilter(cfg.Channels); err != nil {
+		return nil, fmt.Errorf("mirror.channels: %w", err)
+	}
+	if filters.Users, err = NewNameFilter(cfg.Users); err != nil {
+		return nil, fmt.Errorf("mirror.users: %w", err)
+	}
+	return &filters, nil
+}
+
+// TeamAllowed checks a team against the team filter
+func (f *MirrorFilters) TeamAllowed(team *model.Team) bool {
+	return f == nil || f.Teams.Allowed(team.Name, team.DisplayName, team.Id)
+}
+
+// ChannelAllowed checks a channel against the channel filter
+func (f *MirrorFilters) ChannelAllowed(channel *model.Channel) bool {
+	return f == nil || f.Channels.Allowed(channel.Name, channel.DisplayName, channel.Id)
+}
+
+// UserAllowed checks a user against the user filter
+func (f *MirrorFilters) UserAllowed(user *model.User) bool {
+	return f == nil || f.Users.Allowed(user.Username, user.Id)
+}
+
+// isChannelMirrored checks if events from a channel should be bridged in mirror mode.
+// Direct and group messages aren't affected by the filters. Results are cached, as
+// this is checked for every websocket event.
+func (m *MattermostConnector) isChannelMirrored(ctx context.Context, channelID string) bool {
+	filters := m.mirrorFilters()
+	if filters == nil || !m.IsMirrorMode() || channelID == "" {
+		return true
+	}
+	m.filterCacheLock.RLock()
+	allowed, ok := m.channelFilterCache[channelID]
+	m.filterCacheLock.RUnlock()
+	if ok {
+		return allowed
+	}
+
+	log := m.moduleLog(LogModuleWebSocket)
+	channel, _, err := m.Client.GetChannel(ctx, channelID, "")
+	if err != nil {
+		// Don't drop messages because of a temporary error, and don't cache the result
+		log.Warn().Err(err).Str("channel_id", channelID).Msg("Failed to get channel for mirror filter")
+		return true
+	}
+	allowed = true
+	if channel.Type != model.ChannelTypeDirect && channel.Type != model.ChannelTypeGroup {
+		allowed = filters.ChannelAllowed(channel)
+		if allowed && channel.TeamId != "" {
+			team, err := m.Client.GetTeam(ctx, channel.TeamId)
+			if err != nil {
+				log.Warn().Err(err).Str("team_id", channel.TeamId).Msg("Failed to get team for mirror filter")
+				return true
+			}
+			allowed = filters.TeamAllowed(team)
+		}
+	}
+
+	m.filterCacheLock.Lock()
+	// Don't cache a result of filters that a reload replaced in the meantime
+	if m.mirrorFilters() == filters {
+		if m.channelFilterCache == nil {
+			m.channelFilterCache = make(map[string]bool)
+		}
+		m.channelFilterCache[channelID] = allowed
+	}
+	m.filterCacheLock.Unlock()
+	return allowed
+}
+
+// forgetChannelFilter drops the cached mirror filter result of a channel, e.g. because it
+// was renamed or moved to another team
+func (m *MattermostConnector) forgetChannelFilter(channelID string) {
+	m.filterCacheLock.Lock()
+	delete(m.channelFilterCache, channelID)
+	m.filterCacheLock.Unlock()
+}
+
+// isUserMirrored checks if events from a user should be bridged in mirror mode
+func (m *MattermostConnector) isUserMirrored(ctx context.Context, userID string) bool {
+	filters := m.mirrorFilters()
+	if filters == nil || filters.Users == nil || !m.IsMirrorMode() || userID == "" {
+		return true
+	}
+	return filters.Users.Allowed(m.GetUsername(ctx, userID), userID)
+}
@@ -0,0 +1,84 @@
+package mattermost
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameFilter_Allowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      FilterConfig
+		values   []string
+		expected bool
+	}{
+		{"empty filter", FilterConfig{}, []string{"town-square"}, true},
+		{"glob allow match", FilterConfig{Allow: []string{"dev-*"}}, []string{"dev-backend"}, true},
+		{"glob allow no match", FilterConfig{Allow: []string{"dev-*"}}, []string{"sales"}, false},
+		{"glob is case-insensitive", FilterConfig{Allow: []string{"Dev-*"}}, []string{"DEV-ops"}, true},
+		{"deny wins over allow", FilterConfig{Allow: []string{"dev-*"}, Deny: []string{"dev-secret"}}, []string{"dev-secret"}, false},
+		{"deny only", FilterConfig{Deny: []string{"off-topic"}}, []string{"town-square"}, true},
+		{"regex", FilterConfig{Allow: []string{"re:^team-[0-9]+$"}}, []string{"team-42"}, true},
+		{"regex no match", FilterConfig{Allow: []string{"re:^team-[0-9]+$"}}, []string{"team-x"}, false},
+		{"matches any value", FilterConfig{Allow: []string{"abc123"}}, []string{"general", "abc123"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewNameFilter(tt.cfg)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, filter.Allowed(tt.values...))
+		})
+	}
+}
+
+func TestNewMirrorFilters_InvalidPattern(t *testing.T) {
+	_, err := NewMirrorFilters(MirrorConfig{Channels: FilterConfig{Deny: []string{"re:("}}})
+	assert.ErrorContains(t, err, "mirror.channels")
+
+	_, err = NewMirrorFilters(MirrorConfig{Teams: FilterConfig{Allow: []string{"[a-"}}})
+	assert.ErrorContains(t, err, "mirror.teams")
+}
+
+func TestMirrorFilters_NilAllowsEverything(t *testing.T) {
+	var filters *MirrorFilters
+	assert.True(t, filters.TeamAllowed(&model.Team{Name: "team"}))
+	assert.True(t, filters.ChannelAllowed(&model.Channel{Name: "channel"}))
+	assert.True(t, filters.UserAllowed(&model.User{Username: "user"}))
+
+	filters, err := NewMirrorFilters(MirrorConfig{Users: FilterConfig{Deny: []string{"bot-*"}}})
+	require.NoError(t, err)
+	assert.True(t, filters.TeamAllowed(&model.Team{Name: "team"}))
+	assert.False(t, filters.UserAllowed(&model.User{Username: "bot-ci"}))
+}
+
+func TestIsChannelMirrored_ChannelRenamed(t *testing.T) {
+	connector, server, queued := newTestEventConnector(t)
+	connector.Config.Mode = ModeMirror
+	mirrorFilters, err := NewMirrorFilters(MirrorConfig{Channels: FilterConfig{Deny: []string{"off-topic"}}})
+	require.NoError(t, err)
+	connector.live.Store(&liveConfig{Config: connector.Config, MirrorFilters: mirrorFilters})
+
+	bob := &model.User{Username: "bob"}
+	server.AddUser(bob)
+	channel := server.AddChannel(&model.Channel{Name: "general"}, bob.Id)
+	post := server.CreatePost(&model.Post{ChannelId: channel.Id, UserId: bob.Id, Message: "hello"})
+	postJSON, err := json.Marshal(post)
+	require.NoError(t, err)
+	postEvent := model.NewWebSocketEvent(model.WebsocketEventPosted, "", channel.Id, "", nil, "").
+		SetData(map[string]any{"post": string(postJSON)})
+
+	connector.HandleWebSocketEvent(postEvent)
+	require.Len(t, *queued, 1)
+
+	channel.Name = "off-topic"
+	channelJSON, err := json.Marshal(channel)
+	require.NoError(t, err)
+	connector.HandleWebSocketEvent(model.NewWebSocketEvent(model.WebsocketEventChannelUpdated, "", channel.Id, "", nil, "").
+		SetData(map[string]any{"channel": string(channelJSON)}))
+	connector.HandleWebSocketEvent(postEvent)
+	assert.Len(t, *queued, 1, "events of a channel renamed into a denied name shouldn't be bridged")
+}
@@ -0,0 +1,504 @@
+package mmtest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// handler is an API handler called with the lock held and the ID of the authenticated user
+type handler func(w http.ResponseWriter, r *http.Request, userID string)
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(pattern string, fn handler) {
+		mux.HandleFunc(pattern, s.authenticated(fn))
+	}
+	mux.HandleFunc("GET /api/v4/system/ping", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": model.StatusOk})
+	})
+	mux.HandleFunc("GET /api/v4/websocket", s.serveWebSocket)
+
+	handle("GET /api/v4/users/me", s.getMe)
+	handle("GET /api/v4/users", s.getUsers)
+	handle("POST /api/v4/users", s.createUser)
+	handle("POST /api/v4/users/ids", s.getUsersByIDs)
+	handle("GET /api/v4/users/{user_id}", s.getUser)
+	handle("GET /api/v4/users/username/{username}", s.getUserByUsername)
+	handle("PUT /api/v4/users/{user_id}/patch", s.patchUser)
+	handle("POST /api/v4/users/{user_id}/tokens", s.createUserAccessToken)
+
+	handle("GET /api/v4/teams", s.getTeams)
+	handle("POST /api/v4/teams", s.createTeam)
+	handle("GET /api/v4/teams/{team_id}", s.getTeam)
+	handle("GET /api/v4/teams/{team_id}/members", s.getTeamMembers)
+	handle("POST /api/v4/teams/{team_id}/members", s.addTeamMember)
+	handle("GET /api/v4/teams/{team_id}/channels", s.getTeamChannels(model.ChannelTypeOpen))
+	handle("GET /api/v4/teams/{team_id}/channels/private", s.getTeamChannels(model.ChannelTypePrivate))
+
+	handle("POST /api/v4/channels", s.createChannel)
+	handle("GET /api/v4/channels/{channel_id}", s.getChannel)
+	handle("GET /api/v4/channels/{channel_id}/members", s.getChannelMembers)
+	handle("POST /api/v4/channels/{channel_id}/members", s.addChannelMemberHandler)
+	handle("GET /api/v4/channels/{channel_id}/members/{user_id}", s.getChannelMember)
+	handle("DELETE /api/v4/channels/{channel_id}/members/{user_id}", s.removeChannelMember)
+	handle("GET /api/v4/channels/{channel_id}/posts", s.getChannelPosts)
+
+	handle("POST /api/v4/posts", s.createPostHandler)
+	handle("GET /api/v4/posts/{post_id}", s.getPost)
+	handle("PUT /api/v4/posts/{post_id}/patch", s.patchPost)
+	handle("DELETE /api/v4/posts/{post_id}", s.deletePost)
+	handle("GET /api/v4/posts/{post_id}/reactions", s.getReactions)
+	handle("POST /api/v4/reactions", s.saveReaction)
+	handle("DELETE /api/v4/users/{user_id}/posts/{post_id}/reactions/{emoji_name}", s.deleteReaction)
+
+	handle("POST /api/v4/files", s.uploadFile)
+	handle("GET /api/v4/files/{file_id}", s.getFile)
+	handle("GET /api/v4/files/{file_id}/info", s.getFileInfo)
+	return mux
+}
+
+// authenticated checks the token of a request before calling a handler
+func (s *Server) authenticated(fn handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get(model.HeaderAuth), model.HeaderBearer+" ")
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		userID, ok := s.tokens[token]
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "invalid or expired session")
+			return
+		}
+		fn(w, r, userID)
+	}
+}
+
+// readJSON decodes a request body, writing an error if it's invalid
+func readJSON(w http.ResponseWriter, r *http.Request, into any) bool {
+	if err := json.NewDecoder(r.Body).Decode(into); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *Server) getMe(w http.ResponseWriter, r *http.Request, userID string) {
+	writeJSON(w, http.StatusOK, s.users[userID])
+}
+
+func (s *Server) getUsers(w http.ResponseWriter, r *http.Request, userID string) {
+	users := sortedValues(s.users, func(user *model.User) string { return user.Username })
+	if teamID := r.URL.Query().Get("in_team"); teamID != "" {
+		users = slices.DeleteFunc(users, func(user *model.User) bool {
+			return !slices.Contains(s.teamMembers[teamID], user.Id)
+		})
+	}
+	writeJSON(w, http.StatusOK, paginate(r, users))
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request, userID string) {
+	var user model.User
+	if !readJSON(w, r, &user) {
+		return
+	}
+	for _, existing := range s.users {
+		if existing.Username == user.Username {
+			writeError(w, http.StatusBadRequest, "an account with that username already exists")
+			return
+		}
+	}
+	user.Id = ""
+	s.addUser(&user)
+	writeJSON(w, http.StatusCreated, &user)
+}
+
+func (s *Server) getUsersByIDs(w http.ResponseWriter, r *http.Request, userID string) {
+	var ids []string
+	if !readJSON(w, r, &ids) {
+		return
+	}
+	users := make([]*model.User, 0, len(ids))
+	for _, id := range ids {
+		if user, ok := s.users[id]; ok {
+			users = append(users, user)
+		}
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request, userID string) {
+	if user, ok := s.users[r.PathValue("user_id")]; ok {
+		writeJSON(w, http.StatusOK, user)
+	} else {
+		writeError(w, http.StatusNotFound, "user not found")
+	}
+}
+
+func (s *Server) getUserByUsername(w http.ResponseWriter, r *http.Request, userID string) {
+	for _, user := range s.users {
+		if user.Username == r.PathValue("username") {
+			writeJSON(w, http.StatusOK, user)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "user not found")
+}
+
+func (s *Server) patchUser(w http.ResponseWriter, r *http.Request, userID string) {
+	user, ok := s.users[r.PathValue("user_id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	var patch model.UserPatch
+	if !readJSON(w, r, &patch) {
+		return
+	}
+	user.Patch(&patch)
+	user.UpdateAt = model.GetMillis()
+	evt := model.NewWebSocketEvent(model.WebsocketEventUserUpdated, "", "", "", nil, "")
+	evt.Add("user", user)
+	s.broadcast(evt)
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (s *Server) createUserAccessToken(w http.ResponseWriter, r *http.Request, userID string) {
+	targetID := r.PathValue("user_id")
+	if _, ok := s.users[targetID]; !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	var req struct {
+		Description string `json:"description"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	writeJSON(w, http.StatusOK, &model.UserAccessToken{
+		Id:          model.NewId(),
+		Token:       s.newToken(targetID),
+		UserId:      targetID,
+		Description: req.Description,
+		IsActive:    true,
+	})
+}
+
+func (s *Server) getTeams(w http.ResponseWriter, r *http.Request, userID string) {
+	writeJSON(w, http.StatusOK, paginate(r, sortedValues(s.teams, func(team *model.Team) string { return team.Name })))
+}
+
+func (s *Server) createTeam(w http.ResponseWriter, r *http.Request, userID string) {
+	var team model.Team
+	if !readJSON(w, r, &team) {
+		return
+	}
+	team.Id = ""
+	s.addTeam(&team)
+	s.teamMembers[team.Id] = append(s.teamMembers[team.Id], userID)
+	writeJSON(w, http.StatusCreated, &team)
+}
+
+func (s *Server) getTeam(w http.ResponseWriter, r *http.Request, userID string) {
+	if team, ok := s.teams[r.PathValue("team_id")]; ok {
+		writeJSON(w, http.StatusOK, team)
+	} else {
+		writeError(w, http.StatusNotFound, "team not found")
+	}
+}
+
+func (s *Server) getTeamMembers(w http.ResponseWriter, r *http.Request, userID string) {
+	teamID := r.PathValue("team_id")
+	members := make([]*model.TeamMember, 0, len(s.teamMembers[teamID]))
+	for _, memberID := range s.teamMembers[teamID] {
+		members = append(members, &model.TeamMember{TeamId: teamID, UserId: memberID, Roles: model.TeamUserRoleId})
+	}
+	writeJSON(w, http.StatusOK, paginate(r, members))
+}
+
+func (s *Server) addTeamMember(w http.ResponseWriter, r *http.Request, userID string) {
+	teamID := r.PathValue("team_id")
+	var member model.TeamMember
+	if !readJSON(w, r, &member) {
+		return
+	} else if _, ok := s.teams[teamID]; !ok {
+		writeError(w, http.StatusNotFound, "team not found")
+		return
+	}
+	if !slices.Contains(s.teamMembers[teamID], member.UserId) {
+		s.teamMembers[teamID] = append(s.teamMembers[teamID], member.UserId)
+	}
+	member.TeamId = teamID
+	writeJSON(w, http.StatusCreated, &member)
+}
+
+func (s *Server) getTeamChannels(channelType model.ChannelType) handler {
+	return func(w http.ResponseWriter, r *http.Request, userID string) {
+		var channels []*model.Channel
+		for _, channel := range sortedValues(s.channels, func(channel *model.Channel) string { return channel.Name }) {
+			if channel.TeamId == r.PathValue("team_id") && channel.Type == channelType && channel.DeleteAt == 0 {
+				channels = append(channels, channel)
+			}
+		}
+		writeJSON(w, http.StatusOK, paginate(r, channels))
+	}
+}
+
+func (s *Server) createChannel(w http.ResponseWriter, r *http.Request, userID string) {
+	var channel model.Channel
+	if !readJSON(w, r, &channel) {
+		return
+	}
+	channel.Id = ""
+	channel.CreatorId = userID
+	s.addChannel(&channel)
+	s.addChannelMember(channel.Id, userID)
+	writeJSON(w, http.StatusCreated, &channel)
+}
+
+func (s *Server) getChannel(w http.ResponseWriter, r *http.Request, userID string) {
+	if channel, ok := s.channels[r.PathValue("channel_id")]; ok {
+		writeJSON(w, http.StatusOK, channel)
+	} else {
+		writeError(w, http.StatusNotFound, "channel not found")
+	}
+}
+
+func (s *Server) getChannelMembers(w http.ResponseWriter, r *http.Request, userID string) {
+	channelID := r.PathValue("channel_id")
+	members := make(model.ChannelMembers, 0, len(s.channelMembers[channelID]))
+	for _, memberID := range s.channelMembers[channelID] {
+		members = append(members, model.ChannelMember{ChannelId: channelID, UserId: memberID, Roles: model.ChannelUserRoleId})
+	}
+	writeJSON(w, http.StatusOK, paginate(r, members))
+}
+
+func (s *Server) getChannelMember(w http.ResponseWriter, r *http.Request, userID string) {
+	channelID, memberID := r.PathValue("channel_id"), r.PathValue("user_id")
+	if !slices.Contains(s.channelMembers[channelID], memberID) {
+		writeError(w, http.StatusNotFound, "channel member not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, &model.ChannelMember{ChannelId: channelID, UserId: memberID, Roles: model.ChannelUserRoleId})
+}
+
+func (s *Server) addChannelMemberHandler(w http.ResponseWriter, r *http.Request, userID string) {
+	channelID := r.PathValue("channel_id")
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	} else if _, ok := s.channels[channelID]; !ok {
+		writeError(w, http.StatusNotFound, "channel not found")
+		return
+	} else if _, ok = s.users[req.UserID]; !ok {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	s.addChannelMember(channelID, req.UserID)
+	evt := s.channelEvent(model.WebsocketEventUserAdded, channelID)
+	evt.Add("user_id", req.UserID)
+	s.broadcast(evt)
+	writeJSON(w, http.StatusCreated, &model.ChannelMember{ChannelId: channelID, UserId: req.UserID, Roles: model.ChannelUserRoleId})
+}
+
+func (s *Server) removeChannelMember(w http.ResponseWriter, r *http.Request, userID string) {
+	channelID := r.PathValue("channel_id")
+	s.channelMembers[channelID] = slices.DeleteFunc(s.channelMembers[channelID], func(memberID string) bool {
+		return memberID == r.PathValue("user_id")
+	})
+	evt := s.channelEvent(model.WebsocketEventUserRemoved, channelID)
+	evt.Add("user_id", r.PathValue("user_id"))
+	s.broadcast(evt)
+	writeJSON(w, http.StatusOK, map[string]string{"status": model.StatusOk})
+}
+
+func (s *Server) getChannelPosts(w http.ResponseWriter, r *http.Request, userID string) {
+	channelID := r.PathValue("channel_id")
+	var posts []*model.Post
+	for _, post := range s.posts {
+		if post.ChannelId == channelID && post.DeleteAt == 0 {
+			posts = append(posts, post)
+		}
+	}
+	// Newest first, like Mattermost
+	slices.SortFunc(posts, func(a, b *model.Post) int {
+		return int(b.CreateAt - a.CreateAt)
+	})
+	list := model.NewPostList()
+	for _, post := range paginate(r, posts) {
+		list.AddPost(post)
+		list.AddOrder(post.Id)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) createPostHandler(w http.ResponseWriter, r *http.Request, userID string) {
+	var post model.Post
+	if !readJSON(w, r, &post) {
+		return
+	} else if _, ok := s.channels[post.ChannelId]; !ok {
+		writeError(w, http.StatusNotFound, "channel not found")
+		return
+	}
+	post.Id = ""
+	post.UserId = userID
+	writeJSON(w, http.StatusCreated, s.createPost(&post))
+}
+
+func (s *Server) getPost(w http.ResponseWriter, r *http.Request, userID string) {
+	if post, ok := s.posts[r.PathValue("post_id")]; ok && post.DeleteAt == 0 {
+		writeJSON(w, http.StatusOK, post)
+	} else {
+		writeError(w, http.StatusNotFound, "post not found")
+	}
+}
+
+func (s *Server) patchPost(w http.ResponseWriter, r *http.Request, userID string) {
+	post, ok := s.posts[r.PathValue("post_id")]
+	if !ok || post.DeleteAt != 0 {
+		writeError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	var patch model.PostPatch
+	if !readJSON(w, r, &patch) {
+		return
+	}
+	post.Patch(&patch)
+	post.EditAt = model.GetMillis()
+	post.UpdateAt = post.EditAt
+	evt := s.channelEvent(model.WebsocketEventPostEdited, post.ChannelId)
+	evt.Add("post", postJSON(post))
+	s.broadcast(evt)
+	writeJSON(w, http.StatusOK, post)
+}
+
+func (s *Server) deletePost(w http.ResponseWriter, r *http.Request, userID string) {
+	post, ok := s.posts[r.PathValue("post_id")]
+	if !ok || post.DeleteAt != 0 {
+		writeError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	post.DeleteAt = model.GetMillis()
+	post.UpdateAt = post.DeleteAt
+	evt := s.channelEvent(model.WebsocketEventPostDeleted, post.ChannelId)
+	evt.Add("post", postJSON(post))
+	s.broadcast(evt)
+	writeJSON(w, http.StatusOK, map[string]string{"status": model.StatusOk})
+}
+
+func (s *Server) getReactions(w http.ResponseWriter, r *http.Request, userID string) {
+	reactions := s.reactions[r.PathValue("post_id")]
+	if reactions == nil {
+		reactions = []*model.Reaction{}
+	}
+	writeJSON(w, http.StatusOK, reactions)
+}
+
+func (s *Server) saveReaction(w http.ResponseWriter, r *http.Request, userID string) {
+	var reaction model.Reaction
+	if !readJSON(w, r, &reaction) {
+		return
+	}
+	post, ok := s.posts[reaction.PostId]
+	if !ok {
+		writeError(w, http.StatusNotFound, "post not found")
+		return
+	}
+	reaction.UserId = userID
+	reaction.ChannelId = post.ChannelId
+	reaction.CreateAt = model.GetMillis()
+	for _, existing := range s.reactions[post.Id] {
+		if existing.UserId == userID && existing.EmojiName == reaction.EmojiName {
+			writeJSON(w, http.StatusOK, existing)
+			return
+		}
+	}
+	s.reactions[post.Id] = append(s.reactions[post.Id], &reaction)
+	post.HasReactions = true
+	s.broadcastReaction(model.WebsocketEventReactionAdded, &reaction)
+	writeJSON(w, http.StatusOK, &reaction)
+}
+
+func (s *Server) deleteReaction(w http.ResponseWriter, r *http.Request, userID string) {
+	postID := r.PathValue("post_id")
+	index := slices.IndexFunc(s.reactions[postID], func(reaction *model.Reaction) bool {
+		return reaction.UserId == r.PathValue("user_id") && reaction.EmojiName == r.PathValue("emoji_name")
+	})
+	if index < 0 {
+		writeError(w, http.StatusNotFound, "reaction not found")
+		return
+	}
+	reaction := s.reactions[postID][index]
+	s.reactions[postID] = slices.Delete(s.reactions[postID], index, index+1)
+	s.broadcastReaction(model.WebsocketEventReactionRemoved, reaction)
+	writeJSON(w, http.StatusOK, map[string]string{"status": model.StatusOk})
+}
+
+// broadcastReaction sends a reaction event, which has the reaction encoded as a string
+// like the post of post events
+func (s *Server) broadcastReaction(eventType model.WebsocketEventType, reaction *model.Reaction) {
+	data, _ := json.Marshal(reaction)
+	evt := s.channelEvent(eventType, reaction.ChannelId)
+	evt.Add("reaction", string(data))
+	s.broadcast(evt)
+}
+
+func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request, userID string) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid upload: "+err.Error())
+		return
+	}
+	channelID := r.FormValue("channel_id")
+	resp := &model.FileUploadResponse{}
+	for _, header := range r.MultipartForm.File["files"] {
+		file, err := header.Open()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid upload: "+err.Error())
+			return
+		}
+		data, err := io.ReadAll(file)
+		_ = file.Close()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid upload: "+err.Error())
+			return
+		}
+		info := &model.FileInfo{
+			Id:        model.NewId(),
+			CreatorId: userID,
+			ChannelId: channelID,
+			CreateAt:  model.GetMillis(),
+			Name:      header.Filename,
+			Extension: strings.TrimPrefix(filepath.Ext(header.Filename), "."),
+			Size:      int64(len(data)),
+			MimeType:  http.DetectContentType(data),
+		}
+		s.files[info.Id] = info
+		s.fileData[info.Id] = data
+		resp.FileInfos = append(resp.FileInfos, info)
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+func (s *Server) getFile(w http.ResponseWriter, r *http.Request, userID string) {
+	info, ok := s.files[r.PathValue("file_id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	w.Header().Set("Content-Type", info.MimeType)
+	_, _ = w.Write(s.fileData[info.Id])
+}
+
+func (s *Server) getFileInfo(w http.ResponseWriter, r *http.Request, userID string) {
+	if info, ok := s.files[r.PathValue("file_id")]; ok {
+		writeJSON(w, http.StatusOK, info)
+	} else {
+		writeError(w, http.StatusNotFound, "file not found")
+	}
+}
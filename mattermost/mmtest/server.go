@@ -0,0 +1,330 @@
+// Package mmtest is a fake Mattermost server for unit tests. It keeps users, teams,
+// channels, posts, reactions and files in memory, serves the parts of the REST API that
+// the bridge uses and sends WebSocket events for changes, so tests can use a real client
+// instead of mocking it or starting a Mattermost container.
+//
+// Requests are authenticated with the tokens returned by AddUser and CreateUserAccessToken,
+// but permissions aren't checked: every user can do what a system admin can.
+package mmtest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// Server is a running fake Mattermost server
+type Server struct {
+	*httptest.Server
+	// Admin is a system admin created with the server
+	Admin *model.User
+	// AdminToken is the token of Admin
+	AdminToken string
+
+	lock           sync.Mutex
+	users          map[string]*model.User
+	tokens         map[string]string
+	teams          map[string]*model.Team
+	teamMembers    map[string][]string
+	channels       map[string]*model.Channel
+	channelMembers map[string][]string
+	posts          map[string]*model.Post
+	reactions      map[string][]*model.Reaction
+	files          map[string]*model.FileInfo
+	fileData       map[string][]byte
+	sockets        map[*socket]struct{}
+	// lastPostAt keeps the creation times of posts unique, so that they sort like they
+	// were created
+	lastPostAt int64
+}
+
+// NewServer starts a fake server with a system admin. It's closed when the test ends.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		users:          make(map[string]*model.User),
+		tokens:         make(map[string]string),
+		teams:          make(map[string]*model.Team),
+		teamMembers:    make(map[string][]string),
+		channels:       make(map[string]*model.Channel),
+		channelMembers: make(map[string][]string),
+		posts:          make(map[string]*model.Post),
+		reactions:      make(map[string][]*model.Reaction),
+		files:          make(map[string]*model.FileInfo),
+		fileData:       make(map[string][]byte),
+		sockets:        make(map[*socket]struct{}),
+	}
+	s.Server = httptest.NewServer(s.routes())
+	t.Cleanup(s.Close)
+	s.Admin = &model.User{Username: "admin", Roles: model.SystemAdminRoleId + " " + model.SystemUserRoleId}
+	s.AdminToken = s.AddUser(s.Admin)
+	return s
+}
+
+// Close closes the WebSocket connections and stops the server
+func (s *Server) Close() {
+	s.lock.Lock()
+	for sock := range s.sockets {
+		_ = sock.conn.Close()
+	}
+	s.lock.Unlock()
+	s.Server.Close()
+}
+
+// WebSocketURL returns the address clients connect to the WebSocket with, which
+// model.NewWebSocketClient4 expects without the API path
+func (s *Server) WebSocketURL() string {
+	return strings.Replace(s.URL, "http://", "ws://", 1)
+}
+
+// AddUser adds a user and returns a personal access token for them. The ID of the user
+// is generated if it's empty.
+func (s *Server) AddUser(user *model.User) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.addUser(user)
+	return s.newToken(user.Id)
+}
+
+func (s *Server) addUser(user *model.User) {
+	if user.Id == "" {
+		user.Id = model.NewId()
+	}
+	if user.Roles == "" {
+		user.Roles = model.SystemUserRoleId
+	}
+	if user.CreateAt == 0 {
+		user.CreateAt = model.GetMillis()
+	}
+	user.UpdateAt = user.CreateAt
+	user.Password = ""
+	s.users[user.Id] = user
+}
+
+func (s *Server) newToken(userID string) string {
+	token := model.NewId()
+	s.tokens[token] = userID
+	return token
+}
+
+// AddTeam adds a team, generating its ID if it's empty
+func (s *Server) AddTeam(team *model.Team) *model.Team {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.addTeam(team)
+	return team
+}
+
+func (s *Server) addTeam(team *model.Team) {
+	if team.Id == "" {
+		team.Id = model.NewId()
+	}
+	if team.Type == "" {
+		team.Type = model.TeamOpen
+	}
+	s.teams[team.Id] = team
+}
+
+// AddChannel adds a channel with the given members, generating its ID if it's empty.
+// The members are added to the team of the channel too.
+func (s *Server) AddChannel(channel *model.Channel, userIDs ...string) *model.Channel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.addChannel(channel)
+	for _, userID := range userIDs {
+		s.addChannelMember(channel.Id, userID)
+	}
+	return channel
+}
+
+func (s *Server) addChannel(channel *model.Channel) {
+	if channel.Id == "" {
+		channel.Id = model.NewId()
+	}
+	if channel.Type == "" {
+		channel.Type = model.ChannelTypeOpen
+	}
+	if channel.CreateAt == 0 {
+		channel.CreateAt = model.GetMillis()
+	}
+	s.channels[channel.Id] = channel
+}
+
+func (s *Server) addChannelMember(channelID, userID string) {
+	if !slices.Contains(s.channelMembers[channelID], userID) {
+		s.channelMembers[channelID] = append(s.channelMembers[channelID], userID)
+	}
+	if teamID := s.channels[channelID].TeamId; teamID != "" && !slices.Contains(s.teamMembers[teamID], userID) {
+		s.teamMembers[teamID] = append(s.teamMembers[teamID], userID)
+	}
+}
+
+// CreatePost creates a post as its UserId and sends the posted event, like a post made
+// in the Mattermost UI
+func (s *Server) CreatePost(post *model.Post) *model.Post {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.createPost(post).Clone()
+}
+
+func (s *Server) createPost(post *model.Post) *model.Post {
+	if post.PendingPostId != "" {
+		// Mattermost deduplicates retries of the same post
+		for _, existing := range s.posts {
+			if existing.PendingPostId == post.PendingPostId && existing.UserId == post.UserId {
+				return existing
+			}
+		}
+	}
+	post = post.Clone()
+	s.lastPostAt = max(model.GetMillis(), s.lastPostAt+1)
+	post.CreateAt = s.lastPostAt
+	post.PreSave()
+	channel := s.channels[post.ChannelId]
+	if channel != nil {
+		channel.TotalMsgCount++
+		channel.LastPostAt = post.CreateAt
+	}
+	for _, fileID := range post.FileIds {
+		if info, ok := s.files[fileID]; ok {
+			info.PostId = post.Id
+			if post.Metadata == nil {
+				post.Metadata = &model.PostMetadata{}
+			}
+			post.Metadata.Files = append(post.Metadata.Files, info)
+		}
+	}
+	s.posts[post.Id] = post
+	evt := s.channelEvent(model.WebsocketEventPosted, post.ChannelId)
+	evt.Add("post", postJSON(post))
+	if user := s.users[post.UserId]; user != nil {
+		evt.Add("sender_name", "@"+user.Username)
+	}
+	if channel != nil {
+		evt.Add("channel_type", channel.Type)
+	}
+	s.broadcast(evt)
+	return post
+}
+
+// Post returns a copy of a post, or nil if it doesn't exist
+func (s *Server) Post(postID string) *model.Post {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if post, ok := s.posts[postID]; ok {
+		return post.Clone()
+	}
+	return nil
+}
+
+// ChannelPosts returns copies of the posts of a channel that aren't deleted, oldest first
+func (s *Server) ChannelPosts(channelID string) []*model.Post {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var posts []*model.Post
+	for _, post := range s.posts {
+		if post.ChannelId == channelID && post.DeleteAt == 0 {
+			posts = append(posts, post.Clone())
+		}
+	}
+	slices.SortFunc(posts, func(a, b *model.Post) int {
+		return int(a.CreateAt - b.CreateAt)
+	})
+	return posts
+}
+
+// ChannelMembers returns the IDs of the members of a channel
+func (s *Server) ChannelMembers(channelID string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return slices.Clone(s.channelMembers[channelID])
+}
+
+// Reactions returns the reactions to a post
+func (s *Server) Reactions(postID string) []*model.Reaction {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return slices.Clone(s.reactions[postID])
+}
+
+// User returns a user by username, or nil if there's none
+func (s *Server) User(username string) *model.User {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, user := range s.users {
+		if user.Username == username {
+			return user.DeepCopy()
+		}
+	}
+	return nil
+}
+
+// FileData returns the contents of an uploaded file
+func (s *Server) FileData(fileID string) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.fileData[fileID]
+}
+
+// postJSON encodes a post like Mattermost does in WebSocket events
+func postJSON(post *model.Post) string {
+	data, _ := post.ToJSON()
+	return data
+}
+
+// channelEvent creates an event broadcast to a channel
+func (s *Server) channelEvent(eventType model.WebsocketEventType, channelID string) *model.WebSocketEvent {
+	var teamID string
+	if channel := s.channels[channelID]; channel != nil {
+		teamID = channel.TeamId
+	}
+	return model.NewWebSocketEvent(eventType, teamID, channelID, "", nil, "")
+}
+
+// writeJSON writes a response body
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+// writeError writes an error in the format of Mattermost, which the client parses into
+// an AppError
+func writeError(w http.ResponseWriter, status int, message string) {
+	appErr := model.NewAppError("mmtest", "mmtest.error", nil, message, status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, appErr.ToJSON())
+}
+
+// paginate returns the page of items that a request asks for with the page and per_page
+// query parameters
+func paginate[T any](r *http.Request, items []T) []T {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage <= 0 {
+		perPage = 60
+	}
+	start := min(page*perPage, len(items))
+	end := min(start+perPage, len(items))
+	return items[start:end]
+}
+
+// sortedValues returns the values of a map sorted by a key
+func sortedValues[T any](values map[string]*T, key func(*T) string) []*T {
+	items := make([]*T, 0, len(values))
+	for _, value := range values {
+		items = append(items, value)
+	}
+	slices.SortFunc(items, func(a, b *T) int {
+		return strings.Compare(key(a), key(b))
+	})
+	return items
+}
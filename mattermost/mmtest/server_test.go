@@ -0,0 +1,171 @@
+package mmtest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nextEvent waits for the next event of a WebSocket client
+func nextEvent(t *testing.T, ws *model.WebSocketClient) *model.WebSocketEvent {
+	t.Helper()
+	select {
+	case evt := <-ws.EventChannel:
+		return evt
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for WebSocket event")
+		return nil
+	}
+}
+
+func TestServer_Posts(t *testing.T) {
+	ctx := context.Background()
+	server := NewServer(t)
+	alice := &model.User{Username: "alice"}
+	token := server.AddUser(alice)
+	team := server.AddTeam(&model.Team{Name: "team"})
+	channel := server.AddChannel(&model.Channel{TeamId: team.Id, Name: "town-square"}, alice.Id)
+
+	client := model.NewAPIv4Client(server.URL)
+	client.SetToken(token)
+	me, _, err := client.GetMe(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", me.Username)
+
+	// Posts are made by the authenticated user, and retries with the same pending ID are
+	// deduplicated
+	post, _, err := client.CreatePost(ctx, &model.Post{ChannelId: channel.Id, UserId: server.Admin.Id, Message: "hello", PendingPostId: "pending1"})
+	require.NoError(t, err)
+	assert.Equal(t, alice.Id, post.UserId)
+	retried, _, err := client.CreatePost(ctx, &model.Post{ChannelId: channel.Id, Message: "hello", PendingPostId: "pending1"})
+	require.NoError(t, err)
+	assert.Equal(t, post.Id, retried.Id)
+	second := server.CreatePost(&model.Post{ChannelId: channel.Id, UserId: alice.Id, Message: "second"})
+
+	list, _, err := client.GetPostsForChannel(ctx, channel.Id, 0, 60, "", false, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{second.Id, post.Id}, list.Order)
+
+	_, _, err = client.PatchPost(ctx, post.Id, &model.PostPatch{Message: model.NewPointer("edited")})
+	require.NoError(t, err)
+	assert.Equal(t, "edited", server.Post(post.Id).Message)
+	assert.NotZero(t, server.Post(post.Id).EditAt)
+
+	_, err = client.DeletePost(ctx, second.Id)
+	require.NoError(t, err)
+	_, resp, err := client.GetPost(ctx, second.Id, "")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Len(t, server.ChannelPosts(channel.Id), 1)
+
+	// Requests without a valid token are rejected
+	client.SetToken("invalid")
+	_, resp, err = client.GetMe(ctx, "")
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServer_UsersAndMembers(t *testing.T) {
+	ctx := context.Background()
+	server := NewServer(t)
+	team := server.AddTeam(&model.Team{Name: "team"})
+	channel := server.AddChannel(&model.Channel{TeamId: team.Id, Name: "town-square"})
+
+	client := model.NewAPIv4Client(server.URL)
+	client.SetToken(server.AdminToken)
+	ghost, _, err := client.CreateUser(ctx, &model.User{Username: "mx.alice", Email: "alice@example.com", Password: "password"})
+	require.NoError(t, err)
+	_, _, err = client.CreateUser(ctx, &model.User{Username: "mx.alice"})
+	require.Error(t, err, "usernames are unique")
+
+	token, _, err := client.CreateUserAccessToken(ctx, ghost.Id, "ghost token")
+	require.NoError(t, err)
+	ghostClient := model.NewAPIv4Client(server.URL)
+	ghostClient.SetToken(token.Token)
+	me, _, err := ghostClient.GetMe(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, ghost.Id, me.Id)
+
+	_, _, err = client.AddChannelMember(ctx, channel.Id, ghost.Id)
+	require.NoError(t, err)
+	assert.Equal(t, []string{ghost.Id}, server.ChannelMembers(channel.Id))
+	members, _, err := client.GetChannelMembers(ctx, channel.Id, 0, 60, "")
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+	assert.Equal(t, ghost.Id, members[0].UserId)
+
+	users, _, err := client.GetUsers(ctx, 0, 60, "")
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, "admin", users[0].Username)
+	assert.Equal(t, "mx.alice", users[1].Username)
+}
+
+func TestServer_Files(t *testing.T) {
+	ctx := context.Background()
+	server := NewServer(t)
+	channel := server.AddChannel(&model.Channel{Name: "town-square"})
+
+	client := model.NewAPIv4Client(server.URL)
+	client.SetToken(server.AdminToken)
+	resp, _, err := client.UploadFile(ctx, []byte("some notes"), channel.Id, "notes.txt")
+	require.NoError(t, err)
+	require.Len(t, resp.FileInfos, 1)
+	info := resp.FileInfos[0]
+	assert.Equal(t, "notes.txt", info.Name)
+	assert.Equal(t, "txt", info.Extension)
+	assert.EqualValues(t, 10, info.Size)
+
+	post, _, err := client.CreatePost(ctx, &model.Post{ChannelId: channel.Id, FileIds: model.StringArray{info.Id}})
+	require.NoError(t, err)
+	require.NotNil(t, post.Metadata)
+	require.Len(t, post.Metadata.Files, 1)
+	assert.Equal(t, post.Id, post.Metadata.Files[0].PostId)
+
+	data, _, err := client.GetFile(ctx, info.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "some notes", string(data))
+	assert.Equal(t, data, server.FileData(info.Id))
+}
+
+func TestServer_WebSocket(t *testing.T) {
+	ctx := context.Background()
+	server := NewServer(t)
+	channel := server.AddChannel(&model.Channel{Name: "town-square"}, server.Admin.Id)
+
+	ws, err := model.NewWebSocketClient4(server.WebSocketURL(), server.AdminToken)
+	require.NoError(t, err)
+	defer ws.Close()
+	ws.Listen()
+
+	hello := nextEvent(t, ws)
+	assert.Equal(t, model.WebsocketEventHello, hello.EventType())
+	assert.EqualValues(t, 0, hello.GetSequence())
+	assert.NotEmpty(t, hello.GetData()["connection_id"])
+
+	post := server.CreatePost(&model.Post{ChannelId: channel.Id, UserId: server.Admin.Id, Message: "hello"})
+	evt := nextEvent(t, ws)
+	assert.Equal(t, model.WebsocketEventPosted, evt.EventType())
+	assert.EqualValues(t, 1, evt.GetSequence())
+	assert.Equal(t, channel.Id, evt.GetBroadcast().ChannelId)
+	assert.Contains(t, evt.GetData()["post"], post.Id)
+
+	client := model.NewAPIv4Client(server.URL)
+	client.SetToken(server.AdminToken)
+	_, _, err = client.SaveReaction(ctx, &model.Reaction{UserId: server.Admin.Id, PostId: post.Id, EmojiName: "thumbsup"})
+	require.NoError(t, err)
+	evt = nextEvent(t, ws)
+	assert.Equal(t, model.WebsocketEventReactionAdded, evt.EventType())
+	assert.Contains(t, evt.GetData()["reaction"], `"emoji_name":"thumbsup"`)
+	assert.Len(t, server.Reactions(post.Id), 1)
+
+	_, err = client.DeleteReaction(ctx, &model.Reaction{UserId: server.Admin.Id, PostId: post.Id, EmojiName: "thumbsup"})
+	require.NoError(t, err)
+	assert.Equal(t, model.WebsocketEventReactionRemoved, nextEvent(t, ws).EventType())
+	assert.Empty(t, server.Reactions(post.Id))
+}
@@ -0,0 +1,101 @@
+package mmtest
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+// socket is a WebSocket connection. Every connection gets every event, numbered per
+// connection like Mattermost does.
+type socket struct {
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+	seq       int64
+}
+
+// send writes an event with the next sequence number of the connection. SetSequence
+// copies the event, so the same event can be sent to every connection.
+func (sock *socket) send(evt *model.WebSocketEvent) error {
+	sock.writeLock.Lock()
+	defer sock.writeLock.Unlock()
+	data, err := evt.SetSequence(sock.seq).ToJSON()
+	if err != nil {
+		return err
+	}
+	sock.seq++
+	return sock.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// serveWebSocket authenticates a connection with the token in the header or the first
+// message, like Mattermost, and sends it events until it's closed
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get(model.HeaderAuth), model.HeaderBearer+" ")
+	var challengeSeq int64
+	if token == "" {
+		var req model.WebSocketRequest
+		if err = conn.ReadJSON(&req); err != nil || req.Action != string(model.WebsocketAuthenticationChallenge) {
+			_ = conn.Close()
+			return
+		}
+		token, _ = req.Data["token"].(string)
+		challengeSeq = req.Seq
+	}
+	// The connection is registered after the hello, so that the hello is its first event
+	s.lock.Lock()
+	userID, ok := s.tokens[token]
+	if !ok {
+		s.lock.Unlock()
+		_ = conn.Close()
+		return
+	}
+	sock := &socket{conn: conn}
+	if challengeSeq != 0 {
+		resp, _ := model.NewWebSocketResponse(model.StatusOk, challengeSeq, nil).ToJSON()
+		_ = conn.WriteMessage(websocket.TextMessage, resp)
+	}
+	hello := model.NewWebSocketEvent(model.WebsocketEventHello, "", "", userID, nil, "")
+	hello.Add("connection_id", model.NewId())
+	hello.Add("server_version", "mmtest")
+	_ = sock.send(hello)
+	s.sockets[sock] = struct{}{}
+	s.lock.Unlock()
+
+	// Client messages other than the authentication aren't supported, they're only read
+	// to notice when the connection is closed
+	for {
+		if _, _, err = conn.NextReader(); err != nil {
+			break
+		}
+	}
+	s.lock.Lock()
+	delete(s.sockets, sock)
+	s.lock.Unlock()
+	_ = conn.Close()
+}
+
+// Broadcast sends an event to every WebSocket connection, for events the server doesn't
+// send itself
+func (s *Server) Broadcast(evt *model.WebSocketEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.broadcast(evt)
+}
+
+func (s *Server) broadcast(evt *model.WebSocketEvent) {
+	for sock := range s.sockets {
+		if sock.send(evt) != nil {
+			_ = sock.conn.Close()
+			delete(s.sockets, sock)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package msgconv
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"go.mau.fi/util/variationselector"
+)
+
+var (
+	emojiNamesOnce sync.Once
+	// emojiNames maps Unicode emoji without variation selectors to their Mattermost names
+	emojiNames map[string]string
+)
+
+// decodeEmoji converts the codepoints Mattermost stores system emoji as, like "1f44d" or
+// "2764-fe0f", to the emoji
+func decodeEmoji(codepoints string) (string, bool) {
+	var emoji strings.Builder
+	for _, hex := range strings.Split(codepoints, "-") {
+		codepoint, err := strconv.ParseInt(hex, 16, 32)
+		if err != nil {
+			return "", false
+		}
+		emoji.WriteRune(rune(codepoint))
+	}
+	return emoji.String(), true
+}
+
+func loadEmojiNames() {
+	emojiNames = make(map[string]string, len(model.SystemEmojis))
+	for name, codepoints := range model.SystemEmojis {
+		emoji, ok := decodeEmoji(codepoints)
+		if !ok {
+			continue
+		}
+		emoji = variationselector.Remove(emoji)
+		// Emoji with several names, like "+1" and "thumbsup", always get the same one
+		if existing, ok := emojiNames[emoji]; !ok || name < existing {
+			emojiNames[emoji] = name
+		}
+	}
+}
+
+// EmojiToMattermost returns the Mattermost name of a Matrix reaction emoji. Keys that aren't
+// Unicode emoji, like the names of custom emoji, are returned without their colons.
+func EmojiToMattermost(emoji string) string {
+	emojiNamesOnce.Do(loadEmojiNames)
+	if name, ok := emojiNames[variationselector.Remove(emoji)]; ok {
+		return name
+	}
+	return strings.Trim(emoji, ":")
+}
+
+// EmojiToMatrix returns the Unicode emoji of a Mattermost emoji name. Custom emoji don't
+// have one, so they're returned as their name in colons.
+func EmojiToMatrix(name string) string {
+	if codepoints, ok := model.SystemEmojis[name]; ok {
+		if emoji, ok := decodeEmoji(codepoints); ok {
+			return variationselector.Add(emoji)
+		}
+	}
+	return ":" + name + ":"
+}
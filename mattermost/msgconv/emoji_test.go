@@ -0,0 +1,25 @@
+package msgconv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmojiToMattermost(t *testing.T) {
+	assert.Equal(t, "+1", EmojiToMattermost("👍"))
+	// Variation selectors don't matter
+	assert.Equal(t, "heart", EmojiToMattermost("❤️"))
+	assert.Equal(t, "heart", EmojiToMattermost("❤"))
+	// Names are kept as they are
+	assert.Equal(t, "thumbsup", EmojiToMattermost("thumbsup"))
+	assert.Equal(t, "partyparrot", EmojiToMattermost(":partyparrot:"))
+}
+
+func TestEmojiToMatrix(t *testing.T) {
+	// Variation selectors are added like Matrix clients do
+	assert.Equal(t, "👍\ufe0f", EmojiToMatrix("thumbsup"))
+	assert.Equal(t, "👍\ufe0f", EmojiToMatrix("+1"))
+	assert.Equal(t, "❤️", EmojiToMatrix("heart"))
+	assert.Equal(t, ":partyparrot:", EmojiToMatrix("partyparrot"))
+}
@@ -0,0 +1,165 @@
+package msgconv
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// FilterConfig contains the message filters that are applied to messages bridged in
+// either direction
+type FilterConfig struct {
+	// Drop contains regexes, messages matching any of them aren't bridged
+	Drop []string `yaml:"drop" json:"drop,omitempty"`
+	// Replace replaces whole words (case-insensitive) with other text
+	Replace map[string]string `yaml:"replace" json:"replace,omitempty"`
+	// MaxLength truncates longer messages to this many characters (0 = unlimited)
+	MaxLength int `yaml:"max_length" json:"max_length,omitempty"`
+	// MutedSenders maps channel IDs to the senders whose messages aren't bridged in
+	// that channel. Senders are Mattermost user IDs or Matrix user IDs.
+	MutedSenders map[string][]string `yaml:"muted_senders" json:"muted_senders,omitempty"`
+}
+
+// ErrMessageFiltered is returned for Matrix messages that are dropped by a filter
+var ErrMessageFiltered error = bridgev2.WrapErrorInStatus(errors.New("message was blocked by the bridge's filters")).WithStatus(event.MessageStatusFail).WithErrorReason(event.MessageStatusNoPermission).WithIsCertain(true).WithErrorAsMessage().WithSendNotice(true)
+
+// FilteredMessage is a message going through the filters
+type FilteredMessage struct {
+	ChannelID string
+	SenderID  string
+	Text      string
+}
+
+// Filter is a step of the filter pipeline. It may change the message, or return false
+// to drop it.
+type Filter interface {
+	Filter(msg *FilteredMessage) bool
+}
+
+// Filters is a pipeline of filters that are applied in order
+type Filters []Filter
+
+// FilterSource provides the filters in use, which can be replaced while the bridge runs
+type FilterSource interface {
+	MessageFilters() Filters
+}
+
+// MessageFilters returns the filters themselves, so a fixed pipeline can be a FilterSource
+func (f Filters) MessageFilters() Filters {
+	return f
+}
+
+// NewFilters creates the filter pipeline for a config. Senders are muted first, then
+// messages are dropped, words replaced and the result truncated.
+func NewFilters(cfg FilterConfig) (Filters, error) {
+	var filters Filters
+	if len(cfg.MutedSenders) > 0 {
+		filters = append(filters, muteFilter(cfg.MutedSenders))
+	}
+	if len(cfg.Drop) > 0 {
+		drop := make(dropFilter, len(cfg.Drop))
+		for i, pattern := range cfg.Drop {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid drop pattern %q: %w", pattern, err)
+			}
+			drop[i] = re
+		}
+		filters = append(filters, drop)
+	}
+	if len(cfg.Replace) > 0 {
+		filters = append(filters, newReplaceFilter(cfg.Replace))
+	}
+	if cfg.MaxLength > 0 {
+		filters = append(filters, maxLengthFilter(cfg.MaxLength))
+	}
+	return filters, nil
+}
+
+// Apply runs a message through the filters. It returns false if the message was dropped.
+func (f Filters) Apply(msg *FilteredMessage) bool {
+	for _, filter := range f {
+		if !filter.Filter(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterText runs the text of a message in a portal through the filters. It returns the
+// new text, and false if the message must not be bridged. Portals can override the
+// filters of the converter.
+func (mc *MessageConverter) FilterText(portal *bridgev2.Portal, senderID, text string) (string, bool) {
+	var filters Filters
+	if mc.Filters != nil {
+		filters = mc.Filters.MessageFilters()
+	}
+	if overrides := getPortalOverrides(portal); overrides != nil && overrides.Filters() != nil {
+		filters = overrides.Filters()
+	}
+	msg := &FilteredMessage{ChannelID: string(portal.ID), SenderID: senderID, Text: text}
+	if !filters.Apply(msg) {
+		return "", false
+	}
+	return msg.Text, true
+}
+
+type muteFilter map[string][]string
+
+func (f muteFilter) Filter(msg *FilteredMessage) bool {
+	return !slices.Contains(f[msg.ChannelID], msg.SenderID)
+}
+
+type dropFilter []*regexp.Regexp
+
+func (f dropFilter) Filter(msg *FilteredMessage) bool {
+	for _, re := range f {
+		if re.MatchString(msg.Text) {
+			return false
+		}
+	}
+	return true
+}
+
+type replaceFilter struct {
+	pattern      *regexp.Regexp
+	replacements map[string]string
+}
+
+func newReplaceFilter(replacements map[string]string) *replaceFilter {
+	words := make([]string, 0, len(replacements))
+	lower := make(map[string]string, len(replacements))
+	for word, replacement := range replacements {
+		words = append(words, regexp.QuoteMeta(word))
+		lower[strings.ToLower(word)] = replacement
+	}
+	// Longer words first, so that they win over words they start with
+	slices.SortFunc(words, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	return &replaceFilter{
+		pattern:      regexp.MustCompile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`),
+		replacements: lower,
+	}
+}
+
+func (f *replaceFilter) Filter(msg *FilteredMessage) bool {
+	msg.Text = f.pattern.ReplaceAllStringFunc(msg.Text, func(word string) string {
+		return f.replacements[strings.ToLower(word)]
+	})
+	return true
+}
+
+type maxLengthFilter int
+
+func (f maxLengthFilter) Filter(msg *FilteredMessage) bool {
+	if runes := []rune(msg.Text); len(runes) > int(f) {
+		msg.Text = string(runes[:f]) + "…"
+	}
+	return true
+}
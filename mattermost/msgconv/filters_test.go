@@ -0,0 +1,64 @@
+package msgconv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestFilters(t *testing.T) {
+	filters, err := NewFilters(FilterConfig{
+		Drop:         []string{`(?i)^!spam`},
+		Replace:      map[string]string{"darn": "d**n", "darnit": "oops"},
+		MaxLength:    12,
+		MutedSenders: map[string][]string{"channel1": {"user1", "@bob:example.com"}},
+	})
+	require.NoError(t, err)
+	mc := &MessageConverter{Filters: filters}
+	channel1 := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "channel1"}}}
+	channel2 := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "channel2"}}}
+
+	text, ok := mc.FilterText(channel1, "user2", "Darn, darnit")
+	assert.True(t, ok)
+	assert.Equal(t, "d**n, oops", text)
+
+	text, ok = mc.FilterText(channel1, "user2", "this message is too long")
+	assert.True(t, ok)
+	assert.Equal(t, "this message…", text)
+
+	_, ok = mc.FilterText(channel1, "user2", "!SPAM buy now")
+	assert.False(t, ok)
+	_, ok = mc.FilterText(channel1, "user1", "hello")
+	assert.False(t, ok)
+	_, ok = mc.FilterText(channel1, "@bob:example.com", "hello")
+	assert.False(t, ok)
+	_, ok = mc.FilterText(channel2, "user1", "hello")
+	assert.True(t, ok)
+
+	_, err = NewFilters(FilterConfig{Drop: []string{"("}})
+	assert.Error(t, err)
+}
+
+func TestFilters_AppliedInBothDirections(t *testing.T) {
+	filters, err := NewFilters(FilterConfig{Drop: []string{"secret"}})
+	require.NoError(t, err)
+	mc := &MessageConverter{Filters: filters}
+	portal := &bridgev2.Portal{Portal: &database.Portal{}}
+
+	assert.Nil(t, mc.ToMatrix(context.Background(), portal, nil, &bridgev2.UserLogin{}, &model.Post{Message: "a secret"}))
+	assert.NotNil(t, mc.ToMatrix(context.Background(), portal, nil, &bridgev2.UserLogin{}, &model.Post{Message: "hello"}))
+
+	_, err = mc.ToMattermost(context.Background(), &MockAPI{}, portal, "@alice:example.com", &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "a secret",
+	})
+	assert.ErrorContains(t, err, "blocked by the bridge's filters")
+	assert.Equal(t, event.MessageStatusNoPermission, bridgev2.WrapErrorInStatus(err).ErrorReason)
+}
@@ -2,18 +2,23 @@ package msgconv
 
 import (
 	"context"
+	"fmt"
+	"html"
 	"mime"
 	"net/http"
 	"strings"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/rs/zerolog"
+	ptrutil "go.mau.fi/util/ptr"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
 )
 
+// ToMatrix converts a Mattermost post to Matrix. It returns nil if the post is dropped by
+// the filters.
 func (mc *MessageConverter) ToMatrix(
 	ctx context.Context,
 	portal *bridgev2.Portal,
@@ -24,6 +29,10 @@ func (mc *MessageConverter) ToMatrix(
 	ctx = context.WithValue(ctx, contextKeyPortal, portal)
 	ctx = context.WithValue(ctx, contextKeySource, source)
 	
+	message, ok := mc.FilterText(portal, post.UserId, post.Message)
+	if !ok {
+		return nil
+	}
 	output := &bridgev2.ConvertedMessage{}
 
 	// Handle Reply
@@ -35,8 +44,18 @@ func (mc *MessageConverter) ToMatrix(
 	}
 
 	// Handle Text
-	if post.Message != "" {
-		content := format.RenderMarkdown(post.Message, true, false)
+	if message != "" {
+		if label := PriorityLabel(post.GetPriority()); label != "" {
+			message = "**" + label + "**\n\n" + message
+		}
+		content := format.RenderMarkdown(message, true, false)
+		if mc.IsNoticePost(post) {
+			content.MsgType = event.MsgNotice
+		}
+		if source != nil {
+			client, _ := source.Client.(MattermostClientProvider)
+			mc.addGroupMentions(ctx, client, message, &content)
+		}
 		output.Parts = append(output.Parts, &bridgev2.ConvertedMessagePart{
 			Type:    event.EventMessage,
 			Content: &content,
@@ -56,7 +75,8 @@ func (mc *MessageConverter) ToMatrix(
 	}
 
 	// If post has message and files, we might want to merge caption
-	if len(output.Parts) > 1 && post.Message != "" {
+	overrides := getPortalOverrides(portal)
+	if len(output.Parts) > 1 && message != "" && (overrides == nil || overrides.MergeCaptions()) {
 		// Logic to merge caption if the first part is text and second is file
 		// bridgev2.MergeCaption can be used if we want to attach text as caption to the first file
 		// For now, let's keep them separate or use MergeCaption helper
@@ -68,6 +88,47 @@ func (mc *MessageConverter) ToMatrix(
 	return output
 }
 
+// IsSystemPost checks if a post is a system message, like a user joining the channel
+func IsSystemPost(post *model.Post) bool {
+	return strings.HasPrefix(post.Type, model.PostSystemMessagePrefix)
+}
+
+// IsBotPost checks whether a post was made by a Mattermost bot account
+func IsBotPost(post *model.Post) bool {
+	return post.GetProp(model.PostPropsFromBot) == "true"
+}
+
+// IsNoticePost checks whether a post is bridged as a notice: system messages always are,
+// and posts of bot accounts are if BotNotices is set
+func (mc *MessageConverter) IsNoticePost(post *model.Post) bool {
+	return IsSystemPost(post) || (mc.BotNotices && IsBotPost(post))
+}
+
+// Mattermost only has a constant for urgent posts
+const postPriorityImportant = "important"
+
+// PriorityLabel returns the label shown above urgent and important posts, so that they
+// keep their weight on Matrix, or an empty string for normal posts
+func PriorityLabel(priority *model.PostPriority) string {
+	if priority == nil {
+		return ""
+	}
+	var label string
+	switch ptrutil.Val(priority.Priority) {
+	case model.PostPriorityUrgent:
+		label = "🚨 URGENT"
+	case postPriorityImportant:
+		label = "❗ IMPORTANT"
+	}
+	if ptrutil.Val(priority.RequestedAck) {
+		if label != "" {
+			label += " · "
+		}
+		label += "✅ Acknowledgement requested"
+	}
+	return label
+}
+
 func (mc *MessageConverter) fileToMatrix(
 	ctx context.Context,
 	portal *bridgev2.Portal,
@@ -78,26 +139,31 @@ func (mc *MessageConverter) fileToMatrix(
 ) *bridgev2.ConvertedMessagePart {
 	log := zerolog.Ctx(ctx).With().Str("file_id", fileID).Logger()
 
-	// Get file with metadata for better filename and mime type detection
-	data, fileInfo, err := client.GetFileWithInfo(ctx, fileID)
+	// Fetch metadata first so oversized or disallowed files are never downloaded
+	fileInfo, err := client.GetFileInfo(ctx, fileID)
 	if err != nil {
-		log.Err(err).Msg("Failed to get file with info from Mattermost")
-		// Fallback to just downloading the file
-		data, err = client.GetFile(ctx, fileID)
-		if err != nil {
-			log.Err(err).Msg("Failed to download file from Mattermost")
-			return nil
+		log.Err(err).Msg("Failed to get file info from Mattermost")
+		fileInfo = nil
+	}
+	if fileInfo != nil {
+		mimeType := resolveMimeType(fileInfo.MimeType, fileInfo.Name, "")
+		if linkPart := mc.checkFileLimits(client, partID, fileID, fileInfo.Name, mimeType, fileInfo.Size); linkPart != nil {
+			log.Debug().Int64("size", fileInfo.Size).Str("mime_type", mimeType).Msg("Bridging file as link instead of uploading")
+			return linkPart
 		}
 	}
-	
+
+	data, err := client.GetFile(ctx, fileID)
+	if err != nil {
+		log.Err(err).Msg("Failed to download file from Mattermost")
+		return nil
+	}
+
 	// Determine filename and mime type
 	var fileName, mimeType string
 	if fileInfo != nil {
 		fileName = fileInfo.Name
-		mimeType = fileInfo.MimeType
-		if mimeType == "" {
-			mimeType = http.DetectContentType(data)
-		}
+		mimeType = resolveMimeType(fileInfo.MimeType, fileName, http.DetectContentType(data))
 	} else {
 		// Fallback: detect content type and generate filename
 		mimeType = http.DetectContentType(data)
@@ -105,12 +171,10 @@ func (mc *MessageConverter) fileToMatrix(
 		if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
 			fileName += exts[0]
 		}
-	}
-
-	// Check file size against limit
-	if mc.MaxFileSize > 0 && int64(len(data)) > mc.MaxFileSize {
-		log.Warn().Int64("size", int64(len(data))).Int64("max", mc.MaxFileSize).Msg("File too large, skipping")
-		return nil
+		// Limits couldn't be checked without metadata, so check them now
+		if linkPart := mc.checkFileLimits(client, partID, fileID, fileName, mimeType, int64(len(data))); linkPart != nil {
+			return linkPart
+		}
 	}
 
 	mxc, file, err := intent.UploadMedia(ctx, portal.MXID, data, fileName, mimeType)
@@ -127,13 +191,23 @@ func (mc *MessageConverter) fileToMatrix(
 		},
 	}
 	
-	// Add image dimensions if available
-	if fileInfo != nil && (mimeType == "image/jpeg" || mimeType == "image/png" || mimeType == "image/gif" || strings.HasPrefix(mimeType, "image/")) {
+	// Add image/video dimensions if available
+	if fileInfo != nil && (strings.HasPrefix(mimeType, "image/") || strings.HasPrefix(mimeType, "video/")) {
 		if fileInfo.Width > 0 && fileInfo.Height > 0 {
 			content.Info.Width = fileInfo.Width
 			content.Info.Height = fileInfo.Height
 		}
 	}
+
+	// Mattermost doesn't store duration (or video dimensions), so probe the container
+	if strings.HasPrefix(mimeType, "video/") || strings.HasPrefix(mimeType, "audio/") {
+		meta := probeMediaMetadata(data)
+		content.Info.Duration = meta.Duration
+		if content.Info.Width == 0 && strings.HasPrefix(mimeType, "video/") {
+			content.Info.Width = meta.Width
+			content.Info.Height = meta.Height
+		}
+	}
 	
 	if file != nil {
 		content.File = file
@@ -142,6 +216,60 @@ func (mc *MessageConverter) fileToMatrix(
 	}
 	content.MsgType = mimeToMsgType(mimeType)
 
+	// Thumbnail and blurhash so clients can render a placeholder before downloading
+	mc.addThumbnail(ctx, portal, intent, client, fileInfo, data, content.Info)
+
+	return &bridgev2.ConvertedMessagePart{
+		ID:      partID,
+		Type:    event.EventMessage,
+		Content: content,
+	}
+}
+
+// fileLinkNote tells Matrix users that links to files on Mattermost need a Mattermost
+// session, as the file API doesn't accept anonymous requests
+const fileLinkNote = "log in to Mattermost to download"
+
+// checkFileLimits applies the configured size and mime type limits to a Mattermost file.
+// If the file shouldn't be uploaded to Matrix, a text part linking to the file on
+// Mattermost is returned instead.
+func (mc *MessageConverter) checkFileLimits(
+	client MattermostClientProvider,
+	partID networkid.PartID,
+	fileID, fileName, mimeType string,
+	size int64,
+) *bridgev2.ConvertedMessagePart {
+	var reason string
+	switch {
+	case !mc.IsMimeTypeAllowed(mimeType):
+		reason = "file type not bridged"
+	case mc.MaxFileSize > 0 && size > mc.MaxFileSize:
+		reason = "file too large"
+	case mc.LinkThreshold > 0 && size > mc.LinkThreshold:
+		reason = ""
+	default:
+		return nil
+	}
+
+	var fileURL string
+	if mmClient := client.GetClient(); mmClient != nil {
+		fileURL = fmt.Sprintf("%s/api/v4/files/%s?download=1", strings.TrimSuffix(mmClient.URL, "/"), fileID)
+	}
+
+	label := fmt.Sprintf("%s (%s)", fileName, formatFileSize(size))
+	if reason != "" {
+		label = fmt.Sprintf("%s, %s", label, reason)
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgText,
+		Body:    "📎 " + label,
+	}
+	if fileURL != "" {
+		content.Body = fmt.Sprintf("📎 %s: %s (%s)", label, fileURL, fileLinkNote)
+		content.Format = event.FormatHTML
+		content.FormattedBody = fmt.Sprintf(`📎 <a href="%s">%s</a> (%s)`, html.EscapeString(fileURL), html.EscapeString(label), fileLinkNote)
+	}
+
 	return &bridgev2.ConvertedMessagePart{
 		ID:      partID,
 		Type:    event.EventMessage,
@@ -149,6 +277,20 @@ func (mc *MessageConverter) fileToMatrix(
 	}
 }
 
+// formatFileSize renders a byte count in a human-readable form
+func formatFileSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
 func mimeToMsgType(mime string) event.MessageType {
 	if strings.HasPrefix(mime, "image/") {
 		return event.MsgImage
@@ -0,0 +1,140 @@
+package msgconv
+
+import (
+	"encoding/binary"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// mediaMetadata is the subset of audio/video metadata Matrix clients use to render players
+type mediaMetadata struct {
+	Width    int
+	Height   int
+	Duration int // milliseconds
+}
+
+// resolveMimeType picks the best mime type for a file: the one reported by Mattermost,
+// then one guessed from the file extension, then content sniffing.
+func resolveMimeType(reported, fileName, sniffed string) string {
+	if reported != "" && reported != "application/octet-stream" {
+		return reported
+	}
+	if ext := filepath.Ext(fileName); ext != "" {
+		if byExt := mime.TypeByExtension(strings.ToLower(ext)); byExt != "" {
+			// Strip parameters like "; charset=utf-8"
+			if mediaType, _, err := mime.ParseMediaType(byExt); err == nil {
+				return mediaType
+			}
+			return byExt
+		}
+	}
+	if sniffed != "" {
+		return sniffed
+	}
+	return "application/octet-stream"
+}
+
+// probeMediaMetadata does a lightweight parse of the container headers to find
+// duration and dimensions. Only ISO base media files (MP4, MOV, M4A) are supported,
+// which covers what most Mattermost clients record and upload.
+func probeMediaMetadata(data []byte) mediaMetadata {
+	var meta mediaMetadata
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return meta
+	}
+	walkBoxes(data, &meta)
+	return meta
+}
+
+// walkBoxes iterates over the ISO BMFF boxes in data, descending into the containers
+// that hold the movie and track headers.
+func walkBoxes(data []byte, meta *mediaMetadata) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		boxType := string(data[4:8])
+		headerLen := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerLen = 16
+		}
+		if size < headerLen || size > uint64(len(data)) {
+			return
+		}
+		body := data[headerLen:size]
+
+		switch boxType {
+		case "moov", "trak", "mdia", "minf":
+			walkBoxes(body, meta)
+		case "mvhd":
+			parseMovieHeader(body, meta)
+		case "tkhd":
+			parseTrackHeader(body, meta)
+		}
+		data = data[size:]
+	}
+}
+
+// maxMediaDuration is the longest duration in seconds that is reported, longer ones are
+// assumed to be bogus (e.g. the all-ones "unknown" value)
+const maxMediaDuration = 1<<31/1000 - 1
+
+func parseMovieHeader(body []byte, meta *mediaMetadata) {
+	if len(body) < 1 {
+		return
+	}
+	var timescale uint32
+	var duration uint64
+	if body[0] == 1 {
+		if len(body) < 32 {
+			return
+		}
+		timescale = binary.BigEndian.Uint32(body[20:24])
+		duration = binary.BigEndian.Uint64(body[24:32])
+	} else {
+		if len(body) < 20 {
+			return
+		}
+		timescale = binary.BigEndian.Uint32(body[12:16])
+		duration = uint64(binary.BigEndian.Uint32(body[16:20]))
+	}
+	if timescale == 0 {
+		return
+	}
+	// Divide before scaling to milliseconds, a 64-bit duration times 1000 can overflow
+	seconds := duration / uint64(timescale)
+	if seconds > maxMediaDuration {
+		return
+	}
+	meta.Duration = int(seconds*1000 + duration%uint64(timescale)*1000/uint64(timescale))
+}
+
+func parseTrackHeader(body []byte, meta *mediaMetadata) {
+	if meta.Width > 0 && meta.Height > 0 {
+		// Use the first track with dimensions (the video track)
+		return
+	}
+	if len(body) < 1 {
+		return
+	}
+	offset := 76
+	if body[0] == 1 {
+		offset = 88
+	}
+	if len(body) < offset+8 {
+		return
+	}
+	// Width and height are 16.16 fixed point numbers
+	width := int(binary.BigEndian.Uint32(body[offset:offset+4]) >> 16)
+	height := int(binary.BigEndian.Uint32(body[offset+4:offset+8]) >> 16)
+	if width > 0 && height > 0 {
+		meta.Width = width
+		meta.Height = height
+	}
+}
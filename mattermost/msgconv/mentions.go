@@ -0,0 +1,71 @@
+package msgconv
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// GroupMentionResolver resolves @-mentions of Mattermost user groups, like LDAP groups or
+// custom groups
+type GroupMentionResolver interface {
+	// ResolveGroupMentions returns the Matrix users of the members of the groups with the
+	// given names. Names that aren't groups that can be mentioned are left out.
+	ResolveGroupMentions(ctx context.Context, client MattermostClientProvider, names []string) map[string][]id.UserID
+}
+
+// mentionRegex matches @-mentions in Mattermost messages. Mentions can't follow a letter or
+// digit, so email addresses aren't mentions.
+var mentionRegex = regexp.MustCompile(`(?i)\B@([a-z0-9][a-z0-9._-]*[a-z0-9]|[a-z0-9])`)
+
+// specialMentions notify the whole channel instead of a user or group
+var specialMentions = []string{"all", "channel", "here"}
+
+// mentionNames returns the distinct names mentioned in a message, in lowercase
+func mentionNames(message string) []string {
+	var names []string
+	for _, match := range mentionRegex.FindAllStringSubmatch(strings.ToLower(message), -1) {
+		if name := match[1]; !slices.Contains(specialMentions, name) && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// addGroupMentions mentions the members of the groups a message mentions, and highlights
+// the group mentions, as Matrix has no pills for groups
+func (mc *MessageConverter) addGroupMentions(ctx context.Context, client MattermostClientProvider, message string, content *event.MessageEventContent) {
+	if mc.Groups == nil || client == nil {
+		return
+	}
+	names := mentionNames(message)
+	if len(names) == 0 {
+		return
+	}
+	groups := mc.Groups.ResolveGroupMentions(ctx, client, names)
+	if len(groups) == 0 {
+		return
+	}
+	if content.Mentions == nil {
+		content.Mentions = &event.Mentions{}
+	}
+	for _, members := range groups {
+		for _, userID := range members {
+			content.Mentions.Add(userID)
+		}
+	}
+	if content.FormattedBody == "" {
+		content.Format = event.FormatHTML
+		content.FormattedBody = event.TextToHTML(content.Body)
+	}
+	content.FormattedBody = mentionRegex.ReplaceAllStringFunc(content.FormattedBody, func(mention string) string {
+		if _, ok := groups[strings.ToLower(mention[1:])]; ok {
+			return "<strong>" + mention + "</strong>"
+		}
+		return mention
+	})
+}
@@ -0,0 +1,54 @@
+package msgconv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+type fakeGroupResolver map[string][]id.UserID
+
+func (f fakeGroupResolver) ResolveGroupMentions(ctx context.Context, client MattermostClientProvider, names []string) map[string][]id.UserID {
+	groups := make(map[string][]id.UserID)
+	for _, name := range names {
+		if members, ok := f[name]; ok {
+			groups[name] = members
+		}
+	}
+	return groups
+}
+
+func TestMentionNames(t *testing.T) {
+	assert.Equal(t, []string{"developers", "alice"}, mentionNames("@Developers and @alice, @channel: mail bob@example.com or @developers."))
+	assert.Empty(t, mentionNames("no mentions here"))
+}
+
+func TestToMatrix_GroupMentions(t *testing.T) {
+	mc := &MessageConverter{Groups: fakeGroupResolver{
+		"developers": {"@alice:example.com", "@bob:example.com"},
+	}}
+	portal := &bridgev2.Portal{
+		Portal: &database.Portal{
+			PortalKey: networkid.PortalKey{ID: networkid.PortalID("channel1")},
+		},
+	}
+	source := &bridgev2.UserLogin{Client: new(MockAPI)}
+
+	converted := mc.ToMatrix(context.Background(), portal, nil, source, &model.Post{Message: "@developers please review, thanks @carol"})
+	require.Len(t, converted.Parts, 1)
+	content := converted.Parts[0].Content
+	require.NotNil(t, content.Mentions)
+	assert.Equal(t, []id.UserID{"@alice:example.com", "@bob:example.com"}, content.Mentions.UserIDs)
+	assert.Equal(t, "<strong>@developers</strong> please review, thanks @carol", content.FormattedBody)
+
+	converted = mc.ToMatrix(context.Background(), portal, nil, source, &model.Post{Message: "thanks @carol"})
+	assert.Empty(t, converted.Parts[0].Content.Mentions.UserIDs)
+	assert.Empty(t, converted.Parts[0].Content.FormattedBody)
+}
@@ -2,23 +2,111 @@ package msgconv
 
 import (
 	"context"
+	"errors"
+	"strings"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// DefaultMaxFileSize is used when no limit is configured
+const DefaultMaxFileSize = 50 * 1024 * 1024
+
+// MediaConfig contains settings for bridging files in both directions
+type MediaConfig struct {
+	// MaxFileSizeToMatrix is the largest Mattermost file that will be uploaded to Matrix (0 = default)
+	MaxFileSizeToMatrix int64 `yaml:"max_file_size_to_matrix"`
+	// MaxFileSizeToMattermost is the largest Matrix file that will be uploaded to Mattermost (0 = default)
+	MaxFileSizeToMattermost int64 `yaml:"max_file_size_to_mattermost"`
+	// LinkThreshold makes Mattermost files larger than this be bridged as a link instead of uploaded (0 = disabled)
+	LinkThreshold int64 `yaml:"link_threshold"`
+	// AllowedMimeTypes limits which files are bridged, e.g. "image/*" (empty = all)
+	AllowedMimeTypes []string `yaml:"allowed_mime_types"`
+	// LongTextFileThreshold makes Matrix messages longer than this many characters be uploaded
+	// as a text file instead of split into several posts (0 = always split)
+	LongTextFileThreshold int `yaml:"long_text_file_threshold"`
+}
+
+// Errors for Matrix files that are rejected by the media config. They're message statuses,
+// so the sender gets told why their file didn't make it.
+var (
+	ErrFileTooLarge       error = bridgev2.WrapErrorInStatus(errors.New("file is too large")).WithStatus(event.MessageStatusFail).WithErrorReason(event.MessageStatusUnsupported).WithIsCertain(true).WithErrorAsMessage().WithSendNotice(true)
+	ErrFileTypeNotAllowed error = bridgev2.WrapErrorInStatus(errors.New("files of this type are not bridged")).WithStatus(event.MessageStatusFail).WithErrorReason(event.MessageStatusUnsupported).WithIsCertain(true).WithErrorAsMessage().WithSendNotice(true)
 )
 
 type MessageConverter struct {
 	Bridge      *bridgev2.Bridge
 	ServerName  string
 	MaxFileSize int64
+
+	MaxFileSizeToMattermost int64
+	LinkThreshold           int64
+	AllowedMimeTypes        []string
+	LongTextFileThreshold   int
+
+	// BotNotices makes posts of Mattermost bot accounts notices
+	BotNotices bool
+	// Groups resolves mentions of user groups, they're left as text if it's nil
+	Groups GroupMentionResolver
+
+	// Filters provides the filters applied to messages, nothing is filtered if it's nil
+	Filters FilterSource
+}
+
+// PortalOverrides can be implemented by portal metadata to override the settings of the
+// converter in a single portal
+type PortalOverrides interface {
+	// MergeCaptions returns whether the text and first file of a post are sent as one message
+	MergeCaptions() bool
+	// Filters returns the filters used instead of the converter's own, or nil
+	Filters() Filters
 }
 
-func New(br *bridgev2.Bridge) *MessageConverter {
-	return &MessageConverter{
-		Bridge:      br,
-		ServerName:  br.Matrix.ServerName(),
-		MaxFileSize: 50 * 1024 * 1024, // Default to 50MB, should potentially be configurable
+func getPortalOverrides(portal *bridgev2.Portal) PortalOverrides {
+	if portal == nil || portal.Portal == nil {
+		return nil
+	}
+	overrides, _ := portal.Metadata.(PortalOverrides)
+	return overrides
+}
+
+func New(br *bridgev2.Bridge, media MediaConfig) *MessageConverter {
+	mc := &MessageConverter{
+		Bridge:                  br,
+		ServerName:              br.Matrix.ServerName(),
+		MaxFileSize:             media.MaxFileSizeToMatrix,
+		MaxFileSizeToMattermost: media.MaxFileSizeToMattermost,
+		LinkThreshold:           media.LinkThreshold,
+		AllowedMimeTypes:        media.AllowedMimeTypes,
+		LongTextFileThreshold:   media.LongTextFileThreshold,
+	}
+	if mc.MaxFileSize <= 0 {
+		mc.MaxFileSize = DefaultMaxFileSize
+	}
+	if mc.MaxFileSizeToMattermost <= 0 {
+		mc.MaxFileSizeToMattermost = DefaultMaxFileSize
+	}
+	return mc
+}
+
+// IsMimeTypeAllowed checks a mime type against AllowedMimeTypes.
+// Entries may end in "/*" to allow a whole category.
+func (mc *MessageConverter) IsMimeTypeAllowed(mimeType string) bool {
+	if len(mc.AllowedMimeTypes) == 0 {
+		return true
+	}
+	mimeType = strings.ToLower(mimeType)
+	for _, allowed := range mc.AllowedMimeTypes {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "*" || allowed == "*/*" || allowed == mimeType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mimeType, prefix+"/") {
+			return true
+		}
 	}
+	return false
 }
 
 type MattermostClientProvider interface {
@@ -26,6 +114,7 @@ type MattermostClientProvider interface {
 	GetFile(ctx context.Context, fileID string) ([]byte, error)
 	GetFileInfo(ctx context.Context, fileID string) (*model.FileInfo, error)
 	GetFileWithInfo(ctx context.Context, fileID string) ([]byte, *model.FileInfo, error)
+	GetFileThumbnail(ctx context.Context, fileID string) ([]byte, error)
 	UploadFile(ctx context.Context, data []byte, channelID, filename string) (*model.FileInfo, error)
 }
 
@@ -1,7 +1,13 @@
 package msgconv
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
 	"testing"
 
 	"time"
@@ -9,6 +15,7 @@ import (
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
@@ -65,6 +72,13 @@ func (m *MockAPI) GetFileWithInfo(ctx context.Context, fileID string) ([]byte, *
 	}
 	return data, info, args.Error(2)
 }
+func (m *MockAPI) GetFileThumbnail(ctx context.Context, fileID string) ([]byte, error) {
+	args := m.Called(ctx, fileID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]byte), args.Error(1)
+}
 func (m *MockAPI) UploadFile(ctx context.Context, data []byte, channelID, filename string) (*model.FileInfo, error) {
 	args := m.Called(ctx, data, channelID, filename)
 	return args.Get(0).(*model.FileInfo), args.Error(1)
@@ -134,6 +148,70 @@ func TestToMatrix_Text(t *testing.T) {
 	assert.Equal(t, "Hello <em>world</em>!", converted.Parts[0].Content.FormattedBody)
 }
 
+func TestToMatrix_PriorityLabel(t *testing.T) {
+	mc := &MessageConverter{}
+	portal := &bridgev2.Portal{
+		Portal: &database.Portal{
+			PortalKey: networkid.PortalKey{ID: networkid.PortalID("channel1")},
+		},
+	}
+	urgent := model.PostPriorityUrgent
+	requestedAck := true
+	post := &model.Post{
+		Message: "Server is down",
+		Metadata: &model.PostMetadata{Priority: &model.PostPriority{
+			Priority:     &urgent,
+			RequestedAck: &requestedAck,
+		}},
+	}
+
+	converted := mc.ToMatrix(context.Background(), portal, nil, &bridgev2.UserLogin{}, post)
+
+	assert.Len(t, converted.Parts, 1)
+	assert.Contains(t, converted.Parts[0].Content.FormattedBody, "<strong>🚨 URGENT · ✅ Acknowledgement requested</strong>")
+	assert.Contains(t, converted.Parts[0].Content.Body, "Server is down")
+}
+
+func TestToMatrix_SystemPostIsNotice(t *testing.T) {
+	mc := &MessageConverter{}
+	portal := &bridgev2.Portal{
+		Portal: &database.Portal{
+			PortalKey: networkid.PortalKey{ID: networkid.PortalID("channel1")},
+		},
+	}
+	post := &model.Post{Message: "alice joined the channel.", Type: model.PostTypeJoinChannel}
+
+	converted := mc.ToMatrix(context.Background(), portal, nil, &bridgev2.UserLogin{}, post)
+
+	assert.Len(t, converted.Parts, 1)
+	assert.Equal(t, event.MsgNotice, converted.Parts[0].Content.MsgType)
+}
+
+func TestToMatrix_BotPostIsNotice(t *testing.T) {
+	mc := &MessageConverter{}
+	portal := &bridgev2.Portal{
+		Portal: &database.Portal{
+			PortalKey: networkid.PortalKey{ID: networkid.PortalID("channel1")},
+		},
+	}
+	post := &model.Post{Message: "Build passed", Props: model.StringInterface{model.PostPropsFromBot: "true"}}
+
+	converted := mc.ToMatrix(context.Background(), portal, nil, &bridgev2.UserLogin{}, post)
+	assert.Equal(t, event.MsgText, converted.Parts[0].Content.MsgType)
+
+	mc.BotNotices = true
+	converted = mc.ToMatrix(context.Background(), portal, nil, &bridgev2.UserLogin{}, post)
+	assert.Equal(t, event.MsgNotice, converted.Parts[0].Content.MsgType)
+	assert.False(t, mc.IsNoticePost(&model.Post{Message: "hello"}))
+}
+
+func TestPriorityLabel(t *testing.T) {
+	important := "important"
+	assert.Empty(t, PriorityLabel(nil))
+	assert.Empty(t, PriorityLabel(&model.PostPriority{}))
+	assert.Equal(t, "❗ IMPORTANT", PriorityLabel(&model.PostPriority{Priority: &important}))
+}
+
 func TestToMatrix_File(t *testing.T) {
 	mc := &MessageConverter{
 		ServerName:  "example.com",
@@ -169,8 +247,9 @@ func TestToMatrix_File(t *testing.T) {
 		FileIds: []string{fileID},
 	}
 	
-	// Mock GetFileWithInfo to return both content and metadata
-	mockAPI.On("GetFileWithInfo", mock.Anything, fileID).Return(fileContent, fileInfo, nil)
+	// Metadata is fetched before the content so limits can be checked first
+	mockAPI.On("GetFileInfo", mock.Anything, fileID).Return(fileInfo, nil)
+	mockAPI.On("GetFile", mock.Anything, fileID).Return(fileContent, nil)
 	mockMatrix.On("UploadMedia", mock.Anything, portal.MXID, fileContent, "test.png", "image/png").Return("mxc://example.com/xyz", nil, nil)
 
 	converted := mc.ToMatrix(ctx, portal, mockMatrix, source, post)
@@ -183,3 +262,324 @@ func TestToMatrix_File(t *testing.T) {
 	assert.Equal(t, 100, converted.Parts[0].Content.Info.Width)
 	assert.Equal(t, 100, converted.Parts[0].Content.Info.Height)
 }
+
+func makeTestPNG(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / w), G: uint8(y * 255 / h), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+// convertTestImage bridges a post with an image, with the preview Mattermost generated for
+// it if thumbContent is set, and returns the file info of the bridged image
+func convertTestImage(t *testing.T, fileInfo *model.FileInfo, fileContent, thumbContent []byte) (*event.FileInfo, *MockAPI) {
+	mc := &MessageConverter{
+		ServerName:  "example.com",
+		MaxFileSize: 50 * 1024 * 1024,
+	}
+	mockAPI := new(MockAPI)
+	mockMatrix := new(MockMatrixAPI)
+	portal := &bridgev2.Portal{
+		Portal: &database.Portal{
+			PortalKey: networkid.PortalKey{ID: networkid.PortalID("channel1")},
+			MXID:      id.RoomID("!room:example.com"),
+		},
+	}
+
+	mockAPI.On("GetFileInfo", mock.Anything, fileInfo.Id).Return(fileInfo, nil)
+	mockAPI.On("GetFile", mock.Anything, fileInfo.Id).Return(fileContent, nil)
+	mockMatrix.On("UploadMedia", mock.Anything, portal.MXID, fileContent, fileInfo.Name, fileInfo.MimeType).Return("mxc://example.com/full", nil, nil)
+	if thumbContent != nil {
+		fileInfo.HasPreviewImage = true
+		mockAPI.On("GetFileThumbnail", mock.Anything, fileInfo.Id).Return(thumbContent, nil)
+		mockMatrix.On("UploadMedia", mock.Anything, portal.MXID, thumbContent, "thumbnail.png", "image/png").Return("mxc://example.com/thumb", nil, nil)
+	}
+
+	source := &bridgev2.UserLogin{Client: mockAPI}
+	converted := mc.ToMatrix(context.Background(), portal, mockMatrix, source, &model.Post{FileIds: []string{fileInfo.Id}})
+	require.Len(t, converted.Parts, 1)
+	return converted.Parts[0].Content.Info, mockAPI
+}
+
+func TestToMatrix_ImageThumbnail(t *testing.T) {
+	t.Run("preview", func(t *testing.T) {
+		fileInfo := &model.FileInfo{Id: "file123", Name: "photo.png", MimeType: "image/png", Width: 64, Height: 48}
+		info, _ := convertTestImage(t, fileInfo, makeTestPNG(t, 64, 48), makeTestPNG(t, 16, 12))
+		assert.Equal(t, id.ContentURIString("mxc://example.com/thumb"), info.ThumbnailURL)
+		if assert.NotNil(t, info.ThumbnailInfo) {
+			assert.Equal(t, 16, info.ThumbnailInfo.Width)
+			assert.Equal(t, 12, info.ThumbnailInfo.Height)
+			assert.Equal(t, "image/png", info.ThumbnailInfo.MimeType)
+		}
+		assert.NotEmpty(t, info.Blurhash)
+		assert.Equal(t, info.Blurhash, info.AnoaBlurhash)
+	})
+
+	t.Run("no preview", func(t *testing.T) {
+		// The blurhash is computed from the image itself
+		fileInfo := &model.FileInfo{Id: "file456", Name: "small.png", MimeType: "image/png"}
+		info, mockAPI := convertTestImage(t, fileInfo, makeTestPNG(t, 32, 32), nil)
+		assert.Empty(t, info.ThumbnailURL)
+		assert.Nil(t, info.ThumbnailInfo)
+		assert.NotEmpty(t, info.Blurhash)
+		mockAPI.AssertNotCalled(t, "GetFileThumbnail", mock.Anything, fileInfo.Id)
+	})
+}
+
+func TestComputeBlurhash_LargeImages(t *testing.T) {
+	scaled := downscale(image.NewRGBA(image.Rect(0, 0, 640, 480)), blurhashSize)
+	assert.Equal(t, image.Rect(0, 0, 64, 48), scaled.Bounds())
+
+	hash, err := computeBlurhash(makeTestPNG(t, 200, 100))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, hash)
+
+	// A PNG claiming to be 20000x20000 is rejected from its header
+	data := makeTestPNG(t, 1, 1)
+	binary.BigEndian.PutUint32(data[16:20], 20000)
+	binary.BigEndian.PutUint32(data[20:24], 20000)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	_, err = computeBlurhash(data)
+	assert.ErrorContains(t, err, "too large")
+}
+
+func mp4Box(boxType string, body []byte) []byte {
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box[0:4], uint32(8+len(body)))
+	copy(box[4:8], boxType)
+	return append(box, body...)
+}
+
+// makeTestMP4 builds a minimal ISO BMFF header with a movie header and a single video track
+func makeTestMP4(timescale, duration uint32, width, height uint16) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:16], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:20], duration)
+
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:80], uint32(width)<<16)
+	binary.BigEndian.PutUint32(tkhd[80:84], uint32(height)<<16)
+
+	ftyp := mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2"))
+	moov := mp4Box("moov", append(mp4Box("mvhd", mvhd), mp4Box("trak", mp4Box("tkhd", tkhd))...))
+	return append(ftyp, moov...)
+}
+
+func TestProbeMediaMetadata_MP4(t *testing.T) {
+	meta := probeMediaMetadata(makeTestMP4(1000, 12345, 1280, 720))
+
+	assert.Equal(t, 12345, meta.Duration)
+	assert.Equal(t, 1280, meta.Width)
+	assert.Equal(t, 720, meta.Height)
+}
+
+func TestParseMovieHeader_LargeDuration(t *testing.T) {
+	mvhd := func(timescale uint32, duration uint64) []byte {
+		body := make([]byte, 112)
+		body[0] = 1
+		binary.BigEndian.PutUint32(body[20:24], timescale)
+		binary.BigEndian.PutUint64(body[24:32], duration)
+		return body
+	}
+
+	var meta mediaMetadata
+	parseMovieHeader(mvhd(90000, 90000*3600+45000), &meta)
+	assert.Equal(t, 3600500, meta.Duration)
+
+	// Durations that would overflow when scaled to milliseconds are dropped
+	meta = mediaMetadata{}
+	parseMovieHeader(mvhd(1<<31, 1<<54), &meta)
+	assert.Zero(t, meta.Duration)
+
+	meta = mediaMetadata{}
+	parseMovieHeader(mvhd(1000, ^uint64(0)), &meta)
+	assert.Zero(t, meta.Duration)
+}
+
+func TestProbeMediaMetadata_Unsupported(t *testing.T) {
+	assert.Equal(t, mediaMetadata{}, probeMediaMetadata([]byte("ID3\x04\x00not an mp4 file")))
+	assert.Equal(t, mediaMetadata{}, probeMediaMetadata(nil))
+}
+
+func TestResolveMimeType(t *testing.T) {
+	assert.Equal(t, "video/mp4", resolveMimeType("video/mp4", "clip.bin", "application/octet-stream"))
+	assert.Equal(t, "video/mp4", resolveMimeType("", "clip.mp4", "application/octet-stream"))
+	assert.Equal(t, "audio/mpeg", resolveMimeType("application/octet-stream", "song.MP3", "application/octet-stream"))
+	assert.Equal(t, "text/plain", resolveMimeType("", "README", "text/plain"))
+}
+
+func TestToMatrix_VideoMetadata(t *testing.T) {
+	mc := &MessageConverter{
+		ServerName:  "example.com",
+		MaxFileSize: 50 * 1024 * 1024,
+	}
+
+	ctx := context.Background()
+	mockAPI := new(MockAPI)
+	mockMatrix := new(MockMatrixAPI)
+
+	source := &bridgev2.UserLogin{
+		Client: mockAPI,
+	}
+	portal := &bridgev2.Portal{
+		Portal: &database.Portal{
+			PortalKey: networkid.PortalKey{ID: networkid.PortalID("channel1")},
+			MXID:      id.RoomID("!room:example.com"),
+		},
+	}
+
+	fileID := "video1"
+	fileContent := makeTestMP4(600, 3000, 640, 480)
+	fileInfo := &model.FileInfo{
+		Id:       fileID,
+		Name:     "clip.mp4",
+		MimeType: "video/mp4",
+	}
+
+	mockAPI.On("GetFileInfo", mock.Anything, fileID).Return(fileInfo, nil)
+	mockAPI.On("GetFile", mock.Anything, fileID).Return(fileContent, nil)
+	mockMatrix.On("UploadMedia", mock.Anything, portal.MXID, fileContent, "clip.mp4", "video/mp4").Return("mxc://example.com/clip", nil, nil)
+
+	converted := mc.ToMatrix(ctx, portal, mockMatrix, source, &model.Post{FileIds: []string{fileID}})
+
+	assert.Len(t, converted.Parts, 1)
+	content := converted.Parts[0].Content
+	assert.Equal(t, event.MsgVideo, content.MsgType)
+	assert.Equal(t, "video/mp4", content.Info.MimeType)
+	assert.Equal(t, 5000, content.Info.Duration)
+	assert.Equal(t, 640, content.Info.Width)
+	assert.Equal(t, 480, content.Info.Height)
+}
+
+func TestToMatrix_FileOverLinkThreshold(t *testing.T) {
+	mc := &MessageConverter{
+		ServerName:    "example.com",
+		MaxFileSize:   50 * 1024 * 1024,
+		LinkThreshold: 1024,
+	}
+
+	ctx := context.Background()
+	mockAPI := new(MockAPI)
+	source := &bridgev2.UserLogin{
+		Client: mockAPI,
+	}
+	portal := &bridgev2.Portal{
+		Portal: &database.Portal{
+			PortalKey: networkid.PortalKey{ID: networkid.PortalID("channel1")},
+			MXID:      id.RoomID("!room:example.com"),
+		},
+	}
+
+	fileID := "bigfile"
+	mockAPI.On("GetFileInfo", mock.Anything, fileID).Return(&model.FileInfo{
+		Id:       fileID,
+		Name:     "backup.zip",
+		MimeType: "application/zip",
+		Size:     5 * 1024 * 1024,
+	}, nil)
+
+	converted := mc.ToMatrix(ctx, portal, nil, source, &model.Post{FileIds: []string{fileID}})
+
+	assert.Len(t, converted.Parts, 1)
+	assert.Equal(t, event.MsgText, converted.Parts[0].Content.MsgType)
+	assert.Contains(t, converted.Parts[0].Content.Body, "backup.zip (5.0 MiB)")
+	mockAPI.AssertNotCalled(t, "GetFile", mock.Anything, fileID)
+}
+
+// clientMockAPI is a MockAPI with a Mattermost client
+type clientMockAPI struct {
+	*MockAPI
+	client *model.Client4
+}
+
+func (m *clientMockAPI) GetClient() *model.Client4 { return m.client }
+
+func TestCheckFileLimits_LinkNeedsLogin(t *testing.T) {
+	mc := &MessageConverter{LinkThreshold: 1024}
+	client := &clientMockAPI{MockAPI: new(MockAPI), client: model.NewAPIv4Client("https://mm.example.com")}
+
+	part := mc.checkFileLimits(client, "file1", "bigfile", "backup.zip", "application/zip", 5*1024*1024)
+	if assert.NotNil(t, part) {
+		assert.Equal(t, "📎 backup.zip (5.0 MiB): https://mm.example.com/api/v4/files/bigfile?download=1 (log in to Mattermost to download)", part.Content.Body)
+		assert.Contains(t, part.Content.FormattedBody, "(log in to Mattermost to download)")
+	}
+	assert.Nil(t, mc.checkFileLimits(client, "file1", "small", "small.txt", "text/plain", 10))
+}
+
+func TestMessageConverter_IsMimeTypeAllowed(t *testing.T) {
+	mc := &MessageConverter{}
+	assert.True(t, mc.IsMimeTypeAllowed("application/x-anything"))
+
+	mc.AllowedMimeTypes = []string{"image/*", "application/pdf"}
+	assert.True(t, mc.IsMimeTypeAllowed("image/png"))
+	assert.True(t, mc.IsMimeTypeAllowed("Application/PDF"))
+	assert.False(t, mc.IsMimeTypeAllowed("video/mp4"))
+	assert.False(t, mc.IsMimeTypeAllowed("imagex/png"))
+}
+
+func TestToMattermost_RejectedFileStatus(t *testing.T) {
+	mc := &MessageConverter{
+		MaxFileSizeToMattermost: 1024,
+		AllowedMimeTypes:        []string{"image/*"},
+	}
+	portal := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "channel1"}}}
+
+	_, err := mc.ToMattermost(context.Background(), &MockAPI{}, portal, "@alice:example.com", &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    "big.png",
+		Info:    &event.FileInfo{MimeType: "image/png", Size: 4096},
+	})
+	assert.ErrorContains(t, err, "file is too large")
+	status := bridgev2.WrapErrorInStatus(err)
+	assert.Equal(t, event.MessageStatusFail, status.Status)
+	assert.Equal(t, event.MessageStatusUnsupported, status.ErrorReason)
+	assert.True(t, status.SendNotice)
+	assert.Contains(t, status.Error(), "4.0 KiB")
+
+	_, err = mc.ToMattermost(context.Background(), &MockAPI{}, portal, "@alice:example.com", &event.MessageEventContent{
+		MsgType: event.MsgFile,
+		Body:    "archive.zip",
+		Info:    &event.FileInfo{MimeType: "application/zip", Size: 10},
+	})
+	assert.ErrorContains(t, err, "files of this type are not bridged (application/zip)")
+	assert.Equal(t, event.MessageStatusUnsupported, bridgev2.WrapErrorInStatus(err).ErrorReason)
+}
+
+func TestEditToMattermost(t *testing.T) {
+	mc := &MessageConverter{}
+	portal := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "channel1"}}}
+	ctx := context.Background()
+
+	message, err := mc.EditToMattermost(ctx, portal, "@alice:example.com", &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          "new text",
+		Format:        event.FormatHTML,
+		FormattedBody: "<b>new</b> text",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "**new** text", message)
+
+	// Edited captions replace the message without reuploading the file
+	message, err = mc.EditToMattermost(ctx, portal, "@alice:example.com", &event.MessageEventContent{
+		MsgType:  event.MsgImage,
+		Body:     "new caption",
+		FileName: "cat.png",
+		URL:      "mxc://example.com/cat",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "new caption", message)
+
+	// Removing the caption leaves the file without text
+	message, err = mc.EditToMattermost(ctx, portal, "@alice:example.com", &event.MessageEventContent{
+		MsgType:  event.MsgImage,
+		Body:     "cat.png",
+		FileName: "cat.png",
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, message)
+}
@@ -0,0 +1,65 @@
+package msgconv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// MaxMessageLength is the longest post message Mattermost accepts, in characters
+const MaxMessageLength = model.PostMessageMaxRunesV2
+
+// LongTextFileName is the name of the file long messages are uploaded as
+const LongTextFileName = "message.md"
+
+// longTextPreviewLength is how much of a message uploaded as a file is kept in its post
+const longTextPreviewLength = 500
+
+// SplitLongPost makes the message of a post fit in Mattermost. Messages over the long text
+// file threshold are uploaded as a file, keeping their beginning as a preview. Messages over
+// the Mattermost limit are split: the post keeps the first part, and the other parts are
+// returned to be sent as separate posts. The post's ChannelId must be set.
+func (mc *MessageConverter) SplitLongPost(ctx context.Context, client MattermostClientProvider, post *model.Post) ([]string, error) {
+	length := utf8.RuneCountInString(post.Message)
+	if mc.LongTextFileThreshold > 0 && length > mc.LongTextFileThreshold {
+		info, err := client.UploadFile(ctx, []byte(post.Message), post.ChannelId, LongTextFileName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload long message as file: %w", err)
+		}
+		post.FileIds = append(post.FileIds, info.Id)
+		post.Message = SplitText(post.Message, longTextPreviewLength)[0] + " …"
+		return nil, nil
+	} else if length <= MaxMessageLength {
+		return nil, nil
+	}
+	parts := SplitText(post.Message, MaxMessageLength)
+	post.Message = parts[0]
+	return parts[1:], nil
+}
+
+// SplitText splits a message into parts of at most maxLength characters. Parts end at
+// paragraph breaks, line breaks or spaces if possible, so that words aren't cut in half.
+func SplitText(text string, maxLength int) []string {
+	runes := []rune(text)
+	var parts []string
+	for len(runes) > maxLength {
+		cut := splitPoint(string(runes[:maxLength]))
+		parts = append(parts, strings.TrimRight(string(runes[:cut]), " \n"))
+		runes = []rune(strings.TrimLeft(string(runes[cut:]), " \n"))
+	}
+	return append(parts, string(runes))
+}
+
+// splitPoint returns the rune index to cut a too long message at: after its last paragraph
+// break, line break or space, or at the end if there's none
+func splitPoint(text string) int {
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if i := strings.LastIndex(text, sep); i > 0 {
+			return len([]rune(text[:i+len(sep)]))
+		}
+	}
+	return len([]rune(text))
+}
@@ -0,0 +1,65 @@
+package msgconv
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitText(t *testing.T) {
+	assert.Equal(t, []string{"short"}, SplitText("short", 10))
+	assert.Equal(t, []string{"first", "second"}, SplitText("first\n\nsecond", 10))
+	assert.Equal(t, []string{"one two", "three four"}, SplitText("one two three four", 10))
+	assert.Equal(t, []string{"abcdefghij", "klm"}, SplitText("abcdefghijklm", 10))
+	// Lengths are counted in characters, not bytes
+	assert.Equal(t, []string{"ääää", "öö"}, SplitText("ääää öö", 5))
+
+	long := strings.Repeat("word ", MaxMessageLength)
+	for _, part := range SplitText(long, MaxMessageLength) {
+		assert.LessOrEqual(t, len([]rune(part)), MaxMessageLength)
+	}
+}
+
+func TestSplitLongPost(t *testing.T) {
+	ctx := context.Background()
+	long := strings.Repeat("word ", 4000)
+
+	t.Run("short", func(t *testing.T) {
+		mc := &MessageConverter{}
+		post := &model.Post{ChannelId: "channel", Message: "short"}
+		parts, err := mc.SplitLongPost(ctx, &MockAPI{}, post)
+		require.NoError(t, err)
+		assert.Empty(t, parts)
+		assert.Equal(t, "short", post.Message)
+	})
+
+	t.Run("split", func(t *testing.T) {
+		mc := &MessageConverter{}
+		post := &model.Post{ChannelId: "channel", Message: long}
+		parts, err := mc.SplitLongPost(ctx, &MockAPI{}, post)
+		require.NoError(t, err)
+		assert.Len(t, parts, 1)
+		assert.Empty(t, post.FileIds)
+		assert.LessOrEqual(t, len([]rune(post.Message)), MaxMessageLength)
+		assert.Equal(t, long, post.Message+" "+parts[0])
+	})
+
+	t.Run("file", func(t *testing.T) {
+		mc := &MessageConverter{LongTextFileThreshold: 1000}
+		client := &MockAPI{}
+		client.On("UploadFile", mock.Anything, []byte(long), "channel", LongTextFileName).Return(&model.FileInfo{Id: "file"}, nil)
+		post := &model.Post{ChannelId: "channel", Message: long}
+		parts, err := mc.SplitLongPost(ctx, client, post)
+		require.NoError(t, err)
+		assert.Empty(t, parts)
+		assert.Equal(t, model.StringArray{"file"}, post.FileIds)
+		assert.True(t, strings.HasSuffix(post.Message, " …"))
+		assert.Less(t, len([]rune(post.Message)), 1000)
+		client.AssertExpectations(t)
+	})
+}
@@ -0,0 +1,156 @@
+package msgconv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strings"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+// Blurhash component counts recommended by the Matrix spec proposal (MSC2448)
+const (
+	blurhashXComponents = 4
+	blurhashYComponents = 3
+)
+
+// maxBlurhashPixels is the largest image a blurhash is computed for. Larger images are
+// rejected before decoding them, as decoding them would need too much memory.
+const maxBlurhashPixels = 16_000_000
+
+// blurhashSize is the largest width and height images are scaled down to before encoding
+// them as a blurhash, which only keeps a few components anyway
+const blurhashSize = 64
+
+// addThumbnail fills the thumbnail and blurhash fields of info for images and videos.
+// The thumbnail is generated by Mattermost (only available when HasPreviewImage is set),
+// the bridge only scales images down for blurhashes. If no thumbnail exists, the blurhash
+// is computed from the original image data instead, unless it's too large.
+func (mc *MessageConverter) addThumbnail(
+	ctx context.Context,
+	portal *bridgev2.Portal,
+	intent bridgev2.MatrixAPI,
+	client MattermostClientProvider,
+	fileInfo *model.FileInfo,
+	data []byte,
+	info *event.FileInfo,
+) {
+	log := zerolog.Ctx(ctx)
+
+	isImage := strings.HasPrefix(info.MimeType, "image/")
+	isVideo := strings.HasPrefix(info.MimeType, "video/")
+	if !isImage && !isVideo {
+		return
+	}
+
+	var thumbData []byte
+	if fileInfo != nil && fileInfo.HasPreviewImage {
+		var err error
+		thumbData, err = client.GetFileThumbnail(ctx, fileInfo.Id)
+		if err != nil {
+			log.Debug().Err(err).Msg("Failed to get file thumbnail from Mattermost")
+			thumbData = nil
+		}
+	}
+
+	// Blurhash source: prefer the small thumbnail, fall back to the full image
+	hashSource := thumbData
+	if len(hashSource) == 0 && isImage {
+		hashSource = data
+	}
+	if len(hashSource) > 0 {
+		if hash, err := computeBlurhash(hashSource); err != nil {
+			log.Debug().Err(err).Msg("Failed to compute blurhash")
+		} else {
+			info.Blurhash = hash
+			info.AnoaBlurhash = hash
+		}
+	}
+
+	if len(thumbData) == 0 {
+		return
+	}
+
+	thumbMime := http.DetectContentType(thumbData)
+	thumbInfo := &event.FileInfo{
+		MimeType: thumbMime,
+		Size:     len(thumbData),
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(thumbData)); err == nil {
+		thumbInfo.Width = cfg.Width
+		thumbInfo.Height = cfg.Height
+	}
+
+	mxc, file, err := intent.UploadMedia(ctx, portal.MXID, thumbData, "thumbnail"+extensionForMime(thumbMime), thumbMime)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to upload thumbnail to Matrix")
+		return
+	}
+	if file != nil {
+		info.ThumbnailFile = file
+	} else {
+		info.ThumbnailURL = mxc
+	}
+	info.ThumbnailInfo = thumbInfo
+}
+
+// computeBlurhash decodes an image and encodes it as a blurhash string. Images larger than
+// maxBlurhashPixels are rejected, and others are scaled down first.
+func computeBlurhash(data []byte) (string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	} else if cfg.Width*cfg.Height > maxBlurhashPixels {
+		return "", fmt.Errorf("image is too large for a blurhash (%dx%d)", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	return blurhash.Encode(blurhashXComponents, blurhashYComponents, downscale(img, blurhashSize))
+}
+
+// downscale scales an image down with nearest neighbor sampling, so that neither side is
+// longer than size. Smaller images are returned as is.
+func downscale(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+	newWidth, newHeight := size, size
+	if width > height {
+		newHeight = max(1, height*size/width)
+	} else {
+		newWidth = max(1, width*size/height)
+	}
+	scaled := image.NewNRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := range newHeight {
+		for x := range newWidth {
+			scaled.Set(x, y, img.At(bounds.Min.X+x*width/newWidth, bounds.Min.Y+y*height/newHeight))
+		}
+	}
+	return scaled
+}
+
+func extensionForMime(mimeType string) string {
+	switch mimeType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	}
+	return ""
+}
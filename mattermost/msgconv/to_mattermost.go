@@ -9,6 +9,7 @@ import (
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 )
 
 var converter *md.Converter
@@ -21,32 +22,34 @@ func (mc *MessageConverter) ToMattermost(
 	ctx context.Context,
 	client MattermostClientProvider,
 	portal *bridgev2.Portal,
+	sender id.UserID,
 	content *event.MessageEventContent,
 ) (*model.Post, error) {
-	log := zerolog.Ctx(ctx)
-
-	post := &model.Post{}
-
-	// Convert Text
-	var body string
-	if content.Format == event.FormatHTML {
-		var err error
-		body, err = converter.ConvertString(content.FormattedBody)
-		if err != nil {
-			log.Warn().Err(err).Msg("Failed to convert HTML to Markdown, falling back to plain text")
-			body = content.Body
-		}
-	} else {
-		body = content.Body
+	body, err := mc.convertBody(ctx, portal, sender, content)
+	if err != nil {
+		return nil, err
 	}
-	post.Message = body
-	log.Info().Str("body", body).Msg("ToMattermost converted body")
+	post := &model.Post{Message: body}
+	zerolog.Ctx(ctx).Info().Str("body", body).Msg("ToMattermost converted body")
 
 	// Handle Media
-	if content.MsgType == event.MsgImage || content.MsgType == event.MsgFile || content.MsgType == event.MsgVideo || content.MsgType == event.MsgAudio {
+	if isMedia(content.MsgType) {
+		if content.Info != nil {
+			if content.Info.MimeType != "" && !mc.IsMimeTypeAllowed(content.Info.MimeType) {
+				return nil, fmt.Errorf("%w (%s)", ErrFileTypeNotAllowed, content.Info.MimeType)
+			}
+			if mc.MaxFileSizeToMattermost > 0 && int64(content.Info.Size) > mc.MaxFileSizeToMattermost {
+				return nil, fmt.Errorf("%w (%s, limit %s)", ErrFileTooLarge, formatFileSize(int64(content.Info.Size)), formatFileSize(mc.MaxFileSizeToMattermost))
+			}
+		}
+
 		data, err := mc.Bridge.Bot.DownloadMedia(ctx, content.URL, content.File)
 		if err != nil {
-			return nil, fmt.Errorf("failed to download media from Matrix: %w", err)
+			return nil, fmt.Errorf("%w: %w", bridgev2.ErrMediaDownloadFailed, err)
+		}
+		// The size in info is optional and client-provided, so check the real size too
+		if mc.MaxFileSizeToMattermost > 0 && int64(len(data)) > mc.MaxFileSizeToMattermost {
+			return nil, fmt.Errorf("%w (%s, limit %s)", ErrFileTooLarge, formatFileSize(int64(len(data))), formatFileSize(mc.MaxFileSizeToMattermost))
 		}
 
 		fileName := content.FileName
@@ -59,7 +62,7 @@ func (mc *MessageConverter) ToMattermost(
 
 		fileInfo, err := client.UploadFile(ctx, data, string(portal.ID), fileName)
 		if err != nil {
-			return nil, fmt.Errorf("failed to upload file to Mattermost: %w", err)
+			return nil, fmt.Errorf("%w: %w", bridgev2.ErrMediaReuploadFailed, err)
 		}
 		if fileInfo != nil {
 			post.FileIds = []string{fileInfo.Id}
@@ -68,3 +71,43 @@ func (mc *MessageConverter) ToMattermost(
 
 	return post, nil
 }
+
+// EditToMattermost converts the new content of an edited Matrix message to the message of
+// its Mattermost post. Mattermost posts can't get new files, so only the text or caption of
+// the content is converted, and the post keeps the files it has.
+func (mc *MessageConverter) EditToMattermost(
+	ctx context.Context,
+	portal *bridgev2.Portal,
+	sender id.UserID,
+	content *event.MessageEventContent,
+) (string, error) {
+	return mc.convertBody(ctx, portal, sender, content)
+}
+
+// convertBody converts the text of a Matrix message to Markdown. The body of a file is a
+// caption only if the file name is set separately, so files without one have no text.
+func (mc *MessageConverter) convertBody(ctx context.Context, portal *bridgev2.Portal, sender id.UserID, content *event.MessageEventContent) (string, error) {
+	var body string
+	if content.Format == event.FormatHTML {
+		var err error
+		body, err = converter.ConvertString(content.FormattedBody)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to convert HTML to Markdown, falling back to plain text")
+			body = content.Body
+		}
+	} else {
+		body = content.Body
+	}
+	body, ok := mc.FilterText(portal, string(sender), body)
+	if !ok {
+		return "", ErrMessageFiltered
+	}
+	if isMedia(content.MsgType) && (content.FileName == "" || content.Body == content.FileName) {
+		return "", nil
+	}
+	return body, nil
+}
+
+func isMedia(msgType event.MessageType) bool {
+	return msgType == event.MsgImage || msgType == event.MsgFile || msgType == event.MsgVideo || msgType == event.MsgAudio
+}
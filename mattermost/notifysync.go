@@ -0,0 +1,205 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+// notificationLevel is the notification setting of a room, as Matrix clients set it with
+// room-specific push rules
+type notificationLevel string
+
+const (
+	// notifyDefault means the room has no push rule of its own
+	notifyDefault notificationLevel = ""
+	// notifyAll is a room rule that notifies, "all messages"
+	notifyAll notificationLevel = "all"
+	// notifyMentions is a room rule that doesn't notify, "mentions & keywords". The bridge
+	// also mutes rooms like this when the homeserver doesn't support mute account data.
+	notifyMentions notificationLevel = "mention"
+	// notifyMuted is an override rule for the room that doesn't notify, "mute"
+	notifyMuted notificationLevel = "muted"
+)
+
+// notifyProps returns the channel member notify props that match a notification level.
+// Muting only sets mark_unread, like muting a channel on Mattermost, and "mentions &
+// keywords" leaves it alone, as it's also how muted rooms look on some homeservers.
+func (level notificationLevel) notifyProps() map[string]string {
+	switch level {
+	case notifyMuted:
+		return map[string]string{model.MarkUnreadNotifyProp: model.ChannelMarkUnreadMention}
+	case notifyMentions:
+		return map[string]string{
+			model.DesktopNotifyProp: model.ChannelNotifyMention,
+			model.PushNotifyProp:    model.ChannelNotifyMention,
+		}
+	case notifyAll:
+		return map[string]string{
+			model.DesktopNotifyProp:    model.ChannelNotifyAll,
+			model.PushNotifyProp:       model.ChannelNotifyAll,
+			model.MarkUnreadNotifyProp: model.ChannelMarkUnreadAll,
+		}
+	default:
+		return map[string]string{
+			model.DesktopNotifyProp:    model.ChannelNotifyDefault,
+			model.PushNotifyProp:       model.ChannelNotifyDefault,
+			model.MarkUnreadNotifyProp: model.ChannelMarkUnreadAll,
+		}
+	}
+}
+
+// roomNotificationLevels returns the notification level of every room that has push rules
+// of its own. Override rules win over room rules, like they do when pushing.
+func roomNotificationLevels(rules *pushrules.PushRuleset) map[id.RoomID]notificationLevel {
+	levels := make(map[id.RoomID]notificationLevel)
+	if rules == nil {
+		return levels
+	}
+	for roomID, rule := range rules.Room.Map {
+		if !rule.Enabled || !strings.HasPrefix(roomID, "!") {
+			continue
+		}
+		if rule.Actions.Should().Notify {
+			levels[id.RoomID(roomID)] = notifyAll
+		} else {
+			levels[id.RoomID(roomID)] = notifyMentions
+		}
+	}
+	for _, rule := range rules.Override {
+		if !rule.Enabled || rule.Default || rule.Actions.Should().Notify {
+			continue
+		}
+		if roomID := mutedRoomID(rule); roomID != "" {
+			levels[roomID] = notifyMuted
+		}
+	}
+	return levels
+}
+
+// mutedRoomID returns the room an override rule applies to, if its only condition is a
+// room ID match
+func mutedRoomID(rule *pushrules.PushRule) id.RoomID {
+	if len(rule.Conditions) != 1 {
+		return ""
+	}
+	cond := rule.Conditions[0]
+	if cond.Kind != pushrules.KindEventMatch || cond.Key != "room_id" || !strings.HasPrefix(cond.Pattern, "!") {
+		return ""
+	}
+	return id.RoomID(cond.Pattern)
+}
+
+// changedNotificationLevels returns the rooms whose level differs between two polls.
+// Rooms whose push rules were removed are back to the default level.
+func changedNotificationLevels(prev, cur map[id.RoomID]notificationLevel) map[id.RoomID]notificationLevel {
+	changed := make(map[id.RoomID]notificationLevel)
+	for roomID, level := range cur {
+		if prevLevel, ok := prev[roomID]; !ok || prevLevel != level {
+			changed[roomID] = level
+		}
+	}
+	for roomID := range prev {
+		if _, ok := cur[roomID]; !ok {
+			changed[roomID] = notifyDefault
+		}
+	}
+	return changed
+}
+
+// notificationSync remembers the notification levels seen in the last poll of each login
+type notificationSync struct {
+	lock   sync.Mutex
+	levels map[networkid.UserLoginID]map[id.RoomID]notificationLevel
+}
+
+// swap stores the levels of a login and returns the previous ones
+func (s *notificationSync) swap(loginID networkid.UserLoginID, levels map[id.RoomID]notificationLevel) map[id.RoomID]notificationLevel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.levels == nil {
+		s.levels = make(map[networkid.UserLoginID]map[id.RoomID]notificationLevel)
+	}
+	prev := s.levels[loginID]
+	s.levels[loginID] = maps.Clone(levels)
+	return prev
+}
+
+// runNotificationSync copies the notification settings of portals from the double puppets'
+// push rules to Mattermost every notification_sync minutes. Homeservers don't send push
+// rule changes to appservices, so they're polled.
+func (m *MattermostConnector) runNotificationSync(ctx context.Context) {
+	if m.config().NotificationSync <= 0 {
+		return
+	}
+	interval := time.Duration(m.config().NotificationSync) * time.Minute
+	log := m.moduleLog(LogModuleSync).With().Str("action", "notification sync").Logger()
+	ctx = log.WithContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, login := range m.GetUsers() {
+			if err := m.syncLoginNotifications(ctx, login); err != nil {
+				log.Warn().Err(err).Str("login_id", string(login.ID)).Msg("Failed to sync notification settings")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncLoginNotifications applies the push rules of a login's double puppet that changed
+// since the last poll to the channels of its portals
+func (m *MattermostConnector) syncLoginNotifications(ctx context.Context, login *bridgev2.UserLogin) error {
+	if login.User == nil || !m.canDoublePuppet(login) {
+		return nil
+	}
+	api, ok := login.Client.(*MattermostAPI)
+	if !ok || api.Client() == nil {
+		return nil
+	}
+	intent := asIntent(login.User.DoublePuppet(ctx))
+	if intent == nil {
+		return nil
+	}
+	rules, err := intent.GetPushRules(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get push rules: %w", err)
+	}
+	levels := roomNotificationLevels(rules)
+	prev := m.notificationSync.swap(login.ID, levels)
+	for roomID, level := range changedNotificationLevels(prev, levels) {
+		portal, err := m.Bridge.GetPortalByMXID(ctx, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to get portal of %s: %w", roomID, err)
+		} else if portal == nil || !isChannelPortal(portal) || !m.ownsChannel(string(portal.ID)) {
+			continue
+		}
+		if err = api.setNotificationLevel(ctx, string(portal.ID), level); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Stringer("room_id", roomID).Msg("Failed to update channel notify props")
+		}
+	}
+	return nil
+}
+
+// setNotificationLevel updates the user's notify props of a channel to match a level
+func (m *MattermostAPI) setNotificationLevel(ctx context.Context, channelID string, level notificationLevel) error {
+	resp, err := m.Client().UpdateChannelNotifyProps(ctx, channelID, m.getOwnMMID(), level.notifyProps())
+	if err != nil {
+		return wrapMattermostError(resp, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/pushrules"
+)
+
+func TestRoomNotificationLevels(t *testing.T) {
+	rules := &pushrules.PushRuleset{
+		Room: pushrules.PushRuleMap{Map: map[string]*pushrules.PushRule{
+			"!loud:example.com":     {RuleID: "!loud:example.com", Enabled: true, Actions: pushrules.PushActionArray{{Action: pushrules.ActionNotify}}},
+			"!mentions:example.com": {RuleID: "!mentions:example.com", Enabled: true, Actions: pushrules.PushActionArray{{Action: pushrules.ActionDontNotify}}},
+			"!muted:example.com":    {RuleID: "!muted:example.com", Enabled: true, Actions: pushrules.PushActionArray{{Action: pushrules.ActionNotify}}},
+			"!disabled:example.com": {RuleID: "!disabled:example.com", Enabled: false},
+		}},
+		Override: pushrules.PushRuleArray{
+			{RuleID: ".m.rule.master", Default: true, Enabled: true},
+			{RuleID: "!muted:example.com", Enabled: true, Conditions: []*pushrules.PushCondition{
+				{Kind: pushrules.KindEventMatch, Key: "room_id", Pattern: "!muted:example.com"},
+			}},
+		},
+	}
+	assert.Equal(t, map[id.RoomID]notificationLevel{
+		"!loud:example.com":     notifyAll,
+		"!mentions:example.com": notifyMentions,
+		"!muted:example.com":    notifyMuted,
+	}, roomNotificationLevels(rules))
+	assert.Empty(t, roomNotificationLevels(nil))
+}
+
+func TestChangedNotificationLevels(t *testing.T) {
+	prev := map[id.RoomID]notificationLevel{"!a:x": notifyMuted, "!b:x": notifyAll, "!c:x": notifyMentions}
+	cur := map[id.RoomID]notificationLevel{"!a:x": notifyMuted, "!b:x": notifyMentions, "!d:x": notifyAll}
+	assert.Equal(t, map[id.RoomID]notificationLevel{
+		"!b:x": notifyMentions,
+		"!c:x": notifyDefault,
+		"!d:x": notifyAll,
+	}, changedNotificationLevels(prev, cur))
+	assert.Equal(t, cur, changedNotificationLevels(nil, cur))
+
+	var s notificationSync
+	assert.Nil(t, s.swap("alice", prev))
+	assert.Equal(t, prev, s.swap("alice", cur))
+}
+
+func TestSetNotificationLevel(t *testing.T) {
+	var props map[string]string
+	api := newPrefsTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v4/channels/channel1/members/user1/notify_props", r.URL.Path)
+		props = nil
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&props))
+		_, _ = w.Write([]byte(`{"status": "OK"}`))
+	})
+	ctx := context.Background()
+
+	require.NoError(t, api.setNotificationLevel(ctx, "channel1", notifyMentions))
+	assert.Equal(t, model.ChannelNotifyMention, props[model.DesktopNotifyProp])
+	assert.Equal(t, model.ChannelNotifyMention, props[model.PushNotifyProp])
+	assert.NotContains(t, props, model.MarkUnreadNotifyProp, "rooms muted by the bridge look like mentions only")
+
+	require.NoError(t, api.setNotificationLevel(ctx, "channel1", notifyMuted))
+	assert.Equal(t, map[string]string{model.MarkUnreadNotifyProp: model.ChannelMarkUnreadMention}, props)
+
+	require.NoError(t, api.setNotificationLevel(ctx, "channel1", notifyDefault))
+	assert.Equal(t, model.ChannelNotifyDefault, props[model.DesktopNotifyProp])
+	assert.Equal(t, model.ChannelMarkUnreadAll, props[model.MarkUnreadNotifyProp])
+}
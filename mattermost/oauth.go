@@ -0,0 +1,255 @@
+package mattermost
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// OAuthConfig configures logging in through a Mattermost OAuth 2.0 application, which
+// also works for users who sign in to Mattermost with GitLab, OpenID Connect or SAML.
+// The application must be registered in Mattermost with the callback URL
+// <appservice.public_address>/mattermost/oauth/callback.
+type OAuthConfig struct {
+	ClientID         string `yaml:"client_id"`
+	ClientSecret     string `yaml:"client_secret"`
+	ClientSecretFile string `yaml:"client_secret_file"`
+}
+
+const (
+	oauthCallbackPath = "/mattermost/oauth/callback"
+	oauthLoginTimeout = 10 * time.Minute
+)
+
+var (
+	ErrOAuthNotConfigured = errors.New("SSO login is not configured")
+	ErrOAuthTimeout       = errors.New("timed out waiting for SSO login")
+)
+
+// oauthRedirectURL returns the OAuth callback URL of the bridge, or an empty string if
+// SSO login isn't configured or the bridge has no public address to receive callbacks on.
+func (m *MattermostConnector) oauthRedirectURL() string {
+	if m.config() == nil || m.config().OAuth.ClientID == "" || m.Bridge == nil {
+		return ""
+	}
+	server, ok := m.Bridge.Matrix.(bridgev2.MatrixConnectorWithServer)
+	if !ok || server.GetRouter() == nil {
+		return ""
+	}
+	return strings.TrimRight(server.GetPublicAddress(), "/") + oauthCallbackPath
+}
+
+// registerOAuthCallback adds the OAuth callback endpoint to the appservice HTTP server
+func (m *MattermostConnector) registerOAuthCallback() {
+	if m.oauthRedirectURL() == "" {
+		return
+	}
+	m.oauthLogins = make(map[string]*SSOLogin)
+	router := m.Bridge.Matrix.(bridgev2.MatrixConnectorWithServer).GetRouter()
+	router.HandleFunc(oauthCallbackPath, m.handleOAuthCallback).Methods(http.MethodGet)
+	log := m.moduleLog(LogModuleConnector)
+	log.Info().Str("redirect_url", m.oauthRedirectURL()).Msg("SSO login enabled")
+}
+
+// handleOAuthCallback receives the authorization code after the user logged in to Mattermost
+// and passes it to the waiting login process
+func (m *MattermostConnector) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	m.oauthLock.Lock()
+	login, ok := m.oauthLogins[query.Get("state")]
+	delete(m.oauthLogins, query.Get("state"))
+	m.oauthLock.Unlock()
+	if !ok {
+		http.Error(w, "Unknown or expired login, please start the login again.", http.StatusBadRequest)
+		return
+	}
+
+	result := oauthResult{code: query.Get("code")}
+	if errCode := query.Get("error"); errCode != "" {
+		result.err = fmt.Errorf("mattermost returned an error: %s %s", errCode, query.Get("error_description"))
+	} else if result.code == "" {
+		result.err = errors.New("mattermost didn't return an authorization code")
+	}
+	login.result <- result
+
+	if result.err != nil {
+		http.Error(w, "Login failed, please return to Matrix and try again.", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("Login successful, you can close this page and return to Matrix."))
+}
+
+type oauthResult struct {
+	code string
+	err  error
+}
+
+// OAuthToken is the token response of the Mattermost OAuth 2.0 token endpoint
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// exchangeOAuthCode trades an authorization code for an access token
+func (m *MattermostConnector) exchangeOAuthCode(ctx context.Context, code string) (*OAuthToken, error) {
+	return m.requestOAuthToken(ctx, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {m.oauthRedirectURL()},
+	})
+}
+
+// requestOAuthToken requests an access token from the token endpoint with the client
+// credentials of the bridge added to form
+func (m *MattermostConnector) requestOAuthToken(ctx context.Context, form url.Values) (*OAuthToken, error) {
+	form.Set("client_id", m.config().OAuth.ClientID)
+	form.Set("client_secret", m.config().OAuth.ClientSecret)
+	tokenURL := strings.TrimRight(m.config().ServerURL, "/") + "/oauth/access_token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request failed with status %d", resp.StatusCode)
+	}
+	var token OAuthToken
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %w", err)
+	} else if token.AccessToken == "" {
+		return nil, errors.New("token response didn't contain an access token")
+	}
+	return &token, nil
+}
+
+// oauthTokenMetadata returns the login metadata of an access token
+func oauthTokenMetadata(token *OAuthToken) map[string]any {
+	metadata := map[string]any{
+		"token":         token.AccessToken,
+		"refresh_token": token.RefreshToken,
+	}
+	if token.ExpiresIn > 0 {
+		metadata["token_expiry"] = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second).Unix()
+	}
+	return metadata
+}
+
+// SSOLogin logs in through the Mattermost OAuth 2.0 authorization flow
+type SSOLogin struct {
+	user      *bridgev2.User
+	connector *MattermostConnector
+	state     string
+	result    chan oauthResult
+	// pending is set while the user is asked whether to take over the account
+	pending *pendingLogin
+	// relogin is the login whose token is being replaced, if any
+	relogin *bridgev2.UserLogin
+}
+
+var _ bridgev2.LoginProcessUserInput = (*SSOLogin)(nil)
+
+func (s *SSOLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
+	redirectURL := s.connector.oauthRedirectURL()
+	if redirectURL == "" {
+		return nil, ErrOAuthNotConfigured
+	}
+	stateBytes := make([]byte, 16)
+	if _, err := rand.Read(stateBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate state: %w", err)
+	}
+	s.state = hex.EncodeToString(stateBytes)
+	s.result = make(chan oauthResult, 1)
+	s.connector.oauthLock.Lock()
+	s.connector.oauthLogins[s.state] = s
+	s.connector.oauthLock.Unlock()
+
+	authURL := strings.TrimRight(s.connector.config().ServerURL, "/") + "/oauth/authorize?" + url.Values{
+		"response_type": {"code"},
+		"client_id":     {s.connector.config().OAuth.ClientID},
+		"redirect_uri":  {redirectURL},
+		"state":         {s.state},
+	}.Encode()
+	return &bridgev2.LoginStep{
+		Type:         bridgev2.LoginStepTypeDisplayAndWait,
+		StepID:       "sso",
+		Instructions: fmt.Sprintf("Open %s and log in to Mattermost. The link is valid for %d minutes.", authURL, int(oauthLoginTimeout.Minutes())),
+		DisplayAndWaitParams: &bridgev2.LoginDisplayAndWaitParams{
+			Type: bridgev2.LoginDisplayTypeNothing,
+		},
+	}, nil
+}
+
+func (s *SSOLogin) Wait(ctx context.Context) (*bridgev2.LoginStep, error) {
+	var result oauthResult
+	select {
+	case result = <-s.result:
+	case <-time.After(oauthLoginTimeout):
+		s.Cancel()
+		return nil, ErrOAuthTimeout
+	case <-ctx.Done():
+		s.Cancel()
+		return nil, ctx.Err()
+	}
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	token, err := s.connector.exchangeOAuthCode(ctx, result.code)
+	if err != nil {
+		return nil, err
+	}
+	client := NewClient(s.connector.config().ServerURL, token.AccessToken)
+	me, _, err := client.GetMe(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Mattermost user: %w", err)
+	}
+	if err = checkRelogin(s.relogin, me.Id); err != nil {
+		return nil, err
+	}
+
+	metadata := oauthTokenMetadata(token)
+	metadata["mm_id"] = me.Id
+	metadata["oauth"] = true
+	step, pending, err := s.connector.finishLogin(ctx, s.user, "", &database.UserLogin{
+		ID:         networkid.UserLoginID(me.Username),
+		RemoteName: me.Username,
+		Metadata:   metadata,
+	})
+	s.pending = pending
+	return step, err
+}
+
+// SubmitUserInput answers whether to take over an account another Matrix user is logged
+// in with
+func (s *SSOLogin) SubmitUserInput(ctx context.Context, input map[string]string) (*bridgev2.LoginStep, error) {
+	if s.pending == nil {
+		return nil, fmt.Errorf("unexpected login step")
+	}
+	return s.pending.submit(ctx, input)
+}
+
+func (s *SSOLogin) Cancel() {
+	s.connector.oauthLock.Lock()
+	delete(s.connector.oauthLogins, s.state)
+	s.connector.oauthLock.Unlock()
+}
@@ -0,0 +1,66 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleOAuthCallback(t *testing.T) {
+	connector := &MattermostConnector{oauthLogins: make(map[string]*SSOLogin)}
+	login := &SSOLogin{connector: connector, state: "state1", result: make(chan oauthResult, 1)}
+	connector.oauthLogins["state1"] = login
+
+	rec := httptest.NewRecorder()
+	connector.handleOAuthCallback(rec, httptest.NewRequest(http.MethodGet, oauthCallbackPath+"?state=state1&code=abc", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	result := <-login.result
+	assert.NoError(t, result.err)
+	assert.Equal(t, "abc", result.code)
+	assert.Empty(t, connector.oauthLogins)
+
+	// The state can only be used once
+	rec = httptest.NewRecorder()
+	connector.handleOAuthCallback(rec, httptest.NewRequest(http.MethodGet, oauthCallbackPath+"?state=state1&code=abc", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHandleOAuthCallback_Error(t *testing.T) {
+	connector := &MattermostConnector{oauthLogins: make(map[string]*SSOLogin)}
+	login := &SSOLogin{connector: connector, state: "state1", result: make(chan oauthResult, 1)}
+	connector.oauthLogins["state1"] = login
+
+	rec := httptest.NewRecorder()
+	connector.handleOAuthCallback(rec, httptest.NewRequest(http.MethodGet, oauthCallbackPath+"?state=state1&error=access_denied", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	result := <-login.result
+	assert.ErrorContains(t, result.err, "access_denied")
+}
+
+func TestExchangeOAuthCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/oauth/access_token", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "authorization_code", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "client", r.PostForm.Get("client_id"))
+		assert.Equal(t, "secret", r.PostForm.Get("client_secret"))
+		assert.Equal(t, "abc", r.PostForm.Get("code"))
+		_ = json.NewEncoder(w).Encode(OAuthToken{AccessToken: "access", RefreshToken: "refresh", ExpiresIn: 3600})
+	}))
+	defer server.Close()
+
+	connector := &MattermostConnector{Config: &NetworkConfig{
+		ServerURL: server.URL,
+		OAuth:     OAuthConfig{ClientID: "client", ClientSecret: "secret"},
+	}}
+	token, err := connector.exchangeOAuthCode(context.Background(), "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "access", token.AccessToken)
+	assert.Equal(t, "refresh", token.RefreshToken)
+	assert.Equal(t, int64(3600), token.ExpiresIn)
+}
@@ -0,0 +1,112 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// Mattermost shows a preview of the post a permalink points to under the post that links
+// it. On Matrix, the link alone would only lead back to Mattermost, so posts that link a
+// post bridged to the same room are sent as a reply to it, and other linked posts are
+// quoted, with a link to their Matrix event if they were bridged to another room.
+
+// permalinkPreview returns the post a post previews with a permalink, or nil if there is
+// none. Embeds decoded from JSON have their data as a map, and posts without metadata
+// only have the ID of the previewed post.
+func permalinkPreview(post *model.Post) *model.PreviewPost {
+	if preview := post.GetPreviewPost(); preview != nil {
+		return preview
+	}
+	if post.Metadata != nil {
+		for _, embed := range post.Metadata.Embeds {
+			if embed == nil || embed.Type != model.PostEmbedPermalink || embed.Data == nil {
+				continue
+			}
+			data, err := json.Marshal(embed.Data)
+			if err != nil {
+				continue
+			}
+			var preview model.PreviewPost
+			if err = json.Unmarshal(data, &preview); err == nil && preview.PostID != "" {
+				return &preview
+			}
+		}
+	}
+	if postID := post.GetPreviewedPostProp(); postID != "" {
+		return &model.PreviewPost{PostID: postID}
+	}
+	return nil
+}
+
+// permalinkQuote renders the quote of a previewed post, with a link to its Matrix event if
+// it's known
+func permalinkQuote(username, channel, text, eventURL string) event.MessageEventContent {
+	if utf8.RuneCountInString(text) > threadRootQuoteMaxRunes {
+		text = string([]rune(text)[:threadRootQuoteMaxRunes]) + "…"
+	}
+	header := "**@" + username + "** wrote"
+	if channel != "" {
+		header += " in **" + channel + "**"
+	}
+	if eventURL != "" {
+		header += " ([view message](" + eventURL + "))"
+	}
+	lines := strings.Split(header+":\n"+text, "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+	return format.RenderMarkdown(strings.Join(lines, "\n"), true, false)
+}
+
+// renderPermalink turns the permalink preview of a post into a reply to the linked post if
+// it's in the same room, or a quote of it otherwise
+func (m *MattermostConnector) renderPermalink(ctx context.Context, portal *bridgev2.Portal, client *Client, msg *bridgev2.ConvertedMessage, preview *model.PreviewPost) {
+	if preview == nil || preview.PostID == "" {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Str("previewed_post_id", preview.PostID).Logger()
+	var eventURL string
+	if portal.Bridge != nil && portal.Bridge.DB != nil {
+		linked, err := portal.Bridge.DB.Message.GetFirstPartByID(ctx, portal.Receiver, networkid.MessageID(preview.PostID))
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to get previewed post from database")
+		} else if linked != nil && linked.Room == portal.PortalKey {
+			if msg.ReplyTo == nil {
+				msg.ReplyTo = &networkid.MessageOptionalPartID{MessageID: linked.ID}
+			}
+			return
+		} else if linked != nil {
+			linkedPortal, err := portal.Bridge.GetExistingPortalByKey(ctx, linked.Room)
+			if err == nil && linkedPortal != nil && linkedPortal.MXID != "" {
+				eventURL = linkedPortal.MXID.EventURI(linked.MXID).MatrixToURL()
+			}
+		}
+	}
+	linkedPost := preview.Post
+	if linkedPost == nil {
+		post, resp, err := client.GetPost(ctx, preview.PostID, "")
+		if err != nil {
+			log.Debug().Err(wrapMattermostError(resp, err)).Msg("Failed to get previewed post to quote it")
+			return
+		}
+		linkedPost = post
+	}
+	text := linkedPost.Message
+	if text == "" && len(linkedPost.FileIds) > 0 {
+		text = "(attachment)"
+	}
+	username := linkedPost.UserId
+	if user, err := m.getUser(ctx, client, linkedPost.UserId); err == nil {
+		username = user.Username
+	}
+	prependQuote(msg, permalinkQuote(username, preview.ChannelDisplayName, text, eventURL))
+}
@@ -0,0 +1,96 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestPermalinkPreview(t *testing.T) {
+	assert.Nil(t, permalinkPreview(&model.Post{}))
+
+	// Embeds of posts from the WebSocket are decoded as maps
+	var post model.Post
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"id": "post1",
+		"message": "see https://mm.example.com/team/pl/post2",
+		"metadata": {"embeds": [{"type": "permalink", "data": {
+			"post_id": "post2",
+			"post": {"id": "post2", "user_id": "user2", "message": "original"},
+			"channel_display_name": "Town Square"
+		}}]}
+	}`), &post))
+	preview := permalinkPreview(&post)
+	require.NotNil(t, preview)
+	assert.Equal(t, "post2", preview.PostID)
+	assert.Equal(t, "Town Square", preview.ChannelDisplayName)
+	require.NotNil(t, preview.Post)
+	assert.Equal(t, "original", preview.Post.Message)
+
+	// Without metadata, only the ID of the previewed post is known
+	post = model.Post{}
+	post.AddProp(model.PostPropsPreviewedPost, "post3")
+	assert.Equal(t, &model.PreviewPost{PostID: "post3"}, permalinkPreview(&post))
+}
+
+func TestPermalinkQuote(t *testing.T) {
+	quote := permalinkQuote("bob", "Town Square", "original", "https://matrix.to/#/!room:example.com/$event")
+	assert.Equal(t, "> **@bob** wrote in **Town Square** (https://matrix.to/#/!room:example.com/$event):\n> original", quote.Body)
+	assert.Contains(t, quote.FormattedBody, `<a href="https://matrix.to/#/!room:example.com/$event">view message</a>`)
+}
+
+func TestRenderPermalink(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/posts/post3":
+			_ = json.NewEncoder(w).Encode(&model.Post{Id: "post3", UserId: "user2", Message: "fetched"})
+		case "/api/v4/users/user2":
+			_ = json.NewEncoder(w).Encode(&model.User{Id: "user2", Username: "bob"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client := NewClient(server.URL, "token")
+
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+	require.NoError(t, bridgeDB.Ghost.Insert(ctx, &database.Ghost{BridgeID: "mattermost", ID: "user2", Metadata: map[string]any{}}))
+	portalKey := networkid.PortalKey{ID: "channel1"}
+	require.NoError(t, bridgeDB.Portal.Insert(ctx, &database.Portal{BridgeID: "mattermost", PortalKey: portalKey, MXID: "!room:example.com"}))
+	require.NoError(t, bridgeDB.Message.Insert(ctx, &database.Message{
+		BridgeID: "mattermost", ID: "post2", MXID: "$post2", Room: portalKey, SenderID: "user2", Timestamp: time.UnixMilli(1),
+	}))
+	portal := &bridgev2.Portal{Portal: &database.Portal{BridgeID: "mattermost", PortalKey: portalKey}, Bridge: &bridgev2.Bridge{DB: bridgeDB}}
+	m := &MattermostConnector{}
+	newMsg := func() *bridgev2.ConvertedMessage {
+		return &bridgev2.ConvertedMessage{Parts: []*bridgev2.ConvertedMessagePart{{
+			Type:    event.EventMessage,
+			Content: &event.MessageEventContent{MsgType: event.MsgText, Body: "see this"},
+		}}}
+	}
+
+	// Posts bridged to the same room are replied to
+	msg := newMsg()
+	m.renderPermalink(ctx, portal, client, msg, &model.PreviewPost{PostID: "post2"})
+	require.NotNil(t, msg.ReplyTo)
+	assert.EqualValues(t, "post2", msg.ReplyTo.MessageID)
+	assert.Equal(t, "see this", msg.Parts[0].Content.Body)
+
+	// Other posts are quoted, fetching them if the preview doesn't include them
+	msg = newMsg()
+	m.renderPermalink(ctx, portal, client, msg, &model.PreviewPost{PostID: "post3"})
+	assert.Nil(t, msg.ReplyTo)
+	assert.Equal(t, "> **@bob** wrote:\n> fetched\n\nsee this", msg.Parts[0].Content.Body)
+}
@@ -0,0 +1,140 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+	"maunium.net/go/mautrix/id"
+)
+
+// CommandLevel is who can use a slash subcommand
+type CommandLevel string
+
+const (
+	// CommandEveryone lets any Mattermost user use the subcommand
+	CommandEveryone CommandLevel = "everyone"
+	// CommandUser needs the commands bridge permission and an allowed team and role
+	CommandUser CommandLevel = "user"
+	// CommandAdmin needs a Mattermost system admin or a bridge admin
+	CommandAdmin CommandLevel = "admin"
+	// CommandDisabled turns the subcommand off
+	CommandDisabled CommandLevel = "disabled"
+)
+
+// SlashCommandPermissions configures who can use the /matrix slash command. Mattermost users
+// get the bridge permissions of their Matrix ID: the Matrix user they're logged in as, or
+// @username:<homeserver domain>.
+type SlashCommandPermissions struct {
+	// Teams only allows members of these teams (IDs or names), empty allows all teams
+	Teams []string `yaml:"teams"`
+	// Roles only allows users with one of these Mattermost roles, empty allows all roles
+	Roles []string `yaml:"roles"`
+	// Commands is the level each subcommand needs, unlisted subcommands need user
+	Commands map[string]CommandLevel `yaml:"commands"`
+}
+
+// defaultCommandLevels are the levels of subcommands that don't need the user level
+var defaultCommandLevels = map[string]CommandLevel{
+	"help":    CommandEveryone,
+	"status":  CommandEveryone,
+	"cleanup": CommandAdmin,
+}
+
+// Validate checks the command levels
+func (p *SlashCommandPermissions) Validate() error {
+	for cmd, level := range p.Commands {
+		switch level {
+		case CommandEveryone, CommandUser, CommandAdmin, CommandDisabled:
+		default:
+			return fmt.Errorf("invalid level %q for slash command %q", level, cmd)
+		}
+	}
+	return nil
+}
+
+// level returns the level a subcommand needs
+func (p *SlashCommandPermissions) level(subcommand string) CommandLevel {
+	if level, ok := p.Commands[subcommand]; ok {
+		return level
+	} else if level, ok = defaultCommandLevels[subcommand]; ok {
+		return level
+	}
+	return CommandUser
+}
+
+// allowsTeam checks whether commands can be used in a team
+func (p *SlashCommandPermissions) allowsTeam(teamID, teamName string) bool {
+	return len(p.Teams) == 0 || slices.Contains(p.Teams, teamID) || (teamName != "" && slices.Contains(p.Teams, teamName))
+}
+
+// allowsRoles checks whether a user has one of the allowed roles
+func (p *SlashCommandPermissions) allowsRoles(roles string) bool {
+	if len(p.Roles) == 0 {
+		return true
+	}
+	for _, role := range strings.Fields(roles) {
+		if slices.Contains(p.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCommandPermission checks whether the user who sent a slash command can use the
+// subcommand, and returns the reason if they can't
+func (h *SlashCommandHandler) checkCommandPermission(ctx context.Context, req *SlashCommandRequest, subcommand string) (bool, string) {
+	perms := &h.Connector.config().SlashCommandPermissions
+	level := perms.level(subcommand)
+	switch level {
+	case CommandEveryone:
+		return true, ""
+	case CommandDisabled:
+		return false, fmt.Sprintf("`/matrix %s` is disabled on this server.", subcommand)
+	}
+	user, err := h.Connector.getUser(ctx, h.Connector.Client, req.UserID)
+	if err != nil {
+		return false, "Failed to check your permissions."
+	}
+	bridgePerms := h.Connector.bridgePermissions(user)
+	if user.IsSystemAdmin() || bridgePerms.Admin {
+		return true, ""
+	} else if level == CommandAdmin {
+		return false, fmt.Sprintf("Only admins can use `/matrix %s`.", subcommand)
+	} else if !bridgePerms.Commands {
+		return false, "You don't have permission to use the Matrix bridge."
+	} else if !perms.allowsTeam(req.TeamID, req.TeamDomain) {
+		return false, "The Matrix bridge can't be used in this team."
+	} else if !perms.allowsRoles(user.Roles) {
+		return false, "You don't have a role that can use the Matrix bridge."
+	}
+	return true, ""
+}
+
+// bridgePermissions returns the bridge permissions of a Mattermost user's Matrix ID
+func (m *MattermostConnector) bridgePermissions(user *model.User) bridgeconfig.Permissions {
+	if m.Bridge == nil || m.Bridge.Config == nil {
+		return bridgeconfig.PermissionLevelBlock
+	}
+	return m.Bridge.Config.Permissions.Get(m.matrixIDForMMUser(user))
+}
+
+// matrixIDForMMUser returns the Matrix ID of the login of a Mattermost user, or the ID the
+// user would have on the bridge's homeserver
+func (m *MattermostConnector) matrixIDForMMUser(user *model.User) id.UserID {
+	m.usersLock.RLock()
+	for _, login := range m.users {
+		if meta, ok := login.Metadata.(map[string]any); ok && meta["mm_id"] == user.Id {
+			m.usersLock.RUnlock()
+			return login.UserMXID
+		}
+	}
+	m.usersLock.RUnlock()
+	if m.Bridge.Matrix == nil {
+		return ""
+	}
+	return id.NewUserID(strings.ToLower(user.Username), m.Bridge.Matrix.ServerName())
+}
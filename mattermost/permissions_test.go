@@ -0,0 +1,117 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/bridgeconfig"
+)
+
+func TestSlashCommandPermissions_Level(t *testing.T) {
+	perms := &SlashCommandPermissions{Commands: map[string]CommandLevel{
+		"dm":   CommandAdmin,
+		"help": CommandDisabled,
+	}}
+	assert.Equal(t, CommandAdmin, perms.level("dm"))
+	assert.Equal(t, CommandDisabled, perms.level("help"))
+	assert.Equal(t, CommandEveryone, perms.level("status"))
+	assert.Equal(t, CommandUser, perms.level("join"))
+}
+
+func TestSlashCommandPermissions_Validate(t *testing.T) {
+	perms := &SlashCommandPermissions{Commands: map[string]CommandLevel{"dm": CommandAdmin}}
+	assert.NoError(t, perms.Validate())
+	perms.Commands["join"] = "owner"
+	assert.Error(t, perms.Validate())
+}
+
+func TestSlashCommandPermissions_TeamsAndRoles(t *testing.T) {
+	perms := &SlashCommandPermissions{}
+	assert.True(t, perms.allowsTeam("team1", "eng"))
+	assert.True(t, perms.allowsRoles("system_guest"))
+
+	perms.Teams = []string{"eng"}
+	perms.Roles = []string{"system_user"}
+	assert.True(t, perms.allowsTeam("team1", "eng"))
+	assert.False(t, perms.allowsTeam("team2", "sales"))
+	assert.True(t, perms.allowsRoles("system_user system_admin"))
+	assert.False(t, perms.allowsRoles("system_guest"))
+}
+
+func newPermissionsTestHandler(t *testing.T, perms SlashCommandPermissions, bridgePerms bridgeconfig.PermissionConfig) *SlashCommandHandler {
+	users := map[string]*model.User{
+		"admin1": {Id: "admin1", Username: "admin", Roles: "system_user system_admin"},
+		"user1":  {Id: "user1", Username: "alice", Roles: "system_user"},
+		"guest1": {Id: "guest1", Username: "guest", Roles: "system_guest"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := users[strings.TrimPrefix(r.URL.Path, "/api/v4/users/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(&model.AppError{Id: "app.user.missing_account.const", StatusCode: http.StatusNotFound})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(user)
+	}))
+	t.Cleanup(server.Close)
+	return &SlashCommandHandler{Connector: &MattermostConnector{
+		Config: &NetworkConfig{SlashCommandPermissions: perms},
+		Client: NewClient(server.URL, "token"),
+		Bridge: &bridgev2.Bridge{Config: &bridgeconfig.BridgeConfig{Permissions: bridgePerms}},
+	}}
+}
+
+func TestCheckCommandPermission(t *testing.T) {
+	h := newPermissionsTestHandler(t, SlashCommandPermissions{
+		Teams:    []string{"eng"},
+		Roles:    []string{"system_user"},
+		Commands: map[string]CommandLevel{"account": CommandAdmin, "dm": CommandDisabled},
+	}, bridgeconfig.PermissionConfig{"*": &bridgeconfig.PermissionLevelCommands})
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		userID     string
+		team       string
+		subcommand string
+		allowed    bool
+	}{
+		{"everyone command", "guest1", "sales", "help", true},
+		{"user command", "user1", "eng", "join", true},
+		{"wrong team", "user1", "sales", "join", false},
+		{"wrong role", "guest1", "eng", "join", false},
+		{"admin command as user", "user1", "eng", "account", false},
+		{"admin command as system admin", "admin1", "sales", "account", true},
+		{"disabled command", "admin1", "eng", "dm", false},
+		{"unknown user", "missing", "eng", "join", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, reason := h.checkCommandPermission(ctx, &SlashCommandRequest{UserID: tt.userID, TeamDomain: tt.team}, tt.subcommand)
+			assert.Equal(t, tt.allowed, ok)
+			if !ok {
+				assert.NotEmpty(t, reason)
+			}
+		})
+	}
+}
+
+func TestCheckCommandPermission_BridgePermissions(t *testing.T) {
+	h := newPermissionsTestHandler(t, SlashCommandPermissions{
+		Commands: map[string]CommandLevel{"account": CommandAdmin},
+	}, bridgeconfig.PermissionConfig{"*": &bridgeconfig.PermissionLevelRelay})
+	ok, _ := h.checkCommandPermission(context.Background(), &SlashCommandRequest{UserID: "user1"}, "join")
+	assert.False(t, ok, "relay permission shouldn't allow commands")
+
+	h.Connector.Bridge.Config.Permissions["*"] = &bridgeconfig.PermissionLevelAdmin
+	ok, _ = h.checkCommandPermission(context.Background(), &SlashCommandRequest{UserID: "user1"}, "account")
+	require.True(t, ok, "bridge admins can use admin commands")
+}
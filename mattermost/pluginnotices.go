@@ -0,0 +1,409 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// Playbooks runs and Boards cards aren't posts, so they aren't bridged. With plugin_notices,
+// the bridge bot posts a notice in the room of a channel when a run in it starts, finishes
+// or gets a checklist item checked, and when a card is added to or removed from a board
+// linked to it. The bridge user needs to be a member of the runs and boards to get their
+// events, and Boards notices need the bridge to read boards through the plugin's API.
+
+// PluginNoticesConfig contains the settings for notices of Playbooks and Boards events
+type PluginNoticesConfig struct {
+	// Playbooks posts notices for updates of Playbooks runs
+	Playbooks bool `yaml:"playbooks"`
+	// Boards posts notices for card activity on boards linked to channels
+	Boards bool `yaml:"boards"`
+}
+
+// WebSocket events of the Playbooks and Boards plugins
+const (
+	playbookRunCreatedEvent = model.WebsocketEventType("custom_playbooks_playbook_run_created")
+	playbookRunUpdatedEvent = model.WebsocketEventType("custom_playbooks_playbook_run_updated")
+	boardsBlockEvent        = model.WebsocketEventType("custom_focalboard_UPDATE_BLOCK")
+)
+
+// playbookRunFinished is the status of runs that are over
+const playbookRunFinished = "Finished"
+
+// playbookRun is the part of a Playbooks run the notices use
+type playbookRun struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	OwnerUserID   string `json:"owner_user_id"`
+	ChannelID     string `json:"channel_id"`
+	CurrentStatus string `json:"current_status"`
+	Checklists    []struct {
+		Title string `json:"title"`
+		Items []struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+			State string `json:"state"`
+		} `json:"items"`
+	} `json:"checklists"`
+}
+
+// playbookItem is a checklist item of a run
+type playbookItem struct {
+	Key   string
+	Title string
+}
+
+// closedItems returns the checked checklist items of a run in order
+func (r *playbookRun) closedItems() []playbookItem {
+	var closed []playbookItem
+	for i, checklist := range r.Checklists {
+		for j, item := range checklist.Items {
+			if item.State != "closed" {
+				continue
+			}
+			key := item.ID
+			if key == "" {
+				key = fmt.Sprintf("%d/%d", i, j)
+			}
+			closed = append(closed, playbookItem{Key: key, Title: item.Title})
+		}
+	}
+	return closed
+}
+
+// parsePlaybookRun parses the run in the data of a Playbooks event. Updates have the run
+// as their payload, while creations wrap it in a playbook_run field.
+func parsePlaybookRun(data map[string]any) (*playbookRun, error) {
+	payload, ok := data["payload"].(string)
+	if !ok {
+		return nil, fmt.Errorf("event has no payload")
+	}
+	var wrapped struct {
+		PlaybookRun *playbookRun `json:"playbook_run"`
+	}
+	if err := json.Unmarshal([]byte(payload), &wrapped); err == nil && wrapped.PlaybookRun != nil {
+		return wrapped.PlaybookRun, nil
+	}
+	var run playbookRun
+	if err := json.Unmarshal([]byte(payload), &run); err != nil {
+		return nil, fmt.Errorf("failed to parse run: %w", err)
+	}
+	return &run, nil
+}
+
+// playbookRunState is what the bridge last saw of a run, to notice what changed
+type playbookRunState struct {
+	Status string
+	Closed map[string]bool
+}
+
+// playbookRuns remembers the state of the runs the bridge has seen. The zero value is
+// ready to use.
+type playbookRuns struct {
+	lock sync.Mutex
+	runs map[string]*playbookRunState
+}
+
+// update stores the state of a run, returning the state it replaced or nil if it's new
+func (p *playbookRuns) update(run *playbookRun) *playbookRunState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.runs == nil {
+		p.runs = make(map[string]*playbookRunState)
+	}
+	prev := p.runs[run.ID]
+	state := &playbookRunState{Status: run.CurrentStatus, Closed: make(map[string]bool)}
+	for _, item := range run.closedItems() {
+		state.Closed[item.Key] = true
+	}
+	p.runs[run.ID] = state
+	return prev
+}
+
+// playbookRunNotices returns the lines of the notice of a run update. Runs seen for the first
+// time only get a notice if they were just created, as the bridge doesn't know what changed.
+func playbookRunNotices(prev *playbookRunState, run *playbookRun, created bool, owner, runURL string) []string {
+	name := "**" + run.Name + "**"
+	if runURL != "" {
+		name = "[" + run.Name + "](" + runURL + ")"
+	}
+	if prev == nil {
+		if !created {
+			return nil
+		}
+		if owner != "" {
+			return []string{"📋 **@" + owner + "** started the run " + name}
+		}
+		return []string{"📋 The run " + name + " started"}
+	}
+	var lines []string
+	for _, item := range run.closedItems() {
+		if !prev.Closed[item.Key] {
+			lines = append(lines, "☑️ **"+item.Title+"** was checked in "+name)
+		}
+	}
+	if run.CurrentStatus != prev.Status {
+		if run.CurrentStatus == playbookRunFinished {
+			lines = append(lines, "🏁 The run "+name+" finished")
+		} else if prev.Status == playbookRunFinished {
+			lines = append(lines, "📋 The run "+name+" was restarted")
+		}
+	}
+	return lines
+}
+
+// MattermostPluginNoticeEvent is a synthetic event for a notice of a Playbooks or Boards
+// event, which the bridge bot sends
+type MattermostPluginNoticeEvent struct {
+	MattermostEvent
+	NoticeID string
+	// Text is the notice in Markdown
+	Text string
+}
+
+var _ bridgev2.RemoteMessage = (*MattermostPluginNoticeEvent)(nil)
+
+func (e *MattermostPluginNoticeEvent) GetType() bridgev2.RemoteEventType {
+	return bridgev2.RemoteEventMessage
+}
+
+func (e *MattermostPluginNoticeEvent) GetSender() bridgev2.EventSender {
+	return bridgev2.EventSender{}
+}
+
+func (e *MattermostPluginNoticeEvent) GetID() networkid.MessageID {
+	return networkid.MessageID("plugin:" + e.NoticeID)
+}
+
+func (e *MattermostPluginNoticeEvent) ConvertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI) (*bridgev2.ConvertedMessage, error) {
+	if !getPortalMetadata(portal).BridgesToMatrix() {
+		return nil, bridgev2.ErrIgnoringRemoteEvent
+	}
+	content := format.RenderMarkdown(e.Text, true, false)
+	content.MsgType = event.MsgNotice
+	return &bridgev2.ConvertedMessage{
+		Parts: []*bridgev2.ConvertedMessagePart{{
+			Type:    event.EventMessage,
+			Content: &content,
+		}},
+	}, nil
+}
+
+// queuePluginNotice posts a notice in the room of a channel
+func (m *MattermostConnector) queuePluginNotice(ctx context.Context, server, channelID, noticeID, text string) {
+	if !m.isChannelMirrored(ctx, channelID) {
+		return
+	}
+	m.queueRemoteEvent(&MattermostPluginNoticeEvent{
+		MattermostEvent: MattermostEvent{
+			Connector: m,
+			Server:    server,
+			Timestamp: time.Now(),
+			ChannelID: channelID,
+		},
+		NoticeID: noticeID,
+		Text:     text,
+	})
+}
+
+// pluginURL returns the URL of a page of a plugin on a server, or an empty string if the
+// server is unknown
+func (m *MattermostConnector) pluginURL(server, path string) string {
+	serverURL, ok := m.serverURL(server)
+	if !ok || serverURL == "" {
+		return ""
+	}
+	return strings.TrimRight(serverURL, "/") + path
+}
+
+// handlePlaybookEvent posts a notice of the changes of a Playbooks run
+func (m *MattermostConnector) handlePlaybookEvent(ctx context.Context, server string, evt *model.WebSocketEvent) {
+	if !m.config().PluginNotices.Playbooks {
+		return
+	}
+	log := zerolog.Ctx(ctx)
+	run, err := parsePlaybookRun(evt.GetData())
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to parse Playbooks event")
+		return
+	} else if run.ID == "" || run.ChannelID == "" {
+		return
+	}
+	prev := m.playbookRuns.update(run)
+	var owner string
+	if prev == nil && run.OwnerUserID != "" {
+		owner = m.getServerUsername(ctx, server, run.OwnerUserID)
+	}
+	lines := playbookRunNotices(prev, run, evt.EventType() == playbookRunCreatedEvent, owner, m.pluginURL(server, "/playbooks/runs/"+run.ID))
+	if len(lines) == 0 {
+		return
+	}
+	noticeID := fmt.Sprintf("playbooks:%s:%d", run.ID, time.Now().UnixMilli())
+	m.queuePluginNotice(ctx, server, run.ChannelID, noticeID, strings.Join(lines, "\n"))
+}
+
+// boardsBlock is the part of a Boards block the notices use
+type boardsBlock struct {
+	ID         string `json:"id"`
+	BoardID    string `json:"boardId"`
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	ModifiedBy string `json:"modifiedBy"`
+	CreateAt   int64  `json:"createAt"`
+	UpdateAt   int64  `json:"updateAt"`
+	DeleteAt   int64  `json:"deleteAt"`
+}
+
+// boardsBoard is the part of a board the notices use
+type boardsBoard struct {
+	ID        string `json:"id"`
+	TeamID    string `json:"teamId"`
+	ChannelID string `json:"channelId"`
+	Title     string `json:"title"`
+}
+
+// boardsCacheTTL is how long boards are cached, so that their channel links are noticed
+const boardsCacheTTL = 10 * time.Minute
+
+type boardsCacheEntry struct {
+	board   *boardsBoard
+	fetched time.Time
+}
+
+// boardsCache caches the boards cards are on by server and ID. The zero value is ready to use.
+type boardsCache struct {
+	lock    sync.Mutex
+	entries map[string]*boardsCacheEntry
+}
+
+func (c *boardsCache) get(key string) (*boardsBoard, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Since(entry.fetched) >= boardsCacheTTL {
+		return nil, false
+	}
+	return entry.board, true
+}
+
+func (c *boardsCache) set(key string, board *boardsBoard) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*boardsCacheEntry)
+	}
+	c.entries[key] = &boardsCacheEntry{board: board, fetched: time.Now()}
+}
+
+// parseBoardsBlock parses the block in the data of a Boards event
+func parseBoardsBlock(data map[string]any) (*boardsBlock, error) {
+	raw, ok := data["block"]
+	if !ok {
+		return nil, fmt.Errorf("event has no block")
+	}
+	blockJSON, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var block boardsBlock
+	if err = json.Unmarshal(blockJSON, &block); err != nil {
+		return nil, fmt.Errorf("failed to parse block: %w", err)
+	}
+	return &block, nil
+}
+
+// boardsCardNotice returns the notice of a change of a card, or an empty string for changes
+// that don't get one. Only cards being added and deleted are announced, as cards are edited
+// a field at a time.
+func boardsCardNotice(block *boardsBlock, board *boardsBoard, username, boardURL string) string {
+	if block.Type != "card" {
+		return ""
+	}
+	var action string
+	switch {
+	case block.DeleteAt > 0:
+		action = "removed the card **%s** from %s"
+	case block.CreateAt == block.UpdateAt:
+		action = "added the card **%s** to %s"
+	default:
+		return ""
+	}
+	boardName := "**" + board.Title + "**"
+	if boardURL != "" {
+		boardName = "[" + board.Title + "](" + boardURL + ")"
+	}
+	actor := "Someone"
+	if username != "" {
+		actor = "**@" + username + "**"
+	}
+	return "🗂️ " + actor + " " + fmt.Sprintf(action, block.Title, boardName)
+}
+
+// getBoard returns a board through the API of the Boards plugin
+func (m *MattermostConnector) getBoard(ctx context.Context, server, boardID string) (*boardsBoard, error) {
+	key := server + "/" + boardID
+	if board, ok := m.boards.get(key); ok {
+		return board, nil
+	}
+	client := m.serverClient(server).GetClient()
+	if client == nil {
+		return nil, fmt.Errorf("no client for server")
+	}
+	resp, err := client.DoAPIRequestWithHeaders(ctx, http.MethodGet, client.URL+"/plugins/focalboard/api/v2/boards/"+boardID, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get board: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get board: HTTP %d", resp.StatusCode)
+	}
+	var board boardsBoard
+	if err = json.NewDecoder(resp.Body).Decode(&board); err != nil {
+		return nil, fmt.Errorf("failed to parse board: %w", err)
+	}
+	m.boards.set(key, &board)
+	return &board, nil
+}
+
+// handleBoardsEvent posts a notice of card activity on a board linked to a channel
+func (m *MattermostConnector) handleBoardsEvent(ctx context.Context, server string, evt *model.WebSocketEvent) {
+	if !m.config().PluginNotices.Boards {
+		return
+	}
+	log := zerolog.Ctx(ctx)
+	block, err := parseBoardsBlock(evt.GetData())
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to parse Boards event")
+		return
+	} else if block.Type != "card" || block.BoardID == "" {
+		return
+	}
+	board, err := m.getBoard(ctx, server, block.BoardID)
+	if err != nil {
+		log.Warn().Err(err).Str("board_id", block.BoardID).Msg("Failed to get board of card")
+		return
+	} else if board.ChannelID == "" {
+		return
+	}
+	var username string
+	if block.ModifiedBy != "" {
+		username = m.getServerUsername(ctx, server, block.ModifiedBy)
+	}
+	text := boardsCardNotice(block, board, username, m.pluginURL(server, "/boards/team/"+board.TeamID+"/"+board.ID))
+	if text == "" {
+		return
+	}
+	noticeID := fmt.Sprintf("boards:%s:%d", block.ID, block.UpdateAt)
+	m.queuePluginNotice(ctx, server, board.ChannelID, noticeID, text)
+}
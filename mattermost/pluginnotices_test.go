@@ -0,0 +1,65 @@
+package mattermost
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlaybookRun(t *testing.T) {
+	run, err := parsePlaybookRun(map[string]any{"payload": `{"id":"run1","name":"Outage","channel_id":"channel1"}`})
+	require.NoError(t, err)
+	assert.Equal(t, "run1", run.ID)
+	assert.Equal(t, "channel1", run.ChannelID)
+
+	run, err = parsePlaybookRun(map[string]any{"payload": `{"playbook_run":{"id":"run2","channel_id":"channel2"}}`})
+	require.NoError(t, err)
+	assert.Equal(t, "run2", run.ID)
+
+	_, err = parsePlaybookRun(map[string]any{})
+	assert.Error(t, err)
+}
+
+func TestPlaybookRunNotices(t *testing.T) {
+	var runs playbookRuns
+	run := &playbookRun{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"id": "run1", "name": "Outage", "channel_id": "channel1", "current_status": "InProgress",
+		"checklists": [{"title": "Triage", "items": [{"id": "item1", "title": "Page on-call", "state": ""}]}]
+	}`), run))
+
+	// Runs that were only updated aren't announced the first time they're seen
+	assert.Nil(t, playbookRunNotices(runs.update(run), run, false, "", ""))
+	assert.Nil(t, playbookRunNotices(runs.update(run), run, false, "", ""))
+
+	run.Checklists[0].Items[0].State = "closed"
+	run.CurrentStatus = playbookRunFinished
+	assert.Equal(t, []string{
+		"☑️ **Page on-call** was checked in [Outage](https://mm.example.com/playbooks/runs/run1)",
+		"🏁 The run [Outage](https://mm.example.com/playbooks/runs/run1) finished",
+	}, playbookRunNotices(runs.update(run), run, false, "", "https://mm.example.com/playbooks/runs/run1"))
+
+	created := &playbookRun{ID: "run2", Name: "Release"}
+	assert.Equal(t, []string{"📋 **@alice** started the run **Release**"}, playbookRunNotices(runs.update(created), created, true, "alice", ""))
+}
+
+func TestBoardsCardNotice(t *testing.T) {
+	block, err := parseBoardsBlock(map[string]any{"block": map[string]any{
+		"id": "card1", "boardId": "board1", "type": "card", "title": "Fix login", "createAt": 10, "updateAt": 10,
+	}})
+	require.NoError(t, err)
+	board := &boardsBoard{ID: "board1", Title: "Sprint"}
+	assert.Equal(t, "🗂️ **@alice** added the card **Fix login** to [Sprint](https://mm.example.com/boards/team/team1/board1)",
+		boardsCardNotice(block, board, "alice", "https://mm.example.com/boards/team/team1/board1"))
+
+	// Edits aren't announced, deletions are
+	block.UpdateAt = 20
+	assert.Empty(t, boardsCardNotice(block, board, "alice", ""))
+	block.DeleteAt = 30
+	assert.Equal(t, "🗂️ Someone removed the card **Fix login** from **Sprint**", boardsCardNotice(block, board, "", ""))
+
+	block.Type = "view"
+	assert.Empty(t, boardsCardNotice(block, board, "alice", ""))
+}
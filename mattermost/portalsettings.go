@@ -0,0 +1,225 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/msgconv"
+)
+
+// BridgeDirection limits which way messages are bridged in a portal
+type BridgeDirection string
+
+const (
+	DirectionBoth         BridgeDirection = "both"
+	DirectionToMatrix     BridgeDirection = "to_matrix"
+	DirectionToMattermost BridgeDirection = "to_mattermost"
+)
+
+// PortalSettings are the settings of a single portal. Unset values use the defaults.
+type PortalSettings struct {
+	Relay         *bool                 `json:"relay,omitempty"`
+	Direction     BridgeDirection       `json:"direction,omitempty"`
+	MergeCaptions *bool                 `json:"merge_captions,omitempty"`
+	Filters       *msgconv.FilterConfig `json:"filters,omitempty"`
+	Backfill      *bool                 `json:"backfill,omitempty"`
+	// GhostNameSuffix is added to the display names of ghosts in this portal only
+	GhostNameSuffix string `json:"ghost_name_suffix,omitempty"`
+}
+
+// PortalMetadata is the metadata the bridge stores for every portal
+type PortalMetadata struct {
+	Settings PortalSettings `json:"settings"`
+	// ReadOnly is set while the room is read-only because members can't post in the channel
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	filtersLock   sync.Mutex
+	filters       msgconv.Filters
+	filtersConfig *msgconv.FilterConfig
+}
+
+var _ msgconv.PortalOverrides = (*PortalMetadata)(nil)
+
+// portalSettingKeys are the settings that can be changed with commands
+var portalSettingKeys = []string{"relay", "direction", "merge_captions", "backfill", "filters", "ghost_name_suffix"}
+
+// getPortalMetadata returns the metadata of a portal, or the defaults if the portal has none
+func getPortalMetadata(portal *bridgev2.Portal) *PortalMetadata {
+	if portal != nil && portal.Portal != nil {
+		if meta, ok := portal.Metadata.(*PortalMetadata); ok {
+			return meta
+		}
+	}
+	return &PortalMetadata{}
+}
+
+// RelayEnabled returns whether messages of Matrix users without a login are relayed
+func (pm *PortalMetadata) RelayEnabled() bool {
+	return pm.Settings.Relay == nil || *pm.Settings.Relay
+}
+
+// BridgesToMatrix returns whether Mattermost messages are bridged to Matrix
+func (pm *PortalMetadata) BridgesToMatrix() bool {
+	return pm.Settings.Direction != DirectionToMattermost
+}
+
+// BridgesToMattermost returns whether Matrix messages are bridged to Mattermost
+func (pm *PortalMetadata) BridgesToMattermost() bool {
+	return pm.Settings.Direction != DirectionToMatrix
+}
+
+// BackfillEnabled returns whether the history of the portal is backfilled
+func (pm *PortalMetadata) BackfillEnabled() bool {
+	return pm.Settings.Backfill == nil || *pm.Settings.Backfill
+}
+
+// MergeCaptions returns whether the text and first file of a post are sent as one message
+func (pm *PortalMetadata) MergeCaptions() bool {
+	return pm.Settings.MergeCaptions == nil || *pm.Settings.MergeCaptions
+}
+
+// Filters returns the filters of the portal if they override the global ones. They're
+// compiled when first used after changing.
+func (pm *PortalMetadata) Filters() msgconv.Filters {
+	pm.filtersLock.Lock()
+	defer pm.filtersLock.Unlock()
+	if pm.Settings.Filters == nil {
+		return nil
+	}
+	if pm.filtersConfig != pm.Settings.Filters {
+		// The config is validated when it's set, so this can't fail unless the database
+		// was edited by hand. Messages are unfiltered rather than dropped in that case.
+		filters, _ := msgconv.NewFilters(*pm.Settings.Filters)
+		pm.filters, pm.filtersConfig = filters, pm.Settings.Filters
+	}
+	return pm.filters
+}
+
+// Set changes a setting. The value "default" resets it.
+func (pm *PortalMetadata) Set(key, value string) error {
+	reset := strings.EqualFold(value, "default")
+	switch key {
+	case "relay":
+		return setBoolSetting(&pm.Settings.Relay, value, reset)
+	case "merge_captions":
+		return setBoolSetting(&pm.Settings.MergeCaptions, value, reset)
+	case "backfill":
+		return setBoolSetting(&pm.Settings.Backfill, value, reset)
+	case "direction":
+		switch direction := BridgeDirection(strings.ToLower(value)); {
+		case reset:
+			pm.Settings.Direction = ""
+		case direction == DirectionBoth || direction == DirectionToMatrix || direction == DirectionToMattermost:
+			pm.Settings.Direction = direction
+		default:
+			return fmt.Errorf("direction must be %s, %s or %s", DirectionBoth, DirectionToMatrix, DirectionToMattermost)
+		}
+	case "filters":
+		if reset {
+			pm.Settings.Filters = nil
+			return nil
+		}
+		var cfg msgconv.FilterConfig
+		if err := json.Unmarshal([]byte(value), &cfg); err != nil {
+			return fmt.Errorf("filters must be a JSON object: %w", err)
+		}
+		if _, err := msgconv.NewFilters(cfg); err != nil {
+			return err
+		}
+		pm.Settings.Filters = &cfg
+	case "ghost_name_suffix":
+		if reset {
+			pm.Settings.GhostNameSuffix = ""
+		} else {
+			pm.Settings.GhostNameSuffix = strings.TrimSpace(value)
+		}
+	default:
+		return fmt.Errorf("unknown setting %q, must be one of %s", key, strings.Join(portalSettingKeys, ", "))
+	}
+	return nil
+}
+
+func setBoolSetting(setting **bool, value string, reset bool) error {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes":
+		*setting = ptr.Ptr(true)
+	case "off", "false", "no":
+		*setting = ptr.Ptr(false)
+	default:
+		if !reset {
+			return fmt.Errorf("value must be on, off or default")
+		}
+		*setting = nil
+	}
+	return nil
+}
+
+// Describe lists the settings of the portal in Markdown
+func (pm *PortalMetadata) Describe() string {
+	describeBool := func(setting *bool) string {
+		if setting == nil {
+			return "on (default)"
+		} else if *setting {
+			return "on"
+		}
+		return "off"
+	}
+	direction := string(pm.Settings.Direction)
+	if direction == "" {
+		direction = string(DirectionBoth) + " (default)"
+	}
+	filters := "global (default)"
+	if pm.Settings.Filters != nil {
+		data, _ := json.Marshal(pm.Settings.Filters)
+		filters = "`" + string(data) + "`"
+	}
+	ghostNameSuffix := "none (default)"
+	if pm.Settings.GhostNameSuffix != "" {
+		ghostNameSuffix = "`" + pm.Settings.GhostNameSuffix + "`"
+	}
+	return strings.Join([]string{
+		"* `relay`: " + describeBool(pm.Settings.Relay),
+		"* `direction`: " + direction,
+		"* `merge_captions`: " + describeBool(pm.Settings.MergeCaptions),
+		"* `backfill`: " + describeBool(pm.Settings.Backfill),
+		"* `filters`: " + filters,
+		"* `ghost_name_suffix`: " + ghostNameSuffix,
+	}, "\n")
+}
+
+// runConfigCommand handles the config command of a portal, from Matrix or Mattermost.
+// Without arguments the settings are listed, otherwise the given setting is changed if
+// the sender is allowed to. It returns the reply in Markdown.
+func runConfigCommand(ctx context.Context, portal *bridgev2.Portal, args []string, canChange bool) string {
+	meta, ok := portal.Metadata.(*PortalMetadata)
+	if !ok {
+		meta = &PortalMetadata{}
+		portal.Metadata = meta
+	}
+	if len(args) == 0 {
+		return "**Bridge settings of this channel**\n\n" + meta.Describe()
+	} else if len(args) < 2 {
+		return "Usage: `config <setting> <value>`, where setting is one of " + strings.Join(portalSettingKeys, ", ") + " and value can be `default`"
+	} else if !canChange {
+		return "You don't have permission to change the bridge settings of this channel"
+	}
+	key := strings.ToLower(args[0])
+	if err := meta.Set(key, strings.Join(args[1:], " ")); err != nil {
+		return "Failed to change setting: " + err.Error()
+	}
+	if err := portal.Save(ctx); err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal settings")
+		return "Failed to save settings"
+	}
+	if key == "ghost_name_suffix" && portal.MXID != "" {
+		go applyRoomGhostNames(context.WithoutCancel(ctx), portal)
+	}
+	return fmt.Sprintf("Changed `%s`\n\n%s", key, meta.Describe())
+}
@@ -0,0 +1,78 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/msgconv"
+)
+
+func TestPortalMetadata_Set(t *testing.T) {
+	meta := &PortalMetadata{}
+	assert.True(t, meta.RelayEnabled())
+	assert.True(t, meta.BridgesToMatrix())
+	assert.True(t, meta.BridgesToMattermost())
+	assert.True(t, meta.BackfillEnabled())
+	assert.True(t, meta.MergeCaptions())
+	assert.Nil(t, meta.Filters())
+
+	require.NoError(t, meta.Set("relay", "off"))
+	require.NoError(t, meta.Set("direction", "to_matrix"))
+	require.NoError(t, meta.Set("backfill", "no"))
+	require.NoError(t, meta.Set("merge_captions", "false"))
+	require.NoError(t, meta.Set("filters", `{"drop": ["secret"]}`))
+	assert.False(t, meta.RelayEnabled())
+	assert.True(t, meta.BridgesToMatrix())
+	assert.False(t, meta.BridgesToMattermost())
+	assert.False(t, meta.BackfillEnabled())
+	assert.False(t, meta.MergeCaptions())
+	assert.False(t, meta.Filters().Apply(&msgconv.FilteredMessage{Text: "a secret"}))
+	assert.Contains(t, meta.Describe(), "`direction`: to_matrix")
+
+	require.NoError(t, meta.Set("relay", "default"))
+	require.NoError(t, meta.Set("direction", "default"))
+	require.NoError(t, meta.Set("filters", "default"))
+	assert.True(t, meta.RelayEnabled())
+	assert.True(t, meta.BridgesToMattermost())
+	assert.Nil(t, meta.Filters())
+
+	require.NoError(t, meta.Set("ghost_name_suffix", " (Mattermost) "))
+	assert.Equal(t, "(Mattermost)", meta.Settings.GhostNameSuffix)
+	assert.Contains(t, meta.Describe(), "`ghost_name_suffix`: `(Mattermost)`")
+	require.NoError(t, meta.Set("ghost_name_suffix", "default"))
+	assert.Empty(t, meta.Settings.GhostNameSuffix)
+
+	assert.Error(t, meta.Set("relay", "maybe"))
+	assert.Error(t, meta.Set("direction", "sideways"))
+	assert.Error(t, meta.Set("filters", `{"drop": ["("]}`))
+	assert.Error(t, meta.Set("color", "blue"))
+}
+
+func TestRoomGhostName(t *testing.T) {
+	portal := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "channel1"}}}
+	ghost := &bridgev2.Ghost{Ghost: &database.Ghost{Name: "Alice"}}
+	assert.Equal(t, "Alice", roomGhostName(portal, ghost))
+
+	portal.Metadata = &PortalMetadata{Settings: PortalSettings{GhostNameSuffix: "(Mattermost)"}}
+	assert.Equal(t, "Alice (Mattermost)", roomGhostName(portal, ghost))
+}
+
+func TestRunConfigCommand(t *testing.T) {
+	portal := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "channel1"}}}
+
+	reply := runConfigCommand(context.Background(), portal, nil, false)
+	assert.Contains(t, reply, "`relay`: on (default)")
+
+	reply = runConfigCommand(context.Background(), portal, []string{"relay", "off"}, false)
+	assert.Contains(t, reply, "don't have permission")
+	assert.True(t, getPortalMetadata(portal).RelayEnabled())
+
+	reply = runConfigCommand(context.Background(), portal, []string{"relay"}, true)
+	assert.Contains(t, reply, "Usage")
+}
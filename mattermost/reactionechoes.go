@@ -0,0 +1,125 @@
+package mattermost
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// reactionEchoTTL is how long a reaction sent from Matrix waits for its echo. Echoes come
+// within seconds, older entries are of echoes that were missed, like while the WebSocket
+// was reconnecting.
+const reactionEchoTTL = 10 * time.Minute
+
+var reactionEchoUpgrades dbutil.UpgradeTable
+
+func init() {
+	reactionEchoUpgrades.Register(-1, 1, 0, "Create Mattermost bridged reaction table", dbutil.TxnModeOn, func(ctx context.Context, db *dbutil.Database) error {
+		_, err := db.Exec(ctx, `
+			CREATE TABLE mattermost_bridged_reaction (
+				bridge_id  TEXT    NOT NULL,
+				post_id    TEXT    NOT NULL,
+				user_id    TEXT    NOT NULL,
+				emoji_name TEXT    NOT NULL,
+				added      BOOLEAN NOT NULL,
+				sent_at    BIGINT  NOT NULL,
+
+				PRIMARY KEY (bridge_id, post_id, user_id, emoji_name, added)
+			)
+		`)
+		return err
+	})
+}
+
+// ReactionEchoStore stores the reactions the bridge added or removed in Mattermost for Matrix
+// users, so that their WebSocket events aren't bridged back to Matrix. Unlike posts,
+// reactions have no props to mark them as coming from Matrix.
+type ReactionEchoStore struct {
+	bridgeID networkid.BridgeID
+	db       *dbutil.Database
+}
+
+// NewReactionEchoStore creates a reaction echo store in the given database
+func NewReactionEchoStore(bridgeID networkid.BridgeID, db *dbutil.Database) *ReactionEchoStore {
+	return &ReactionEchoStore{
+		bridgeID: bridgeID,
+		db:       db.Child("mattermost_bridged_reaction_version", reactionEchoUpgrades, nil),
+	}
+}
+
+// Upgrade creates the table if needed
+func (s *ReactionEchoStore) Upgrade(ctx context.Context) error {
+	return s.db.Upgrade(ctx)
+}
+
+// Add stores a reaction that is about to be added or removed in Mattermost. Entries whose
+// echo didn't come within reactionEchoTTL are dropped.
+func (s *ReactionEchoStore) Add(ctx context.Context, postID, userID, emojiName string, added bool) error {
+	now := time.Now()
+	_, err := s.db.Exec(ctx, "DELETE FROM mattermost_bridged_reaction WHERE bridge_id=$1 AND sent_at<$2", s.bridgeID, now.Add(-reactionEchoTTL).UnixMilli())
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(ctx, `
+		INSERT INTO mattermost_bridged_reaction (bridge_id, post_id, user_id, emoji_name, added, sent_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (bridge_id, post_id, user_id, emoji_name, added) DO UPDATE SET sent_at=excluded.sent_at
+	`, s.bridgeID, postID, userID, emojiName, added, now.UnixMilli())
+	return err
+}
+
+// Remove deletes a stored reaction, for example because sending it failed
+func (s *ReactionEchoStore) Remove(ctx context.Context, postID, userID, emojiName string, added bool) error {
+	_, err := s.db.Exec(ctx, `
+		DELETE FROM mattermost_bridged_reaction
+		WHERE bridge_id=$1 AND post_id=$2 AND user_id=$3 AND emoji_name=$4 AND added=$5
+	`, s.bridgeID, postID, userID, emojiName, added)
+	return err
+}
+
+// TakeEcho checks whether a reaction event is the echo of a stored reaction. The entry is
+// removed, so each reaction only drops one echo.
+func (s *ReactionEchoStore) TakeEcho(ctx context.Context, postID, userID, emojiName string, added bool) (bool, error) {
+	res, err := s.db.Exec(ctx, `
+		DELETE FROM mattermost_bridged_reaction
+		WHERE bridge_id=$1 AND post_id=$2 AND user_id=$3 AND emoji_name=$4 AND added=$5 AND sent_at>=$6
+	`, s.bridgeID, postID, userID, emojiName, added, time.Now().Add(-reactionEchoTTL).UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	deleted, err := res.RowsAffected()
+	return deleted > 0, err
+}
+
+// trackReaction remembers a reaction the bridge is about to add or remove for a Matrix user.
+// It returns a function that forgets it again if sending it failed.
+func (m *MattermostConnector) trackReaction(ctx context.Context, postID, userID, emojiName string, added bool) (forget func()) {
+	if m.ReactionEchoes == nil {
+		return func() {}
+	}
+	if err := m.ReactionEchoes.Add(ctx, postID, userID, emojiName, added); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("post_id", postID).Msg("Failed to store bridged reaction, its echo may be bridged back")
+		return func() {}
+	}
+	return func() {
+		if err := m.ReactionEchoes.Remove(ctx, postID, userID, emojiName, added); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("post_id", postID).Msg("Failed to remove bridged reaction")
+		}
+	}
+}
+
+// isReactionEcho checks whether a reaction event from the WebSocket is the echo of a reaction
+// the bridge added or removed for a Matrix user
+func (m *MattermostConnector) isReactionEcho(ctx context.Context, postID, userID, emojiName string, added bool) bool {
+	if m.ReactionEchoes == nil {
+		return false
+	}
+	echo, err := m.ReactionEchoes.TakeEcho(ctx, postID, userID, emojiName, added)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("post_id", postID).Msg("Failed to check for reaction echo")
+	}
+	return echo
+}
@@ -0,0 +1,47 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReactionEchoStore(t *testing.T) {
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+	store := NewReactionEchoStore("mattermost", bridgeDB.Database)
+	require.NoError(t, store.Upgrade(ctx))
+
+	require.NoError(t, store.Add(ctx, "post1", "user1", "+1", true))
+	// A removal isn't the echo of an added reaction
+	echo, err := store.TakeEcho(ctx, "post1", "user1", "+1", false)
+	require.NoError(t, err)
+	assert.False(t, echo)
+	echo, err = store.TakeEcho(ctx, "post1", "user1", "+1", true)
+	require.NoError(t, err)
+	assert.True(t, echo)
+	// Each reaction only drops one echo
+	echo, err = store.TakeEcho(ctx, "post1", "user1", "+1", true)
+	require.NoError(t, err)
+	assert.False(t, echo)
+
+	// Reactions that failed to send are forgotten
+	require.NoError(t, store.Add(ctx, "post1", "user1", "heart", true))
+	require.NoError(t, store.Remove(ctx, "post1", "user1", "heart", true))
+	echo, err = store.TakeEcho(ctx, "post1", "user1", "heart", true)
+	require.NoError(t, err)
+	assert.False(t, echo)
+
+	// Echoes that didn't come in time don't drop later events
+	_, err = bridgeDB.Exec(ctx, `
+		INSERT INTO mattermost_bridged_reaction (bridge_id, post_id, user_id, emoji_name, added, sent_at)
+		VALUES ('mattermost', 'post2', 'user1', '+1', true, $1)
+	`, time.Now().Add(-2*reactionEchoTTL).UnixMilli())
+	require.NoError(t, err)
+	echo, err = store.TakeEcho(ctx, "post2", "user1", "+1", true)
+	require.NoError(t, err)
+	assert.False(t, echo)
+}
@@ -0,0 +1,74 @@
+package mattermost
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/variationselector"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/msgconv"
+)
+
+// Bridged reactions are stored in the bridge's reaction table with the Mattermost name of
+// their emoji as the emoji ID, next to the Matrix annotation event. Removing a reaction on
+// either side looks up that row, so the exact Matrix event is redacted and the exact
+// Mattermost reaction is deleted, without converting the emoji back and forth. Reactions
+// bridged by older versions may have the Unicode emoji as their ID instead.
+
+// isEmojiName checks whether an emoji ID is a Mattermost emoji name, which are made of
+// lowercase letters, digits, underscores, dashes and pluses
+func isEmojiName(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' && r != '-' && r != '+' {
+			return false
+		}
+	}
+	return true
+}
+
+// reactionEmojiName returns the Mattermost emoji name of a bridged reaction. Emoji IDs
+// that are names are used as they are, as that's the name the reaction was saved with.
+func reactionEmojiName(reaction *database.Reaction) string {
+	if id := string(reaction.EmojiID); isEmojiName(id) {
+		return id
+	}
+	if name := msgconv.EmojiToMattermost(string(reaction.EmojiID)); name != "" {
+		return name
+	}
+	return msgconv.EmojiToMattermost(reaction.Emoji)
+}
+
+// legacyReactionEmojiIDs returns the emoji IDs older versions of the bridge may have stored
+// a reaction with the given Mattermost emoji name as
+func legacyReactionEmojiIDs(emojiName string) []networkid.EmojiID {
+	emoji := msgconv.EmojiToMatrix(emojiName)
+	ids := []networkid.EmojiID{networkid.EmojiID(emoji)}
+	if stripped := variationselector.Remove(emoji); stripped != emoji {
+		ids = append(ids, networkid.EmojiID(stripped))
+	}
+	return ids
+}
+
+// removedReactionEmojiID finds the emoji ID a reaction removed on Mattermost was bridged
+// with, so that its Matrix event can be redacted even if it was stored with a legacy ID.
+// It returns the emoji name if the reaction isn't found.
+func (m *MattermostConnector) removedReactionEmojiID(ctx context.Context, sender networkid.UserID, postID, emojiName string) networkid.EmojiID {
+	if m.Bridge == nil || m.Bridge.DB == nil {
+		return networkid.EmojiID(emojiName)
+	}
+	for _, id := range append([]networkid.EmojiID{networkid.EmojiID(emojiName)}, legacyReactionEmojiIDs(emojiName)...) {
+		reaction, err := m.Bridge.DB.Reaction.GetByIDWithoutMessagePart(ctx, networkid.MessageID(postID), sender, id)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("post_id", postID).Msg("Failed to get removed reaction from database")
+			break
+		} else if reaction != nil {
+			return reaction.EmojiID
+		}
+	}
+	return networkid.EmojiID(emojiName)
+}
@@ -0,0 +1,45 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestReactionEmojiName(t *testing.T) {
+	assert.Equal(t, "+1", reactionEmojiName(&database.Reaction{EmojiID: "+1", Emoji: "👍️"}))
+	assert.Equal(t, "partyparrot", reactionEmojiName(&database.Reaction{EmojiID: "partyparrot", Emoji: ":partyparrot:"}))
+	// Reactions stored by older versions have the Unicode emoji as their ID
+	assert.Equal(t, "heart", reactionEmojiName(&database.Reaction{EmojiID: "❤️", Emoji: "❤️"}))
+}
+
+func TestRemovedReactionEmojiID(t *testing.T) {
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+	require.NoError(t, bridgeDB.Ghost.Insert(ctx, &database.Ghost{BridgeID: "mattermost", ID: "user1", Metadata: map[string]any{}}))
+	portalKey := networkid.PortalKey{ID: "channel1"}
+	require.NoError(t, bridgeDB.Portal.Insert(ctx, &database.Portal{BridgeID: "mattermost", PortalKey: portalKey}))
+	require.NoError(t, bridgeDB.Message.Insert(ctx, &database.Message{
+		BridgeID: "mattermost", ID: "post1", MXID: "$post1", Room: portalKey, SenderID: "user1", Timestamp: time.UnixMilli(1),
+	}))
+	insert := func(emojiID networkid.EmojiID) {
+		require.NoError(t, bridgeDB.Reaction.Upsert(ctx, &database.Reaction{
+			BridgeID: "mattermost", Room: portalKey, MessageID: "post1", SenderID: "user1",
+			EmojiID: emojiID, MXID: id.EventID("$reaction_" + string(emojiID)), Timestamp: time.UnixMilli(2), Metadata: map[string]any{},
+		}))
+	}
+	insert("smile")
+	insert("❤️")
+	m := &MattermostConnector{Bridge: &bridgev2.Bridge{DB: bridgeDB}}
+
+	assert.EqualValues(t, "smile", m.removedReactionEmojiID(ctx, "user1", "post1", "smile"))
+	assert.EqualValues(t, "❤️", m.removedReactionEmojiID(ctx, "user1", "post1", "heart"))
+	assert.EqualValues(t, "tada", m.removedReactionEmojiID(ctx, "user1", "post1", "tada"))
+}
@@ -0,0 +1,156 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Channels where channel moderation doesn't let members post, like announcement channels,
+// are bridged to rooms where only moderators can send messages. Channel admins are made
+// moderators, so that their posts can still be bridged. The other way around, posts of users
+// whose ghost can't send messages in the room are bounced back to them.
+
+// moderatorPowerLevel is the power level of channel admins in read-only rooms
+const moderatorPowerLevel = 50
+
+// channelModeration is what channel moderation lets the members of a channel do
+type channelModeration struct {
+	CanPost  bool
+	CanReact bool
+}
+
+// parseChannelModerations reads the member permissions of a channel from its moderations
+func parseChannelModerations(moderations []*model.ChannelModeration) *channelModeration {
+	mod := &channelModeration{CanPost: true, CanReact: true}
+	for _, moderation := range moderations {
+		if moderation.Roles == nil || moderation.Roles.Members == nil {
+			continue
+		}
+		switch moderation.Name {
+		case model.PermissionCreatePost.Id:
+			mod.CanPost = moderation.Roles.Members.Value
+		case model.ChannelModeratedPermissionsMap[model.PermissionAddReaction.Id]:
+			mod.CanReact = moderation.Roles.Members.Value
+		}
+	}
+	return mod
+}
+
+// getChannelModeration returns what members may do in a channel, or nil if it's unknown.
+// Reading moderations needs a system console permission, and servers without a license
+// don't support them.
+func getChannelModeration(ctx context.Context, client *Client, channelID string) *channelModeration {
+	moderations, resp, err := client.GetChannelModerations(ctx, channelID, "")
+	if err != nil {
+		log := zerolog.Ctx(ctx).Warn()
+		if status := responseStatusCode(resp, err); status == http.StatusNotImplemented || status == http.StatusForbidden {
+			log = zerolog.Ctx(ctx).Debug()
+		}
+		log.Err(wrapMattermostError(resp, err)).Str("channel_id", channelID).Msg("Failed to get channel moderations")
+		return nil
+	}
+	return parseChannelModerations(moderations)
+}
+
+// applyChannelModeration sets the power levels of a channel's room from its moderation.
+// Only rooms the bridge made read-only are opened up again, so that rooms made read-only
+// on Matrix stay that way. Nothing is changed if the moderation can't be read.
+func (m *MattermostAPI) applyChannelModeration(ctx context.Context, client *Client, portal *bridgev2.Portal, channel *model.Channel, ci *bridgev2.ChatInfo) {
+	mod := getChannelModeration(ctx, client, channel.Id)
+	if mod == nil || (mod.CanPost && !getPortalMetadata(portal).ReadOnly) {
+		return
+	}
+	readOnly := !mod.CanPost
+	ci.ExtraUpdates = func(ctx context.Context, portal *bridgev2.Portal) bool {
+		meta, ok := portal.Metadata.(*PortalMetadata)
+		if !ok || meta.ReadOnly == readOnly {
+			return false
+		}
+		meta.ReadOnly = readOnly
+		return true
+	}
+	if !readOnly {
+		ci.Members.PowerLevels = &bridgev2.PowerLevelOverrides{EventsDefault: ptr.Ptr(0)}
+		return
+	}
+	ci.Members.PowerLevels = &bridgev2.PowerLevelOverrides{EventsDefault: ptr.Ptr(moderatorPowerLevel)}
+	if mod.CanReact {
+		ci.Members.PowerLevels.Events = map[event.Type]int{event.EventReaction: 0}
+	}
+	admins, err := channelAdmins(ctx, client, channel.Id)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("channel_id", channel.Id).Msg("Failed to get admins of read-only channel")
+	}
+	for _, userID := range admins {
+		ci.Members.Members = append(ci.Members.Members, bridgev2.ChatMember{
+			EventSender: bridgev2.EventSender{Sender: m.makeUserID(userID)},
+			PowerLevel:  ptr.Ptr(moderatorPowerLevel),
+		})
+	}
+}
+
+// channelAdmins returns the IDs of the admins of a channel
+func channelAdmins(ctx context.Context, client *Client, channelID string) ([]string, error) {
+	var admins []string
+	for page := 0; ; page++ {
+		members, resp, err := client.GetChannelMembers(ctx, channelID, page, 200, "")
+		if err != nil {
+			return admins, wrapMattermostError(resp, err)
+		}
+		for _, member := range members {
+			if member.SchemeAdmin {
+				admins = append(admins, member.UserId)
+			}
+		}
+		if len(members) < 200 {
+			return admins, nil
+		}
+	}
+}
+
+// canSendMessages checks whether a user may send messages in a room. Users who can't be
+// checked are assumed to be allowed, so that posts aren't lost when the state is unknown.
+func (m *MattermostConnector) canSendMessages(ctx context.Context, roomID id.RoomID, userID id.UserID) bool {
+	if roomID == "" || userID == "" {
+		return true
+	}
+	levels, err := m.Bridge.Matrix.GetPowerLevels(ctx, roomID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("room_id", roomID).Msg("Failed to get power levels to check sender")
+		return true
+	} else if levels == nil {
+		return true
+	}
+	return levels.GetUserLevel(userID) >= levels.GetEventLevel(event.EventMessage)
+}
+
+// readOnlyBounceMessage tells a Mattermost user that their post wasn't bridged
+const readOnlyBounceMessage = "⚠️ This message wasn't delivered to Matrix: the Matrix room is read-only, and only its moderators can post there."
+
+// bounceReadOnlyPost tells the author of a post that couldn't be bridged to a read-only
+// room that it wasn't delivered, with an ephemeral post only they can see
+func (m *MattermostConnector) bounceReadOnlyPost(ctx context.Context, server, channelID, userID, postID, rootID string) error {
+	if rootID == "" {
+		rootID = postID
+	}
+	_, resp, err := m.serverClient(server).CreatePostEphemeral(ctx, &model.PostEphemeral{
+		UserID: userID,
+		Post: &model.Post{
+			ChannelId: channelID,
+			RootId:    rootID,
+			Message:   readOnlyBounceMessage,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send bounce notice: %w", wrapMattermostError(resp, err))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/event"
+)
+
+func newModerationTestServer(t *testing.T, canPost bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp any
+		switch r.URL.Path {
+		case "/api/v4/channels/channel1/moderations":
+			resp = []*model.ChannelModeration{
+				{Name: "create_post", Roles: &model.ChannelModeratedRoles{Members: &model.ChannelModeratedRole{Value: canPost, Enabled: true}}},
+				{Name: "create_reactions", Roles: &model.ChannelModeratedRoles{Members: &model.ChannelModeratedRole{Value: true, Enabled: true}}},
+			}
+		case "/api/v4/channels/channel1/members":
+			resp = model.ChannelMembers{
+				{ChannelId: "channel1", UserId: "user1", SchemeAdmin: true},
+				{ChannelId: "channel1", UserId: "user2"},
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestParseChannelModerations(t *testing.T) {
+	assert.Equal(t, &channelModeration{CanPost: true, CanReact: true}, parseChannelModerations(nil))
+	mod := parseChannelModerations([]*model.ChannelModeration{
+		{Name: "create_post", Roles: &model.ChannelModeratedRoles{Members: &model.ChannelModeratedRole{Value: false}}},
+		{Name: "create_reactions", Roles: &model.ChannelModeratedRoles{Members: &model.ChannelModeratedRole{Value: false}}},
+		{Name: "manage_members"},
+	})
+	assert.Equal(t, &channelModeration{}, mod)
+}
+
+func TestApplyChannelModeration(t *testing.T) {
+	server := newModerationTestServer(t, false)
+	defer server.Close()
+	client := NewClient(server.URL, "token")
+	api := &MattermostAPI{Connector: &MattermostConnector{}}
+	channel := &model.Channel{Id: "channel1", Type: model.ChannelTypeOpen}
+	portal := &bridgev2.Portal{Portal: &database.Portal{Metadata: &PortalMetadata{}}}
+	ctx := context.Background()
+
+	ci := &bridgev2.ChatInfo{Members: &bridgev2.ChatMemberList{}}
+	api.applyChannelModeration(ctx, client, portal, channel, ci)
+	require.NotNil(t, ci.Members.PowerLevels)
+	assert.Equal(t, moderatorPowerLevel, *ci.Members.PowerLevels.EventsDefault)
+	assert.Equal(t, map[event.Type]int{event.EventReaction: 0}, ci.Members.PowerLevels.Events)
+	// Channel admins are moderators
+	require.Len(t, ci.Members.Members, 1)
+	assert.EqualValues(t, "user1", ci.Members.Members[0].Sender)
+	assert.Equal(t, moderatorPowerLevel, *ci.Members.Members[0].PowerLevel)
+	require.NotNil(t, ci.ExtraUpdates)
+	assert.True(t, ci.ExtraUpdates(ctx, portal))
+	assert.True(t, getPortalMetadata(portal).ReadOnly)
+
+	// Once members can post again, the room the bridge made read-only is opened up
+	server.Close()
+	server = newModerationTestServer(t, true)
+	client = NewClient(server.URL, "token")
+	ci = &bridgev2.ChatInfo{Members: &bridgev2.ChatMemberList{}}
+	api.applyChannelModeration(ctx, client, portal, channel, ci)
+	require.NotNil(t, ci.Members.PowerLevels)
+	assert.Equal(t, 0, *ci.Members.PowerLevels.EventsDefault)
+	assert.Empty(t, ci.Members.Members)
+	assert.True(t, ci.ExtraUpdates(ctx, portal))
+	assert.False(t, getPortalMetadata(portal).ReadOnly)
+
+	// Rooms that weren't made read-only by the bridge are left alone
+	ci = &bridgev2.ChatInfo{Members: &bridgev2.ChatMemberList{}}
+	api.applyChannelModeration(ctx, client, portal, channel, ci)
+	assert.Nil(t, ci.Members.PowerLevels)
+	assert.Nil(t, ci.ExtraUpdates)
+}
+
+func TestBounceReadOnlyPost(t *testing.T) {
+	var bounced model.PostEphemeral
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v4/posts/ephemeral", r.URL.Path)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&bounced))
+		_ = json.NewEncoder(w).Encode(bounced.Post)
+	}))
+	defer server.Close()
+
+	m := &MattermostConnector{Client: NewClient(server.URL, "token")}
+	require.NoError(t, m.bounceReadOnlyPost(context.Background(), "", "channel1", "user1", "post1", ""))
+	assert.Equal(t, "user1", bounced.UserID)
+	assert.Equal(t, "channel1", bounced.Post.ChannelId)
+	// The notice is shown in the thread of the bounced post
+	assert.Equal(t, "post1", bounced.Post.RootId)
+	assert.Equal(t, readOnlyBounceMessage, bounced.Post.Message)
+}
@@ -0,0 +1,101 @@
+package mattermost
+
+import (
+	"context"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// MattermostReadEvent moves the read marker of a logged-in user's Matrix account to the
+// last time they viewed the channel on Mattermost
+type MattermostReadEvent struct {
+	MattermostEvent
+	ReadUpTo time.Time
+}
+
+var _ bridgev2.RemoteReadReceipt = (*MattermostReadEvent)(nil)
+
+func (e *MattermostReadEvent) GetType() bridgev2.RemoteEventType {
+	return bridgev2.RemoteEventReadReceipt
+}
+
+func (e *MattermostReadEvent) GetSender() bridgev2.EventSender {
+	sender := e.MattermostEvent.GetSender()
+	sender.IsFromMe = true
+	return sender
+}
+
+func (e *MattermostReadEvent) GetLastReceiptTarget() networkid.MessageID {
+	return ""
+}
+
+func (e *MattermostReadEvent) GetReceiptTargets() []networkid.MessageID {
+	return nil
+}
+
+func (e *MattermostReadEvent) GetReadUpTo() time.Time {
+	return e.ReadUpTo
+}
+
+// MattermostMarkUnreadEvent sets or clears the unread flag of a room for a logged-in user
+type MattermostMarkUnreadEvent struct {
+	MattermostEvent
+	Unread bool
+}
+
+var _ bridgev2.RemoteMarkUnread = (*MattermostMarkUnreadEvent)(nil)
+
+func (e *MattermostMarkUnreadEvent) GetType() bridgev2.RemoteEventType {
+	return bridgev2.RemoteEventMarkUnread
+}
+
+func (e *MattermostMarkUnreadEvent) GetSender() bridgev2.EventSender {
+	sender := e.MattermostEvent.GetSender()
+	sender.IsFromMe = true
+	return sender
+}
+
+func (e *MattermostMarkUnreadEvent) GetUnread() bool {
+	return e.Unread
+}
+
+// queueReadState copies the read state of a channel to Matrix for every double puppeted
+// login that is a member of it. It's queued after backfilling history, so that users don't
+// end up with every backfilled message unread: the room is marked as read up to when they
+// last viewed the channel on Mattermost. Channels they never viewed are marked as read
+// entirely and flagged as unread instead.
+func (m *MattermostConnector) queueReadState(ctx context.Context, channelID string) {
+	log := m.moduleLog(LogModuleSync)
+	for _, login := range m.GetUsers() {
+		meta, ok := login.Metadata.(map[string]any)
+		if !ok || !m.canDoublePuppet(login) {
+			continue
+		}
+		mmUserID, _ := meta["mm_id"].(string)
+		if mmUserID == "" {
+			continue
+		}
+		member, _, err := m.Client.GetChannelMember(ctx, channelID, mmUserID, "")
+		if err != nil {
+			// Most likely the user isn't in the channel
+			log.Debug().Err(err).Str("channel_id", channelID).Str("mm_user_id", mmUserID).Msg("Failed to get channel member for read state")
+			continue
+		}
+		baseEvt := MattermostEvent{
+			Connector: m,
+			Timestamp: time.Now(),
+			ChannelID: channelID,
+			UserID:    mmUserID,
+		}
+		readUpTo := time.UnixMilli(member.LastViewedAt)
+		if member.LastViewedAt == 0 {
+			readUpTo = time.Now()
+		}
+		m.queueRemoteEvent(&MattermostReadEvent{MattermostEvent: baseEvt, ReadUpTo: readUpTo})
+		if member.LastViewedAt == 0 {
+			m.queueRemoteEvent(&MattermostMarkUnreadEvent{MattermostEvent: baseEvt, Unread: true})
+		}
+	}
+}
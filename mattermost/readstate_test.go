@@ -0,0 +1,31 @@
+package mattermost
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestReadStateEvents_AreFromMe(t *testing.T) {
+	connector := &MattermostConnector{users: map[networkid.UserLoginID]*bridgev2.UserLogin{
+		"alice": {UserLogin: &database.UserLogin{ID: "alice", Metadata: map[string]any{"mm_id": "user1"}}},
+	}}
+	base := MattermostEvent{Connector: connector, ChannelID: "channel1", UserID: "user1"}
+	readUpTo := time.UnixMilli(1700000000000)
+
+	read := &MattermostReadEvent{MattermostEvent: base, ReadUpTo: readUpTo}
+	assert.Equal(t, bridgev2.RemoteEventReadReceipt, read.GetType())
+	assert.True(t, read.GetSender().IsFromMe)
+	assert.Equal(t, networkid.UserLoginID("alice"), read.GetSender().SenderLogin)
+	assert.Equal(t, readUpTo, read.GetReadUpTo())
+	assert.Empty(t, read.GetLastReceiptTarget())
+
+	unread := &MattermostMarkUnreadEvent{MattermostEvent: base, Unread: true}
+	assert.Equal(t, bridgev2.RemoteEventMarkUnread, unread.GetType())
+	assert.True(t, unread.GetSender().IsFromMe)
+	assert.True(t, unread.GetUnread())
+}
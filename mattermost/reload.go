@@ -0,0 +1,141 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/msgconv"
+)
+
+var ErrNoConfigPath = errors.New("the config file path is unknown")
+
+// ReloadConfig reads the network section of the config file again and applies the settings
+// that can change while the bridge is running: log_levels, mirror, filters, ignore,
+// system_messages, slash_command_permissions and event_source.events. The new settings are
+// validated before anything is applied, so an invalid config leaves the old one in place.
+// Other changes need a restart, and are only logged. It returns the names of the settings
+// that were changed.
+func (m *MattermostConnector) ReloadConfig() ([]string, error) {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	if m.ConfigPath == "" {
+		return nil, ErrNoConfigPath
+	}
+	data, err := os.ReadFile(m.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	var file struct {
+		Network NetworkConfig `yaml:"network"`
+	}
+	if err = yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	return m.applyConfig(&file.Network)
+}
+
+// applyConfig validates a new config and swaps in its reloadable settings
+func (m *MattermostConnector) applyConfig(newCfg *NetworkConfig) ([]string, error) {
+	mirrorFilters, err := NewMirrorFilters(newCfg.Mirror)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror filter: %w", err)
+	}
+	filters, err := msgconv.NewFilters(newCfg.Filters)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message filter: %w", err)
+	}
+	if err = newCfg.SlashCommandPermissions.Validate(); err != nil {
+		return nil, err
+	}
+	if err = newCfg.EventSource.Events.Validate(); err != nil {
+		return nil, err
+	}
+
+	oldCfg := m.config()
+	cfg := *oldCfg
+	cfg.LogLevels = newCfg.LogLevels
+	cfg.Mirror = newCfg.Mirror
+	// --dry-run overrides the config
+	cfg.Mirror.DryRun = oldCfg.Mirror.DryRun
+	cfg.Filters = newCfg.Filters
+	cfg.Ignore = newCfg.Ignore
+	cfg.SystemMessages = newCfg.SystemMessages
+	cfg.SlashCommandPermissions = newCfg.SlashCommandPermissions
+	cfg.EventSource.Events = newCfg.EventSource.Events
+
+	var changed []string
+	for name, values := range map[string][2]any{
+		"log_levels":                {oldCfg.LogLevels, cfg.LogLevels},
+		"mirror":                    {oldCfg.Mirror, cfg.Mirror},
+		"filters":                   {oldCfg.Filters, cfg.Filters},
+		"ignore":                    {oldCfg.Ignore, cfg.Ignore},
+		"system_messages":           {oldCfg.SystemMessages, cfg.SystemMessages},
+		"slash_command_permissions": {oldCfg.SlashCommandPermissions, cfg.SlashCommandPermissions},
+		"event_source.events":       {oldCfg.EventSource.Events, cfg.EventSource.Events},
+	} {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+
+	// Readers load the config and the filters together, so they never see a mix of old
+	// and new settings
+	m.filterCacheLock.Lock()
+	m.live.Store(&liveConfig{Config: &cfg, MirrorFilters: mirrorFilters, Filters: filters})
+	m.channelFilterCache = nil
+	m.filterCacheLock.Unlock()
+	if slices.Contains(changed, "log_levels") {
+		m.moduleLoggers.reset()
+	}
+
+	log := m.moduleLog(LogModuleConnector)
+	if newCfg.ServerURL != oldCfg.ServerURL || newCfg.Mode != oldCfg.Mode || !reflect.DeepEqual(newCfg.Servers, oldCfg.Servers) ||
+		newCfg.EventSource.WebSocket != oldCfg.EventSource.WebSocket || !reflect.DeepEqual(newCfg.EventSource.Webhook, oldCfg.EventSource.Webhook) || !slices.Equal(newCfg.Cluster.Instances, oldCfg.Cluster.Instances) {
+		log.Warn().Msg("Connection settings changed in the config, restart the bridge to apply them")
+	}
+	log.Info().Strs("changed", changed).Msg("Reloaded config")
+	if slices.Contains(changed, "mirror") {
+		m.requestResync()
+	}
+	return changed, nil
+}
+
+// requestResync asks the mirror sync engine to resync everything, e.g. after the mirror
+// filters changed and channels that weren't mirrored before may now be
+func (m *MattermostConnector) requestResync() {
+	if m.resyncRequests == nil {
+		return
+	}
+	select {
+	case m.resyncRequests <- struct{}{}:
+	default:
+	}
+}
+
+// watchReloadSignal reloads the config whenever the process gets SIGHUP
+func (m *MattermostConnector) watchReloadSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	log := m.moduleLog(LogModuleConnector)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Info().Msg("Got SIGHUP, reloading config")
+			if _, err := m.ReloadConfig(); err != nil {
+				log.Err(err).Msg("Failed to reload config, keeping the old one")
+			}
+		}
+	}
+}
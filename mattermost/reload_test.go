@@ -0,0 +1,93 @@
+package mattermost
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	connector := &MattermostConnector{
+		Config: &NetworkConfig{
+			ServerURL: "https://mattermost.example.com",
+			Mirror:    MirrorConfig{DryRun: true},
+		},
+		ConfigPath:         path,
+		channelFilterCache: map[string]bool{"channel1": true},
+		resyncRequests:     make(chan struct{}, 1),
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+network:
+  server_url: https://mattermost.example.com
+  log_levels:
+    sync: debug
+  mirror:
+    channels:
+      deny: ["off-topic"]
+  system_messages: [system_join_channel]
+`), 0600))
+	changed, err := connector.ReloadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"log_levels", "mirror", "system_messages"}, changed)
+	assert.Equal(t, "debug", connector.config().LogLevels["sync"])
+	assert.True(t, connector.config().Mirror.DryRun, "--dry-run should survive reloads")
+	assert.False(t, connector.mirrorFilters().Channels.Allowed("off-topic", "channel2"))
+	assert.Nil(t, connector.channelFilterCache)
+	assert.Len(t, connector.resyncRequests, 1, "changing mirror filters should trigger a resync")
+
+	// An invalid config leaves the old one in place
+	require.NoError(t, os.WriteFile(path, []byte(`
+network:
+  mirror:
+    channels:
+      deny: ["re:("]
+`), 0600))
+	_, err = connector.ReloadConfig()
+	assert.Error(t, err)
+	assert.Equal(t, "debug", connector.config().LogLevels["sync"])
+
+	connector.ConfigPath = ""
+	_, err = connector.ReloadConfig()
+	assert.ErrorIs(t, err, ErrNoConfigPath)
+}
+
+// Run with -race: reloads swap the config and filters while events are reading them
+func TestReloadConfig_WhileHandlingEvents(t *testing.T) {
+	connector, server, queued := newTestEventConnector(t)
+	connector.Config.Mode = ModeMirror
+	bob := &model.User{Username: "bob"}
+	server.AddUser(bob)
+	channel := server.AddChannel(&model.Channel{Name: "town-square"}, bob.Id)
+	post := server.CreatePost(&model.Post{ChannelId: channel.Id, UserId: bob.Id, Message: "hello"})
+	postJSON, err := json.Marshal(post)
+	require.NoError(t, err)
+	evt := model.NewWebSocketEvent(model.WebsocketEventPosted, "", channel.Id, "", nil, "").
+		SetData(map[string]any{"post": string(postJSON)})
+
+	const count = 50
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range count {
+			_, err := connector.applyConfig(&NetworkConfig{
+				Mode:   ModeMirror,
+				Mirror: MirrorConfig{Channels: FilterConfig{Deny: []string{fmt.Sprintf("off-topic-%d", i)}}},
+			})
+			assert.NoError(t, err)
+		}
+	}()
+	for range count {
+		connector.HandleWebSocketEvent(evt)
+	}
+	<-done
+	assert.Len(t, *queued, count)
+	assert.Equal(t, []string{"off-topic-49"}, connector.config().Mirror.Channels.Deny)
+}
@@ -0,0 +1,261 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Tokens of logins can be revoked or expire. When Mattermost rejects the token of a login, the
+// bridge first tries to get a new one by itself: OAuth logins use their refresh token, and bot
+// and auto-provisioned logins get a new token with the admin token. If that isn't possible,
+// the login is put in the BAD_CREDENTIALS bridge state and its user is told to use relogin,
+// which runs the login's flow again. Logging in with the same Mattermost account updates the
+// existing login, so its portals are kept.
+
+// StateTokenRejected is the error code of the bridge state of a login whose token Mattermost
+// rejected
+const StateTokenRejected status.BridgeStateErrorCode = "mm-token-rejected"
+
+// ErrReloginWrongAccount is returned when a login is renewed with a token of another account
+var ErrReloginWrongAccount = errors.New("the new token belongs to another Mattermost account")
+
+// errNoTokenRenewal is returned for logins whose token only their user can replace
+var errNoTokenRenewal = errors.New("the token can only be replaced by logging in again")
+
+// unauthorizedTransport reports responses saying that the token of a request was rejected
+type unauthorizedTransport struct {
+	base           http.RoundTripper
+	onUnauthorized func()
+}
+
+func (t *unauthorizedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.onUnauthorized()
+	}
+	return resp, err
+}
+
+// newLoginClient returns a client with a token of the login's account, which notices when
+// Mattermost rejects the token
+func (m *MattermostAPI) newLoginClient(token string) *Client {
+	client := NewClient(m.Connector.loginServerURL(m.Login), token)
+	httpClient := *client.HTTPClient
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	httpClient.Transport = &unauthorizedTransport{base: base, onUnauthorized: m.tokenRejected}
+	client.HTTPClient = &httpClient
+	return client
+}
+
+// tokenRejected handles Mattermost rejecting the token of the login. It only acts once until
+// the login gets a new token.
+func (m *MattermostAPI) tokenRejected() {
+	if m.tokenInvalid.CompareAndSwap(false, true) {
+		go m.renewToken(m.Login.Log.WithContext(context.Background()))
+	}
+}
+
+// renewToken gets a new token for the login if the bridge can, or else asks its user to log
+// in again
+func (m *MattermostAPI) renewToken(ctx context.Context) {
+	log := m.Login.Log
+	meta, _ := m.Login.Metadata.(map[string]any)
+	oldToken, _ := meta["token"].(string)
+	refreshToken, _ := meta["refresh_token"].(string)
+	var err error
+	switch {
+	case meta["bot"] == true:
+		err = m.Connector.rotateBotToken(ctx, m.Login, meta)
+	case meta["is_auto_provisioned"] == true:
+		err = m.renewAutoProvisionedToken(ctx)
+	case meta["oauth"] == true && refreshToken != "":
+		err = m.refreshOAuthToken(ctx, refreshToken)
+	default:
+		err = errNoTokenRenewal
+	}
+	if newToken, _ := meta["token"].(string); newToken != oldToken {
+		// Bot tokens are rotated even if revoking the old one failed
+		if err != nil {
+			log.Warn().Err(err).Msg("Error while renewing the rejected token of the login")
+		}
+		log.Info().Msg("Renewed the rejected token of the login")
+		m.tokenInvalid.Store(false)
+		return
+	}
+
+	log.Warn().Err(err).Msg("Mattermost rejected the token of the login")
+	m.Login.BridgeState.Send(status.BridgeState{
+		StateEvent: status.StateBadCredentials,
+		Error:      StateTokenRejected,
+		Message:    "Mattermost rejected the token of the login, it was revoked or has expired",
+	})
+	m.sendReloginNotice(ctx)
+}
+
+// renewAutoProvisionedToken replaces the token of an auto-provisioned login, which is the
+// token of the Mattermost account the bridge created for its user
+func (m *MattermostAPI) renewAutoProvisionedToken(ctx context.Context) error {
+	mxid := m.Login.UserMXID.String()
+	if err := m.Connector.InvalidateUserToken(ctx, "", mxid); err != nil {
+		return err
+	}
+	client, _, err := m.Connector.GetClientForUser(ctx, "", mxid)
+	if err != nil {
+		return err
+	}
+	return m.setToken(ctx, map[string]any{"token": client.AuthToken})
+}
+
+// refreshOAuthToken gets a new access token for an OAuth login with its refresh token
+func (m *MattermostAPI) refreshOAuthToken(ctx context.Context, refreshToken string) error {
+	token, err := m.Connector.requestOAuthToken(ctx, map[string][]string{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return err
+	}
+	return m.setToken(ctx, oauthTokenMetadata(token))
+}
+
+// setToken switches the login to a new token of its Mattermost account and saves it
+func (m *MattermostAPI) setToken(ctx context.Context, values map[string]any) error {
+	meta, ok := m.Login.Metadata.(map[string]any)
+	if !ok {
+		return fmt.Errorf("login has no metadata")
+	}
+	token, _ := values["token"].(string)
+	maps.Copy(meta, values)
+	m.setClient(m.newLoginClient(token))
+	m.tokenInvalid.Store(false)
+	if err := m.Login.Save(ctx); err != nil {
+		return fmt.Errorf("failed to save login: %w", err)
+	}
+	m.Login.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+	return nil
+}
+
+// sendReloginNotice tells the user of the login how to log in again in their management room
+func (m *MattermostAPI) sendReloginNotice(ctx context.Context) {
+	if m.Login.User == nil || m.Login.User.ManagementRoom == "" || m.Connector.Bridge == nil || m.Connector.Bridge.Bot == nil {
+		return
+	}
+	_, err := m.Connector.Bridge.Bot.SendMessage(ctx, m.Login.User.ManagementRoom, event.EventMessage, &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf("Mattermost rejected the token of your login %s, it was revoked or has expired. Use `relogin %s` to log in again, your portals are kept.", m.Login.ID, m.Login.ID),
+		},
+	}, nil)
+	if err != nil {
+		m.Login.Log.Warn().Err(err).Msg("Failed to send relogin notice")
+	}
+}
+
+// reloginFlow returns the login flow that renews the token of a login, or an empty ID if the
+// bridge renews it by itself
+func (m *MattermostConnector) reloginFlow(login *bridgev2.UserLogin) (string, error) {
+	meta, _ := login.Metadata.(map[string]any)
+	switch {
+	case meta["bot"] == true, meta["is_auto_provisioned"] == true:
+		return "", nil
+	case meta["oauth"] == true:
+		if m.oauthRedirectURL() == "" {
+			return "", ErrOAuthNotConfigured
+		}
+		return "sso", nil
+	case loginServer(login) != "":
+		return serverLoginFlowPrefix + loginServer(login), nil
+	default:
+		return "personal-access-token", nil
+	}
+}
+
+// takeRelogin returns the login that a user is renewing with relogin and forgets it, nil if
+// they aren't renewing any
+func (m *MattermostConnector) takeRelogin(mxid id.UserID) *bridgev2.UserLogin {
+	m.reloginLock.Lock()
+	defer m.reloginLock.Unlock()
+	login := m.relogins[mxid]
+	delete(m.relogins, mxid)
+	return login
+}
+
+// checkRelogin makes sure that a login being renewed keeps its Mattermost account
+func checkRelogin(login *bridgev2.UserLogin, mmUserID string) error {
+	if login == nil {
+		return nil
+	}
+	if api, ok := login.Client.(*MattermostAPI); ok && api.getOwnMMID() != mmUserID {
+		return fmt.Errorf("%w, log in with a token of %s", ErrReloginWrongAccount, login.RemoteName)
+	}
+	return nil
+}
+
+// cmdRelogin renews the token of a login, keeping its portals
+func (m *MattermostConnector) cmdRelogin() *commands.FullHandler {
+	return &commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			login := ce.User.GetDefaultLogin()
+			if len(ce.Args) > 0 {
+				login = ce.Bridge.GetCachedUserLoginByID(networkid.UserLoginID(ce.Args[0]))
+				if login == nil || login.UserMXID != ce.User.MXID {
+					ce.Reply("You don't have a login with the ID `%s`", ce.Args[0])
+					return
+				}
+			}
+			if login == nil {
+				ce.Reply("You're not logged in")
+				return
+			}
+			flowID, err := m.reloginFlow(login)
+			if err != nil {
+				ce.Reply("Can't renew the token of %s: %v", login.ID, err)
+				return
+			}
+			api, ok := login.Client.(*MattermostAPI)
+			if !ok {
+				ce.Reply("Login %s isn't loaded", login.ID)
+				return
+			}
+			if flowID == "" {
+				api.tokenInvalid.Store(true)
+				api.renewToken(ce.Ctx)
+				if api.tokenInvalid.Load() {
+					ce.Reply("Failed to renew the token of %s, see the logs", login.ID)
+				} else {
+					ce.Reply("Renewed the token of %s", login.ID)
+				}
+				return
+			}
+			m.reloginLock.Lock()
+			if m.relogins == nil {
+				m.relogins = make(map[id.UserID]*bridgev2.UserLogin)
+			}
+			m.relogins[ce.User.MXID] = login
+			m.reloginLock.Unlock()
+			defer m.takeRelogin(ce.User.MXID)
+			ce.Args = []string{flowID}
+			commands.CommandLogin.Func(ce)
+		},
+		Name: "relogin",
+		Help: commands.HelpMeta{
+			Section:     commands.HelpSectionAuth,
+			Description: "Log in again to replace the revoked or expired token of a login, keeping its portals",
+			Args:        "[_login ID_]",
+		},
+		RequiresLogin: true,
+	}
+}
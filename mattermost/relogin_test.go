@@ -0,0 +1,80 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/mmtest"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestLoginClient_NoticesRejectedToken(t *testing.T) {
+	ctx := context.Background()
+	server := mmtest.NewServer(t)
+	alice := &model.User{Username: "alice"}
+	token := server.AddUser(alice)
+	connector := &MattermostConnector{Config: &NetworkConfig{ServerURL: server.URL}}
+	login := &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "alice", Metadata: map[string]any{"mm_id": alice.Id}}}
+	api := newMattermostAPI(login, connector, nil)
+
+	api.setClient(api.newLoginClient(token))
+	_, _, err := api.Client().GetMe(ctx, "")
+	require.NoError(t, err)
+	assert.False(t, api.tokenInvalid.Load())
+
+	api.setClient(api.newLoginClient("revoked"))
+	_, _, err = api.Client().GetMe(ctx, "")
+	require.Error(t, err)
+	assert.True(t, api.tokenInvalid.Load())
+}
+
+func TestReloginFlow(t *testing.T) {
+	connector := &MattermostConnector{Config: &NetworkConfig{}}
+	tests := map[string]struct {
+		meta map[string]any
+		flow string
+		err  error
+	}{
+		"token":            {meta: map[string]any{"mm_id": "mm-alice"}, flow: "personal-access-token"},
+		"server":           {meta: map[string]any{"mm_id": "mm-alice", "server": "work"}, flow: serverLoginFlowPrefix + "work"},
+		"bot":              {meta: map[string]any{"mm_id": "mm-bot", "bot": true}},
+		"auto-provisioned": {meta: map[string]any{"mm_id": "mm-alice", "is_auto_provisioned": true}},
+		"sso":              {meta: map[string]any{"mm_id": "mm-alice", "oauth": true}, err: ErrOAuthNotConfigured},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			login := &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "alice", Metadata: tc.meta}}
+			flow, err := connector.reloginFlow(login)
+			assert.Equal(t, tc.flow, flow)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+}
+
+func TestCheckRelogin(t *testing.T) {
+	connector := &MattermostConnector{Config: &NetworkConfig{}}
+	login := addTestLogin(connector, "alice", "@alice:example.com", map[string]any{"mm_id": "mm-alice"})
+	login.RemoteName = "alice"
+
+	assert.NoError(t, checkRelogin(nil, "mm-bob"))
+	assert.NoError(t, checkRelogin(login, "mm-alice"))
+	err := checkRelogin(login, "mm-bob")
+	assert.True(t, errors.Is(err, ErrReloginWrongAccount))
+	assert.Contains(t, err.Error(), "alice")
+}
+
+func TestTakeRelogin(t *testing.T) {
+	connector := &MattermostConnector{Config: &NetworkConfig{}}
+	login := addTestLogin(connector, "alice", "@alice:example.com", map[string]any{"mm_id": "mm-alice"})
+	connector.relogins = map[id.UserID]*bridgev2.UserLogin{"@alice:example.com": login}
+
+	assert.Nil(t, connector.takeRelogin("@bob:example.com"))
+	assert.Equal(t, login, connector.takeRelogin("@alice:example.com"))
+	assert.Nil(t, connector.takeRelogin("@alice:example.com"))
+}
@@ -0,0 +1,277 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// runResyncScheduler runs Resync every interval and when the config is reloaded, until
+// the context is canceled
+func (s *SyncEngine) runResyncScheduler(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		s.log.Info().Dur("interval", interval).Msg("Scheduling incremental resyncs")
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-s.Connector.resyncRequests:
+			// The mirror filters changed, so lists that didn't change on Mattermost may
+			// still contain teams and channels that are now mirrored
+			clear(s.etags)
+		}
+		if err := s.Resync(ctx); err != nil {
+			s.log.Err(err).Msg("Incremental resync failed")
+		}
+	}
+}
+
+// Resync performs an incremental synchronization after the initial SyncAll. It picks up
+// new teams, channels and users, renamed teams and channels, and membership changes.
+// List requests send the etag of the previous response, so unchanged lists cost the
+// server almost nothing, and only users updated since the last sync are processed.
+func (s *SyncEngine) Resync(ctx context.Context) error {
+	s.log.Info().Msg("Starting incremental resync")
+
+	if s.Connector.config().Mirror.SyncAllUsers && s.Connector.ownsGlobalTasks() {
+		if err := s.resyncUsers(ctx); err != nil {
+			s.log.Warn().Err(err).Msg("Failed to resync users")
+		}
+	}
+
+	if s.Connector.config().Mirror.SyncAllTeams {
+		if err := s.resyncTeams(ctx); err != nil {
+			return fmt.Errorf("failed to resync teams: %w", err)
+		}
+	}
+
+	s.resyncMemberships(ctx)
+
+	s.log.Info().Msg("Incremental resync complete")
+	return nil
+}
+
+// resyncUsers syncs users that are new or were updated since the last sync
+func (s *SyncEngine) resyncUsers(ctx context.Context) error {
+	since := s.lastUserSync
+	startedAt := time.Now().UnixMilli()
+	matrixAdmin := s.accountAdmin()
+	updatedUsers := 0
+
+	err := fetchPages(s, "users", usersPerPage, func(page, perPage int, etag string) ([]*model.User, *model.Response, error) {
+		return s.Connector.Client.GetUsers(ctx, page, perPage, etag)
+	}, func(users []*model.User) {
+		for _, user := range users {
+			if s.syncedUsers[user.Id] && user.UpdateAt <= since {
+				continue
+			}
+			if !s.Connector.mirrorFilters().UserAllowed(user) {
+				continue
+			}
+			s.syncUser(ctx, user, matrixAdmin)
+			s.syncedUsers[user.Id] = true
+			updatedUsers++
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get users: %w", err)
+	}
+
+	s.lastUserSync = startedAt
+	s.log.Debug().Int("user_count", updatedUsers).Msg("Resynced new and updated users")
+	return nil
+}
+
+// resyncTeams syncs new teams, updates renamed ones and resyncs the channels of all teams
+func (s *SyncEngine) resyncTeams(ctx context.Context) error {
+	err := fetchPages(s, "teams", teamsPerPage, func(page, perPage int, etag string) ([]*model.Team, *model.Response, error) {
+		return s.Connector.Client.GetAllTeams(ctx, etag, page, perPage)
+	}, func(teams []*model.Team) {
+		for _, team := range teams {
+			if !s.Connector.mirrorFilters().TeamAllowed(team) {
+				continue
+			}
+			known, ok := s.teams[team.Id]
+			if !ok {
+				if err := s.SyncTeam(ctx, team); err != nil {
+					s.log.Warn().Err(err).Str("team_id", team.Id).Msg("Failed to sync new team")
+				}
+				continue
+			}
+			if known.UpdateAt != team.UpdateAt || known.LastTeamIconUpdate != team.LastTeamIconUpdate {
+				s.log.Debug().Str("team_id", team.Id).Msg("Team changed, updating space")
+				s.queueChatInfoUpdate(func(evt MattermostEvent) bridgev2.RemoteEvent {
+					evt.ChannelID = team.Id
+					return &TeamSyncEvent{MattermostEvent: evt, Team: team}
+				})
+			}
+			s.teams[team.Id] = team
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get teams: %w", err)
+	}
+
+	for teamID := range s.teams {
+		if s.Connector.config().Mirror.SyncAllChannels {
+			if err := s.resyncChannels(ctx, teamID); err != nil {
+				s.log.Warn().Err(err).Str("team_id", teamID).Msg("Failed to resync channels")
+			}
+		}
+		if s.Connector.config().Mirror.CategorySpaces {
+			if err := s.SyncCategories(ctx, teamID); err != nil {
+				s.log.Warn().Err(err).Str("team_id", teamID).Msg("Failed to resync sidebar categories")
+			}
+		}
+	}
+	return nil
+}
+
+// resyncChannels syncs new channels in a team and updates renamed ones
+func (s *SyncEngine) resyncChannels(ctx context.Context, teamID string) error {
+	for _, private := range []bool{false, true} {
+		err := s.fetchChannels(ctx, teamID, private, func(channels []*model.Channel) {
+			for _, channel := range channels {
+				if !s.Connector.mirrorFilters().ChannelAllowed(channel) {
+					continue
+				}
+				updateAt, ok := s.channelUpdateAt[channel.Id]
+				if !ok {
+					if err := s.SyncChannel(ctx, channel); err != nil {
+						s.log.Warn().Err(err).Str("channel_id", channel.Id).Msg("Failed to sync new channel")
+					}
+					continue
+				}
+				if updateAt != channel.UpdateAt {
+					s.log.Debug().Str("channel_id", channel.Id).Msg("Channel changed, updating room")
+					s.queueChatInfoUpdate(func(evt MattermostEvent) bridgev2.RemoteEvent {
+						evt.ChannelID = channel.Id
+						return &ChannelSyncEvent{MattermostEvent: evt, Channel: channel}
+					})
+					s.channelUpdateAt[channel.Id] = channel.UpdateAt
+				}
+			}
+		})
+		if err != nil {
+			if private {
+				// Same as SyncChannels, private channels may need more permissions
+				continue
+			}
+			return fmt.Errorf("failed to get public channels: %w", err)
+		}
+	}
+	return nil
+}
+
+// Page sizes for listing teams and channels, the maximum Mattermost allows
+const (
+	teamsPerPage    = 200
+	channelsPerPage = 200
+)
+
+// fetchPages fetches a list page by page until a page isn't full, and passes the items of
+// each page to handle. The etag of each page is stored, and pages that didn't change since
+// the last fetch are skipped, so handle only sees new and changed items.
+func fetchPages[T any](s *SyncEngine, key string, perPage int, getPage func(page, perPage int, etag string) ([]T, *model.Response, error), handle func([]T)) error {
+	for page := 0; ; page++ {
+		etagKey := fmt.Sprintf("%s:%d", key, page)
+		items, resp, err := getPage(page, perPage, s.etags[etagKey])
+		if err != nil {
+			return fmt.Errorf("failed to get page %d: %w", page, err)
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			if page+1 < s.pageCounts[key] {
+				continue
+			}
+			return nil
+		}
+		s.etags[etagKey] = resp.Etag
+		handle(items)
+		if len(items) < perPage {
+			s.pageCounts[key] = page + 1
+			return nil
+		}
+	}
+}
+
+// fetchChannels fetches the public or private channels of a team with fetchPages
+func (s *SyncEngine) fetchChannels(ctx context.Context, teamID string, private bool, handle func([]*model.Channel)) error {
+	return fetchPages(s, fmt.Sprintf("channels:%s:%t", teamID, private), channelsPerPage, func(page, perPage int, etag string) ([]*model.Channel, *model.Response, error) {
+		if private {
+			return s.Connector.Client.GetPrivateChannelsForTeam(ctx, teamID, page, perPage, etag)
+		}
+		return s.Connector.Client.GetPublicChannelsForTeam(ctx, teamID, page, perPage, etag)
+	}, handle)
+}
+
+// resyncMemberships syncs room and space members of channels and teams whose member lists changed
+func (s *SyncEngine) resyncMemberships(ctx context.Context) {
+	for channelID := range s.syncedChannels {
+		etagKey := "members:" + channelID
+		_, resp, err := s.Connector.Client.GetChannelMembers(ctx, channelID, 0, 1000, s.etags[etagKey])
+		if err != nil {
+			s.log.Debug().Err(err).Str("channel_id", channelID).Msg("Failed to check channel members")
+			continue
+		} else if resp.StatusCode == http.StatusNotModified {
+			continue
+		}
+		portal, err := s.Connector.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{ID: networkid.PortalID(channelID)})
+		if err != nil || portal == nil || portal.MXID == "" {
+			continue
+		}
+		if err := s.SyncChannelMemberships(ctx, channelID, portal); err != nil {
+			s.log.Warn().Err(err).Str("channel_id", channelID).Msg("Failed to resync channel members")
+			continue
+		}
+		s.etags[etagKey] = resp.Etag
+	}
+
+	for teamID := range s.teams {
+		if !s.Connector.ownsChannel(teamID) {
+			continue
+		}
+		etagKey := "team_members:" + teamID
+		_, resp, err := s.Connector.Client.Client4.GetTeamMembers(ctx, teamID, 0, 200, s.etags[etagKey])
+		if err != nil {
+			s.log.Debug().Err(err).Str("team_id", teamID).Msg("Failed to check team members")
+			continue
+		} else if resp.StatusCode == http.StatusNotModified {
+			continue
+		}
+		portal, err := s.Connector.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{ID: networkid.PortalID(teamID)})
+		if err != nil || portal == nil || portal.MXID == "" {
+			continue
+		}
+		if err := s.SyncTeamMemberships(ctx, teamID, portal); err != nil {
+			s.log.Warn().Err(err).Str("team_id", teamID).Msg("Failed to resync team members")
+			continue
+		}
+		s.etags[etagKey] = resp.Etag
+	}
+}
+
+// queueChatInfoUpdate queues a synthetic sync event so that the bridge updates the name,
+// topic and avatar of an existing portal
+func (s *SyncEngine) queueChatInfoUpdate(build func(evt MattermostEvent) bridgev2.RemoteEvent) {
+	login := s.getAnyLogin()
+	if login == nil {
+		s.log.Debug().Msg("No logged-in user available, skipping portal update")
+		return
+	}
+	s.Connector.queueRemoteEvent(build(MattermostEvent{
+		Connector: s.Connector,
+		Timestamp: time.Now(),
+		UserID:    string(login.ID),
+	}))
+}
@@ -0,0 +1,106 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncEngine_ResyncTeamsUsesEtag(t *testing.T) {
+	var ifNoneMatch []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v4/teams", r.URL.Path)
+		ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == "teams-v1" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Etag", "teams-v1")
+		_ = json.NewEncoder(w).Encode([]*model.Team{{Id: "team1", Name: "team-one", UpdateAt: 100}})
+	}))
+	defer server.Close()
+
+	engine := NewSyncEngine(&MattermostConnector{
+		Config: &NetworkConfig{Mirror: MirrorConfig{SyncAllTeams: true}},
+		Client: NewClient(server.URL, "token"),
+	})
+	engine.teams["team1"] = &model.Team{Id: "team1", Name: "team-one", UpdateAt: 100}
+
+	ctx := context.Background()
+	require.NoError(t, engine.resyncTeams(ctx))
+	require.NoError(t, engine.resyncTeams(ctx))
+
+	assert.Equal(t, []string{"", "teams-v1"}, ifNoneMatch)
+	assert.Equal(t, "teams-v1", engine.etags["teams:0"])
+	assert.Len(t, engine.teams, 1)
+}
+
+func TestSyncEngine_ResyncUsersSkipsUnchanged(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v4/users", r.URL.Path)
+		requests++
+		if r.Header.Get("If-None-Match") == "users-v1" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Etag", "users-v1")
+		_ = json.NewEncoder(w).Encode([]*model.User{
+			{Id: "user1", Username: "alice", UpdateAt: 100},
+			{Id: "user2", Username: "bob", UpdateAt: 200},
+		})
+	}))
+	defer server.Close()
+
+	engine := NewSyncEngine(&MattermostConnector{
+		Config: &NetworkConfig{Mirror: MirrorConfig{SyncAllUsers: true}},
+		Client: NewClient(server.URL, "token"),
+	})
+	engine.syncedUsers["user1"] = true
+	engine.syncedUsers["user2"] = true
+	engine.lastUserSync = 500
+
+	ctx := context.Background()
+	require.NoError(t, engine.resyncUsers(ctx))
+	assert.Equal(t, 1, engine.pageCounts["users"])
+	assert.Equal(t, "users-v1", engine.etags["users:0"])
+	assert.Greater(t, engine.lastUserSync, int64(500))
+
+	require.NoError(t, engine.resyncUsers(ctx))
+	assert.Equal(t, 2, requests)
+}
+
+func TestFetchPages_PaginatesAndSkipsUnchanged(t *testing.T) {
+	engine := NewSyncEngine(&MattermostConnector{})
+	// Two pages, the second one changes between fetches
+	secondPage := "page1-v1"
+	getPage := func(page, perPage int, etag string) ([]int, *model.Response, error) {
+		pageEtag := "page0-v1"
+		items := make([]int, perPage)
+		if page == 1 {
+			pageEtag = secondPage
+			items = []int{perPage}
+		}
+		if etag == pageEtag {
+			return nil, &model.Response{StatusCode: http.StatusNotModified}, nil
+		}
+		return items, &model.Response{StatusCode: http.StatusOK, Etag: pageEtag}, nil
+	}
+
+	var fetched int
+	handle := func(items []int) { fetched += len(items) }
+	require.NoError(t, fetchPages(engine, "items", 2, getPage, handle))
+	assert.Equal(t, 3, fetched)
+	assert.Equal(t, 2, engine.pageCounts["items"])
+
+	fetched = 0
+	secondPage = "page1-v2"
+	require.NoError(t, fetchPages(engine, "items", 2, getPage, handle))
+	assert.Equal(t, 1, fetched, "only the changed page should be handled")
+}
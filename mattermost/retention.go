@@ -0,0 +1,250 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// RetentionConfig configures removing bridged messages from Matrix after they're gone from
+// Mattermost or have reached a maximum age. It only applies to messages that came from
+// Mattermost: messages sent from Matrix are the users' own events.
+type RetentionConfig struct {
+	// Reconcile checks whether bridged posts still exist, and redacts the ones that were
+	// deleted without a deletion event, like the posts removed by Mattermost's data
+	// retention policies
+	Reconcile bool `yaml:"reconcile"`
+	// MaxAge is the number of days after which bridged messages are redacted, 0 keeps them
+	MaxAge int `yaml:"max_age"`
+	// Interval is the number of hours between runs
+	Interval int `yaml:"interval"`
+}
+
+// Defaults used when the retention config values are unset
+const (
+	defaultRetentionInterval = 24 * time.Hour
+	// retentionBatchSize is the number of messages loaded from the database at a time,
+	// and the most post IDs checked with one request
+	retentionBatchSize = 200
+)
+
+// retentionReason is the reason of redactions of messages past the maximum age
+const retentionReason = "Message is older than the retention period"
+
+// Enabled checks whether there is anything to do
+func (c *RetentionConfig) Enabled() bool {
+	return c.Reconcile || c.MaxAge > 0
+}
+
+func (c *RetentionConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval) * time.Hour
+	}
+	return defaultRetentionInterval
+}
+
+// RetentionResult counts what a retention run did
+type RetentionResult struct {
+	Checked  int
+	Deleted  int
+	Expired  int
+	Redacted int
+}
+
+// runRetention enforces the retention policy every interval until the context is canceled
+func (m *MattermostConnector) runRetention(ctx context.Context) {
+	cfg := m.config().Retention
+	if !cfg.Enabled() {
+		return
+	}
+	log := m.moduleLog(LogModuleConnector).With().Str("action", "retention").Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Dur("interval", cfg.interval()).Bool("reconcile", cfg.Reconcile).Int("max_age_days", cfg.MaxAge).
+		Msg("Scheduling retention policy")
+	ticker := time.NewTicker(cfg.interval())
+	defer ticker.Stop()
+	for {
+		if result, err := m.EnforceRetention(ctx); err != nil {
+			log.Err(err).Msg("Failed to enforce retention policy")
+		} else {
+			log.Info().Any("result", result).Msg("Enforced retention policy")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// EnforceRetention goes through the bridged messages from Mattermost once. Messages past
+// the maximum age are redacted and forgotten. With reconcile enabled, the others are
+// checked on Mattermost, and deleted posts are handled like deletion events from the
+// WebSocket. In a cluster, each instance handles the messages of its own channels.
+func (m *MattermostConnector) EnforceRetention(ctx context.Context) (*RetentionResult, error) {
+	cfg := m.config().Retention
+	var cutoff time.Time
+	if cfg.MaxAge > 0 {
+		cutoff = time.Now().Add(-time.Duration(cfg.MaxAge) * 24 * time.Hour)
+	}
+	result := &RetentionResult{}
+	var afterRowID int64
+	for {
+		batch, err := getRetentionBatch(ctx, m.Bridge.DB.Database, m.Bridge.ID, afterRowID, retentionBatchSize)
+		if err != nil {
+			return result, fmt.Errorf("failed to get bridged messages: %w", err)
+		} else if len(batch) == 0 {
+			return result, nil
+		}
+		afterRowID = batch[len(batch)-1].RowID
+
+		toCheck := make(map[string][]*retentionMessage)
+		for _, msg := range batch {
+			if !m.ownsChannel(string(msg.Portal.ID)) {
+				continue
+			}
+			server, _ := ParseServerUserID(msg.SenderID)
+			if !cutoff.IsZero() && msg.Timestamp.Before(cutoff) {
+				m.expireMessage(ctx, msg, result)
+			} else if cfg.Reconcile && m.canReconcile(server) {
+				toCheck[server] = append(toCheck[server], msg)
+			}
+		}
+		for server, msgs := range toCheck {
+			m.reconcileMessages(ctx, server, msgs, result)
+		}
+	}
+}
+
+// canReconcile checks whether the bridge can see all posts of a server. Without an admin
+// token, posts the login can't see would look deleted.
+func (m *MattermostConnector) canReconcile(server string) bool {
+	if server == "" {
+		return true
+	}
+	srv, ok := m.servers[server]
+	return ok && srv.Client != nil
+}
+
+// expireMessage redacts a message that is past the maximum age and forgets it
+func (m *MattermostConnector) expireMessage(ctx context.Context, msg *retentionMessage, result *RetentionResult) {
+	if msg.Event.RoomID != "" {
+		if err := m.redactBridgedEvent(ctx, msg.SenderID, msg.Event, retentionReason); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Stringer("event_id", msg.Event.EventID).Msg("Failed to redact expired message")
+			return
+		}
+		result.Redacted++
+	}
+	if err := m.Bridge.DB.Message.Delete(ctx, msg.RowID); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("event_id", msg.Event.EventID).Msg("Failed to delete expired message")
+		return
+	}
+	result.Expired++
+}
+
+// reconcileMessages checks whether the posts of messages still exist on a server, and
+// queues a deletion event for each post that doesn't
+func (m *MattermostConnector) reconcileMessages(ctx context.Context, server string, msgs []*retentionMessage, result *RetentionResult) {
+	client := m.adminClient()
+	if server != "" {
+		client = m.serverClient(server)
+	}
+	byPost := make(map[string]*retentionMessage, len(msgs))
+	postIDs := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		postID := string(msg.ID)
+		if _, ok := byPost[postID]; !ok {
+			byPost[postID] = msg
+			postIDs = append(postIDs, postID)
+		}
+	}
+	missing, err := findMissingPosts(ctx, client, postIDs)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("server", server).Msg("Failed to check if bridged posts still exist")
+		return
+	}
+	result.Checked += len(postIDs)
+	for _, postID := range missing {
+		msg := byPost[postID]
+		_, mmUserID := ParseServerUserID(msg.SenderID)
+		queued := m.queueRemoteEvent(&MattermostRemoveEvent{
+			MattermostEvent: MattermostEvent{
+				Connector: m,
+				Server:    server,
+				Timestamp: time.Now(),
+				ChannelID: string(msg.Portal.ID),
+				UserID:    mmUserID,
+			},
+			PostID: postID,
+		})
+		if queued {
+			result.Deleted++
+		}
+	}
+}
+
+// findMissingPosts returns the posts that don't exist on Mattermost anymore, or were deleted
+func findMissingPosts(ctx context.Context, client *Client, postIDs []string) ([]string, error) {
+	posts, resp, err := client.GetPostsByIds(ctx, postIDs)
+	if err != nil && responseStatusCode(resp, err) != http.StatusNotFound {
+		return nil, wrapMattermostError(resp, err)
+	}
+	// Mattermost answers 404 if none of the posts exist
+	existing := make(map[string]bool, len(posts))
+	for _, post := range posts {
+		if post.DeleteAt == 0 {
+			existing[post.Id] = true
+		}
+	}
+	var missing []string
+	for _, postID := range postIDs {
+		if !existing[postID] {
+			missing = append(missing, postID)
+		}
+	}
+	return missing, nil
+}
+
+// retentionMessage is a message part the bridge sent to Matrix for a Mattermost post
+type retentionMessage struct {
+	RowID     int64
+	ID        networkid.MessageID
+	Portal    networkid.PortalKey
+	SenderID  networkid.UserID
+	Timestamp time.Time
+	Event     bridgedEvent
+}
+
+// getRetentionBatch returns the next messages from Mattermost after a row ID, in row order
+func getRetentionBatch(ctx context.Context, db *dbutil.Database, bridgeID networkid.BridgeID, afterRowID int64, limit int) ([]*retentionMessage, error) {
+	rows, err := db.Query(ctx, `
+		SELECT message.rowid, message.id, message.room_id, message.room_receiver, message.sender_id,
+		       message.timestamp, COALESCE(portal.mxid, ''), message.mxid, message.sender_mxid
+		FROM message
+		JOIN portal ON portal.bridge_id=message.bridge_id AND portal.id=message.room_id AND portal.receiver=message.room_receiver
+		WHERE message.bridge_id=$1 AND message.sender_id<>'' AND message.rowid>$2
+		ORDER BY message.rowid
+		LIMIT $3
+	`, bridgeID, afterRowID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []*retentionMessage
+	for rows.Next() {
+		var msg retentionMessage
+		var timestamp int64
+		err = rows.Scan(&msg.RowID, &msg.ID, &msg.Portal.ID, &msg.Portal.Receiver, &msg.SenderID, &timestamp, &msg.Event.RoomID, &msg.Event.EventID, &msg.Event.Sender)
+		if err != nil {
+			return nil, err
+		}
+		msg.Timestamp = time.Unix(0, timestamp)
+		msgs = append(msgs, &msg)
+	}
+	return msgs, rows.Err()
+}
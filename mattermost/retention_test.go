@@ -0,0 +1,100 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestGetRetentionBatch(t *testing.T) {
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+	require.NoError(t, bridgeDB.Ghost.Insert(ctx, &database.Ghost{BridgeID: "mattermost", ID: "alice-mm-id", Metadata: map[string]any{}}))
+	portalKey := networkid.PortalKey{ID: "channel1"}
+	require.NoError(t, bridgeDB.Portal.Insert(ctx, &database.Portal{BridgeID: "mattermost", PortalKey: portalKey, MXID: "!room:example.com"}))
+	messages := []*database.Message{
+		{ID: "post1", MXID: "$post1", SenderID: "alice-mm-id", SenderMXID: "@mattermost_alice-mm-id:example.com"},
+		// Sent from Matrix, which retention leaves alone
+		{ID: "post2", MXID: "$post2", SenderMXID: "@carol:example.com"},
+		{ID: "post3", MXID: "$post3", SenderID: "alice-mm-id", SenderMXID: "@alice:example.com"},
+	}
+	for i, msg := range messages {
+		msg.BridgeID = "mattermost"
+		msg.Room = portalKey
+		msg.Timestamp = time.UnixMilli(int64(i + 1))
+		require.NoError(t, bridgeDB.Message.Insert(ctx, msg))
+	}
+
+	batch, err := getRetentionBatch(ctx, bridgeDB.Database, "mattermost", 0, 1)
+	require.NoError(t, err)
+	require.Len(t, batch, 1)
+	assert.Equal(t, networkid.MessageID("post1"), batch[0].ID)
+	assert.Equal(t, portalKey, batch[0].Portal)
+	assert.Equal(t, time.UnixMilli(1), batch[0].Timestamp)
+	assert.Equal(t, bridgedEvent{RoomID: "!room:example.com", EventID: "$post1", Sender: "@mattermost_alice-mm-id:example.com"}, batch[0].Event)
+
+	batch, err = getRetentionBatch(ctx, bridgeDB.Database, "mattermost", batch[0].RowID, 10)
+	require.NoError(t, err)
+	require.Len(t, batch, 1)
+	assert.Equal(t, networkid.MessageID("post3"), batch[0].ID)
+	assert.Equal(t, bridgedEvent{RoomID: "!room:example.com", EventID: "$post3", Sender: "@alice:example.com"}, batch[0].Event)
+
+	batch, err = getRetentionBatch(ctx, bridgeDB.Database, "mattermost", batch[0].RowID, 10)
+	require.NoError(t, err)
+	assert.Empty(t, batch)
+}
+
+func TestFindMissingPosts(t *testing.T) {
+	existing := map[string]*model.Post{
+		"post1": {Id: "post1"},
+		"post2": {Id: "post2", DeleteAt: 1000},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v4/posts/ids", r.URL.Path)
+		var ids []string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&ids))
+		var posts []*model.Post
+		for _, postID := range ids {
+			if post, ok := existing[postID]; ok {
+				posts = append(posts, post)
+			}
+		}
+		if len(posts) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"id":"app.post.get.app_error","status_code":404}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(posts)
+	}))
+	defer server.Close()
+	client := NewClient(server.URL, "token")
+
+	missing, err := findMissingPosts(context.Background(), client, []string{"post1", "post2", "post3"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"post2", "post3"}, missing)
+
+	missing, err = findMissingPosts(context.Background(), client, []string{"post3", "post4"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"post3", "post4"}, missing)
+}
+
+func TestFindMissingPosts_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"id":"api.context.permissions.app_error","status_code":403}`))
+	}))
+	defer server.Close()
+
+	// Posts must not look deleted when they can't be checked
+	_, err := findMissingPosts(context.Background(), NewClient(server.URL, "token"), []string{"post1"})
+	assert.Error(t, err)
+}
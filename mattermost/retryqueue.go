@@ -0,0 +1,452 @@
+package mattermost
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// RetryQueueConfig contains settings for retrying Matrix messages that failed to post to Mattermost
+type RetryQueueConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	MaxAttempts  int  `yaml:"max_attempts"`
+	InitialDelay int  `yaml:"initial_delay"` // seconds
+	MaxDelay     int  `yaml:"max_delay"`     // seconds
+}
+
+// Defaults used when the retry queue config values are unset
+const (
+	defaultRetryMaxAttempts  = 5
+	defaultRetryInitialDelay = 5 * time.Second
+	defaultRetryMaxDelay     = 5 * time.Minute
+
+	retryPollInterval = 30 * time.Second
+)
+
+// RetryState is the state of a queued post
+type RetryState string
+
+const (
+	RetryStatePending RetryState = "pending"
+	// RetryStateFailed is the dead-letter state: the post won't be retried again
+	RetryStateFailed RetryState = "failed"
+)
+
+var retryQueueUpgrades dbutil.UpgradeTable
+
+func init() {
+	retryQueueUpgrades.Register(-1, 1, 0, "Create Mattermost retry queue table", dbutil.TxnModeOn, func(ctx context.Context, db *dbutil.Database) error {
+		_, err := db.Exec(ctx, `
+			CREATE TABLE mattermost_retry_queue (
+				bridge_id       TEXT   NOT NULL,
+				event_id        TEXT   NOT NULL,
+				room_id         TEXT   NOT NULL,
+				portal_id       TEXT   NOT NULL,
+				portal_receiver TEXT   NOT NULL,
+				sender_mxid     TEXT   NOT NULL,
+				post            TEXT   NOT NULL,
+				attempts        INTEGER NOT NULL,
+				next_attempt    BIGINT NOT NULL,
+				last_error      TEXT   NOT NULL,
+				state           TEXT   NOT NULL,
+				created_at      BIGINT NOT NULL,
+
+				PRIMARY KEY (bridge_id, event_id)
+			)
+		`)
+		return err
+	})
+}
+
+// RetryItem is a Matrix message waiting to be posted to Mattermost
+type RetryItem struct {
+	EventID     id.EventID
+	RoomID      id.RoomID
+	Portal      networkid.PortalKey
+	SenderMXID  id.UserID
+	Post        *model.Post
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	State       RetryState
+	CreatedAt   time.Time
+}
+
+// RetryQueue persists posts that failed with a transient error and retries them
+// with exponential backoff. Posts that keep failing are moved to a dead-letter
+// state and the sender is notified in the room.
+type RetryQueue struct {
+	Connector *MattermostConnector
+	Config    RetryQueueConfig
+
+	db   *dbutil.Database
+	log  zerolog.Logger
+	wake chan struct{}
+	stop context.CancelFunc
+
+	// sendPost is swapped out in tests
+	sendPost func(ctx context.Context, item *RetryItem) (*model.Post, *model.Response, error)
+}
+
+// NewRetryQueue creates a retry queue stored in the given database
+func NewRetryQueue(connector *MattermostConnector, db *dbutil.Database, cfg RetryQueueConfig) *RetryQueue {
+	q := &RetryQueue{
+		Connector: connector,
+		Config:    cfg,
+		db:        db.Child("mattermost_retry_queue_version", retryQueueUpgrades, nil),
+		log:       connector.moduleLog(LogModuleRetry),
+		wake:      make(chan struct{}, 1),
+	}
+	q.sendPost = q.sendPostAsSender
+	return q
+}
+
+// Start creates the queue table if needed and starts processing queued posts
+func (q *RetryQueue) Start(ctx context.Context) error {
+	if err := q.db.Upgrade(ctx); err != nil {
+		return fmt.Errorf("failed to upgrade retry queue database: %w", err)
+	}
+	ctx, q.stop = context.WithCancel(ctx)
+	go q.loop(ctx)
+	return nil
+}
+
+// Stop stops processing queued posts. Pending posts stay in the database.
+func (q *RetryQueue) Stop() {
+	if q.stop != nil {
+		q.stop()
+	}
+}
+
+// Enqueue stores a post for a later retry
+func (q *RetryQueue) Enqueue(ctx context.Context, item *RetryItem, cause error) error {
+	now := time.Now()
+	item.Attempts = 1
+	item.State = RetryStatePending
+	item.CreatedAt = now
+	item.NextAttempt = now.Add(q.backoff(item.Attempts))
+	if cause != nil {
+		item.LastError = cause.Error()
+	}
+	postJSON, err := json.Marshal(item.Post)
+	if err != nil {
+		return fmt.Errorf("failed to marshal post: %w", err)
+	}
+	_, err = q.db.Exec(ctx, `
+		INSERT INTO mattermost_retry_queue
+			(bridge_id, event_id, room_id, portal_id, portal_receiver, sender_mxid, post,
+			 attempts, next_attempt, last_error, state, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`, q.bridgeID(), item.EventID, item.RoomID, item.Portal.ID, item.Portal.Receiver, item.SenderMXID, string(postJSON),
+		item.Attempts, item.NextAttempt.UnixMilli(), item.LastError, item.State, item.CreatedAt.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to insert retry queue item: %w", err)
+	}
+	q.log.Info().
+		Stringer("event_id", item.EventID).
+		Str("channel_id", item.Post.ChannelId).
+		Time("next_attempt", item.NextAttempt).
+		Msg("Queued failed post for retry")
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// GetDue returns pending posts whose next attempt is due
+func (q *RetryQueue) GetDue(ctx context.Context, now time.Time) ([]*RetryItem, error) {
+	return q.query(ctx, `
+		SELECT event_id, room_id, portal_id, portal_receiver, sender_mxid, post,
+		       attempts, next_attempt, last_error, state, created_at
+		FROM mattermost_retry_queue
+		WHERE bridge_id=$1 AND state=$2 AND next_attempt<=$3
+		ORDER BY created_at
+	`, q.bridgeID(), RetryStatePending, now.UnixMilli())
+}
+
+// GetFailed returns posts in the dead-letter state
+func (q *RetryQueue) GetFailed(ctx context.Context) ([]*RetryItem, error) {
+	return q.query(ctx, `
+		SELECT event_id, room_id, portal_id, portal_receiver, sender_mxid, post,
+		       attempts, next_attempt, last_error, state, created_at
+		FROM mattermost_retry_queue
+		WHERE bridge_id=$1 AND state=$2
+		ORDER BY created_at
+	`, q.bridgeID(), RetryStateFailed)
+}
+
+func (q *RetryQueue) query(ctx context.Context, query string, args ...any) ([]*RetryItem, error) {
+	rows, err := q.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*RetryItem
+	for rows.Next() {
+		var item RetryItem
+		var postJSON string
+		var nextAttempt, createdAt int64
+		err = rows.Scan(&item.EventID, &item.RoomID, &item.Portal.ID, &item.Portal.Receiver, &item.SenderMXID, &postJSON,
+			&item.Attempts, &nextAttempt, &item.LastError, &item.State, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(postJSON), &item.Post); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal queued post for %s: %w", item.EventID, err)
+		}
+		item.NextAttempt = time.UnixMilli(nextAttempt)
+		item.CreatedAt = time.UnixMilli(createdAt)
+		items = append(items, &item)
+	}
+	return items, rows.Err()
+}
+
+func (q *RetryQueue) update(ctx context.Context, item *RetryItem) error {
+	_, err := q.db.Exec(ctx, `
+		UPDATE mattermost_retry_queue SET attempts=$3, next_attempt=$4, last_error=$5, state=$6
+		WHERE bridge_id=$1 AND event_id=$2
+	`, q.bridgeID(), item.EventID, item.Attempts, item.NextAttempt.UnixMilli(), item.LastError, item.State)
+	return err
+}
+
+func (q *RetryQueue) delete(ctx context.Context, eventID id.EventID) error {
+	_, err := q.db.Exec(ctx, "DELETE FROM mattermost_retry_queue WHERE bridge_id=$1 AND event_id=$2", q.bridgeID(), eventID)
+	return err
+}
+
+// DeleteBySender drops the queued posts of a Matrix user and returns how many there were
+func (q *RetryQueue) DeleteBySender(ctx context.Context, sender id.UserID) (int64, error) {
+	res, err := q.db.Exec(ctx, "DELETE FROM mattermost_retry_queue WHERE bridge_id=$1 AND sender_mxid=$2", q.bridgeID(), sender)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (q *RetryQueue) bridgeID() networkid.BridgeID {
+	if q.Connector.Bridge == nil {
+		return ""
+	}
+	return q.Connector.Bridge.ID
+}
+
+func (q *RetryQueue) maxAttempts() int {
+	if q.Config.MaxAttempts > 0 {
+		return q.Config.MaxAttempts
+	}
+	return defaultRetryMaxAttempts
+}
+
+// backoff returns the delay before the next attempt after the given number of attempts
+func (q *RetryQueue) backoff(attempts int) time.Duration {
+	delay := defaultRetryInitialDelay
+	if q.Config.InitialDelay > 0 {
+		delay = time.Duration(q.Config.InitialDelay) * time.Second
+	}
+	maxDelay := defaultRetryMaxDelay
+	if q.Config.MaxDelay > 0 {
+		maxDelay = time.Duration(q.Config.MaxDelay) * time.Second
+	}
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+func (q *RetryQueue) loop(ctx context.Context) {
+	for {
+		q.ProcessDue(ctx)
+
+		// Sleep until the next item is due, a new item is queued or the poll interval passes
+		wait := retryPollInterval
+		if next, err := q.nextAttempt(ctx); err != nil {
+			q.log.Warn().Err(err).Msg("Failed to get next retry time")
+		} else if !next.IsZero() {
+			wait = min(max(time.Until(next), 0), retryPollInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (q *RetryQueue) nextAttempt(ctx context.Context) (time.Time, error) {
+	var next sql.NullInt64
+	err := q.db.QueryRow(ctx,
+		"SELECT MIN(next_attempt) FROM mattermost_retry_queue WHERE bridge_id=$1 AND state=$2",
+		q.bridgeID(), RetryStatePending,
+	).Scan(&next)
+	if err != nil || !next.Valid {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(next.Int64), nil
+}
+
+// ProcessDue retries all posts whose next attempt is due
+func (q *RetryQueue) ProcessDue(ctx context.Context) {
+	items, err := q.GetDue(ctx, time.Now())
+	if err != nil {
+		q.log.Err(err).Msg("Failed to get due retry queue items")
+		return
+	}
+	for _, item := range items {
+		if ctx.Err() != nil {
+			return
+		} else if !q.Connector.ownsChannel(item.Post.ChannelId) {
+			continue
+		}
+		q.retry(ctx, item)
+	}
+}
+
+func (q *RetryQueue) retry(ctx context.Context, item *RetryItem) {
+	log := q.log.With().
+		Stringer("event_id", item.EventID).
+		Str("channel_id", item.Post.ChannelId).
+		Int("attempt", item.Attempts+1).
+		Logger()
+
+	createdPost, resp, err := q.sendPost(ctx, item)
+	if err == nil {
+		log.Info().Str("post_id", createdPost.Id).Msg("Retried post sent successfully")
+		if err = q.delete(ctx, item.EventID); err != nil {
+			log.Err(err).Msg("Failed to delete sent post from retry queue")
+		}
+		q.onSuccess(ctx, item, createdPost)
+		return
+	}
+
+	item.Attempts++
+	item.LastError = err.Error()
+	if IsRetryablePostError(resp, err) && item.Attempts < q.maxAttempts() {
+		item.NextAttempt = time.Now().Add(q.backoff(item.Attempts))
+		log.Warn().Err(err).Time("next_attempt", item.NextAttempt).Msg("Retrying post failed, will try again")
+	} else {
+		item.State = RetryStateFailed
+		log.Err(err).Msg("Retrying post failed permanently, moving to dead-letter state")
+	}
+	if updateErr := q.update(ctx, item); updateErr != nil {
+		log.Err(updateErr).Msg("Failed to update retry queue item")
+	}
+	if item.State == RetryStateFailed {
+		q.onPermanentFailure(ctx, item, wrapMattermostError(resp, err))
+	} else {
+		q.sendStatus(ctx, item, bridgev2.WrapErrorInStatus(fmt.Errorf("%w: %w", ErrQueuedForRetry, err)))
+	}
+}
+
+// sendPostAsSender sends a post with the account it was first attempted with: the sender's
+// own login if the post is theirs, otherwise their ghost account on the server it was made on
+func (q *RetryQueue) sendPostAsSender(ctx context.Context, item *RetryItem) (*model.Post, *model.Response, error) {
+	var userClient *Client
+	var server string
+	for _, login := range q.Connector.senderLogins(item.SenderMXID) {
+		if login.getOwnMMID() == item.Post.UserId {
+			userClient = login.Client()
+			server = loginServer(login.Login)
+			break
+		}
+	}
+	if userClient == nil {
+		matrixUsers, err := q.Connector.MatrixUsers.GetAll(ctx, item.SenderMXID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get ghost accounts: %w", err)
+		}
+		for _, matrixUser := range matrixUsers {
+			if matrixUser.MMUserID == item.Post.UserId {
+				server = matrixUser.Server
+				break
+			}
+		}
+		userClient, _, err = q.Connector.GetClientForUser(ctx, server, item.SenderMXID.String())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get client for ghost: %w", err)
+		}
+	}
+	var createdPost *model.Post
+	resp, err := q.Connector.DoAsUser(ctx, server, item.SenderMXID.String(), userClient, func(client *Client) (resp *model.Response, err error) {
+		createdPost, resp, err = client.CreatePost(ctx, item.Post)
+		return resp, err
+	})
+	return createdPost, resp, err
+}
+
+// onSuccess saves the message mapping that would normally be saved when HandleMatrixMessage returns
+func (q *RetryQueue) onSuccess(ctx context.Context, item *RetryItem, createdPost *model.Post) {
+	br := q.Connector.Bridge
+	if br == nil {
+		return
+	}
+	err := br.DB.Message.Insert(ctx, &database.Message{
+		ID:         networkid.MessageID(createdPost.Id),
+		MXID:       item.EventID,
+		Room:       item.Portal,
+		SenderMXID: item.SenderMXID,
+		Timestamp:  time.UnixMilli(createdPost.CreateAt),
+		ThreadRoot: networkid.MessageID(createdPost.RootId),
+	})
+	if err != nil {
+		q.log.Err(err).Stringer("event_id", item.EventID).Msg("Failed to save retried message to database")
+	}
+	q.sendStatus(ctx, item, bridgev2.MessageStatus{Status: event.MessageStatusSuccess})
+}
+
+// onPermanentFailure tells the sender that their message will never reach Mattermost.
+// The error notice is sent by the bridge if message_error_notices is enabled.
+func (q *RetryQueue) onPermanentFailure(ctx context.Context, item *RetryItem, err error) {
+	q.Connector.notifyStatusAsync("", "Message %s from %s in %s couldn't be delivered to Mattermost after %d attempts: %v", item.EventID, item.SenderMXID, item.RoomID, item.Attempts, err)
+	q.sendStatus(ctx, item, bridgev2.WrapErrorInStatus(err).
+		WithStatus(event.MessageStatusFail).
+		WithMessage(fmt.Sprintf("failed to send message to Mattermost after %d attempts", item.Attempts)).
+		WithIsCertain(true).
+		WithSendNotice(true))
+}
+
+func (q *RetryQueue) sendStatus(ctx context.Context, item *RetryItem, status bridgev2.MessageStatus) {
+	br := q.Connector.Bridge
+	if br == nil || br.Matrix == nil {
+		return
+	}
+	status.RetryNum = item.Attempts
+	br.Matrix.SendMessageStatus(ctx, &status, &bridgev2.MessageStatusEventInfo{
+		RoomID:    item.RoomID,
+		EventID:   item.EventID,
+		EventType: event.EventMessage,
+		Sender:    item.SenderMXID,
+	})
+}
+
+// IsRetryablePostError checks if creating a post failed for a reason that may go away,
+// i.e. a network error, rate limiting or a server error.
+func IsRetryablePostError(resp *model.Response, err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch statusCode := responseStatusCode(resp, err); {
+	case statusCode == 0:
+		// No response at all, most likely a network error
+		return true
+	case statusCode == http.StatusTooManyRequests, statusCode == http.StatusRequestTimeout:
+		return true
+	case statusCode >= 500:
+		return true
+	}
+	return false
+}
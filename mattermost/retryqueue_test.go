@@ -0,0 +1,140 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func newTestRetryQueue(t *testing.T, cfg RetryQueueConfig) *RetryQueue {
+	db, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	require.NoError(t, err)
+	// Every connection to :memory: is a separate database
+	db.RawDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+
+	q := NewRetryQueue(&MattermostConnector{}, db, cfg)
+	require.NoError(t, q.db.Upgrade(context.Background()))
+	return q
+}
+
+func TestIsRetryablePostError(t *testing.T) {
+	someErr := errors.New("failed")
+	tests := []struct {
+		name     string
+		resp     *model.Response
+		err      error
+		expected bool
+	}{
+		{"no error", &model.Response{StatusCode: http.StatusCreated}, nil, false},
+		{"network error", nil, someErr, true},
+		{"rate limited", &model.Response{StatusCode: http.StatusTooManyRequests}, someErr, true},
+		{"server error", &model.Response{StatusCode: http.StatusBadGateway}, someErr, true},
+		{"forbidden", &model.Response{StatusCode: http.StatusForbidden}, someErr, false},
+		{"bad request", &model.Response{StatusCode: http.StatusBadRequest}, someErr, false},
+		{"canceled", nil, context.Canceled, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, IsRetryablePostError(tt.resp, tt.err))
+		})
+	}
+}
+
+func TestRetryQueue_Backoff(t *testing.T) {
+	q := &RetryQueue{Config: RetryQueueConfig{InitialDelay: 2, MaxDelay: 10}}
+	assert.Equal(t, 2*time.Second, q.backoff(1))
+	assert.Equal(t, 4*time.Second, q.backoff(2))
+	assert.Equal(t, 8*time.Second, q.backoff(3))
+	assert.Equal(t, 10*time.Second, q.backoff(4))
+	assert.Equal(t, 10*time.Second, q.backoff(20))
+
+	defaults := &RetryQueue{}
+	assert.Equal(t, defaultRetryInitialDelay, defaults.backoff(1))
+	assert.Equal(t, defaultRetryMaxDelay, defaults.backoff(100))
+}
+
+func TestRetryQueue_DeadLetterAfterMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	q := newTestRetryQueue(t, RetryQueueConfig{MaxAttempts: 3})
+
+	sendCount := 0
+	q.sendPost = func(ctx context.Context, item *RetryItem) (*model.Post, *model.Response, error) {
+		sendCount++
+		assert.Equal(t, "Hello from Matrix", item.Post.Message)
+		return nil, &model.Response{StatusCode: http.StatusServiceUnavailable}, errors.New("service unavailable")
+	}
+
+	err := q.Enqueue(ctx, &RetryItem{
+		EventID:    "$event1",
+		RoomID:     "!room:example.com",
+		Portal:     networkid.PortalKey{ID: "channel1"},
+		SenderMXID: "@alice:example.com",
+		Post:       &model.Post{ChannelId: "channel1", Message: "Hello from Matrix"},
+	}, errors.New("rate limited"))
+	require.NoError(t, err)
+
+	// Nothing is due immediately because of the backoff
+	due, err := q.GetDue(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, due)
+
+	farFuture := time.Now().Add(24 * time.Hour)
+	for attempt := 2; attempt <= 3; attempt++ {
+		due, err = q.GetDue(ctx, farFuture)
+		require.NoError(t, err)
+		require.Len(t, due, 1)
+		assert.Equal(t, attempt-1, due[0].Attempts)
+		q.retry(ctx, due[0])
+	}
+	assert.Equal(t, 2, sendCount)
+
+	due, err = q.GetDue(ctx, farFuture)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+
+	failed, err := q.GetFailed(ctx)
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	assert.Equal(t, RetryStateFailed, failed[0].State)
+	assert.Equal(t, 3, failed[0].Attempts)
+	assert.Equal(t, "service unavailable", failed[0].LastError)
+}
+
+func TestRetryQueue_SuccessRemovesItem(t *testing.T) {
+	ctx := context.Background()
+	q := newTestRetryQueue(t, RetryQueueConfig{})
+	q.sendPost = func(ctx context.Context, item *RetryItem) (*model.Post, *model.Response, error) {
+		return &model.Post{Id: "post1", ChannelId: item.Post.ChannelId}, &model.Response{StatusCode: http.StatusCreated}, nil
+	}
+
+	err := q.Enqueue(ctx, &RetryItem{
+		EventID:    "$event1",
+		RoomID:     "!room:example.com",
+		Portal:     networkid.PortalKey{ID: "channel1"},
+		SenderMXID: "@alice:example.com",
+		Post:       &model.Post{ChannelId: "channel1", Message: "Hello"},
+	}, nil)
+	require.NoError(t, err)
+
+	due, err := q.GetDue(ctx, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	q.retry(ctx, due[0])
+
+	due, err = q.GetDue(ctx, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, due)
+	failed, err := q.GetFailed(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+}
@@ -0,0 +1,261 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/event"
+)
+
+// Favorite and muted channels on Mattermost are synced with room tags and mutes of the
+// Matrix accounts of logged-in users, in both directions. Favorites are the m.favourite
+// tag, and muted channels are muted rooms with the m.lowpriority tag. In mirror mode,
+// other direct and group messages can get the tag set in mirror.dm_tag. The tags are set
+// with the double puppet, so users without one only get them from Matrix to Mattermost.
+
+var (
+	_ bridgev2.TagHandlingNetworkAPI  = (*MattermostAPI)(nil)
+	_ bridgev2.MuteHandlingNetworkAPI = (*MattermostAPI)(nil)
+)
+
+// channelUserLocalInfo returns the favorite and mute state of a channel for the login's
+// Mattermost user, or nil if it can't be fetched
+func (m *MattermostAPI) channelUserLocalInfo(ctx context.Context, channelID string) *bridgev2.UserLocalPortalInfo {
+	mmUserID := m.getOwnMMID()
+	if mmUserID == "" {
+		return nil
+	}
+	member, _, err := m.Client().GetChannelMember(ctx, channelID, mmUserID, "")
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Str("channel_id", channelID).Msg("Failed to get channel member for room tags")
+		return nil
+	}
+	favorite := false
+	pref, resp, err := m.Client().GetPreferenceByCategoryAndName(ctx, mmUserID, model.PreferenceCategoryFavoriteChannel, channelID)
+	if err == nil {
+		favorite = pref.Value == "true"
+	} else if responseStatusCode(resp, err) != http.StatusNotFound {
+		zerolog.Ctx(ctx).Debug().Err(err).Str("channel_id", channelID).Msg("Failed to get favorite preference for room tags")
+		return nil
+	}
+	info := userLocalInfo(favorite, member.IsChannelMuted())
+	if *info.Tag == "" {
+		*info.Tag = m.directChatTag(ctx, channelID)
+	}
+	return info
+}
+
+// directChatTag returns the room tag set on direct and group message rooms in mirror mode,
+// so that users can tell their own conversations apart from the mirrored channels, or an
+// empty tag if mirror.dm_tag isn't set or the channel isn't a direct or group message
+func (m *MattermostAPI) directChatTag(ctx context.Context, channelID string) event.RoomTag {
+	if !m.Connector.IsMirrorMode() || m.Connector.config().Mirror.DMTag == "" {
+		return ""
+	}
+	channel, err := m.Connector.getCachedChannel(ctx, m.Client(), channelID)
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Str("channel_id", channelID).Msg("Failed to get channel for room tags")
+		return ""
+	} else if channel.Type != model.ChannelTypeDirect && channel.Type != model.ChannelTypeGroup {
+		return ""
+	}
+	return event.RoomTag(m.Connector.config().Mirror.DMTag)
+}
+
+// userLocalInfo converts the favorite and mute state of a channel to Matrix. Rooms can only
+// have one of the tags, so favorites win over low priority.
+func userLocalInfo(favorite, muted bool) *bridgev2.UserLocalPortalInfo {
+	info := &bridgev2.UserLocalPortalInfo{
+		MutedUntil: ptr.Ptr(bridgev2.Unmuted),
+		Tag:        ptr.Ptr(event.RoomTag("")),
+	}
+	if muted {
+		info.MutedUntil = ptr.Ptr(event.MutedForever)
+		*info.Tag = event.RoomTagLowPriority
+	}
+	if favorite {
+		*info.Tag = event.RoomTagFavourite
+	}
+	return info
+}
+
+// isChannelPortal checks whether a portal is a channel, rather than a team or category space
+func isChannelPortal(portal *bridgev2.Portal) bool {
+	if _, ok := parseCategoryPortalID(portal.ID); ok {
+		return false
+	}
+	return portal.RoomType != database.RoomTypeSpace
+}
+
+// HandleRoomTag adds or removes the channel of a room from the user's favorites when the
+// room is tagged as a favourite, and mutes or unmutes it when it's tagged as low priority
+func (m *MattermostAPI) HandleRoomTag(ctx context.Context, msg *bridgev2.MatrixRoomTag) error {
+	if !isChannelPortal(msg.Portal) {
+		return nil
+	}
+	var prevTags event.Tags
+	if msg.PrevContent != nil {
+		prevTags = msg.PrevContent.Tags
+	}
+	_, favorite := msg.Content.Tags[event.RoomTagFavourite]
+	_, wasFavorite := prevTags[event.RoomTagFavourite]
+	if msg.PrevContent == nil || favorite != wasFavorite {
+		if err := m.setFavorite(ctx, string(msg.Portal.ID), favorite); err != nil {
+			return err
+		}
+	}
+	_, lowPriority := msg.Content.Tags[event.RoomTagLowPriority]
+	_, wasLowPriority := prevTags[event.RoomTagLowPriority]
+	if lowPriority != wasLowPriority {
+		return m.setMuted(ctx, string(msg.Portal.ID), lowPriority)
+	}
+	return nil
+}
+
+// HandleMute mutes or unmutes the channel of a room. Mattermost doesn't have timed mutes,
+// so a room muted until some time is muted until it's unmuted on Matrix.
+func (m *MattermostAPI) HandleMute(ctx context.Context, msg *bridgev2.MatrixMute) error {
+	if !isChannelPortal(msg.Portal) {
+		return nil
+	}
+	return m.setMuted(ctx, string(msg.Portal.ID), msg.Content.IsMuted())
+}
+
+// setFavorite adds or removes a channel from the user's favorites. Mattermost keeps the
+// favorites sidebar category in sync with the preferences.
+func (m *MattermostAPI) setFavorite(ctx context.Context, channelID string, favorite bool) error {
+	mmUserID := m.getOwnMMID()
+	prefs := model.Preferences{{
+		UserId:   mmUserID,
+		Category: model.PreferenceCategoryFavoriteChannel,
+		Name:     channelID,
+		Value:    "true",
+	}}
+	var resp *model.Response
+	var err error
+	if favorite {
+		resp, err = m.Client().UpdatePreferences(ctx, mmUserID, prefs)
+	} else {
+		resp, err = m.Client().DeletePreferences(ctx, mmUserID, prefs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update favorite channels: %w", wrapMattermostError(resp, err))
+	}
+	return nil
+}
+
+// setMuted mutes or unmutes a channel for the user
+func (m *MattermostAPI) setMuted(ctx context.Context, channelID string, muted bool) error {
+	markUnread := model.ChannelMarkUnreadAll
+	if muted {
+		markUnread = model.ChannelMarkUnreadMention
+	}
+	resp, err := m.Client().UpdateChannelNotifyProps(ctx, channelID, m.getOwnMMID(), map[string]string{
+		model.MarkUnreadNotifyProp: markUnread,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update channel notify props: %w", wrapMattermostError(resp, err))
+	}
+	return nil
+}
+
+// ChannelPrefsEvent is a synthetic event that applies the favorite and mute state of a
+// channel to the Matrix account of the login it's queued for
+type ChannelPrefsEvent struct {
+	MattermostEvent
+	UserLocal *bridgev2.UserLocalPortalInfo
+}
+
+var _ bridgev2.RemoteChatInfoChange = (*ChannelPrefsEvent)(nil)
+
+func (e *ChannelPrefsEvent) GetType() bridgev2.RemoteEventType {
+	return bridgev2.RemoteEventChatInfoChange
+}
+
+func (e *ChannelPrefsEvent) GetSender() bridgev2.EventSender {
+	sender := e.MattermostEvent.GetSender()
+	sender.IsFromMe = true
+	return sender
+}
+
+func (e *ChannelPrefsEvent) GetChatInfoChange(ctx context.Context) (*bridgev2.ChatInfoChange, error) {
+	return &bridgev2.ChatInfoChange{
+		ChatInfo: &bridgev2.ChatInfo{UserLocal: e.UserLocal},
+	}, nil
+}
+
+// handlePreferencesEvent syncs the room tags of the channels whose favorite preference
+// changed
+func (m *MattermostConnector) handlePreferencesEvent(ctx context.Context, server string, evt *model.WebSocketEvent) {
+	prefsStr, ok := evt.GetData()["preferences"].(string)
+	if !ok {
+		return
+	}
+	var prefs model.Preferences
+	if err := json.Unmarshal([]byte(prefsStr), &prefs); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to parse preferences in websocket event")
+		return
+	}
+	for _, pref := range prefs {
+		if pref.Category == model.PreferenceCategoryFavoriteChannel {
+			m.syncChannelPrefs(ctx, server, pref.UserId, pref.Name)
+		}
+	}
+}
+
+// handleChannelMemberEvent syncs the mute state of a channel when a member's notify props
+// changed
+func (m *MattermostConnector) handleChannelMemberEvent(ctx context.Context, server string, evt *model.WebSocketEvent) {
+	memberStr, ok := evt.GetData()["channelMember"].(string)
+	if !ok {
+		return
+	}
+	var member model.ChannelMember
+	if err := json.Unmarshal([]byte(memberStr), &member); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to parse channel member in websocket event")
+		return
+	}
+	m.syncChannelPrefs(ctx, server, member.UserId, member.ChannelId)
+}
+
+// syncChannelPrefs fetches the favorite and mute state of a channel for a logged-in user
+// and queues it for their login. Users who aren't logged in or can't be double puppeted
+// are skipped.
+func (m *MattermostConnector) syncChannelPrefs(ctx context.Context, server, mmUserID, channelID string) {
+	loginID := m.loginIDForMMUser(mmUserID)
+	if loginID == "" || channelID == "" {
+		return
+	}
+	m.usersLock.RLock()
+	login := m.users[loginID]
+	m.usersLock.RUnlock()
+	if login == nil || loginServer(login) != server {
+		return
+	}
+	api, ok := login.Client.(*MattermostAPI)
+	if !ok || api.Client() == nil {
+		return
+	}
+	info := api.channelUserLocalInfo(ctx, channelID)
+	if info == nil {
+		return
+	}
+	m.queueLoginEvent(login, &ChannelPrefsEvent{
+		MattermostEvent: MattermostEvent{
+			Connector: m,
+			Server:    server,
+			Timestamp: time.Now(),
+			ChannelID: channelID,
+			UserID:    mmUserID,
+		},
+		UserLocal: info,
+	})
+}
@@ -0,0 +1,142 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestUserLocalInfo(t *testing.T) {
+	info := userLocalInfo(false, false)
+	assert.Equal(t, bridgev2.Unmuted, *info.MutedUntil)
+	assert.Equal(t, event.RoomTag(""), *info.Tag)
+
+	info = userLocalInfo(false, true)
+	assert.Equal(t, event.MutedForever, *info.MutedUntil)
+	assert.Equal(t, event.RoomTagLowPriority, *info.Tag)
+
+	info = userLocalInfo(true, true)
+	assert.Equal(t, event.MutedForever, *info.MutedUntil)
+	assert.Equal(t, event.RoomTagFavourite, *info.Tag)
+}
+
+// newPrefsTestAPI returns an API for the user user1 that records the requests it makes
+func newPrefsTestAPI(t *testing.T, handler http.HandlerFunc) *MattermostAPI {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	login := &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "alice", Metadata: map[string]any{"mm_id": "user1"}}}
+	return newMattermostAPI(login, nil, NewClient(server.URL, "token"))
+}
+
+func TestChannelUserLocalInfo(t *testing.T) {
+	api := newPrefsTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/channels/channel1/members/user1":
+			_ = json.NewEncoder(w).Encode(&model.ChannelMember{
+				ChannelId:   "channel1",
+				UserId:      "user1",
+				NotifyProps: model.StringMap{model.MarkUnreadNotifyProp: model.ChannelMarkUnreadMention},
+			})
+		case "/api/v4/users/user1/preferences/favorite_channel/name/channel1":
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(&model.AppError{Id: "app.preference.get.app_error", StatusCode: http.StatusNotFound})
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(&model.AppError{Id: "api.context.permissions.app_error", StatusCode: http.StatusForbidden})
+		}
+	})
+	info := api.channelUserLocalInfo(context.Background(), "channel1")
+	require.NotNil(t, info)
+	assert.Equal(t, event.MutedForever, *info.MutedUntil)
+	assert.Equal(t, event.RoomTagLowPriority, *info.Tag)
+
+	assert.Nil(t, api.channelUserLocalInfo(context.Background(), "channel2"), "the user isn't in channel2")
+}
+
+func TestDirectChatTag(t *testing.T) {
+	api := newPrefsTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/channels/dm1/members/user1", "/api/v4/channels/open1/members/user1":
+			_ = json.NewEncoder(w).Encode(&model.ChannelMember{UserId: "user1"})
+		case "/api/v4/users/user1/preferences/favorite_channel/name/dm1", "/api/v4/users/user1/preferences/favorite_channel/name/open1":
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(&model.AppError{Id: "app.preference.get.app_error", StatusCode: http.StatusNotFound})
+		case "/api/v4/channels/dm1":
+			_ = json.NewEncoder(w).Encode(&model.Channel{Id: "dm1", Type: model.ChannelTypeDirect})
+		case "/api/v4/channels/open1":
+			_ = json.NewEncoder(w).Encode(&model.Channel{Id: "open1", Type: model.ChannelTypeOpen})
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(&model.AppError{Id: "api.context.permissions.app_error", StatusCode: http.StatusForbidden})
+		}
+	})
+	api.Connector = &MattermostConnector{Config: &NetworkConfig{Mode: ModeMirror, Mirror: MirrorConfig{DMTag: "u.mattermost.direct"}}}
+	ctx := context.Background()
+
+	info := api.channelUserLocalInfo(ctx, "dm1")
+	require.NotNil(t, info)
+	assert.Equal(t, event.RoomTag("u.mattermost.direct"), *info.Tag)
+	assert.Equal(t, event.RoomTag(""), *api.channelUserLocalInfo(ctx, "open1").Tag)
+
+	// Outside of mirror mode, DMs aren't tagged
+	api.Connector.config().Mode = ModePuppet
+	assert.Equal(t, event.RoomTag(""), *api.channelUserLocalInfo(ctx, "dm1").Tag)
+}
+
+func TestHandleRoomTag(t *testing.T) {
+	var requests []string
+	api := newPrefsTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		_, _ = w.Write([]byte(`{"status": "OK"}`))
+	})
+	portal := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "channel1"}}}
+	ctx := context.Background()
+
+	err := api.HandleRoomTag(ctx, &bridgev2.MatrixRoomTag{
+		MatrixEventBase: bridgev2.MatrixEventBase[*event.TagEventContent]{
+			Portal:  portal,
+			Content: &event.TagEventContent{Tags: event.Tags{event.RoomTagFavourite: {}}},
+		},
+		PrevContent: &event.TagEventContent{Tags: event.Tags{event.RoomTagLowPriority: {}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+	assert.Contains(t, requests[0], "PUT /api/v4/users/user1/preferences ")
+	assert.Contains(t, requests[0], `"category":"favorite_channel","name":"channel1","value":"true"`)
+	assert.Contains(t, requests[1], "PUT /api/v4/channels/channel1/members/user1/notify_props")
+	assert.Contains(t, requests[1], `"mark_unread":"all"`)
+
+	requests = nil
+	err = api.HandleMute(ctx, &bridgev2.MatrixMute{
+		MatrixEventBase: bridgev2.MatrixEventBase[*event.BeeperMuteEventContent]{
+			Portal:  portal,
+			Content: &event.BeeperMuteEventContent{MutedUntil: -1},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, requests, 1)
+	assert.Contains(t, requests[0], `"mark_unread":"mention"`)
+
+	requests = nil
+	space := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "team1"}, RoomType: database.RoomTypeSpace}}
+	err = api.HandleRoomTag(ctx, &bridgev2.MatrixRoomTag{
+		MatrixEventBase: bridgev2.MatrixEventBase[*event.TagEventContent]{
+			Portal:  space,
+			Content: &event.TagEventContent{Tags: event.Tags{event.RoomTagFavourite: {}}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, requests, "spaces aren't channels")
+}
@@ -0,0 +1,337 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// Posts scheduled on Mattermost are created by the server when they're due, and bridged
+// like any other post. With scheduled_posts, Matrix users can schedule posts too: the
+// schedule command creates a scheduled post with their Mattermost account, and the bridge
+// remembers it so that it can be listed and cancelled from Matrix. When the post of a
+// Matrix user's ghost account fires, it's sent by their double puppet, or by the bridge bot
+// with their name if they don't have one, since it never came from Matrix.
+
+var scheduledPostUpgrades dbutil.UpgradeTable
+
+func init() {
+	scheduledPostUpgrades.Register(-1, 1, 0, "Create Mattermost scheduled post table", dbutil.TxnModeOn, func(ctx context.Context, db *dbutil.Database) error {
+		_, err := db.Exec(ctx, `
+			CREATE TABLE mattermost_scheduled_post (
+				bridge_id    TEXT   NOT NULL,
+				id           TEXT   NOT NULL,
+				mxid         TEXT   NOT NULL,
+				room_id      TEXT   NOT NULL,
+				channel_id   TEXT   NOT NULL,
+				message      TEXT   NOT NULL,
+				scheduled_at BIGINT NOT NULL,
+
+				PRIMARY KEY (bridge_id, id)
+			)
+		`)
+		return err
+	})
+}
+
+// scheduledByProp marks the posts scheduled from Matrix with the Matrix user who scheduled them
+const scheduledByProp = "matrix_scheduled_by"
+
+// PendingScheduledPost is a post a Matrix user scheduled that hasn't been sent yet
+type PendingScheduledPost struct {
+	// ID is the ID of the scheduled post on Mattermost
+	ID          string
+	MXID        id.UserID
+	RoomID      id.RoomID
+	ChannelID   string
+	Message     string
+	ScheduledAt time.Time
+}
+
+// ScheduledPostStore stores the posts Matrix users scheduled through the bridge
+type ScheduledPostStore struct {
+	bridgeID networkid.BridgeID
+	db       *dbutil.Database
+}
+
+// NewScheduledPostStore creates a scheduled post store in the given database
+func NewScheduledPostStore(bridgeID networkid.BridgeID, db *dbutil.Database) *ScheduledPostStore {
+	return &ScheduledPostStore{
+		bridgeID: bridgeID,
+		db:       db.Child("mattermost_scheduled_post_version", scheduledPostUpgrades, nil),
+	}
+}
+
+// Upgrade creates the table if needed
+func (s *ScheduledPostStore) Upgrade(ctx context.Context) error {
+	return s.db.Upgrade(ctx)
+}
+
+// Put inserts or replaces a scheduled post
+func (s *ScheduledPostStore) Put(ctx context.Context, post *PendingScheduledPost) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO mattermost_scheduled_post (bridge_id, id, mxid, room_id, channel_id, message, scheduled_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (bridge_id, id) DO UPDATE
+			SET mxid=excluded.mxid, room_id=excluded.room_id, channel_id=excluded.channel_id,
+				message=excluded.message, scheduled_at=excluded.scheduled_at
+	`, s.bridgeID, post.ID, post.MXID, post.RoomID, post.ChannelID, post.Message, post.ScheduledAt.UnixMilli())
+	return err
+}
+
+// GetByMXID returns the posts a Matrix user scheduled that are due after the given time,
+// the next one first
+func (s *ScheduledPostStore) GetByMXID(ctx context.Context, mxid id.UserID, after time.Time) ([]*PendingScheduledPost, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT id, room_id, channel_id, message, scheduled_at
+		FROM mattermost_scheduled_post WHERE bridge_id=$1 AND mxid=$2 AND scheduled_at>$3
+		ORDER BY scheduled_at
+	`, s.bridgeID, mxid, after.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var posts []*PendingScheduledPost
+	for rows.Next() {
+		post := &PendingScheduledPost{MXID: mxid}
+		var scheduledAt int64
+		if err = rows.Scan(&post.ID, &post.RoomID, &post.ChannelID, &post.Message, &scheduledAt); err != nil {
+			return nil, err
+		}
+		post.ScheduledAt = time.UnixMilli(scheduledAt)
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+// Delete removes a scheduled post
+func (s *ScheduledPostStore) Delete(ctx context.Context, postID string) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM mattermost_scheduled_post WHERE bridge_id=$1 AND id=$2", s.bridgeID, postID)
+	return err
+}
+
+// DeleteFired removes the posts a Matrix user scheduled in a channel that were due by the
+// given time. Posts created from a schedule don't say which scheduled post they came from.
+func (s *ScheduledPostStore) DeleteFired(ctx context.Context, mxid id.UserID, channelID string, before time.Time) error {
+	_, err := s.db.Exec(ctx, `
+		DELETE FROM mattermost_scheduled_post
+		WHERE bridge_id=$1 AND mxid=$2 AND channel_id=$3 AND scheduled_at<=$4
+	`, s.bridgeID, mxid, channelID, before.UnixMilli())
+	return err
+}
+
+// scheduleTimeLayouts are the absolute times the schedule command accepts, in the bridge's
+// time zone unless the time has an offset
+var scheduleTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02T15:04:05"}
+
+// parseScheduleTime parses when a post should be sent: a duration from now, a time of day
+// (today, or tomorrow if it has passed) or a date and time
+func parseScheduleTime(arg string, now time.Time) (time.Time, error) {
+	var at time.Time
+	if d, err := time.ParseDuration(arg); err == nil {
+		at = now.Add(d)
+	} else if t, err := time.ParseInLocation("15:04", arg, now.Location()); err == nil {
+		at = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+	} else {
+		for _, layout := range scheduleTimeLayouts {
+			if at, err = time.ParseInLocation(layout, arg, now.Location()); err == nil {
+				break
+			}
+		}
+		if at.IsZero() {
+			return at, fmt.Errorf("%q isn't a duration like 2h30m, a time like 17:00 or a date like 2006-01-02T15:04", arg)
+		}
+	}
+	if !at.After(now) {
+		return at, fmt.Errorf("the time must be in the future")
+	}
+	return at, nil
+}
+
+// scheduleClient returns the client and Mattermost user ID posts of a Matrix user are
+// scheduled with: their login if they're logged in, otherwise their ghost account
+func (m *MattermostConnector) scheduleClient(ctx context.Context, user *bridgev2.User) (*Client, string, error) {
+	if login := user.GetDefaultLogin(); login != nil {
+		if api, ok := login.Client.(*MattermostAPI); ok && api.Client() != nil {
+			return api.Client(), api.getOwnMMID(), nil
+		}
+	}
+	return m.GetClientForUser(ctx, "", user.MXID.String())
+}
+
+// schedulePost schedules a post of a Matrix user in the channel of a portal
+func (m *MattermostConnector) schedulePost(ctx context.Context, user *bridgev2.User, portal *bridgev2.Portal, at time.Time, message string) (*PendingScheduledPost, error) {
+	if !getPortalMetadata(portal).BridgesToMattermost() {
+		return nil, ErrDirectionDisabled
+	}
+	client, mmUserID, err := m.scheduleClient(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	created, resp, err := client.CreateScheduledPost(ctx, &model.ScheduledPost{
+		Draft: model.Draft{
+			UserId:    mmUserID,
+			ChannelId: string(portal.ID),
+			Message:   message,
+			Props:     model.StringInterface{scheduledByProp: user.MXID.String()},
+		},
+		ScheduledAt: at.UnixMilli(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scheduled post: %w", wrapMattermostError(resp, err))
+	}
+	post := &PendingScheduledPost{
+		ID:          created.Id,
+		MXID:        user.MXID,
+		RoomID:      portal.MXID,
+		ChannelID:   string(portal.ID),
+		Message:     message,
+		ScheduledAt: at,
+	}
+	if err = m.ScheduledPosts.Put(ctx, post); err != nil {
+		return post, fmt.Errorf("failed to save scheduled post: %w", err)
+	}
+	return post, nil
+}
+
+// cancelScheduledPost deletes a post a Matrix user scheduled before it's sent
+func (m *MattermostConnector) cancelScheduledPost(ctx context.Context, user *bridgev2.User, postID string) error {
+	posts, err := m.ScheduledPosts.GetByMXID(ctx, user.MXID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to get scheduled posts: %w", err)
+	}
+	found := false
+	for _, post := range posts {
+		found = found || post.ID == postID
+	}
+	if !found {
+		return fmt.Errorf("you have no scheduled post with ID %s", postID)
+	}
+	client, _, err := m.scheduleClient(ctx, user)
+	if err != nil {
+		return err
+	}
+	if _, resp, err := client.DeleteScheduledPost(ctx, postID); err != nil && responseStatusCode(resp, err) != http.StatusNotFound {
+		return fmt.Errorf("failed to delete scheduled post: %w", wrapMattermostError(resp, err))
+	}
+	return m.ScheduledPosts.Delete(ctx, postID)
+}
+
+// scheduledPostAuthor returns the Matrix user who scheduled a post, if it was scheduled from Matrix
+func scheduledPostAuthor(post *model.Post) id.UserID {
+	mxid, _ := post.GetProp(scheduledByProp).(string)
+	return id.UserID(mxid)
+}
+
+// forgetFiredScheduledPost removes a scheduled post from the store once it has been sent
+func (m *MattermostConnector) forgetFiredScheduledPost(ctx context.Context, post *model.Post, mxid id.UserID) {
+	if m.ScheduledPosts == nil {
+		return
+	}
+	if err := m.ScheduledPosts.DeleteFired(ctx, mxid, post.ChannelId, time.Now()); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("post_id", post.Id).Msg("Failed to remove sent scheduled post")
+	}
+}
+
+// attributeScheduledPost prefixes a scheduled post the bridge bot sends for a Matrix user
+// with the user, so that it's clear who it's from
+func attributeScheduledPost(msg *bridgev2.ConvertedMessage, mxid id.UserID) {
+	if len(msg.Parts) == 0 || msg.Parts[0].Content == nil {
+		return
+	}
+	content := msg.Parts[0].Content
+	content.Body = fmt.Sprintf("%s: %s", mxid, content.Body)
+	if content.Format == event.FormatHTML {
+		content.FormattedBody = fmt.Sprintf(`<a href="%s">%s</a>: %s`, html.EscapeString(mxid.URI().MatrixToURL()), html.EscapeString(mxid.String()), content.FormattedBody)
+	}
+}
+
+// formatScheduledPosts lists scheduled posts for the schedule command
+func formatScheduledPosts(posts []*PendingScheduledPost) string {
+	if len(posts) == 0 {
+		return "You have no scheduled posts"
+	}
+	lines := make([]string, len(posts))
+	for i, post := range posts {
+		preview := []rune(post.Message)
+		if len(preview) > 50 {
+			preview = append(preview[:50], '…')
+		}
+		lines[i] = fmt.Sprintf("* `%s` at %s in %s: %s", post.ID, post.ScheduledAt.Format("2006-01-02 15:04 MST"), post.RoomID.URI().MatrixToURL(), string(preview))
+	}
+	return "Your scheduled posts:\n\n" + strings.Join(lines, "\n")
+}
+
+// cmdSchedule schedules posts in the channel of a room, and lists or cancels them
+func (m *MattermostConnector) cmdSchedule() *commands.FullHandler {
+	return &commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			const usage = "**Usage:** `$cmdprefix schedule <duration|time> <message>`, `$cmdprefix schedule list` or `$cmdprefix schedule cancel <ID>`"
+			if len(ce.Args) == 0 {
+				ce.Reply(usage)
+				return
+			}
+			switch strings.ToLower(ce.Args[0]) {
+			case "list":
+				posts, err := m.ScheduledPosts.GetByMXID(ce.Ctx, ce.User.MXID, time.Now())
+				if err != nil {
+					ce.Reply("Failed to get scheduled posts: %v", err)
+					return
+				}
+				ce.Reply(formatScheduledPosts(posts))
+				return
+			case "cancel":
+				if len(ce.Args) != 2 {
+					ce.Reply(usage)
+					return
+				}
+				if err := m.cancelScheduledPost(ce.Ctx, ce.User, ce.Args[1]); err != nil {
+					ce.Reply("Failed to cancel scheduled post: %v", err)
+				} else {
+					ce.Reply("Cancelled scheduled post `%s`", ce.Args[1])
+				}
+				return
+			}
+			if ce.Portal == nil {
+				ce.Reply("Posts can only be scheduled in a portal room")
+				return
+			} else if len(ce.Args) < 2 {
+				ce.Reply(usage)
+				return
+			}
+			at, err := parseScheduleTime(ce.Args[0], time.Now())
+			if err != nil {
+				ce.Reply("Invalid time: %v", err)
+				return
+			}
+			message := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(ce.RawArgs), ce.Args[0]))
+			post, err := m.schedulePost(ce.Ctx, ce.User, ce.Portal, at, message)
+			if err != nil {
+				ce.Reply("Failed to schedule post: %v", err)
+				return
+			}
+			ce.Reply("Scheduled post `%s` for %s", post.ID, post.ScheduledAt.Format("2006-01-02 15:04 MST"))
+		},
+		Name: "schedule",
+		Help: commands.HelpMeta{
+			Section:     commands.HelpSectionChats,
+			Description: "Schedule a post in the channel of this room, or list and cancel your scheduled posts",
+			Args:        "<_duration or time_> <_message_> | list | cancel <_ID_>",
+		},
+	}
+}
@@ -0,0 +1,105 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestScheduledPostStore(t *testing.T) {
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+	store := NewScheduledPostStore("mattermost", bridgeDB.Database)
+	require.NoError(t, store.Upgrade(ctx))
+
+	now := time.UnixMilli(time.Now().UnixMilli())
+	for _, post := range []*PendingScheduledPost{
+		{ID: "later", MXID: "@alice:example.com", RoomID: "!room:example.com", ChannelID: "channel1", Message: "later", ScheduledAt: now.Add(2 * time.Hour)},
+		{ID: "soon", MXID: "@alice:example.com", RoomID: "!room:example.com", ChannelID: "channel1", Message: "soon", ScheduledAt: now.Add(time.Hour)},
+		{ID: "other", MXID: "@bob:example.com", RoomID: "!room:example.com", ChannelID: "channel1", Message: "other", ScheduledAt: now.Add(time.Hour)},
+	} {
+		require.NoError(t, store.Put(ctx, post))
+	}
+
+	posts, err := store.GetByMXID(ctx, "@alice:example.com", now)
+	require.NoError(t, err)
+	require.Len(t, posts, 2)
+	assert.Equal(t, "soon", posts[0].ID)
+	assert.Equal(t, "later", posts[1].ID)
+	assert.True(t, now.Add(time.Hour).Equal(posts[0].ScheduledAt))
+
+	// Only the posts that were due are removed when one fires
+	require.NoError(t, store.DeleteFired(ctx, "@alice:example.com", "channel1", now.Add(time.Hour)))
+	posts, err = store.GetByMXID(ctx, "@alice:example.com", now)
+	require.NoError(t, err)
+	require.Len(t, posts, 1)
+	assert.Equal(t, "later", posts[0].ID)
+
+	require.NoError(t, store.Delete(ctx, "later"))
+	posts, err = store.GetByMXID(ctx, "@alice:example.com", now)
+	require.NoError(t, err)
+	assert.Empty(t, posts)
+	posts, err = store.GetByMXID(ctx, "@bob:example.com", now)
+	require.NoError(t, err)
+	assert.Len(t, posts, 1)
+}
+
+func TestParseScheduleTime(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		arg  string
+		want time.Time
+	}{
+		{"90m", now.Add(90 * time.Minute)},
+		{"17:30", time.Date(2024, 5, 1, 17, 30, 0, 0, time.UTC)},
+		// Times of day that have passed are tomorrow
+		{"09:00", time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC)},
+		{"2024-05-03T08:15", time.Date(2024, 5, 3, 8, 15, 0, 0, time.UTC)},
+		{"2024-05-03T08:15:00+02:00", time.Date(2024, 5, 3, 6, 15, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseScheduleTime(tt.arg, now)
+		require.NoError(t, err, tt.arg)
+		assert.True(t, tt.want.Equal(got), "%s: got %s", tt.arg, got)
+	}
+
+	for _, arg := range []string{"-1h", "2024-04-30T08:00", "tomorrow"} {
+		_, err := parseScheduleTime(arg, now)
+		assert.Error(t, err, arg)
+	}
+}
+
+func TestScheduledPostAuthor(t *testing.T) {
+	post := &model.Post{}
+	assert.Empty(t, scheduledPostAuthor(post))
+	post.AddProp(scheduledByProp, "@alice:example.com")
+	assert.EqualValues(t, "@alice:example.com", scheduledPostAuthor(post))
+}
+
+func TestAttributeScheduledPost(t *testing.T) {
+	msg := &bridgev2.ConvertedMessage{Parts: []*bridgev2.ConvertedMessagePart{{
+		Content: &event.MessageEventContent{
+			MsgType:       event.MsgText,
+			Body:          "hello",
+			Format:        event.FormatHTML,
+			FormattedBody: "<b>hello</b>",
+		},
+	}}}
+	attributeScheduledPost(msg, "@alice:example.com")
+	assert.Equal(t, "@alice:example.com: hello", msg.Parts[0].Content.Body)
+	assert.Equal(t, `<a href="https://matrix.to/#/@alice:example.com">@alice:example.com</a>: <b>hello</b>`, msg.Parts[0].Content.FormattedBody)
+}
+
+func TestMattermostMessageEvent_ScheduledBySender(t *testing.T) {
+	evt := &MattermostMessageEvent{MattermostEvent: MattermostEvent{UserID: "ghost1"}}
+	assert.NotEmpty(t, evt.GetSender().Sender)
+	// Scheduled posts of users without double puppeting are sent by the bridge bot
+	evt.ScheduledBy = "@alice:example.com"
+	assert.Equal(t, bridgev2.EventSender{}, evt.GetSender())
+}
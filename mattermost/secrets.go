@@ -0,0 +1,61 @@
+package mattermost
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variables that can provide secrets instead of the config file
+const (
+	EnvAdminToken        = "MATTERMOST_ADMIN_TOKEN"
+	EnvSynapseAdminToken = "MATTERMOST_SYNAPSE_ADMIN_TOKEN"
+	EnvSlashCommandToken = "MATTERMOST_SLASH_COMMAND_TOKEN"
+	EnvOAuthClientSecret = "MATTERMOST_OAUTH_CLIENT_SECRET"
+	EnvCompanionSecret   = "MATTERMOST_COMPANION_SECRET"
+)
+
+// ResolveSecrets fills in the tokens from secret files or environment variables.
+// A configured file takes precedence over the environment variable, which takes
+// precedence over the value in the config itself.
+func (c *NetworkConfig) ResolveSecrets() error {
+	var err error
+	if c.AdminToken, err = resolveSecret(c.AdminToken, c.AdminTokenFile, EnvAdminToken); err != nil {
+		return fmt.Errorf("failed to read admin_token: %w", err)
+	}
+	if c.SynapseAdmin.Token, err = resolveSecret(c.SynapseAdmin.Token, c.SynapseAdmin.TokenFile, EnvSynapseAdminToken); err != nil {
+		return fmt.Errorf("failed to read synapse_admin.token: %w", err)
+	}
+	if c.SlashCommandToken, err = resolveSecret(c.SlashCommandToken, c.SlashCommandTokenFile, EnvSlashCommandToken); err != nil {
+		return fmt.Errorf("failed to read slash_command_token: %w", err)
+	}
+	for i := range c.SlashCommandTeams {
+		team := &c.SlashCommandTeams[i]
+		if team.Token, err = resolveSecret(team.Token, team.TokenFile, ""); err != nil {
+			return fmt.Errorf("failed to read token of slash_command_teams[%d]: %w", i, err)
+		}
+	}
+	if c.OAuth.ClientSecret, err = resolveSecret(c.OAuth.ClientSecret, c.OAuth.ClientSecretFile, EnvOAuthClientSecret); err != nil {
+		return fmt.Errorf("failed to read oauth.client_secret: %w", err)
+	}
+	if c.Companion.Secret, err = resolveSecret(c.Companion.Secret, c.Companion.SecretFile, EnvCompanionSecret); err != nil {
+		return fmt.Errorf("failed to read companion.secret: %w", err)
+	}
+	return nil
+}
+
+// resolveSecret returns the contents of file if set, otherwise the environment variable
+// if set, otherwise value.
+func resolveSecret(value, file, envVar string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if env, ok := os.LookupEnv(envVar); ok && env != "" {
+		return env, nil
+	}
+	return value, nil
+}
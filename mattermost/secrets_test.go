@@ -0,0 +1,38 @@
+package mattermost
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkConfig_ResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	adminTokenFile := filepath.Join(dir, "admin_token")
+	require.NoError(t, os.WriteFile(adminTokenFile, []byte("file-token\n"), 0600))
+	t.Setenv(EnvAdminToken, "env-admin-token")
+	t.Setenv(EnvSynapseAdminToken, "env-synapse-token")
+	t.Setenv(EnvSlashCommandToken, "")
+
+	cfg := &NetworkConfig{
+		AdminToken:        "config-token",
+		AdminTokenFile:    adminTokenFile,
+		SynapseAdmin:      SynapseAdminConfig{Token: "config-synapse-token"},
+		SlashCommandToken: "config-slash-token",
+	}
+	require.NoError(t, cfg.ResolveSecrets())
+
+	assert.Equal(t, "file-token", cfg.AdminToken)
+	assert.Equal(t, "env-synapse-token", cfg.SynapseAdmin.Token)
+	assert.Equal(t, "config-slash-token", cfg.SlashCommandToken)
+}
+
+func TestNetworkConfig_ResolveSecretsMissingFile(t *testing.T) {
+	cfg := &NetworkConfig{
+		SynapseAdmin: SynapseAdminConfig{TokenFile: filepath.Join(t.TempDir(), "missing")},
+	}
+	assert.ErrorContains(t, cfg.ResolveSecrets(), "synapse_admin.token")
+}
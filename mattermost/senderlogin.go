@@ -0,0 +1,69 @@
+package mattermost
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/id"
+)
+
+// Matrix users who are logged in to the bridge with their own Mattermost account post with
+// that account. Only Matrix users without a login get a ghost account (mx.*) and a personal
+// access token minted for them, so logged-in users don't end up with two accounts.
+
+// senderLogins returns the logins of a Matrix user that are their own Mattermost account,
+// sorted by ID. Bot logins and logins owned by ghosts aren't the same person on both sides,
+// like for double puppeting.
+func (m *MattermostConnector) senderLogins(mxid id.UserID) []*MattermostAPI {
+	var logins []*bridgev2.UserLogin
+	for _, login := range m.GetUsers() {
+		if login.UserMXID == mxid && m.canDoublePuppet(login) {
+			logins = append(logins, login)
+		}
+	}
+	slices.SortFunc(logins, func(a, b *bridgev2.UserLogin) int {
+		return strings.Compare(string(a.ID), string(b.ID))
+	})
+	apis := make([]*MattermostAPI, 0, len(logins))
+	for _, login := range logins {
+		if api, ok := login.Client.(*MattermostAPI); ok && api.Client() != nil && api.getOwnMMID() != "" {
+			apis = append(apis, api)
+		}
+	}
+	return apis
+}
+
+// isLoginClient checks whether a client is the client of a login. Its token comes from the
+// user, so unlike ghost tokens the bridge can't replace it when it's rejected.
+func (m *MattermostConnector) isLoginClient(client *Client) bool {
+	for _, login := range m.GetUsers() {
+		if api, ok := login.Client.(*MattermostAPI); ok && api.Client() == client {
+			return true
+		}
+	}
+	return false
+}
+
+// senderLogin returns the sender's own login on the server of this login, nil if they
+// don't have one
+func (m *MattermostAPI) senderLogin(mxid id.UserID) *MattermostAPI {
+	server := loginServer(m.Login)
+	for _, api := range m.Connector.senderLogins(mxid) {
+		if loginServer(api.Login) == server {
+			return api
+		}
+	}
+	return nil
+}
+
+// getSenderClient returns the client and Mattermost user ID that actions of a Matrix user
+// are sent with: their own login if they have one on this server, otherwise their ghost
+// account, which is created if needed
+func (m *MattermostAPI) getSenderClient(ctx context.Context, mxid id.UserID) (*Client, string, error) {
+	if login := m.senderLogin(mxid); login != nil {
+		return login.Client(), login.getOwnMMID(), nil
+	}
+	return m.Connector.GetClientForUser(ctx, loginServer(m.Login), mxid.String())
+}
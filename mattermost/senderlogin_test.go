@@ -0,0 +1,91 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// addTestLogin adds a login of a Matrix user to a connector
+func addTestLogin(connector *MattermostConnector, loginID string, mxid id.UserID, meta map[string]any) *bridgev2.UserLogin {
+	login := &bridgev2.UserLogin{UserLogin: &database.UserLogin{
+		ID:       networkid.UserLoginID(loginID),
+		UserMXID: mxid,
+		Metadata: meta,
+	}}
+	token, _ := meta["token"].(string)
+	login.Client = newMattermostAPI(login, connector, NewClient(connector.config().ServerURL, token))
+	if connector.users == nil {
+		connector.users = make(map[networkid.UserLoginID]*bridgev2.UserLogin)
+	}
+	connector.users[login.ID] = login
+	return login
+}
+
+func TestSenderLogins(t *testing.T) {
+	connector := &MattermostConnector{Config: &NetworkConfig{}}
+	addTestLogin(connector, "bob", "@alice:example.com", map[string]any{"mm_id": "mm-bob", "token": "token"})
+	addTestLogin(connector, "alice", "@alice:example.com", map[string]any{"mm_id": "mm-alice", "token": "token"})
+	addTestLogin(connector, "bot", "@alice:example.com", map[string]any{"mm_id": "mm-bot", "token": "token", "bot": true})
+	addTestLogin(connector, "carol", "@carol:example.com", map[string]any{"mm_id": "mm-carol", "token": "token"})
+
+	var mmIDs []string
+	for _, login := range connector.senderLogins("@alice:example.com") {
+		mmIDs = append(mmIDs, login.getOwnMMID())
+	}
+	assert.Equal(t, []string{"mm-alice", "mm-bob"}, mmIDs)
+	assert.Empty(t, connector.senderLogins("@dave:example.com"))
+}
+
+func TestHandleMatrixMessage_PostsWithSenderLogin(t *testing.T) {
+	ctx := context.Background()
+	api, server, portal := newTestMatrixMessageAPI(t)
+	channelID := string(portal.ID)
+	alice := &model.User{Username: "alice"}
+	token := server.AddUser(alice)
+	addTestLogin(api.Connector, "alice", "@alice:example.com", map[string]any{"mm_id": alice.Id, "token": token})
+
+	resp, err := api.HandleMatrixMessage(ctx, newTestMatrixMessage(portal, "@alice:example.com", "hello"))
+	require.NoError(t, err)
+	post := server.Post(string(resp.DB.ID))
+	require.NotNil(t, post)
+	assert.Equal(t, alice.Id, post.UserId)
+	assert.Equal(t, true, post.GetProp("from_matrix"))
+	assert.Contains(t, server.ChannelMembers(channelID), alice.Id)
+
+	// No ghost account was created for the sender
+	matrixUser, err := api.Connector.MatrixUsers.Get(ctx, "", "@alice:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, matrixUser)
+	assert.Nil(t, server.User("mx.alice"))
+
+	// Reactions use the login too
+	preResp, err := api.PreHandleMatrixReaction(ctx, &bridgev2.MatrixReaction{MatrixEventBase: bridgev2.MatrixEventBase[*event.ReactionEventContent]{
+		Event:   &event.Event{Sender: "@alice:example.com"},
+		Content: &event.ReactionEventContent{RelatesTo: event.RelatesTo{Key: "👍"}},
+		Portal:  portal,
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, MakeUserID(alice.Id), preResp.SenderID)
+}
+
+func TestHandleMatrixMessage_RejectedLoginTokenIsNotReplaced(t *testing.T) {
+	ctx := context.Background()
+	api, server, portal := newTestMatrixMessageAPI(t)
+	alice := &model.User{Username: "alice"}
+	server.AddUser(alice)
+	addTestLogin(api.Connector, "alice", "@alice:example.com", map[string]any{"mm_id": alice.Id, "token": "revoked"})
+
+	_, err := api.HandleMatrixMessage(ctx, newTestMatrixMessage(portal, "@alice:example.com", "hello"))
+	require.Error(t, err)
+	assert.Empty(t, server.ChannelPosts(string(portal.ID)))
+	assert.Nil(t, server.User("mx.alice"), "the post must not fall back to a ghost account")
+}
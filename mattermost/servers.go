@@ -0,0 +1,212 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// ServerConfig is an additional Mattermost server bridged by the same bridge. The admin
+// token is optional: without it, the server's WebSocket uses the token of a login.
+type ServerConfig struct {
+	URL        string `yaml:"url"`
+	AdminToken string `yaml:"admin_token"`
+}
+
+// mattermostServer is a Mattermost server the bridge is connected to. The main server
+// (server_url) has an empty name, additional servers are named by their key in servers.
+type mattermostServer struct {
+	Name string
+	URL  string
+	// Client uses the admin token of the server, nil if an additional server has none
+	Client *Client
+
+	wsSequence wsSequence
+}
+
+// validServerName restricts server names to characters that can be used in ghost IDs
+// unescaped, and that can't appear in Mattermost IDs
+var validServerName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// setupServers connects to the additional servers. The main server must be connected first.
+func (m *MattermostConnector) setupServers(ctx context.Context) error {
+	m.servers = map[string]*mattermostServer{
+		"": {URL: m.config().ServerURL, Client: m.Client},
+	}
+	log := m.moduleLog(LogModuleConnector)
+	for name, cfg := range m.config().Servers {
+		if !validServerName.MatchString(name) {
+			return fmt.Errorf("invalid server name %q: only lowercase letters, digits and dashes are allowed", name)
+		} else if cfg.URL == "" {
+			return fmt.Errorf("servers.%s.url must be set", name)
+		}
+		srv := &mattermostServer{Name: name, URL: cfg.URL}
+		if cfg.AdminToken != "" {
+			srv.Client = NewClient(cfg.URL, cfg.AdminToken)
+			if err := srv.Client.Connect(ctx); err != nil {
+				return fmt.Errorf("failed to connect to Mattermost server %s: %w", name, err)
+			}
+		}
+		m.servers[name] = srv
+		log.Info().Str("server", name).Str("url", cfg.URL).Msg("Added Mattermost server")
+	}
+	return nil
+}
+
+// serverNames returns the names of the servers, the main server first
+func (m *MattermostConnector) serverNames() []string {
+	names := []string{""}
+	for name := range m.servers {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names[1:])
+	return names
+}
+
+// serverURL returns the URL of a server
+func (m *MattermostConnector) serverURL(name string) (string, bool) {
+	if name == "" {
+		return m.config().ServerURL, true
+	} else if srv, ok := m.servers[name]; ok {
+		return srv.URL, true
+	}
+	return "", false
+}
+
+// serverClient returns a client for a server: the admin client if the server has one,
+// otherwise the client of one of its logins
+func (m *MattermostConnector) serverClient(name string) *Client {
+	if name == "" {
+		return m.Client
+	}
+	srv, ok := m.servers[name]
+	if !ok {
+		return m.Client
+	} else if srv.Client != nil {
+		return srv.Client
+	}
+	if login := m.serverLogin(name); login != nil {
+		if api, ok := login.Client.(*MattermostAPI); ok && api.Client() != nil {
+			return api.Client()
+		}
+	}
+	// Unauthenticated, requests fail until a user logs in to the server
+	return NewClient(srv.URL, "")
+}
+
+// serverAdminClient returns the client for privileged operations on a server, like
+// creating the Mattermost accounts of Matrix users. Additional servers need an admin token.
+func (m *MattermostConnector) serverAdminClient(name string) (*Client, error) {
+	if name == "" {
+		return m.adminClient(), nil
+	}
+	srv, ok := m.servers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown server %s", name)
+	} else if srv.Client == nil {
+		return nil, fmt.Errorf("server %s has no admin token, only Matrix users logged in to it can post there", name)
+	}
+	return srv.Client, nil
+}
+
+// serverLogin returns a login of a server, nil if nobody is logged in to it
+func (m *MattermostConnector) serverLogin(name string) *bridgev2.UserLogin {
+	var found *bridgev2.UserLogin
+	for _, login := range m.GetUsers() {
+		if loginServer(login) == name && (found == nil || login.ID < found.ID) {
+			found = login
+		}
+	}
+	return found
+}
+
+// loginServer returns the name of the server of a login, empty for the main server
+func loginServer(login *bridgev2.UserLogin) string {
+	if login == nil {
+		return ""
+	}
+	meta, _ := login.Metadata.(map[string]any)
+	server, _ := meta["server"].(string)
+	return server
+}
+
+// loginServerURL returns the URL of the server of a login. Logins store the URL they were
+// created with, so they keep working if the server is renamed in the config.
+func (m *MattermostConnector) loginServerURL(login *bridgev2.UserLogin) string {
+	meta, _ := login.Metadata.(map[string]any)
+	if url, ok := meta["server_url"].(string); ok && url != "" {
+		return url
+	}
+	if url, ok := m.serverURL(loginServer(login)); ok {
+		return url
+	}
+	return m.config().ServerURL
+}
+
+// serverLoginFlowPrefix is the prefix of the personal access token login flows of
+// additional servers, followed by the server name
+const serverLoginFlowPrefix = "personal-access-token-"
+
+// serverLoginFlows returns a personal access token login flow for each additional server
+func (m *MattermostConnector) serverLoginFlows() []bridgev2.LoginFlow {
+	var flows []bridgev2.LoginFlow
+	for _, name := range m.serverNames()[1:] {
+		flows = append(flows, bridgev2.LoginFlow{
+			ID:          serverLoginFlowPrefix + name,
+			Name:        "Personal Access Token (" + name + ")",
+			Description: "Login to " + m.servers[name].URL + " using a Mattermost Personal Access Token",
+		})
+	}
+	return flows
+}
+
+// serverForLoginFlow returns the server of a personal access token login flow
+func (m *MattermostConnector) serverForLoginFlow(flowID string) (string, bool) {
+	name, ok := strings.CutPrefix(flowID, serverLoginFlowPrefix)
+	if !ok || name == "" {
+		return "", false
+	}
+	_, ok = m.servers[name]
+	return name, ok
+}
+
+// serverWSToken returns the token to connect to the WebSocket of a server with
+func (m *MattermostConnector) serverWSToken(srv *mattermostServer) (string, error) {
+	if srv.Client != nil {
+		return srv.Client.AdminToken, nil
+	}
+	login := m.serverLogin(srv.Name)
+	if login == nil {
+		return "", fmt.Errorf("nobody is logged in to server %s", srv.Name)
+	}
+	api, ok := login.Client.(*MattermostAPI)
+	if !ok || api.Client() == nil {
+		return "", fmt.Errorf("login %s has no client", login.ID)
+	}
+	return api.Client().AuthToken, nil
+}
+
+// serverEvent is implemented by remote events that know which server they came from
+type serverEvent interface {
+	getServer() string
+}
+
+// eventServer returns the server a remote event came from
+func eventServer(evt bridgev2.RemoteEvent) string {
+	if se, ok := evt.(serverEvent); ok {
+		return se.getServer()
+	}
+	return ""
+}
+
+// makeUserID returns the ghost ID of a Mattermost user of the login's server
+func (m *MattermostAPI) makeUserID(mmUserID string) networkid.UserID {
+	return MakeServerUserID(loginServer(m.Login), mmUserID)
+}
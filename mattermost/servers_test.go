@@ -0,0 +1,72 @@
+package mattermost
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestServerUserIDs(t *testing.T) {
+	assert.Equal(t, networkid.UserID("user1"), MakeServerUserID("", "user1"))
+	assert.Equal(t, networkid.UserID("work.user1"), MakeServerUserID("work", "user1"))
+
+	server, mmUserID := ParseServerUserID("work.user1")
+	assert.Equal(t, "work", server)
+	assert.Equal(t, "user1", mmUserID)
+	server, mmUserID = ParseServerUserID("user1")
+	assert.Equal(t, "", server)
+	assert.Equal(t, "user1", mmUserID)
+	assert.Equal(t, "user1", ParseUserID("work.user1"))
+
+	assert.Equal(t, networkid.UserLoginID("alice"), MakeServerLoginID("", "alice"))
+	assert.Equal(t, networkid.UserLoginID("work.alice"), MakeServerLoginID("work", "alice"))
+}
+
+func TestServerPortalLogin(t *testing.T) {
+	newLogin := func(loginID networkid.UserLoginID, server string) *bridgev2.UserLogin {
+		meta := map[string]any{}
+		if server != "" {
+			meta["server"] = server
+		}
+		return &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: loginID, Metadata: meta}}
+	}
+	connector := &MattermostConnector{users: map[networkid.UserLoginID]*bridgev2.UserLogin{
+		"alice":      newLogin("alice", ""),
+		"work.alice": newLogin("work.alice", "work"),
+	}}
+	channel := networkid.PortalKey{ID: "channel1"}
+	assert.Equal(t, networkid.UserLoginID("work.alice"), connector.serverPortalLogin(channel, "work").ID)
+	assert.Equal(t, networkid.UserLoginID("alice"), connector.portalLogin(networkid.PortalKey{ID: "channel2"}).ID)
+	assert.Nil(t, connector.serverPortalLogin(channel, "other"))
+
+	assert.Equal(t, "work", eventServer(&MattermostMessageEvent{MattermostEvent: MattermostEvent{Server: "work"}}))
+}
+
+func TestServerLoginFlows(t *testing.T) {
+	connector := &MattermostConnector{
+		Config: &NetworkConfig{ServerURL: "https://main.example.com"},
+		servers: map[string]*mattermostServer{
+			"":     {URL: "https://main.example.com"},
+			"work": {Name: "work", URL: "https://work.example.com"},
+		},
+	}
+	flows := connector.serverLoginFlows()
+	if assert.Len(t, flows, 1) {
+		assert.Equal(t, "personal-access-token-work", flows[0].ID)
+	}
+	server, ok := connector.serverForLoginFlow("personal-access-token-work")
+	assert.True(t, ok)
+	assert.Equal(t, "work", server)
+	_, ok = connector.serverForLoginFlow("personal-access-token-other")
+	assert.False(t, ok)
+
+	login := &bridgev2.UserLogin{UserLogin: &database.UserLogin{Metadata: map[string]any{"server": "work"}}}
+	assert.Equal(t, "https://work.example.com", connector.loginServerURL(login))
+	login.Metadata = map[string]any{"server": "work", "server_url": "https://old.example.com"}
+	assert.Equal(t, "https://old.example.com", connector.loginServerURL(login))
+	login.Metadata = map[string]any{}
+	assert.Equal(t, "https://main.example.com", connector.loginServerURL(login))
+}
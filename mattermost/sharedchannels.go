@@ -0,0 +1,631 @@
+package mattermost
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
+)
+
+// With shared_channels (experimental), the bridge registers itself with the main Mattermost
+// server as a remote cluster of Mattermost's Shared Channels. Channels shared with it are
+// synced to the bridge with the same protocol Mattermost servers use between each other,
+// and text messages from Matrix are synced back as posts of remote users, which Mattermost
+// creates itself, so no ghost accounts are needed for them. Shared Channels needs an
+// Enterprise license and must be enabled in Mattermost (ConnectedWorkspacesSettings).
+
+// SharedChannelsConfig configures the Shared Channels transport
+type SharedChannelsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Name is the name of the bridge's remote cluster in Mattermost
+	Name string `yaml:"name"`
+}
+
+const (
+	defaultSharedChannelsName = "matrix"
+	// sharedChannelsPath is the site URL of the bridge's remote cluster. Mattermost appends
+	// the remote cluster API paths to it.
+	sharedChannelsPath   = "/mattermost/remote"
+	remoteClusterAPIPath = "/api/v4/remotecluster"
+	// Topics of the remote cluster messages the bridge handles
+	topicSharedChannelInvitation = "sharedchannel_invitation"
+	topicSharedChannelSync       = "sharedchannel_sync"
+	// remoteClusterTimeout limits requests to the remote cluster API of Mattermost
+	remoteClusterTimeout = 30 * time.Second
+)
+
+var ErrSharedChannelsNotRegistered = errors.New("the bridge isn't registered as a remote cluster, use the shared-channels register command")
+
+func (c *SharedChannelsConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return defaultSharedChannelsName
+}
+
+var sharedChannelUpgrades dbutil.UpgradeTable
+
+func init() {
+	sharedChannelUpgrades.Register(-1, 1, 0, "Create Mattermost shared channel tables", dbutil.TxnModeOn, func(ctx context.Context, db *dbutil.Database) error {
+		_, err := db.Exec(ctx, `
+			CREATE TABLE mattermost_remote_cluster (
+				bridge_id    TEXT NOT NULL PRIMARY KEY,
+				remote_id    TEXT NOT NULL,
+				token        TEXT NOT NULL,
+				remote_token TEXT NOT NULL
+			)
+		`)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(ctx, `
+			CREATE TABLE mattermost_shared_channel (
+				bridge_id  TEXT NOT NULL,
+				channel_id TEXT NOT NULL,
+
+				PRIMARY KEY (bridge_id, channel_id)
+			)
+		`)
+		return err
+	})
+}
+
+// RemoteCluster is the bridge's registration as a remote cluster of the main server
+type RemoteCluster struct {
+	// RemoteID identifies the bridge in Mattermost
+	RemoteID string
+	// Token is the token Mattermost sends to the bridge
+	Token string
+	// RemoteToken is the token the bridge sends to Mattermost
+	RemoteToken string
+}
+
+// SharedChannelStore stores the bridge's remote cluster and the channels shared with it
+type SharedChannelStore struct {
+	bridgeID networkid.BridgeID
+	db       *dbutil.Database
+}
+
+// NewSharedChannelStore creates a shared channel store in the given database
+func NewSharedChannelStore(bridgeID networkid.BridgeID, db *dbutil.Database) *SharedChannelStore {
+	return &SharedChannelStore{
+		bridgeID: bridgeID,
+		db:       db.Child("mattermost_shared_channel_version", sharedChannelUpgrades, nil),
+	}
+}
+
+// Upgrade creates the tables if needed
+func (s *SharedChannelStore) Upgrade(ctx context.Context) error {
+	return s.db.Upgrade(ctx)
+}
+
+// GetRemoteCluster returns the bridge's remote cluster, or nil if it isn't registered
+func (s *SharedChannelStore) GetRemoteCluster(ctx context.Context) (*RemoteCluster, error) {
+	var rc RemoteCluster
+	err := s.db.QueryRow(ctx, `
+		SELECT remote_id, token, remote_token FROM mattermost_remote_cluster WHERE bridge_id=$1
+	`, s.bridgeID).Scan(&rc.RemoteID, &rc.Token, &rc.RemoteToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+// PutRemoteCluster stores the bridge's remote cluster, replacing the previous one
+func (s *SharedChannelStore) PutRemoteCluster(ctx context.Context, rc *RemoteCluster) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO mattermost_remote_cluster (bridge_id, remote_id, token, remote_token)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (bridge_id) DO UPDATE
+			SET remote_id=excluded.remote_id, token=excluded.token, remote_token=excluded.remote_token
+	`, s.bridgeID, rc.RemoteID, rc.Token, rc.RemoteToken)
+	return err
+}
+
+// AddChannel marks a channel as shared with the bridge
+func (s *SharedChannelStore) AddChannel(ctx context.Context, channelID string) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO mattermost_shared_channel (bridge_id, channel_id) VALUES ($1, $2)
+		ON CONFLICT (bridge_id, channel_id) DO NOTHING
+	`, s.bridgeID, channelID)
+	return err
+}
+
+// RemoveChannel unmarks a channel as shared with the bridge
+func (s *SharedChannelStore) RemoveChannel(ctx context.Context, channelID string) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM mattermost_shared_channel WHERE bridge_id=$1 AND channel_id=$2", s.bridgeID, channelID)
+	return err
+}
+
+// IsShared checks whether a channel is shared with the bridge
+func (s *SharedChannelStore) IsShared(ctx context.Context, channelID string) (bool, error) {
+	var count int
+	err := s.db.QueryRow(ctx, `
+		SELECT COUNT(*) FROM mattermost_shared_channel WHERE bridge_id=$1 AND channel_id=$2
+	`, s.bridgeID, channelID).Scan(&count)
+	return count > 0, err
+}
+
+// remoteClusterResponse is the response to a message sent to a remote cluster
+type remoteClusterResponse struct {
+	Status  string          `json:"status"`
+	Err     string          `json:"err"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+const (
+	remoteClusterStatusOK   = "OK"
+	remoteClusterStatusFail = "FAIL"
+)
+
+// sharedChannelInvite is the payload of an invitation to a shared channel
+type sharedChannelInvite struct {
+	ChannelID   string            `json:"channel_id"`
+	TeamID      string            `json:"team_id"`
+	ReadOnly    bool              `json:"read_only"`
+	Name        string            `json:"name"`
+	DisplayName string            `json:"display_name"`
+	Type        model.ChannelType `json:"type"`
+}
+
+// sharedChannelIDEncoding is the base32 alphabet of Mattermost IDs
+var sharedChannelIDEncoding = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769").WithPadding(base32.NoPadding)
+
+// sharedChannelUserID returns the Mattermost user ID of the remote user of a Matrix user,
+// which is derived from the Matrix ID so that it's the same every time
+func sharedChannelUserID(mxid id.UserID) string {
+	hash := sha256.Sum256([]byte(mxid))
+	return sharedChannelIDEncoding.EncodeToString(hash[:16])
+}
+
+// sharedChannelsSiteURL returns the site URL of the bridge's remote cluster
+func (m *MattermostConnector) sharedChannelsSiteURL() (string, error) {
+	server, ok := m.Bridge.Matrix.(bridgev2.MatrixConnectorWithServer)
+	if !ok || server.GetRouter() == nil {
+		return "", errors.New("shared channels need the appservice HTTP server")
+	}
+	return strings.TrimRight(server.GetPublicAddress(), "/") + sharedChannelsPath, nil
+}
+
+// registerSharedChannelsEndpoint adds the remote cluster API that Mattermost sends pings and
+// shared channel messages to
+func (m *MattermostConnector) registerSharedChannelsEndpoint() error {
+	if !m.config().SharedChannels.Enabled {
+		return nil
+	}
+	siteURL, err := m.sharedChannelsSiteURL()
+	if err != nil {
+		return err
+	}
+	router := m.Bridge.Matrix.(bridgev2.MatrixConnectorWithServer).GetRouter()
+	router.HandleFunc(sharedChannelsPath+remoteClusterAPIPath+"/ping", m.handleRemoteClusterPing).Methods(http.MethodPost)
+	router.HandleFunc(sharedChannelsPath+remoteClusterAPIPath+"/msg", m.handleRemoteClusterMsg).Methods(http.MethodPost)
+	log := m.moduleLog(LogModuleConnector)
+	log.Info().Str("site_url", siteURL).Msg("Shared channels endpoint enabled")
+	return nil
+}
+
+// remoteCluster returns the bridge's remote cluster, or nil if it isn't registered
+func (m *MattermostConnector) remoteCluster(ctx context.Context) *RemoteCluster {
+	if m.SharedChannels == nil {
+		return nil
+	}
+	rc, err := m.SharedChannels.GetRemoteCluster(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to get remote cluster from database")
+	}
+	return rc
+}
+
+// readRemoteClusterFrame authenticates a request from Mattermost and reads its frame
+func (m *MattermostConnector) readRemoteClusterFrame(w http.ResponseWriter, r *http.Request) (*model.RemoteClusterFrame, bool) {
+	rc := m.remoteCluster(r.Context())
+	if rc == nil || r.Header.Get(model.HeaderRemoteclusterId) != rc.RemoteID ||
+		subtle.ConstantTimeCompare([]byte(r.Header.Get(model.HeaderRemoteclusterToken)), []byte(rc.Token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	var frame model.RemoteClusterFrame
+	if err := json.NewDecoder(r.Body).Decode(&frame); err != nil || frame.RemoteId != rc.RemoteID {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return nil, false
+	}
+	return &frame, true
+}
+
+// handleRemoteClusterPing answers the pings Mattermost uses to check that the bridge is online
+func (m *MattermostConnector) handleRemoteClusterPing(w http.ResponseWriter, r *http.Request) {
+	frame, ok := m.readRemoteClusterFrame(w, r)
+	if !ok {
+		return
+	}
+	var ping model.RemoteClusterPing
+	_ = json.Unmarshal(frame.Msg.Payload, &ping)
+	ping.RecvAt = model.GetMillis()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&ping)
+}
+
+// handleRemoteClusterMsg receives a message from Mattermost, like an invitation to a shared
+// channel or the posts and reactions of a shared channel
+func (m *MattermostConnector) handleRemoteClusterMsg(w http.ResponseWriter, r *http.Request) {
+	frame, ok := m.readRemoteClusterFrame(w, r)
+	if !ok {
+		return
+	}
+	log := m.moduleLog(LogModuleWebSocket).With().Str("topic", frame.Msg.Topic).Str("msg_id", frame.Msg.Id).Logger()
+	ctx := log.WithContext(r.Context())
+	resp := remoteClusterResponse{Status: remoteClusterStatusOK}
+	switch frame.Msg.Topic {
+	case topicSharedChannelInvitation:
+		var invite sharedChannelInvite
+		if err := json.Unmarshal(frame.Msg.Payload, &invite); err != nil || invite.ChannelID == "" {
+			resp = remoteClusterResponse{Status: remoteClusterStatusFail, Err: "invalid invitation"}
+		} else if err = m.acceptSharedChannel(ctx, &invite); err != nil {
+			log.Err(err).Str("channel_id", invite.ChannelID).Msg("Failed to accept shared channel")
+			resp = remoteClusterResponse{Status: remoteClusterStatusFail, Err: err.Error()}
+		}
+	case topicSharedChannelSync:
+		var msg model.SyncMsg
+		if err := json.Unmarshal(frame.Msg.Payload, &msg); err != nil {
+			resp = remoteClusterResponse{Status: remoteClusterStatusFail, Err: "invalid sync message"}
+			break
+		}
+		resp.Payload, _ = json.Marshal(m.handleSharedChannelSync(ctx, &msg))
+	default:
+		// Files are fetched from Mattermost like for other posts, so attachments and other
+		// topics are only acknowledged
+		log.Debug().Msg("Ignoring remote cluster message with unhandled topic")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+// acceptSharedChannel remembers a channel shared with the bridge and syncs its room
+func (m *MattermostConnector) acceptSharedChannel(ctx context.Context, invite *sharedChannelInvite) error {
+	if err := m.SharedChannels.AddChannel(ctx, invite.ChannelID); err != nil {
+		return fmt.Errorf("failed to store shared channel: %w", err)
+	}
+	zerolog.Ctx(ctx).Info().Str("channel_id", invite.ChannelID).Str("channel_name", invite.Name).Msg("Channel was shared with the bridge")
+	channel, resp, err := m.Client.GetChannel(ctx, invite.ChannelID, "")
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(wrapMattermostError(resp, err)).Msg("Failed to get shared channel")
+		return nil
+	}
+	m.queueRemoteEvent(&ChannelSyncEvent{
+		MattermostEvent: MattermostEvent{
+			Connector: m,
+			Timestamp: time.Now(),
+			ChannelID: channel.Id,
+		},
+		Channel: channel,
+	})
+	return nil
+}
+
+// sharedChannelSyncEvents turns the posts, reactions and acknowledgements of a sync message
+// into the WebSocket events Mattermost would send for them
+func sharedChannelSyncEvents(msg *model.SyncMsg, isBridged func(postID string) bool) []*model.WebSocketEvent {
+	var events []*model.WebSocketEvent
+	add := func(eventType model.WebsocketEventType, channelID, key string, value any) {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return
+		}
+		evt := model.NewWebSocketEvent(eventType, "", channelID, "", nil, "")
+		evt.Add(key, string(data))
+		events = append(events, evt)
+	}
+	for _, post := range msg.Posts {
+		eventType := model.WebsocketEventPosted
+		if post.DeleteAt > 0 {
+			eventType = model.WebsocketEventPostDeleted
+		} else if post.EditAt > 0 && isBridged(post.Id) {
+			eventType = model.WebsocketEventPostEdited
+		}
+		add(eventType, msg.ChannelId, "post", post)
+	}
+	for _, reaction := range msg.Reactions {
+		eventType := model.WebsocketEventReactionAdded
+		if reaction.DeleteAt > 0 {
+			eventType = model.WebsocketEventReactionRemoved
+		}
+		add(eventType, msg.ChannelId, "reaction", reaction)
+	}
+	for _, ack := range msg.Acknowledgements {
+		eventType := model.WebsocketEventAcknowledgementAdded
+		if ack.AcknowledgedAt == 0 {
+			eventType = model.WebsocketEventAcknowledgementRemoved
+		}
+		add(eventType, msg.ChannelId, "acknowledgement", ack)
+	}
+	return events
+}
+
+// sharedChannelSyncResponse returns the response to a sync message, which tells Mattermost
+// up to when its contents were received
+func sharedChannelSyncResponse(msg *model.SyncMsg) *model.SyncResponse {
+	resp := &model.SyncResponse{}
+	for userID, user := range msg.Users {
+		resp.UsersSyncd = append(resp.UsersSyncd, userID)
+		resp.UsersLastUpdateAt = max(resp.UsersLastUpdateAt, user.UpdateAt)
+	}
+	slices.Sort(resp.UsersSyncd)
+	for _, post := range msg.Posts {
+		resp.PostsLastUpdateAt = max(resp.PostsLastUpdateAt, post.UpdateAt)
+	}
+	for _, reaction := range msg.Reactions {
+		resp.ReactionsLastUpdateAt = max(resp.ReactionsLastUpdateAt, reaction.UpdateAt)
+	}
+	for _, ack := range msg.Acknowledgements {
+		resp.AcknowledgementsLastUpdateAt = max(resp.AcknowledgementsLastUpdateAt, ack.AcknowledgedAt)
+	}
+	return resp
+}
+
+// handleSharedChannelSync bridges the contents of a sync message. They're handled like the
+// events of the WebSocket, which already delivers them if it's connected, so then they're
+// only acknowledged.
+func (m *MattermostConnector) handleSharedChannelSync(ctx context.Context, msg *model.SyncMsg) *model.SyncResponse {
+	if m.config().EventSource.WebSocket || !m.ownsChannel(msg.ChannelId) {
+		return sharedChannelSyncResponse(msg)
+	}
+	isBridged := func(postID string) bool {
+		if m.Bridge == nil || m.Bridge.DB == nil {
+			return false
+		}
+		bridged, err := m.Bridge.DB.Message.GetFirstPartByID(ctx, "", networkid.MessageID(postID))
+		return err == nil && bridged != nil
+	}
+	for _, evt := range sharedChannelSyncEvents(msg, isBridged) {
+		m.eventWorkers.submit(msg.ChannelId, func() {
+			m.handleServerEvent("", evt)
+		})
+	}
+	return sharedChannelSyncResponse(msg)
+}
+
+// sendRemoteClusterFrame sends a frame to the remote cluster API of the main server. The
+// server URL from the config is used rather than the site URL of the invitation, which
+// may not be reachable from the bridge.
+func (m *MattermostConnector) sendRemoteClusterFrame(ctx context.Context, path, token string, frame *model.RemoteClusterFrame) (*remoteClusterResponse, error) {
+	body, err := json.Marshal(frame)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal frame: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, remoteClusterTimeout)
+	defer cancel()
+	url := strings.TrimRight(m.config().ServerURL, "/") + remoteClusterAPIPath + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(model.HeaderRemoteclusterId, frame.RemoteId)
+	req.Header.Set(model.HeaderRemoteclusterToken, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send remote cluster message: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("remote cluster API returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(errBody)))
+	}
+	var rcResp remoteClusterResponse
+	if err = json.NewDecoder(resp.Body).Decode(&rcResp); err != nil {
+		return nil, fmt.Errorf("failed to parse remote cluster response: %w", err)
+	} else if rcResp.Status != remoteClusterStatusOK {
+		return nil, fmt.Errorf("remote cluster message failed: %s", rcResp.Err)
+	}
+	return &rcResp, nil
+}
+
+// decodeRemoteClusterInvite decrypts the invitation Mattermost created for a remote cluster
+func decodeRemoteClusterInvite(encoded, password string) (*model.RemoteClusterInvite, error) {
+	encrypted, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		if encrypted, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("failed to decode invitation: %w", err)
+		}
+	}
+	var invite model.RemoteClusterInvite
+	if err = invite.Decrypt(encrypted, password); err != nil {
+		return nil, fmt.Errorf("failed to decrypt invitation: %w", err)
+	}
+	return &invite, nil
+}
+
+// registerRemoteCluster creates a remote cluster for the bridge on the main server and
+// accepts its invitation, the same way a Mattermost server would
+func (m *MattermostConnector) registerRemoteCluster(ctx context.Context) (*RemoteCluster, error) {
+	siteURL, err := m.sharedChannelsSiteURL()
+	if err != nil {
+		return nil, err
+	}
+	password := model.NewId()
+	created, resp, err := m.Client.CreateRemoteCluster(ctx, &model.RemoteClusterWithPassword{
+		RemoteCluster: &model.RemoteCluster{
+			Name:        m.config().SharedChannels.name(),
+			DisplayName: "Matrix",
+		},
+		Password: password,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create remote cluster: %w", wrapMattermostError(resp, err))
+	}
+	invite, err := decodeRemoteClusterInvite(created.Invite, password)
+	if err != nil {
+		return nil, err
+	}
+	rc := &RemoteCluster{RemoteID: invite.RemoteId, Token: model.NewId(), RemoteToken: invite.Token}
+	payload, err := json.Marshal(&model.RemoteClusterInvite{RemoteId: invite.RemoteId, SiteURL: siteURL, Token: rc.Token})
+	if err != nil {
+		return nil, err
+	}
+	_, err = m.sendRemoteClusterFrame(ctx, "/confirm_invite", invite.Token, &model.RemoteClusterFrame{
+		RemoteId: invite.RemoteId,
+		Msg:      model.NewRemoteClusterMsg("", payload),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to confirm invitation: %w", err)
+	}
+	if err = m.SharedChannels.PutRemoteCluster(ctx, rc); err != nil {
+		return nil, fmt.Errorf("failed to store remote cluster: %w", err)
+	}
+	return rc, nil
+}
+
+// sharedChannelRemote returns the bridge's remote cluster if a channel is shared with it,
+// so that messages from Matrix can be synced to it instead of posted by ghosts
+func (m *MattermostConnector) sharedChannelRemote(ctx context.Context, channelID string) *RemoteCluster {
+	if !m.config().SharedChannels.Enabled || m.SharedChannels == nil {
+		return nil
+	}
+	shared, err := m.SharedChannels.IsShared(ctx, channelID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("channel_id", channelID).Msg("Failed to check whether channel is shared")
+		return nil
+	} else if !shared {
+		return nil
+	}
+	return m.remoteCluster(ctx)
+}
+
+// syncSharedChannelPost sends a post of a Matrix user to a shared channel as a post of the
+// user's remote user
+func (m *MattermostConnector) syncSharedChannelPost(ctx context.Context, rc *RemoteCluster, sender id.UserID, displayName string, post *model.Post) (*model.Post, error) {
+	now := model.GetMillis()
+	userID := sharedChannelUserID(sender)
+	user := &model.User{
+		Id:       userID,
+		Username: encodeGhostUsername(sender.String()),
+		Nickname: displayName,
+		Email:    userID + "@matrix.invalid",
+		RemoteId: &rc.RemoteID,
+		CreateAt: now,
+		UpdateAt: now,
+		Position: ghostPosition,
+		Roles:    model.SystemUserRoleId,
+		Locale:   model.DefaultLocale,
+		Props:    model.StringMap{ghostMXIDProp: sender.String()},
+	}
+	if len(user.Username) > model.UserNameMaxLength {
+		user.Username = ghostUsernames(sender.String())[0]
+	}
+	synced := post.Clone()
+	synced.Id = model.NewId()
+	synced.UserId = user.Id
+	synced.CreateAt = now
+	synced.UpdateAt = now
+	synced.RemoteId = &rc.RemoteID
+	msg := model.NewSyncMsg(post.ChannelId)
+	msg.Users = map[string]*model.User{user.Id: user}
+	msg.Posts = []*model.Post{synced}
+	payload, err := msg.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.sendRemoteClusterFrame(ctx, "/msg", rc.RemoteToken, &model.RemoteClusterFrame{
+		RemoteId: rc.RemoteID,
+		Msg:      model.NewRemoteClusterMsg(topicSharedChannelSync, payload),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var syncResp model.SyncResponse
+	if err = json.Unmarshal(resp.Payload, &syncResp); err == nil && slices.Contains(syncResp.PostErrors, synced.Id) {
+		return nil, fmt.Errorf("mattermost rejected the synced post")
+	}
+	return synced, nil
+}
+
+// cmdSharedChannels registers the bridge as a remote cluster and shares channels with it
+func (m *MattermostConnector) cmdSharedChannels() *commands.FullHandler {
+	return &commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			const usage = "**Usage:** `$cmdprefix shared-channels register`, `$cmdprefix shared-channels share [channel ID]` or `$cmdprefix shared-channels unshare [channel ID]`"
+			if len(ce.Args) == 0 {
+				ce.Reply(usage)
+				return
+			}
+			if strings.ToLower(ce.Args[0]) == "register" {
+				if rc := m.remoteCluster(ce.Ctx); rc != nil {
+					ce.Reply("The bridge is already registered as remote cluster `%s`", rc.RemoteID)
+					return
+				}
+				rc, err := m.registerRemoteCluster(ce.Ctx)
+				if err != nil {
+					ce.Reply("Failed to register remote cluster: %v", err)
+					return
+				}
+				ce.Reply("Registered the bridge as remote cluster `%s`", rc.RemoteID)
+				return
+			}
+			channelID := ""
+			if len(ce.Args) > 1 {
+				channelID = ce.Args[1]
+			} else if ce.Portal != nil {
+				channelID = string(ce.Portal.ID)
+			} else {
+				ce.Reply(usage)
+				return
+			}
+			rc := m.remoteCluster(ce.Ctx)
+			if rc == nil {
+				ce.Reply("%v", ErrSharedChannelsNotRegistered)
+				return
+			}
+			switch strings.ToLower(ce.Args[0]) {
+			case "share":
+				resp, err := m.Client.InviteRemoteClusterToChannel(ce.Ctx, rc.RemoteID, channelID)
+				if err != nil {
+					ce.Reply("Failed to share channel: %v", wrapMattermostError(resp, err))
+					return
+				}
+				ce.Reply("Shared channel `%s` with the bridge", channelID)
+			case "unshare":
+				resp, err := m.Client.UninviteRemoteClusterToChannel(ce.Ctx, rc.RemoteID, channelID)
+				if err != nil {
+					ce.Reply("Failed to unshare channel: %v", wrapMattermostError(resp, err))
+					return
+				}
+				if err = m.SharedChannels.RemoveChannel(ce.Ctx, channelID); err != nil {
+					ce.Reply("Unshared the channel, but failed to forget it: %v", err)
+					return
+				}
+				ce.Reply("Unshared channel `%s`", channelID)
+			default:
+				ce.Reply(usage)
+			}
+		},
+		Name: "shared-channels",
+		Help: commands.HelpMeta{
+			Section:     commands.HelpSectionAdmin,
+			Description: "Register the bridge as a Mattermost remote cluster and share channels with it (experimental)",
+			Args:        "<register|share|unshare> [_channel ID_]",
+		},
+		RequiresAdmin: true,
+	}
+}
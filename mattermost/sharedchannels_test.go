@@ -0,0 +1,93 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedChannelUserID(t *testing.T) {
+	userID := sharedChannelUserID("@alice:example.com")
+	assert.True(t, model.IsValidId(userID))
+	assert.Equal(t, userID, sharedChannelUserID("@alice:example.com"))
+	assert.NotEqual(t, userID, sharedChannelUserID("@bob:example.com"))
+}
+
+func TestDecodeRemoteClusterInvite(t *testing.T) {
+	invite := &model.RemoteClusterInvite{RemoteId: model.NewId(), SiteURL: "https://mm.example.com", Token: "token"}
+	encrypted, err := invite.Encrypt("password")
+	require.NoError(t, err)
+
+	decoded, err := decodeRemoteClusterInvite(base64.URLEncoding.EncodeToString(encrypted), "password")
+	require.NoError(t, err)
+	assert.Equal(t, invite.RemoteId, decoded.RemoteId)
+	assert.Equal(t, "token", decoded.Token)
+
+	_, err = decodeRemoteClusterInvite(base64.URLEncoding.EncodeToString(encrypted), "wrong")
+	assert.Error(t, err)
+}
+
+func TestSharedChannelSyncEvents(t *testing.T) {
+	msg := &model.SyncMsg{
+		ChannelId: "channel1",
+		Posts: []*model.Post{
+			{Id: "new", UpdateAt: 10},
+			{Id: "edited", EditAt: 20, UpdateAt: 20},
+			{Id: "edited_unknown", EditAt: 30, UpdateAt: 30},
+			{Id: "deleted", DeleteAt: 40, UpdateAt: 40},
+		},
+		Reactions: []*model.Reaction{{PostId: "new", EmojiName: "smile", DeleteAt: 50, UpdateAt: 50}},
+		Users:     map[string]*model.User{"user1": {Id: "user1", UpdateAt: 5}},
+	}
+	events := sharedChannelSyncEvents(msg, func(postID string) bool { return postID == "edited" })
+	require.Len(t, events, 5)
+	assert.Equal(t, model.WebsocketEventPosted, events[0].EventType())
+	assert.Equal(t, model.WebsocketEventPostEdited, events[1].EventType())
+	// Edits of posts that were never bridged are bridged as new posts
+	assert.Equal(t, model.WebsocketEventPosted, events[2].EventType())
+	assert.Equal(t, model.WebsocketEventPostDeleted, events[3].EventType())
+	assert.Equal(t, model.WebsocketEventReactionRemoved, events[4].EventType())
+	assert.Equal(t, "channel1", events[0].GetBroadcast().ChannelId)
+	assert.Contains(t, events[0].GetData()["post"], `"id":"new"`)
+
+	resp := sharedChannelSyncResponse(msg)
+	assert.EqualValues(t, 40, resp.PostsLastUpdateAt)
+	assert.EqualValues(t, 50, resp.ReactionsLastUpdateAt)
+	assert.Equal(t, []string{"user1"}, resp.UsersSyncd)
+}
+
+func TestHandleRemoteClusterPing(t *testing.T) {
+	ctx := context.Background()
+	store := NewSharedChannelStore("mattermost", newTestBridgeDB(t).Database)
+	require.NoError(t, store.Upgrade(ctx))
+	remoteID := model.NewId()
+	require.NoError(t, store.PutRemoteCluster(ctx, &RemoteCluster{RemoteID: remoteID, Token: "bridge_token", RemoteToken: "mm_token"}))
+	m := &MattermostConnector{SharedChannels: store}
+
+	ping := func(token string) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(&model.RemoteClusterPing{SentAt: 1})
+		body, _ := json.Marshal(&model.RemoteClusterFrame{RemoteId: remoteID, Msg: model.NewRemoteClusterMsg("", payload)})
+		req := httptest.NewRequest(http.MethodPost, sharedChannelsPath+remoteClusterAPIPath+"/ping", strings.NewReader(string(body)))
+		req.Header.Set(model.HeaderRemoteclusterId, remoteID)
+		req.Header.Set(model.HeaderRemoteclusterToken, token)
+		w := httptest.NewRecorder()
+		m.handleRemoteClusterPing(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusUnauthorized, ping("mm_token").Code)
+
+	w := ping("bridge_token")
+	require.Equal(t, http.StatusOK, w.Code)
+	var pong model.RemoteClusterPing
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&pong))
+	assert.EqualValues(t, 1, pong.SentAt)
+	assert.NotZero(t, pong.RecvAt)
+}
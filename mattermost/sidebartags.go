@@ -0,0 +1,151 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// With chat_sync.sidebar_tags, the rooms of channels in custom sidebar categories are tagged
+// with the category name on the Matrix account of the logged-in user, so that clients that
+// group rooms by tag show roughly the same sidebar. Favorites and muted channels are synced
+// as m.favourite and m.lowpriority like before, this only adds the custom categories.
+
+// sidebarTagPrefix is the prefix of sidebar category tags. Tags in the u. namespace are
+// user-defined, like the ones clients create.
+const sidebarTagPrefix = "u."
+
+// defaultDoublePuppetSource marks sidebar tags if the appservice has no double puppet value
+const defaultDoublePuppetSource = "mautrix-mattermost"
+
+// sidebarTag is the room tag of a channel in a custom sidebar category
+type sidebarTag struct {
+	Tag event.RoomTag
+	// Order sorts the room like the channel is sorted in its category
+	Order json.Number
+}
+
+// sidebarCategoryTags returns the channels in the given categories with the tag of their
+// category. Channels in the built-in categories have an empty tag, so that tags of
+// categories they were moved out of are removed.
+func sidebarCategoryTags(categories []*model.SidebarCategoryWithChannels) map[string]sidebarTag {
+	tags := make(map[string]sidebarTag)
+	for _, category := range categories {
+		isCustom := category.Type == model.SidebarCategoryCustom && category.DisplayName != ""
+		for i, channelID := range category.Channels {
+			if !isCustom {
+				if _, ok := tags[channelID]; !ok {
+					tags[channelID] = sidebarTag{}
+				}
+				continue
+			}
+			tags[channelID] = sidebarTag{
+				Tag:   event.RoomTag(sidebarTagPrefix + category.DisplayName),
+				Order: json.Number(strconv.FormatFloat(float64(i+1)/float64(len(category.Channels)+1), 'f', -1, 64)),
+			}
+		}
+	}
+	return tags
+}
+
+// roomTagger is the part of a Matrix client used for tagging rooms
+type roomTagger interface {
+	GetTags(ctx context.Context, roomID id.RoomID) (event.TagEventContent, error)
+	AddTagWithCustomData(ctx context.Context, roomID id.RoomID, tag event.RoomTag, data any) error
+	RemoveTag(ctx context.Context, roomID id.RoomID, tag event.RoomTag) error
+}
+
+// applySidebarTag sets the sidebar tag of a room. Other sidebar tags the bridge added are
+// removed, while tags the user added themselves are kept.
+func applySidebarTag(ctx context.Context, tagger roomTagger, roomID id.RoomID, tag sidebarTag, source string) error {
+	tags, err := tagger.GetTags(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get room tags: %w", err)
+	}
+	for existing, meta := range tags.Tags {
+		if existing != tag.Tag && strings.HasPrefix(string(existing), sidebarTagPrefix) && meta.MauDoublePuppetSource == source {
+			if err = tagger.RemoveTag(ctx, roomID, existing); err != nil {
+				return fmt.Errorf("failed to remove tag %s: %w", existing, err)
+			}
+		}
+	}
+	if tag.Tag == "" {
+		return nil
+	}
+	if meta, ok := tags.Tags[tag.Tag]; ok && meta.Order == tag.Order {
+		return nil
+	}
+	err = tagger.AddTagWithCustomData(ctx, roomID, tag.Tag, &event.TagMetadata{
+		Order:                 tag.Order,
+		MauDoublePuppetSource: source,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add tag %s: %w", tag.Tag, err)
+	}
+	return nil
+}
+
+// doublePuppetSource returns the value that marks account data the bridge's double puppets set
+func (m *MattermostConnector) doublePuppetSource() string {
+	if mc, ok := m.Bridge.Matrix.(*matrix.Connector); ok && mc.AS != nil && mc.AS.DoublePuppetValue != "" {
+		return mc.AS.DoublePuppetValue
+	}
+	return defaultDoublePuppetSource
+}
+
+// syncSidebarTags tags the rooms of the login's channels with their sidebar categories,
+// using the user's double puppet. Users without double puppeting are skipped.
+func (m *MattermostAPI) syncSidebarTags(ctx context.Context) error {
+	if !m.Connector.config().ChatSync.SidebarTags {
+		return nil
+	}
+	userID := m.getOwnMMID()
+	if userID == "" {
+		return fmt.Errorf("own Mattermost user ID is unknown")
+	}
+	log := zerolog.Ctx(ctx)
+	dp := asIntent(m.Login.User.DoublePuppet(ctx))
+	if dp == nil {
+		log.Debug().Msg("Not syncing sidebar tags without double puppeting")
+		return nil
+	}
+	teams, err := m.Client().GetTeamsForUser(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get teams: %w", err)
+	}
+	var categories []*model.SidebarCategoryWithChannels
+	for _, team := range teams {
+		teamCategories, resp, err := m.Client().GetSidebarCategoriesForTeamForUser(ctx, userID, team.Id, "")
+		if err != nil {
+			return fmt.Errorf("failed to get sidebar categories of team %s: %w", team.Id, wrapMattermostError(resp, err))
+		}
+		categories = append(categories, teamCategories.Categories...)
+	}
+	source := m.Connector.doublePuppetSource()
+	var tagged int
+	for channelID, tag := range sidebarCategoryTags(categories) {
+		portal, err := m.Connector.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{ID: networkid.PortalID(channelID)})
+		if err != nil {
+			log.Warn().Err(err).Str("channel_id", channelID).Msg("Failed to get portal for sidebar tag")
+			continue
+		} else if portal == nil || portal.MXID == "" {
+			continue
+		}
+		if err = applySidebarTag(ctx, dp, portal.MXID, tag, source); err != nil {
+			log.Warn().Err(err).Str("channel_id", channelID).Stringer("room_id", portal.MXID).Msg("Failed to sync sidebar tag")
+		} else if tag.Tag != "" {
+			tagged++
+		}
+	}
+	log.Info().Int("tagged_rooms", tagged).Msg("Synced sidebar category tags")
+	return nil
+}
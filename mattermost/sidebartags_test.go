@@ -0,0 +1,67 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+type fakeRoomTagger struct {
+	tags event.Tags
+}
+
+func (f *fakeRoomTagger) GetTags(ctx context.Context, roomID id.RoomID) (event.TagEventContent, error) {
+	return event.TagEventContent{Tags: f.tags}, nil
+}
+
+func (f *fakeRoomTagger) AddTagWithCustomData(ctx context.Context, roomID id.RoomID, tag event.RoomTag, data any) error {
+	f.tags[tag] = *data.(*event.TagMetadata)
+	return nil
+}
+
+func (f *fakeRoomTagger) RemoveTag(ctx context.Context, roomID id.RoomID, tag event.RoomTag) error {
+	delete(f.tags, tag)
+	return nil
+}
+
+func TestSidebarCategoryTags(t *testing.T) {
+	tags := sidebarCategoryTags([]*model.SidebarCategoryWithChannels{
+		{SidebarCategory: model.SidebarCategory{Type: model.SidebarCategoryFavorites, DisplayName: "Favorites"}, Channels: []string{"fav"}},
+		{SidebarCategory: model.SidebarCategory{Type: model.SidebarCategoryCustom, DisplayName: "Projects"}, Channels: []string{"a", "dm"}},
+		{SidebarCategory: model.SidebarCategory{Type: model.SidebarCategoryChannels, DisplayName: "Channels"}, Channels: []string{"b"}},
+		// Direct messages show up in the categories of every team
+		{SidebarCategory: model.SidebarCategory{Type: model.SidebarCategoryDirectMessages, DisplayName: "Direct Messages"}, Channels: []string{"dm"}},
+	})
+	assert.Equal(t, map[string]sidebarTag{
+		"fav": {},
+		"a":   {Tag: "u.Projects", Order: "0.3333333333333333"},
+		"dm":  {Tag: "u.Projects", Order: "0.6666666666666666"},
+		"b":   {},
+	}, tags)
+}
+
+func TestApplySidebarTag(t *testing.T) {
+	ctx := context.Background()
+	tagger := &fakeRoomTagger{tags: event.Tags{
+		event.RoomTagFavourite: {},
+		"u.Old":                {MauDoublePuppetSource: "bridge"},
+		"u.Mine":               {},
+	}}
+
+	require.NoError(t, applySidebarTag(ctx, tagger, "!room:example.com", sidebarTag{Tag: "u.Projects", Order: json.Number("0.5")}, "bridge"))
+	// Tags of other categories the bridge added are replaced, others are kept
+	assert.Equal(t, event.Tags{
+		event.RoomTagFavourite: {},
+		"u.Mine":               {},
+		"u.Projects":           {Order: "0.5", MauDoublePuppetSource: "bridge"},
+	}, tagger.tags)
+
+	require.NoError(t, applySidebarTag(ctx, tagger, "!room:example.com", sidebarTag{}, "bridge"))
+	assert.Equal(t, event.Tags{event.RoomTagFavourite: {}, "u.Mine": {}}, tagger.tags)
+}
@@ -1,21 +1,60 @@
 package mattermost
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 
 	"time"
 
+	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/mattermost/mattermost/server/public/model"
 )
 
+// The slash command server listens on its own port, next to the appservice
+const (
+	slashCommandPort = 8081
+	slashCommandPath = "/mattermost/command"
+)
+
+// SlashCommandSetup returns instructions for creating the /matrix slash command in
+// Mattermost. The request URL uses the host of the appservice address, as the slash
+// command server runs in the same process.
+func SlashCommandSetup(appserviceAddress string) string {
+	host := "bridge"
+	if parsed, err := url.Parse(appserviceAddress); err == nil && parsed.Hostname() != "" {
+		host = parsed.Hostname()
+	}
+	requestURL := (&url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(host, fmt.Sprint(slashCommandPort)),
+		Path:   slashCommandPath,
+	}).String()
+	return fmt.Sprintf(`Create the /matrix slash command in Mattermost (Integrations > Slash Commands):
+  Title:           Matrix
+  Command Trigger: matrix
+  Request URL:     %s
+  Request Method:  POST
+  Autocomplete:    enabled, hint [command]
+Then put the token Mattermost shows in the bridge config:
+  network:
+    slash_command_token: <token>
+`, requestURL)
+}
+
 // SlashCommandRequest represents a request from a Mattermost slash command webhook.
 // See: https://developers.mattermost.com/integrate/slash-commands/
 type SlashCommandRequest struct {
@@ -30,18 +69,29 @@ type SlashCommandRequest struct {
 	TriggerID   string `json:"trigger_id"`
 	UserID      string `json:"user_id"`
 	UserName    string `json:"user_name"`
+
+	// actionURL is where Mattermost sends clicks on buttons in the response
+	actionURL string
 }
 
 // SlashCommandResponse is the JSON response sent back to Mattermost.
 type SlashCommandResponse struct {
 	ResponseType string `json:"response_type"` // "ephemeral" or "in_channel"
 	Text         string `json:"text"`
+	Username     string `json:"username,omitempty"`
+	IconURL      string `json:"icon_url,omitempty"`
+
+	Attachments []*model.SlackAttachment `json:"attachments,omitempty"`
 }
 
 // SlashCommandHandler holds the connector and token for handling slash commands.
 type SlashCommandHandler struct {
 	Connector *MattermostConnector
 	Token     string // Expected token from Mattermost to verify requests
+	// Teams are the integrations of teams with their own token
+	Teams []SlashCommandTeam
+
+	confirmations confirmations
 }
 
 // NewSlashCommandHandler creates a new handler for Mattermost slash commands.
@@ -76,22 +126,34 @@ func (h *SlashCommandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		TriggerID:   r.FormValue("trigger_id"),
 		UserID:      r.FormValue("user_id"),
 		UserName:    r.FormValue("user_name"),
+		actionURL:   actionURL(r),
 	}
 
 	// Verify token if configured
-	if h.Token != "" && req.Token != h.Token {
+	if !h.verifyToken(&req) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	resp := h.handleCommand(context.Background(), &req)
+	log := h.Connector.moduleLog(LogModuleSlashCmd).With().
+		Str("channel_id", req.ChannelID).
+		Str("team_id", req.TeamID).
+		Str("mm_user_id", req.UserID).
+		Logger()
+	ctx := log.WithContext(context.Background())
+	log.Debug().Str("text", req.Text).Msg("Handling slash command")
+	resp := h.handleCommand(ctx, &req)
+	h.applyTeamResponse(&req, resp)
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		fmt.Printf("ERROR: Failed to encode slash command response: %v\n", err)
+		log.Err(err).Msg("Failed to encode slash command response")
 	}
 }
 
+// slashSubcommands are the subcommands of the /matrix slash command
+var slashSubcommands = []string{"help", "status", "join", "dm", "me", "rooms", "account", "password-reset", "config", "whois", "search", "invite", "unbridge", "cleanup"}
+
 // handleCommand routes the command to the appropriate handler.
 func (h *SlashCommandHandler) handleCommand(ctx context.Context, req *SlashCommandRequest) *SlashCommandResponse {
 	parts := strings.Fields(req.Text)
@@ -101,6 +163,12 @@ func (h *SlashCommandHandler) handleCommand(ctx context.Context, req *SlashComma
 
 	subcommand := strings.ToLower(parts[0])
 	args := parts[1:]
+	if slices.Contains(slashSubcommands, subcommand) {
+		if ok, reason := h.checkCommandPermission(ctx, req, subcommand); !ok {
+			zerolog.Ctx(ctx).Debug().Str("subcommand", subcommand).Msg("Denied slash command")
+			return &SlashCommandResponse{ResponseType: "ephemeral", Text: "❌ " + reason}
+		}
+	}
 
 	switch subcommand {
 	case "help":
@@ -108,15 +176,42 @@ func (h *SlashCommandHandler) handleCommand(ctx context.Context, req *SlashComma
 	case "status":
 		return h.statusResponse(ctx)
 	case "join":
-		return h.joinResponse(ctx, req.UserID, args)
+		return h.withFollowUp(ctx, req, func(ctx context.Context) *SlashCommandResponse {
+			return h.joinResponse(ctx, req.UserID, args)
+		})
 	case "dm":
-		return h.dmResponse(ctx, req.UserID, req.TeamDomain, args)
+		return h.withFollowUp(ctx, req, func(ctx context.Context) *SlashCommandResponse {
+			return h.dmResponse(ctx, req.UserID, req.TeamDomain, args)
+		})
 	case "me":
 		return h.meResponse(ctx, req.UserID)
 	case "rooms":
 		return h.roomsResponse(ctx, req.UserID)
 	case "account":
-		return h.accountResponse(ctx, req.UserID, req.UserName)
+		if len(args) > 0 && strings.ToLower(args[0]) == "reset" {
+			return h.accountResetResponse(ctx, req)
+		}
+		return h.withFollowUp(ctx, req, func(ctx context.Context) *SlashCommandResponse {
+			return h.accountResponse(ctx, req.UserID, req.UserName)
+		})
+	case "password-reset":
+		return h.accountResetResponse(ctx, req)
+	case "config":
+		return h.configResponse(ctx, req.UserID, req.ChannelID, args)
+	case "whois":
+		return h.withFollowUp(ctx, req, func(ctx context.Context) *SlashCommandResponse {
+			return h.whoisResponse(ctx, req.UserID, args)
+		})
+	case "search":
+		return h.searchResponse(ctx, req.UserID, args)
+	case "invite":
+		return h.withFollowUp(ctx, req, func(ctx context.Context) *SlashCommandResponse {
+			return h.inviteResponse(ctx, req.UserID, req.ChannelID, args)
+		})
+	case "unbridge":
+		return h.unbridgeResponse(ctx, req)
+	case "cleanup":
+		return h.cleanupResponse(ctx, req)
 	default:
 		return &SlashCommandResponse{
 			ResponseType: "ephemeral",
@@ -125,6 +220,68 @@ func (h *SlashCommandHandler) handleCommand(ctx context.Context, req *SlashComma
 	}
 }
 
+// slashCommandFollowUpDelay is how long a slow subcommand can run before the bridge answers
+// with a placeholder and posts the result to the response URL. Mattermost gives up on slash
+// commands after 3 seconds.
+var slashCommandFollowUpDelay = 2 * time.Second
+
+// withFollowUp runs a subcommand that may take long, like joining a federated room or
+// creating accounts. If it doesn't finish in time, it returns a placeholder response, and
+// the result is posted to the response URL of the request when it's done. Requests are
+// only followed up when the slash command token is checked, so that unauthenticated
+// requests can't make the bridge post to arbitrary URLs.
+func (h *SlashCommandHandler) withFollowUp(ctx context.Context, req *SlashCommandRequest, fn func(context.Context) *SlashCommandResponse) *SlashCommandResponse {
+	if req.ResponseURL == "" || h.expectedToken(req) == "" {
+		return fn(ctx)
+	}
+	done := make(chan *SlashCommandResponse, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+	select {
+	case resp := <-done:
+		return resp
+	case <-time.After(slashCommandFollowUpDelay):
+	}
+	go func() {
+		log := zerolog.Ctx(ctx)
+		resp := <-done
+		h.applyTeamResponse(req, resp)
+		if err := sendSlashCommandFollowUp(ctx, req.ResponseURL, resp); err != nil {
+			log.Err(err).Msg("Failed to send slash command result")
+		} else {
+			log.Debug().Msg("Sent slash command result to response URL")
+		}
+	}()
+	return &SlashCommandResponse{
+		ResponseType: "ephemeral",
+		Text:         "⏳ Working on it, the result will show up here when it's done.",
+	}
+}
+
+// sendSlashCommandFollowUp posts the result of a slash command to its response URL
+func sendSlashCommandFollowUp(ctx context.Context, responseURL string, resp *SlashCommandResponse) error {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, responseURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to post to response URL: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		errBody, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return fmt.Errorf("response URL returned HTTP %d: %s", httpResp.StatusCode, strings.TrimSpace(string(errBody)))
+	}
+	return nil
+}
+
 // helpResponse returns the help text.
 func (h *SlashCommandHandler) helpResponse() *SlashCommandResponse {
 	helpText := `**Matrix Bridge Commands**
@@ -134,8 +291,15 @@ func (h *SlashCommandHandler) helpResponse() *SlashCommandResponse {
 • ` + "`/matrix me`" + ` - Show your Matrix user info
 • ` + "`/matrix join <room>`" + ` - Join a Matrix room (e.g., ` + "`#room:matrix.org`" + `)
 • ` + "`/matrix dm <user>`" + ` - Start a DM with a Matrix user (e.g., ` + "`@user:matrix.org`" + `)
+• ` + "`/matrix invite <user>`" + ` - Invite a Matrix user to the Matrix room of this channel
 • ` + "`/matrix rooms`" + ` - List your bridged Matrix rooms
-• ` + "`/matrix account`" + ` - Get your Matrix account credentials`
+• ` + "`/matrix account`" + ` - Get your Matrix account credentials
+• ` + "`/matrix password-reset`" + ` - Reset the password of your Matrix account (also ` + "`/matrix account reset`" + `)
+• ` + "`/matrix config [setting value]`" + ` - View or change the bridge settings of this channel
+• ` + "`/matrix unbridge`" + ` - Stop bridging this channel to Matrix (channel admins only)
+• ` + "`/matrix cleanup`" + ` - Unbridge the Matrix rooms of deleted channels (admins only)
+• ` + "`/matrix whois <user>`" + ` - Show a Matrix user's profile and the channels you share
+• ` + "`/matrix search <text>`" + ` - Find bridged channels and their Matrix rooms`
 
 	return &SlashCommandResponse{
 		ResponseType: "ephemeral",
@@ -151,20 +315,20 @@ func (h *SlashCommandHandler) statusResponse(ctx context.Context) *SlashCommandR
 
 	// Check connection
 	if h.Connector.Client != nil {
-		statusLines = append(statusLines, "• **Mattermost**: Connected to "+h.Connector.Config.ServerURL)
+		statusLines = append(statusLines, "• **Mattermost**: Connected to "+h.Connector.config().ServerURL)
 	} else {
 		statusLines = append(statusLines, "• **Mattermost**: Not connected")
 	}
 
 	// Check WebSocket
-	if h.Connector.WSClient != nil {
+	if h.Connector.WSClient.Load() != nil {
 		statusLines = append(statusLines, "• **WebSocket**: Connected")
 	} else {
 		statusLines = append(statusLines, "• **WebSocket**: Not connected")
 	}
 
 	// Check mode
-	mode := string(h.Connector.Config.Mode)
+	mode := string(h.Connector.config().Mode)
 	if mode == "" {
 		mode = "puppet"
 	}
@@ -209,27 +373,26 @@ func (h *SlashCommandHandler) joinResponse(ctx context.Context, userID string, a
 		}
 	}
 
-	roomIdentifier := args[0]
-	if !strings.HasPrefix(roomIdentifier, "#") && !strings.HasPrefix(roomIdentifier, "!") {
+	ref, ok := parseRoomReference(args[0])
+	if !ok {
 		return &SlashCommandResponse{
 			ResponseType: "ephemeral",
-			Text:         "Invalid room identifier. Use a room alias (e.g., `#room:server.com`) or room ID (e.g., `!abc123:server.com`).",
+			Text:         "Invalid room identifier. Use a room alias (e.g., `#room:server.com`), room ID (e.g., `!abc123:server.com`) or matrix.to link.",
 		}
 	}
+	roomIdentifier := ref.String()
 
-	// Check if Synapse Admin API is configured
-	if h.Connector.Config.SynapseAdmin.URL == "" || h.Connector.Config.SynapseAdmin.Token == "" {
+	// Check if a homeserver admin backend is configured
+	admin := h.Connector.MatrixAdmin
+	if admin == nil {
 		return &SlashCommandResponse{
 			ResponseType: "ephemeral",
-			Text:         "❌ Synapse Admin API is not configured. Contact your administrator to enable this feature.",
+			Text:         "❌ Homeserver admin API is not configured. Contact your administrator to enable this feature.",
 		}
 	}
 
-	// Create Matrix Admin client
-	admin := NewMatrixAdminClient(h.Connector.Config.SynapseAdmin.URL, h.Connector.Config.SynapseAdmin.Token)
-
 	// Get Mattermost user to generate Matrix ID
-	mmUser, _, err := h.Connector.Client.GetUser(ctx, userID, "")
+	mmUser, err := h.Connector.getUser(ctx, h.Connector.Client, userID)
 	if err != nil {
 		return &SlashCommandResponse{
 			ResponseType: "ephemeral",
@@ -238,8 +401,9 @@ func (h *SlashCommandHandler) joinResponse(ctx context.Context, userID string, a
 	}
 
 	// Generate Matrix user ID from Mattermost username
-	serverName := h.Connector.Bridge.Matrix.ServerName()
-	matrixUserID := GenerateMatrixUserID(mmUser, serverName)
+	matrixUserID := h.Connector.matrixAccountID(mmUser)
+
+	log := zerolog.Ctx(ctx)
 
 	// Try to ensure Matrix user exists (create if needed)
 	// This is optional - if admin API isn't available or lacks permissions, we'll still try to join
@@ -248,60 +412,52 @@ func (h *SlashCommandHandler) joinResponse(ctx context.Context, userID string, a
 		if err != nil {
 			// Admin API not working - log warning but continue
 			// The user might already exist, or the join will fail with a clear error
-			fmt.Printf("WARN: Cannot check if Matrix user exists (admin API issue): %v\n", err)
-			fmt.Printf("INFO: Will attempt to join anyway - if user doesn't exist, join will fail\n")
+			log.Warn().Err(err).Msg("Cannot check if Matrix user exists (admin API issue), attempting to join anyway")
 		} else if !exists {
 			// Try to create Matrix account
 			displayName := mmUser.GetDisplayName(model.ShowFullName)
 			if displayName == "" {
 				displayName = mmUser.Username
 			}
-			password := GeneratePassword()
-
-			err = admin.CreateUser(ctx, matrixUserID, password, displayName)
+			password, err := GeneratePassword(h.Connector.config().PasswordPolicy)
+			if err == nil {
+				err = admin.CreateUser(ctx, matrixUserID, password, displayName)
+			}
 			if err != nil {
-				fmt.Printf("WARN: Failed to create Matrix user %s: %v\n", matrixUserID, err)
+				log.Warn().Err(err).Stringer("mxid", matrixUserID).Msg("Failed to create Matrix user")
 				// Continue anyway - user might exist despite the check failing
 			} else {
-				fmt.Printf("INFO: Created Matrix user %s\n", matrixUserID)
+				log.Info().Stringer("mxid", matrixUserID).Msg("Created Matrix user")
 			}
 		}
 	}
 
 	// Resolve room alias to room ID if needed, capturing via servers for federation
-	var roomID id.RoomID
-	var viaServers []string
-	if strings.HasPrefix(roomIdentifier, "#") {
-		resolvedID, servers, err := admin.ResolveRoomAlias(ctx, roomIdentifier)
-		if err != nil {
-			return &SlashCommandResponse{
-				ResponseType: "ephemeral",
-				Text:         fmt.Sprintf("❌ Failed to resolve room alias `%s`: %v\n\nMake sure the room exists and is accessible.", roomIdentifier, err),
-			}
-		}
-		roomID = resolvedID
-		viaServers = servers
-		fmt.Printf("DEBUG: Resolved alias %s to room %s with via servers: %v\n", roomIdentifier, roomID, viaServers)
-	} else {
-		roomID = id.RoomID(roomIdentifier)
-		// Extract server from room ID for federation (e.g., !abc:matrix.org -> matrix.org)
-		parts := strings.SplitN(string(roomID), ":", 2)
-		if len(parts) == 2 {
-			viaServers = []string{parts[1]}
+	roomID, viaServers, err := h.Connector.resolveRoomReference(ctx, ref)
+	if err != nil {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         fmt.Sprintf("❌ Failed to resolve room alias `%s`: %v\n\nMake sure the room exists and is accessible.", roomIdentifier, err),
 		}
 	}
+	log.Debug().
+		Str("room_identifier", roomIdentifier).
+		Stringer("room_id", roomID).
+		Strs("via", viaServers).
+		Msg("Resolved room")
 
 	// Get room info to determine if public or private
+	var joinRule event.JoinRule
 	roomInfo, err := admin.GetRoomInfo(ctx, roomID)
-	isPublic := true // Default to public
 	if err == nil && roomInfo != nil {
-		if joinRule, ok := roomInfo["join_rule"].(string); ok {
-			isPublic = (joinRule == "public")
+		if rule, ok := roomInfo["join_rule"].(string); ok {
+			joinRule = event.JoinRule(rule)
 		}
 	}
+	isPublic := joinRule == "" || joinRule == event.JoinRulePublic // Default to public
 
 	// Get the ghost for this user so we can use their Matrix identity
-	ghost, err := h.Connector.Bridge.GetGhostByID(ctx, networkid.UserID(mmUser.Username))
+	ghost, err := h.Connector.Bridge.GetGhostByID(ctx, MakeUserID(mmUser.Id))
 	if err != nil {
 		return &SlashCommandResponse{
 			ResponseType: "ephemeral",
@@ -311,28 +467,110 @@ func (h *SlashCommandHandler) joinResponse(ctx context.Context, userID string, a
 
 	// Get the ghost's MXID
 	ghostMXID := ghost.Intent.GetMXID()
-	fmt.Printf("DEBUG: Attempting to join room %s as ghost %s with via servers: %v\n", roomID, ghostMXID, viaServers)
+	log.Debug().
+		Stringer("room_id", roomID).
+		Stringer("ghost_mxid", ghostMXID).
+		Strs("via", viaServers).
+		Msg("Attempting to join room as ghost")
+
+	// Join the room, trying each via server until one works
+	err = h.Connector.joinRoomVia(ctx, ghostMXID, roomID, viaServers)
+	if errors.Is(err, ErrJoinForbidden) && mayKnock(joinRule) {
+		// Rooms that can't be joined directly may accept a knock instead
+		log.Debug().Err(err).Stringer("room_id", roomID).Msg("Join was forbidden, knocking on room")
+		return h.knockResponse(ctx, userID, roomIdentifier, roomID, ghostMXID, viaServers, err)
+	} else if err != nil {
+		log.Err(err).Stringer("room_id", roomID).Stringer("ghost_mxid", ghostMXID).Msg("Failed to join room")
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         fmt.Sprintf("❌ Failed to join Matrix room: %v", err),
+		}
+	}
 
-	// Join the room using our custom federation-aware join method
-	err = admin.JoinRoomVia(ctx, ghostMXID, roomID, viaServers)
+	link, err := h.Connector.linkJoinedRoom(ctx, userID, roomIdentifier, roomID, isPublic)
 	if err != nil {
-		fmt.Printf("ERROR: Failed to join room %s as %s: %v\n", roomID, ghostMXID, err)
 		return &SlashCommandResponse{
 			ResponseType: "ephemeral",
-			Text:         fmt.Sprintf("❌ Failed to join Matrix room: %v\n\nThe room may be invite-only or your Matrix account may not have access.", err),
+			Text:         fmt.Sprintf("❌ Joined the Matrix room, but %v", err),
+		}
+	}
+	return &SlashCommandResponse{
+		ResponseType: "ephemeral",
+		Text:         link.joinedText(matrixUserID),
+	}
+}
+
+// knockResponse knocks on a room that couldn't be joined, and tells the user that the
+// channel will be created once the knock is accepted
+func (h *SlashCommandHandler) knockResponse(ctx context.Context, userID, roomIdentifier string, roomID id.RoomID, ghostMXID id.UserID, viaServers []string, joinErr error) *SlashCommandResponse {
+	log := zerolog.Ctx(ctx)
+	if h.Connector.PendingKnocks == nil {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         fmt.Sprintf("❌ Failed to join Matrix room: %v", joinErr),
+		}
+	}
+	if err := h.Connector.knockRoomVia(ctx, ghostMXID, roomID, viaServers); err != nil {
+		log.Err(err).Stringer("room_id", roomID).Stringer("ghost_mxid", ghostMXID).Msg("Failed to knock on room")
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         fmt.Sprintf("❌ Failed to join Matrix room: %v\n\nAsking to join it failed too: %v", joinErr, err),
 		}
 	}
+	err := h.Connector.PendingKnocks.Put(ctx, &PendingKnock{
+		RoomID:         roomID,
+		MXID:           ghostMXID,
+		MMUserID:       userID,
+		RoomIdentifier: roomIdentifier,
+		KnockedAt:      time.Now(),
+	})
+	if err != nil {
+		log.Err(err).Stringer("room_id", roomID).Msg("Failed to store pending knock")
+	}
+	log.Info().Stringer("room_id", roomID).Stringer("ghost_mxid", ghostMXID).Msg("Knocked on room")
+	return &SlashCommandResponse{
+		ResponseType: "ephemeral",
+		Text: fmt.Sprintf("🚪 **Asked to join Matrix room `%s`**\n\n"+
+			"The room can't be joined directly, so the bridge knocked on it for you. "+
+			"Once a member of the room accepts, the channel will be created and you'll get a direct message with a link to it.",
+			roomIdentifier),
+	}
+}
+
+// linkedRoom is the Mattermost channel a joined Matrix room was linked to
+type linkedRoom struct {
+	RoomID   id.RoomID
+	Channel  *model.Channel
+	TeamName string
+	IsPublic bool
+}
+
+// joinedText describes a linked room to the user who joined it
+func (l *linkedRoom) joinedText(matrixUserID id.UserID) string {
+	channelLink := fmt.Sprintf("/%s/channels/%s", l.TeamName, l.Channel.Name)
+	return fmt.Sprintf("✅ **Successfully joined Matrix room!**\n\n"+
+		"• **Matrix Room**: `%s`\n"+
+		"• **Matrix Account**: `%s`\n"+
+		"• **Mattermost Channel**: `%s` (%s)\n"+
+		"• **[Open Channel](%s)**\n\n"+
+		"Messages will now be bridged between the Matrix room and this Mattermost channel.",
+		l.RoomID, matrixUserID, l.Channel.DisplayName,
+		map[bool]string{true: "public", false: "private"}[l.IsPublic],
+		channelLink)
+}
+
+// linkJoinedRoom creates the Mattermost channel of a Matrix room the user's Matrix account
+// joined, adds the user to it and links it to the room
+func (m *MattermostConnector) linkJoinedRoom(ctx context.Context, userID, roomIdentifier string, roomID id.RoomID, isPublic bool) (*linkedRoom, error) {
+	log := zerolog.Ctx(ctx)
 
 	// Generate Mattermost channel name
 	channelName := sanitizeChannelName(roomIdentifier)
 
 	// Get any available login for creating the portal and setting up relay
-	users := h.Connector.GetUsers()
+	users := m.GetUsers()
 	if len(users) == 0 {
-		return &SlashCommandResponse{
-			ResponseType: "ephemeral",
-			Text:         "❌ No bridge logins available. The bridge may not be fully configured.",
-		}
+		return nil, fmt.Errorf("no bridge logins are available. The bridge may not be fully configured.")
 	}
 	login := users[0]
 
@@ -344,12 +582,9 @@ func (h *SlashCommandHandler) joinResponse(ctx context.Context, userID string, a
 
 	// Get user's team - we need to know which team to create the channel in
 	// For now, we'll get the first team the user is a member of
-	teams, err := h.Connector.Client.GetTeamsForUser(ctx, userID)
+	teams, err := m.Client.GetTeamsForUser(ctx, userID)
 	if err != nil || len(teams) == 0 {
-		return &SlashCommandResponse{
-			ResponseType: "ephemeral",
-			Text:         "❌ Could not find a team to create the channel in. Make sure you're a member of at least one team.",
-		}
+		return nil, fmt.Errorf("could not find a team to create the channel in. Make sure you're a member of at least one team.")
 	}
 	teamID := teams[0].Id
 
@@ -361,25 +596,22 @@ func (h *SlashCommandHandler) joinResponse(ctx context.Context, userID string, a
 		Purpose:     fmt.Sprintf("Bridged from Matrix room %s", roomID),
 	}
 
-	createdChannel, _, err := h.Connector.Client.CreateChannel(ctx, newChannel)
+	createdChannel, _, err := m.Client.CreateChannel(ctx, newChannel)
 	if err != nil {
 		// Channel might already exist, try to get it
-		existingChannel, _, err2 := h.Connector.Client.GetChannelByName(ctx, channelName, teamID, "")
+		existingChannel, _, err2 := m.Client.GetChannelByName(ctx, channelName, teamID, "")
 		if err2 == nil && existingChannel != nil {
 			createdChannel = existingChannel
 		} else {
-			return &SlashCommandResponse{
-				ResponseType: "ephemeral",
-				Text:         fmt.Sprintf("❌ Failed to create Mattermost channel: %v", err),
-			}
+			return nil, fmt.Errorf("failed to create Mattermost channel: %w", err)
 		}
 	}
 
 	// Add the requesting user to the channel
-	_, _, err = h.Connector.Client.AddChannelMember(ctx, createdChannel.Id, userID)
+	_, _, err = m.Client.AddChannelMember(ctx, createdChannel.Id, userID)
 	if err != nil {
 		// Might already be a member, continue anyway
-		fmt.Printf("DEBUG: Failed to add user to channel (may already be member): %v\n", err)
+		log.Debug().Err(err).Str("created_channel_id", createdChannel.Id).Msg("Failed to add user to channel (may already be member)")
 	}
 
 	// Create portal mapping between Matrix room and Mattermost channel
@@ -387,21 +619,18 @@ func (h *SlashCommandHandler) joinResponse(ctx context.Context, userID string, a
 		ID: networkid.PortalID(createdChannel.Id),
 	}
 
-	portal, err := h.Connector.Bridge.GetPortalByKey(ctx, portalKey)
+	portal, err := m.Bridge.GetPortalByKey(ctx, portalKey)
 	if err != nil {
-		return &SlashCommandResponse{
-			ResponseType: "ephemeral",
-			Text:         fmt.Sprintf("✅ Joined Matrix room and created channel, but failed to set up portal: %v", err),
-		}
+		return nil, fmt.Errorf("created the channel, but failed to set up portal: %w", err)
 	}
 
 	// If portal doesn't have an MXID yet, we need to set it
 	if portal.MXID == "" {
 		portal.MXID = roomID
 		// Save the portal
-		err = h.Connector.Bridge.DB.Portal.Update(ctx, portal.Portal)
+		err = m.Bridge.DB.Portal.Update(ctx, portal.Portal)
 		if err != nil {
-			fmt.Printf("WARN: Failed to update portal MXID: %v\n", err)
+			log.Warn().Err(err).Str("created_channel_id", createdChannel.Id).Msg("Failed to update portal MXID")
 		}
 	}
 
@@ -409,24 +638,16 @@ func (h *SlashCommandHandler) joinResponse(ctx context.Context, userID string, a
 	// This is better than joining the bridge bot - the ghost can handle everything
 	err = portal.SetRelay(ctx, login)
 	if err != nil {
-		fmt.Printf("WARN: Failed to set relay for portal %s: %v\n", portal.MXID, err)
+		log.Warn().Err(err).Stringer("room_id", portal.MXID).Msg("Failed to set relay for portal")
 		// Don't fail the command - basic bridging should still work
 	}
 
-	channelLink := fmt.Sprintf("/%s/channels/%s", teams[0].Name, createdChannel.Name)
-
-	return &SlashCommandResponse{
-		ResponseType: "ephemeral",
-		Text: fmt.Sprintf("✅ **Successfully joined Matrix room!**\n\n"+
-			"• **Matrix Room**: `%s`\n"+
-			"• **Matrix Account**: `%s`\n"+
-			"• **Mattermost Channel**: `%s` (%s)\n"+
-			"• **[Open Channel](%s)**\n\n"+
-			"Messages will now be bridged between the Matrix room and this Mattermost channel.",
-			roomID, matrixUserID, createdChannel.DisplayName,
-			map[bool]string{true: "public", false: "private"}[isPublic],
-			channelLink),
-	}
+	return &linkedRoom{
+		RoomID:   roomID,
+		Channel:  createdChannel,
+		TeamName: teams[0].Name,
+		IsPublic: isPublic,
+	}, nil
 }
 
 // sanitizeChannelName converts a Matrix room identifier to a valid Mattermost channel name
@@ -491,8 +712,8 @@ func (h *SlashCommandHandler) dmResponse(ctx context.Context, userID, teamDomain
 		}
 	}
 
-	// 3. Get the ghost object using the Matrix User ID (the network ID)
-	ghost, err := h.Connector.Bridge.GetGhostByID(ctx, networkid.UserID(matrixUserID))
+	// 2. Get the ghost object of the Mattermost account
+	ghost, err := h.Connector.Bridge.GetGhostByID(ctx, MakeUserID(mmRecipientID))
 	if err != nil {
 		return &SlashCommandResponse{
 			ResponseType: "ephemeral",
@@ -500,30 +721,6 @@ func (h *SlashCommandHandler) dmResponse(ctx context.Context, userID, teamDomain
 		}
 	}
 
-	// 4. Update ghost metadata with proper Mattermost UUID to ensure calls like CreateDirectChannelWithBoth work
-	if ghost.Metadata == nil {
-		ghost.Metadata = make(map[string]any)
-	}
-	// We need to handle the map type assertion safely
-	var meta map[string]any
-	if m, ok := ghost.Metadata.(map[string]any); ok {
-		meta = m
-	} else {
-		meta = make(map[string]any)
-	}
-
-	meta["mm_id"] = mmRecipientID
-	ghost.Metadata = meta
-
-	// Persist the metadata
-	if ghost.Ghost != nil {
-		err = h.Connector.Bridge.DB.Ghost.Update(ctx, ghost.Ghost)
-		if err != nil {
-			// Log but continue, as in-memory metadata might be enough for this request
-			fmt.Printf("DEBUG: Failed to update ghost metadata in DB: %v\n", err)
-		}
-	}
-
 	// Try to create a DM with this ghost using the existing API
 	api, ok := login.Client.(*MattermostAPI)
 	if !ok || api == nil {
@@ -534,7 +731,6 @@ func (h *SlashCommandHandler) dmResponse(ctx context.Context, userID, teamDomain
 	}
 
 	// Attempt to create a DM channel
-	// CreateChatWithGhost will use the mm_id from metadata
 	chatResp, err := api.CreateChatWithGhost(ctx, ghost)
 	if err != nil {
 		return &SlashCommandResponse{
@@ -548,10 +744,10 @@ func (h *SlashCommandHandler) dmResponse(ctx context.Context, userID, teamDomain
 		ChannelId: string(chatResp.PortalKey.ID),
 		Message:   fmt.Sprintf("Bridged DM with `%s` established. You can now chat with this user.", matrixUserID),
 	}
-	_, _, err = api.Client.CreatePost(ctx, post)
+	_, _, err = api.Client().CreatePost(ctx, post)
 	if err != nil {
 		// Log error but don't fail the command
-		fmt.Printf("Failed to post starter message: %v\n", err)
+		zerolog.Ctx(ctx).Warn().Err(err).Str("dm_channel_id", string(chatResp.PortalKey.ID)).Msg("Failed to post starter message")
 	}
 
 	channelID := string(chatResp.PortalKey.ID)
@@ -559,7 +755,7 @@ func (h *SlashCommandHandler) dmResponse(ctx context.Context, userID, teamDomain
 
 	// Invite the real Matrix user to the room (async)
 	// We use context.Background() so it doesn't get canceled when the slash command response is sent
-	bgCtx := context.Background()
+	bgCtx := zerolog.Ctx(ctx).WithContext(context.Background())
 	portalKey := chatResp.PortalKey
 	go func() {
 		var portal *bridgev2.Portal
@@ -575,6 +771,11 @@ func (h *SlashCommandHandler) dmResponse(ctx context.Context, userID, teamDomain
 		}
 
 		if portal != nil && portal.MXID != "" {
+			log := zerolog.Ctx(bgCtx).With().
+				Str("dm_channel_id", string(portalKey.ID)).
+				Stringer("room_id", portal.MXID).
+				Str("mxid", matrixUserID).
+				Logger()
 			// Invite the native Matrix user
 			// We use the user's puppet intent (ghost or double puppet) to perform the invite
 			// as it looks more natural than using the bridge bot and avoids the 403 error
@@ -582,20 +783,20 @@ func (h *SlashCommandHandler) dmResponse(ctx context.Context, userID, teamDomain
 			intent := login.User.DoublePuppet(bgCtx)
 			err = intent.InviteUser(bgCtx, portal.MXID, id.UserID(matrixUserID))
 			if err != nil {
-				fmt.Printf("DEBUG: Failed to invite %s to %s: %v\n", matrixUserID, portal.MXID, err)
+				log.Debug().Err(err).Msg("Failed to invite Matrix user to DM")
 			} else {
-				fmt.Printf("DEBUG: Successfully invited %s to %s\n", matrixUserID, portal.MXID)
+				log.Debug().Msg("Invited Matrix user to DM")
 			}
 
 			// Set the portal relay so that the remote Matrix user can reply without being logged in
 			err = portal.SetRelay(bgCtx, login)
 			if err != nil {
-				fmt.Printf("DEBUG: Failed to set relay for %s: %v\n", portal.MXID, err)
+				log.Debug().Err(err).Msg("Failed to set relay for DM")
 			} else {
-				fmt.Printf("DEBUG: Successfully set relay for %s to %s\n", portal.MXID, login.ID)
+				log.Debug().Str("login_id", string(login.ID)).Msg("Set relay for DM")
 			}
 		} else {
-			fmt.Printf("DEBUG: Failed to resolve portal MXID for invite after timeout\n")
+			zerolog.Ctx(bgCtx).Debug().Str("dm_channel_id", string(portalKey.ID)).Msg("Failed to resolve portal MXID for invite after timeout")
 		}
 	}()
 
@@ -649,6 +850,35 @@ func (h *SlashCommandHandler) roomsResponse(ctx context.Context, userID string)
 	}
 }
 
+// configResponse shows or changes the bridge settings of the channel. Only system and
+// channel admins can change them.
+func (h *SlashCommandHandler) configResponse(ctx context.Context, userID, channelID string, args []string) *SlashCommandResponse {
+	portal, err := h.Connector.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{ID: networkid.PortalID(channelID)})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get portal")
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "❌ Failed to get the bridged room of this channel."}
+	} else if portal == nil {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "This channel isn't bridged to Matrix."}
+	}
+	canChange := false
+	if len(args) > 0 {
+		canChange = h.isChannelAdmin(ctx, userID, channelID)
+	}
+	return &SlashCommandResponse{
+		ResponseType: "ephemeral",
+		Text:         runConfigCommand(ctx, portal, args, canChange),
+	}
+}
+
+// isChannelAdmin checks whether a Mattermost user is a system admin or an admin of a channel
+func (h *SlashCommandHandler) isChannelAdmin(ctx context.Context, userID, channelID string) bool {
+	if user, err := h.Connector.getUser(ctx, h.Connector.Client, userID); err == nil && user.IsSystemAdmin() {
+		return true
+	}
+	member, _, err := h.Connector.Client.GetChannelMember(ctx, channelID, userID, "")
+	return err == nil && member.SchemeAdmin
+}
+
 // accountResponse returns the user's Matrix account credentials.
 func (h *SlashCommandHandler) accountResponse(ctx context.Context, userID, userName string) *SlashCommandResponse {
 	// Get the homeserver domain from the bridge config
@@ -657,21 +887,31 @@ func (h *SlashCommandHandler) accountResponse(ctx context.Context, userID, userN
 	// Generate the Matrix user ID for this Mattermost user
 	matrixUserID := id.NewUserID(userName, string(domain))
 
-	// Check if Synapse Admin API is configured
-	if h.Connector.Config.SynapseAdmin.URL == "" || h.Connector.Config.SynapseAdmin.Token == "" {
+	// Check if a homeserver admin backend that can create accounts is configured
+	admin := h.Connector.MatrixAdmin
+	if h.Connector.usesGhostAccounts() {
+		ghostMXID := h.Connector.Bridge.Matrix.GhostIntent(MakeUserID(userID)).GetMXID()
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text: fmt.Sprintf("**Your Matrix Account**\n\n"+
+				"• **Matrix ID**: `%s`\n"+
+				"• **Homeserver**: `%s`\n\n"+
+				"_You appear on Matrix as the bridge's ghost user, which you can't log in to. Log in to the bridge from a Matrix account to use Matrix clients._",
+				ghostMXID, domain),
+		}
+	} else if admin == nil {
 		return &SlashCommandResponse{
 			ResponseType: "ephemeral",
 			Text: fmt.Sprintf("**Your Matrix Account**\n\n"+
 				"• **Matrix ID**: `%s`\n"+
 				"• **Homeserver**: `%s`\n\n"+
-				"_Note: Synapse Admin API is not configured. Contact your administrator for login credentials._",
+				"_Note: Homeserver admin API is not configured. Contact your administrator for login credentials._",
 				matrixUserID, domain),
 		}
+	} else if h.Connector.ssoAccounts() {
+		return h.ssoAccountResponse(ctx, userID)
 	}
 
-	// Create Synapse Admin client
-	admin := NewMatrixAdminClient(h.Connector.Config.SynapseAdmin.URL, h.Connector.Config.SynapseAdmin.Token)
-
 	// Check if user exists
 	exists, err := admin.UserExists(ctx, matrixUserID)
 	if err != nil {
@@ -695,12 +935,18 @@ func (h *SlashCommandHandler) accountResponse(ctx context.Context, userID, userN
 	}
 
 	// Account doesn't exist - create it
-	password := GeneratePassword()
+	password, err := GeneratePassword(h.Connector.config().PasswordPolicy)
+	if err != nil {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         fmt.Sprintf("❌ Failed to generate a password: %v", err),
+		}
+	}
 
 	// Get the user's display name from Mattermost if possible
 	displayName := userName
 	if h.Connector.Client != nil {
-		mmUser, _, err := h.Connector.Client.GetUser(ctx, userID, "")
+		mmUser, err := h.Connector.getUser(ctx, h.Connector.Client, userID)
 		if err == nil && mmUser != nil {
 			if mmUser.FirstName != "" || mmUser.LastName != "" {
 				displayName = strings.TrimSpace(mmUser.FirstName + " " + mmUser.LastName)
@@ -718,15 +964,55 @@ func (h *SlashCommandHandler) accountResponse(ctx context.Context, userID, userN
 		}
 	}
 
+	credentials := matrixCredentials("Matrix Account Created!", matrixUserID, domain, password)
+	if h.Connector.config().PasswordPolicy.DeliverViaDM {
+		err = h.Connector.sendBridgeDM(ctx, userID, credentials)
+		if err == nil {
+			return &SlashCommandResponse{
+				ResponseType: "ephemeral",
+				Text:         fmt.Sprintf("✅ Matrix account `%s` created. Your login credentials were sent to you in a direct message.", matrixUserID),
+			}
+		}
+		// The account already exists at this point, so show the credentials rather than losing them
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to send Matrix credentials via DM, showing them in the response instead")
+	}
+
+	return &SlashCommandResponse{
+		ResponseType: "ephemeral",
+		Text:         credentials,
+	}
+}
+
+// ssoAccountResponse shows the Matrix account linked to a user's SSO identity, and creates
+// it without a password if it doesn't exist
+func (h *SlashCommandHandler) ssoAccountResponse(ctx context.Context, userID string) *SlashCommandResponse {
+	admin := h.Connector.MatrixAdmin
+	mmUser, err := h.Connector.getUser(ctx, h.Connector.Client, userID)
+	if err != nil {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: fmt.Sprintf("❌ Failed to get your Mattermost user info: %v", err)}
+	}
+	matrixUserID, exists, err := h.Connector.resolveMatrixAccount(ctx, admin, mmUser)
+	if err != nil {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: fmt.Sprintf("❌ Failed to check Matrix account status: %v", err)}
+	}
+	text := "✅ **Matrix Account Created!**"
+	if exists {
+		text = "**Your Matrix Account**"
+	} else if _, err = h.Connector.createMatrixAccount(ctx, admin, matrixUserID, mmUser); errors.Is(err, errNoSSOIdentity) {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         "❌ Matrix accounts are only created for users who log in to Mattermost with single sign-on. Contact your administrator.",
+		}
+	} else if err != nil {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: fmt.Sprintf("❌ Failed to create Matrix account: %v", err)}
+	}
 	return &SlashCommandResponse{
 		ResponseType: "ephemeral",
-		Text: fmt.Sprintf("✅ **Matrix Account Created!**\n\n"+
+		Text: fmt.Sprintf("%s\n\n"+
 			"• **Matrix ID**: `%s`\n"+
-			"• **Homeserver**: `%s`\n"+
-			"• **Password**: `%s`\n\n"+
-			"⚠️ **Save this password!** It will not be shown again.\n\n"+
-			"You can log in to any Matrix client (e.g., Element Web, Element Desktop, FluffyChat) using these credentials.",
-			matrixUserID, domain, password),
+			"• **Homeserver**: `%s`\n\n"+
+			"Log in to any Matrix client (e.g., Element) with single sign-on, using the same account as on Mattermost.",
+			text, matrixUserID, h.Connector.Bridge.Matrix.ServerName()),
 	}
 }
 
@@ -735,7 +1021,7 @@ func (h *SlashCommandHandler) accountResponse(ctx context.Context, userID, userN
 func (h *SlashCommandHandler) getOrProvisionGhost(ctx context.Context, mxid string) (string, error) {
 	// Delegate to the shared helper in Connector
 	// This ensures consistent username encoding and provisioning logic
-	userid, err := h.Connector.EnsureGhost(ctx, mxid)
+	userid, err := h.Connector.EnsureGhost(ctx, "", mxid)
 	if err != nil {
 		return "", err
 	}
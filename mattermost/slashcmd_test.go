@@ -1,11 +1,14 @@
 package mattermost
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -86,6 +89,8 @@ func TestSlashCommandHandler_JoinMissingArg(t *testing.T) {
 	connector := &MattermostConnector{
 		Config: &NetworkConfig{
 			ServerURL: "http://test.mattermost.com",
+			// Skips the permission check, which needs Mattermost
+			SlashCommandPermissions: SlashCommandPermissions{Commands: map[string]CommandLevel{"join": CommandEveryone}},
 		},
 	}
 	handler := NewSlashCommandHandler(connector, "")
@@ -123,3 +128,75 @@ func TestSlashCommandHandler_UnknownCommand(t *testing.T) {
 	require.Equal(t, http.StatusOK, rr.Code)
 	assert.Contains(t, rr.Body.String(), "Unknown subcommand")
 }
+
+func TestSlashCommandSetup(t *testing.T) {
+	setup := SlashCommandSetup("http://mattermost-bridge:29319")
+	assert.Contains(t, setup, "http://mattermost-bridge:8081/mattermost/command")
+	assert.Contains(t, setup, "slash_command_token")
+	assert.Contains(t, SlashCommandSetup(""), "http://bridge:8081/mattermost/command")
+}
+
+func TestSlashCommandHandler_WithFollowUp(t *testing.T) {
+	prevDelay := slashCommandFollowUpDelay
+	slashCommandFollowUpDelay = 10 * time.Millisecond
+	t.Cleanup(func() { slashCommandFollowUpDelay = prevDelay })
+
+	followUps := make(chan SlashCommandResponse, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp SlashCommandResponse
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&resp))
+		followUps <- resp
+	}))
+	t.Cleanup(server.Close)
+
+	handler := NewSlashCommandHandler(&MattermostConnector{Config: &NetworkConfig{}}, "test-token")
+	req := &SlashCommandRequest{ResponseURL: server.URL}
+	ctx := context.Background()
+
+	resp := handler.withFollowUp(ctx, req, func(context.Context) *SlashCommandResponse {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "fast"}
+	})
+	assert.Equal(t, "fast", resp.Text)
+
+	resp = handler.withFollowUp(ctx, req, func(context.Context) *SlashCommandResponse {
+		time.Sleep(50 * time.Millisecond)
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "slow"}
+	})
+	assert.Contains(t, resp.Text, "Working on it")
+	select {
+	case followUp := <-followUps:
+		assert.Equal(t, "slow", followUp.Text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("result wasn't posted to the response URL")
+	}
+
+	// Without a token the response URL isn't trusted, so the command runs synchronously
+	handler.Token = ""
+	resp = handler.withFollowUp(ctx, req, func(context.Context) *SlashCommandResponse {
+		time.Sleep(50 * time.Millisecond)
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "slow"}
+	})
+	assert.Equal(t, "slow", resp.Text)
+}
+
+func TestSlashCommandHandler_PasswordReset(t *testing.T) {
+	connector := &MattermostConnector{
+		Config: &NetworkConfig{
+			ServerURL:               "http://test.mattermost.com",
+			SlashCommandPermissions: SlashCommandPermissions{Commands: map[string]CommandLevel{"password-reset": CommandEveryone}},
+		},
+	}
+	handler := NewSlashCommandHandler(connector, "")
+
+	form := url.Values{}
+	form.Set("text", "password-reset")
+
+	req := httptest.NewRequest(http.MethodPost, "/mattermost/command", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Homeserver admin API is not configured")
+}
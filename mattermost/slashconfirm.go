@@ -0,0 +1,157 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// Destructive slash commands answer with Confirm and Cancel buttons instead of running
+// right away. Mattermost sends button clicks to the action endpoint, on the same server and
+// host as the slash command.
+
+// slashActionPath is the path of the endpoint for slash command buttons
+const slashActionPath = "/mattermost/action"
+
+// confirmationTimeout is how long the buttons of a confirmation work
+const confirmationTimeout = 5 * time.Minute
+
+// pendingConfirmation is a destructive action waiting for a user to confirm it
+type pendingConfirmation struct {
+	userID      string
+	responseURL string
+	expires     time.Time
+	run         func(context.Context) string
+}
+
+// confirmations stores pending confirmations by a random ID, which is the only secret in the
+// button callbacks as Mattermost doesn't sign them
+type confirmations struct {
+	lock    sync.Mutex
+	pending map[string]*pendingConfirmation
+}
+
+// add stores a confirmation and returns its ID. Expired confirmations are dropped.
+func (c *confirmations) add(pc *pendingConfirmation) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.pending == nil {
+		c.pending = make(map[string]*pendingConfirmation)
+	}
+	now := time.Now()
+	for confirmationID, other := range c.pending {
+		if now.After(other.expires) {
+			delete(c.pending, confirmationID)
+		}
+	}
+	confirmationID := model.NewId()
+	c.pending[confirmationID] = pc
+	return confirmationID
+}
+
+// pop removes a confirmation of a user and returns it if it hasn't expired
+func (c *confirmations) pop(confirmationID, userID string) *pendingConfirmation {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pc, ok := c.pending[confirmationID]
+	if !ok || pc.userID != userID {
+		return nil
+	}
+	delete(c.pending, confirmationID)
+	if time.Now().After(pc.expires) {
+		return nil
+	}
+	return pc
+}
+
+// actionURL returns the URL of the action endpoint as reached by Mattermost, from a slash
+// command request
+func actionURL(r *http.Request) string {
+	scheme := "http"
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	} else if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + slashActionPath
+}
+
+// confirm asks the user to confirm a destructive action with buttons. run is called when
+// they click Confirm and returns the text that replaces the buttons.
+func (h *SlashCommandHandler) confirm(req *SlashCommandRequest, prompt, confirmLabel string, run func(context.Context) string) *SlashCommandResponse {
+	if req.actionURL == "" {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "❌ This command needs confirmation, which isn't available here."}
+	}
+	confirmationID := h.confirmations.add(&pendingConfirmation{
+		userID:      req.UserID,
+		responseURL: req.ResponseURL,
+		expires:     time.Now().Add(confirmationTimeout),
+		run:         run,
+	})
+	button := func(name, style, action string) *model.PostAction {
+		return &model.PostAction{
+			Type:  model.PostActionTypeButton,
+			Name:  name,
+			Style: style,
+			Integration: &model.PostActionIntegration{
+				URL:     req.actionURL,
+				Context: map[string]any{"confirmation_id": confirmationID, "action": action},
+			},
+		}
+	}
+	return &SlashCommandResponse{
+		ResponseType: "ephemeral",
+		Attachments: []*model.SlackAttachment{{
+			Text: prompt,
+			Actions: []*model.PostAction{
+				button(confirmLabel, "danger", "confirm"),
+				button("Cancel", "default", "cancel"),
+			},
+		}},
+	}
+}
+
+// ServeAction handles clicks on the buttons of slash command responses
+func (h *SlashCommandHandler) ServeAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req model.PostActionIntegrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	log := h.Connector.moduleLog(LogModuleSlashCmd).With().
+		Str("channel_id", req.ChannelId).
+		Str("mm_user_id", req.UserId).
+		Logger()
+	ctx := log.WithContext(context.Background())
+
+	confirmationID, _ := req.Context["confirmation_id"].(string)
+	action, _ := req.Context["action"].(string)
+	var text string
+	if pc := h.confirmations.pop(confirmationID, req.UserId); pc == nil {
+		text = "This confirmation has expired, run the command again."
+	} else if action != "confirm" {
+		text = "Cancelled."
+	} else {
+		log.Debug().Msg("Running confirmed slash command")
+		resp := h.withFollowUp(ctx, &SlashCommandRequest{ResponseURL: pc.responseURL}, func(ctx context.Context) *SlashCommandResponse {
+			return &SlashCommandResponse{ResponseType: "ephemeral", Text: pc.run(ctx)}
+		})
+		text = resp.Text
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(&model.PostActionIntegrationResponse{
+		Update: &model.Post{Message: text, Props: model.StringInterface{}},
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to encode slash command action response")
+	}
+}
@@ -0,0 +1,76 @@
+package mattermost
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfirmations_Pop(t *testing.T) {
+	var c confirmations
+	confirmationID := c.add(&pendingConfirmation{userID: "user1", expires: time.Now().Add(time.Minute)})
+	assert.Nil(t, c.pop(confirmationID, "user2"), "other users can't use a confirmation")
+	assert.NotNil(t, c.pop(confirmationID, "user1"))
+	assert.Nil(t, c.pop(confirmationID, "user1"), "confirmations can only be used once")
+
+	confirmationID = c.add(&pendingConfirmation{userID: "user1", expires: time.Now().Add(-time.Second)})
+	assert.Nil(t, c.pop(confirmationID, "user1"), "expired confirmations can't be used")
+}
+
+func TestActionURL(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "http://bridge:8081/mattermost/command", nil)
+	assert.Equal(t, "http://bridge:8081/mattermost/action", actionURL(r))
+	r.Header.Set("X-Forwarded-Proto", "https")
+	assert.Equal(t, "https://bridge:8081/mattermost/action", actionURL(r))
+}
+
+// clickButton sends a click on a button of a confirmation to the action endpoint
+func clickButton(t *testing.T, h *SlashCommandHandler, resp *SlashCommandResponse, button int, userID string) string {
+	require.Len(t, resp.Attachments, 1)
+	require.Len(t, resp.Attachments[0].Actions, 2)
+	body, err := json.Marshal(&model.PostActionIntegrationRequest{
+		UserId:  userID,
+		Context: resp.Attachments[0].Actions[button].Integration.Context,
+	})
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	h.ServeAction(rr, httptest.NewRequest(http.MethodPost, slashActionPath, bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var actionResp model.PostActionIntegrationResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&actionResp))
+	require.NotNil(t, actionResp.Update)
+	return actionResp.Update.Message
+}
+
+func TestSlashCommandHandler_Confirm(t *testing.T) {
+	h := NewSlashCommandHandler(&MattermostConnector{Config: &NetworkConfig{}}, "")
+	req := &SlashCommandRequest{UserID: "user1", actionURL: "http://bridge:8081/mattermost/action"}
+	ran := 0
+	run := func(context.Context) string {
+		ran++
+		return "done"
+	}
+
+	resp := h.confirm(req, "Really?", "Do it", run)
+	assert.Equal(t, "http://bridge:8081/mattermost/action", resp.Attachments[0].Actions[0].Integration.URL)
+	assert.Equal(t, "Cancelled.", clickButton(t, h, resp, 1, "user1"))
+	assert.Contains(t, clickButton(t, h, resp, 0, "user1"), "expired")
+	assert.Zero(t, ran)
+
+	resp = h.confirm(req, "Really?", "Do it", run)
+	assert.Contains(t, clickButton(t, h, resp, 0, "user2"), "expired")
+	assert.Equal(t, "done", clickButton(t, h, resp, 0, "user1"))
+	assert.Equal(t, 1, ran)
+
+	resp = h.confirm(&SlashCommandRequest{UserID: "user1"}, "Really?", "Do it", run)
+	assert.Empty(t, resp.Attachments)
+	assert.Contains(t, resp.Text, "isn't available")
+}
@@ -0,0 +1,162 @@
+package mattermost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// unbridgeResponse asks a channel admin to confirm unbridging the current channel
+func (h *SlashCommandHandler) unbridgeResponse(ctx context.Context, req *SlashCommandRequest) *SlashCommandResponse {
+	portal, err := h.Connector.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{ID: networkid.PortalID(req.ChannelID)})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get portal")
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "❌ Failed to get the bridged room of this channel."}
+	} else if portal == nil {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "This channel isn't bridged to Matrix."}
+	} else if !h.isChannelAdmin(ctx, req.UserID, req.ChannelID) {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "❌ Only channel admins can unbridge a channel."}
+	}
+	prompt := "Unbridge this channel from Matrix? Messages will stop being bridged, and the bridge's users leave the Matrix room."
+	if portal.MXID != "" {
+		prompt = fmt.Sprintf("Unbridge this channel from the Matrix room `%s`? Messages will stop being bridged, and the bridge's users leave the room.", portal.MXID)
+	}
+	return h.confirm(req, prompt, "Unbridge", func(ctx context.Context) string {
+		if err := h.unbridgePortal(ctx, portal); err != nil {
+			zerolog.Ctx(ctx).Err(err).Stringer("room_id", portal.MXID).Msg("Failed to unbridge channel")
+			return fmt.Sprintf("❌ Failed to unbridge this channel: %v", err)
+		}
+		zerolog.Ctx(ctx).Info().Stringer("room_id", portal.MXID).Msg("Unbridged channel")
+		return "✅ This channel is no longer bridged to Matrix."
+	})
+}
+
+// unbridgePortal removes the bridge's users from the Matrix room of a portal and deletes
+// the portal. Matrix users stay in the room.
+func (h *SlashCommandHandler) unbridgePortal(ctx context.Context, portal *bridgev2.Portal) error {
+	if portal.MXID != "" {
+		if err := h.Connector.Bridge.Bot.DeleteRoom(ctx, portal.MXID, true); err != nil {
+			return fmt.Errorf("failed to leave Matrix room: %w", err)
+		}
+	}
+	if err := portal.Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete portal: %w", err)
+	}
+	return nil
+}
+
+// stalePortals returns the channel portals whose Mattermost channel was deleted
+func (h *SlashCommandHandler) stalePortals(ctx context.Context) ([]*bridgev2.Portal, error) {
+	dbPortals, err := h.Connector.Bridge.DB.Portal.GetAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get portals: %w", err)
+	}
+	var stale []*bridgev2.Portal
+	for _, dbPortal := range dbPortals {
+		if _, ok := parseCategoryPortalID(dbPortal.ID); ok || dbPortal.RoomType == database.RoomTypeSpace {
+			continue
+		}
+		channel, resp, err := h.Connector.Client.GetChannel(ctx, string(dbPortal.ID), "")
+		if err != nil && responseStatusCode(resp, err) != http.StatusNotFound {
+			return nil, fmt.Errorf("failed to get channel %s: %w", dbPortal.ID, wrapMattermostError(resp, err))
+		} else if err == nil && channel.DeleteAt == 0 {
+			continue
+		}
+		portal, err := h.Connector.Bridge.GetExistingPortalByKey(ctx, dbPortal.PortalKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get portal %s: %w", dbPortal.ID, err)
+		} else if portal != nil {
+			stale = append(stale, portal)
+		}
+	}
+	return stale, nil
+}
+
+// cleanupResponse asks an admin to confirm unbridging the portals of deleted channels
+func (h *SlashCommandHandler) cleanupResponse(ctx context.Context, req *SlashCommandRequest) *SlashCommandResponse {
+	stale, err := h.stalePortals(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to find portals of deleted channels")
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: fmt.Sprintf("❌ Failed to find portals of deleted channels: %v", err)}
+	} else if len(stale) == 0 {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "✅ Every bridged channel still exists, there's nothing to clean up."}
+	}
+	lines := []string{fmt.Sprintf("Unbridge the Matrix rooms of %d deleted channel(s)? The bridge's users leave the rooms.", len(stale)), ""}
+	for i, portal := range stale {
+		if i == maxLookupResults {
+			lines = append(lines, "• _…and more_")
+			break
+		}
+		lines = append(lines, fmt.Sprintf("• %s (`%s`)", portal.Name, portal.MXID))
+	}
+	return h.confirm(req, strings.Join(lines, "\n"), "Clean up", func(ctx context.Context) string {
+		var errs []error
+		for _, portal := range stale {
+			if err := h.unbridgePortal(ctx, portal); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", portal.ID, err))
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to clean up some portals")
+			return fmt.Sprintf("⚠️ Cleaned up %d of %d portals:\n%v", len(stale)-len(errs), len(stale), err)
+		}
+		zerolog.Ctx(ctx).Info().Int("portal_count", len(stale)).Msg("Cleaned up portals of deleted channels")
+		return fmt.Sprintf("✅ Cleaned up %d portal(s) of deleted channels.", len(stale))
+	})
+}
+
+// accountResetResponse asks a user to confirm resetting the password of their Matrix account
+func (h *SlashCommandHandler) accountResetResponse(ctx context.Context, req *SlashCommandRequest) *SlashCommandResponse {
+	admin := h.Connector.MatrixAdmin
+	if admin == nil || h.Connector.usesGhostAccounts() {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         "❌ Homeserver admin API is not configured. Contact your administrator to reset your password.",
+		}
+	} else if h.Connector.ssoAccounts() {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         "Your Matrix account logs in with single sign-on, so it has no password to reset. Manage your password with your identity provider.",
+		}
+	}
+	mmUser, err := h.Connector.getUser(ctx, h.Connector.Client, req.UserID)
+	if err != nil {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: fmt.Sprintf("❌ Failed to get your Mattermost user info: %v", err)}
+	}
+	matrixUserID, exists, err := h.Connector.resolveMatrixAccount(ctx, admin, mmUser)
+	if err != nil {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: fmt.Sprintf("❌ Failed to check Matrix account status: %v", err)}
+	} else if !exists {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         "You don't have a Matrix account yet. Use `/matrix account` to create one.",
+		}
+	}
+	prompt := fmt.Sprintf("Reset the password of your Matrix account `%s`? All your Matrix sessions will be logged out.", matrixUserID)
+	return h.confirm(req, prompt, "Reset password", func(ctx context.Context) string {
+		password, err := GeneratePassword(h.Connector.config().PasswordPolicy)
+		if err != nil {
+			return fmt.Sprintf("❌ Failed to generate a password: %v", err)
+		}
+		if err = admin.ResetPassword(ctx, matrixUserID, password); err != nil {
+			zerolog.Ctx(ctx).Err(err).Stringer("mxid", matrixUserID).Msg("Failed to reset Matrix password")
+			return fmt.Sprintf("❌ Failed to reset your password: %v", err)
+		}
+		zerolog.Ctx(ctx).Info().Stringer("mxid", matrixUserID).Msg("Reset Matrix password")
+		credentials := matrixCredentials("Matrix Password Reset!", matrixUserID, h.Connector.Bridge.Matrix.ServerName(), password)
+		if h.Connector.config().PasswordPolicy.DeliverViaDM {
+			if err = h.Connector.sendBridgeDM(ctx, req.UserID, credentials); err == nil {
+				return "✅ Your Matrix password was reset. The new password was sent to you in a direct message."
+			}
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to send Matrix credentials via DM, showing them in the response instead")
+		}
+		return credentials
+	})
+}
@@ -0,0 +1,88 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// inviteResponse invites a Matrix user into the room bridged to the current channel. The
+// invite is sent by the requesting user's ghost if it's in the room, otherwise by the
+// bridge bot. Portals without a relay get one, so that the messages of the invited user
+// are bridged even if they never log in.
+func (h *SlashCommandHandler) inviteResponse(ctx context.Context, userID, channelID string, args []string) *SlashCommandResponse {
+	if len(args) == 0 {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         "Usage: `/matrix invite <user>` - e.g., `/matrix invite @alice:matrix.org`",
+		}
+	}
+	mxid := id.UserID(args[0])
+	if _, _, err := mxid.Parse(); err != nil {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         "Invalid Matrix user ID. Use the format `@user:server.com`.",
+		}
+	}
+	log := zerolog.Ctx(ctx).With().Stringer("invitee_mxid", mxid).Logger()
+
+	portal, err := h.Connector.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{ID: networkid.PortalID(channelID)})
+	if err != nil {
+		log.Err(err).Msg("Failed to get portal")
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "❌ Failed to get the bridged room of this channel."}
+	} else if portal == nil || portal.MXID == "" {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         "This channel isn't bridged to a Matrix room yet. Use `/matrix join <room>` to bridge one.",
+		}
+	}
+	log = log.With().Stringer("room_id", portal.MXID).Logger()
+
+	if member, err := h.Connector.Bridge.Matrix.GetMemberInfo(ctx, portal.MXID, mxid); err != nil {
+		log.Debug().Err(err).Msg("Failed to get member info of invitee")
+	} else if member != nil && member.Membership == event.MembershipJoin {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: fmt.Sprintf("`%s` is already in the Matrix room of this channel.", mxid)}
+	} else if member != nil && member.Membership == event.MembershipInvite {
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: fmt.Sprintf("`%s` is already invited to the Matrix room of this channel.", mxid)}
+	}
+
+	inviter := h.inviterIntent(ctx, userID, portal.MXID)
+	if err = inviter.InviteUser(ctx, portal.MXID, mxid); err != nil {
+		log.Err(err).Stringer("inviter_mxid", inviter.GetMXID()).Msg("Failed to invite user")
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         fmt.Sprintf("❌ Failed to invite `%s`: %v", mxid, err),
+		}
+	}
+	log.Info().Stringer("inviter_mxid", inviter.GetMXID()).Msg("Invited Matrix user to portal")
+
+	text := fmt.Sprintf("✅ Invited `%s` to the Matrix room of this channel.", mxid)
+	if portal.Relay == nil {
+		if users := h.Connector.GetUsers(); len(users) == 0 {
+			text += "\n\n⚠️ There's no bridge login to relay their messages, they'll only be bridged once they log in."
+		} else if err = portal.SetRelay(ctx, users[0]); err != nil {
+			log.Warn().Err(err).Msg("Failed to set relay for portal")
+			text += "\n\n⚠️ Failed to set up relaying, their messages will only be bridged once they log in."
+		}
+	}
+	return &SlashCommandResponse{ResponseType: "ephemeral", Text: text}
+}
+
+// inviterIntent returns the intent of the ghost of a Mattermost user if it's in a room,
+// otherwise the bridge bot
+func (h *SlashCommandHandler) inviterIntent(ctx context.Context, userID string, roomID id.RoomID) bridgev2.MatrixAPI {
+	ghost, err := h.Connector.Bridge.GetGhostByID(ctx, MakeUserID(userID))
+	if err != nil || ghost == nil || ghost.Intent == nil {
+		return h.Connector.Bridge.Bot
+	}
+	member, err := h.Connector.Bridge.Matrix.GetMemberInfo(ctx, roomID, ghost.Intent.GetMXID())
+	if err != nil || member == nil || member.Membership != event.MembershipJoin {
+		return h.Connector.Bridge.Bot
+	}
+	return ghost.Intent
+}
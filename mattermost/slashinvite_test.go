@@ -0,0 +1,24 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+func TestSlashCommandHandler_Invite(t *testing.T) {
+	ctx := context.Background()
+	handler := NewSlashCommandHandler(&MattermostConnector{
+		Config: &NetworkConfig{},
+		Bridge: &bridgev2.Bridge{DB: newTestBridgeDB(t)},
+	}, "")
+
+	resp := handler.inviteResponse(ctx, "user1", "channel1", nil)
+	assert.Contains(t, resp.Text, "Usage")
+	resp = handler.inviteResponse(ctx, "user1", "channel1", []string{"alice:example.com"})
+	assert.Contains(t, resp.Text, "Invalid Matrix user ID")
+	resp = handler.inviteResponse(ctx, "user1", "channel1", []string{"@alice:example.com"})
+	assert.Contains(t, resp.Text, "isn't bridged")
+}
@@ -0,0 +1,191 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// maxLookupResults limits the lists in whois and search responses, so that they fit in a
+// slash command response
+const maxLookupResults = 20
+
+// whoisResponse shows the Matrix profile of a user, their Mattermost account and the
+// bridged channels the requesting user shares with them
+func (h *SlashCommandHandler) whoisResponse(ctx context.Context, userID string, args []string) *SlashCommandResponse {
+	if len(args) == 0 {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         "Usage: `/matrix whois <user>` - e.g., `/matrix whois @alice:matrix.org`",
+		}
+	}
+	mxid := id.UserID(args[0])
+	if _, _, err := mxid.Parse(); err != nil {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         "Invalid Matrix user ID. Use the format `@user:server.com`.",
+		}
+	}
+	log := zerolog.Ctx(ctx).With().Stringer("target_mxid", mxid).Logger()
+
+	lines := []string{fmt.Sprintf("**Matrix User %s**", mxid), ""}
+	if intent := asIntent(h.Connector.Bridge.Bot); intent == nil {
+		lines = append(lines, "• **Profile**: _not available_")
+	} else if profile, err := intent.GetProfile(ctx, mxid); err != nil {
+		log.Debug().Err(err).Msg("Failed to get Matrix profile")
+		lines = append(lines, "• **Profile**: _not found_")
+	} else {
+		if profile.DisplayName != "" {
+			lines = append(lines, "• **Display name**: "+profile.DisplayName)
+		}
+		if !profile.AvatarURL.IsEmpty() {
+			lines = append(lines, fmt.Sprintf("• **Avatar**: `%s`", profile.AvatarURL))
+		}
+	}
+
+	var mmUserID string
+	if matrixUser, err := h.Connector.MatrixUsers.Get(ctx, "", mxid); err != nil {
+		log.Err(err).Msg("Failed to get Mattermost account of Matrix user")
+	} else if matrixUser != nil && matrixUser.MMUserID != "" {
+		mmUserID = matrixUser.MMUserID
+		if user, err := h.Connector.getUser(ctx, h.Connector.Client, mmUserID); err != nil {
+			log.Debug().Err(err).Msg("Failed to get Mattermost user")
+		} else {
+			lines = append(lines, "• **Mattermost account**: @"+user.Username)
+		}
+	}
+	if mmUserID == "" {
+		lines = append(lines, "• **Mattermost account**: _none yet_")
+	}
+
+	shared, err := h.sharedPortals(ctx, userID, mxid)
+	if err != nil {
+		log.Err(err).Msg("Failed to find shared portals")
+		lines = append(lines, "", "_Failed to list the channels you share._")
+	} else if len(shared) == 0 {
+		lines = append(lines, "", "_You don't share any bridged channels._")
+	} else {
+		lines = append(lines, "", "**Shared channels**")
+		lines = append(lines, shared...)
+	}
+	return &SlashCommandResponse{ResponseType: "ephemeral", Text: strings.Join(lines, "\n")}
+}
+
+// sharedPortals lists the bridged channels of a Mattermost user whose Matrix room the
+// Matrix user is in
+func (h *SlashCommandHandler) sharedPortals(ctx context.Context, userID string, mxid id.UserID) ([]string, error) {
+	channels, resp, err := h.Connector.Client.GetChannelsForUserWithLastDeleteAt(ctx, userID, 0)
+	if err != nil {
+		return nil, wrapMattermostError(resp, err)
+	}
+	var lines []string
+	for _, channel := range channels {
+		portal, err := h.Connector.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{ID: networkid.PortalID(channel.Id)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get portal: %w", err)
+		} else if portal == nil || portal.MXID == "" {
+			continue
+		}
+		member, err := h.Connector.Bridge.Matrix.GetMemberInfo(ctx, portal.MXID, mxid)
+		if err != nil {
+			zerolog.Ctx(ctx).Debug().Err(err).Stringer("room_id", portal.MXID).Msg("Failed to get member info")
+			continue
+		} else if member == nil || member.Membership != event.MembershipJoin {
+			continue
+		}
+		if len(lines) == maxLookupResults {
+			lines = append(lines, "• _…and more_")
+			break
+		}
+		lines = append(lines, formatPortalLine(channel, portal.Portal))
+	}
+	return lines, nil
+}
+
+// searchResponse lists the bridged channels whose name, topic, channel ID or room ID
+// contain the query. Private channels are only listed to their members.
+func (h *SlashCommandHandler) searchResponse(ctx context.Context, userID string, args []string) *SlashCommandResponse {
+	query := strings.ToLower(strings.Join(args, " "))
+	if query == "" {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         "Usage: `/matrix search <text>` - e.g., `/matrix search general`",
+		}
+	}
+	portals, err := h.Connector.Bridge.DB.Portal.GetAllWithMXID(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get portals")
+		return &SlashCommandResponse{ResponseType: "ephemeral", Text: "❌ Failed to search bridged channels."}
+	}
+	memberOf := make(map[string]*model.Channel)
+	if channels, resp, err := h.Connector.Client.GetChannelsForUserWithLastDeleteAt(ctx, userID, 0); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(wrapMattermostError(resp, err)).Msg("Failed to get channels of user")
+	} else {
+		for _, channel := range channels {
+			memberOf[channel.Id] = channel
+		}
+	}
+
+	var lines []string
+	for _, portal := range portals {
+		if !portalMatches(portal, query) {
+			continue
+		}
+		channel, ok := memberOf[string(portal.ID)]
+		if !ok {
+			var resp *model.Response
+			channel, resp, err = h.Connector.Client.GetChannel(ctx, string(portal.ID), "")
+			if err != nil {
+				zerolog.Ctx(ctx).Debug().Err(wrapMattermostError(resp, err)).Str("channel_id", string(portal.ID)).Msg("Failed to get channel of portal")
+				continue
+			} else if channel.Type != model.ChannelTypeOpen {
+				continue
+			}
+		}
+		if len(lines) == maxLookupResults {
+			lines = append(lines, "• _…and more, try a longer query_")
+			break
+		}
+		lines = append(lines, formatPortalLine(channel, portal))
+	}
+	if len(lines) == 0 {
+		return &SlashCommandResponse{
+			ResponseType: "ephemeral",
+			Text:         fmt.Sprintf("No bridged channels match `%s`.", query),
+		}
+	}
+	lines = append([]string{fmt.Sprintf("**Bridged channels matching `%s`**", query), ""}, lines...)
+	return &SlashCommandResponse{ResponseType: "ephemeral", Text: strings.Join(lines, "\n")}
+}
+
+// portalMatches checks whether a channel portal matches a lowercase search query
+func portalMatches(portal *database.Portal, query string) bool {
+	if _, ok := parseCategoryPortalID(portal.ID); ok || portal.RoomType == database.RoomTypeSpace {
+		return false
+	}
+	for _, field := range []string{portal.Name, portal.Topic, string(portal.ID), string(portal.MXID)} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatPortalLine formats a bridged channel and its Matrix room as a list item
+func formatPortalLine(channel *model.Channel, portal *database.Portal) string {
+	name := channel.DisplayName
+	if name == "" {
+		name = portal.Name
+	}
+	if channel.Name != "" && channel.Type != model.ChannelTypeDirect && channel.Type != model.ChannelTypeGroup {
+		name = fmt.Sprintf("%s (~%s)", name, channel.Name)
+	}
+	return fmt.Sprintf("• %s ↔ [%s](%s)", name, portal.MXID, portal.MXID.URI().MatrixToURL())
+}
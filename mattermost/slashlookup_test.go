@@ -0,0 +1,92 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestPortalMatches(t *testing.T) {
+	portal := &database.Portal{
+		PortalKey: networkid.PortalKey{ID: "channel1"},
+		MXID:      "!room1:example.com",
+		Name:      "Town Square",
+		Topic:     "General chatter",
+	}
+	assert.True(t, portalMatches(portal, "town"))
+	assert.True(t, portalMatches(portal, "chatter"))
+	assert.True(t, portalMatches(portal, "!room1"))
+	assert.False(t, portalMatches(portal, "random"))
+
+	portal.RoomType = database.RoomTypeSpace
+	assert.False(t, portalMatches(portal, "town"))
+}
+
+func TestFormatPortalLine(t *testing.T) {
+	portal := &database.Portal{MXID: "!room1:example.com", Name: "Town Square"}
+	line := formatPortalLine(&model.Channel{Name: "town-square", DisplayName: "Town Square", Type: model.ChannelTypeOpen}, portal)
+	assert.Equal(t, "• Town Square (~town-square) ↔ [!room1:example.com](https://matrix.to/#/%21room1:example.com)", line)
+
+	line = formatPortalLine(&model.Channel{Name: "user1__user2", Type: model.ChannelTypeDirect}, portal)
+	assert.Equal(t, "• Town Square ↔ [!room1:example.com](https://matrix.to/#/%21room1:example.com)", line)
+}
+
+func TestSlashCommandHandler_Search(t *testing.T) {
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+	for _, portal := range []*database.Portal{
+		{PortalKey: networkid.PortalKey{ID: "joined"}, MXID: "!joined:example.com", Name: "Design Private"},
+		{PortalKey: networkid.PortalKey{ID: "public"}, MXID: "!public:example.com", Name: "Design Public"},
+		{PortalKey: networkid.PortalKey{ID: "secret"}, MXID: "!secret:example.com", Name: "Design Secret"},
+		{PortalKey: networkid.PortalKey{ID: "other"}, MXID: "!other:example.com", Name: "Random"},
+	} {
+		require.NoError(t, bridgeDB.Portal.Insert(ctx, portal))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/users/user1/channels":
+			_ = json.NewEncoder(w).Encode([]*model.Channel{{Id: "joined", Name: "design-private", DisplayName: "Design Private", Type: model.ChannelTypePrivate}})
+		case "/api/v4/channels/public":
+			_ = json.NewEncoder(w).Encode(&model.Channel{Id: "public", Name: "design-public", DisplayName: "Design Public", Type: model.ChannelTypeOpen})
+		case "/api/v4/channels/secret":
+			_ = json.NewEncoder(w).Encode(&model.Channel{Id: "secret", Name: "design-secret", DisplayName: "Design Secret", Type: model.ChannelTypePrivate})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(&model.AppError{Id: "app.channel.get.existing.app_error", StatusCode: http.StatusNotFound})
+		}
+	}))
+	t.Cleanup(server.Close)
+	handler := NewSlashCommandHandler(&MattermostConnector{
+		Config: &NetworkConfig{},
+		Client: NewClient(server.URL, "token"),
+		Bridge: &bridgev2.Bridge{DB: bridgeDB},
+	}, "")
+
+	resp := handler.searchResponse(ctx, "user1", []string{"Design"})
+	assert.Contains(t, resp.Text, "~design-private")
+	assert.Contains(t, resp.Text, "~design-public")
+	assert.NotContains(t, resp.Text, "design-secret", "private channels are only listed to members")
+	assert.NotContains(t, resp.Text, "!other")
+
+	resp = handler.searchResponse(ctx, "user1", []string{"nothing"})
+	assert.Contains(t, resp.Text, "No bridged channels match")
+	resp = handler.searchResponse(ctx, "user1", nil)
+	assert.Contains(t, resp.Text, "Usage")
+}
+
+func TestSlashCommandHandler_WhoisInvalid(t *testing.T) {
+	handler := NewSlashCommandHandler(&MattermostConnector{Config: &NetworkConfig{}}, "")
+	resp := handler.whoisResponse(context.Background(), "user1", nil)
+	assert.Contains(t, resp.Text, "Usage")
+	resp = handler.whoisResponse(context.Background(), "user1", []string{"alice"})
+	assert.Contains(t, resp.Text, "Invalid Matrix user ID")
+}
@@ -0,0 +1,77 @@
+package mattermost
+
+import (
+	"fmt"
+)
+
+// Operators running one bridge against several teams or installations can give each of them
+// its own /matrix slash command integration with slash_command_teams. Requests from a listed
+// team are checked against the token of its integration, and responses use its username and
+// icon. Requests from other teams are checked against slash_command_token, and rejected if
+// only per-team tokens are configured.
+
+// SlashCommandTeam is the slash command integration of one team
+type SlashCommandTeam struct {
+	// Team is the ID or name of the team
+	Team      string `yaml:"team"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	// Username and IconURL override the name and picture responses are posted with, which
+	// needs integrations to be allowed to override them
+	Username string `yaml:"username"`
+	IconURL  string `yaml:"icon_url"`
+}
+
+// validateSlashCommandTeams checks that every team has one integration with a token
+func validateSlashCommandTeams(teams []SlashCommandTeam) error {
+	seen := make(map[string]bool, len(teams))
+	for i, team := range teams {
+		if team.Team == "" {
+			return fmt.Errorf("slash_command_teams[%d] has no team", i)
+		} else if team.Token == "" {
+			return fmt.Errorf("slash_command_teams[%d] (%s) has no token", i, team.Team)
+		} else if seen[team.Team] {
+			return fmt.Errorf("slash_command_teams has team %s more than once", team.Team)
+		}
+		seen[team.Team] = true
+	}
+	return nil
+}
+
+// teamFor returns the integration of the team a request comes from, or nil if it isn't listed
+func (h *SlashCommandHandler) teamFor(req *SlashCommandRequest) *SlashCommandTeam {
+	for i, team := range h.Teams {
+		if team.Team == req.TeamID || (req.TeamDomain != "" && team.Team == req.TeamDomain) {
+			return &h.Teams[i]
+		}
+	}
+	return nil
+}
+
+// expectedToken returns the token a request must have, or an empty string if its token
+// isn't checked
+func (h *SlashCommandHandler) expectedToken(req *SlashCommandRequest) string {
+	if team := h.teamFor(req); team != nil {
+		return team.Token
+	}
+	return h.Token
+}
+
+// verifyToken checks the token of a request against the integration of its team
+func (h *SlashCommandHandler) verifyToken(req *SlashCommandRequest) bool {
+	token := h.expectedToken(req)
+	if token == "" {
+		return len(h.Teams) == 0
+	}
+	return req.Token == token
+}
+
+// applyTeamResponse sets the response settings of the integration a request came from
+func (h *SlashCommandHandler) applyTeamResponse(req *SlashCommandRequest, resp *SlashCommandResponse) {
+	team := h.teamFor(req)
+	if team == nil || resp == nil {
+		return
+	}
+	resp.Username = team.Username
+	resp.IconURL = team.IconURL
+}
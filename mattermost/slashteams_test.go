@@ -0,0 +1,54 @@
+package mattermost
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateSlashCommandTeams(t *testing.T) {
+	assert.NoError(t, validateSlashCommandTeams(nil))
+	assert.NoError(t, validateSlashCommandTeams([]SlashCommandTeam{{Team: "eng", Token: "a"}, {Team: "sales", Token: "b"}}))
+	assert.Error(t, validateSlashCommandTeams([]SlashCommandTeam{{Token: "a"}}))
+	assert.Error(t, validateSlashCommandTeams([]SlashCommandTeam{{Team: "eng"}}))
+	assert.Error(t, validateSlashCommandTeams([]SlashCommandTeam{{Team: "eng", Token: "a"}, {Team: "eng", Token: "b"}}))
+}
+
+func TestSlashCommandHandler_TeamTokens(t *testing.T) {
+	handler := NewSlashCommandHandler(&MattermostConnector{Config: &NetworkConfig{}}, "")
+	handler.Teams = []SlashCommandTeam{
+		{Team: "team1", Token: "token1", Username: "Matrix", IconURL: "https://example.com/icon.png"},
+		{Team: "sales", Token: "token2"},
+	}
+	command := func(teamID, teamDomain, token string) *httptest.ResponseRecorder {
+		form := url.Values{"team_id": {teamID}, "team_domain": {teamDomain}, "token": {token}, "text": {"help"}}
+		req := httptest.NewRequest(http.MethodPost, "/mattermost/command", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := command("team1", "eng", "token1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var resp SlashCommandResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, "Matrix", resp.Username)
+	assert.Equal(t, "https://example.com/icon.png", resp.IconURL)
+
+	// Tokens are checked against the integration of the team, found by ID or name
+	assert.Equal(t, http.StatusUnauthorized, command("team1", "eng", "token2").Code)
+	assert.Equal(t, http.StatusOK, command("team2", "sales", "token2").Code)
+	// Teams without an integration are rejected when there's no global token
+	assert.Equal(t, http.StatusUnauthorized, command("team3", "support", "").Code)
+
+	handler.Token = "global"
+	assert.Equal(t, http.StatusOK, command("team3", "support", "global").Code)
+	assert.Equal(t, http.StatusUnauthorized, command("team3", "support", "token1").Code)
+}
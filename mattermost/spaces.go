@@ -0,0 +1,65 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+// teamAvatar returns the avatar of a team space on a server. The ID
+// changes with LastTeamIconUpdate, so the space avatar is only reuploaded when the icon
+// changed, and it's removed when the team has no icon anymore.
+func (m *MattermostConnector) teamAvatar(server string, team *model.Team) *bridgev2.Avatar {
+	// LastTeamIconUpdate > 0 means an icon exists
+	if team.LastTeamIconUpdate <= 0 {
+		return &bridgev2.Avatar{Remove: true}
+	}
+	teamID := team.Id
+	return &bridgev2.Avatar{
+		ID: networkid.AvatarID(fmt.Sprintf("team-%s-%d", teamID, team.LastTeamIconUpdate)),
+		Get: func(ctx context.Context) ([]byte, error) {
+			return m.serverClient(server).GetTeamIcon(ctx, teamID)
+		},
+	}
+}
+
+// ensureInSpace adds a channel room to its team space if it isn't there yet. The bridge
+// does this when creating rooms, but rooms created before their space existed, or while
+// the space couldn't be updated, are left outside of it.
+func (s *SyncEngine) ensureInSpace(ctx context.Context, portal *bridgev2.Portal) error {
+	if portal.MXID == "" || portal.ParentID == "" || portal.InSpace {
+		return nil
+	}
+	parent, err := s.Connector.Bridge.GetExistingPortalByKey(ctx, networkid.PortalKey{ID: portal.ParentID})
+	if err != nil {
+		return fmt.Errorf("failed to get parent portal: %w", err)
+	} else if parent == nil || parent.MXID == "" {
+		return nil
+	}
+
+	via := []string{s.Connector.Bridge.Matrix.ServerName()}
+	_, err = s.Connector.Bridge.Bot.SendState(ctx, parent.MXID, event.StateSpaceChild, portal.MXID.String(), &event.Content{
+		Parsed: &event.SpaceChildEventContent{Via: via},
+	}, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to add room to space: %w", err)
+	}
+	_, err = s.Connector.Bridge.Bot.SendState(ctx, portal.MXID, event.StateSpaceParent, parent.MXID.String(), &event.Content{
+		Parsed: &event.SpaceParentEventContent{Via: via, Canonical: true},
+	}, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to set space parent: %w", err)
+	}
+
+	portal.InSpace = true
+	if err = portal.Save(ctx); err != nil {
+		return fmt.Errorf("failed to save portal: %w", err)
+	}
+	s.log.Debug().Str("channel_id", string(portal.ID)).Stringer("space_mxid", parent.MXID).Msg("Added room to team space")
+	return nil
+}
@@ -0,0 +1,80 @@
+package mattermost
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+func TestChannelParentID(t *testing.T) {
+	tests := []struct {
+		name     string
+		channel  *model.Channel
+		expected networkid.PortalID
+	}{
+		{"public channel", &model.Channel{TeamId: "team1", Type: model.ChannelTypeOpen}, "team1"},
+		{"private channel", &model.Channel{TeamId: "team1", Type: model.ChannelTypePrivate}, "team1"},
+		{"direct message", &model.Channel{Type: model.ChannelTypeDirect}, ""},
+		{"group message", &model.Channel{Type: model.ChannelTypeGroup}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parentID := (&MattermostConnector{}).channelParentID(tt.channel)
+			if tt.expected == "" {
+				assert.Nil(t, parentID)
+			} else {
+				require.NotNil(t, parentID)
+				assert.Equal(t, tt.expected, *parentID)
+			}
+		})
+	}
+}
+
+func TestChannelSyncEvent_MovedChannelChangesParent(t *testing.T) {
+	evt := &ChannelSyncEvent{Channel: &model.Channel{Id: "channel1", TeamId: "team2", Type: model.ChannelTypeOpen}}
+
+	change, err := evt.GetChatInfoChange(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, change.ChatInfo.ParentID)
+	assert.Equal(t, networkid.PortalID("team2"), *change.ChatInfo.ParentID)
+}
+
+func TestTeamAvatar(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/teams/team1/image" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("icon"))
+	}))
+	defer server.Close()
+	m := &MattermostConnector{Client: NewClient(server.URL, "token")}
+
+	// Teams without an icon remove the space avatar
+	avatar := m.teamAvatar("", &model.Team{Id: "team1"})
+	require.NotNil(t, avatar)
+	assert.True(t, avatar.Remove)
+
+	avatar = m.teamAvatar("", &model.Team{Id: "team1", LastTeamIconUpdate: 1234})
+	require.NotNil(t, avatar)
+	assert.Equal(t, networkid.AvatarID("team-team1-1234"), avatar.ID)
+	data, err := avatar.Get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []byte("icon"), data)
+}
+
+func TestSyncEvents_ShouldCreatePortal(t *testing.T) {
+	mirror := &MattermostConnector{Config: &NetworkConfig{Mode: ModeMirror}}
+	puppet := &MattermostConnector{Config: &NetworkConfig{Mode: ModePuppet}}
+
+	assert.True(t, (&TeamSyncEvent{MattermostEvent: MattermostEvent{Connector: mirror}}).ShouldCreatePortal())
+	assert.True(t, (&ChannelSyncEvent{MattermostEvent: MattermostEvent{Connector: mirror}}).ShouldCreatePortal())
+	assert.False(t, (&TeamSyncEvent{MattermostEvent: MattermostEvent{Connector: puppet}}).ShouldCreatePortal())
+	assert.False(t, (&ChannelSyncEvent{MattermostEvent: MattermostEvent{Connector: puppet}}).ShouldCreatePortal())
+}
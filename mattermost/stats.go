@@ -0,0 +1,324 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+// With stats.enabled, the bridge counts the messages it bridges in each direction per day
+// in its own database, for capacity planning without external analytics. Nothing leaves the
+// bridge: the counts are shown by the stats command and the stats endpoint of the
+// provisioning API, both limited to bridge admins.
+
+// StatsConfig configures the usage stats
+type StatsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Days is the number of days the daily counts are kept
+	Days int `yaml:"days"`
+}
+
+const (
+	defaultStatsDays = 90
+	// statsFlushInterval is how often the counts are written to the database
+	statsFlushInterval = time.Minute
+	// statsPath is the path of the stats endpoint under the provisioning API prefix
+	statsPath = "/mattermost/stats"
+	// statsDayFormat is how days are stored
+	statsDayFormat = "2006-01-02"
+)
+
+// Directions of bridged messages
+const (
+	StatsFromMattermost = "from_mattermost"
+	StatsFromMatrix     = "from_matrix"
+)
+
+func (c *StatsConfig) days() int {
+	if c.Days > 0 {
+		return c.Days
+	}
+	return defaultStatsDays
+}
+
+var statsUpgrades dbutil.UpgradeTable
+
+func init() {
+	statsUpgrades.Register(-1, 1, 0, "Create Mattermost stats table", dbutil.TxnModeOn, func(ctx context.Context, db *dbutil.Database) error {
+		_, err := db.Exec(ctx, `
+			CREATE TABLE mattermost_stats (
+				bridge_id TEXT   NOT NULL,
+				day       TEXT   NOT NULL,
+				direction TEXT   NOT NULL,
+				messages  BIGINT NOT NULL,
+
+				PRIMARY KEY (bridge_id, day, direction)
+			)
+		`)
+		return err
+	})
+}
+
+// DailyStats is the number of messages bridged in each direction on a day
+type DailyStats struct {
+	Day            string `json:"day"`
+	FromMattermost int64  `json:"from_mattermost"`
+	FromMatrix     int64  `json:"from_matrix"`
+}
+
+// StatsStore stores the daily message counts
+type StatsStore struct {
+	bridgeID networkid.BridgeID
+	db       *dbutil.Database
+}
+
+// NewStatsStore creates a stats store in the given database
+func NewStatsStore(bridgeID networkid.BridgeID, db *dbutil.Database) *StatsStore {
+	return &StatsStore{
+		bridgeID: bridgeID,
+		db:       db.Child("mattermost_stats_version", statsUpgrades, nil),
+	}
+}
+
+// Upgrade creates the table if needed
+func (s *StatsStore) Upgrade(ctx context.Context) error {
+	return s.db.Upgrade(ctx)
+}
+
+// AddMessages adds to the count of messages bridged in a direction on a day
+func (s *StatsStore) AddMessages(ctx context.Context, day, direction string, count int64) error {
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO mattermost_stats (bridge_id, day, direction, messages)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (bridge_id, day, direction) DO UPDATE SET messages=mattermost_stats.messages+excluded.messages
+	`, s.bridgeID, day, direction, count)
+	return err
+}
+
+// GetDaily returns the counts of the days since the given one, oldest first
+func (s *StatsStore) GetDaily(ctx context.Context, since string) ([]*DailyStats, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT day, direction, messages FROM mattermost_stats WHERE bridge_id=$1 AND day>=$2 ORDER BY day
+	`, s.bridgeID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var days []*DailyStats
+	for rows.Next() {
+		var day, direction string
+		var messages int64
+		if err = rows.Scan(&day, &direction, &messages); err != nil {
+			return nil, err
+		}
+		if len(days) == 0 || days[len(days)-1].Day != day {
+			days = append(days, &DailyStats{Day: day})
+		}
+		switch direction {
+		case StatsFromMattermost:
+			days[len(days)-1].FromMattermost = messages
+		case StatsFromMatrix:
+			days[len(days)-1].FromMatrix = messages
+		}
+	}
+	return days, rows.Err()
+}
+
+// DeleteBefore removes the counts of the days before the given one
+func (s *StatsStore) DeleteBefore(ctx context.Context, day string) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM mattermost_stats WHERE bridge_id=$1 AND day<$2", s.bridgeID, day)
+	return err
+}
+
+// statsKey is a day and direction messages are counted for
+type statsKey struct {
+	day       string
+	direction string
+}
+
+// statsCounter counts bridged messages in memory until they're written to the database.
+// The zero value is ready to use.
+type statsCounter struct {
+	lock   sync.Mutex
+	counts map[statsKey]int64
+}
+
+func (c *statsCounter) add(key statsKey, count int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[statsKey]int64)
+	}
+	c.counts[key] += count
+}
+
+// take returns the counts and resets them
+func (c *statsCounter) take() map[statsKey]int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counts := c.counts
+	c.counts = nil
+	return counts
+}
+
+// countMessage counts a message bridged in a direction
+func (m *MattermostConnector) countMessage(direction string) {
+	if m.Stats == nil {
+		return
+	}
+	m.statsCounter.add(statsKey{time.Now().UTC().Format(statsDayFormat), direction}, 1)
+}
+
+// flushStats writes the counted messages to the database. Counts that fail to be written
+// are kept for the next flush.
+func (m *MattermostConnector) flushStats(ctx context.Context) error {
+	var firstErr error
+	for key, count := range m.statsCounter.take() {
+		if err := m.Stats.AddMessages(ctx, key.day, key.direction, count); err != nil {
+			m.statsCounter.add(key, count)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to save message counts: %w", err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// runStats writes the counted messages to the database every minute and removes the old
+// days until the context is canceled
+func (m *MattermostConnector) runStats(ctx context.Context) {
+	if m.Stats == nil {
+		return
+	}
+	log := m.moduleLog(LogModuleConnector).With().Str("action", "stats").Logger()
+	ctx = log.WithContext(ctx)
+	ticker := time.NewTicker(statsFlushInterval)
+	defer ticker.Stop()
+	lastCleanup := ""
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			if err := m.flushStats(flushCtx); err != nil {
+				log.Err(err).Msg("Failed to save stats on shutdown")
+			}
+			cancel()
+			return
+		case <-ticker.C:
+		}
+		if err := m.flushStats(ctx); err != nil {
+			log.Err(err).Msg("Failed to save stats")
+		}
+		if today := time.Now().UTC().Format(statsDayFormat); today != lastCleanup && m.ownsGlobalTasks() {
+			lastCleanup = today
+			cutoff := time.Now().UTC().AddDate(0, 0, -m.config().Stats.days()).Format(statsDayFormat)
+			if err := m.Stats.DeleteBefore(ctx, cutoff); err != nil {
+				log.Err(err).Msg("Failed to remove old stats")
+			}
+		}
+	}
+}
+
+// UsageStats is the report of the stats command and endpoint
+type UsageStats struct {
+	ActiveLogins  int           `json:"active_logins"`
+	ActivePortals int           `json:"active_portals"`
+	Days          []*DailyStats `json:"days"`
+}
+
+// String renders the report for the stats command
+func (s *UsageStats) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "**Active logins:** %d  \n**Active portals:** %d\n\n", s.ActiveLogins, s.ActivePortals)
+	if len(s.Days) == 0 {
+		sb.WriteString("No messages bridged yet")
+		return sb.String()
+	}
+	sb.WriteString("| Day | From Mattermost | From Matrix |\n|---|---|---|\n")
+	for _, day := range s.Days {
+		fmt.Fprintf(&sb, "| %s | %d | %d |\n", day.Day, day.FromMattermost, day.FromMatrix)
+	}
+	return sb.String()
+}
+
+// GetUsageStats returns the active logins and portals and the message counts of the last days
+func (m *MattermostConnector) GetUsageStats(ctx context.Context, days int) (*UsageStats, error) {
+	if err := m.flushStats(ctx); err != nil {
+		return nil, err
+	}
+	stats := &UsageStats{ActiveLogins: len(m.GetUsers())}
+	err := m.Bridge.DB.QueryRow(ctx, "SELECT COUNT(*) FROM portal WHERE bridge_id=$1 AND mxid IS NOT NULL", m.Bridge.ID).
+		Scan(&stats.ActivePortals)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count portals: %w", err)
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Format(statsDayFormat)
+	if stats.Days, err = m.Stats.GetDaily(ctx, since); err != nil {
+		return nil, fmt.Errorf("failed to get message counts: %w", err)
+	}
+	return stats, nil
+}
+
+// cmdStats shows the usage stats of the bridge
+func (m *MattermostConnector) cmdStats() *commands.FullHandler {
+	return &commands.FullHandler{
+		Func: func(ce *commands.Event) {
+			stats, err := m.GetUsageStats(ce.Ctx, 7)
+			if err != nil {
+				ce.Reply("Failed to get stats: %v", err)
+				return
+			}
+			ce.Reply(stats.String())
+		},
+		Name: "stats",
+		Help: commands.HelpMeta{
+			Section:     commands.HelpSectionAdmin,
+			Description: "Show the active logins and portals and the messages bridged in the last week",
+		},
+		RequiresAdmin: true,
+	}
+}
+
+// registerStatsEndpoint adds the stats endpoint to the provisioning API. It uses the
+// provisioning API's authentication, and only bridge admins may call it.
+func (m *MattermostConnector) registerStatsEndpoint() {
+	prov, ok := m.Bridge.Matrix.(provisioningConnector)
+	if m.Stats == nil || !ok || prov.GetProvisioning() == nil || prov.GetProvisioning().GetRouter() == nil {
+		return
+	}
+	api := prov.GetProvisioning()
+	api.GetRouter().HandleFunc(statsPath, func(w http.ResponseWriter, r *http.Request) {
+		m.handleStats(w, r, api)
+	}).Methods(http.MethodGet)
+}
+
+func (m *MattermostConnector) handleStats(w http.ResponseWriter, r *http.Request, api matrix.IProvisioningAPI) {
+	w.Header().Set("Content-Type", "application/json")
+	if user := api.GetUser(r); user == nil || !user.Permissions.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(&mautrix.RespError{ErrCode: mautrix.MForbidden.ErrCode, Err: "Only bridge admins can see stats"})
+		return
+	}
+	days := m.config().Stats.days()
+	if n, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && n > 0 {
+		days = n
+	}
+	stats, err := m.GetUsageStats(r.Context(), days)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(&mautrix.RespError{ErrCode: "M_UNKNOWN", Err: err.Error()})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,54 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewStatsStore("mattermost", newTestBridgeDB(t).Database)
+	require.NoError(t, store.Upgrade(ctx))
+
+	require.NoError(t, store.AddMessages(ctx, "2026-01-01", StatsFromMattermost, 3))
+	require.NoError(t, store.AddMessages(ctx, "2026-01-02", StatsFromMattermost, 1))
+	require.NoError(t, store.AddMessages(ctx, "2026-01-02", StatsFromMatrix, 2))
+	require.NoError(t, store.AddMessages(ctx, "2026-01-02", StatsFromMattermost, 4))
+
+	days, err := store.GetDaily(ctx, "2026-01-01")
+	require.NoError(t, err)
+	assert.Equal(t, []*DailyStats{
+		{Day: "2026-01-01", FromMattermost: 3},
+		{Day: "2026-01-02", FromMattermost: 5, FromMatrix: 2},
+	}, days)
+
+	require.NoError(t, store.DeleteBefore(ctx, "2026-01-02"))
+	days, err = store.GetDaily(ctx, "2026-01-01")
+	require.NoError(t, err)
+	assert.Len(t, days, 1)
+}
+
+func TestFlushStats(t *testing.T) {
+	ctx := context.Background()
+	m := &MattermostConnector{}
+	// Messages aren't counted when stats are disabled
+	m.countMessage(StatsFromMatrix)
+	assert.Nil(t, m.statsCounter.take())
+
+	m.Stats = NewStatsStore("mattermost", newTestBridgeDB(t).Database)
+	require.NoError(t, m.Stats.Upgrade(ctx))
+	m.countMessage(StatsFromMatrix)
+	m.countMessage(StatsFromMatrix)
+	m.countMessage(StatsFromMattermost)
+	require.NoError(t, m.flushStats(ctx))
+	assert.Nil(t, m.statsCounter.take())
+
+	days, err := m.Stats.GetDaily(ctx, "2000-01-01")
+	require.NoError(t, err)
+	require.Len(t, days, 1)
+	assert.EqualValues(t, 1, days[0].FromMattermost)
+	assert.EqualValues(t, 2, days[0].FromMatrix)
+}
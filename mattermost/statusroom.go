@@ -0,0 +1,118 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// With status_room set, the bridge bot posts operational notices to that room: the bridge
+// starting and stopping, sync progress, WebSocket disconnects, rate limits and messages
+// that couldn't be delivered, so that operators don't have to watch the logs. Notices that
+// can repeat quickly, like disconnects of a flapping WebSocket, are throttled per key.
+
+// statusNoticeInterval is how often a throttled notice is sent at most
+const statusNoticeInterval = 10 * time.Minute
+
+// Keys of the throttled status notices
+const (
+	statusKeyWebSocket = "websocket"
+	statusKeyRateLimit = "rate_limit"
+)
+
+// statusRoom resolves the status room and remembers when throttled notices were sent
+type statusRoom struct {
+	lock sync.Mutex
+	// alias is the room alias roomID was resolved from
+	alias    string
+	roomID   id.RoomID
+	lastSent map[string]time.Time
+}
+
+// allow checks whether a notice with the given key may be sent now, and records it as
+// sent if so. Notices without a key are always allowed.
+func (s *statusRoom) allow(key string, now time.Time) bool {
+	if key == "" {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if last, ok := s.lastSent[key]; ok && now.Sub(last) < statusNoticeInterval {
+		return false
+	}
+	if s.lastSent == nil {
+		s.lastSent = make(map[string]time.Time)
+	}
+	s.lastSent[key] = now
+	return true
+}
+
+// statusRoomID returns the ID of the status room, resolving the alias in the config if needed
+func (m *MattermostConnector) statusRoomID(ctx context.Context) (id.RoomID, error) {
+	room := strings.TrimSpace(m.config().StatusRoom)
+	if !strings.HasPrefix(room, "#") {
+		return id.RoomID(room), nil
+	}
+	m.statusRoom.lock.Lock()
+	defer m.statusRoom.lock.Unlock()
+	if m.statusRoom.alias == room {
+		return m.statusRoom.roomID, nil
+	}
+	intent := asIntent(m.Bridge.Bot)
+	if intent == nil {
+		return "", fmt.Errorf("bridge bot is not an appservice intent")
+	}
+	resp, err := intent.ResolveAlias(ctx, id.RoomAlias(room))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", room, err)
+	}
+	m.statusRoom.alias, m.statusRoom.roomID = room, resp.RoomID
+	return resp.RoomID, nil
+}
+
+// notifyStatus posts a notice to the status room, if one is configured. Notices with a key
+// are sent at most once per statusNoticeInterval. Failures are only logged.
+func (m *MattermostConnector) notifyStatus(ctx context.Context, key, format string, args ...any) {
+	if m.config() == nil || m.config().StatusRoom == "" || m.Bridge == nil || m.Bridge.Bot == nil {
+		return
+	} else if !m.statusRoom.allow(key, time.Now()) {
+		return
+	}
+	log := m.moduleLog(LogModuleConnector)
+	roomID, err := m.statusRoomID(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to find status room")
+		return
+	}
+	if err = m.Bridge.Bot.EnsureJoined(ctx, roomID); err != nil {
+		log.Warn().Err(err).Stringer("room_id", roomID).Msg("Failed to join status room")
+		return
+	}
+	_, err = m.Bridge.Bot.SendMessage(ctx, roomID, event.EventMessage, &event.Content{
+		Parsed: &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf(format, args...),
+		},
+	}, nil)
+	if err != nil {
+		log.Warn().Err(err).Stringer("room_id", roomID).Msg("Failed to send status notice")
+	}
+}
+
+// notifyStatusAsync posts a notice to the status room without waiting for it, for code
+// paths that shouldn't be slowed down by Matrix
+func (m *MattermostConnector) notifyStatusAsync(key, format string, args ...any) {
+	if m.config() == nil || m.config().StatusRoom == "" {
+		return
+	}
+	ctx := m.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	go m.notifyStatus(context.WithoutCancel(ctx), key, format, args...)
+}
@@ -0,0 +1,37 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusRoom_Allow(t *testing.T) {
+	var room statusRoom
+	now := time.Now()
+	assert.True(t, room.allow(statusKeyWebSocket, now))
+	assert.False(t, room.allow(statusKeyWebSocket, now.Add(time.Minute)))
+	// Other keys and notices without a key aren't throttled
+	assert.True(t, room.allow(statusKeyRateLimit, now.Add(time.Minute)))
+	assert.True(t, room.allow("", now.Add(time.Minute)))
+	assert.True(t, room.allow("", now.Add(time.Minute)))
+	assert.True(t, room.allow(statusKeyWebSocket, now.Add(statusNoticeInterval)))
+}
+
+func TestStatusRoomID(t *testing.T) {
+	m := &MattermostConnector{Config: &NetworkConfig{StatusRoom: " !status:example.com "}}
+	roomID, err := m.statusRoomID(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, "!status:example.com", roomID)
+}
+
+func TestNotifyStatus_Disabled(t *testing.T) {
+	m := &MattermostConnector{Config: &NetworkConfig{}}
+	// Without a status room nothing is sent or throttled
+	m.notifyStatus(context.Background(), statusKeyWebSocket, "disconnected")
+	m.notifyStatusAsync(statusKeyWebSocket, "disconnected")
+	assert.Empty(t, m.statusRoom.lastSent)
+}
@@ -2,30 +2,51 @@ package mattermost
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
 	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 )
 
 // SyncEngine handles full server synchronization in mirror mode
 type SyncEngine struct {
 	Connector *MattermostConnector
+	log       zerolog.Logger
 	// Track synced entities to avoid duplicates
 	syncedTeams    map[string]bool
 	syncedChannels map[string]bool
 	syncedUsers    map[string]bool
+	// State of the last sync, used by Resync to only process changes
+	teams           map[string]*model.Team
+	channelUpdateAt map[string]int64
+	etags           map[string]string
+	pageCounts      map[string]int
+	lastUserSync    int64
+	// If set, nothing is created and the planned changes are recorded instead
+	dryRun *DryRunReport
+	// Mattermost user whose sidebar categories are mirrored, resolved on first use
+	categoryUserID string
 }
 
 // NewSyncEngine creates a new sync engine for mirror mode
 func NewSyncEngine(connector *MattermostConnector) *SyncEngine {
 	return &SyncEngine{
 		Connector:      connector,
+		log:            connector.moduleLog(LogModuleSync),
 		syncedTeams:    make(map[string]bool),
 		syncedChannels: make(map[string]bool),
 		syncedUsers:    make(map[string]bool),
+
+		teams:           make(map[string]*model.Team),
+		channelUpdateAt: make(map[string]int64),
+		etags:           make(map[string]string),
+		pageCounts:      make(map[string]int),
 	}
 }
 
@@ -35,57 +56,82 @@ func (m *MattermostConnector) startMirrorSync(ctx context.Context) {
 	time.Sleep(5 * time.Second)
 
 	engine := NewSyncEngine(m)
+	if m.config().Mirror.DryRun {
+		engine.log.Info().Msg("Running mirror sync in dry-run mode")
+		engine.dryRun = &DryRunReport{}
+	}
 
+	if engine.dryRun == nil {
+		m.notifyStatus(ctx, "", "Starting mirror sync")
+	}
 	if err := engine.SyncAll(ctx); err != nil {
-		fmt.Printf("ERROR: Mirror sync failed: %v\n", err)
+		engine.log.Err(err).Msg("Mirror sync failed")
+		m.notifyStatus(ctx, "", "Mirror sync failed: %v", err)
+	} else if engine.dryRun == nil {
+		m.notifyStatus(ctx, "", "Mirror sync complete: %d teams, %d channels and %d users synced", len(engine.syncedTeams), len(engine.syncedChannels), len(engine.syncedUsers))
+	}
+	if engine.dryRun != nil {
+		engine.dryRun.Log(engine.log)
+		return
 	}
+
+	engine.runResyncScheduler(ctx, time.Duration(m.config().Mirror.ResyncInterval)*time.Minute)
 }
 
 // SyncAll performs a full synchronization of the Mattermost server to Matrix
 func (s *SyncEngine) SyncAll(ctx context.Context) error {
-	fmt.Printf("INFO: Starting full server sync...\n")
+	s.log.Info().Msg("Starting full server sync")
 
 	// First sync users so ghosts exist for channel members
-	if s.Connector.Config.Mirror.SyncAllUsers {
+	if s.Connector.config().Mirror.SyncAllUsers && s.Connector.ownsGlobalTasks() {
 		if err := s.SyncUsers(ctx); err != nil {
-			fmt.Printf("WARN: Failed to sync users: %v\n", err)
+			s.log.Warn().Err(err).Msg("Failed to sync users")
 			// Continue anyway - ghosts will be created on demand
 		}
 	}
 
 	// Sync teams (which creates spaces) and their channels
-	if s.Connector.Config.Mirror.SyncAllTeams {
+	if s.Connector.config().Mirror.SyncAllTeams {
 		if err := s.SyncTeams(ctx); err != nil {
 			return fmt.Errorf("failed to sync teams: %w", err)
 		}
 	}
 
 	// Backfill history for all synced channels
-	if s.Connector.Config.Mirror.SyncHistory {
+	if s.Connector.config().Mirror.SyncHistory {
 		if err := s.BackfillAllChannels(ctx); err != nil {
-			fmt.Printf("WARN: Failed to backfill channels: %v\n", err)
+			s.log.Warn().Err(err).Msg("Failed to backfill channels")
 		}
 	}
 
-	fmt.Printf("INFO: Full server sync complete\n")
+	s.log.Info().Msg("Full server sync complete")
 	return nil
 }
 
 // SyncTeams synchronizes all Mattermost teams to Matrix Spaces
 func (s *SyncEngine) SyncTeams(ctx context.Context) error {
-	fmt.Printf("INFO: Syncing teams...\n")
+	s.log.Info().Msg("Syncing teams")
 
 	// Get all teams from Mattermost
-	teams, _, err := s.Connector.Client.GetAllTeams(ctx, "", 0, 100)
+	var teams []*model.Team
+	err := fetchPages(s, "teams", teamsPerPage, func(page, perPage int, etag string) ([]*model.Team, *model.Response, error) {
+		return s.Connector.Client.GetAllTeams(ctx, etag, page, perPage)
+	}, func(page []*model.Team) {
+		teams = append(teams, page...)
+	})
 	if err != nil {
 		return fmt.Errorf("failed to get teams: %w", err)
 	}
 
-	fmt.Printf("INFO: Found %d teams to sync\n", len(teams))
+	s.log.Info().Int("team_count", len(teams)).Msg("Found teams to sync")
 
 	for _, team := range teams {
+		if !s.Connector.mirrorFilters().TeamAllowed(team) {
+			s.log.Debug().Str("team_id", team.Id).Str("team_name", team.Name).Msg("Skipping team excluded by mirror filters")
+			continue
+		}
 		if err := s.SyncTeam(ctx, team); err != nil {
-			fmt.Printf("WARN: Failed to sync team %s: %v\n", team.Name, err)
+			s.log.Warn().Err(err).Str("team_id", team.Id).Str("team_name", team.Name).Msg("Failed to sync team")
 			continue
 		}
 	}
@@ -99,7 +145,8 @@ func (s *SyncEngine) SyncTeam(ctx context.Context, team *model.Team) error {
 		return nil // Already synced
 	}
 
-	fmt.Printf("INFO: Syncing team: %s (%s)\n", team.DisplayName, team.Id)
+	log := s.log.With().Str("team_id", team.Id).Logger()
+	log.Info().Str("team_name", team.DisplayName).Msg("Syncing team")
 
 	// Create portal for team (as Space)
 	portalKey := networkid.PortalKey{
@@ -107,20 +154,22 @@ func (s *SyncEngine) SyncTeam(ctx context.Context, team *model.Team) error {
 	}
 
 	// Get the first available login to use for portal creation
-	login := s.getAnyLogin()
+	login := s.Connector.portalLogin(portalKey)
 	if login == nil {
 		return fmt.Errorf("no logged-in user available for portal creation")
 	}
 
 	// Get or create the portal
-	portal, err := s.Connector.Bridge.GetPortalByKey(ctx, portalKey)
+	portal, err := s.getPortal(ctx, portalKey)
 	if err != nil {
 		return fmt.Errorf("failed to get portal for team: %w", err)
 	}
 
-	if portal.MXID == "" {
+	if portal.MXID == "" && s.dryRun != nil {
+		s.dryRun.Spaces = append(s.dryRun.Spaces, DryRunEntity{ID: team.Id, Name: team.DisplayName})
+	} else if portal.MXID == "" {
 		// Portal doesn't exist in Matrix yet - create it
-		fmt.Printf("INFO: Creating Matrix Space for team: %s\n", team.DisplayName)
+		log.Info().Msg("Creating Matrix Space for team")
 
 		// Create a synthetic event to trigger room creation
 		evt := &TeamSyncEvent{
@@ -134,22 +183,30 @@ func (s *SyncEngine) SyncTeam(ctx context.Context, team *model.Team) error {
 		}
 
 		// Queue the event to create the portal
-		s.Connector.Bridge.QueueRemoteEvent(login, evt)
+		s.Connector.queueRemoteEvent(evt)
 	}
 
 	s.syncedTeams[team.Id] = true
+	s.teams[team.Id] = team
+
+	// Sync categories first, so that channel rooms are created in the right sub-space
+	if s.Connector.config().Mirror.CategorySpaces {
+		if err := s.SyncCategories(ctx, team.Id); err != nil {
+			log.Warn().Err(err).Msg("Failed to sync sidebar categories")
+		}
+	}
 
 	// Sync channels in this team
-	if s.Connector.Config.Mirror.SyncAllChannels {
+	if s.Connector.config().Mirror.SyncAllChannels {
 		if err := s.SyncChannels(ctx, team.Id); err != nil {
-			fmt.Printf("WARN: Failed to sync channels for team %s: %v\n", team.Name, err)
+			log.Warn().Err(err).Msg("Failed to sync channels for team")
 		}
 	}
 
 	// Sync team memberships - join all team members to the Matrix Space
-	if portal.MXID != "" {
+	if (portal.MXID != "" || s.dryRun != nil) && s.Connector.ownsChannel(team.Id) {
 		if err := s.SyncTeamMemberships(ctx, team.Id, portal); err != nil {
-			fmt.Printf("WARN: Failed to sync team memberships for %s: %v\n", team.Name, err)
+			log.Warn().Err(err).Msg("Failed to sync team memberships")
 		}
 	}
 
@@ -158,27 +215,35 @@ func (s *SyncEngine) SyncTeam(ctx context.Context, team *model.Team) error {
 
 // SyncChannels synchronizes all channels in a team
 func (s *SyncEngine) SyncChannels(ctx context.Context, teamID string) error {
-	fmt.Printf("INFO: Syncing channels for team %s...\n", teamID)
+	log := s.log.With().Str("team_id", teamID).Logger()
+	log.Info().Msg("Syncing channels for team")
 
 	// Get public channels
-	publicChannels, _, err := s.Connector.Client.GetPublicChannelsForTeam(ctx, teamID, 0, 200, "")
+	var allChannels []*model.Channel
+	err := s.fetchChannels(ctx, teamID, false, func(page []*model.Channel) {
+		allChannels = append(allChannels, page...)
+	})
 	if err != nil {
 		return fmt.Errorf("failed to get public channels: %w", err)
 	}
 
 	// Get private channels (requires admin)
-	privateChannels, _, err := s.Connector.Client.GetPrivateChannelsForTeam(ctx, teamID, 0, 200, "")
+	err = s.fetchChannels(ctx, teamID, true, func(page []*model.Channel) {
+		allChannels = append(allChannels, page...)
+	})
 	if err != nil {
-		fmt.Printf("WARN: Failed to get private channels (may need admin): %v\n", err)
-		privateChannels = []*model.Channel{}
+		log.Warn().Err(err).Msg("Failed to get private channels (may need admin)")
 	}
 
-	allChannels := append(publicChannels, privateChannels...)
-	fmt.Printf("INFO: Found %d channels to sync in team %s\n", len(allChannels), teamID)
+	log.Info().Int("channel_count", len(allChannels)).Msg("Found channels to sync")
 
 	for _, channel := range allChannels {
+		if !s.Connector.mirrorFilters().ChannelAllowed(channel) {
+			log.Debug().Str("channel_id", channel.Id).Str("channel_name", channel.Name).Msg("Skipping channel excluded by mirror filters")
+			continue
+		}
 		if err := s.SyncChannel(ctx, channel); err != nil {
-			fmt.Printf("WARN: Failed to sync channel %s: %v\n", channel.Name, err)
+			log.Warn().Err(err).Str("channel_id", channel.Id).Str("channel_name", channel.Name).Msg("Failed to sync channel")
 			continue
 		}
 	}
@@ -192,31 +257,34 @@ func (s *SyncEngine) SyncChannel(ctx context.Context, channel *model.Channel) er
 		return nil // Already synced
 	}
 
-	// Skip DM and Group DM channels in team sync
-	if channel.Type == model.ChannelTypeDirect || channel.Type == model.ChannelTypeGroup {
+	// Skip DM and Group DM channels in team sync, and channels of other instances
+	if channel.Type == model.ChannelTypeDirect || channel.Type == model.ChannelTypeGroup || !s.Connector.ownsChannel(channel.Id) {
 		return nil
 	}
 
-	fmt.Printf("INFO: Syncing channel: %s (%s)\n", channel.DisplayName, channel.Id)
+	log := s.log.With().Str("channel_id", channel.Id).Str("team_id", channel.TeamId).Logger()
+	log.Info().Str("channel_name", channel.DisplayName).Msg("Syncing channel")
 
 	// Create portal for channel
 	portalKey := networkid.PortalKey{
 		ID: networkid.PortalID(channel.Id),
 	}
 
-	login := s.getAnyLogin()
+	login := s.Connector.portalLogin(portalKey)
 	if login == nil {
 		return fmt.Errorf("no logged-in user available for portal creation")
 	}
 
 	// Get or create the portal
-	portal, err := s.Connector.Bridge.GetPortalByKey(ctx, portalKey)
+	portal, err := s.getPortal(ctx, portalKey)
 	if err != nil {
 		return fmt.Errorf("failed to get portal for channel: %w", err)
 	}
 
-	if portal.MXID == "" {
-		fmt.Printf("INFO: Creating Matrix room for channel: %s\n", channel.DisplayName)
+	if portal.MXID == "" && s.dryRun != nil {
+		s.dryRun.Rooms = append(s.dryRun.Rooms, DryRunEntity{ID: channel.Id, Name: channel.DisplayName})
+	} else if portal.MXID == "" {
+		log.Info().Msg("Creating Matrix room for channel")
 
 		// Create a synthetic event to trigger room creation
 		evt := &ChannelSyncEvent{
@@ -229,103 +297,64 @@ func (s *SyncEngine) SyncChannel(ctx context.Context, channel *model.Channel) er
 			Channel: channel,
 		}
 
-		s.Connector.Bridge.QueueRemoteEvent(login, evt)
+		s.Connector.queueRemoteEvent(evt)
+	}
+
+	if s.dryRun == nil {
+		if err := s.ensureInSpace(ctx, portal); err != nil {
+			log.Warn().Err(err).Msg("Failed to add room to team space")
+		}
 	}
 
 	// Auto-invite users if configured
-	if s.Connector.Config.Mirror.AutoInviteUsers && portal.MXID != "" {
+	if s.Connector.config().Mirror.AutoInviteUsers && portal.MXID != "" {
 		if err := s.inviteChannelMembers(ctx, channel.Id, portal); err != nil {
-			fmt.Printf("WARN: Failed to invite members to channel %s: %v\n", channel.Name, err)
+			log.Warn().Err(err).Msg("Failed to invite members to channel")
 		}
 	}
 
 	s.syncedChannels[channel.Id] = true
+	s.channelUpdateAt[channel.Id] = channel.UpdateAt
 	return nil
 }
 
 // SyncUsers synchronizes all Mattermost users to Matrix ghosts
 func (s *SyncEngine) SyncUsers(ctx context.Context) error {
-	fmt.Printf("INFO: Syncing users...\\n")
+	s.log.Info().Msg("Syncing users")
 
 	page := 0
 	perPage := 200
 	totalUsers := 0
 	createdMatrixUsers := 0
-
-	// Create Matrix Admin client if needed
-	var matrixAdmin *MatrixAdminClient
-	if s.Connector.Config.Mirror.CreateMatrixAccounts && s.Connector.Config.SynapseAdmin.Token != "" {
-		matrixAdmin = NewMatrixAdminClient(
-			s.Connector.Config.SynapseAdmin.URL,
-			s.Connector.Config.SynapseAdmin.Token,
-		)
-	}
+	startedAt := time.Now().UnixMilli()
+	matrixAdmin := s.accountAdmin()
 
 	for {
-		fmt.Printf("DEBUG: Fetching users page %d...\n", page)
+		s.log.Debug().Int("page", page).Msg("Fetching users page")
 		users, _, err := s.Connector.Client.GetUsers(ctx, page, perPage, "")
 		if err != nil {
 			return fmt.Errorf("failed to get users page %d: %w", page, err)
 		}
 
-		fmt.Printf("DEBUG: Got %d users on page %d\n", len(users), page)
+		s.log.Debug().Int("page", page).Int("user_count", len(users)).Msg("Got users page")
 		if len(users) == 0 {
 			break
 		}
 
 		for _, user := range users {
-			fmt.Printf("DEBUG: Processing user %s (ID: %s)\\n", user.Username, user.Id)
+			log := s.log.With().Str("mm_user_id", user.Id).Str("username", user.Username).Logger()
+			log.Debug().Msg("Processing user")
 			if s.syncedUsers[user.Id] {
-				fmt.Printf("DEBUG: User %s already synced, skipping\\n", user.Username)
+				log.Debug().Msg("User already synced, skipping")
 				continue
 			}
-
-			// Ensure ghost exists for this user
-			ghostID := networkid.UserID(user.Username)
-			ghost, err := s.Connector.Bridge.GetGhostByID(ctx, ghostID)
-			if err != nil {
-				fmt.Printf("WARN: Failed to get/create ghost for user %s: %v\n", user.Username, err)
+			if !s.Connector.mirrorFilters().UserAllowed(user) {
+				log.Debug().Msg("Skipping user excluded by mirror filters")
 				continue
 			}
-			// Store UUID in metadata for API stability
-			if ghost.Metadata == nil {
-				ghost.Metadata = make(map[string]any)
-			}
-			meta, ok := ghost.Metadata.(map[string]any)
-			if ok && meta["mm_id"] != user.Id {
-				meta["mm_id"] = user.Id
-				err = s.Connector.Bridge.DB.Ghost.Update(ctx, ghost.Ghost)
-				if err != nil {
-					fmt.Printf("WARN: Failed to update ghost metadata for %s: %v\n", user.Username, err)
-				}
-			}
 
-			// Update ghost info (profile and avatar) from Mattermost to Matrix
-			fmt.Printf("DEBUG: About to sync profile for user %s\n", user.Username)
-			login := s.getAnyLogin()
-			if login == nil {
-				fmt.Printf("DEBUG: No login available for profile sync\n")
-			} else if login.Client == nil {
-				fmt.Printf("DEBUG: Login client is nil for profile sync\n")
-			} else if api, ok := login.Client.(*MattermostAPI); ok {
-				fmt.Printf("DEBUG: Calling GetUserInfo for user %s\n", user.Username)
-				info, err := api.GetUserInfo(ctx, ghost)
-				if err != nil {
-					fmt.Printf("WARN: Failed to get user info for %s: %v\n", user.Username, err)
-				} else {
-					fmt.Printf("DEBUG: Got user info for %s, calling UpdateInfo\n", user.Username)
-					ghost.UpdateInfo(ctx, info)
-					fmt.Printf("DEBUG: UpdateInfo completed for %s\n", user.Username)
-				}
-			} else {
-				fmt.Printf("DEBUG: Login client is not MattermostAPI\n")
-			}
-
-			// Optionally create a real Matrix account for the user
-			if matrixAdmin != nil {
-				if created := s.CreateMatrixUserIfNeeded(ctx, matrixAdmin, user); created {
-					createdMatrixUsers++
-				}
+			if created := s.syncUser(ctx, user, matrixAdmin); created {
+				createdMatrixUsers++
 			}
 
 			s.syncedUsers[user.Id] = true
@@ -338,130 +367,151 @@ func (s *SyncEngine) SyncUsers(ctx context.Context) error {
 		}
 	}
 
-	fmt.Printf("INFO: Synced %d users, created %d Matrix accounts\\n", totalUsers, createdMatrixUsers)
+	s.lastUserSync = startedAt
+	s.log.Info().Int("user_count", totalUsers).Int("created_accounts", createdMatrixUsers).Msg("Synced users")
 	return nil
 }
 
-// CreateMatrixUserIfNeeded creates a Matrix account for a Mattermost user if it doesn't exist
-func (s *SyncEngine) CreateMatrixUserIfNeeded(ctx context.Context, admin *MatrixAdminClient, mmUser *model.User) bool {
-	serverName := s.Connector.Bridge.Matrix.ServerName()
-	mxid := GenerateMatrixUserID(mmUser, serverName)
-
-	// Check if user already exists
-	exists, err := admin.UserExists(ctx, mxid)
-	if err != nil {
-		fmt.Printf("WARN: Failed to check if Matrix user exists for %s: %v\\n", mmUser.Username, err)
-		return false
+// accountAdmin returns the homeserver admin backend if Matrix accounts should be created
+func (s *SyncEngine) accountAdmin() HomeserverAdmin {
+	if s.Connector.config().Mirror.CreateMatrixAccounts {
+		return s.Connector.MatrixAdmin
 	}
+	return nil
+}
 
-	if exists {
-		// User exists, just update display name if needed
-		displayName := mmUser.GetDisplayName(model.ShowFullName)
-		if displayName == "" {
-			displayName = mmUser.Username
-		}
-		_ = admin.UpdateUserDisplayName(ctx, mxid, displayName)
-		return false
-	}
+// syncUser creates or updates the ghost of a Mattermost user, and optionally their Matrix account.
+// It returns true if a Matrix account was created.
+func (s *SyncEngine) syncUser(ctx context.Context, user *model.User, matrixAdmin HomeserverAdmin) bool {
+	log := s.log.With().Str("mm_user_id", user.Id).Str("username", user.Username).Logger()
 
-	// Create the user
-	displayName := mmUser.GetDisplayName(model.ShowFullName)
-	if displayName == "" {
-		displayName = mmUser.Username
+	if s.dryRun != nil {
+		return s.dryRunUser(ctx, user, matrixAdmin)
 	}
-	password := GeneratePassword()
 
-	if err := admin.CreateUser(ctx, mxid, password, displayName); err != nil {
-		fmt.Printf("WARN: Failed to create Matrix user for %s: %v\\n", mmUser.Username, err)
+	// Ensure ghost exists for this user
+	ghost, err := s.Connector.Bridge.GetGhostByID(ctx, MakeUserID(user.Id))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get/create ghost for user")
 		return false
 	}
 
-	fmt.Printf("INFO: Created Matrix user %s for Mattermost user %s\\n", mxid, mmUser.Username)
-	return true
-}
-
-// SyncHistoricalMessages syncs message history for a channel
-func (s *SyncEngine) SyncHistoricalMessages(ctx context.Context, channelID string, limit int) error {
-	fmt.Printf("INFO: Syncing history for channel %s (limit: %d)...\n", channelID, limit)
-
-	if limit == 0 {
-		limit = s.Connector.Config.Mirror.HistoryLimit
-	}
-	if limit == 0 {
-		limit = 100 // Default
-	}
-
+	// Update ghost info (profile and avatar) from Mattermost to Matrix
 	login := s.getAnyLogin()
 	if login == nil {
-		return fmt.Errorf("no logged-in user available for backfill")
+		log.Debug().Msg("No login available for profile sync")
+	} else if login.Client == nil {
+		log.Debug().Str("login_id", string(login.ID)).Msg("Login client is nil for profile sync")
+	} else if api, ok := login.Client.(*MattermostAPI); ok {
+		info, err := api.GetUserInfo(ctx, ghost)
+		if err != nil {
+			log.Warn().Err(err).Str("login_id", string(login.ID)).Msg("Failed to get user info")
+		} else {
+			ghost.UpdateInfo(ctx, info)
+			log.Debug().Msg("Synced user profile")
+		}
+	} else {
+		log.Debug().Str("login_id", string(login.ID)).Msg("Login client is not MattermostAPI")
 	}
 
-	// Get posts for channel
-	postList, _, err := s.Connector.Client.GetPostsForChannel(ctx, channelID, 0, limit, "", false, false)
-	if err != nil {
-		return fmt.Errorf("failed to get posts: %w", err)
+	// Optionally create a real Matrix account for the user
+	if matrixAdmin != nil {
+		return s.CreateMatrixUserIfNeeded(ctx, matrixAdmin, user)
 	}
+	return false
+}
 
-	fmt.Printf("INFO: Found %d posts to backfill\n", len(postList.Posts))
+// CreateMatrixUserIfNeeded creates a Matrix account for a Mattermost user if it doesn't
+// exist, and otherwise keeps the account's profile, email and SSO link in sync. Accounts
+// of deactivated users aren't created, and existing ones are deactivated if configured.
+func (s *SyncEngine) CreateMatrixUserIfNeeded(ctx context.Context, admin HomeserverAdmin, mmUser *model.User) bool {
+	log := s.log.With().Str("mm_user_id", mmUser.Id).Logger()
 
-	// Posts need to be processed in order (oldest first)
-	// postList.Order is newest first, so reverse it
-	syncedCount := 0
-	for i := len(postList.Order) - 1; i >= 0; i-- {
-		postID := postList.Order[i]
-		post := postList.Posts[postID]
+	// Check if user already exists
+	mxid, exists, err := s.Connector.resolveMatrixAccount(ctx, admin, mmUser)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to find Matrix user")
+		return false
+	}
+	log = log.With().Stringer("mxid", mxid).Logger()
 
-		// Skip system messages
-		if post.Type != "" && post.Type != "custom_post" {
-			continue
+	if exists {
+		if err = s.Connector.syncMatrixAccount(log.WithContext(ctx), admin, mxid, mmUser); err != nil {
+			log.Warn().Err(err).Msg("Failed to update Matrix user")
 		}
+		return false
+	} else if mmUser.DeleteAt != 0 {
+		return false
+	}
 
-		// Create event for this historical message
-		evt := &MattermostMessageEvent{
-			MattermostEvent: MattermostEvent{
-				Connector: s.Connector,
-				Timestamp: time.Unix(post.CreateAt/1000, (post.CreateAt%1000)*1000000),
-				ChannelID: post.ChannelId,
-				UserID:    post.UserId,
-			},
-			PostID:  post.Id,
-			Content: post.Message,
-			FileIds: post.FileIds,
-			RootID:  post.RootId,
-		}
+	// Create the user
+	password, err := s.Connector.createMatrixAccount(log.WithContext(ctx), admin, mxid, mmUser)
+	if errors.Is(err, errNoSSOIdentity) {
+		log.Debug().Msg("Not creating Matrix user for user without SSO identity")
+		return false
+	} else if err != nil {
+		log.Warn().Err(err).Msg("Failed to create Matrix user")
+		return false
+	}
+	log.Info().Msg("Created Matrix user")
 
-		// Queue the event for processing
-		s.Connector.Bridge.QueueRemoteEvent(login, evt)
-		syncedCount++
+	// Nobody else sees the password of accounts created by the sync, so without a DM the user
+	// has to reset it before logging in
+	if password != "" && s.Connector.config().PasswordPolicy.DeliverViaDM {
+		credentials := matrixCredentials("Matrix Account Created!", mxid, s.Connector.Bridge.Matrix.ServerName(), password)
+		if err = s.Connector.sendBridgeDM(ctx, mmUser.Id, credentials); err != nil {
+			log.Warn().Err(err).Msg("Failed to send Matrix credentials via DM, the user can reset their password to log in")
+		}
 	}
+	return true
+}
 
-	fmt.Printf("INFO: Queued %d historical messages for channel %s\n", syncedCount, channelID)
+// SyncHistoricalMessages makes the bridge backfill the history of a channel. Rooms are
+// backfilled when they're created, so this catches up rooms that already existed: a
+// resync event is queued, and the bridge fetches the missing posts with FetchMessages
+// if the channel has posts newer than the last bridged message.
+func (s *SyncEngine) SyncHistoricalMessages(ctx context.Context, channelID string) error {
+	if !s.Connector.Bridge.Config.Backfill.Enabled {
+		return fmt.Errorf("backfill is disabled in the bridge config")
+	}
+	ok := s.Connector.queueRemoteEvent(&ChannelBackfillEvent{
+		MattermostEvent: MattermostEvent{
+			Connector: s.Connector,
+			Timestamp: time.Now(),
+			ChannelID: channelID,
+		},
+	})
+	if !ok {
+		return fmt.Errorf("no logged-in user available for backfill")
+	}
+	s.log.Debug().Str("channel_id", channelID).Msg("Queued channel history backfill")
 	return nil
 }
 
 // BackfillChannel performs a complete backfill of a channel including messages and members
 func (s *SyncEngine) BackfillChannel(ctx context.Context, channelID string) error {
-	fmt.Printf("INFO: Starting full backfill for channel %s\n", channelID)
+	log := s.log.With().Str("channel_id", channelID).Logger()
+	log.Info().Msg("Starting full backfill for channel")
 
 	// Get portal for channel
 	portalKey := networkid.PortalKey{
 		ID: networkid.PortalID(channelID),
 	}
 
-	portal, err := s.Connector.Bridge.GetPortalByKey(ctx, portalKey)
+	portal, err := s.getPortal(ctx, portalKey)
 	if err != nil {
 		return fmt.Errorf("failed to get portal: %w", err)
 	}
 
 	// Sync channel memberships first
 	if err := s.SyncChannelMemberships(ctx, channelID, portal); err != nil {
-		fmt.Printf("WARN: Failed to sync memberships for channel %s: %v\n", channelID, err)
+		log.Warn().Err(err).Msg("Failed to sync channel memberships")
 	}
 
 	// Then backfill historical messages
-	if s.Connector.Config.Mirror.SyncHistory {
-		if err := s.SyncHistoricalMessages(ctx, channelID, 0); err != nil {
-			fmt.Printf("WARN: Failed to backfill messages for channel %s: %v\n", channelID, err)
+	if s.Connector.config().Mirror.SyncHistory && s.dryRun == nil {
+		if err := s.SyncHistoricalMessages(ctx, channelID); err != nil {
+			log.Warn().Err(err).Msg("Failed to backfill channel messages")
 		}
 	}
 
@@ -470,83 +520,67 @@ func (s *SyncEngine) BackfillChannel(ctx context.Context, channelID string) erro
 
 // SyncChannelMemberships syncs all channel members to the Matrix room
 func (s *SyncEngine) SyncChannelMemberships(ctx context.Context, channelID string, portal *bridgev2.Portal) error {
-	members, _, err := s.Connector.Client.GetChannelMembers(ctx, channelID, 0, 1000, "")
+	users, err := s.Connector.getChannelUsers(ctx, s.Connector.Client, channelID)
 	if err != nil {
 		return fmt.Errorf("failed to get channel members: %w", err)
 	}
 
-	fmt.Printf("INFO: Syncing %d members for channel %s\n", len(members), channelID)
+	log := s.log.With().Str("channel_id", channelID).Str("room_id", portal.MXID.String()).Logger()
+	log.Info().Int("member_count", len(users)).Msg("Syncing channel members")
 
-	// Create Matrix Admin client if available for direct room joins
-	var matrixAdmin *MatrixAdminClient
-	if s.Connector.Config.SynapseAdmin.Token != "" {
-		matrixAdmin = NewMatrixAdminClient(
-			s.Connector.Config.SynapseAdmin.URL,
-			s.Connector.Config.SynapseAdmin.Token,
-		)
-	}
+	// Use the homeserver admin backend if available for direct room joins
+	matrixAdmin := s.Connector.MatrixAdmin
 
-	serverName := s.Connector.Bridge.Matrix.ServerName()
 	joinedCount := 0
 
-	for _, member := range members {
-		// Get Mattermost user info
-		user, _, err := s.Connector.Client.GetUser(ctx, member.UserId, "")
-		if err != nil {
-			fmt.Printf("WARN: Failed to get user %s: %v\n", member.UserId, err)
+	for _, user := range users {
+		if !s.Connector.mirrorFilters().UserAllowed(user) {
+			continue
+		}
+		if s.dryRun != nil {
+			if matrixAdmin != nil && s.Connector.config().Mirror.CreateMatrixAccounts {
+				s.dryRun.Joins = append(s.dryRun.Joins, DryRunJoin{UserID: s.Connector.matrixAccountID(user), PortalID: channelID})
+			}
 			continue
 		}
 
 		// Ensure ghost exists
-		ghostID := networkid.UserID(user.Username)
-		ghost, err := s.Connector.Bridge.GetGhostByID(ctx, ghostID)
+		_, err = s.Connector.Bridge.GetGhostByID(ctx, MakeUserID(user.Id))
 		if err != nil {
-			fmt.Printf("WARN: Failed to get ghost for user %s: %v\n", user.Username, err)
+			log.Warn().Err(err).Str("mm_user_id", user.Id).Msg("Failed to get ghost for user")
 			continue
 		}
-		// Store UUID in metadata for API stability
-		if ghost.Metadata == nil {
-			ghost.Metadata = make(map[string]any)
-		}
-		meta, ok := ghost.Metadata.(map[string]any)
-		if ok && meta["mm_id"] != user.Id {
-			meta["mm_id"] = user.Id
-			err = s.Connector.Bridge.DB.Ghost.Update(ctx, ghost.Ghost)
-			if err != nil {
-				fmt.Printf("DEBUG: Failed to update ghost metadata: %v\n", err)
-			}
-		}
 
 		// If we have Matrix admin access and create_matrix_accounts is enabled,
 		// join the real Matrix user to the room
-		if matrixAdmin != nil && s.Connector.Config.Mirror.CreateMatrixAccounts {
-			mxid := GenerateMatrixUserID(user, serverName)
+		if matrixAdmin != nil && s.Connector.config().Mirror.CreateMatrixAccounts {
+			mxid := s.Connector.matrixAccountID(user)
 			if err := matrixAdmin.JoinUserToRoom(ctx, mxid, portal.MXID); err != nil {
-				fmt.Printf("DEBUG: Could not join %s to %s: %v\n", mxid, portal.MXID, err)
+				log.Debug().Err(err).Stringer("mxid", mxid).Msg("Could not join user to room")
 			} else {
 				joinedCount++
 			}
 		}
 	}
 
-	fmt.Printf("INFO: Joined %d Matrix users to room %s\n", joinedCount, portal.MXID)
+	log.Info().Int("joined_count", joinedCount).Msg("Joined Matrix users to room")
 	return nil
 }
 
 // BackfillAllChannels backfills all synced channels
 func (s *SyncEngine) BackfillAllChannels(ctx context.Context) error {
-	fmt.Printf("INFO: Starting backfill for all synced channels...\n")
+	s.log.Info().Msg("Starting backfill for all synced channels")
 
 	backfilledCount := 0
 	for channelID := range s.syncedChannels {
 		if err := s.BackfillChannel(ctx, channelID); err != nil {
-			fmt.Printf("WARN: Failed to backfill channel %s: %v\n", channelID, err)
+			s.log.Warn().Err(err).Str("channel_id", channelID).Msg("Failed to backfill channel")
 			continue
 		}
 		backfilledCount++
 	}
 
-	fmt.Printf("INFO: Backfilled %d channels\n", backfilledCount)
+	s.log.Info().Int("channel_count", backfilledCount).Msg("Backfilled channels")
 	return nil
 }
 
@@ -568,12 +602,13 @@ func (s *SyncEngine) inviteChannelMembers(ctx context.Context, channelID string,
 		return fmt.Errorf("failed to get channel members: %w", err)
 	}
 
-	fmt.Printf("INFO: Would invite %d members to portal %s\n", len(members), portal.MXID)
+	log := s.log.With().Str("channel_id", channelID).Str("room_id", portal.MXID.String()).Logger()
+	log.Info().Int("member_count", len(members)).Msg("Would invite members to portal")
 
 	// Phase 7 will implement actual Matrix user invitation via Synapse Admin API
 	// For now, just log what would happen
 	for _, member := range members {
-		fmt.Printf("DEBUG: Would invite user %s to room\n", member.UserId)
+		log.Debug().Str("mm_user_id", member.UserId).Msg("Would invite user to room")
 	}
 
 	return nil
@@ -581,65 +616,44 @@ func (s *SyncEngine) inviteChannelMembers(ctx context.Context, channelID string,
 
 // SyncTeamMemberships joins all team members to the corresponding Matrix Space
 func (s *SyncEngine) SyncTeamMemberships(ctx context.Context, teamID string, portal *bridgev2.Portal) error {
-	if portal.MXID == "" {
+	// In a dry run the space may not exist yet, the joins are only recorded
+	if portal.MXID == "" && s.dryRun == nil {
 		return fmt.Errorf("portal has no Matrix room ID")
 	}
 
-	fmt.Printf("INFO: Syncing team memberships for team %s to space %s\n", teamID, portal.MXID)
+	log := s.log.With().Str("team_id", teamID).Str("room_id", portal.MXID.String()).Logger()
+	log.Info().Msg("Syncing team memberships to space")
 
 	// Get all team members
-	page := 0
-	perPage := 200
-	joinedCount := 0
-
-	// Create Matrix Admin client if available
-	var matrixAdmin *MatrixAdminClient
-	if s.Connector.Config.SynapseAdmin.Token != "" {
-		matrixAdmin = NewMatrixAdminClient(
-			s.Connector.Config.SynapseAdmin.URL,
-			s.Connector.Config.SynapseAdmin.Token,
-		)
+	users, err := s.Connector.getTeamUsers(ctx, s.Connector.Client, teamID)
+	if err != nil {
+		return fmt.Errorf("failed to get team members: %w", err)
 	}
+	joinedCount := 0
 
-	serverName := s.Connector.Bridge.Matrix.ServerName()
+	// Use the homeserver admin backend if available
+	matrixAdmin := s.Connector.MatrixAdmin
 
-	for {
-		members, err := s.Connector.Client.GetTeamMembers(ctx, teamID, page, perPage)
-		if err != nil {
-			return fmt.Errorf("failed to get team members: %w", err)
-		}
-
-		if len(members) == 0 {
-			break
+	for _, user := range users {
+		if !s.Connector.mirrorFilters().UserAllowed(user) {
+			continue
 		}
 
-		for _, member := range members {
-			// Get user info
-			user, _, err := s.Connector.Client.GetUser(ctx, member.UserId, "")
-			if err != nil {
-				fmt.Printf("DEBUG: Failed to get user %s: %v\n", member.UserId, err)
-				continue
-			}
-
-			// If we have Matrix admin access and create_matrix_accounts is enabled,
-			// join the real Matrix user to the Space
-			if matrixAdmin != nil && s.Connector.Config.Mirror.CreateMatrixAccounts {
-				mxid := GenerateMatrixUserID(user, serverName)
-				if err := matrixAdmin.JoinUserToRoom(ctx, mxid, portal.MXID); err != nil {
-					fmt.Printf("DEBUG: Could not join %s to space %s: %v\n", mxid, portal.MXID, err)
-				} else {
-					joinedCount++
-				}
+		// If we have Matrix admin access and create_matrix_accounts is enabled,
+		// join the real Matrix user to the Space
+		if matrixAdmin != nil && s.Connector.config().Mirror.CreateMatrixAccounts {
+			mxid := s.Connector.matrixAccountID(user)
+			if s.dryRun != nil {
+				s.dryRun.Joins = append(s.dryRun.Joins, DryRunJoin{UserID: mxid, PortalID: teamID})
+			} else if err := matrixAdmin.JoinUserToRoom(ctx, mxid, portal.MXID); err != nil {
+				log.Debug().Err(err).Stringer("mxid", mxid).Msg("Could not join user to space")
+			} else {
+				joinedCount++
 			}
 		}
-
-		page++
-		if len(members) < perPage {
-			break
-		}
 	}
 
-	fmt.Printf("INFO: Joined %d Matrix users to space %s\n", joinedCount, portal.MXID)
+	log.Info().Int("joined_count", joinedCount).Msg("Joined Matrix users to space")
 	return nil
 }
 
@@ -653,28 +667,45 @@ func (e *TeamSyncEvent) GetType() bridgev2.RemoteEventType {
 	return bridgev2.RemoteEventChatInfoChange
 }
 
-func (e *TeamSyncEvent) GetChatInfoChange(ctx context.Context) (*bridgev2.ChatInfoChange, error) {
-	chatInfo := &bridgev2.ChatInfo{
-		Name:  &e.Team.DisplayName,
-		Topic: &e.Team.Description,
-	}
-
-	// Fetch team icon if available (LastTeamIconUpdate > 0 means icon exists)
-	if e.Team.LastTeamIconUpdate > 0 {
-		teamID := e.Team.Id
-		chatInfo.Avatar = &bridgev2.Avatar{
-			ID: networkid.AvatarID(fmt.Sprintf("team-%s-%d", teamID, e.Team.LastTeamIconUpdate)),
-			Get: func(ctx context.Context) ([]byte, error) {
-				return e.Connector.Client.GetTeamIcon(ctx, teamID)
-			},
-		}
-	}
+// ShouldCreatePortal lets the event create the space if it doesn't exist yet.
+// Outside of mirror mode, spaces are only created on demand.
+func (e *TeamSyncEvent) ShouldCreatePortal() bool {
+	return e.Connector != nil && e.Connector.IsMirrorMode()
+}
 
+func (e *TeamSyncEvent) GetChatInfoChange(ctx context.Context) (*bridgev2.ChatInfoChange, error) {
 	return &bridgev2.ChatInfoChange{
-		ChatInfo: chatInfo,
+		ChatInfo: &bridgev2.ChatInfo{
+			Name:   &e.Team.DisplayName,
+			Topic:  &e.Team.Description,
+			Avatar: e.Connector.teamAvatar(e.Server, e.Team),
+		},
 	}, nil
 }
 
+// ChannelBackfillEvent is a synthetic event that makes the bridge backfill a channel's room
+// if posts are missing from it
+type ChannelBackfillEvent struct {
+	MattermostEvent
+}
+
+var _ bridgev2.RemoteChatResyncBackfill = (*ChannelBackfillEvent)(nil)
+
+func (e *ChannelBackfillEvent) GetType() bridgev2.RemoteEventType {
+	return bridgev2.RemoteEventChatResync
+}
+
+func (e *ChannelBackfillEvent) CheckNeedsBackfill(ctx context.Context, latestMessage *database.Message) (bool, error) {
+	channel, resp, err := e.Connector.Client.GetChannel(ctx, e.ChannelID, "")
+	if err != nil {
+		return false, wrapMattermostError(resp, err)
+	}
+	if latestMessage == nil {
+		return channel.TotalMsgCount > 0, nil
+	}
+	return channel.LastPostAt > latestMessage.Timestamp.UnixMilli(), nil
+}
+
 // ChannelSyncEvent is a synthetic event for creating channel rooms
 type ChannelSyncEvent struct {
 	MattermostEvent
@@ -685,11 +716,19 @@ func (e *ChannelSyncEvent) GetType() bridgev2.RemoteEventType {
 	return bridgev2.RemoteEventChatInfoChange
 }
 
+// ShouldCreatePortal lets the event create the room if it doesn't exist yet.
+// Outside of mirror mode, rooms are only created on demand.
+func (e *ChannelSyncEvent) ShouldCreatePortal() bool {
+	return e.Connector != nil && e.Connector.IsMirrorMode()
+}
+
 func (e *ChannelSyncEvent) GetChatInfoChange(ctx context.Context) (*bridgev2.ChatInfoChange, error) {
 	return &bridgev2.ChatInfoChange{
 		ChatInfo: &bridgev2.ChatInfo{
 			Name:  &e.Channel.DisplayName,
-			Topic: &e.Channel.Purpose,
+			Topic: ptr.Ptr(e.Connector.channelTopic(e.Channel)),
+			// Moves the room to the new team's space if the channel was moved
+			ParentID: e.Connector.channelParentID(e.Channel),
 		},
 	}, nil
 }
@@ -3,67 +3,19 @@ package mattermost
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
-)
-
-// MockMattermostClient mocks the Mattermost Client for testing
-type MockMattermostClient struct {
-	mock.Mock
-}
-
-func (m *MockMattermostClient) GetAllTeams(ctx context.Context, etag string, page, perPage int) ([]*model.Team, *model.Response, error) {
-	args := m.Called(ctx, etag, page, perPage)
-	if args.Get(0) == nil {
-		return nil, nil, args.Error(2)
-	}
-	return args.Get(0).([]*model.Team), nil, args.Error(2)
-}
-
-func (m *MockMattermostClient) GetPublicChannelsForTeam(ctx context.Context, teamID string, page, perPage int, etag string) ([]*model.Channel, *model.Response, error) {
-	args := m.Called(ctx, teamID, page, perPage, etag)
-	if args.Get(0) == nil {
-		return nil, nil, args.Error(2)
-	}
-	return args.Get(0).([]*model.Channel), nil, args.Error(2)
-}
-
-func (m *MockMattermostClient) GetPrivateChannelsForTeam(ctx context.Context, teamID string, page, perPage int, etag string) ([]*model.Channel, *model.Response, error) {
-	args := m.Called(ctx, teamID, page, perPage, etag)
-	if args.Get(0) == nil {
-		return nil, nil, args.Error(2)
-	}
-	return args.Get(0).([]*model.Channel), nil, args.Error(2)
-}
-
-func (m *MockMattermostClient) GetUsers(ctx context.Context, page, perPage int, etag string) ([]*model.User, *model.Response, error) {
-	args := m.Called(ctx, page, perPage, etag)
-	if args.Get(0) == nil {
-		return nil, nil, args.Error(2)
-	}
-	return args.Get(0).([]*model.User), nil, args.Error(2)
-}
-
-func (m *MockMattermostClient) GetChannelMembers(ctx context.Context, channelID string, page, perPage int, etag string) (model.ChannelMembers, *model.Response, error) {
-	args := m.Called(ctx, channelID, page, perPage, etag)
-	if args.Get(0) == nil {
-		return nil, nil, args.Error(2)
-	}
-	return args.Get(0).(model.ChannelMembers), nil, args.Error(2)
-}
+	"maunium.net/go/mautrix/event"
 
-func (m *MockMattermostClient) GetPostsForChannel(ctx context.Context, channelID string, page, perPage int, etag string, collapsedThreads, collapsedThreadsExtended bool) (*model.PostList, *model.Response, error) {
-	args := m.Called(ctx, channelID, page, perPage, etag, collapsedThreads, collapsedThreadsExtended)
-	if args.Get(0) == nil {
-		return nil, nil, args.Error(2)
-	}
-	return args.Get(0).(*model.PostList), nil, args.Error(2)
-}
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/mmtest"
+)
 
 // MockBridge mocks bridgev2.Bridge for testing
 type MockBridge struct {
@@ -90,13 +42,14 @@ func (m *MockBridge) QueueRemoteEvent(login *bridgev2.UserLogin, evt bridgev2.Re
 	m.Called(login, evt)
 }
 
-// Helper to create a test SyncEngine with mocked dependencies
-func createTestSyncEngine() (*SyncEngine, *MockMattermostClient) {
-	mockClient := new(MockMattermostClient)
+// Helper to create a test SyncEngine whose client talks to a fake Mattermost server
+func createTestSyncEngine(t *testing.T) (*SyncEngine, *mmtest.Server) {
+	server := mmtest.NewServer(t)
 	
 	connector := &MattermostConnector{
 		Config: &NetworkConfig{
-			Mode: ModeMirror,
+			ServerURL: server.URL,
+			Mode:      ModeMirror,
 			Mirror: MirrorConfig{
 				SyncAllTeams:    true,
 				SyncAllChannels: true,
@@ -106,11 +59,12 @@ func createTestSyncEngine() (*SyncEngine, *MockMattermostClient) {
 				HistoryLimit:    100,
 			},
 		},
-		users: make(map[networkid.UserLoginID]*bridgev2.UserLogin),
+		Client: NewClient(server.URL, server.AdminToken),
+		users:  make(map[networkid.UserLoginID]*bridgev2.UserLogin),
 	}
 	
 	engine := NewSyncEngine(connector)
-	return engine, mockClient
+	return engine, server
 }
 
 func TestNewSyncEngine(t *testing.T) {
@@ -166,7 +120,7 @@ func TestSyncEngine_IsMirrorMode(t *testing.T) {
 }
 
 func TestSyncEngine_TeamTrackingPreventsduplicates(t *testing.T) {
-	engine, _ := createTestSyncEngine()
+	engine, _ := createTestSyncEngine(t)
 	
 	team := &model.Team{
 		Id:          "team1",
@@ -181,7 +135,7 @@ func TestSyncEngine_TeamTrackingPreventsduplicates(t *testing.T) {
 }
 
 func TestSyncEngine_ChannelTrackingPreventsHDuplicates(t *testing.T) {
-	engine, _ := createTestSyncEngine()
+	engine, _ := createTestSyncEngine(t)
 	
 	channel := &model.Channel{
 		Id:          "channel1",
@@ -197,7 +151,7 @@ func TestSyncEngine_ChannelTrackingPreventsHDuplicates(t *testing.T) {
 }
 
 func TestSyncEngine_UserTrackingPreventsDuplicates(t *testing.T) {
-	engine, _ := createTestSyncEngine()
+	engine, _ := createTestSyncEngine(t)
 	
 	user := &model.User{
 		Id:       "user1",
@@ -311,7 +265,7 @@ func TestBridgeMode_Constants(t *testing.T) {
 }
 
 func TestSyncEngine_GetAnyLogin_Empty(t *testing.T) {
-	engine, _ := createTestSyncEngine()
+	engine, _ := createTestSyncEngine(t)
 	
 	// With no users, should return nil
 	login := engine.getAnyLogin()
@@ -319,7 +273,7 @@ func TestSyncEngine_GetAnyLogin_Empty(t *testing.T) {
 }
 
 func TestSyncEngine_GetAnyLogin_WithUsers(t *testing.T) {
-	engine, _ := createTestSyncEngine()
+	engine, _ := createTestSyncEngine(t)
 	
 	// Add a user
 	login := &bridgev2.UserLogin{
@@ -335,6 +289,30 @@ func TestSyncEngine_GetAnyLogin_WithUsers(t *testing.T) {
 	assert.Equal(t, login, result)
 }
 
+func TestSyncEngine_SyncTeams_DryRun(t *testing.T) {
+	engine, server := createTestSyncEngine(t)
+	engine.Connector.Bridge = &bridgev2.Bridge{DB: newTestBridgeDB(t)}
+	engine.Connector.users["admin"] = &bridgev2.UserLogin{UserLogin: &database.UserLogin{ID: "admin"}}
+	engine.dryRun = &DryRunReport{}
+	team := server.AddTeam(&model.Team{Name: "team", DisplayName: "Team"})
+	server.AddChannel(&model.Channel{TeamId: team.Id, Name: "town-square", DisplayName: "Town Square"}, server.Admin.Id)
+	server.AddChannel(&model.Channel{TeamId: team.Id, Name: "secret", DisplayName: "Secret", Type: model.ChannelTypePrivate})
+	server.AddChannel(&model.Channel{TeamId: team.Id, Name: "dm", Type: model.ChannelTypeDirect})
+
+	require.NoError(t, engine.SyncTeams(context.Background()))
+	assert.Equal(t, []DryRunEntity{{ID: team.Id, Name: "Team"}}, engine.dryRun.Spaces)
+	var rooms []string
+	for _, room := range engine.dryRun.Rooms {
+		rooms = append(rooms, room.Name)
+	}
+	assert.ElementsMatch(t, []string{"Town Square", "Secret"}, rooms)
+	assert.True(t, engine.syncedTeams[team.Id])
+	assert.Len(t, engine.syncedChannels, 2)
+
+	// Spaces that would be created don't have a room yet
+	assert.NoError(t, engine.SyncTeamMemberships(context.Background(), team.Id, &bridgev2.Portal{Portal: &database.Portal{}}))
+}
+
 func TestMattermostEvent_GetPortalKey(t *testing.T) {
 	event := MattermostEvent{
 		ChannelID: "channel123",
@@ -424,6 +402,38 @@ func TestMattermostEditEvent_GetTargetMessage(t *testing.T) {
 	assert.Equal(t, networkid.MessageID("post_to_edit"), event.GetTargetMessage())
 }
 
+func TestEditParts(t *testing.T) {
+	part := func(id networkid.PartID, body string) *bridgev2.ConvertedMessagePart {
+		return &bridgev2.ConvertedMessagePart{ID: id, Type: event.EventMessage, Content: &event.MessageEventContent{Body: body}}
+	}
+	existing := []*database.Message{
+		{ID: "post1", PartID: "", MXID: "$text"},
+		{ID: "post1", PartID: "file1", MXID: "$file1"},
+		{ID: "post1", PartID: "file2", MXID: "$file2"},
+	}
+
+	// Text-only edits only modify the text
+	edit := editParts(&bridgev2.ConvertedMessage{Parts: []*bridgev2.ConvertedMessagePart{part("", "edited"), part("file1", "a.png"), part("file2", "b.png")}}, existing)
+	require.Len(t, edit.ModifiedParts, 3)
+	assert.Equal(t, "edited", edit.ModifiedParts[0].Content.Body)
+	assert.Empty(t, edit.DeletedParts)
+	assert.Nil(t, edit.AddedParts)
+
+	// Removed files are redacted and added files are sent in the same thread
+	threadRoot := networkid.MessageID("root1")
+	edit = editParts(&bridgev2.ConvertedMessage{
+		ThreadRoot: &threadRoot,
+		Parts:      []*bridgev2.ConvertedMessagePart{part("", "text"), part("file1", "a.png"), part("file3", "c.png")},
+	}, existing)
+	require.Len(t, edit.ModifiedParts, 2)
+	require.Len(t, edit.DeletedParts, 1)
+	assert.EqualValues(t, "file2", edit.DeletedParts[0].PartID)
+	require.NotNil(t, edit.AddedParts)
+	require.Len(t, edit.AddedParts.Parts, 1)
+	assert.EqualValues(t, "file3", edit.AddedParts.Parts[0].ID)
+	assert.Equal(t, &threadRoot, edit.AddedParts.ThreadRoot)
+}
+
 func TestMattermostRemoveEvent_GetType(t *testing.T) {
 	event := &MattermostRemoveEvent{}
 	
@@ -496,3 +506,26 @@ func TestMattermostReactionEvent_GetRemovedEmojiID(t *testing.T) {
 	
 	assert.Equal(t, networkid.EmojiID("smile"), event.GetRemovedEmojiID())
 }
+
+func TestChannelBackfillEvent_CheckNeedsBackfill(t *testing.T) {
+	server := mmtest.NewServer(t)
+	server.AddChannel(&model.Channel{Id: "channel1", TotalMsgCount: 3, LastPostAt: 2000})
+
+	evt := &ChannelBackfillEvent{MattermostEvent: MattermostEvent{
+		Connector: &MattermostConnector{Client: NewClient(server.URL, server.AdminToken)},
+		ChannelID: "channel1",
+	}}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		latest   *database.Message
+		expected bool
+	}{
+		{nil, true},
+		{&database.Message{Timestamp: time.UnixMilli(1000)}, true},
+		{&database.Message{Timestamp: time.UnixMilli(2000)}, false},
+	} {
+		needsBackfill, err := evt.CheckNeedsBackfill(ctx, tc.latest)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, needsBackfill)
+	}
+}
@@ -0,0 +1,92 @@
+package mattermost
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// threadRootQuoteMaxRunes is how much of a thread root is quoted in replies to it
+const threadRootQuoteMaxRunes = 300
+
+// Replies to a post that was never bridged to the room, like a post from before the room was
+// created, would not be in a thread on Matrix. Instead, they quote the root post. They still
+// keep their thread root, so they're stored in the thread and later replies are threaded
+// under the first one.
+
+// isThreadRootMissing checks whether the thread of a reply has no message in the room yet.
+// The reply itself may already be there, when it's edited.
+func isThreadRootMissing(ctx context.Context, portal *bridgev2.Portal, rootID, postID string) bool {
+	if rootID == "" || portal.Bridge == nil || portal.Bridge.DB == nil {
+		return false
+	}
+	first, err := portal.Bridge.DB.Message.GetFirstThreadMessage(ctx, portal.PortalKey, networkid.MessageID(rootID))
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("root_id", rootID).Msg("Failed to get thread root from database")
+		return false
+	}
+	return first == nil || first.ID == networkid.MessageID(postID)
+}
+
+// threadRootQuote renders the quote of a thread root post
+func (m *MattermostConnector) threadRootQuote(ctx context.Context, client *Client, root *model.Post) event.MessageEventContent {
+	text := root.Message
+	if utf8.RuneCountInString(text) > threadRootQuoteMaxRunes {
+		text = string([]rune(text)[:threadRootQuoteMaxRunes]) + "…"
+	}
+	if text == "" && len(root.FileIds) > 0 {
+		text = "(attachment)"
+	}
+	username := root.UserId
+	if user, err := m.getUser(ctx, client, root.UserId); err == nil {
+		username = user.Username
+	}
+	lines := strings.Split("**@"+username+"** wrote:\n"+text, "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+	return format.RenderMarkdown(strings.Join(lines, "\n"), true, false)
+}
+
+// quoteThreadRoot adds the quote of a reply's thread root if the root isn't in the room
+func (m *MattermostConnector) quoteThreadRoot(ctx context.Context, portal *bridgev2.Portal, client *Client, msg *bridgev2.ConvertedMessage, rootID, postID string) {
+	if !isThreadRootMissing(ctx, portal, rootID, postID) {
+		return
+	}
+	root, resp, err := client.GetPost(ctx, rootID, "")
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(wrapMattermostError(resp, err)).Str("root_id", rootID).Msg("Failed to get thread root to quote it")
+		return
+	}
+	prependQuote(msg, m.threadRootQuote(ctx, client, root))
+}
+
+// prependQuote adds a quote before the text of a message, or as its first part if it only
+// has files
+func prependQuote(msg *bridgev2.ConvertedMessage, quote event.MessageEventContent) {
+	for _, part := range msg.Parts {
+		content := part.Content
+		if part.Type != event.EventMessage || part.ID != "" || (content.MsgType != event.MsgText && content.MsgType != event.MsgNotice) {
+			continue
+		}
+		if content.FormattedBody == "" {
+			content.Format = event.FormatHTML
+			content.FormattedBody = event.TextToHTML(content.Body)
+		}
+		content.Body = quote.Body + "\n\n" + content.Body
+		content.FormattedBody = quote.FormattedBody + content.FormattedBody
+		return
+	}
+	quote.MsgType = event.MsgText
+	msg.Parts = append([]*bridgev2.ConvertedMessagePart{{
+		Type:    event.EventMessage,
+		Content: &quote,
+	}}, msg.Parts...)
+}
@@ -0,0 +1,63 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestIsThreadRootMissing(t *testing.T) {
+	ctx := context.Background()
+	bridgeDB := newTestBridgeDB(t)
+	require.NoError(t, bridgeDB.Ghost.Insert(ctx, &database.Ghost{BridgeID: "mattermost", ID: "alice", Metadata: map[string]any{}}))
+	portalKey := networkid.PortalKey{ID: "channel1"}
+	require.NoError(t, bridgeDB.Portal.Insert(ctx, &database.Portal{BridgeID: "mattermost", PortalKey: portalKey, MXID: "!room:example.com"}))
+	portal := &bridgev2.Portal{Portal: &database.Portal{BridgeID: "mattermost", PortalKey: portalKey}, Bridge: &bridgev2.Bridge{DB: bridgeDB}}
+
+	assert.False(t, isThreadRootMissing(ctx, portal, "", "reply1"))
+	assert.True(t, isThreadRootMissing(ctx, portal, "root1", "reply1"))
+
+	// The first reply is stored in the thread, so only it is still missing the root
+	require.NoError(t, bridgeDB.Message.Insert(ctx, &database.Message{
+		BridgeID: "mattermost", ID: "reply1", MXID: "$reply1", Room: portalKey, SenderID: "alice",
+		ThreadRoot: "root1", Timestamp: time.UnixMilli(1),
+	}))
+	assert.True(t, isThreadRootMissing(ctx, portal, "root1", "reply1"))
+	assert.False(t, isThreadRootMissing(ctx, portal, "root1", "reply2"))
+
+	require.NoError(t, bridgeDB.Message.Insert(ctx, &database.Message{
+		BridgeID: "mattermost", ID: "root2", MXID: "$root2", Room: portalKey, SenderID: "alice", Timestamp: time.UnixMilli(2),
+	}))
+	assert.False(t, isThreadRootMissing(ctx, portal, "root2", "reply3"))
+}
+
+func TestPrependQuote(t *testing.T) {
+	quote := event.MessageEventContent{Body: "> quote", Format: event.FormatHTML, FormattedBody: "<blockquote>quote</blockquote>"}
+
+	msg := &bridgev2.ConvertedMessage{Parts: []*bridgev2.ConvertedMessagePart{{
+		Type:    event.EventMessage,
+		Content: &event.MessageEventContent{MsgType: event.MsgText, Body: "reply"},
+	}}}
+	prependQuote(msg, quote)
+	require.Len(t, msg.Parts, 1)
+	assert.Equal(t, "> quote\n\nreply", msg.Parts[0].Content.Body)
+	assert.Equal(t, "<blockquote>quote</blockquote>reply", msg.Parts[0].Content.FormattedBody)
+
+	// Replies with only files get the quote as their own part
+	msg = &bridgev2.ConvertedMessage{Parts: []*bridgev2.ConvertedMessagePart{{
+		ID:      "file1",
+		Type:    event.EventMessage,
+		Content: &event.MessageEventContent{MsgType: event.MsgImage, Body: "image.png"},
+	}}}
+	prependQuote(msg, quote)
+	require.Len(t, msg.Parts, 2)
+	assert.Equal(t, "> quote", msg.Parts[0].Content.Body)
+	assert.Equal(t, event.MsgText, msg.Parts[0].Content.MsgType)
+}
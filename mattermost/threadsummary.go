@@ -0,0 +1,175 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+// With thread_summaries, the bridged root of a Mattermost thread is edited to show how many
+// replies the thread has and when the last one was posted, so that busy threads stand out
+// in Matrix clients that don't show threads. Only the text of the root is edited.
+
+// threadSummaryDelay is how long the bridge waits after a reply before updating the summary
+// of its thread, so that busy threads are only edited once in a while
+const threadSummaryDelay = 30 * time.Second
+
+// ThreadSummary is the reply count and last activity of a thread
+type ThreadSummary struct {
+	ReplyCount  int64
+	LastReplyAt time.Time
+}
+
+// postThreadSummary returns the thread summary of a root post, or nil if it has no replies
+func postThreadSummary(post *model.Post) *ThreadSummary {
+	if post.RootId != "" || post.ReplyCount <= 0 {
+		return nil
+	}
+	return &ThreadSummary{ReplyCount: post.ReplyCount, LastReplyAt: time.UnixMilli(post.LastReplyAt)}
+}
+
+// String renders the summary as it's shown under the thread root
+func (s *ThreadSummary) String() string {
+	replies := "replies"
+	if s.ReplyCount == 1 {
+		replies = "reply"
+	}
+	text := fmt.Sprintf("💬 %d %s", s.ReplyCount, replies)
+	if !s.LastReplyAt.IsZero() && s.LastReplyAt.UnixMilli() > 0 {
+		text += ", last " + s.LastReplyAt.Format("2006-01-02 15:04")
+	}
+	return text
+}
+
+// appendThreadSummary adds a thread summary under the text of a message. It returns false
+// if the message has no text part to add it to.
+func appendThreadSummary(msg *bridgev2.ConvertedMessage, summary *ThreadSummary) bool {
+	for _, part := range msg.Parts {
+		content := part.Content
+		if part.Type != event.EventMessage || part.ID != "" || (content.MsgType != event.MsgText && content.MsgType != event.MsgNotice) {
+			continue
+		}
+		if content.FormattedBody == "" {
+			content.Format = event.FormatHTML
+			content.FormattedBody = event.TextToHTML(content.Body)
+		}
+		text := summary.String()
+		content.Body += "\n\n" + text
+		content.FormattedBody += "<br><br><em>" + html.EscapeString(text) + "</em>"
+		return true
+	}
+	return false
+}
+
+// threadSummaryParts returns the edits of a thread root with a summary, which only change
+// the text part, as the files of the post stay the same
+func threadSummaryParts(msg *bridgev2.ConvertedMessage, existing []*database.Message) []*bridgev2.ConvertedEditPart {
+	var parts []*bridgev2.ConvertedEditPart
+	for _, dbMsg := range existing {
+		for _, part := range msg.Parts {
+			if part.ID == dbMsg.PartID && part.ID == "" {
+				parts = append(parts, part.ToEditPart(dbMsg))
+			}
+		}
+	}
+	return parts
+}
+
+// threadSummaries remembers the threads whose summary update is already scheduled
+type threadSummaries struct {
+	lock    sync.Mutex
+	pending map[string]bool
+}
+
+// schedule marks the summary of a thread as scheduled, returning false if it already was
+func (t *threadSummaries) schedule(key string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.pending[key] {
+		return false
+	}
+	if t.pending == nil {
+		t.pending = make(map[string]bool)
+	}
+	t.pending[key] = true
+	return true
+}
+
+// done clears the scheduled mark of a thread
+func (t *threadSummaries) done(key string) {
+	t.lock.Lock()
+	delete(t.pending, key)
+	t.lock.Unlock()
+}
+
+// queueThreadSummary schedules an update of the summary of the thread a reply is in
+func (m *MattermostConnector) queueThreadSummary(server string, reply *model.Post) {
+	if !m.config().ThreadSummaries || reply.RootId == "" {
+		return
+	}
+	key := server + "/" + reply.RootId
+	if !m.threadSummaries.schedule(key) {
+		return
+	}
+	time.AfterFunc(threadSummaryDelay, func() {
+		m.threadSummaries.done(key)
+		log := m.moduleLog(LogModuleWebSocket).With().Str("root_id", reply.RootId).Logger()
+		ctx, cancel := m.eventContext(log)
+		defer cancel()
+		m.updateThreadSummary(ctx, server, reply.RootId)
+	})
+}
+
+// updateThreadSummary edits the bridged root of a thread to show its current summary
+func (m *MattermostConnector) updateThreadSummary(ctx context.Context, server, rootID string) {
+	log := zerolog.Ctx(ctx)
+	if m.Bridge == nil || m.Bridge.DB == nil {
+		return
+	}
+	bridged, err := m.Bridge.DB.Message.GetFirstPartByID(ctx, "", networkid.MessageID(rootID))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get thread root from database")
+		return
+	} else if bridged == nil {
+		return
+	}
+	root, resp, err := m.serverClient(server).GetPost(ctx, rootID, "")
+	if err != nil {
+		log.Warn().Err(wrapMattermostError(resp, err)).Msg("Failed to get thread root for summary")
+		return
+	}
+	// The summary is added to the text of the root, posts with only files are left alone.
+	// Roots that came from Matrix are events of Matrix users, which the bridge can't edit.
+	summary := postThreadSummary(root)
+	if summary == nil || root.Message == "" || m.ignoredPostReason(root) != "" {
+		return
+	}
+	m.queueRemoteEvent(&MattermostEditEvent{
+		MattermostMessageEvent: MattermostMessageEvent{
+			MattermostEvent: MattermostEvent{
+				Connector: m,
+				Server:    server,
+				Timestamp: time.Now(),
+				ChannelID: root.ChannelId,
+				UserID:    root.UserId,
+				Username:  m.getServerUsername(ctx, server, root.UserId),
+			},
+			PostID:   root.Id,
+			Content:  root.Message,
+			FileIds:  root.FileIds,
+			Priority: root.GetPriority(),
+			PostType: root.Type,
+			Preview:  permalinkPreview(root),
+		},
+		Summary: summary,
+	})
+}
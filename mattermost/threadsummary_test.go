@@ -0,0 +1,53 @@
+package mattermost
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestPostThreadSummary(t *testing.T) {
+	assert.Nil(t, postThreadSummary(&model.Post{}))
+	assert.Nil(t, postThreadSummary(&model.Post{RootId: "root1", ReplyCount: 2}))
+
+	lastReply := time.Date(2024, 5, 1, 12, 34, 0, 0, time.Local)
+	summary := postThreadSummary(&model.Post{ReplyCount: 3, LastReplyAt: lastReply.UnixMilli()})
+	require.NotNil(t, summary)
+	assert.Equal(t, "💬 3 replies, last 2024-05-01 12:34", summary.String())
+	assert.Equal(t, "💬 1 reply", (&ThreadSummary{ReplyCount: 1}).String())
+}
+
+func TestAppendThreadSummary(t *testing.T) {
+	summary := &ThreadSummary{ReplyCount: 2}
+	msg := &bridgev2.ConvertedMessage{Parts: []*bridgev2.ConvertedMessagePart{
+		{ID: "file1", Type: event.EventMessage, Content: &event.MessageEventContent{MsgType: event.MsgImage, Body: "image.png"}},
+		{Type: event.EventMessage, Content: &event.MessageEventContent{MsgType: event.MsgText, Body: "root"}},
+	}}
+	require.True(t, appendThreadSummary(msg, summary))
+	assert.Equal(t, "root\n\n💬 2 replies", msg.Parts[1].Content.Body)
+	assert.Equal(t, "root<br><br><em>💬 2 replies</em>", msg.Parts[1].Content.FormattedBody)
+	assert.Equal(t, "image.png", msg.Parts[0].Content.Body)
+
+	// Only the text part of the root is edited
+	parts := threadSummaryParts(msg, []*database.Message{{ID: "root1", PartID: "file1"}, {ID: "root1"}})
+	require.Len(t, parts, 1)
+	assert.Equal(t, "root\n\n💬 2 replies", parts[0].Content.Body)
+
+	filesOnly := &bridgev2.ConvertedMessage{Parts: msg.Parts[:1]}
+	assert.False(t, appendThreadSummary(filesOnly, summary))
+}
+
+func TestThreadSummaries_Schedule(t *testing.T) {
+	var summaries threadSummaries
+	assert.True(t, summaries.schedule("/root1"))
+	assert.False(t, summaries.schedule("/root1"))
+	assert.True(t, summaries.schedule("/root2"))
+	summaries.done("/root1")
+	assert.True(t, summaries.schedule("/root1"))
+}
@@ -0,0 +1,104 @@
+package mattermost
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+// Mattermost channels have a purpose, shown in the channel list, and a header, shown at the
+// top of the channel. channel_topic picks which of them is the topic of the Matrix room.
+const (
+	TopicPurpose = "purpose"
+	TopicHeader  = "header"
+	// TopicBoth joins the purpose and the header with a blank line
+	TopicBoth = "both"
+)
+
+// topicSeparator separates the purpose and the header in the topic with TopicBoth
+const topicSeparator = "\n\n"
+
+var _ bridgev2.RoomTopicHandlingNetworkAPI = (*MattermostAPI)(nil)
+
+// topicSource returns the channel_topic setting, defaulting to the purpose
+func (m *MattermostConnector) topicSource() string {
+	if m == nil || m.config() == nil {
+		return TopicPurpose
+	}
+	switch m.config().ChannelTopic {
+	case TopicHeader, TopicBoth:
+		return m.config().ChannelTopic
+	default:
+		return TopicPurpose
+	}
+}
+
+// channelTopic returns the Matrix room topic of a channel
+func (m *MattermostConnector) channelTopic(channel *model.Channel) string {
+	switch m.topicSource() {
+	case TopicHeader:
+		return channel.Header
+	case TopicBoth:
+		if channel.Purpose == "" || channel.Header == "" {
+			return channel.Purpose + channel.Header
+		}
+		return channel.Purpose + topicSeparator + channel.Header
+	default:
+		return channel.Purpose
+	}
+}
+
+// topicPatch returns the channel patch that sets a Matrix room topic. With TopicBoth, the
+// topic is only split if it still ends with the current header, otherwise all of it becomes
+// the purpose.
+func (m *MattermostConnector) topicPatch(channel *model.Channel, topic string) (*model.ChannelPatch, error) {
+	field, maxRunes := "purpose", model.ChannelPurposeMaxRunes
+	patch := &model.ChannelPatch{}
+	switch m.topicSource() {
+	case TopicHeader:
+		field, maxRunes = "header", model.ChannelHeaderMaxRunes
+		patch.Header = &topic
+	case TopicBoth:
+		if channel.Header != "" && topic == channel.Header {
+			topic = ""
+		} else if channel.Header != "" {
+			topic = strings.TrimSuffix(topic, topicSeparator+channel.Header)
+		}
+		patch.Purpose = &topic
+	default:
+		patch.Purpose = &topic
+	}
+	if utf8.RuneCountInString(topic) > maxRunes {
+		return nil, fmt.Errorf("topic is too long for the channel %s, the maximum is %d characters", field, maxRunes)
+	}
+	return patch, nil
+}
+
+// HandleMatrixRoomTopic updates the purpose or header of a channel when the topic of its room
+// is changed on Matrix
+func (m *MattermostAPI) HandleMatrixRoomTopic(ctx context.Context, msg *bridgev2.MatrixRoomTopic) (bool, error) {
+	if !isChannelPortal(msg.Portal) {
+		return false, fmt.Errorf("topics of spaces aren't bridged")
+	}
+	channelID := string(msg.Portal.ID)
+	channel, err := m.Connector.getCachedChannel(ctx, m.Client(), channelID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get channel: %w", err)
+	}
+	patch, err := m.Connector.topicPatch(channel, msg.Content.Topic)
+	if err != nil {
+		return false, err
+	}
+	_, resp, err := m.Client().PatchChannel(ctx, channelID, patch)
+	if err != nil {
+		return false, fmt.Errorf("failed to update channel: %w", wrapMattermostError(resp, err))
+	}
+	m.Connector.channelCache.invalidate(channelID)
+	msg.Portal.Topic = msg.Content.Topic
+	msg.Portal.TopicSet = true
+	return true, nil
+}
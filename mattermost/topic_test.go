@@ -0,0 +1,89 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestChannelTopic(t *testing.T) {
+	m := &MattermostConnector{Config: &NetworkConfig{}}
+	channel := &model.Channel{Purpose: "Team chat", Header: "Standup at 10"}
+
+	assert.Equal(t, "Team chat", m.channelTopic(channel))
+	m.config().ChannelTopic = TopicHeader
+	assert.Equal(t, "Standup at 10", m.channelTopic(channel))
+	m.config().ChannelTopic = TopicBoth
+	assert.Equal(t, "Team chat\n\nStandup at 10", m.channelTopic(channel))
+	assert.Equal(t, "Standup at 10", m.channelTopic(&model.Channel{Header: "Standup at 10"}))
+}
+
+func TestTopicPatch(t *testing.T) {
+	m := &MattermostConnector{Config: &NetworkConfig{}}
+	channel := &model.Channel{Purpose: "Team chat", Header: "Standup at 10"}
+
+	patch, err := m.topicPatch(channel, "New purpose")
+	require.NoError(t, err)
+	assert.Equal(t, "New purpose", *patch.Purpose)
+	assert.Nil(t, patch.Header)
+
+	m.config().ChannelTopic = TopicHeader
+	patch, err = m.topicPatch(channel, "New header")
+	require.NoError(t, err)
+	assert.Equal(t, "New header", *patch.Header)
+	assert.Nil(t, patch.Purpose)
+
+	// With both, the header part of the topic is left to the header
+	m.config().ChannelTopic = TopicBoth
+	patch, err = m.topicPatch(channel, "New purpose\n\nStandup at 10")
+	require.NoError(t, err)
+	assert.Equal(t, "New purpose", *patch.Purpose)
+	patch, err = m.topicPatch(channel, "Something else")
+	require.NoError(t, err)
+	assert.Equal(t, "Something else", *patch.Purpose)
+
+	m.config().ChannelTopic = TopicPurpose
+	_, err = m.topicPatch(channel, string(make([]byte, model.ChannelPurposeMaxRunes+1)))
+	assert.Error(t, err)
+}
+
+func TestHandleMatrixRoomTopic(t *testing.T) {
+	var patch model.ChannelPatch
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/channels/channel1":
+			_ = json.NewEncoder(w).Encode(&model.Channel{Id: "channel1", Type: model.ChannelTypeOpen, Header: "Old header"})
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v4/channels/channel1/patch":
+			_ = json.NewDecoder(r.Body).Decode(&patch)
+			_ = json.NewEncoder(w).Encode(&model.Channel{Id: "channel1"})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	api := newMattermostAPI(nil, &MattermostConnector{Config: &NetworkConfig{ChannelTopic: TopicHeader}}, NewClient(server.URL, "token"))
+	portal := &bridgev2.Portal{Portal: &database.Portal{PortalKey: networkid.PortalKey{ID: "channel1"}}}
+	changed, err := api.HandleMatrixRoomTopic(context.Background(), &bridgev2.MatrixRoomTopic{
+		MatrixEventBase: bridgev2.MatrixEventBase[*event.TopicEventContent]{
+			Portal:  portal,
+			Content: &event.TopicEventContent{Topic: "New header"},
+		},
+	})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "New header", *patch.Header)
+	assert.Nil(t, patch.Purpose)
+	assert.Equal(t, "New header", portal.Topic)
+	assert.True(t, portal.TopicSet)
+}
@@ -0,0 +1,145 @@
+package mattermost
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// Limits of the Mattermost user cache
+const (
+	userCacheSize = 5000
+	userCacheTTL  = 10 * time.Minute
+)
+
+// userCache is an LRU cache of Mattermost users, so that looking up the sender of every
+// event doesn't need an API call. Entries expire after userCacheTTL in case a
+// user_updated event is missed. The zero value is ready to use.
+type userCache struct {
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+	size    int
+	ttl     time.Duration
+}
+
+type userCacheEntry struct {
+	user    *model.User
+	expires time.Time
+}
+
+func (c *userCache) init() {
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.order = list.New()
+	}
+	if c.size <= 0 {
+		c.size = userCacheSize
+	}
+	if c.ttl <= 0 {
+		c.ttl = userCacheTTL
+	}
+}
+
+// get returns a cached user, or nil if it isn't cached or has expired
+func (c *userCache) get(userID string) *model.User {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.init()
+	elem, ok := c.entries[userID]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*userCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, userID)
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return entry.user
+}
+
+// set caches a user, evicting the least recently used one if the cache is full
+func (c *userCache) set(user *model.User) {
+	if user == nil || user.Id == "" {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.init()
+	entry := &userCacheEntry{user: user, expires: time.Now().Add(c.ttl)}
+	if elem, ok := c.entries[user.Id]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[user.Id] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*userCacheEntry).user.Id)
+	}
+}
+
+// invalidate removes a user from the cache
+func (c *userCache) invalidate(userID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[userID]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, userID)
+	}
+}
+
+// getUser returns a Mattermost user, from the cache if possible. Users that aren't cached
+// are fetched with the given client, as logins may not share the bridge's admin token.
+func (m *MattermostConnector) getUser(ctx context.Context, client *Client, userID string) (*model.User, error) {
+	if user := m.userCache.get(userID); user != nil {
+		return user, nil
+	}
+	user, resp, err := client.GetUser(ctx, userID, "")
+	if err != nil {
+		return nil, wrapMattermostError(resp, err)
+	}
+	m.userCache.set(user)
+	return user, nil
+}
+
+// usersPerPage is the page size for listing users, the maximum Mattermost allows
+const usersPerPage = 200
+
+// getChannelUsers returns all users in a channel and caches them
+func (m *MattermostConnector) getChannelUsers(ctx context.Context, client *Client, channelID string) ([]*model.User, error) {
+	return m.getUserPages(func(page int) ([]*model.User, *model.Response, error) {
+		return client.GetUsersInChannel(ctx, channelID, page, usersPerPage, "")
+	})
+}
+
+// getTeamUsers returns all users in a team and caches them
+func (m *MattermostConnector) getTeamUsers(ctx context.Context, client *Client, teamID string) ([]*model.User, error) {
+	return m.getUserPages(func(page int) ([]*model.User, *model.Response, error) {
+		return client.GetUsersInTeam(ctx, teamID, page, usersPerPage, "")
+	})
+}
+
+// getUserPages fetches pages of users until a page isn't full
+func (m *MattermostConnector) getUserPages(getPage func(page int) ([]*model.User, *model.Response, error)) ([]*model.User, error) {
+	var users []*model.User
+	for page := 0; ; page++ {
+		pageUsers, resp, err := getPage(page)
+		if err != nil {
+			return nil, wrapMattermostError(resp, err)
+		}
+		for _, user := range pageUsers {
+			m.userCache.set(user)
+		}
+		users = append(users, pageUsers...)
+		if len(pageUsers) < usersPerPage {
+			return users, nil
+		}
+	}
+}
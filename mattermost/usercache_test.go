@@ -0,0 +1,68 @@
+package mattermost
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserCache_GetSetInvalidate(t *testing.T) {
+	var cache userCache
+	assert.Nil(t, cache.get("alice"))
+
+	cache.set(&model.User{Id: "alice", Username: "alice"})
+	user := cache.get("alice")
+	require.NotNil(t, user)
+	assert.Equal(t, "alice", user.Username)
+
+	cache.set(&model.User{Id: "alice", Username: "alice2"})
+	assert.Equal(t, "alice2", cache.get("alice").Username)
+
+	cache.invalidate("alice")
+	assert.Nil(t, cache.get("alice"))
+}
+
+func TestUserCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache := userCache{size: 2}
+	cache.set(&model.User{Id: "alice"})
+	cache.set(&model.User{Id: "bob"})
+	// Using alice makes bob the least recently used user
+	require.NotNil(t, cache.get("alice"))
+	cache.set(&model.User{Id: "carol"})
+
+	assert.NotNil(t, cache.get("alice"))
+	assert.Nil(t, cache.get("bob"))
+	assert.NotNil(t, cache.get("carol"))
+}
+
+func TestUserCache_Expires(t *testing.T) {
+	cache := userCache{ttl: time.Millisecond}
+	cache.set(&model.User{Id: "alice"})
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(t, cache.get("alice"))
+}
+
+func TestGetUserPages(t *testing.T) {
+	m := &MattermostConnector{}
+	var pages []int
+	users, err := m.getUserPages(func(page int) ([]*model.User, *model.Response, error) {
+		pages = append(pages, page)
+		count := usersPerPage
+		if page == 2 {
+			count = 3
+		}
+		pageUsers := make([]*model.User, count)
+		for i := range pageUsers {
+			pageUsers[i] = &model.User{Id: fmt.Sprintf("user-%d-%d", page, i)}
+		}
+		return pageUsers, &model.Response{StatusCode: 200}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, pages)
+	assert.Len(t, users, 2*usersPerPage+3)
+	assert.NotNil(t, m.userCache.get("user-2-0"), "fetched users should be cached")
+}
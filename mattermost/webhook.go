@@ -0,0 +1,163 @@
+package mattermost
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+// EventSourceConfig selects how the bridge receives events from Mattermost
+type EventSourceConfig struct {
+	WebSocket bool              `yaml:"websocket"`
+	Webhook   WebhookConfig     `yaml:"webhook"`
+	Events    EventFilterConfig `yaml:"events"`
+}
+
+// WebhookConfig configures receiving posts through Mattermost outgoing webhooks, for
+// setups where the bridge can't keep a WebSocket connection to Mattermost open. The
+// webhooks must be created in Mattermost with the callback URL
+// <appservice.public_address>/mattermost/webhook.
+type WebhookConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Tokens  []string `yaml:"tokens"`
+}
+
+const webhookPath = "/mattermost/webhook"
+
+var ErrWebhookNoTokens = errors.New("event_source.webhook.tokens must be set to receive outgoing webhooks")
+
+// registerWebhookEndpoint adds the outgoing webhook endpoint to the appservice HTTP server
+func (m *MattermostConnector) registerWebhookEndpoint() error {
+	cfg := m.config().EventSource.Webhook
+	if !cfg.Enabled {
+		return nil
+	} else if len(cfg.Tokens) == 0 {
+		return ErrWebhookNoTokens
+	}
+	server, ok := m.Bridge.Matrix.(bridgev2.MatrixConnectorWithServer)
+	if !ok || server.GetRouter() == nil {
+		return errors.New("outgoing webhooks need the appservice HTTP server")
+	}
+	server.GetRouter().HandleFunc(webhookPath, m.handleWebhook).Methods(http.MethodPost)
+	log := m.moduleLog(LogModuleWebhook)
+	log.Info().Str("url", strings.TrimRight(server.GetPublicAddress(), "/")+webhookPath).Msg("Outgoing webhook endpoint enabled")
+	return nil
+}
+
+// handleWebhook receives a post from a Mattermost outgoing webhook. The full post is
+// fetched from Mattermost, as the webhook payload doesn't include threads or props and
+// can't be trusted, and is bridged the same way as posts from the WebSocket, including
+// the event and mirror filters. Posts that can't be fetched are dropped.
+func (m *MattermostConnector) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := parseWebhookPayload(r)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	} else if !m.isWebhookTokenValid(payload.Token) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	log := m.moduleLog(LogModuleWebhook).With().
+		Str("channel_id", payload.ChannelId).
+		Str("post_id", payload.PostId).
+		Logger()
+	ctx := log.WithContext(r.Context())
+	if !m.config().EventSource.Events.Allows(model.WebsocketEventPosted) {
+		log.Trace().Msg("Ignoring outgoing webhook, posted events are excluded by the event filter")
+		writeEmptyWebhookResponse(w)
+		return
+	} else if !m.isChannelMirrored(ctx, payload.ChannelId) {
+		log.Trace().Msg("Ignoring outgoing webhook in channel excluded by mirror filters")
+		writeEmptyWebhookResponse(w)
+		return
+	}
+	// Only the post and channel IDs of the payload are used, anyone who knows a webhook
+	// token could forge the rest of it
+	server, post, err := m.getWebhookPost(ctx, payload)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get post of outgoing webhook, dropping it")
+		http.Error(w, "Failed to get post", http.StatusBadGateway)
+		return
+	}
+	m.eventWorkers.submit(post.ChannelId, func() {
+		ctx, cancel := m.eventContext(log)
+		defer cancel()
+		m.queueServerPost(ctx, server, post)
+	})
+	writeEmptyWebhookResponse(w)
+}
+
+// getWebhookPost fetches the post of an outgoing webhook from the server it was made on.
+// Webhooks don't say which server sent them, so each server is tried in turn.
+func (m *MattermostConnector) getWebhookPost(ctx context.Context, payload *model.OutgoingWebhookPayload) (string, *model.Post, error) {
+	var lastErr error
+	for _, server := range m.serverNames() {
+		post, resp, err := m.serverClient(server).GetPost(ctx, payload.PostId, "")
+		if err != nil {
+			if responseStatusCode(resp, err) != http.StatusNotFound {
+				lastErr = wrapMattermostError(resp, err)
+			}
+			continue
+		} else if post.ChannelId != payload.ChannelId {
+			continue
+		}
+		return server, post, nil
+	}
+	if lastErr != nil {
+		return "", nil, lastErr
+	}
+	return "", nil, fmt.Errorf("post %s wasn't found in channel %s", payload.PostId, payload.ChannelId)
+}
+
+// writeEmptyWebhookResponse answers an outgoing webhook. An empty response doesn't make
+// Mattermost post anything in reply.
+func writeEmptyWebhookResponse(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte("{}"))
+}
+
+// parseWebhookPayload reads an outgoing webhook request, which Mattermost sends either as
+// a form or as JSON depending on the webhook's content type setting
+func parseWebhookPayload(r *http.Request) (*model.OutgoingWebhookPayload, error) {
+	var payload model.OutgoingWebhookPayload
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		payload = model.OutgoingWebhookPayload{
+			Token:     r.FormValue("token"),
+			ChannelId: r.FormValue("channel_id"),
+			UserId:    r.FormValue("user_id"),
+			PostId:    r.FormValue("post_id"),
+			Text:      r.FormValue("text"),
+			FileIds:   r.FormValue("file_ids"),
+		}
+		payload.Timestamp, _ = strconv.ParseInt(r.FormValue("timestamp"), 10, 64)
+	}
+	if payload.PostId == "" || payload.ChannelId == "" {
+		return nil, errors.New("missing post or channel ID")
+	}
+	return &payload, nil
+}
+
+// isWebhookTokenValid checks a token against the tokens of the configured webhooks
+func (m *MattermostConnector) isWebhookTokenValid(token string) bool {
+	for _, valid := range m.config().EventSource.Webhook.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+			return true
+		}
+	}
+	return false
+}
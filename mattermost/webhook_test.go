@@ -0,0 +1,172 @@
+package mattermost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWebhookPayload(t *testing.T) {
+	form := url.Values{
+		"token":      {"secret"},
+		"channel_id": {"channel1"},
+		"post_id":    {"post1"},
+		"user_id":    {"user1"},
+		"text":       {"hello"},
+		"timestamp":  {"1700000000000"},
+		"file_ids":   {"file1,file2"},
+	}
+	req := httptest.NewRequest(http.MethodPost, webhookPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	payload, err := parseWebhookPayload(req)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", payload.Token)
+	assert.Equal(t, "post1", payload.PostId)
+	assert.Equal(t, int64(1700000000000), payload.Timestamp)
+	assert.Equal(t, "file1,file2", payload.FileIds)
+
+	body, _ := json.Marshal(model.OutgoingWebhookPayload{Token: "secret", ChannelId: "channel1", PostId: "post1"})
+	req = httptest.NewRequest(http.MethodPost, webhookPath, strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	payload, err = parseWebhookPayload(req)
+	require.NoError(t, err)
+	assert.Equal(t, "channel1", payload.ChannelId)
+
+	req = httptest.NewRequest(http.MethodPost, webhookPath, strings.NewReader("token=secret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = parseWebhookPayload(req)
+	assert.Error(t, err)
+}
+
+func TestHandleWebhook(t *testing.T) {
+	var postFetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/posts/post1":
+			postFetches.Add(1)
+			_ = json.NewEncoder(w).Encode(&model.Post{Id: "post1", ChannelId: "channel1", UserId: "user1", Message: "hello"})
+		case "/api/v4/users/user1":
+			_ = json.NewEncoder(w).Encode(&model.User{Id: "user1", Username: "alice"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	connector := &MattermostConnector{
+		Config: &NetworkConfig{EventSource: EventSourceConfig{Webhook: WebhookConfig{Enabled: true, Tokens: []string{"secret"}}}},
+		Client: NewClient(server.URL, "token"),
+		ctx:    context.Background(),
+	}
+	send := func(token string) int {
+		form := url.Values{"token": {token}, "channel_id": {"channel1"}, "post_id": {"post1"}}
+		req := httptest.NewRequest(http.MethodPost, webhookPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		connector.handleWebhook(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send("wrong"))
+	assert.Equal(t, int32(0), postFetches.Load())
+	assert.Equal(t, http.StatusOK, send("secret"))
+	assert.Equal(t, int32(1), postFetches.Load(), "the full post should be fetched")
+}
+
+func TestHandleWebhook_PostLookup(t *testing.T) {
+	var otherFetches atomic.Int32
+	mainServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer mainServer.Close()
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/posts/post1":
+			otherFetches.Add(1)
+			_ = json.NewEncoder(w).Encode(&model.Post{Id: "post1", ChannelId: "channel1", UserId: "user1", Message: "hello"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer otherServer.Close()
+
+	connector := &MattermostConnector{
+		Config: &NetworkConfig{EventSource: EventSourceConfig{Webhook: WebhookConfig{Enabled: true, Tokens: []string{"secret"}}}},
+		Client: NewClient(mainServer.URL, "token"),
+		ctx:    context.Background(),
+	}
+	connector.servers = map[string]*mattermostServer{
+		"":      {URL: mainServer.URL, Client: connector.Client},
+		"other": {Name: "other", URL: otherServer.URL, Client: NewClient(otherServer.URL, "token")},
+	}
+	send := func(channelID, postID string) int {
+		form := url.Values{"token": {"secret"}, "channel_id": {channelID}, "post_id": {postID}, "text": {"forged"}}
+		req := httptest.NewRequest(http.MethodPost, webhookPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		connector.handleWebhook(rr, req)
+		return rr.Code
+	}
+
+	// Posts are fetched from the server they were made on
+	server, post, err := connector.getWebhookPost(context.Background(), &model.OutgoingWebhookPayload{ChannelId: "channel1", PostId: "post1"})
+	require.NoError(t, err)
+	assert.Equal(t, "other", server)
+	assert.Equal(t, "hello", post.Message)
+
+	// Posts that can't be fetched are dropped instead of being made from the payload
+	assert.Equal(t, http.StatusBadGateway, send("channel1", "missing"))
+	assert.Equal(t, http.StatusBadGateway, send("channel2", "post1"))
+	assert.Equal(t, int32(2), otherFetches.Load())
+}
+
+func TestHandleWebhook_Filters(t *testing.T) {
+	var postFetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/posts/post1":
+			postFetches.Add(1)
+			_ = json.NewEncoder(w).Encode(&model.Post{Id: "post1", ChannelId: "channel1", UserId: "user1", Message: "hello"})
+		case "/api/v4/channels/channel1":
+			_ = json.NewEncoder(w).Encode(&model.Channel{Id: "channel1", Name: "off-topic", Type: model.ChannelTypeOpen})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &NetworkConfig{
+		Mode:        ModeMirror,
+		EventSource: EventSourceConfig{Webhook: WebhookConfig{Enabled: true, Tokens: []string{"secret"}}},
+	}
+	connector := &MattermostConnector{Config: cfg, Client: NewClient(server.URL, "token"), ctx: context.Background()}
+	send := func() int {
+		form := url.Values{"token": {"secret"}, "channel_id": {"channel1"}, "post_id": {"post1"}}
+		req := httptest.NewRequest(http.MethodPost, webhookPath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		connector.handleWebhook(rr, req)
+		return rr.Code
+	}
+
+	mirrorFilters, err := NewMirrorFilters(MirrorConfig{Channels: FilterConfig{Deny: []string{"off-topic"}}})
+	require.NoError(t, err)
+	connector.live.Store(&liveConfig{Config: cfg, MirrorFilters: mirrorFilters})
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, int32(0), postFetches.Load(), "posts in channels excluded by mirror filters shouldn't be bridged")
+
+	eventCfg := *cfg
+	eventCfg.EventSource.Events = EventFilterConfig{Deny: []string{string(model.WebsocketEventPosted)}}
+	connector.live.Store(&liveConfig{Config: &eventCfg})
+	assert.Equal(t, http.StatusOK, send())
+	assert.Equal(t, int32(0), postFetches.Load(), "posts should follow the event filter")
+}
@@ -1,46 +1,244 @@
 package mattermost
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
 )
 
+// Delays between WebSocket reconnection attempts
+const (
+	wsReconnectMinDelay = 2 * time.Second
+	wsReconnectMaxDelay = 2 * time.Minute
+)
+
+type wsSequenceResult int
+
+const (
+	wsSequenceOK wsSequenceResult = iota
+	// wsSequenceDuplicate means the event was already handled before a resume
+	wsSequenceDuplicate
+	// wsSequenceGap means events were lost, either in the connection or because
+	// the server couldn't resume it
+	wsSequenceGap
+)
+
+// wsSequence tracks the sequence numbers of WebSocket events. Mattermost numbers the events
+// of each connection, and when a client reconnects with the connection ID and the next
+// sequence number, the server replays the events the client missed if it still has them.
+type wsSequence struct {
+	lock         sync.Mutex
+	connectionID string
+	next         int64
+}
+
+// track checks the sequence number of an event
+func (s *wsSequence) track(event *model.WebSocketEvent) wsSequenceResult {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seq := event.GetSequence()
+	if event.EventType() == model.WebsocketEventHello {
+		connectionID, _ := event.GetData()["connection_id"].(string)
+		if connectionID == s.connectionID {
+			return wsSequenceOK
+		}
+		// A new connection, sequence numbers start over
+		resumeFailed := s.connectionID != ""
+		s.connectionID = connectionID
+		s.next = seq + 1
+		if resumeFailed {
+			return wsSequenceGap
+		}
+		return wsSequenceOK
+	}
+	switch {
+	case seq < s.next:
+		return wsSequenceDuplicate
+	case seq > s.next:
+		s.next = seq + 1
+		return wsSequenceGap
+	default:
+		s.next = seq + 1
+		return wsSequenceOK
+	}
+}
+
+// resumeParams returns the connection ID and sequence number to resume the connection with
+func (s *wsSequence) resumeParams() (string, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.connectionID, s.next
+}
+
+// StartWebSocket connects to the WebSocket of each Mattermost server and keeps them
+// connected. Short disconnects are resumed without losing events; if events were lost
+// anyway, the bridge catches up on missed posts like it does on startup.
 func (m *MattermostConnector) StartWebSocket() {
-	wsURL := m.Config.ServerURL
+	var ctx context.Context
+	ctx, m.stopWebSocket = context.WithCancel(m.ctx)
+	for _, name := range m.serverNames() {
+		go m.runWebSocket(ctx, m.servers[name])
+	}
+}
+
+func (m *MattermostConnector) runWebSocket(ctx context.Context, srv *mattermostServer) {
+	log := m.moduleLog(LogModuleWebSocket).With().Str("server", srv.Name).Logger()
+	delay := wsReconnectMinDelay
+	for {
+		wsClient, err := m.connectWebSocket(srv)
+		if err != nil {
+			log.Err(err).Dur("retry_in", delay).Msg("Failed to connect to WebSocket")
+		} else {
+			delay = wsReconnectMinDelay
+			if srv.Name == "" {
+				m.WSClient.Store(wsClient)
+			}
+			m.readWebSocket(ctx, srv, wsClient)
+			if srv.Name == "" {
+				m.WSClient.Store(nil)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warn().AnErr("listen_error", wsClient.ListenError).Dur("retry_in", delay).Msg("WebSocket disconnected")
+			m.notifyStatusAsync(statusKeyWebSocket, "WebSocket to %s disconnected, reconnecting", srv.URL)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, wsReconnectMaxDelay)
+	}
+}
+
+// connectWebSocket opens a WebSocket connection to a server, resuming the previous one if
+// there was one
+func (m *MattermostConnector) connectWebSocket(srv *mattermostServer) (*model.WebSocketClient, error) {
+	wsURL := srv.URL
 	wsURL = strings.Replace(wsURL, "http://", "ws://", 1)
 	wsURL = strings.Replace(wsURL, "https://", "wss://", 1)
+	token, err := m.serverWSToken(srv)
+	if err != nil {
+		return nil, err
+	}
 
-	// Connect to WebSocket
-	wsClient, err := model.NewWebSocketClient4(wsURL, m.Client.AdminToken)
+	var wsClient *model.WebSocketClient
+	if connectionID, next := srv.wsSequence.resumeParams(); connectionID != "" {
+		wsClient, err = model.NewReliableWebSocketClientWithDialer(websocket.DefaultDialer, wsURL, token, connectionID, int(next), false)
+	} else {
+		wsClient, err = model.NewWebSocketClient4(wsURL, token)
+	}
 	if err != nil {
-		fmt.Printf("Failed to create WebSocket client: %v\n", err)
-		return
+		return nil, err
 	}
-	m.WSClient = wsClient
-	m.WSClient.Listen()
-
-	go func() {
-		for {
-			select {
-			case event, ok := <-m.WSClient.EventChannel:
-				if !ok {
-					return
+	wsClient.Listen()
+	return wsClient, nil
+}
+
+// readWebSocket handles the events of a connection until it's closed
+func (m *MattermostConnector) readWebSocket(ctx context.Context, srv *mattermostServer, wsClient *model.WebSocketClient) {
+	log := m.moduleLog(LogModuleWebSocket).With().Str("server", srv.Name).Logger()
+	done := ctx.Done()
+	for {
+		select {
+		case <-done:
+			// Closing the client closes the event channel, which ends the loop
+			wsClient.Close()
+			done = nil
+		case <-wsClient.PingTimeoutChannel:
+			log.Warn().Msg("WebSocket ping timed out, reconnecting")
+			wsClient.Close()
+		case event, ok := <-wsClient.EventChannel:
+			if !ok {
+				return
+			}
+			log.Trace().Str("event_type", string(event.EventType())).Int64("seq", event.GetSequence()).Msg("Received websocket event")
+			switch srv.wsSequence.track(event) {
+			case wsSequenceDuplicate:
+				continue
+			case wsSequenceGap:
+				if srv.Name != "" {
+					// Catching up uses the admin client of the main server
+					log.Warn().Int64("seq", event.GetSequence()).Msg("Missed WebSocket events")
+					break
 				}
-				fmt.Printf("DEBUG: Received websocket event: %s\n", event.EventType())
-				m.HandleWebSocketEvent(event)
-			case _ = <-m.WSClient.ResponseChannel:
-				// Handle responses if needed
+				// The catch-up of each channel is queued before the event that revealed the
+				// gap, which would otherwise move the last post time past the missed posts
+				log.Warn().Int64("seq", event.GetSequence()).Msg("Missed WebSocket events, catching up on missed posts")
+				if err := m.CatchUp(ctx); err != nil {
+					log.Err(err).Msg("Failed to catch up on missed posts")
+				}
+			}
+			// Events without a channel, like user updates, share a queue
+			var channelID string
+			if broadcast := event.GetBroadcast(); broadcast != nil {
+				channelID = broadcast.ChannelId
 			}
+			if !m.ownsChannel(channelID) {
+				continue
+			}
+			m.eventWorkers.submit(channelID, func() {
+				m.handleServerEvent(srv.Name, event)
+			})
+		case <-wsClient.ResponseChannel:
+			// Handle responses if needed
 		}
-	}()
+	}
+}
+
+// webSocketEventTimeout limits how long handling a single event may take, so that a stuck
+// request doesn't hold up the other events of its channel
+const webSocketEventTimeout = 2 * time.Minute
+
+// eventContext returns the context to handle an event in, which is canceled when the
+// connector stops or after webSocketEventTimeout
+func (m *MattermostConnector) eventContext(log zerolog.Logger) (context.Context, context.CancelFunc) {
+	ctx := m.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithTimeout(log.WithContext(ctx), webSocketEventTimeout)
 }
 
+// HandleWebSocketEvent handles an event of the main server
 func (m *MattermostConnector) HandleWebSocketEvent(event *model.WebSocketEvent) {
+	m.handleServerEvent("", event)
+}
+
+// handleServerEvent handles a WebSocket event of a server
+func (m *MattermostConnector) handleServerEvent(server string, event *model.WebSocketEvent) {
+	if !m.config().EventSource.Events.Allows(event.EventType()) {
+		return
+	}
+	logCtx := m.moduleLog(LogModuleWebSocket).With().Str("event_type", string(event.EventType()))
+	if server != "" {
+		logCtx = logCtx.Str("server", server)
+	}
+	if broadcast := event.GetBroadcast(); broadcast != nil {
+		logCtx = logCtx.Str("channel_id", broadcast.ChannelId).Str("team_id", broadcast.TeamId)
+	}
+	log := logCtx.Logger()
+	ctx, cancel := m.eventContext(log)
+	defer cancel()
+	if broadcast := event.GetBroadcast(); broadcast != nil && event.EventType() == model.WebsocketEventChannelUpdated {
+		// The filters may match the new name of the channel differently, including for
+		// this event
+		m.forgetChannelFilter(broadcast.ChannelId)
+	}
+	if broadcast := event.GetBroadcast(); broadcast != nil && !m.isChannelMirrored(ctx, broadcast.ChannelId) {
+		log.Trace().Msg("Ignoring event in channel excluded by mirror filters")
+		return
+	}
 	switch event.EventType() {
 	case model.WebsocketEventPosted:
 		postStr, ok := event.GetData()["post"].(string)
@@ -50,49 +248,11 @@ func (m *MattermostConnector) HandleWebSocketEvent(event *model.WebSocketEvent)
 		var post model.Post
 		err := json.Unmarshal([]byte(postStr), &post)
 		if err != nil {
+			log.Warn().Err(err).Msg("Failed to parse post in websocket event")
 			return
 		}
 
-		// Discard events from the bridge itself if necessary
-		// But bridgev2 handles some of this via SenderLogin/Sender
-
-		// Filter out system messages
-		if post.Type != "" && !strings.HasPrefix(post.Type, "custom_") {
-			return
-		}
-
-		evt := &MattermostMessageEvent{
-			MattermostEvent: MattermostEvent{
-				Connector: m,
-				Timestamp: time.Unix(post.CreateAt/1000, (post.CreateAt%1000)*1000000),
-				ChannelID: post.ChannelId,
-				UserID:    post.UserId,
-				Username:  m.GetUsername(m.ctx, post.UserId),
-			},
-			PostID:  post.Id,
-			Content: post.Message,
-			FileIds: post.FileIds,
-			RootID:  post.RootId, // Thread root for replies
-		}
-
-		// We need to find the correct UserLogin to queue this event.
-		// Since we are using an Admin API, we might have one primary login
-		// that "receives" all events, or we might need to map it.
-
-		// Dispatch to logins
-		logins := m.GetUsers()
-		fmt.Printf("DEBUG: Found %d logins for event\n", len(logins))
-		if m.IsMirrorMode() {
-			// In mirror mode, any login can process the event
-			if len(logins) > 0 {
-				m.Bridge.QueueRemoteEvent(logins[0], evt)
-			}
-		} else {
-			// In puppet mode, we might need to find the specific login
-			for _, login := range logins {
-				m.Bridge.QueueRemoteEvent(login, evt)
-			}
-		}
+		m.queueServerPost(ctx, server, &post)
 
 	case model.WebsocketEventPostEdited:
 		postStr, ok := event.GetData()["post"].(string)
@@ -102,6 +262,7 @@ func (m *MattermostConnector) HandleWebSocketEvent(event *model.WebSocketEvent)
 		var post model.Post
 		err := json.Unmarshal([]byte(postStr), &post)
 		if err != nil {
+			log.Warn().Err(err).Msg("Failed to parse post in websocket event")
 			return
 		}
 
@@ -109,30 +270,25 @@ func (m *MattermostConnector) HandleWebSocketEvent(event *model.WebSocketEvent)
 			MattermostMessageEvent: MattermostMessageEvent{
 				MattermostEvent: MattermostEvent{
 					Connector: m,
+					Server:    server,
 					Timestamp: time.Unix(post.EditAt/1000, (post.EditAt%1000)*1000000),
 					ChannelID: post.ChannelId,
 					UserID:    post.UserId,
-					Username:  m.GetUsername(m.ctx, post.UserId),
+					Username:  m.getServerUsername(ctx, server, post.UserId),
 				},
 				PostID:  post.Id,
 				Content: post.Message,
 				FileIds: post.FileIds,
 				RootID:  post.RootId,
+				Preview: permalinkPreview(&post),
 			},
 		}
-
-		// Find the user login to dispatch the event
-		logins := m.GetUsers()
-		if m.IsMirrorMode() {
-			if len(logins) > 0 {
-				m.Bridge.QueueRemoteEvent(logins[0], evt)
-			}
-		} else {
-			for _, login := range logins {
-				m.Bridge.QueueRemoteEvent(login, evt)
-			}
+		if m.config().ThreadSummaries {
+			evt.Summary = postThreadSummary(&post)
 		}
 
+		m.queueRemoteEvent(evt)
+
 	case model.WebsocketEventPostDeleted:
 		postStr, ok := event.GetData()["post"].(string)
 		if !ok {
@@ -141,31 +297,23 @@ func (m *MattermostConnector) HandleWebSocketEvent(event *model.WebSocketEvent)
 		var post model.Post
 		err := json.Unmarshal([]byte(postStr), &post)
 		if err != nil {
+			log.Warn().Err(err).Msg("Failed to parse post in websocket event")
 			return
 		}
 
 		evt := &MattermostRemoveEvent{
 			MattermostEvent: MattermostEvent{
 				Connector: m,
+				Server:    server,
 				Timestamp: time.Unix(post.DeleteAt/1000, (post.DeleteAt%1000)*1000000),
 				ChannelID: post.ChannelId,
 				UserID:    post.UserId,
-				Username:  m.GetUsername(m.ctx, post.UserId),
+				Username:  m.getServerUsername(ctx, server, post.UserId),
 			},
 			PostID: post.Id,
 		}
 
-		// Find the user login to dispatch the event
-		logins := m.GetUsers()
-		if m.IsMirrorMode() {
-			if len(logins) > 0 {
-				m.Bridge.QueueRemoteEvent(logins[0], evt)
-			}
-		} else {
-			for _, login := range logins {
-				m.Bridge.QueueRemoteEvent(login, evt)
-			}
-		}
+		m.queueRemoteEvent(evt)
 
 	case model.WebsocketEventReactionAdded:
 		reactionStr, ok := event.GetData()["reaction"].(string)
@@ -175,32 +323,31 @@ func (m *MattermostConnector) HandleWebSocketEvent(event *model.WebSocketEvent)
 		var reaction model.Reaction
 		err := json.Unmarshal([]byte(reactionStr), &reaction)
 		if err != nil {
+			log.Warn().Err(err).Msg("Failed to parse reaction in websocket event")
+			return
+		}
+		if !m.isUserMirrored(ctx, reaction.UserId) {
+			return
+		} else if m.isReactionEcho(ctx, reaction.PostId, reaction.UserId, reaction.EmojiName, true) {
+			log.Debug().Str("post_id", reaction.PostId).Str("emoji", reaction.EmojiName).Msg("Ignoring echo of reaction sent from Matrix")
 			return
 		}
 
 		evt := &MattermostReactionEvent{
 			MattermostEvent: MattermostEvent{
 				Connector: m,
+				Server:    server,
 				Timestamp: time.Unix(reaction.CreateAt/1000, (reaction.CreateAt%1000)*1000000),
 				ChannelID: reaction.ChannelId,
 				UserID:    reaction.UserId,
-				Username:  m.GetUsername(m.ctx, reaction.UserId),
+				Username:  m.getServerUsername(ctx, server, reaction.UserId),
 			},
 			PostID:    reaction.PostId,
 			EmojiName: reaction.EmojiName,
 			Added:     true,
 		}
 
-		logins := m.GetUsers()
-		if m.IsMirrorMode() {
-			if len(logins) > 0 {
-				m.Bridge.QueueRemoteEvent(logins[0], evt)
-			}
-		} else {
-			for _, login := range logins {
-				m.Bridge.QueueRemoteEvent(login, evt)
-			}
-		}
+		m.queueRemoteEvent(evt)
 
 	case model.WebsocketEventReactionRemoved:
 		reactionStr, ok := event.GetData()["reaction"].(string)
@@ -210,31 +357,148 @@ func (m *MattermostConnector) HandleWebSocketEvent(event *model.WebSocketEvent)
 		var reaction model.Reaction
 		err := json.Unmarshal([]byte(reactionStr), &reaction)
 		if err != nil {
+			log.Warn().Err(err).Msg("Failed to parse reaction in websocket event")
+			return
+		}
+		if !m.isUserMirrored(ctx, reaction.UserId) {
+			return
+		} else if m.isReactionEcho(ctx, reaction.PostId, reaction.UserId, reaction.EmojiName, false) {
+			log.Debug().Str("post_id", reaction.PostId).Str("emoji", reaction.EmojiName).Msg("Ignoring echo of reaction sent from Matrix")
 			return
 		}
 
 		evt := &MattermostReactionEvent{
 			MattermostEvent: MattermostEvent{
 				Connector: m,
+				Server:    server,
 				Timestamp: time.Now(), // DeleteAt not always available
 				ChannelID: reaction.ChannelId,
 				UserID:    reaction.UserId,
-				Username:  m.GetUsername(m.ctx, reaction.UserId),
+				Username:  m.getServerUsername(ctx, server, reaction.UserId),
 			},
-			PostID:    reaction.PostId,
-			EmojiName: reaction.EmojiName,
-			Added:     false,
+			PostID:         reaction.PostId,
+			EmojiName:      reaction.EmojiName,
+			Added:          false,
+			RemovedEmojiID: m.removedReactionEmojiID(ctx, MakeServerUserID(server, reaction.UserId), reaction.PostId, reaction.EmojiName),
 		}
 
-		logins := m.GetUsers()
-		if m.IsMirrorMode() {
-			if len(logins) > 0 {
-				m.Bridge.QueueRemoteEvent(logins[0], evt)
-			}
-		} else {
-			for _, login := range logins {
-				m.Bridge.QueueRemoteEvent(login, evt)
-			}
+		m.queueRemoteEvent(evt)
+
+	case callStartEvent, callEndEvent:
+		m.handleCallEvent(ctx, server, event)
+
+	case playbookRunCreatedEvent, playbookRunUpdatedEvent:
+		m.handlePlaybookEvent(ctx, server, event)
+
+	case boardsBlockEvent:
+		m.handleBoardsEvent(ctx, server, event)
+
+	case model.WebsocketEventAcknowledgementAdded, model.WebsocketEventAcknowledgementRemoved:
+		ackStr, ok := event.GetData()["acknowledgement"].(string)
+		if !ok {
+			return
+		}
+		var ack model.PostAcknowledgement
+		err := json.Unmarshal([]byte(ackStr), &ack)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to parse acknowledgement in websocket event")
+			return
+		}
+		if !m.isUserMirrored(ctx, ack.UserId) {
+			return
+		}
+		if ack.ChannelId == "" && event.GetBroadcast() != nil {
+			ack.ChannelId = event.GetBroadcast().ChannelId
+		}
+		added := event.EventType() == model.WebsocketEventAcknowledgementAdded
+		timestamp := time.Now()
+		if added {
+			timestamp = time.UnixMilli(ack.AcknowledgedAt)
+		}
+
+		m.queueRemoteEvent(&MattermostAckEvent{MattermostReactionEvent{
+			MattermostEvent: MattermostEvent{
+				Connector: m,
+				Server:    server,
+				Timestamp: timestamp,
+				ChannelID: ack.ChannelId,
+				UserID:    ack.UserId,
+				Username:  m.getServerUsername(ctx, server, ack.UserId),
+			},
+			PostID: ack.PostId,
+			Added:  added,
+		}})
+
+	case model.WebsocketEventChannelUpdated:
+		channelStr, ok := event.GetData()["channel"].(string)
+		if !ok {
+			return
+		}
+		var channel model.Channel
+		err := json.Unmarshal([]byte(channelStr), &channel)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to parse channel in websocket event")
+			return
+		}
+		m.channelCache.invalidate(channel.Id)
+		// DM and group message names are generated from the members
+		if channel.Type == model.ChannelTypeDirect || channel.Type == model.ChannelTypeGroup {
+			return
+		}
+
+		if login := m.serverPortalLogin(networkid.PortalKey{ID: networkid.PortalID(channel.Id)}, server); login != nil {
+			m.queueRemoteEvent(&ChannelSyncEvent{
+				MattermostEvent: MattermostEvent{
+					Connector: m,
+					Server:    server,
+					Timestamp: time.Now(),
+					ChannelID: channel.Id,
+					UserID:    string(login.ID),
+				},
+				Channel: &channel,
+			})
+		}
+
+	case model.WebsocketEventPreferencesChanged, model.WebsocketEventPreferencesDeleted:
+		m.handlePreferencesEvent(ctx, server, event)
+
+	case model.WebsocketEventChannelMemberUpdated:
+		m.handleChannelMemberEvent(ctx, server, event)
+
+	case model.WebsocketEventUserAdded, model.WebsocketEventUserRemoved:
+		m.channelCache.invalidateMembers(eventChannelID(event))
+		m.channelMemberships.invalidate(eventChannelID(event))
+
+	case model.WebsocketEventChannelDeleted, model.WebsocketEventChannelRestored, model.WebsocketEventChannelConverted:
+		m.channelCache.invalidate(eventChannelID(event))
+		m.channelMemberships.invalidate(eventChannelID(event))
+
+	case model.WebsocketEventUpdateTeam:
+		teamStr, ok := event.GetData()["team"].(string)
+		if !ok {
+			return
+		}
+		var team model.Team
+		err := json.Unmarshal([]byte(teamStr), &team)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to parse team in websocket event")
+			return
+		}
+		if !m.mirrorFilters().TeamAllowed(&team) {
+			return
+		}
+
+		if login := m.serverPortalLogin(networkid.PortalKey{ID: networkid.PortalID(team.Id)}, server); login != nil {
+			m.queueRemoteEvent(&TeamSyncEvent{
+				MattermostEvent: MattermostEvent{
+					Connector: m,
+					Server:    server,
+					Timestamp: time.Now(),
+					ChannelID: team.Id,
+					UserID:    string(login.ID),
+				},
+				Team: &team,
+			})
 		}
 
 	case model.WebsocketEventUserUpdated:
@@ -245,22 +509,127 @@ func (m *MattermostConnector) HandleWebSocketEvent(event *model.WebSocketEvent)
 		var user model.User
 		err := json.Unmarshal([]byte(userStr), &user)
 		if err != nil {
+			log.Warn().Err(err).Msg("Failed to parse user in websocket event")
 			return
 		}
+		// The event doesn't contain all fields of the user, so it's fetched again when needed
+		m.userCache.invalidate(user.Id)
 
-		ghost, err := m.Bridge.GetGhostByID(m.ctx, networkid.UserID(user.Username))
+		ghost, err := m.Bridge.GetGhostByID(ctx, MakeServerUserID(server, user.Id))
 		if err == nil && ghost != nil {
-			logins := m.GetUsers()
-			if len(logins) > 0 && logins[0].Client != nil {
-				if api, ok := logins[0].Client.(*MattermostAPI); ok {
-					info, err := api.GetUserInfo(m.ctx, ghost)
+			if login := m.serverLogin(server); login != nil && login.Client != nil {
+				if api, ok := login.Client.(*MattermostAPI); ok {
+					info, err := api.GetUserInfo(ctx, ghost)
 					if err == nil {
-						ghost.UpdateInfo(m.ctx, info)
-						fmt.Printf("INFO: Syncing profile for updated user %s\n", user.Username)
+						ghost.UpdateInfo(ctx, info)
+						log.Info().Str("mm_user_id", user.Id).Str("username", user.Username).Msg("Synced profile for updated user")
 					}
 				}
 			}
 		}
+		if server == "" {
+			m.handleMirrorUserUpdated(ctx, user.Id)
+		}
+
+	}
+}
+
+// eventChannelID returns the channel of an event, from its data or its broadcast
+func eventChannelID(event *model.WebSocketEvent) string {
+	if channelID, ok := event.GetData()["channel_id"].(string); ok && channelID != "" {
+		return channelID
+	} else if broadcast := event.GetBroadcast(); broadcast != nil {
+		return broadcast.ChannelId
+	}
+	return ""
+}
+
+// isPostTypeBridged checks whether posts of a type are bridged. Normal posts and posts of
+// plugins always are, system posts (like joins and header changes) only if their type is
+// listed in system_messages.
+func (m *MattermostConnector) isPostTypeBridged(postType string) bool {
+	if postType == "" || strings.HasPrefix(postType, "custom_") {
+		return true
+	}
+	return slices.Contains(m.config().SystemMessages, postType)
+}
+
+// queuePost queues a post of the main server from the WebSocket or from catching up as a
+// remote event
+func (m *MattermostConnector) queuePost(ctx context.Context, post *model.Post) {
+	m.queueServerPost(ctx, "", post)
+}
 
+// queueServerPost queues a post of a server as a remote event
+func (m *MattermostConnector) queueServerPost(ctx context.Context, server string, post *model.Post) {
+	if !m.ownsChannel(post.ChannelId) {
+		return
+	}
+	log := m.moduleLog(LogModuleWebSocket).With().Str("channel_id", post.ChannelId).Logger()
+	m.recordPost(ctx, post)
+
+	// Discard posts the bridge created itself, like echoes of messages from Matrix
+	// (posts sent by the retry queue may echo back before they've been saved) and
+	// messages sent to Mattermost users directly, as well as ignored posts
+	if reason := m.ignoredPostReason(post); reason != "" {
+		log.Debug().Str("post_id", post.Id).Str("reason", reason).Msg("Ignoring post")
+		return
+	}
+
+	scheduledBy := scheduledPostAuthor(post)
+	if scheduledBy != "" {
+		m.forgetFiredScheduledPost(ctx, post, scheduledBy)
+	}
+
+	// Posts of ghost accounts are only bridged if their Matrix user's double puppet can send
+	// them, otherwise they'd show up on Matrix as a ghost of their own ghost. Posts the user
+	// scheduled from Matrix are sent by the bridge bot instead.
+	var senderLogin networkid.UserLoginID
+	var relayFor id.UserID
+	if mxid, isGhost := m.ghostMXID(ctx, server, post.UserId); isGhost {
+		if senderLogin = m.ghostPostLogin(ctx, mxid); senderLogin == "" {
+			if mxid == "" || mxid != scheduledBy {
+				log.Debug().Str("post_id", post.Id).Stringer("mxid", mxid).Msg("Ignoring post from ghost of Matrix user")
+				return
+			}
+			relayFor = mxid
+		}
+	}
+
+	// Filter out system messages
+	if !m.isPostTypeBridged(post.Type) {
+		return
+	}
+	if !m.isUserMirrored(ctx, post.UserId) {
+		log.Debug().Str("post_id", post.Id).Msg("Ignoring post from user excluded by mirror filters")
+		return
+	}
+
+	evt := &MattermostMessageEvent{
+		MattermostEvent: MattermostEvent{
+			Connector: m,
+			Server:    server,
+			Timestamp: time.Unix(post.CreateAt/1000, (post.CreateAt%1000)*1000000),
+			ChannelID: post.ChannelId,
+			UserID:    post.UserId,
+			Username:  m.getServerUsername(ctx, server, post.UserId),
+			// Set for posts of ghost accounts
+			SenderLogin: senderLogin,
+		},
+		PostID:   post.Id,
+		Content:  post.Message,
+		FileIds:  post.FileIds,
+		RootID:   post.RootId, // Thread root for replies
+		Priority: post.GetPriority(),
+		PostType: post.Type,
+		Preview:  permalinkPreview(post),
+
+		ScheduledBy: relayFor,
+	}
+
+	if !m.queueRemoteEvent(evt) {
+		log.Debug().Str("post_id", post.Id).Msg("No logins to dispatch post to")
+		return
 	}
+	m.queueThreadSummary(server, post)
 }
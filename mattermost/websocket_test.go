@@ -0,0 +1,168 @@
+package mattermost
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost/mmtest"
+)
+
+func newTestWSEvent(eventType model.WebsocketEventType, seq int64, data map[string]any) *model.WebSocketEvent {
+	return model.NewWebSocketEvent(eventType, "", "", "", nil, "").SetSequence(seq).SetData(data)
+}
+
+func TestWSSequence_Track(t *testing.T) {
+	var seq wsSequence
+	hello := newTestWSEvent(model.WebsocketEventHello, 0, map[string]any{"connection_id": "conn1"})
+	assert.Equal(t, wsSequenceOK, seq.track(hello))
+	assert.Equal(t, wsSequenceOK, seq.track(newTestWSEvent(model.WebsocketEventPosted, 1, nil)))
+	assert.Equal(t, wsSequenceOK, seq.track(newTestWSEvent(model.WebsocketEventPosted, 2, nil)))
+
+	connectionID, next := seq.resumeParams()
+	assert.Equal(t, "conn1", connectionID)
+	assert.EqualValues(t, 3, next)
+
+	// Resumed connection replaying an event that was already handled
+	assert.Equal(t, wsSequenceOK, seq.track(hello))
+	assert.Equal(t, wsSequenceDuplicate, seq.track(newTestWSEvent(model.WebsocketEventPosted, 2, nil)))
+	assert.Equal(t, wsSequenceOK, seq.track(newTestWSEvent(model.WebsocketEventPosted, 3, nil)))
+
+	// Skipped sequence numbers
+	assert.Equal(t, wsSequenceGap, seq.track(newTestWSEvent(model.WebsocketEventPosted, 6, nil)))
+	assert.Equal(t, wsSequenceOK, seq.track(newTestWSEvent(model.WebsocketEventPosted, 7, nil)))
+
+	// The server couldn't resume the connection and started a new one
+	newHello := newTestWSEvent(model.WebsocketEventHello, 0, map[string]any{"connection_id": "conn2"})
+	assert.Equal(t, wsSequenceGap, seq.track(newHello))
+	assert.Equal(t, wsSequenceOK, seq.track(newTestWSEvent(model.WebsocketEventPosted, 1, nil)))
+}
+
+func TestMattermostAckEvent_UsesAckEmoji(t *testing.T) {
+	evt := &MattermostAckEvent{MattermostReactionEvent{PostID: "post1", Added: true}}
+	emoji, emojiID := evt.GetReactionEmoji()
+	assert.Equal(t, "✅", emoji)
+	assert.Equal(t, ackEmojiID, emojiID)
+	assert.Equal(t, ackEmojiID, evt.GetRemovedEmojiID())
+	assert.Equal(t, bridgev2.RemoteEventReaction, evt.GetType())
+}
+
+func TestIsPostTypeBridged(t *testing.T) {
+	m := &MattermostConnector{Config: &NetworkConfig{SystemMessages: []string{model.PostTypeJoinChannel}}}
+	assert.True(t, m.isPostTypeBridged(""))
+	assert.True(t, m.isPostTypeBridged("custom_poll"))
+	assert.True(t, m.isPostTypeBridged(model.PostTypeJoinChannel))
+	assert.False(t, m.isPostTypeBridged(model.PostTypeHeaderChange))
+}
+
+func TestEventContext(t *testing.T) {
+	m := &MattermostConnector{}
+	m.ctx, m.stop = context.WithCancel(context.Background())
+
+	ctx, cancel := m.eventContext(zerolog.Nop())
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(webSocketEventTimeout), deadline, time.Second)
+
+	// Stopping the connector cancels the events being handled
+	m.stop()
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+// newTestEventConnector returns a connector using a fake Mattermost server, with a login
+// to queue events for. The queued events are collected instead of being handled.
+func newTestEventConnector(t *testing.T) (*MattermostConnector, *mmtest.Server, *[]bridgev2.RemoteEvent) {
+	server := mmtest.NewServer(t)
+	connector := &MattermostConnector{
+		Config: &NetworkConfig{ServerURL: server.URL},
+		Bridge: &bridgev2.Bridge{DB: newTestBridgeDB(t)},
+		Client: NewClient(server.URL, server.AdminToken),
+		users: map[networkid.UserLoginID]*bridgev2.UserLogin{
+			"admin": {UserLogin: &database.UserLogin{ID: "admin"}},
+		},
+	}
+	var queued []bridgev2.RemoteEvent
+	connector.dispatcher.queue = func(login *bridgev2.UserLogin, evt bridgev2.RemoteEvent) {
+		queued = append(queued, evt)
+	}
+	return connector, server, &queued
+}
+
+// nextWSEvent waits for the next event of a WebSocket client
+func nextWSEvent(t *testing.T, ws *model.WebSocketClient) *model.WebSocketEvent {
+	t.Helper()
+	select {
+	case evt := <-ws.EventChannel:
+		return evt
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for WebSocket event")
+		return nil
+	}
+}
+
+func TestHandleWebSocketEvent(t *testing.T) {
+	ctx := context.Background()
+	connector, server, queued := newTestEventConnector(t)
+	bob := &model.User{Username: "bob"}
+	bobClient := model.NewAPIv4Client(server.URL)
+	bobClient.SetToken(server.AddUser(bob))
+	channel := server.AddChannel(&model.Channel{Name: "town-square"}, bob.Id)
+
+	ws, err := model.NewWebSocketClient4(server.WebSocketURL(), server.AdminToken)
+	require.NoError(t, err)
+	defer ws.Close()
+	ws.Listen()
+	require.Equal(t, model.WebsocketEventHello, nextWSEvent(t, ws).EventType())
+	handleNext := func() bridgev2.RemoteEvent {
+		t.Helper()
+		count := len(*queued)
+		connector.HandleWebSocketEvent(nextWSEvent(t, ws))
+		require.Len(t, *queued, count+1)
+		return (*queued)[count]
+	}
+
+	post, _, err := bobClient.CreatePost(ctx, &model.Post{ChannelId: channel.Id, Message: "hello"})
+	require.NoError(t, err)
+	msg, ok := handleNext().(*MattermostMessageEvent)
+	require.True(t, ok)
+	assert.Equal(t, post.Id, msg.PostID)
+	assert.Equal(t, "hello", msg.Content)
+	assert.Equal(t, bob.Id, msg.UserID)
+	assert.Equal(t, "bob", msg.Username)
+	assert.Equal(t, networkid.PortalID(channel.Id), msg.GetPortalKey().ID)
+
+	_, _, err = bobClient.PatchPost(ctx, post.Id, &model.PostPatch{Message: model.NewPointer("edited")})
+	require.NoError(t, err)
+	edit, ok := handleNext().(*MattermostEditEvent)
+	require.True(t, ok)
+	assert.Equal(t, networkid.MessageID(post.Id), edit.GetTargetMessage())
+	assert.Equal(t, "edited", edit.Content)
+
+	_, _, err = bobClient.SaveReaction(ctx, &model.Reaction{UserId: bob.Id, PostId: post.Id, EmojiName: "thumbsup"})
+	require.NoError(t, err)
+	reaction, ok := handleNext().(*MattermostReactionEvent)
+	require.True(t, ok)
+	assert.True(t, reaction.Added)
+	assert.Equal(t, "thumbsup", reaction.EmojiName)
+	assert.Equal(t, networkid.PortalID(channel.Id), reaction.GetPortalKey().ID)
+
+	_, err = bobClient.DeletePost(ctx, post.Id)
+	require.NoError(t, err)
+	remove, ok := handleNext().(*MattermostRemoveEvent)
+	require.True(t, ok)
+	assert.Equal(t, networkid.MessageID(post.Id), remove.GetTargetMessage())
+
+	// Echoes of messages sent from Matrix aren't bridged back
+	server.CreatePost(&model.Post{ChannelId: channel.Id, UserId: bob.Id, Message: "echo", Props: model.StringInterface{"from_matrix": true}})
+	connector.HandleWebSocketEvent(nextWSEvent(t, ws))
+	assert.Len(t, *queued, 4)
+}
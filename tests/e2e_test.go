@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+
+	"github.com/hanthor/mattermost-matrix-bridge/tests/harness"
+)
+
+// TestE2E_Bridging runs the bridge as an appservice of Synapse and checks the main flows
+// in both directions. Bob only exists on Mattermost, so his posts are sent by his ghost,
+// and Alice is logged in to the bridge, so her Matrix messages are posted as her.
+func TestE2E_Bridging(t *testing.T) {
+	h := harness.New(t, harness.Options{Federation: true})
+	ctx := context.Background()
+
+	mmAlice := h.Mattermost.CreateUser(ctx, t, "alice", false)
+	mmBob := h.Mattermost.CreateUser(ctx, t, "bob", false)
+	channel := h.Mattermost.CreateChannel(ctx, t, "e2e", "town-square-e2e", mmAlice, mmBob)
+
+	alice := h.Synapse.RegisterUser(ctx, t, "alice")
+	h.Bridge.Login(ctx, t, alice.UserID(), mmAlice)
+
+	// The portal is created by the first post the bridge sees in the channel
+	first, _, err := mmBob.Client.CreatePost(ctx, &model.Post{ChannelId: channel.Id, Message: "hello from mattermost"})
+	require.NoError(t, err)
+	portal := alice.WaitForPortal(ctx, t, channel.Id)
+	firstEvt := alice.WaitForMessage(ctx, t, portal, "hello from mattermost")
+
+	t.Run("MatrixToMattermost", func(t *testing.T) {
+		_, err := alice.Client.SendText(ctx, portal, "hello from matrix")
+		require.NoError(t, err)
+		post := h.Mattermost.WaitForPost(ctx, t, channel.Id, func(post *model.Post) bool {
+			return post.Message == "hello from matrix"
+		})
+		assert.Equal(t, mmAlice.Id, post.UserId)
+	})
+
+	t.Run("Edit", func(t *testing.T) {
+		_, _, err := mmBob.Client.PatchPost(ctx, first.Id, &model.PostPatch{Message: model.NewPointer("edited from mattermost")})
+		require.NoError(t, err)
+		alice.WaitForEvent(ctx, t, portal, func(evt *event.Event) bool {
+			content := evt.Content.AsMessage()
+			return evt.Type == event.EventMessage &&
+				content.RelatesTo.GetReplaceID() == firstEvt.ID &&
+				content.NewContent != nil && content.NewContent.Body == "edited from mattermost"
+		})
+	})
+
+	t.Run("Reaction", func(t *testing.T) {
+		_, _, err := mmBob.Client.SaveReaction(ctx, &model.Reaction{UserId: mmBob.Id, PostId: first.Id, EmojiName: "thumbsup"})
+		require.NoError(t, err)
+		alice.WaitForEvent(ctx, t, portal, func(evt *event.Event) bool {
+			return evt.Type == event.EventReaction &&
+				evt.Content.AsReaction().RelatesTo.EventID == firstEvt.ID
+		})
+	})
+
+	t.Run("File", func(t *testing.T) {
+		info, err := mmBob.Client.UploadFile(ctx, []byte("some notes"), channel.Id, "notes.txt")
+		require.NoError(t, err)
+		_, _, err = mmBob.Client.CreatePost(ctx, &model.Post{ChannelId: channel.Id, FileIds: model.StringArray{info.Id}})
+		require.NoError(t, err)
+		evt := alice.WaitForEvent(ctx, t, portal, func(evt *event.Event) bool {
+			return evt.Type == event.EventMessage && evt.Content.AsMessage().Body == "notes.txt"
+		})
+		content := evt.Content.AsMessage()
+		assert.Equal(t, event.MsgFile, content.MsgType)
+		assert.NotEmpty(t, content.URL)
+	})
+
+	t.Run("Thread", func(t *testing.T) {
+		_, _, err := mmBob.Client.CreatePost(ctx, &model.Post{ChannelId: channel.Id, RootId: first.Id, Message: "reply in thread"})
+		require.NoError(t, err)
+		evt := alice.WaitForMessage(ctx, t, portal, "reply in thread")
+		relatesTo := evt.Content.AsMessage().RelatesTo
+		require.NotNil(t, relatesTo)
+		assert.Equal(t, event.RelThread, relatesTo.Type)
+		assert.Equal(t, firstEvt.ID, relatesTo.EventID)
+	})
+
+	t.Run("Federation", func(t *testing.T) {
+		carol := h.Remote.RegisterUser(ctx, t, "carol")
+		_, err := alice.Client.InviteUser(ctx, portal, &mautrix.ReqInviteUser{UserID: carol.UserID()})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			_, err := carol.Client.JoinRoom(ctx, portal.String(), h.Synapse.ServerName, nil)
+			return err == nil
+		}, harness.DefaultTimeout, time.Second, "Remote user couldn't join the portal")
+
+		_, _, err = mmBob.Client.CreatePost(ctx, &model.Post{ChannelId: channel.Id, Message: "hello over federation"})
+		require.NoError(t, err)
+		evt := carol.WaitForMessage(ctx, t, portal, "hello over federation")
+		assert.Equal(t, h.Synapse.ServerName, evt.Sender.Homeserver())
+	})
+}
@@ -0,0 +1,177 @@
+package harness
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/id"
+)
+
+// provisioningPrefix is the prefix of the provisioning API in the bridge config
+const provisioningPrefix = "/_matrix/provision"
+
+// BridgeOptions configures the bridge started by StartBridge
+type BridgeOptions struct {
+	RepoRoot      string
+	Registration  *Registration
+	Synapse       *Synapse
+	Mattermost    *Mattermost
+	NetworkConfig string
+}
+
+// Bridge is the running bridge
+type Bridge struct {
+	Container testcontainers.Container
+	// URL is the appservice address from the host running the tests
+	URL string
+	// provisioningSecret is the shared secret of the provisioning API
+	provisioningSecret string
+}
+
+// bridgeConfig renders the bridge config. Everything that isn't set here comes from the
+// example config, which the bridge fills in when it loads the config.
+func bridgeConfig(opts BridgeOptions, provisioningSecret string) string {
+	cfg := fmt.Sprintf(`homeserver:
+    address: %s
+    domain: %s
+appservice:
+    address: http://%s:%d
+    hostname: 0.0.0.0
+    port: %d
+    id: mattermost
+    bot:
+        username: mattermostbot
+    as_token: %s
+    hs_token: %s
+    username_template: mattermost_{{.}}
+database:
+    type: sqlite3-fk-wal
+    uri: file:/data/mattermost.db?_txlock=immediate
+provisioning:
+    prefix: %s
+    shared_secret: %s
+bridge:
+    permissions:
+        "*": relay
+        %q: admin
+logging:
+    min_level: debug
+    writers:
+        - type: stdout
+          format: pretty
+network:
+    server_url: %s
+    admin_token: %s
+    mode: puppet
+`, opts.Synapse.InternalURL, opts.Registration.ServerName,
+		bridgeAlias, bridgePort, bridgePort,
+		opts.Registration.ASToken, opts.Registration.HSToken,
+		provisioningPrefix, provisioningSecret,
+		opts.Registration.ServerName,
+		opts.Mattermost.InternalURL, opts.Mattermost.Admin.Token)
+	for _, line := range strings.Split(strings.TrimSpace(opts.NetworkConfig), "\n") {
+		if line != "" {
+			cfg += "    " + line + "\n"
+		}
+	}
+	return cfg
+}
+
+// StartBridge builds the bridge image from the repository and starts it as an appservice
+// of the Synapse of the registration
+func StartBridge(ctx context.Context, t *testing.T, nw *testcontainers.DockerNetwork, opts BridgeOptions) *Bridge {
+	t.Helper()
+	t.Log("Building and starting bridge container...")
+	provisioningSecret := randomToken()
+	ctr, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			FromDockerfile: testcontainers.FromDockerfile{
+				Context:   opts.RepoRoot,
+				KeepImage: true,
+			},
+			ExposedPorts:   []string{bridgePortSpec},
+			Networks:       []string{nw.Name},
+			NetworkAliases: map[string][]string{nw.Name: {bridgeAlias}},
+			Files: []testcontainers.ContainerFile{{
+				Reader:            strings.NewReader(bridgeConfig(opts, provisioningSecret)),
+				ContainerFilePath: "/data/config.yaml",
+				FileMode:          0o644,
+			}},
+			WaitingFor: wait.ForHTTP("/_matrix/mau/ready").WithPort(bridgePortSpec).WithStartupTimeout(5 * time.Minute),
+		},
+		Started: true,
+	})
+	testcontainers.CleanupContainer(t, ctr)
+	require.NoError(t, err, "Failed to start bridge")
+
+	host, err := ctr.Host(ctx)
+	require.NoError(t, err)
+	mappedPort, err := ctr.MappedPort(ctx, bridgePortSpec)
+	require.NoError(t, err)
+	br := &Bridge{
+		Container:          ctr,
+		URL:                fmt.Sprintf("http://%s:%s", host, mappedPort.Port()),
+		provisioningSecret: provisioningSecret,
+	}
+	t.Logf("Bridge running at %s", br.URL)
+	return br
+}
+
+// provisioning makes a request to the provisioning API as a Matrix user
+func (br *Bridge) provisioning(ctx context.Context, method, path string, userID id.UserID, body, resp any) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	url := fmt.Sprintf("%s%s%s?user_id=%s", br.URL, provisioningPrefix, path, userID)
+	req, err := http.NewRequestWithContext(ctx, method, url, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+br.provisioningSecret)
+	req.Header.Set("Content-Type", "application/json")
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		var errBody bytes.Buffer
+		_, _ = errBody.ReadFrom(httpResp.Body)
+		return fmt.Errorf("%s %s returned HTTP %d: %s", method, path, httpResp.StatusCode, errBody.String())
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// respLoginStep is a step of a login through the provisioning API
+type respLoginStep struct {
+	LoginID string `json:"login_id"`
+	bridgev2.LoginStep
+}
+
+// Login logs a Matrix user in to Mattermost with the personal access token of a
+// Mattermost user, like the login command does
+func (br *Bridge) Login(ctx context.Context, t *testing.T, userID id.UserID, mmUser *MattermostUser) {
+	t.Helper()
+	var step respLoginStep
+	err := br.provisioning(ctx, http.MethodPost, "/v3/login/start/personal-access-token", userID, nil, &step)
+	require.NoError(t, err, "Failed to start login")
+	require.Equal(t, bridgev2.LoginStepTypeUserInput, step.Type)
+
+	path := fmt.Sprintf("/v3/login/step/%s/%s/user_input", step.LoginID, step.StepID)
+	err = br.provisioning(ctx, http.MethodPost, path, userID, map[string]string{"token": mmUser.Token}, &step)
+	require.NoError(t, err, "Failed to submit token")
+	require.Equal(t, bridgev2.LoginStepTypeComplete, step.Type)
+}
@@ -0,0 +1,125 @@
+// Package harness starts Mattermost, Synapse and the bridge in Docker containers for
+// end-to-end tests of the bridge. The bridge is built from the repository's Dockerfile and
+// runs as a real appservice of Synapse, so tests only talk to it the way users do: through
+// the Mattermost API, the Matrix client-server API and the provisioning API.
+package harness
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/network"
+)
+
+// Defaults used when the options are unset
+const (
+	DefaultServerName       = "local.test"
+	DefaultRemoteServerName = "remote.test"
+	// DefaultTimeout is how long the Wait helpers wait for something to be bridged
+	DefaultTimeout = 30 * time.Second
+)
+
+// Options configures the environment started by New
+type Options struct {
+	// ServerName is the server name of the Synapse the bridge is an appservice of
+	ServerName string
+	// Federation starts a second Synapse, federated with the first one, for tests of rooms
+	// with users of other servers
+	Federation bool
+	// RemoteServerName is the server name of the second Synapse
+	RemoteServerName string
+	// RepoRoot is the directory the bridge image is built from. It's found by looking for
+	// go.mod in the parent directories of the working directory if unset.
+	RepoRoot string
+	// NetworkConfig is added to the network section of the bridge config, after the
+	// Mattermost server URL and admin token
+	NetworkConfig string
+}
+
+// Harness is a running environment. Everything is stopped when the test ends.
+type Harness struct {
+	Network    *testcontainers.DockerNetwork
+	Mattermost *Mattermost
+	Synapse    *Synapse
+	// Remote is the federated Synapse, nil unless Options.Federation is set
+	Remote *Synapse
+	Bridge *Bridge
+}
+
+// New starts Mattermost, Synapse and the bridge, in that order, in a new Docker network.
+// It skips the test in short mode and when Docker isn't available.
+func New(t *testing.T, opts Options) *Harness {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("Skipping end-to-end test in short mode")
+	}
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	if opts.ServerName == "" {
+		opts.ServerName = DefaultServerName
+	}
+	if opts.RemoteServerName == "" {
+		opts.RemoteServerName = DefaultRemoteServerName
+	}
+	if opts.RepoRoot == "" {
+		opts.RepoRoot = findRepoRoot(t)
+	}
+	ctx := context.Background()
+
+	nw, err := network.New(ctx)
+	require.NoError(t, err, "Failed to create Docker network")
+	testcontainers.CleanupNetwork(t, nw)
+	h := &Harness{Network: nw}
+
+	h.Mattermost = StartMattermost(ctx, t, nw)
+	reg := NewRegistration(opts.ServerName)
+	h.Synapse = StartSynapse(ctx, t, nw, SynapseOptions{
+		ServerName:   opts.ServerName,
+		Registration: reg,
+		Federation:   opts.Federation,
+	})
+	if opts.Federation {
+		h.Remote = StartSynapse(ctx, t, nw, SynapseOptions{
+			ServerName: opts.RemoteServerName,
+			Federation: true,
+		})
+	}
+	h.Bridge = StartBridge(ctx, t, nw, BridgeOptions{
+		RepoRoot:      opts.RepoRoot,
+		Registration:  reg,
+		Synapse:       h.Synapse,
+		Mattermost:    h.Mattermost,
+		NetworkConfig: opts.NetworkConfig,
+	})
+	return h
+}
+
+// findRepoRoot returns the closest parent directory of the working directory with a go.mod
+func findRepoRoot(t *testing.T) string {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+	for {
+		if _, err = os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		require.NotEqual(t, dir, parent, "Failed to find the repository root")
+		dir = parent
+	}
+}
+
+// randomToken returns a random hex string for secrets of the environment
+func randomToken() string {
+	data := make([]byte, 24)
+	if _, err := rand.Read(data); err != nil {
+		panic(fmt.Errorf("failed to generate token: %w", err))
+	}
+	return hex.EncodeToString(data)
+}
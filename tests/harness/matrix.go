@@ -0,0 +1,107 @@
+package harness
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// MatrixUser is a logged in Matrix user
+type MatrixUser struct {
+	Client *mautrix.Client
+	// since is the sync token of JoinInvites
+	since string
+}
+
+// UserID returns the ID of the user
+func (u *MatrixUser) UserID() id.UserID {
+	return u.Client.UserID
+}
+
+// JoinInvites joins the rooms the user has been invited to since the last call
+func (u *MatrixUser) JoinInvites(ctx context.Context) error {
+	resp, err := u.Client.SyncRequest(ctx, 0, u.since, "", false, event.PresenceOffline)
+	if err != nil {
+		return err
+	}
+	u.since = resp.NextBatch
+	for roomID := range resp.Rooms.Invite {
+		if _, err = u.Client.JoinRoomByID(ctx, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// portalOf returns the ID of the channel a room is the portal of, or an empty string
+func (u *MatrixUser) portalOf(ctx context.Context, roomID id.RoomID) string {
+	state, err := u.Client.State(ctx, roomID)
+	if err != nil {
+		return ""
+	}
+	for _, evt := range state[event.StateBridge] {
+		if content := evt.Content.AsBridge(); content.Channel.ID != "" {
+			return content.Channel.ID
+		}
+	}
+	return ""
+}
+
+// WaitForPortal joins the rooms the bridge invites the user to until one of them is the
+// portal of a Mattermost channel, and returns it
+func (u *MatrixUser) WaitForPortal(ctx context.Context, t *testing.T, channelID string) id.RoomID {
+	t.Helper()
+	var portal id.RoomID
+	require.Eventually(t, func() bool {
+		if err := u.JoinInvites(ctx); err != nil {
+			return false
+		}
+		rooms, err := u.Client.JoinedRooms(ctx)
+		if err != nil {
+			return false
+		}
+		for _, roomID := range rooms.JoinedRooms {
+			if u.portalOf(ctx, roomID) == channelID {
+				portal = roomID
+				return true
+			}
+		}
+		return false
+	}, 2*DefaultTimeout, time.Second, "Portal of channel %s wasn't created", channelID)
+	return portal
+}
+
+// WaitForEvent waits for an event in a room that matches a condition. The content of the
+// events is parsed before they're passed to it.
+func (u *MatrixUser) WaitForEvent(ctx context.Context, t *testing.T, roomID id.RoomID, match func(*event.Event) bool) *event.Event {
+	t.Helper()
+	var found *event.Event
+	require.Eventually(t, func() bool {
+		resp, err := u.Client.Messages(ctx, roomID, "", "", mautrix.DirectionBackward, nil, 100)
+		if err != nil {
+			return false
+		}
+		for _, evt := range resp.Chunk {
+			_ = evt.Content.ParseRaw(evt.Type)
+			if match(evt) {
+				found = evt
+				return true
+			}
+		}
+		return false
+	}, DefaultTimeout, 500*time.Millisecond, "Event wasn't bridged to Matrix")
+	return found
+}
+
+// WaitForMessage waits for a message with the given text in a room
+func (u *MatrixUser) WaitForMessage(ctx context.Context, t *testing.T, roomID id.RoomID, body string) *event.Event {
+	t.Helper()
+	return u.WaitForEvent(ctx, t, roomID, func(evt *event.Event) bool {
+		return evt.Type == event.EventMessage && evt.Content.AsMessage().Body == body
+	})
+}
@@ -0,0 +1,174 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	tcexec "github.com/testcontainers/testcontainers-go/exec"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/hanthor/mattermost-matrix-bridge/mattermost"
+)
+
+const (
+	mattermostImage = "mattermost/mattermost-preview:latest"
+	mattermostAlias = "mattermost"
+	mattermostPort  = "8065/tcp"
+	mmctlPath       = "/mm/mattermost/bin/mmctl"
+	// mattermostPassword is the password of the users created by the harness
+	mattermostPassword = "TestPass123!"
+)
+
+// tokenPattern finds the token in the output of mmctl token generate
+var tokenPattern = regexp.MustCompile(`([a-z0-9]{26}): `)
+
+// Mattermost is a running Mattermost server with a system admin
+type Mattermost struct {
+	Container testcontainers.Container
+	// URL is the address of the server from the host running the tests
+	URL string
+	// InternalURL is the address of the server from the other containers
+	InternalURL string
+	// Admin is a system admin, whose token the bridge uses as its admin token
+	Admin *MattermostUser
+}
+
+// MattermostUser is a Mattermost user with a personal access token
+type MattermostUser struct {
+	*model.User
+	Token  string
+	Client *mattermost.Client
+}
+
+// StartMattermost starts Mattermost in local mode and creates a system admin
+func StartMattermost(ctx context.Context, t *testing.T, nw *testcontainers.DockerNetwork) *Mattermost {
+	t.Helper()
+	t.Log("Starting Mattermost container...")
+	ctr, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:          mattermostImage,
+			ExposedPorts:   []string{mattermostPort},
+			Networks:       []string{nw.Name},
+			NetworkAliases: map[string][]string{nw.Name: {mattermostAlias}},
+			WaitingFor:     wait.ForHTTP("/api/v4/system/ping").WithPort(mattermostPort).WithStartupTimeout(3 * time.Minute),
+			Env: map[string]string{
+				"MM_SERVICESETTINGS_SITEURL":                    "http://" + mattermostAlias + ":8065",
+				"MM_SERVICESETTINGS_ENABLELOCALMODE":            "true",
+				"MM_SERVICESETTINGS_LOCALMODESOCKETLOCATION":    "/var/tmp/mattermost_local.socket",
+				"MM_SERVICESETTINGS_ENABLEUSERACCESSTOKENS":     "true",
+				"MM_SERVICESETTINGS_ENABLEPOSTUSERNAMEOVERRIDE": "true",
+				"MM_TEAMSETTINGS_ENABLEOPENSERVER":              "true",
+			},
+		},
+		Started: true,
+	})
+	testcontainers.CleanupContainer(t, ctr)
+	require.NoError(t, err, "Failed to start Mattermost")
+
+	host, err := ctr.Host(ctx)
+	require.NoError(t, err)
+	port, err := ctr.MappedPort(ctx, mattermostPort)
+	require.NoError(t, err)
+	mm := &Mattermost{
+		Container:   ctr,
+		URL:         fmt.Sprintf("http://%s:%s", host, port.Port()),
+		InternalURL: "http://" + mattermostAlias + ":8065",
+	}
+	t.Logf("Mattermost running at %s", mm.URL)
+	mm.Admin = mm.CreateUser(ctx, t, "testadmin", true)
+	return mm
+}
+
+// mmctl runs an mmctl command in local mode and returns its output
+func (mm *Mattermost) mmctl(ctx context.Context, args ...string) (string, error) {
+	code, out, err := mm.Container.Exec(ctx, append(append([]string{mmctlPath}, args...), "--local"), tcexec.Multiplexed())
+	if err != nil {
+		return "", err
+	}
+	output, _ := io.ReadAll(out)
+	if code != 0 {
+		return string(output), fmt.Errorf("mmctl %s exited with %d: %s", args[0], code, output)
+	}
+	return string(output), nil
+}
+
+// CreateUser creates a user and a personal access token for them. The local socket may
+// take a moment to be ready after the server is, so the first command is retried.
+func (mm *Mattermost) CreateUser(ctx context.Context, t *testing.T, username string, admin bool) *MattermostUser {
+	t.Helper()
+	args := []string{"user", "create", "--email", username + "@example.com", "--username", username, "--password", mattermostPassword}
+	if admin {
+		args = append(args, "--system-admin")
+	}
+	require.Eventually(t, func() bool {
+		_, err := mm.mmctl(ctx, args...)
+		return err == nil
+	}, time.Minute, 2*time.Second, "Failed to create Mattermost user %s", username)
+
+	out, err := mm.mmctl(ctx, "token", "generate", username, "bridge-test")
+	require.NoError(t, err, "Failed to generate token for %s", username)
+	matches := tokenPattern.FindStringSubmatch(out)
+	require.Len(t, matches, 2, "Could not extract token from output: %q", out)
+
+	client := mattermost.NewClient(mm.URL, matches[1])
+	require.NoError(t, client.Connect(ctx))
+	user, _, err := client.GetMe(ctx, "")
+	require.NoError(t, err)
+	return &MattermostUser{User: user, Token: matches[1], Client: client}
+}
+
+// CreateChannel creates a team if needed and an open channel in it, and adds the users
+// to both
+func (mm *Mattermost) CreateChannel(ctx context.Context, t *testing.T, teamName, channelName string, members ...*MattermostUser) *model.Channel {
+	t.Helper()
+	client := mm.Admin.Client
+	team, _, err := client.GetTeamByName(ctx, teamName, "")
+	if err != nil {
+		team, _, err = client.CreateTeam(ctx, &model.Team{Name: teamName, DisplayName: teamName, Type: model.TeamOpen})
+		require.NoError(t, err, "Failed to create team")
+	}
+	channel, _, err := client.CreateChannel(ctx, &model.Channel{
+		TeamId:      team.Id,
+		Name:        channelName,
+		DisplayName: channelName,
+		Type:        model.ChannelTypeOpen,
+	})
+	require.NoError(t, err, "Failed to create channel")
+	for _, member := range members {
+		if member.Id == mm.Admin.Id {
+			continue
+		}
+		_, _, err = client.AddTeamMember(ctx, team.Id, member.Id)
+		require.NoError(t, err, "Failed to add %s to team", member.Username)
+		_, _, err = client.AddChannelMember(ctx, channel.Id, member.Id)
+		require.NoError(t, err, "Failed to add %s to channel", member.Username)
+	}
+	return channel
+}
+
+// WaitForPost waits for a post in a channel that matches a condition
+func (mm *Mattermost) WaitForPost(ctx context.Context, t *testing.T, channelID string, match func(*model.Post) bool) *model.Post {
+	t.Helper()
+	var found *model.Post
+	require.Eventually(t, func() bool {
+		posts, _, err := mm.Admin.Client.GetPostsForChannel(ctx, channelID, 0, 100, "", false, false)
+		if err != nil {
+			return false
+		}
+		for _, postID := range posts.Order {
+			if post := posts.Posts[postID]; match(post) {
+				found = post
+				return true
+			}
+		}
+		return false
+	}, DefaultTimeout, 500*time.Millisecond, "Post wasn't bridged to Mattermost")
+	return found
+}
@@ -0,0 +1,281 @@
+package harness
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	synapseImage = "matrixdotorg/synapse:latest"
+	synapsePort  = "8008/tcp"
+	// synapseStartCommand generates the signing key before starting Synapse, which the
+	// image's start script would otherwise only do when generating a whole config
+	synapseStartCommand = "python -m synapse.app.homeserver -c /data/homeserver.yaml --generate-keys && " +
+		"exec python -m synapse.app.homeserver -c /data/homeserver.yaml"
+	// bridgeAlias is the address of the bridge in the Docker network
+	bridgeAlias    = "bridge"
+	bridgePort     = 29324
+	bridgePortSpec = "29324/tcp"
+)
+
+// Registration is the appservice registration of the bridge
+type Registration struct {
+	ServerName string
+	ASToken    string
+	HSToken    string
+}
+
+// NewRegistration generates the tokens of a registration for a server
+func NewRegistration(serverName string) *Registration {
+	return &Registration{ServerName: serverName, ASToken: randomToken(), HSToken: randomToken()}
+}
+
+// YAML renders the registration file for Synapse
+func (r *Registration) YAML() string {
+	domain := regexp.QuoteMeta(r.ServerName)
+	return fmt.Sprintf(`id: mattermost
+url: http://%s:%d
+as_token: %s
+hs_token: %s
+sender_localpart: mattermostbot
+rate_limited: false
+namespaces:
+  users:
+    - exclusive: true
+      regex: '^@mattermostbot:%s$'
+    - exclusive: true
+      regex: '^@mattermost_.*:%s$'
+  aliases:
+    - exclusive: true
+      regex: '^#mattermost_.*:%s$'
+  rooms: []
+`, bridgeAlias, bridgePort, r.ASToken, r.HSToken, domain, domain, domain)
+}
+
+// SynapseOptions configures a Synapse started by StartSynapse
+type SynapseOptions struct {
+	ServerName string
+	// Registration is the appservice registration of the bridge, if the bridge uses this server
+	Registration *Registration
+	// Federation makes the server reachable by other servers of the network
+	Federation bool
+}
+
+// Synapse is a running Synapse server
+type Synapse struct {
+	Container  testcontainers.Container
+	ServerName string
+	// URL is the client-server API address from the host running the tests
+	URL string
+	// InternalURL is the client-server API address from the other containers
+	InternalURL string
+	// sharedSecret is the registration shared secret, used to create users
+	sharedSecret string
+}
+
+// homeserverConfig renders the config of a Synapse for tests: SQLite, no rate limits, and
+// with federation, a self-signed certificate that the other servers don't verify
+func homeserverConfig(opts SynapseOptions, sharedSecret string) string {
+	var cfg strings.Builder
+	fmt.Fprintf(&cfg, `server_name: %q
+pid_file: /data/homeserver.pid
+report_stats: false
+database:
+  name: sqlite3
+  args:
+    database: /data/homeserver.db
+media_store_path: /data/media_store
+signing_key_path: /data/signing.key
+registration_shared_secret: %q
+macaroon_secret_key: %q
+form_secret: %q
+enable_registration: false
+trusted_key_servers: []
+suppress_key_server_warning: true
+rc_message: {per_second: 1000, burst_count: 1000}
+rc_registration: {per_second: 1000, burst_count: 1000}
+rc_login:
+  address: {per_second: 1000, burst_count: 1000}
+  account: {per_second: 1000, burst_count: 1000}
+rc_joins:
+  local: {per_second: 1000, burst_count: 1000}
+  remote: {per_second: 1000, burst_count: 1000}
+rc_invites:
+  per_room: {per_second: 1000, burst_count: 1000}
+  per_user: {per_second: 1000, burst_count: 1000}
+listeners:
+  - port: 8008
+    tls: false
+    type: http
+    x_forwarded: true
+    resources:
+      - names: [client, federation]
+`, opts.ServerName, sharedSecret, randomToken(), randomToken())
+	if opts.Federation {
+		// Containers of the network have private addresses, which Synapse refuses to
+		// federate with by default
+		cfg.WriteString(`  - port: 8448
+    tls: true
+    type: http
+    resources:
+      - names: [federation]
+tls_certificate_path: /data/tls.crt
+tls_private_key_path: /data/tls.key
+federation_verify_certificates: false
+ip_range_blocklist: []
+ip_range_blacklist: []
+`)
+	}
+	if opts.Registration != nil {
+		cfg.WriteString("app_service_config_files: [/data/registration.yaml]\n")
+	}
+	return cfg.String()
+}
+
+// selfSignedCert generates a TLS certificate and key for a server name
+func selfSignedCert(serverName string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// StartSynapse starts a Synapse whose network alias is its server name, so that other
+// servers of the network find it on the default federation port
+func StartSynapse(ctx context.Context, t *testing.T, nw *testcontainers.DockerNetwork, opts SynapseOptions) *Synapse {
+	t.Helper()
+	t.Logf("Starting Synapse container for %s...", opts.ServerName)
+	sharedSecret := randomToken()
+	files := []testcontainers.ContainerFile{{
+		Reader:            strings.NewReader(homeserverConfig(opts, sharedSecret)),
+		ContainerFilePath: "/data/homeserver.yaml",
+		FileMode:          0o644,
+	}}
+	if opts.Registration != nil {
+		files = append(files, testcontainers.ContainerFile{
+			Reader:            strings.NewReader(opts.Registration.YAML()),
+			ContainerFilePath: "/data/registration.yaml",
+			FileMode:          0o644,
+		})
+	}
+	if opts.Federation {
+		certPEM, keyPEM, err := selfSignedCert(opts.ServerName)
+		require.NoError(t, err, "Failed to generate TLS certificate")
+		files = append(files,
+			testcontainers.ContainerFile{Reader: bytes.NewReader(certPEM), ContainerFilePath: "/data/tls.crt", FileMode: 0o644},
+			testcontainers.ContainerFile{Reader: bytes.NewReader(keyPEM), ContainerFilePath: "/data/tls.key", FileMode: 0o600},
+		)
+	}
+	ctr, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:          synapseImage,
+			ExposedPorts:   []string{synapsePort},
+			Networks:       []string{nw.Name},
+			NetworkAliases: map[string][]string{nw.Name: {opts.ServerName}},
+			Files:          files,
+			Entrypoint:     []string{"sh", "-c", synapseStartCommand},
+			WaitingFor:     wait.ForHTTP("/health").WithPort(synapsePort).WithStartupTimeout(2 * time.Minute),
+		},
+		Started: true,
+	})
+	testcontainers.CleanupContainer(t, ctr)
+	require.NoError(t, err, "Failed to start Synapse for %s", opts.ServerName)
+
+	host, err := ctr.Host(ctx)
+	require.NoError(t, err)
+	port, err := ctr.MappedPort(ctx, synapsePort)
+	require.NoError(t, err)
+	hs := &Synapse{
+		Container:    ctr,
+		ServerName:   opts.ServerName,
+		URL:          fmt.Sprintf("http://%s:%s", host, port.Port()),
+		InternalURL:  "http://" + opts.ServerName + ":8008",
+		sharedSecret: sharedSecret,
+	}
+	t.Logf("Synapse for %s running at %s", opts.ServerName, hs.URL)
+	return hs
+}
+
+// reqSharedSecretRegister is the body of a request to the shared secret registration API
+type reqSharedSecretRegister struct {
+	Nonce    string `json:"nonce"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Admin    bool   `json:"admin"`
+	MAC      string `json:"mac"`
+}
+
+// RegisterUser creates a user with the shared secret registration API and logs them in
+func (hs *Synapse) RegisterUser(ctx context.Context, t *testing.T, username string) *MatrixUser {
+	t.Helper()
+	client, err := mautrix.NewClient(hs.URL, "", "")
+	require.NoError(t, err)
+	url := client.BuildURL(mautrix.SynapseAdminURLPath{"v1", "register"})
+	var nonce struct {
+		Nonce string `json:"nonce"`
+	}
+	_, err = client.MakeRequest(ctx, http.MethodGet, url, nil, &nonce)
+	require.NoError(t, err, "Failed to get registration nonce")
+
+	password := randomToken()
+	mac := hmac.New(sha1.New, []byte(hs.sharedSecret))
+	mac.Write([]byte(nonce.Nonce + "\x00" + username + "\x00" + password + "\x00notadmin"))
+	var resp mautrix.RespRegister
+	_, err = client.MakeRequest(ctx, http.MethodPost, url, &reqSharedSecretRegister{
+		Nonce:    nonce.Nonce,
+		Username: username,
+		Password: password,
+		MAC:      hex.EncodeToString(mac.Sum(nil)),
+	}, &resp)
+	require.NoError(t, err, "Failed to register %s", username)
+
+	client.UserID = resp.UserID
+	client.AccessToken = resp.AccessToken
+	return &MatrixUser{Client: client}
+}
+
+// UserID returns the ID of a user of the server
+func (hs *Synapse) UserID(localpart string) id.UserID {
+	return id.NewUserID(localpart, hs.ServerName)
+}